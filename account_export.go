@@ -84,14 +84,17 @@ func (s *service) exportGroupContext(ctx context.Context, gc *GroupContext, tw *
 }
 
 func (s *service) exportOrbitDBStore(ctx context.Context, store orbitdb.Store, tw *tar.Writer) error {
-	allCIDs := store.OpLog().GetEntries().Keys()
+	allCIDs, err := storeEntryCIDs(ctx, store, s.odb.logCompaction)
+	if err != nil {
+		return err
+	}
 
 	if len(allCIDs) == 0 {
 		return nil
 	}
 
-	for _, idStr := range allCIDs {
-		if err := s.exportOrbitDBEntry(ctx, tw, idStr); err != nil {
+	for _, id := range allCIDs {
+		if err := s.exportOrbitDBEntry(ctx, tw, id.String()); err != nil {
 			if clErr := tw.Close(); clErr != nil {
 				err = multierr.Append(err, clErr)
 			}
@@ -438,6 +441,12 @@ func RestoreAccountExport(ctx context.Context, reader io.Reader, coreAPI coreifa
 		handlers...,
 	)
 
+	return restoreExport(tr, logger, handlers)
+}
+
+// restoreExport passes each file of the archive to the first handler
+// accepting it, then runs the post-processing functions of the handlers
+func restoreExport(tr *tar.Reader, logger *zap.Logger, handlers []RestoreAccountHandler) error {
 	for {
 		header, err := tr.Next()
 
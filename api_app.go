@@ -4,13 +4,16 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
+	"berty.tech/go-orbit-db/stores/operation"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
 	"berty.tech/weshnet/v2/pkg/tyber"
 )
 
@@ -18,12 +21,16 @@ func (s *service) AppMetadataSend(ctx context.Context, req *protocoltypes.AppMet
 	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Sending app metadata to group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
 	defer func() { endSection(err, "") }()
 
-	gc, err := s.GetContextGroupForID(req.GroupPk)
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
 	}
+	defer release()
+
 	tyberLogGroupContext(ctx, s.logger, gc)
 
+	s.lanes.setTopicPriority(gc.MetadataStore().Address().String(), req.Priority)
+
 	op, err := gc.MetadataStore().SendAppMetadata(ctx, req.Payload)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
@@ -36,18 +43,151 @@ func (s *service) AppMessageSend(ctx context.Context, req *protocoltypes.AppMess
 	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Sending message to group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
 	defer func() { endSection(err, "") }()
 
-	gc, err := s.GetContextGroupForID(req.GroupPk)
+	// the scheduled messages are journaled in the outbox until their time
+	if len(req.ClientMessageId) == 0 && req.Schedule > time.Now().Unix() {
+		id, err := newClientMessageID()
+		if err != nil {
+			return nil, err
+		}
+
+		req = proto.Clone(req).(*protocoltypes.AppMessageSend_Request)
+		req.ClientMessageId = id
+	}
+
+	if len(req.ClientMessageId) > 0 {
+		return s.sendOutboxMessage(ctx, req)
+	}
+
+	id, err := s.sendAppMessage(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.AppMessageSend_Reply{Cid: id}, nil
+}
+
+// sendAppMessage adds the message to the group, it returns its cid
+func (s *service) sendAppMessage(ctx context.Context, req *protocoltypes.AppMessageSend_Request) ([]byte, error) {
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
 	}
+	defer release()
+
 	tyberLogGroupContext(ctx, s.logger, gc)
 
-	op, err := gc.MessageStore().AddMessage(ctx, req.Payload)
+	var secrets []*protocoltypes.AttachmentSecret
+	if len(req.AttachmentCids) > 0 {
+		if secrets, err = s.attachments.secrets(ctx, req.AttachmentCids); err != nil {
+			return nil, err
+		}
+	}
+
+	// the entry is published in the lane of the message
+	s.lanes.setTopicPriority(gc.MessageStore().Address().String(), req.Priority)
+
+	var op operation.Operation
+	if req.ExpireAfter < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the expiry can't be negative"))
+	} else if req.ExpireAfterRead && req.ExpireAfter == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a message deleted once read needs an expiry"))
+	} else if req.ExpireAfter > 0 {
+		op, err = gc.MessageStore().AddExpiringMessage(ctx, req.Payload, req.ThreadId, secrets, time.Duration(req.ExpireAfter)*time.Second, req.ExpireAfterRead)
+	} else if len(secrets) > 0 {
+		op, err = gc.MessageStore().AddMessageWithAttachments(ctx, req.Payload, req.ThreadId, secrets)
+	} else if req.ThreadId != nil {
+		op, err = gc.MessageStore().AddThreadMessage(ctx, req.ThreadId, req.Payload)
+	} else {
+		op, err = gc.MessageStore().AddMessage(ctx, req.Payload)
+	}
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
 
-	return &protocoltypes.AppMessageSend_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
+	// the attachments are deleted with the message once it is pruned
+	if err := s.attachments.record(ctx, req.GroupPk, op.GetEntry().GetHash(), secrets); err != nil {
+		return nil, err
+	}
+
+	return op.GetEntry().GetHash().Bytes(), nil
+}
+
+// AppMessageEdit adds a message replacing the payload of a message sent by
+// the current device
+func (s *service) AppMessageEdit(ctx context.Context, req *protocoltypes.AppMessageEdit_Request) (_ *protocoltypes.AppMessageEdit_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Editing message of group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
+	defer func() { endSection(err, "") }()
+
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	op, err := gc.MessageStore().EditMessage(ctx, req.MessageId, req.Payload)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.AppMessageEdit_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
+}
+
+// AppMessageRetract adds a tombstone deleting a message sent by the current
+// device
+func (s *service) AppMessageRetract(ctx context.Context, req *protocoltypes.AppMessageRetract_Request) (_ *protocoltypes.AppMessageRetract_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Retracting message of group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
+	defer func() { endSection(err, "") }()
+
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	op, err := gc.MessageStore().RetractMessage(ctx, req.MessageId)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.AppMessageRetract_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
+}
+
+func (s *service) AppMessageReact(ctx context.Context, req *protocoltypes.AppMessageReact_Request) (_ *protocoltypes.AppMessageReact_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, fmt.Sprintf("Reacting to message of group %s", base64.RawURLEncoding.EncodeToString(req.GroupPk)))
+	defer func() { endSection(err, "") }()
+
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	op, err := gc.MessageStore().ReactToMessage(ctx, req.MessageId, req.Code, req.Remove)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.AppMessageReact_Reply{Cid: op.GetEntry().GetHash().Bytes()}, nil
+}
+
+func (s *service) MessageReactionList(ctx context.Context, req *protocoltypes.MessageReactionList_Request) (*protocoltypes.MessageReactionList_Reply, error) {
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	memberPK, err := gc.MemberPubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	messages, err := s.reactions.list(ctx, req.GroupPk, req.MessageIds, memberPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.MessageReactionList_Reply{Messages: messages}, nil
 }
 
 // OutOfStoreReceive parses a payload received outside a synchronized store
@@ -65,12 +205,43 @@ func (s *service) OutOfStoreReceive(ctx context.Context, request *protocoltypes.
 	}, nil
 }
 
+// OutOfStoreReceiveBatch parses several payloads received outside a synchronized store at once
+func (s *service) OutOfStoreReceiveBatch(ctx context.Context, request *protocoltypes.OutOfStoreReceiveBatch_Request) (*protocoltypes.OutOfStoreReceiveBatch_Reply, error) {
+	return outOfStoreReceiveBatch(ctx, s.secretStore, request.Payloads), nil
+}
+
+func outOfStoreReceiveBatch(ctx context.Context, secretStore secretstore.SecretStore, payloads [][]byte) *protocoltypes.OutOfStoreReceiveBatch_Reply {
+	opened := secretStore.OpenOutOfStoreMessages(ctx, payloads)
+	results := make([]*protocoltypes.OutOfStoreReceiveBatch_Result, len(opened))
+
+	for i, msg := range opened {
+		if msg.Err != nil {
+			results[i] = &protocoltypes.OutOfStoreReceiveBatch_Result{
+				Error: errcode.ErrCode_ErrCryptoDecrypt.Wrap(msg.Err).Error(),
+			}
+			continue
+		}
+
+		results[i] = &protocoltypes.OutOfStoreReceiveBatch_Result{
+			Reply: &protocoltypes.OutOfStoreReceive_Reply{
+				Message:         msg.Message,
+				Cleartext:       msg.ClearPayload,
+				GroupPublicKey:  msg.Group.PublicKey,
+				AlreadyReceived: msg.AlreadyDecrypted,
+			},
+		}
+	}
+
+	return &protocoltypes.OutOfStoreReceiveBatch_Reply{Results: results}
+}
+
 // OutOfStoreSeal creates a payload of a message present in store to be sent outside a synchronized store
 func (s *service) OutOfStoreSeal(ctx context.Context, request *protocoltypes.OutOfStoreSeal_Request) (*protocoltypes.OutOfStoreSeal_Reply, error) {
-	gc, err := s.GetContextGroupForID(request.GroupPublicKey)
+	gc, release, err := s.retainContextGroupForID(request.GroupPublicKey)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
 	_, c, err := cid.CidFromBytes(request.Cid)
 	if err != nil {
@@ -104,3 +275,63 @@ func tyberLogGroupContext(ctx context.Context, logger *zap.Logger, gc *GroupCont
 		{Name: "MemberPK", Description: base64.RawURLEncoding.EncodeToString(memberPK)},
 	})...)
 }
+
+// SendStatusWatch sends the status of the messages sent with a client message
+// id then its changes
+func (s *service) SendStatusWatch(req *protocoltypes.SendStatusWatch_Request, sub protocoltypes.ProtocolService_SendStatusWatchServer) error {
+	sent := map[string]*protocoltypes.SendStatusWatch_Reply{}
+	for {
+		messages, version, err := s.outbox.status(sub.Context(), req.ClientMessageIds)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			reply := &protocoltypes.SendStatusWatch_Reply{
+				ClientMessageId: msg.ClientMessageId,
+				GroupPk:         msg.GroupPk,
+				Status:          msg.Status,
+				Cid:             msg.Cid,
+				Attempts:        msg.Attempts,
+				LastError:       msg.LastError,
+				ScheduledAt:     msg.ScheduledAt,
+			}
+
+			if previous, ok := sent[string(msg.ClientMessageId)]; ok && proto.Equal(previous, reply) {
+				continue
+			}
+
+			if err := sub.Send(reply); err != nil {
+				return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+			}
+
+			sent[string(msg.ClientMessageId)] = reply
+		}
+
+		s.outbox.waitForChange(sub.Context(), version)
+		if sub.Context().Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *service) ScheduledMessageList(ctx context.Context, req *protocoltypes.ScheduledMessageList_Request) (*protocoltypes.ScheduledMessageList_Reply, error) {
+	messages, err := s.outbox.scheduled(ctx, req.GroupPk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ScheduledMessageList_Reply{Messages: messages}, nil
+}
+
+func (s *service) ScheduledMessageCancel(ctx context.Context, req *protocoltypes.ScheduledMessageCancel_Request) (*protocoltypes.ScheduledMessageCancel_Reply, error) {
+	if len(req.ClientMessageId) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing client message id"))
+	}
+
+	if err := s.cancelScheduledMessage(ctx, req.ClientMessageId); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ScheduledMessageCancel_Reply{}, nil
+}
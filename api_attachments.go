@@ -0,0 +1,110 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// AttachmentPrepare stores a file as encrypted chunks, the returned cid can
+// be attached to messages
+func (s *service) AttachmentPrepare(server protocoltypes.ProtocolService_AttachmentPrepareServer) (err error) {
+	ctx, _, endSection := tyber.Section(server.Context(), s.logger, "Preparing attachment")
+	defer func() { endSection(err, "") }()
+
+	var w *attachmentWriter
+	for {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		// the options are read from the first request
+		if w == nil {
+			if w, err = s.attachments.newWriter(ctx, req.Deduplicate); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(req.Block); err != nil {
+			return err
+		}
+	}
+
+	if w == nil {
+		if w, err = s.attachments.newWriter(ctx, false); err != nil {
+			return err
+		}
+	}
+
+	id, err := w.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := server.SendAndClose(&protocoltypes.AttachmentPrepare_Reply{AttachmentCid: id.Bytes()}); err != nil {
+		return errcode.ErrCode_ErrStreamSendAndClose.Wrap(err)
+	}
+
+	return nil
+}
+
+// AttachmentRetrieve sends the decrypted chunks of a file prepared locally or
+// attached to a received message, starting from the requested offset
+func (s *service) AttachmentRetrieve(req *protocoltypes.AttachmentRetrieve_Request, server protocoltypes.ProtocolService_AttachmentRetrieveServer) error {
+	return s.attachments.retrieve(server.Context(), req.AttachmentCid, req.Offset, func(block []byte) error {
+		if err := server.Send(&protocoltypes.AttachmentRetrieve_Reply{Block: block}); err != nil {
+			return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+		}
+
+		return nil
+	})
+}
+
+// AttachmentTransferStart fetches the chunks of an attachment in the
+// background, the transfer is resumed on the next start of the service if it
+// is interrupted
+func (s *service) AttachmentTransferStart(_ context.Context, req *protocoltypes.AttachmentTransferStart_Request) (*protocoltypes.AttachmentTransferStart_Reply, error) {
+	if err := s.attachments.startTransfer(s.ctx, req.AttachmentCid); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.AttachmentTransferStart_Reply{}, nil
+}
+
+// AttachmentTransferWatch sends the progress of the transfer of an attachment
+// then its changes, the stream ends once the transfer is completed
+func (s *service) AttachmentTransferWatch(req *protocoltypes.AttachmentTransferWatch_Request, sub protocoltypes.ProtocolService_AttachmentTransferWatchServer) error {
+	var sent *protocoltypes.AttachmentTransfer
+	for {
+		transfer, version, err := s.attachments.transferStatus(sub.Context(), req.AttachmentCid)
+		if err != nil {
+			return err
+		} else if transfer == nil {
+			return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no transfer for this attachment"))
+		}
+
+		if sent == nil || sent.TransferredBytes != transfer.TransferredBytes || sent.ChunkCount != transfer.ChunkCount || sent.Completed != transfer.Completed {
+			if err := sub.Send(&protocoltypes.AttachmentTransferWatch_Reply{Transfer: transfer}); err != nil {
+				return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+			}
+
+			sent = transfer
+		}
+
+		if transfer.Completed {
+			return nil
+		}
+
+		s.attachments.waitForChange(sub.Context(), version)
+		if sub.Context().Err() != nil {
+			return nil
+		}
+	}
+}
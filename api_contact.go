@@ -1,13 +1,19 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/tyber"
 )
@@ -16,10 +22,11 @@ func (s *service) ContactAliasKeySend(ctx context.Context, req *protocoltypes.Co
 	ctx, _, endSection := tyber.Section(ctx, s.logger, "Sending contact alias key")
 	defer func() { endSection(err, "") }()
 
-	g, err := s.GetContextGroupForID(req.GroupPk)
+	g, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMissing.Wrap(err)
 	}
+	defer release()
 
 	if _, err := g.MetadataStore().ContactSendAliasKey(ctx); err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
@@ -41,6 +48,11 @@ func (s *service) ContactBlock(ctx context.Context, req *protocoltypes.ContactBl
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
 
+	// stop replicating and announcing the contact group
+	if err := s.setContactGroupBlocked(ctx, pk, true); err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
 	return &protocoltypes.ContactBlock_Reply{}, nil
 }
 
@@ -57,9 +69,520 @@ func (s *service) ContactUnblock(ctx context.Context, req *protocoltypes.Contact
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
 
+	// replicate the contact group again
+	if err := s.setContactGroupBlocked(ctx, pk, false); err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
 	return &protocoltypes.ContactUnblock_Reply{}, nil
 }
 
+// ContactSetMetadata attaches private metadata to a contact, the metadata is
+// synced across the devices of the account
+func (s *service) ContactSetMetadata(ctx context.Context, req *protocoltypes.ContactSetMetadata_Request) (_ *protocoltypes.ContactSetMetadata_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting contact metadata")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactSetMetadata(ctx, pk, req.Metadata); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.ContactSetMetadata_Reply{}, nil
+}
+
+// ContactGetMetadata retrieves the private metadata attached to a contact
+func (s *service) ContactGetMetadata(_ context.Context, req *protocoltypes.ContactGetMetadata_Request) (*protocoltypes.ContactGetMetadata_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	metadata, err := accountGroup.MetadataStore().GetContactMetadata(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ContactGetMetadata_Reply{Metadata: metadata}, nil
+}
+
+// ContactDelete removes a contact from the account then closes its contact
+// group and deletes the local data and keys of the group. An added contact is
+// notified on the contact group first, the notification reaches its devices
+// once replicated, from a connected device or from the replication servers of
+// the group.
+func (s *service) ContactDelete(ctx context.Context, req *protocoltypes.ContactDelete_Request) (_ *protocoltypes.ContactDelete_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Deleting contact")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	metadataStore := accountGroup.MetadataStore()
+
+	// the contact group only has data once the contact has been added
+	added := metadataStore.checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded)
+
+	if added {
+		if err := s.notifyContactRemoved(ctx, pk); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := metadataStore.ContactDelete(ctx, pk); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	group, err := s.secretStore.GetGroupForContact(pk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	groupPK, err := group.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if !added {
+		if err := s.deactivateGroup(groupPK); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		return &protocoltypes.ContactDelete_Reply{}, nil
+	}
+
+	if _, err := s.purgeGroupLocalData(ctx, groupPK); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ContactDelete_Reply{}, nil
+}
+
+// notifyContactRemoved tells the contact, on the contact group, that it has
+// been deleted from the contacts of the account
+func (s *service) notifyContactRemoved(ctx context.Context, contactPK crypto.PubKey) error {
+	group, err := s.getContactGroup(contactPK)
+	if err != nil {
+		return err
+	}
+
+	cg, release, err := s.retainContextGroupForID(group.PublicKey)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().ContactRemove(ctx); err != nil {
+		return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// ContactVerificationInfo retrieves the safety number of a contact, derived
+// from the keys of both accounts
+func (s *service) ContactVerificationInfo(_ context.Context, req *protocoltypes.ContactVerificationInfo_Request) (*protocoltypes.ContactVerificationInfo_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	ownPK, err := accountGroup.MemberPubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	verification, err := accountGroup.MetadataStore().GetContactVerification(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	safetyNumber, payload := contactSafetyNumber(ownPK, req.ContactPk)
+
+	return &protocoltypes.ContactVerificationInfo_Reply{
+		SafetyNumber: safetyNumber,
+		QrPayload:    payload,
+		Verified:     bytes.Equal(verification, payload),
+	}, nil
+}
+
+// ContactMarkVerified marks a contact as verified with its current keys, or
+// clears its verification
+func (s *service) ContactMarkVerified(ctx context.Context, req *protocoltypes.ContactMarkVerified_Request) (_ *protocoltypes.ContactMarkVerified_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Marking contact as verified")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	fingerprint := []byte(nil)
+	if !req.Unverified {
+		ownPK, err := accountGroup.MemberPubKey().Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		_, fingerprint = contactSafetyNumber(ownPK, req.ContactPk)
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactMarkVerified(ctx, pk, fingerprint); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.ContactMarkVerified_Reply{}, nil
+}
+
+// ContactResetSession renegotiates the chain keys of the contact group with a
+// fresh handshake with a connected device of the contact, the contact and the
+// message history are kept. The reset is then recorded in the contact group so
+// the other devices of both accounts rotate their chain keys too.
+func (s *service) ContactResetSession(ctx context.Context, req *protocoltypes.ContactResetSession_Request) (_ *protocoltypes.ContactResetSession_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Resetting contact session")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.ContactPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if !accountGroup.MetadataStore().checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("contact not added"))
+	}
+
+	group, err := s.getContactGroup(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.host == nil {
+		return nil, errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("session reset requires a libp2p host"))
+	}
+
+	cg, release, err := s.retainContextGroupForID(group.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	peers := s.contactSessionResetPeers(cg, pk)
+	if len(peers) == 0 {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no device of the contact connected"))
+	}
+
+	err = errcode.ErrCode_ErrNotFound
+	for p, devicePK := range peers {
+		if err = s.resetContactSession(ctx, cg, pk, p); err == nil {
+			break
+		}
+
+		s.logger.Warn("unable to reset session", logutil.PrivateBinary("device", devicePK), zap.Error(err))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cg.MetadataStore().ContactResetSession(ctx); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.ContactResetSession_Reply{}, nil
+}
+
+// ContactReintroductionProofCreate creates, on the new account of the user,
+// the proof that it is replacing the given previous account
+func (s *service) ContactReintroductionProofCreate(ctx context.Context, req *protocoltypes.ContactReintroductionProofCreate_Request) (_ *protocoltypes.ContactReintroductionProofCreate_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Creating contact reintroduction proof")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	member, err := accountGroup.MemberPubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// the contacts will send their requests to the new account, using its
+	// current rendezvous seed if contact requests are enabled, the contact
+	// request settings are left untouched
+	newContact := &protocoltypes.ShareableContact{
+		Pk:                    member,
+		ProofOfWorkDifficulty: accountGroup.MetadataStore().GetContactRequestPolicy().ProofOfWorkDifficulty,
+	}
+
+	if enabled, own := accountGroup.MetadataStore().GetIncomingContactRequestsStatus(); enabled && own != nil {
+		newContact.PublicRendezvousSeed = own.PublicRendezvousSeed
+	}
+
+	accountPrivateKey, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	proof, err := signContactReintroductionNewAccount(accountPrivateKey, req.OldAccountPk, newContact)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ContactReintroductionProofCreate_Reply{
+		Proof: proof,
+	}, nil
+}
+
+// ContactReintroduce signs a proof created by the new account of the user and
+// sends it to the contact groups of the current account
+func (s *service) ContactReintroduce(ctx context.Context, req *protocoltypes.ContactReintroduce_Request) (_ *protocoltypes.ContactReintroduce_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Reintroducing account to contacts")
+	defer func() { endSection(err, "") }()
+
+	if req.Proof == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing proof"))
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	accountPrivateKey, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	proof := proto.Clone(req.Proof).(*protocoltypes.ContactReintroductionProof)
+	if err := signContactReintroductionOldAccount(accountPrivateKey, proof); err != nil {
+		return nil, err
+	}
+
+	contactPKs := req.ContactPks
+	if len(contactPKs) == 0 {
+		for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+			contactPKs = append(contactPKs, contact.Pk)
+		}
+	}
+
+	for _, contactPK := range contactPKs {
+		pk, err := crypto.UnmarshalEd25519PublicKey(contactPK)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		group, err := s.getContactGroup(pk)
+		if err != nil {
+			return nil, err
+		}
+
+		cg, release, err := s.retainContextGroupForID(group.PublicKey)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+		}
+		defer release()
+
+		if _, err := cg.MetadataStore().ContactReintroduce(ctx, proof); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	return &protocoltypes.ContactReintroduce_Reply{}, nil
+}
+
+// ContactIntroduce introduces two contacts of the account to each other, each
+// of them receives the signed introduction of the other one on its contact
+// group
+func (s *service) ContactIntroduce(ctx context.Context, req *protocoltypes.ContactIntroduce_Request) (_ *protocoltypes.ContactIntroduce_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Introducing contacts")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	contacts := accountGroup.MetadataStore().ListContacts()
+	introduced := make([]*protocoltypes.ShareableContact, 2)
+	for i, pk := range [][]byte{req.ContactPk, req.OtherContactPk} {
+		contact, ok := contacts[string(pk)]
+		if !ok || contact.state != protocoltypes.ContactState_ContactStateAdded {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown contact"))
+		}
+
+		introduced[i] = contact.contact
+	}
+
+	accountPrivateKey, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	for i, recipient := range introduced {
+		introduction, err := signContactIntroduction(accountPrivateKey, recipient.Pk, introduced[1-i], time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		pk, err := recipient.GetPubKey()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		group, err := s.getContactGroup(pk)
+		if err != nil {
+			return nil, err
+		}
+
+		cg, release, err := s.retainContextGroupForID(group.PublicKey)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+		}
+		defer release()
+
+		if _, err := cg.MetadataStore().ContactIntroductionSend(ctx, introduction); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	return &protocoltypes.ContactIntroduce_Reply{}, nil
+}
+
+// ContactIntroductionAccept accepts an introduction sent by a contact, a
+// contact request is sent to the introduced account, or accepted if the
+// introduced account has already sent one
+func (s *service) ContactIntroductionAccept(ctx context.Context, req *protocoltypes.ContactIntroductionAccept_Request) (_ *protocoltypes.ContactIntroductionAccept_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Accepting contact introduction")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if err := verifyContactIntroduction(req.Introduction); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	introduced := req.Introduction.Introduced
+
+	pk, err := introduced.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if accountGroup.MetadataStore().checkContactStatus(pk, protocoltypes.ContactState_ContactStateBlocked) {
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactIntroductionAccept(ctx, req.Introduction); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	switch {
+	case accountGroup.MetadataStore().checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded):
+
+	case accountGroup.MetadataStore().checkContactStatus(pk, protocoltypes.ContactState_ContactStateReceived):
+		if _, err := s.ContactRequestAccept(ctx, &protocoltypes.ContactRequestAccept_Request{ContactPk: introduced.Pk}); err != nil {
+			return nil, err
+		}
+
+	default:
+		if _, err := accountGroup.MetadataStore().ContactRequestOutgoingEnqueue(ctx, introduced, req.OwnMetadata); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	return &protocoltypes.ContactIntroductionAccept_Reply{}, nil
+}
+
+// ContactList streams the contacts of the account matching the requested
+// states, then their changes in follow mode
+func (s *service) ContactList(req *protocoltypes.ContactList_Request, sub protocoltypes.ProtocolService_ContactListServer) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	metadataStore := accountGroup.MetadataStore()
+
+	// subscribe before listing the contacts to avoid missing a change
+	var evtSub event.Subscription
+	if req.Follow {
+		var err error
+		evtSub, err = metadataStore.EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/api/contact-list"), eventbus.BufSize(32))
+		if err != nil {
+			return fmt.Errorf("unable to subscribe to new events")
+		}
+		defer evtSub.Close()
+	}
+
+	listed := filterContacts(metadataStore.ListContacts(), req.States)
+	for _, reply := range pageContacts(listed, req.Offset, req.Limit) {
+		if err := sub.Send(reply); err != nil {
+			return err
+		}
+	}
+
+	if !req.Follow {
+		return nil
+	}
+
+	for {
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case <-evtSub.Out():
+		}
+
+		contacts := metadataStore.ListContacts()
+		for _, reply := range diffContactList(listed, contacts, req.States) {
+			if err := sub.Send(reply); err != nil {
+				return err
+			}
+		}
+
+		listed = filterContacts(contacts, req.States)
+	}
+}
+
 func (s *service) RefreshContactRequest(ctx context.Context, req *protocoltypes.RefreshContactRequest_Request) (*protocoltypes.RefreshContactRequest_Reply, error) {
 	if len(req.ContactPk) == 0 {
 		return nil, errcode.ErrCode_ErrInternal
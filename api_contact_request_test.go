@@ -49,4 +49,17 @@ func TestShareContact(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, contact.Contact.Pk, config.AccountPk)
 	require.Equal(t, contact.Contact.PublicRendezvousSeed, contactRequestRef.PublicRendezvousSeed)
+	require.Equal(t, uint32(protocoltypes.ShareableContactEnvelopeVersion), contact.Version)
+	require.Equal(t, uint32(ProtocolEpoch), contact.Capabilities.ProtocolEpoch)
+
+	// the legacy encoding is still supported
+	legacyContact, err := pts[0].Client.ShareContact(ctx, &protocoltypes.ShareContact_Request{LegacyEncoding: true})
+	require.NoError(t, err)
+
+	contact, err = pts[0].Client.DecodeContact(ctx, &protocoltypes.DecodeContact_Request{
+		EncodedContact: legacyContact.EncodedContact,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), contact.Version)
+	require.Equal(t, config.AccountPk, contact.Contact.Pk)
 }
@@ -2,6 +2,8 @@ package weshnet
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"google.golang.org/protobuf/proto"
@@ -177,10 +179,45 @@ func (s *service) ContactRequestDiscard(ctx context.Context, req *protocoltypes.
 	return &protocoltypes.ContactRequestDiscard_Reply{}, nil
 }
 
+// ContactRequestPolicySet sets the policy applied to incoming contact requests
+func (s *service) ContactRequestPolicySet(ctx context.Context, req *protocoltypes.ContactRequestPolicySet_Request) (_ *protocoltypes.ContactRequestPolicySet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting contact request policy")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().ContactRequestPolicySet(ctx, req.Policy); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.ContactRequestPolicySet_Reply{}, nil
+}
+
+// ContactRequestPolicyGet retrieves the policy applied to incoming contact requests
+func (s *service) ContactRequestPolicyGet(context.Context, *protocoltypes.ContactRequestPolicyGet_Request) (*protocoltypes.ContactRequestPolicyGet_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	return &protocoltypes.ContactRequestPolicyGet_Reply{
+		Policy: accountGroup.MetadataStore().GetContactRequestPolicy(),
+	}, nil
+}
+
 // ShareContact uses ContactRequestReference to get the contact information for the current account and
 // returns the Protobuf encoding which you can further encode and share. If needed, his will reset the
-// contact request reference and enable contact requests.
-func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContact_Request) (_ *protocoltypes.ShareContact_Reply, err error) {
+// contact request reference and enable contact requests. If an expiry or a single use is requested, the
+// shared contact embeds a nonce registered on the account group and is rejected once no longer valid, its
+// rendezvous seed is derived for the link and only announced while the link is valid.
+func (s *service) ShareContact(ctx context.Context, req *protocoltypes.ShareContact_Request) (_ *protocoltypes.ShareContact_Reply, err error) {
+	if req.ExpiresIn < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid expiry"))
+	}
+
 	accountGroup := s.getAccountGroup()
 	if accountGroup == nil {
 		return nil, errcode.ErrCode_ErrGroupMissing
@@ -218,12 +255,36 @@ func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContac
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	encodedContact, err := proto.Marshal(&protocoltypes.ShareableContact{
-		Pk:                   member,
-		PublicRendezvousSeed: rdvSeed,
-	})
+	contact := &protocoltypes.ShareableContact{
+		Pk:                    member,
+		PublicRendezvousSeed:  rdvSeed,
+		ProofOfWorkDifficulty: accountGroup.MetadataStore().GetContactRequestPolicy().ProofOfWorkDifficulty,
+	}
+
+	if req.ExpiresIn > 0 || req.SingleUse {
+		if req.ExpiresIn > 0 {
+			contact.ExpiresAt = time.Now().Unix() + req.ExpiresIn
+		}
+
+		if contact.Nonce, err = genNewSeed(); err != nil {
+			return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		}
+
+		contact.PublicRendezvousSeed = contactRequestLinkSeed(rdvSeed, contact.Nonce)
+
+		if _, err := accountGroup.MetadataStore().ContactRequestNonceRegister(ctx, contact.Nonce, contact.ExpiresAt, req.SingleUse); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	var encodedContact []byte
+	if req.LegacyEncoding {
+		encodedContact, err = proto.Marshal(contact)
+	} else {
+		encodedContact, err = protocoltypes.EncodeShareableContact(contact, s.shareableContactCapabilities())
+	}
 	if err != nil {
-		return nil, err
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
 	return &protocoltypes.ShareContact_Reply{
@@ -231,14 +292,48 @@ func (s *service) ShareContact(ctx context.Context, _ *protocoltypes.ShareContac
 	}, nil
 }
 
-// DecodeContact decodes the Protobuf encoding of a shareable contact which was returned by ShareContact.
+// shareableContactCapabilities returns the capabilities of the device
+// advertised in the shared contacts
+func (s *service) shareableContactCapabilities() *protocoltypes.ShareableContactCapabilities {
+	capabilities := &protocoltypes.ShareableContactCapabilities{
+		ProtocolEpoch: ProtocolEpoch,
+	}
+
+	if s.host == nil {
+		return capabilities
+	}
+
+	// the transport of an address is its last protocol, ie. tcp or quic-v1
+	transports := map[string]struct{}{}
+	for _, addr := range s.host.Addrs() {
+		transport := ""
+		for _, p := range addr.Protocols() {
+			if p.Name != "p2p" && p.Name != "certhash" {
+				transport = p.Name
+			}
+		}
+
+		if _, ok := transports[transport]; ok || transport == "" {
+			continue
+		}
+
+		transports[transport] = struct{}{}
+		capabilities.Transports = append(capabilities.Transports, transport)
+	}
+
+	return capabilities
+}
+
+// DecodeContact decodes the encoding of a shareable contact which was returned by ShareContact.
 func (s *service) DecodeContact(_ context.Context, req *protocoltypes.DecodeContact_Request) (_ *protocoltypes.DecodeContact_Reply, err error) {
-	contact := &protocoltypes.ShareableContact{}
-	if err := proto.Unmarshal(req.EncodedContact, contact); err != nil {
-		panic(err)
+	envelope, err := protocoltypes.DecodeShareableContact(req.EncodedContact)
+	if err != nil {
+		return nil, err
 	}
 
 	return &protocoltypes.DecodeContact_Reply{
-		Contact: contact,
+		Contact:      envelope.Contact,
+		Version:      envelope.Version,
+		Capabilities: envelope.Capabilities,
 	}, nil
 }
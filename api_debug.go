@@ -69,10 +69,11 @@ func (s *service) DebugInspectGroupStore(req *protocoltypes.DebugInspectGroupSto
 		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid log type specified"))
 	}
 
-	cg, err := s.GetContextGroupForID(req.GroupPk)
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
+	defer release()
 
 	switch req.LogType {
 	case protocoltypes.DebugInspectGroupLogType_DebugInspectGroupLogTypeMessage:
@@ -117,7 +118,7 @@ func (s *service) DebugInspectGroupStore(req *protocoltypes.DebugInspectGroupSto
 
 			if op, err := operation.ParseOperation(e); err != nil {
 				s.logger.Error("unable to parse operation", zap.Error(err))
-			} else if meta, event, err := openGroupEnvelope(cg.group, op.GetValue()); err != nil {
+			} else if meta, event, err := openGroupEnvelope(srv.Context(), cg.group, s.secretStore, op.GetValue()); err != nil {
 				s.logger.Error("unable to open group envelope", zap.Error(err))
 			} else if metaEvent, err := newGroupMetadataEventFromEntry(log, e, meta, event, cg.group); err != nil {
 				s.logger.Error("unable to get group metadata event from entry", zap.Error(err))
@@ -173,6 +174,30 @@ func (s *service) DebugGroup(ctx context.Context, request *protocoltypes.DebugGr
 		}
 	}
 
+	cg, err := s.getOpenedGroup(request.GroupPk)
+	if err != nil {
+		return rep, nil
+	}
+
+	rep.Epoch = cg.MetadataStore().GetEpoch()
+
+	if tip := cg.MetadataStore().Index().(*metadataStoreIndex).getEpochTip(); tip != nil {
+		rep.EpochCommitId = tip.id.Bytes()
+		rep.EpochTreeSize = uint32(tip.tree.Size())
+	}
+
+	keys, err := s.secretStore.ExportGroupKeys(ctx, cg.Group(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys.ChainKeys {
+		rep.DeviceEpochs = append(rep.DeviceEpochs, &protocoltypes.DebugGroup_DeviceEpoch{
+			DevicePk: key.DevicePk,
+			Epoch:    key.ChainKey.Epoch,
+		})
+	}
+
 	return rep, nil
 }
 
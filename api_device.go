@@ -0,0 +1,478 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// DeviceRevoke revokes another device of the account on the account group, on
+// the contact groups and on the multi-member groups where it has registered
+// its device key, the members then renew their chain keys. The secrets of the
+// multi-member groups administered by the account where the device hasn't
+// registered its key are rotated instead. The current device becomes the
+// primary device if the account has none.
+//
+// The revoked device keeps the account key, the chain keys renewed afterwards
+// are then sealed for each of the remaining devices instead of the member key,
+// and the contact request rendezvous seed is reset when contact requests are
+// enabled.
+func (s *service) DeviceRevoke(ctx context.Context, req *protocoltypes.DeviceRevoke_Request) (_ *protocoltypes.DeviceRevoke_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Revoking device")
+	defer func() { endSection(err, "") }()
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(req.DevicePk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().PrimaryDeviceClaim(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := accountGroup.MetadataStore().DeviceRevoke(ctx, devicePK); err != nil {
+		return nil, err
+	}
+
+	// the account chain key known by the revoked device is replaced
+	if _, err := accountGroup.MetadataStore().SendSecret(ctx, accountGroup.MemberPubKey()); err != nil && !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) {
+		return nil, err
+	}
+
+	if enabled, _ := accountGroup.MetadataStore().GetIncomingContactRequestsStatus(); enabled {
+		if _, err := accountGroup.MetadataStore().ContactRequestReferenceReset(ctx); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+	}
+
+	// the device keys used on contact groups are the keys of the devices, the
+	// contacts can reject the revoked device by themselves
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		if err := s.revokeContactDevice(ctx, contact.Pk, devicePK); err != nil {
+			s.logger.Warn("unable to revoke device on contact group", logutil.PrivateBinary("pk", contact.Pk), zap.Error(err))
+		}
+	}
+
+	// the device keys used on multi-member groups are derived for each group,
+	// they are matched with the revoked device using its registrations
+	for _, g := range accountGroup.MetadataStore().ListMultiMemberGroups() {
+		if err := s.revokeGroupDevice(ctx, accountGroup, g, req.DevicePk); err != nil {
+			s.logger.Warn("unable to revoke device on group", logutil.PrivateBinary("pk", g.PublicKey), zap.Error(err))
+		}
+	}
+
+	return &protocoltypes.DeviceRevoke_Reply{}, nil
+}
+
+// DeviceSetName sets the name and the platform of the current device
+func (s *service) DeviceSetName(ctx context.Context, req *protocoltypes.DeviceSetName_Request) (_ *protocoltypes.DeviceSetName_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting device name")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	platform := req.Platform
+	if platform == "" {
+		platform = runtime.GOOS
+	}
+
+	if _, err := accountGroup.MetadataStore().DeviceSetName(ctx, req.Name, platform); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.DeviceSetName_Reply{}, nil
+}
+
+// DeviceList lists the devices linked to the account
+func (s *service) DeviceList(context.Context, *protocoltypes.DeviceList_Request) (*protocoltypes.DeviceList_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	return &protocoltypes.DeviceList_Reply{
+		Devices: accountGroup.MetadataStore().ListDeviceInfos(),
+	}, nil
+}
+
+// DeviceRotateKey announces a new key for the current device on the account
+// group, the contact groups and the multi-member groups, then replaces the
+// previous key and reopens the groups with the new one
+func (s *service) DeviceRotateKey(ctx context.Context, req *protocoltypes.DeviceRotateKey_Request) (_ *protocoltypes.DeviceRotateKey_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Rotating device key")
+	defer func() { endSection(err, "") }()
+
+	if req.GracePeriod < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("grace period can't be negative"))
+	}
+
+	gracePeriod := time.Duration(req.GracePeriod) * time.Second
+	if gracePeriod == 0 {
+		gracePeriod = deviceKeyGracePeriod
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	retiredAt := time.Now().Add(gracePeriod)
+	name := accountGroup.MetadataStore().Index().(*metadataStoreIndex).getDeviceName(accountGroup.MetadataStore().devicePublicKeyRaw)
+
+	// the rotation is aborted if it can't be announced on the account group,
+	// the other devices of the account would reject the new key
+	if err := s.announceDeviceKeyRotation(ctx, accountGroup, retiredAt); err != nil {
+		return nil, err
+	}
+
+	rotated := []*GroupContext{}
+	for _, g := range s.deviceKeyRotationGroups(accountGroup) {
+		cg, err := s.GetContextGroupForID(g.PublicKey)
+		if err != nil {
+			s.logger.Warn("unable to open group, its device key will be replaced on activation", logutil.PrivateBinary("pk", g.PublicKey), zap.Error(err))
+			continue
+		}
+
+		if err := s.announceDeviceKeyRotation(ctx, cg, retiredAt); err != nil {
+			s.logger.Warn("unable to announce device key rotation", logutil.PrivateBinary("pk", g.PublicKey), zap.Error(err))
+			continue
+		}
+
+		rotated = append(rotated, cg)
+	}
+
+	if err := s.secretStore.RotateDeviceKeys(); err != nil {
+		return nil, err
+	}
+
+	// the account group is reopened first as the contact groups depend on it
+	for _, cg := range append([]*GroupContext{accountGroup}, rotated...) {
+		pk, err := cg.Group().GetPubKey()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if err := s.deactivateGroup(pk); err != nil {
+			return nil, err
+		}
+
+		if err := s.activateGroup(ctx, pk, false); err != nil {
+			return nil, err
+		}
+	}
+
+	accountGroup = s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if name != nil {
+		if _, err := accountGroup.MetadataStore().DeviceSetName(ctx, name.Name, name.Platform); err != nil {
+			s.logger.Warn("unable to set the name of the new device key", zap.Error(err))
+		}
+	}
+
+	return &protocoltypes.DeviceRotateKey_Reply{
+		DevicePk: accountGroup.MetadataStore().devicePublicKeyRaw,
+	}, nil
+}
+
+// DevicePrimaryTransferStart proposes the primary role of the current device to
+// another device of the account, or cancels the pending proposal
+func (s *service) DevicePrimaryTransferStart(ctx context.Context, req *protocoltypes.DevicePrimaryTransferStart_Request) (_ *protocoltypes.DevicePrimaryTransferStart_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Proposing primary device role")
+	defer func() { endSection(err, "") }()
+
+	var devicePK crypto.PubKey
+	if len(req.DevicePk) > 0 {
+		if devicePK, err = crypto.UnmarshalEd25519PublicKey(req.DevicePk); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().PrimaryDeviceClaim(ctx); err != nil {
+		return nil, err
+	}
+
+	if _, err := accountGroup.MetadataStore().PrimaryDeviceTransferPropose(ctx, devicePK); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.DevicePrimaryTransferStart_Reply{}, nil
+}
+
+// DevicePrimaryTransferAccept makes the current device the primary device of
+// the account, the role must have been proposed by the primary device
+func (s *service) DevicePrimaryTransferAccept(ctx context.Context, _ *protocoltypes.DevicePrimaryTransferAccept_Request) (_ *protocoltypes.DevicePrimaryTransferAccept_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Accepting primary device role")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().PrimaryDeviceTransferAccept(ctx); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.DevicePrimaryTransferAccept_Reply{}, nil
+}
+
+// DeviceLinkStart sends the provisioning payload to display to the new device,
+// then waits for it to retrieve the account with a device key linked on the
+// account group. Only the primary device can link devices, the current device
+// becomes the primary device if the account has none.
+func (s *service) DeviceLinkStart(req *protocoltypes.DeviceLinkStart_Request, sub protocoltypes.ProtocolService_DeviceLinkStartServer) (err error) {
+	ctx, _, endSection := tyber.Section(sub.Context(), s.logger, "Linking a new device")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().PrimaryDeviceClaim(ctx); err != nil {
+		return err
+	}
+
+	accountPK, err := accountGroup.MemberPubKey().Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	payload, err := newDeviceLinkPayload(accountPK)
+	if err != nil {
+		return err
+	}
+
+	payloadBytes, err := proto.Marshal(payload)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := sub.Send(&protocoltypes.DeviceLinkStart_Reply{Payload: payloadBytes}); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	historyLimit := int(req.HistoryLimit)
+	if historyLimit == 0 {
+		historyLimit = deviceLinkHistoryLimit
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deviceLinkTimeout)
+	defer cancel()
+
+	if err := s.linkDevice(ctx, payload, func() (*protocoltypes.DeviceLinkBundle, error) {
+		return s.deviceLinkBundle(ctx, req.IncludeHistory, historyLimit)
+	}); err != nil {
+		return err
+	}
+
+	if err := sub.Send(&protocoltypes.DeviceLinkStart_Reply{Linked: true}); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// DeviceLinkJoin retrieves the account from the device which created the
+// provisioning payload
+func (s *service) DeviceLinkJoin(ctx context.Context, req *protocoltypes.DeviceLinkJoin_Request) (_ *protocoltypes.DeviceLinkJoin_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Joining an account")
+	defer func() { endSection(err, "") }()
+
+	payload := &protocoltypes.DeviceLinkPayload{}
+	if err := proto.Unmarshal(req.Payload, payload); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if err := checkDeviceLinkPayload(payload); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deviceLinkTimeout)
+	defer cancel()
+
+	bundle, err := s.joinDeviceLink(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleBytes, err := proto.Marshal(bundle)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return &protocoltypes.DeviceLinkJoin_Reply{Bundle: bundleBytes}, nil
+}
+
+// DeviceHistorySync retrieves the keys of the messages received before the
+// current device was linked from another connected device of the account, the
+// transfer resumes where the previous one stopped unless restart is set
+func (s *service) DeviceHistorySync(req *protocoltypes.DeviceHistorySync_Request, sub protocoltypes.ProtocolService_DeviceHistorySyncServer) (err error) {
+	ctx, _, endSection := tyber.Section(sub.Context(), s.logger, "Retrieving history from another device")
+	defer func() { endSection(err, "") }()
+
+	if s.host == nil {
+		return errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("history sync requires a libp2p host"))
+	}
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	known := s.deviceHistorySyncGroups(accountGroup)
+	groups := []*protocoltypes.Group{}
+	if len(req.GroupPks) == 0 {
+		for _, g := range known {
+			groups = append(groups, g)
+		}
+	}
+
+	for _, pk := range req.GroupPks {
+		g, ok := known[string(pk)]
+		if !ok {
+			return errcode.ErrCode_ErrGroupUnknown
+		}
+
+		groups = append(groups, g)
+	}
+
+	peers := s.deviceHistorySyncPeers(accountGroup, req.DevicePk)
+	if len(peers) == 0 {
+		return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no other device of the account connected"))
+	}
+
+	progress := func(reply *protocoltypes.DeviceHistorySync_Reply) error {
+		if err := sub.Send(reply); err != nil {
+			return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+		}
+
+		return nil
+	}
+
+	for p, devicePK := range peers {
+		if err = s.requestDeviceHistory(ctx, p, devicePK, accountGroup, groups, req.Restart, progress); err == nil {
+			return nil
+		}
+
+		s.logger.Warn("unable to retrieve history", logutil.PrivateBinary("device", devicePK), zap.Error(err))
+	}
+
+	return err
+}
+
+func (s *service) revokeContactDevice(ctx context.Context, contactPK []byte, devicePK crypto.PubKey) error {
+	pk, err := crypto.UnmarshalEd25519PublicKey(contactPK)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	group, err := s.getContactGroup(pk)
+	if err != nil {
+		return err
+	}
+
+	cg, release, err := s.retainContextGroupForID(group.PublicKey)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().ContactRevokeDevice(ctx, devicePK); err != nil {
+		return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// revokeGroupDevice revokes on a multi-member group the device key registered
+// by the revoked device, or rotates the secret of the group if the device
+// hasn't registered any and the account administers the group
+func (s *service) revokeGroupDevice(ctx context.Context, accountGroup *GroupContext, g *protocoltypes.Group, devicePK []byte) error {
+	cg, release, err := s.retainContextGroupForID(g.PublicKey)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	groupDevicePK := accountGroup.MetadataStore().Index().(*metadataStoreIndex).getGroupDevice(g.PublicKey, devicePK)
+	if groupDevicePK == nil {
+		if !cg.MetadataStore().IsAdmin() {
+			return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("device key not registered on the group"))
+		}
+
+		if _, err := cg.MetadataStore().RotateSecret(ctx); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(groupDevicePK)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if _, err := cg.MetadataStore().MultiMemberGroupRevokeDevice(ctx, pk); err != nil {
+		return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
+
+// registerGroupDevice links on the account group the device key used by the
+// current device on a multi-member group, so the other devices of the account
+// can revoke it, the registration is made once per group and device key
+func (s *service) registerGroupDevice(accountGroup *GroupContext, gc *GroupContext) {
+	groupDevicePK, err := gc.DevicePubKey().Raw()
+	if err != nil {
+		return
+	}
+
+	key := string(gc.Group().GetPublicKey()) + string(groupDevicePK)
+
+	s.muRegisteredDevices.Lock()
+	if _, ok := s.registeredGroupDevices[key]; ok {
+		s.muRegisteredDevices.Unlock()
+		return
+	}
+	s.registeredGroupDevices[key] = struct{}{}
+	s.muRegisteredDevices.Unlock()
+
+	go func() {
+		if _, err := accountGroup.MetadataStore().GroupDeviceRegister(s.ctx, gc.Group(), gc.ownMemberDevice); err != nil {
+			s.logger.Warn("unable to register group device key", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+
+			// the registration is attempted again on the next activation
+			s.muRegisteredDevices.Lock()
+			delete(s.registeredGroupDevices, key)
+			s.muRegisteredDevices.Unlock()
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -38,10 +39,11 @@ func (s *service) GroupMetadataList(req *protocoltypes.GroupMetadataList_Request
 	defer cancel()
 
 	// Get group context / check if the group is opened
-	cg, err := s.GetContextGroupForID(req.GroupPk)
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
+	defer release()
 
 	// Check parameters consistency
 	if err := checkParametersConsistency(req.SinceId, req.UntilId, req.SinceNow, req.UntilNow, req.ReverseOrder); err != nil {
@@ -126,10 +128,11 @@ func (s *service) GroupMessageList(req *protocoltypes.GroupMessageList_Request,
 	defer cancel()
 
 	// Get group context / check if the group is opened
-	cg, err := s.GetContextGroupForID(req.GroupPk)
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
+	defer release()
 
 	// Check parameters consistency
 	if err := checkParametersConsistency(req.SinceId, req.UntilId, req.SinceNow, req.UntilNow, req.ReverseOrder); err != nil {
@@ -152,7 +155,26 @@ func (s *service) GroupMessageList(req *protocoltypes.GroupMessageList_Request,
 	// Subscribe to previous message events and stream them if requested
 	previousEvents := make(chan *protocoltypes.GroupMessageEvent)
 	if !req.SinceNow {
-		pevt, err := cg.MessageStore().ListEvents(ctx, req.SinceId, req.UntilId, req.ReverseOrder)
+		opts := &listEventsOptions{
+			since:     req.SinceId,
+			until:     req.UntilId,
+			exclusive: req.Exclusive,
+			reverse:   req.ReverseOrder,
+			limit:     req.Limit,
+		}
+
+		if req.ThreadId != nil {
+			opts.filter = func(evt *protocoltypes.GroupMessageEvent) bool {
+				return bytes.Equal(evt.ThreadId, req.ThreadId) || bytes.Equal(evt.EventContext.Id, req.ThreadId)
+			}
+		}
+
+		var pevt <-chan *protocoltypes.GroupMessageEvent
+		if req.Collapsed {
+			pevt, err = cg.MessageStore().listCollapsedEvents(ctx, opts)
+		} else {
+			pevt, err = cg.MessageStore().listEvents(ctx, opts)
+		}
 		if err != nil {
 			return err
 		}
@@ -200,6 +222,10 @@ func (s *service) GroupMessageList(req *protocoltypes.GroupMessageList_Request,
 			continue
 		}
 
+		if req.ThreadId != nil && !bytes.Equal(msg.ThreadId, req.ThreadId) && !bytes.Equal(msg.EventContext.Id, req.ThreadId) {
+			continue
+		}
+
 		if err := sub.Send(msg); err != nil {
 			return err
 		}
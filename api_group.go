@@ -1,20 +1,26 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	peer "github.com/libp2p/go-libp2p/core/peer"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
+	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/logutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
 )
 
 func (s *service) GroupInfo(ctx context.Context, req *protocoltypes.GroupInfo_Request) (*protocoltypes.GroupInfo_Reply, error) {
@@ -63,19 +69,437 @@ func (s *service) GroupInfo(ctx context.Context, req *protocoltypes.GroupInfo_Re
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	return &protocoltypes.GroupInfo_Reply{
+	reply := &protocoltypes.GroupInfo_Reply{
 		Group:    g,
 		MemberPk: member,
 		DevicePk: device,
+	}
+
+	// the epoch is only known by the index of an activated group
+	if cg, err := s.getOpenedGroup(g.PublicKey); err == nil {
+		reply.Epoch = cg.MetadataStore().GetEpoch()
+	}
+
+	return reply, nil
+}
+
+// GroupStats returns statistics about an activated group
+func (s *service) GroupStats(ctx context.Context, req *protocoltypes.GroupStats_Request) (*protocoltypes.GroupStats_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	reply := &protocoltypes.GroupStats_Reply{
+		MemberCount:          uint32(len(cg.MetadataStore().ListMembers())),
+		DeviceCount:          uint32(len(cg.MetadataStore().ListDevices())),
+		MetadataCount:        uint64(cg.MetadataStore().OpLog().GetEntries().Len()),
+		MessageCount:         uint64(cg.MessageStore().OpLog().GetEntries().Len()),
+		MetadataLastActivity: cg.MetadataStore().LastActivity(),
+		MessageLastActivity:  cg.MessageStore().LastActivity(),
+	}
+
+	for _, head := range cg.MetadataStore().OpLog().RawHeads().Slice() {
+		reply.MetadataHeads = append(reply.MetadataHeads, head.GetHash().String())
+	}
+
+	for _, head := range cg.MessageStore().OpLog().RawHeads().Slice() {
+		reply.MessageHeads = append(reply.MessageHeads, head.GetHash().String())
+	}
+
+	for _, store := range []orbitdb.Store{cg.MetadataStore(), cg.MessageStore()} {
+		size, err := s.storeDiskUsage(ctx, store)
+		if err != nil {
+			return nil, err
+		}
+
+		reply.DiskUsage += size
+	}
+
+	return reply, nil
+}
+
+// GroupVerifyIntegrity verifies the metadata and message logs of an activated
+// group and reports the inconsistencies found
+func (s *service) GroupVerifyIntegrity(ctx context.Context, req *protocoltypes.GroupVerifyIntegrity_Request) (_ *protocoltypes.GroupVerifyIntegrity_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Verifying group integrity")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	return verifyGroupIntegrity(ctx, cg, s.odb.logCompaction)
+}
+
+// GroupSyncStateWatch streams the replication state of the logs of the
+// watched groups, the state of a group is sent again each time it changes
+func (s *service) GroupSyncStateWatch(req *protocoltypes.GroupSyncStateWatch_Request, sub protocoltypes.ProtocolService_GroupSyncStateWatchServer) error {
+	for _, groupPK := range req.GroupPks {
+		_, release, err := s.retainContextGroupForID(groupPK)
+		if err != nil {
+			return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+		}
+		defer release()
+
+	}
+
+	syncState := s.odb.syncState
+	sent := map[string]*protocoltypes.GroupSyncState{}
+
+	for {
+		version := syncState.getVersion()
+
+		var groups []*GroupContext
+		if len(req.GroupPks) == 0 {
+			s.lock.RLock()
+			for _, gc := range s.openedGroups {
+				groups = append(groups, gc)
+			}
+			s.lock.RUnlock()
+		} else {
+			for _, groupPK := range req.GroupPks {
+				if gc, err := s.GetContextGroupForID(groupPK); err == nil {
+					groups = append(groups, gc)
+				}
+			}
+		}
+
+		for _, gc := range groups {
+			state := syncState.groupState(gc)
+			if previous, ok := sent[string(state.GroupPk)]; ok && proto.Equal(previous, state) {
+				continue
+			}
+
+			if err := sub.Send(&protocoltypes.GroupSyncStateWatch_Reply{State: state}); err != nil {
+				return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+			}
+
+			sent[string(state.GroupPk)] = state
+		}
+
+		syncState.waitForChange(sub.Context(), version)
+		if sub.Context().Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *service) GroupRetentionPolicySet(ctx context.Context, req *protocoltypes.GroupRetentionPolicySet_Request) (_ *protocoltypes.GroupRetentionPolicySet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting group retention policy")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := s.getGroupForPK(ctx, pk); err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	if err := s.retention.setPolicy(ctx, req.GroupPk, req.Policy); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupRetentionPolicySet_Reply{}, nil
+}
+
+func (s *service) GroupRetentionPolicyGet(ctx context.Context, req *protocoltypes.GroupRetentionPolicyGet_Request) (*protocoltypes.GroupRetentionPolicyGet_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := s.getGroupForPK(ctx, pk); err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	policy, err := s.retention.getPolicy(ctx, req.GroupPk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupRetentionPolicyGet_Reply{Policy: policy}, nil
+}
+
+// GroupSyncPolicySet sets which logs of a group are replicated from the
+// peers, the policy applies immediately if the group is activated
+func (s *service) GroupSyncPolicySet(ctx context.Context, req *protocoltypes.GroupSyncPolicySet_Request) (_ *protocoltypes.GroupSyncPolicySet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting group sync policy")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the account group is always fully replicated"))
+	}
+
+	if err := s.syncPolicies.setMode(ctx, req.GroupPk, req.Mode); err != nil {
+		return nil, err
+	}
+
+	if err := s.applyGroupSyncPolicy(ctx, g); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSyncPolicySet_Reply{}, nil
+}
+
+// GroupSyncPolicyGet retrieves which logs of a group are replicated from the
+// peers
+func (s *service) GroupSyncPolicyGet(ctx context.Context, req *protocoltypes.GroupSyncPolicyGet_Request) (*protocoltypes.GroupSyncPolicyGet_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := s.getGroupForPK(ctx, pk); err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	mode, err := s.syncPolicies.getMode(ctx, req.GroupPk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSyncPolicyGet_Reply{Mode: mode}, nil
+}
+
+// GroupMessageHistoryFetch replicates the messages announced by the peers of
+// an activated group, it returns once the announced heads have been fetched
+func (s *service) GroupMessageHistoryFetch(ctx context.Context, req *protocoltypes.GroupMessageHistoryFetch_Request) (_ *protocoltypes.GroupMessageHistoryFetch_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Fetching group message history")
+	defer func() { endSection(err, "") }()
+
+	gc, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	fetched, err := s.fetchMessageHistory(ctx, gc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupMessageHistoryFetch_Reply{FetchedEntryCount: fetched}, nil
+}
+
+// GroupRecoverFromNetwork rebuilds the local logs of a group from its
+// invitation material, it returns once the heads announced by the peers have
+// been fetched or when the timeout expires
+func (s *service) GroupRecoverFromNetwork(ctx context.Context, req *protocoltypes.GroupRecoverFromNetwork_Request) (_ *protocoltypes.GroupRecoverFromNetwork_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Recovering group from network")
+	defer func() { endSection(err, "") }()
+
+	if req.Timeout < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("timeout can't be negative"))
+	}
+
+	timeout := groupRecoveryTimeout
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	g, err := s.recoveryGroup(ctx, req.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.recoverGroup(ctx, g)
+}
+
+// DisappearingMessagesSet sets the delay after which the messages of an
+// activated group are deleted by all its members
+func (s *service) DisappearingMessagesSet(ctx context.Context, req *protocoltypes.DisappearingMessagesSet_Request) (_ *protocoltypes.DisappearingMessagesSet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting disappearing messages")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().SetDisappearingMessages(ctx, time.Duration(req.Duration)*time.Second); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.DisappearingMessagesSet_Reply{}, nil
+}
+
+// DisappearingMessagesGet retrieves the delay after which the messages of an
+// activated group are deleted
+func (s *service) DisappearingMessagesGet(_ context.Context, req *protocoltypes.DisappearingMessagesGet_Request) (*protocoltypes.DisappearingMessagesGet_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	return &protocoltypes.DisappearingMessagesGet_Reply{
+		Duration: int64(cg.MetadataStore().GetDisappearingMessages() / time.Second),
 	}, nil
 }
 
+func (s *service) GroupExport(req *protocoltypes.GroupExport_Request, server protocoltypes.ProtocolService_GroupExportServer) (err error) {
+	ctx, _, endSection := tyber.Section(server.Context(), s.logger, "Exporting group")
+	defer func() { endSection(err, "") }()
+
+	if len(req.Passphrase) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a passphrase is required"))
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if cg.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return errcode.ErrCode_ErrGroupInvalidType.Wrap(fmt.Errorf("only multi-member groups can be exported"))
+	}
+
+	archive := new(bytes.Buffer)
+	if err := s.exportGroup(ctx, cg, req.IncludeMessages, archive); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	bundle, err := sealGroupBundle(req.Passphrase, archive.Bytes())
+	if err != nil {
+		return err
+	}
+
+	for len(bundle) > 0 {
+		l := len(bundle)
+		if l > 4096 {
+			l = 4096
+		}
+
+		if err := server.Send(&protocoltypes.GroupExport_Reply{ExportedData: bundle[:l]}); err != nil {
+			return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+		}
+
+		bundle = bundle[l:]
+	}
+
+	return nil
+}
+
+func (s *service) GroupImport(server protocoltypes.ProtocolService_GroupImportServer) (err error) {
+	ctx, _, endSection := tyber.Section(server.Context(), s.logger, "Importing group")
+	defer func() { endSection(err, "") }()
+
+	var (
+		passphrase []byte
+		bundle     = new(bytes.Buffer)
+	)
+
+	for {
+		req, err := server.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		if len(req.Passphrase) > 0 {
+			passphrase = req.Passphrase
+		}
+
+		bundle.Write(req.BundleData)
+	}
+
+	archive, err := openGroupBundle(passphrase, bundle.Bytes())
+	if err != nil {
+		return err
+	}
+
+	g, err := s.importGroup(ctx, bytes.NewReader(archive))
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if err := server.SendAndClose(&protocoltypes.GroupImport_Reply{GroupPk: g.PublicKey}); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// storeDiskUsage returns the size of the store entries kept locally
+func (s *service) storeDiskUsage(ctx context.Context, store orbitdb.Store) (uint64, error) {
+	ids, err := storeEntryCIDs(ctx, store, s.odb.logCompaction)
+	if err != nil {
+		return 0, err
+	}
+
+	size := uint64(0)
+
+	for _, id := range ids {
+		dagNode, err := s.ipfsCoreAPI.Dag().Get(ctx, id)
+		if err != nil {
+			return 0, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		size += uint64(len(dagNode.RawData()))
+	}
+
+	return size, nil
+}
+
+// storeEntryCIDs returns the CIDs of the store entries kept locally, the
+// entries removed by the compaction of the log are skipped
+func storeEntryCIDs(ctx context.Context, store orbitdb.Store, compaction *logCompaction) ([]cid.Cid, error) {
+	keys := store.OpLog().GetEntries().Keys()
+	ids := make([]cid.Cid, 0, len(keys))
+	address := store.Address().String()
+
+	for _, idStr := range keys {
+		id, err := cid.Parse(idStr)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if compaction != nil && compaction.isCompacted(ctx, address, id) {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
 func (s *service) ActivateGroup(ctx context.Context, req *protocoltypes.ActivateGroup_Request) (*protocoltypes.ActivateGroup_Reply, error) {
 	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
+	if s.groupActivity != nil && !req.LocalOnly {
+		if err := s.activateGroupLazily(ctx, pk); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		return &protocoltypes.ActivateGroup_Reply{}, nil
+	}
+
 	err = s.activateGroup(ctx, pk, req.LocalOnly)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
@@ -84,12 +508,21 @@ func (s *service) ActivateGroup(ctx context.Context, req *protocoltypes.Activate
 	return &protocoltypes.ActivateGroup_Reply{}, nil
 }
 
-func (s *service) DeactivateGroup(_ context.Context, req *protocoltypes.DeactivateGroup_Request) (*protocoltypes.DeactivateGroup_Reply, error) {
+func (s *service) DeactivateGroup(ctx context.Context, req *protocoltypes.DeactivateGroup_Request) (*protocoltypes.DeactivateGroup_Reply, error) {
 	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
+	if req.Purge {
+		reclaimed, err := s.purgeGroupLocalData(ctx, pk)
+		if err != nil {
+			return nil, err
+		}
+
+		return &protocoltypes.DeactivateGroup_Reply{ReclaimedBytes: reclaimed}, nil
+	}
+
 	if err := s.deactivateGroup(pk); err != nil {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
 	}
@@ -97,6 +530,96 @@ func (s *service) DeactivateGroup(_ context.Context, req *protocoltypes.Deactiva
 	return &protocoltypes.DeactivateGroup_Reply{}, nil
 }
 
+func (s *service) GroupPurgeLocalData(ctx context.Context, req *protocoltypes.GroupPurgeLocalData_Request) (_ *protocoltypes.GroupPurgeLocalData_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Purging group local data")
+	defer func() { endSection(err, "") }()
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	reclaimed, err := s.purgeGroupLocalData(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupPurgeLocalData_Reply{ReclaimedBytes: reclaimed}, nil
+}
+
+// GroupDeviceCapabilities lists the capabilities announced by the devices of
+// an activated group
+func (s *service) GroupDeviceCapabilities(ctx context.Context, req *protocoltypes.GroupDeviceCapabilities_Request) (*protocoltypes.GroupDeviceCapabilities_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	return &protocoltypes.GroupDeviceCapabilities_Reply{
+		Devices: cg.MetadataStore().ListDeviceCapabilities(),
+	}, nil
+}
+
+// MessageDeliveryStatus reports which devices of an activated group have
+// acknowledged the reception of a message
+func (s *service) MessageDeliveryStatus(_ context.Context, req *protocoltypes.MessageDeliveryStatus_Request) (*protocoltypes.MessageDeliveryStatus_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	id, err := cid.Cast(req.Cid)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	op, err := cg.MessageStore().GetMessageByCID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, headers, err := s.secretStore.OpenEnvelopeHeaders(op.GetValue(), cg.Group())
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return &protocoltypes.MessageDeliveryStatus_Reply{
+		DevicePk: headers.DevicePk,
+		Devices:  cg.MetadataStore().ListMessageDeliveryStatus(id.Bytes(), headers.DevicePk),
+	}, nil
+}
+
+func (s *service) MessageSearch(ctx context.Context, req *protocoltypes.MessageSearch_Request) (*protocoltypes.MessageSearch_Reply, error) {
+	if s.messageSearch == nil {
+		return nil, errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("message search index is disabled"))
+	}
+
+	results, total, err := s.messageSearch.search(ctx, req.Query, req.GroupPk, req.Offset, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &protocoltypes.MessageSearch_Reply{Total: total}
+	for _, result := range results {
+		r := &protocoltypes.MessageSearch_Result{
+			GroupPk:   result.groupPK,
+			MessageId: result.id,
+			Score:     result.score,
+		}
+
+		// the groups aren't activated to fill the results
+		if evt, err := s.openSearchResult(ctx, result); err == nil {
+			r.Message = evt
+		}
+
+		reply.Results = append(reply.Results, r)
+	}
+
+	return reply, nil
+}
+
 func (s *service) GroupDeviceStatus(req *protocoltypes.GroupDeviceStatus_Request, srv protocoltypes.ProtocolService_GroupDeviceStatusServer) error {
 	ctx := srv.Context()
 	gkey := hex.EncodeToString(req.GroupPk)
@@ -105,6 +628,30 @@ func (s *service) GroupDeviceStatus(req *protocoltypes.GroupDeviceStatus_Request
 	logger := s.logger.Named("pstatus")
 	logger.Debug("start monitor device status group", logutil.PrivateString("group_key", gkey))
 
+	// send the last time each known device of the group has been seen, only
+	// if requested so the existing consumers only receive the connectivity
+	// events
+	if req.WithLastSeen {
+		devices, err := s.deviceActivity.list(ctx, req.GroupPk)
+		if err != nil {
+			return err
+		}
+
+		for _, device := range devices {
+			event, err := proto.Marshal(device)
+			if err != nil {
+				return errcode.ErrCode_ErrSerialization.Wrap(err)
+			}
+
+			if err := srv.Send(&protocoltypes.GroupDeviceStatus_Reply{
+				Type:  protocoltypes.GroupDeviceStatus_TypeDeviceLastSeen,
+				Event: event,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
 	for {
 		updated, ok := s.peerStatusManager.WaitForConnectednessChange(ctx, gkey, peers)
 		if !ok {
@@ -1,10 +1,14 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
@@ -40,10 +44,11 @@ func (s *service) MultiMemberGroupCreate(ctx context.Context, _ *protocoltypes.M
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to activate group: %w", err))
 	}
 
-	cg, err := s.GetContextGroupForID(group.PublicKey)
+	cg, release, err := s.retainContextGroupForID(group.PublicKey)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
+	defer release()
 
 	_, err = cg.MetadataStore().ClaimGroupOwnership(ctx, groupPrivateKey)
 	if err != nil {
@@ -65,6 +70,12 @@ func (s *service) MultiMemberGroupJoin(ctx context.Context, req *protocoltypes.M
 		return nil, errcode.ErrCode_ErrGroupMissing
 	}
 
+	// the members of the group reject the join of a device once the
+	// invitation has expired, it is refused early
+	if isGroupInvitationExpired(req.Group.GetInvitation(), time.Now()) {
+		return nil, errcode.ErrCode_ErrGroupInvitationExpired
+	}
+
 	if _, err := accountGroup.MetadataStore().GroupJoin(ctx, req.Group); err != nil {
 		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
 	}
@@ -101,10 +112,11 @@ func (s *service) MultiMemberGroupLeave(ctx context.Context, req *protocoltypes.
 
 // MultiMemberGroupAliasResolverDisclose sends an deviceKeystore identity proof to the group members
 func (s *service) MultiMemberGroupAliasResolverDisclose(ctx context.Context, req *protocoltypes.MultiMemberGroupAliasResolverDisclose_Request) (*protocoltypes.MultiMemberGroupAliasResolverDisclose_Reply, error) {
-	cg, err := s.GetContextGroupForID(req.GroupPk)
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
+	defer release()
 
 	_, err = cg.MetadataStore().SendAliasProof(ctx)
 	if err != nil {
@@ -115,18 +127,410 @@ func (s *service) MultiMemberGroupAliasResolverDisclose(ctx context.Context, req
 }
 
 // MultiMemberGroupAdminRoleGrant grants admin role to another member of the group
-func (s *service) MultiMemberGroupAdminRoleGrant(context.Context, *protocoltypes.MultiMemberGroupAdminRoleGrant_Request) (*protocoltypes.MultiMemberGroupAdminRoleGrant_Reply, error) {
-	return nil, errcode.ErrCode_ErrNotImplemented
+func (s *service) MultiMemberGroupAdminRoleGrant(ctx context.Context, req *protocoltypes.MultiMemberGroupAdminRoleGrant_Request) (*protocoltypes.MultiMemberGroupAdminRoleGrant_Reply, error) {
+	if _, err := s.GroupSetMemberRole(ctx, &protocoltypes.GroupSetMemberRole_Request{
+		GroupPk:  req.GroupPk,
+		MemberPk: req.MemberPk,
+		Role:     protocoltypes.GroupMemberRole_GroupMemberRoleAdmin,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.MultiMemberGroupAdminRoleGrant_Reply{}, nil
+}
+
+// GroupSetMemberRole sets the role of a member of a MultiMember group
+func (s *service) GroupSetMemberRole(ctx context.Context, req *protocoltypes.GroupSetMemberRole_Request) (_ *protocoltypes.GroupSetMemberRole_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting member role in MultiMember group")
+	defer func() { endSection(err, "") }()
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(req.MemberPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().SetMemberRole(ctx, memberPK, req.Role); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSetMemberRole_Reply{}, nil
+}
+
+// GroupGetRoles lists the roles of the members of a MultiMember group
+func (s *service) GroupGetRoles(_ context.Context, req *protocoltypes.GroupGetRoles_Request) (*protocoltypes.GroupGetRoles_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if cg.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	roles := cg.MetadataStore().ListMemberRoles()
+	reply := &protocoltypes.GroupGetRoles_Reply{
+		Roles: make([]*protocoltypes.GroupGetRoles_MemberRole, 0, len(roles)),
+	}
+
+	for pk, role := range roles {
+		reply.Roles = append(reply.Roles, &protocoltypes.GroupGetRoles_MemberRole{
+			MemberPk: []byte(pk),
+			Role:     role,
+		})
+	}
+
+	// the roles are indexed in a map, they are sorted by member so the
+	// replies are stable
+	sort.Slice(reply.Roles, func(i, j int) bool {
+		return bytes.Compare(reply.Roles[i].MemberPk, reply.Roles[j].MemberPk) < 0
+	})
+
+	return reply, nil
+}
+
+// GroupMemberRemove evicts a member from a MultiMember group
+func (s *service) GroupMemberRemove(ctx context.Context, req *protocoltypes.GroupMemberRemove_Request) (_ *protocoltypes.GroupMemberRemove_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Removing member from MultiMember group")
+	defer func() { endSection(err, "") }()
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(req.MemberPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().RemoveMember(ctx, memberPK); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupMemberRemove_Reply{}, nil
+}
+
+// GroupSetBroadcastMode enables or disables the broadcast mode of a MultiMember group
+func (s *service) GroupSetBroadcastMode(ctx context.Context, req *protocoltypes.GroupSetBroadcastMode_Request) (_ *protocoltypes.GroupSetBroadcastMode_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting MultiMember group broadcast mode")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().SetBroadcastMode(ctx, req.Enabled); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSetBroadcastMode_Reply{}, nil
+}
+
+// GroupJoinRequestList streams the members waiting for an admin approval
+func (s *service) GroupJoinRequestList(req *protocoltypes.GroupJoinRequestList_Request, sub protocoltypes.ProtocolService_GroupJoinRequestListServer) error {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if !cg.MetadataStore().IsAdmin() {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can list join requests"))
+	}
+
+	evtSub, err := cg.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/api/group-join-request-list"), eventbus.BufSize(32))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to new events")
+	}
+	defer evtSub.Close()
+
+	sent := map[string]struct{}{}
+	sendPendingRequests := func() error {
+		for _, request := range cg.MetadataStore().ListJoinRequests() {
+			if _, ok := sent[string(request.MemberPk)]; ok {
+				continue
+			}
+
+			if err := sub.Send(request); err != nil {
+				return err
+			}
+
+			sent[string(request.MemberPk)] = struct{}{}
+		}
+
+		return nil
+	}
+
+	if err := sendPendingRequests(); err != nil {
+		return err
+	}
+
+	for {
+		var evt interface{}
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case evt = <-evtSub.Out():
+		}
+
+		if e := evt.(*protocoltypes.GroupMetadataEvent); e.Metadata.EventType != protocoltypes.EventType_EventTypeGroupMemberDeviceAdded {
+			continue
+		}
+
+		if err := sendPendingRequests(); err != nil {
+			return err
+		}
+	}
+}
+
+// GroupJoinRequestApprove approves the join request of a member
+func (s *service) GroupJoinRequestApprove(ctx context.Context, req *protocoltypes.GroupJoinRequestApprove_Request) (_ *protocoltypes.GroupJoinRequestApprove_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Approving MultiMember group join request")
+	defer func() { endSection(err, "") }()
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(req.MemberPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().ApproveMember(ctx, memberPK); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupJoinRequestApprove_Reply{}, nil
+}
+
+// GroupMembershipWatch streams the changes of the members of a group and of
+// their devices
+func (s *service) GroupMembershipWatch(req *protocoltypes.GroupMembershipWatch_Request, sub protocoltypes.ProtocolService_GroupMembershipWatchServer) error {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	evtSub, err := cg.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/api/group-membership-watch"), eventbus.BufSize(32))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to new events")
+	}
+	defer evtSub.Close()
+
+	var membership *groupMembership
+	sendChanges := func() error {
+		current := cg.MetadataStore().getMembership()
+
+		for _, event := range diffGroupMembership(membership, current) {
+			if err := sub.Send(event); err != nil {
+				return err
+			}
+		}
+
+		membership = current
+		return nil
+	}
+
+	if err := sendChanges(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case <-evtSub.Out():
+		}
+
+		if err := sendChanges(); err != nil {
+			return err
+		}
+	}
+}
+
+// MultiMemberGroupRotateSecret starts a new secret epoch in a MultiMember group
+func (s *service) MultiMemberGroupRotateSecret(ctx context.Context, req *protocoltypes.MultiMemberGroupRotateSecret_Request) (_ *protocoltypes.MultiMemberGroupRotateSecret_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Rotating MultiMember group secrets")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().RotateSecret(ctx); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.MultiMemberGroupRotateSecret_Reply{}, nil
+}
+
+// GroupBanMember bans or unbans a member of a MultiMember group
+func (s *service) GroupBanMember(ctx context.Context, req *protocoltypes.GroupBanMember_Request) (_ *protocoltypes.GroupBanMember_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Banning member from MultiMember group")
+	defer func() { endSection(err, "") }()
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(req.MemberPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().BanMember(ctx, memberPK, req.Unban); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupBanMember_Reply{}, nil
+}
+
+// GroupTransferOwnership transfers the ownership of a MultiMember group to
+// another member
+func (s *service) GroupTransferOwnership(ctx context.Context, req *protocoltypes.GroupTransferOwnership_Request) (_ *protocoltypes.GroupTransferOwnership_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Transferring MultiMember group ownership")
+	defer func() { endSection(err, "") }()
+
+	memberPK, err := crypto.UnmarshalEd25519PublicKey(req.MemberPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().TransferOwnership(ctx, memberPK); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupTransferOwnership_Reply{}, nil
+}
+
+// GroupBanList lists the members banned from a MultiMember group
+func (s *service) GroupBanList(_ context.Context, req *protocoltypes.GroupBanList_Request) (*protocoltypes.GroupBanList_Reply, error) {
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	return &protocoltypes.GroupBanList_Reply{
+		MemberPks: cg.MetadataStore().ListBannedMembers(),
+	}, nil
 }
 
 // MultiMemberGroupInvitationCreate creates a group invitation
 func (s *service) MultiMemberGroupInvitationCreate(_ context.Context, req *protocoltypes.MultiMemberGroupInvitationCreate_Request) (*protocoltypes.MultiMemberGroupInvitationCreate_Reply, error) {
-	cg, err := s.GetContextGroupForID(req.GroupPk)
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
 	}
+	defer release()
+
+	if !cg.MetadataStore().IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can invite members"))
+	}
+
+	g, err := cg.MetadataStore().CreateInvitation(req.ExpiresAt, req.ApprovalRequired)
+	if err != nil {
+		return nil, err
+	}
 
 	return &protocoltypes.MultiMemberGroupInvitationCreate_Reply{
-		Group: cg.Group(),
+		Group: g,
 	}, nil
 }
+
+// GroupInvitationRevoke prevents an invitation from being used by members who
+// haven't joined the group yet
+func (s *service) GroupInvitationRevoke(ctx context.Context, req *protocoltypes.GroupInvitationRevoke_Request) (_ *protocoltypes.GroupInvitationRevoke_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Revoking group invitation")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	if _, err := cg.MetadataStore().RevokeInvitation(ctx, req.InvitationId); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.GroupInvitationRevoke_Reply{}, nil
+}
+
+// GroupSetPublic publishes or withdraws the public descriptor of a MultiMember
+// group
+func (s *service) GroupSetPublic(ctx context.Context, req *protocoltypes.GroupSetPublic_Request) (_ *protocoltypes.GroupSetPublic_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting MultiMember group public mode")
+	defer func() { endSection(err, "") }()
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	var descriptor *protocoltypes.GroupPublicDescriptor
+	if req.Enabled {
+		descriptor = &protocoltypes.GroupPublicDescriptor{
+			Name:        req.Name,
+			Description: req.Description,
+			JoinHint:    req.JoinHint,
+			Topic:       req.Topic,
+		}
+	}
+
+	if _, err := cg.MetadataStore().SetPublicMode(ctx, descriptor, req.ApprovalRequired); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.GroupSetPublic_Reply{}, nil
+}
+
+// GroupDirectorySearch streams the public groups announced on a rendezvous
+// topic until the client cancels the request
+func (s *service) GroupDirectorySearch(req *protocoltypes.GroupDirectorySearch_Request, sub protocoltypes.ProtocolService_GroupDirectorySearchServer) error {
+	if s.groupDirectory == nil {
+		return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("group directory is disabled, no tinder driver provided"))
+	}
+
+	topic := req.Topic
+	if topic == "" {
+		topic = DefaultGroupDirectoryTopic
+	}
+
+	for descriptor := range s.groupDirectory.search(sub.Context(), topic) {
+		if req.Query != "" && !matchGroupPublicDescriptor(descriptor, req.Query) {
+			continue
+		}
+
+		if err := sub.Send(&protocoltypes.GroupDirectorySearch_Reply{GroupDescriptor: descriptor}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestGroupMemberRemove(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet: mocknet.New(),
+		Logger:  logger,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 3)
+	defer cleanup()
+
+	admin, member, removed := pts[0], pts[1], pts[2]
+
+	created, err := admin.Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	// ownership is claimed asynchronously
+	var invitation *protocoltypes.MultiMemberGroupInvitationCreate_Reply
+	require.Eventually(t, func() bool {
+		invitation, err = admin.Client.MultiMemberGroupInvitationCreate(ctx, &protocoltypes.MultiMemberGroupInvitationCreate_Request{
+			GroupPk: created.GroupPk,
+		})
+		return err == nil
+	}, time.Second*5, time.Millisecond*100)
+
+	for _, pt := range []*TestingProtocol{member, removed} {
+		_, err := pt.Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: invitation.Group})
+		require.NoError(t, err)
+
+		_, err = pt.Client.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: created.GroupPk})
+		require.NoError(t, err)
+	}
+
+	adminInfo, err := admin.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	removedInfo, err := removed.Client.GroupInfo(ctx, &protocoltypes.GroupInfo_Request{GroupPk: created.GroupPk})
+	require.NoError(t, err)
+
+	adminDevicePK, err := crypto.UnmarshalEd25519PublicKey(adminInfo.DevicePk)
+	require.NoError(t, err)
+
+	groupContext := func(pt *TestingProtocol) *GroupContext {
+		gc, err := pt.Service.(*service).GetContextGroupForID(created.GroupPk)
+		require.NoError(t, err)
+		return gc
+	}
+
+	adminGC, memberGC, removedGC := groupContext(admin), groupContext(member), groupContext(removed)
+	g := adminGC.Group()
+
+	groupPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	knowsAdminMetadataKey := func(gc *GroupContext, epoch uint64) bool {
+		_, err := gc.SecretStore().GetMetadataKey(ctx, g, adminDevicePK, epoch)
+		return err == nil
+	}
+
+	// the removed member knows the chain key of the admin before its removal
+	require.Eventually(t, func() bool {
+		return memberGC.SecretStore().IsChainKeyKnownForDevice(ctx, groupPK, adminDevicePK) &&
+			removedGC.SecretStore().IsChainKeyKnownForDevice(ctx, groupPK, adminDevicePK)
+	}, time.Second*20, time.Millisecond*100)
+
+	// each join has started a new epoch of the epoch tree
+	require.Eventually(t, func() bool {
+		tip := adminGC.MetadataStore().Index().(*metadataStoreIndex).getEpochTip()
+		return tip != nil && tip.tree.Size() == 3
+	}, time.Second*20, time.Millisecond*100)
+
+	epochBeforeRemoval := adminGC.MetadataStore().GetEpoch()
+
+	require.Eventually(t, func() bool {
+		_, err := admin.Client.GroupMemberRemove(ctx, &protocoltypes.GroupMemberRemove_Request{
+			GroupPk:  created.GroupPk,
+			MemberPk: removedInfo.MemberPk,
+		})
+		return err == nil
+	}, time.Second*5, time.Millisecond*100)
+
+	// the admin commits a new epoch without the removed member, rotates its
+	// keys and sends them to the devices of the new epoch
+	require.Eventually(t, func() bool {
+		epoch, key, err := adminGC.SecretStore().GetOwnMetadataKey(ctx, g)
+		return err == nil && key != nil && epoch > epochBeforeRemoval && knowsAdminMetadataKey(memberGC, epoch)
+	}, time.Second*20, time.Millisecond*100)
+
+	epoch, _, err := adminGC.SecretStore().GetOwnMetadataKey(ctx, g)
+	require.NoError(t, err)
+	require.False(t, knowsAdminMetadataKey(removedGC, epoch))
+
+	tip := adminGC.MetadataStore().Index().(*metadataStoreIndex).getEpochTip()
+	require.NotNil(t, tip)
+	require.Equal(t, 2, tip.tree.Size())
+	require.False(t, removedGC.SecretStore().IsGroupEpochKnown(ctx, g, tip.id.Bytes()))
+
+	messageReply, err := admin.Client.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("after removal"),
+	})
+	require.NoError(t, err)
+
+	messageCID, err := cid.Cast(messageReply.Cid)
+	require.NoError(t, err)
+
+	metadataReply, err := admin.Client.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("after removal"),
+	})
+	require.NoError(t, err)
+
+	metadataCID, err := cid.Cast(metadataReply.Cid)
+	require.NoError(t, err)
+
+	// both the remaining and the removed member replicate the entries, only
+	// the remaining member can open them
+	for _, gc := range []*GroupContext{memberGC, removedGC} {
+		require.Eventually(t, func() bool {
+			_, hasMessage := gc.MessageStore().OpLog().Get(messageCID)
+			_, hasMetadata := gc.MetadataStore().OpLog().Get(metadataCID)
+			return hasMessage && hasMetadata
+		}, time.Second*20, time.Millisecond*100)
+	}
+
+	openEntries := func(gc *GroupContext) (messageErr error, metadataErr error) {
+		messageEntry, _ := gc.MessageStore().OpLog().Get(messageCID)
+		_, messageErr = gc.MessageStore().openMessage(ctx, messageEntry)
+
+		metadataLog := gc.MetadataStore().OpLog()
+		metadataEntry, _ := metadataLog.Get(metadataCID)
+		_, _, metadataErr = openMetadataEntry(ctx, metadataLog, metadataEntry, g, gc.SecretStore())
+
+		return messageErr, metadataErr
+	}
+
+	messageErr, metadataErr := openEntries(memberGC)
+	require.NoError(t, messageErr)
+	require.NoError(t, metadataErr)
+
+	messageErr, metadataErr = openEntries(removedGC)
+	require.Error(t, messageErr)
+	require.Error(t, metadataErr)
+
+	// the remaining member never seals its events with the group secret
+	// after the removal, whether it has rotated its keys already or not
+	memberReply, err := member.Client.AppMetadataSend(ctx, &protocoltypes.AppMetadataSend_Request{
+		GroupPk: created.GroupPk,
+		Payload: []byte("after removal"),
+	})
+	require.NoError(t, err)
+
+	memberEpoch, memberKey, err := memberGC.SecretStore().GetOwnMetadataKey(ctx, g)
+	require.NoError(t, err)
+	require.NotNil(t, memberKey)
+	require.Greater(t, memberEpoch, epochBeforeRemoval)
+
+	memberMetadataCID, err := cid.Cast(memberReply.Cid)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, ok := removedGC.MetadataStore().OpLog().Get(memberMetadataCID)
+		return ok
+	}, time.Second*20, time.Millisecond*100)
+
+	removedLog := removedGC.MetadataStore().OpLog()
+	memberEntry, _ := removedLog.Get(memberMetadataCID)
+	_, _, err = openMetadataEntry(ctx, removedLog, memberEntry, g, removedGC.SecretStore())
+	require.Error(t, err)
+}
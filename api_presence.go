@@ -0,0 +1,82 @@
+package weshnet
+
+import (
+	"context"
+	"time"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// PresenceSettingsSet changes the settings of the presence beacons published
+// to the contacts
+func (s *service) PresenceSettingsSet(ctx context.Context, req *protocoltypes.PresenceSettingsSet_Request) (_ *protocoltypes.PresenceSettingsSet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting presence settings")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().PresenceSettingsSet(ctx, req.Settings); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.PresenceSettingsSet_Reply{}, nil
+}
+
+// PresenceSettingsGet retrieves the settings of the presence beacons
+func (s *service) PresenceSettingsGet(context.Context, *protocoltypes.PresenceSettingsGet_Request) (*protocoltypes.PresenceSettingsGet_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	return &protocoltypes.PresenceSettingsGet_Reply{
+		Settings: accountGroup.MetadataStore().GetPresenceSettings(),
+	}, nil
+}
+
+// ContactPresenceWatch streams the presence of the requested contacts, or of
+// all the added contacts, then its changes
+func (s *service) ContactPresenceWatch(req *protocoltypes.ContactPresenceWatch_Request, sub protocoltypes.ProtocolService_ContactPresenceWatchServer) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	sent := map[string]*protocoltypes.ContactPresenceWatch_Reply{}
+	for {
+		contactPKs := req.ContactPks
+		if len(contactPKs) == 0 {
+			for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+				contactPKs = append(contactPKs, contact.Pk)
+			}
+		}
+
+		replies, version := s.presence.status(contactPKs, time.Now())
+		for _, reply := range replies {
+			if previous, ok := sent[string(reply.ContactPk)]; ok && previous.Online == reply.Online && previous.LastSeen == reply.LastSeen {
+				continue
+			}
+
+			if err := sub.Send(reply); err != nil {
+				return err
+			}
+
+			sent[string(reply.ContactPk)] = reply
+		}
+
+		// contacts go offline without a beacon, their presence is checked
+		// again after the interval
+		ctx, cancel := context.WithTimeout(sub.Context(), contactPresenceInterval)
+		s.presence.waitForChange(ctx, version)
+		cancel()
+
+		if sub.Context().Err() != nil {
+			return nil
+		}
+	}
+}
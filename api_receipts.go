@@ -0,0 +1,86 @@
+package weshnet
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// ReadReceiptsSet enables or disables the read receipts sent by all the
+// devices of the account
+func (s *service) ReadReceiptsSet(ctx context.Context, req *protocoltypes.ReadReceiptsSet_Request) (_ *protocoltypes.ReadReceiptsSet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting read receipts")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().ReadReceiptsSet(ctx, req.Disabled); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.ReadReceiptsSet_Reply{}, nil
+}
+
+// ReadReceiptsGet returns whether the account sends read receipts
+func (s *service) ReadReceiptsGet(context.Context, *protocoltypes.ReadReceiptsGet_Request) (*protocoltypes.ReadReceiptsGet_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	return &protocoltypes.ReadReceiptsGet_Reply{
+		Disabled: accountGroup.MetadataStore().AreReadReceiptsDisabled(),
+	}, nil
+}
+
+// MessageMarkRead sends a read receipt for messages of an activated group,
+// nothing is sent when the account has disabled the read receipts
+func (s *service) MessageMarkRead(ctx context.Context, req *protocoltypes.MessageMarkRead_Request) (_ *protocoltypes.MessageMarkRead_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Marking messages as read")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	cg, release, err := s.retainContextGroupForID(req.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	ids := make([][]byte, len(req.Cids))
+	now := time.Now()
+	for i, raw := range req.Cids {
+		id, err := cid.Cast(raw)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		}
+
+		// the messages deleted once read expire even if no receipt is sent
+		if err := s.retention.startExpiryOnRead(ctx, req.GroupPk, id, now); err != nil {
+			return nil, err
+		}
+
+		ids[i] = id.Bytes()
+	}
+
+	if accountGroup.MetadataStore().AreReadReceiptsDisabled() {
+		return &protocoltypes.MessageMarkRead_Reply{Sent: false}, nil
+	}
+
+	if _, err := cg.MetadataStore().MarkMessagesRead(ctx, ids); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.MessageMarkRead_Reply{Sent: true}, nil
+}
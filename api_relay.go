@@ -0,0 +1,275 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/relaytypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// RelayServiceDeposit seals a message of the group and deposits it in the
+// current mailbox of the group on the relay
+func (s *service) RelayServiceDeposit(ctx context.Context, request *protocoltypes.RelayServiceDeposit_Request) (_ *protocoltypes.RelayServiceDeposit_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Depositing message on relay")
+	defer func() { endSection(err, "") }()
+
+	if request.RelayServer == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid relay server"))
+	}
+
+	if request.Ttl < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid ttl"))
+	}
+
+	gc, release, err := s.retainContextGroupForID(request.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	_, c, err := cid.CidFromBytes(request.Cid)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	envelope, err := gc.messageStore.GetOutOfStoreMessageEnvelope(ctx, c)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	payload, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	mailbox, err := relayMailbox(gc.Group(), s.odb.rotationInterval, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := s.dialService(request.RelayServer, request.Token)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+
+	reply, err := relaytypes.NewRelayServiceClient(cc).Deposit(ctx, &relaytypes.RelayDeposit_Request{
+		Mailbox: mailbox,
+		Payload: payload,
+		Ttl:     request.Ttl,
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrServiceRelayServer.Wrap(err)
+	}
+
+	return &protocoltypes.RelayServiceDeposit_Reply{ExpiresAt: reply.ExpiresAt}, nil
+}
+
+// fetchRelayMailbox fetches the envelopes deposited in a mailbox after the
+// cursor, each mailbox is fetched on its own connection so the relay can't
+// link the mailboxes of a group by the calls
+func (s *service) fetchRelayMailbox(ctx context.Context, server string, token string, mailbox []byte, cursor uint64) ([][]byte, uint64, error) {
+	cc, err := s.dialService(server, token)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cc.Close()
+
+	client := relaytypes.NewRelayServiceClient(cc)
+
+	payloads := [][]byte{}
+	for {
+		reply, err := client.Fetch(ctx, &relaytypes.RelayFetch_Request{
+			Mailboxes: [][]byte{mailbox},
+			Cursor:    cursor,
+		})
+		if err != nil {
+			return nil, 0, errcode.ErrCode_ErrServiceRelayServer.Wrap(err)
+		}
+
+		for _, envelope := range reply.Envelopes {
+			payloads = append(payloads, envelope.Payload)
+		}
+
+		cursor = reply.Cursor
+		if !reply.More {
+			return payloads, cursor, nil
+		}
+	}
+}
+
+// RelayServiceFetch fetches the envelopes deposited in the mailboxes of the
+// group since the last fetch and opens them
+func (s *service) RelayServiceFetch(ctx context.Context, request *protocoltypes.RelayServiceFetch_Request) (_ *protocoltypes.RelayServiceFetch_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Fetching messages from relay")
+	defer func() { endSection(err, "") }()
+
+	if request.RelayServer == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid relay server"))
+	}
+
+	gc, release, err := s.retainContextGroupForID(request.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	mailboxes, err := relayMailboxes(gc.Group(), s.odb.rotationInterval, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := [][]byte{}
+	cursors := make([]uint64, len(mailboxes))
+	for i, mailbox := range mailboxes {
+		cursor, err := s.relayCursors.get(ctx, request.RelayServer, request.GroupPk, mailbox)
+		if err != nil {
+			return nil, err
+		}
+
+		fetched, cursor, err := s.fetchRelayMailbox(ctx, request.RelayServer, request.Token, mailbox, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		payloads = append(payloads, fetched...)
+		cursors[i] = cursor
+	}
+
+	results := outOfStoreReceiveBatch(ctx, s.secretStore, payloads).Results
+
+	// the envelopes are opened before the cursors are stored, they are
+	// fetched again if the device stops meanwhile
+	for i, mailbox := range mailboxes {
+		if err := s.relayCursors.put(ctx, request.RelayServer, request.GroupPk, mailbox, cursors[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.relayCursors.prune(ctx, request.RelayServer, request.GroupPk, mailboxes); err != nil {
+		s.logger.Warn("unable to prune relay cursors", logutil.PrivateString("relay", request.RelayServer), zap.Error(err))
+	}
+
+	return &protocoltypes.RelayServiceFetch_Reply{Results: results}, nil
+}
+
+// RelayServiceSubscribe streams the envelopes deposited in the mailboxes of
+// the group since the last fetch then the new ones, the envelopes which can't
+// be opened are skipped
+func (s *service) RelayServiceSubscribe(request *protocoltypes.RelayServiceSubscribe_Request, srv protocoltypes.ProtocolService_RelayServiceSubscribeServer) error {
+	ctx := srv.Context()
+
+	if request.RelayServer == "" {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid relay server"))
+	}
+
+	gc, release, err := s.retainContextGroupForID(request.GroupPk)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	// the mailbox of the next periods isn't known by the stream, it is
+	// opened until the end of the current period and the client
+	// subscribes again
+	now := time.Now()
+	ctx, cancel := context.WithDeadline(ctx, s.odb.rotationInterval.NextTimePeriod(now))
+	defer cancel()
+
+	mailboxes, err := relayMailboxes(gc.Group(), s.odb.rotationInterval, now)
+	if err != nil {
+		return err
+	}
+
+	send := func(payload []byte) error {
+		message, group, cleartext, alreadyReceived, err := s.secretStore.OpenOutOfStoreMessage(ctx, payload)
+		if err != nil {
+			s.logger.Warn("unable to open relayed envelope", logutil.PrivateString("relay", request.RelayServer), zap.Error(err))
+		} else if err := srv.Send(&protocoltypes.OutOfStoreReceive_Reply{
+			Message:         message,
+			Cleartext:       cleartext,
+			GroupPublicKey:  group.PublicKey,
+			AlreadyReceived: alreadyReceived,
+		}); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// the mailboxes of the past periods don't receive new envelopes, they
+	// are fetched one by one and only the current one is streamed
+	for _, mailbox := range mailboxes[1:] {
+		cursor, err := s.relayCursors.get(ctx, request.RelayServer, request.GroupPk, mailbox)
+		if err != nil {
+			return err
+		}
+
+		payloads, cursor, err := s.fetchRelayMailbox(ctx, request.RelayServer, request.Token, mailbox, cursor)
+		if err != nil {
+			return err
+		}
+
+		for _, payload := range payloads {
+			if err := send(payload); err != nil {
+				return err
+			}
+		}
+
+		if err := s.relayCursors.put(ctx, request.RelayServer, request.GroupPk, mailbox, cursor); err != nil {
+			return err
+		}
+	}
+
+	if err := s.relayCursors.prune(ctx, request.RelayServer, request.GroupPk, mailboxes); err != nil {
+		s.logger.Warn("unable to prune relay cursors", logutil.PrivateString("relay", request.RelayServer), zap.Error(err))
+	}
+
+	current := mailboxes[0]
+	cursor, err := s.relayCursors.get(ctx, request.RelayServer, request.GroupPk, current)
+	if err != nil {
+		return err
+	}
+
+	cc, err := s.dialService(request.RelayServer, request.Token)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	sub, err := relaytypes.NewRelayServiceClient(cc).Subscribe(ctx, &relaytypes.RelaySubscribe_Request{
+		Mailboxes: [][]byte{current},
+		Cursor:    cursor,
+	})
+	if err != nil {
+		return errcode.ErrCode_ErrServiceRelayServer.Wrap(err)
+	}
+
+	for {
+		envelope, err := sub.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return errcode.ErrCode_ErrServiceRelayServer.Wrap(err)
+		}
+
+		if err := send(envelope.Payload); err != nil {
+			return err
+		}
+
+		if err := s.relayCursors.put(ctx, request.RelayServer, request.GroupPk, current, envelope.Cursor); err != nil {
+			return err
+		}
+	}
+}
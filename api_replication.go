@@ -2,9 +2,9 @@ package weshnet
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -59,10 +59,11 @@ func (s *service) ReplicationServiceRegisterGroup(ctx context.Context, request *
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid replication server"))
 	}
 
-	gc, err := s.GetContextGroupForID(request.GroupPk)
+	gc, release, err := s.retainContextGroupForID(request.GroupPk)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
+	defer release()
 
 	replGroup, err := FilterGroupForReplication(gc.group)
 	if err != nil {
@@ -74,37 +75,175 @@ func (s *service) ReplicationServiceRegisterGroup(ctx context.Context, request *
 		return nil, errcode.ErrCode_ErrGroupMissing
 	}
 
-	gopts := []grpc.DialOption{
-		grpc.WithPerRPCCredentials(grpcutil.NewUnsecureSimpleAuthAccess("bearer", request.Token)),
+	if request.Ttl < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid ttl"))
 	}
 
-	if s.grpcInsecure {
-		gopts = append(gopts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	} else {
-		tlsconfig := credentials.NewTLS(&tls.Config{
-			MinVersion: tls.VersionTLS12,
-		})
-		gopts = append(gopts, grpc.WithTransportCredentials(tlsconfig))
+	client, closeClient, err := s.replicationServiceClient(request.ReplicationServer, request.Token)
+	if err != nil {
+		return nil, err
 	}
+	defer closeClient()
+
+	// the other servers replicating the group are sent as hints so the
+	// servers exchange the heads of the group between them
+	hints := replicationtypes.ProviderHints(request.ReplicationServer, replicationServerNames(gc.metadataStore.ListReplicationServers(time.Now())))
 
-	cc, err := grpc.NewClient("passthrough://"+request.ReplicationServer, gopts...)
+	reply, err := client.ReplicateGroup(ctx, &replicationtypes.ReplicationServiceReplicateGroup_Request{
+		Group:     replGroup,
+		Ttl:       request.Ttl,
+		Providers: hints,
+	})
 	if err != nil {
-		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
+		return nil, errcode.ErrCode_ErrServiceReplicationServer.Wrap(err)
+	}
+
+	s.logger.Info("group will be replicated", logutil.PrivateString("public-key", base64.RawURLEncoding.EncodeToString(request.GroupPk)), zap.Int("providers", len(hints)+1))
+
+	if _, err := gc.metadataStore.SendGroupReplicating(ctx, request.AuthenticationUrl, request.ReplicationServer, reply.ExpiresAt); err != nil {
+		s.logger.Error("error while notifying group about replication", zap.Error(err))
 	}
 
-	client := replicationtypes.NewReplicationServiceClient(cc)
+	return &protocoltypes.ReplicationServiceRegisterGroup_Reply{
+		ExpiresAt: reply.ExpiresAt,
+		Providers: replicationtypes.ProviderHints(request.ReplicationServer, hints, reply.Providers),
+	}, nil
+}
+
+func (s *service) ReplicationServiceUnregisterGroup(ctx context.Context, request *protocoltypes.ReplicationServiceUnregisterGroup_Request) (_ *protocoltypes.ReplicationServiceUnregisterGroup_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Unregistering replication service for group")
+	defer func() { endSection(err, "") }()
 
-	if _, err = client.ReplicateGroup(ctx, &replicationtypes.ReplicationServiceReplicateGroup_Request{
-		Group: replGroup,
+	if request.GroupPk == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid GroupPK"))
+	}
+
+	if request.Token == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+	}
+
+	if request.ReplicationServer == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid replication server"))
+	}
+
+	client, closeClient, err := s.replicationServiceClient(request.ReplicationServer, request.Token)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+
+	if _, err := client.UnregisterGroup(ctx, &replicationtypes.ReplicationServiceUnregisterGroup_Request{
+		GroupPublicKey: base64.RawURLEncoding.EncodeToString(request.GroupPk),
 	}); err != nil {
 		return nil, errcode.ErrCode_ErrServiceReplicationServer.Wrap(err)
 	}
 
-	s.logger.Info("group will be replicated", logutil.PrivateString("public-key", base64.RawURLEncoding.EncodeToString(request.GroupPk)))
+	s.logger.Info("group will not be replicated anymore", logutil.PrivateString("public-key", base64.RawURLEncoding.EncodeToString(request.GroupPk)))
 
-	if _, err := gc.metadataStore.SendGroupReplicating(ctx, request.AuthenticationUrl, request.ReplicationServer); err != nil {
-		s.logger.Error("error while notifying group about replication", zap.Error(err))
+	// the group can be unregistered after it has been left, the members are
+	// only notified if it is still open
+	if gc, release, err := s.retainContextGroupForID(request.GroupPk); err == nil {
+		if _, err := gc.metadataStore.SendGroupUnreplicating(ctx, request.ReplicationServer); err != nil {
+			s.logger.Error("error while notifying group about replication", zap.Error(err))
+		}
+
+		release()
+	}
+
+	return &protocoltypes.ReplicationServiceUnregisterGroup_Reply{}, nil
+}
+
+// ReplicationServiceListProviders lists the replication servers the members
+// of the group have registered it with
+func (s *service) ReplicationServiceListProviders(_ context.Context, request *protocoltypes.ReplicationServiceListProviders_Request) (*protocoltypes.ReplicationServiceListProviders_Reply, error) {
+	if request.GroupPk == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid GroupPK"))
+	}
+
+	gc, release, err := s.retainContextGroupForID(request.GroupPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+	defer release()
+
+	return &protocoltypes.ReplicationServiceListProviders_Reply{
+		Providers: gc.metadataStore.ListReplicationServers(time.Now()),
+	}, nil
+}
+
+func replicationServerNames(servers []*protocoltypes.GroupReplicating) []string {
+	names := make([]string, len(servers))
+	for i, server := range servers {
+		names[i] = server.ReplicationServer
+	}
+
+	return names
+}
+
+// ReplicationServiceProbe checks that the replication server replicates the
+// groups registered with the token, using a canary entry written to a probe
+// group
+func (s *service) ReplicationServiceProbe(ctx context.Context, request *protocoltypes.ReplicationServiceProbe_Request) (_ *protocoltypes.ReplicationServiceProbe_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Probing replication service")
+	defer func() { endSection(err, "") }()
+
+	if request.Token == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid token"))
+	}
+
+	if request.ReplicationServer == "" {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid replication server"))
+	}
+
+	if request.Timeout < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid timeout"))
+	}
+
+	timeout := replicationProbeTimeout
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return s.probeReplication(ctx, request.ReplicationServer, request.Token)
+}
+
+// replicationServiceClient returns a client of the replication server
+// authenticated with the token
+func (s *service) replicationServiceClient(server string, token string) (replicationtypes.ReplicationServiceClient, func(), error) {
+	cc, err := s.dialService(server, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return replicationtypes.NewReplicationServiceClient(cc), func() { _ = cc.Close() }, nil
+}
+
+// dialService returns a connection to a service server, authenticated with
+// the token if it is set
+func (s *service) dialService(server string, token string) (*grpc.ClientConn, error) {
+	gopts := []grpc.DialOption{}
+
+	if token != "" {
+		gopts = append(gopts, grpc.WithPerRPCCredentials(grpcutil.NewUnsecureSimpleAuthAccess("bearer", token)))
+	}
+
+	if s.grpcInsecure {
+		gopts = append(gopts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	} else {
+		config := s.tlsPins.tlsConfig()
+		config.Certificates = s.tlsClientCertificates
+
+		tlsconfig := credentials.NewTLS(config)
+		gopts = append(gopts, grpc.WithTransportCredentials(tlsconfig))
+	}
+
+	cc, err := grpc.NewClient("passthrough://"+server, gopts...)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
 	}
 
-	return &protocoltypes.ReplicationServiceRegisterGroup_Reply{}, nil
+	return cc, nil
 }
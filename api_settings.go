@@ -0,0 +1,102 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// AccountSettingsSet sets or deletes an application setting shared between
+// the devices of the account
+func (s *service) AccountSettingsSet(ctx context.Context, req *protocoltypes.AccountSettingsSet_Request) (_ *protocoltypes.AccountSettingsSet_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Setting account setting")
+	defer func() { endSection(err, "") }()
+
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	if _, err := accountGroup.MetadataStore().AccountSettingSet(ctx, req.Key, req.Value, req.Delete); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return &protocoltypes.AccountSettingsSet_Reply{}, nil
+}
+
+// AccountSettingsGet returns the application settings shared between the
+// devices of the account
+func (s *service) AccountSettingsGet(_ context.Context, req *protocoltypes.AccountSettingsGet_Request) (*protocoltypes.AccountSettingsGet_Reply, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	return &protocoltypes.AccountSettingsGet_Reply{
+		Settings: accountGroup.MetadataStore().ListAccountSettings(req.Keys),
+	}, nil
+}
+
+// AccountSettingsWatch sends the current application settings then their
+// changes, whether they are made on the current device or on another one
+func (s *service) AccountSettingsWatch(req *protocoltypes.AccountSettingsWatch_Request, sub protocoltypes.ProtocolService_AccountSettingsWatchServer) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	evtSub, err := accountGroup.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/api/account-settings-watch"), eventbus.BufSize(32))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to new events")
+	}
+	defer evtSub.Close()
+
+	sent := map[string]*protocoltypes.AccountSetting{}
+	sendChanges := func(initial bool) error {
+		for _, setting := range accountGroup.MetadataStore().listAccountSettings(req.Keys, true) {
+			if previous, ok := sent[setting.Key]; ok && previous.UpdatedAt == setting.UpdatedAt && bytes.Equal(previous.DevicePk, setting.DevicePk) {
+				continue
+			}
+
+			sent[setting.Key] = setting
+
+			// the settings deleted before the subscription are not sent
+			if initial && setting.Deleted {
+				continue
+			}
+
+			if err := sub.Send(&protocoltypes.AccountSettingsWatch_Reply{Setting: setting}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := sendChanges(true); err != nil {
+		return err
+	}
+
+	for {
+		var evt interface{}
+		select {
+		case <-sub.Context().Done():
+			return nil
+		case evt = <-evtSub.Out():
+		}
+
+		if e, ok := evt.(*protocoltypes.GroupMetadataEvent); !ok || e.GetMetadata().GetEventType() != protocoltypes.EventType_EventTypeAccountSettingSet {
+			continue
+		}
+
+		if err := sendChanges(false); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package weshnet
+
+import (
+	"context"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+// StorageUnlock only checks the passphrase once the service is started, the
+// storage of a service started without its passphrase is unlocked by the
+// locked service
+func (s *service) StorageUnlock(ctx context.Context, req *protocoltypes.StorageUnlock_Request) (*protocoltypes.StorageUnlock_Reply, error) {
+	if s.encryptedStorage == nil {
+		return nil, errcode.ErrCode_ErrStorageNotEncrypted
+	}
+
+	if err := s.encryptedStorage.CheckPassphrase(ctx, req.Passphrase); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.StorageUnlock_Reply{}, nil
+}
+
+// StorageChangePassphrase seals the master key of the encrypted storage with
+// a new passphrase
+func (s *service) StorageChangePassphrase(ctx context.Context, req *protocoltypes.StorageChangePassphrase_Request) (*protocoltypes.StorageChangePassphrase_Reply, error) {
+	if s.encryptedStorage == nil {
+		return nil, errcode.ErrCode_ErrStorageNotEncrypted
+	}
+
+	if err := s.encryptedStorage.ChangePassphrase(ctx, req.CurrentPassphrase, req.NewPassphrase); err != nil {
+		return nil, err
+	}
+
+	return &protocoltypes.StorageChangePassphrase_Reply{}, nil
+}
+
+// StorageStats reports the disk usage of the node broken down by datastore
+// namespace, activated group and attachments
+func (s *service) StorageStats(ctx context.Context, _ *protocoltypes.StorageStats_Request) (*protocoltypes.StorageStats_Reply, error) {
+	return s.storageStats(ctx)
+}
+
+// StorageGC deletes the local data not needed anymore and compacts the
+// datastore, it reports the space reclaimed
+func (s *service) StorageGC(ctx context.Context, req *protocoltypes.StorageGC_Request) (_ *protocoltypes.StorageGC_Reply, err error) {
+	ctx, _, endSection := tyber.Section(ctx, s.logger, "Collecting storage garbage")
+	defer func() { endSection(err, "") }()
+
+	return s.collectGarbage(ctx, req)
+}
@@ -15,7 +15,7 @@ import (
 
 func (s *service) CredentialVerificationServiceInitFlow(ctx context.Context, request *protocoltypes.CredentialVerificationServiceInitFlow_Request) (*protocoltypes.CredentialVerificationServiceInitFlow_Reply, error) {
 	s.lock.Lock()
-	s.vcClient = bertyvcissuer.NewClient(request.ServiceUrl)
+	s.vcClient = bertyvcissuer.NewClientWithHTTPClient(request.ServiceUrl, s.httpClient)
 	client := s.vcClient
 	s.lock.Unlock()
 
@@ -0,0 +1,333 @@
+package weshnet
+
+import (
+	"context"
+	"math/bits"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// attachmentTransferRetryDelay is the delay before resuming a transfer which
+// failed, after a loss of the network for instance
+const attachmentTransferRetryDelay = 10 * time.Second
+
+func newAttachmentTransfer(attachmentCID []byte) *protocoltypes.AttachmentTransfer {
+	return &protocoltypes.AttachmentTransfer{AttachmentCid: attachmentCID}
+}
+
+// setAttachmentTransferManifest sizes the transfer once the manifest of the
+// attachment is known
+func setAttachmentTransferManifest(t *protocoltypes.AttachmentTransfer, manifest *protocoltypes.AttachmentManifest) {
+	if len(t.Chunks) > 0 || t.Completed {
+		return
+	}
+
+	t.Size = manifest.Size
+	t.ChunkCount = uint32(len(manifest.ChunkCids))
+	t.Chunks = make([]byte, (t.ChunkCount+7)/8)
+	t.Completed = t.ChunkCount == 0
+}
+
+func hasAttachmentTransferChunk(t *protocoltypes.AttachmentTransfer, index uint64) bool {
+	return index < uint64(t.ChunkCount) && t.Chunks[index/8]&(1<<(index%8)) != 0
+}
+
+// setAttachmentTransferChunk marks a chunk as available locally, it returns
+// false if it already was
+func setAttachmentTransferChunk(t *protocoltypes.AttachmentTransfer, index uint64, size uint64) bool {
+	if index >= uint64(t.ChunkCount) || hasAttachmentTransferChunk(t, index) {
+		return false
+	}
+
+	t.Chunks[index/8] |= 1 << (index % 8)
+	t.TransferredBytes += size
+
+	count := 0
+	for _, b := range t.Chunks {
+		count += bits.OnesCount8(b)
+	}
+
+	t.Completed = count == int(t.ChunkCount)
+
+	return true
+}
+
+// getTransfer returns the transfer of the attachment, nil if there is none
+func (a *attachmentStore) getTransfer(ctx context.Context, attachmentCID []byte) (*protocoltypes.AttachmentTransfer, error) {
+	data, err := a.datastore.Get(ctx, dsKeyForAttachment(dsNamespaceAttachmentTransfers, attachmentCID))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	t := &protocoltypes.AttachmentTransfer{}
+	if err := proto.Unmarshal(data, t); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return t, nil
+}
+
+// putTransfer stores the transfer and notifies its watchers
+func (a *attachmentStore) putTransfer(ctx context.Context, t *protocoltypes.AttachmentTransfer) error {
+	data, err := proto.Marshal(t)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := a.datastore.Put(ctx, dsKeyForAttachment(dsNamespaceAttachmentTransfers, t.AttachmentCid), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	a.mu.Lock()
+	a.version++
+	a.notify.Broadcast()
+	a.mu.Unlock()
+
+	return nil
+}
+
+// updateTransfer applies update to the transfer of the attachment, creating
+// it if needed, and stores it if update returns true
+func (a *attachmentStore) updateTransfer(ctx context.Context, attachmentCID []byte, update func(t *protocoltypes.AttachmentTransfer) bool) (*protocoltypes.AttachmentTransfer, error) {
+	a.muTransfers.Lock()
+	defer a.muTransfers.Unlock()
+
+	t, err := a.getTransfer(ctx, attachmentCID)
+	if err != nil {
+		return nil, err
+	}
+
+	created := t == nil
+	if created {
+		t = newAttachmentTransfer(attachmentCID)
+	}
+
+	if !update(t) && !created {
+		return t, nil
+	}
+
+	if err := a.putTransfer(ctx, t); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// recordChunk marks a fetched chunk as available in the transfer of the
+// attachment
+func (a *attachmentStore) recordChunk(ctx context.Context, attachmentCID []byte, manifest *protocoltypes.AttachmentManifest, index uint64, size uint64) error {
+	_, err := a.updateTransfer(ctx, attachmentCID, func(t *protocoltypes.AttachmentTransfer) bool {
+		setAttachmentTransferManifest(t, manifest)
+		return setAttachmentTransferChunk(t, index, size)
+	})
+
+	return err
+}
+
+// transferStatus returns the transfer of the attachment, nil if there is
+// none, and the version it has been read at
+func (a *attachmentStore) transferStatus(ctx context.Context, attachmentCID []byte) (*protocoltypes.AttachmentTransfer, uint64, error) {
+	a.mu.Lock()
+	version := a.version
+	a.mu.Unlock()
+
+	t, err := a.getTransfer(ctx, attachmentCID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return t, version, nil
+}
+
+// waitForChange waits until a transfer changes after the given version or
+// the context is done
+func (a *attachmentStore) waitForChange(ctx context.Context, version uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for a.version == version {
+		if !a.notify.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// startTransfer fetches the missing chunks of the attachment in the
+// background until they are all available locally or ctx is done
+func (a *attachmentStore) startTransfer(ctx context.Context, attachmentCID []byte) error {
+	if _, err := cid.Cast(attachmentCID); err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := a.getKey(ctx, attachmentCID); err != nil {
+		return err
+	}
+
+	t, err := a.updateTransfer(ctx, attachmentCID, func(*protocoltypes.AttachmentTransfer) bool { return false })
+	if err != nil {
+		return err
+	}
+
+	if t.Completed {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.running[string(attachmentCID)]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	a.running[string(attachmentCID)] = cancel
+
+	go func() {
+		defer func() {
+			a.mu.Lock()
+			delete(a.running, string(attachmentCID))
+			a.mu.Unlock()
+
+			cancel()
+		}()
+
+		a.runTransfer(ctx, attachmentCID)
+	}()
+
+	return nil
+}
+
+// stopTransfer stops the background transfer of the attachment, if any
+func (a *attachmentStore) stopTransfer(attachmentCID []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if cancel, ok := a.running[string(attachmentCID)]; ok {
+		cancel()
+		delete(a.running, string(attachmentCID))
+	}
+}
+
+// runTransfer fetches the missing chunks of the attachment, the transfer is
+// retried until it completes or ctx is done
+func (a *attachmentStore) runTransfer(ctx context.Context, attachmentCID []byte) {
+	logger := a.logger.With(logutil.PrivateBinary("cid", attachmentCID))
+
+	for {
+		err := a.transfer(ctx, attachmentCID)
+		if err == nil {
+			logger.Debug("attachment transfer completed")
+			return
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logger.Warn("attachment transfer interrupted, retrying", zap.Error(err))
+
+		select {
+		case <-time.After(attachmentTransferRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *attachmentStore) transfer(ctx context.Context, attachmentCID []byte) error {
+	key, manifest, err := a.manifest(ctx, a.ipfs.Dag(), attachmentCID)
+	if err != nil {
+		return err
+	}
+
+	// the chunks already stored for another attachment aren't fetched again
+	if err := a.putChunkRefs(ctx, attachmentCID, manifest); err != nil {
+		return err
+	}
+
+	t, err := a.updateTransfer(ctx, attachmentCID, func(t *protocoltypes.AttachmentTransfer) bool {
+		sized := len(t.Chunks) > 0 || t.Completed
+		setAttachmentTransferManifest(t, manifest)
+		return !sized
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range manifest.ChunkCids {
+		if hasAttachmentTransferChunk(t, uint64(i)) {
+			continue
+		}
+
+		// the background transfers use the bulk lane, they don't delay
+		// the messages
+		release, err := a.lanes.acquire(ctx, protocoltypes.SendPriority_SendPriorityBulk)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.fetchChunk(ctx, attachmentCID, key, manifest, uint64(i))
+		release()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeTransfers starts again the transfers which haven't completed
+func (a *attachmentStore) resumeTransfers(ctx context.Context) error {
+	results, err := a.datastore.Query(ctx, query.Query{Prefix: datastore.NewKey(dsNamespaceAttachmentTransfers).String()})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		t := &protocoltypes.AttachmentTransfer{}
+		if err := proto.Unmarshal(entry.Value, t); err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if t.Completed {
+			continue
+		}
+
+		if err := a.startTransfer(ctx, t.AttachmentCid); err != nil {
+			a.logger.Warn("unable to resume attachment transfer", logutil.PrivateBinary("cid", t.AttachmentCid), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// resumeAttachmentTransfers resumes the attachment transfers interrupted by
+// the previous shutdown of the service
+func (s *service) resumeAttachmentTransfers() {
+	if s.ipfsCoreAPI == nil {
+		return
+	}
+
+	go func() {
+		if err := s.attachments.resumeTransfers(s.ctx); err != nil {
+			s.logger.Error("unable to resume attachment transfers", zap.Error(err))
+		}
+	}()
+}
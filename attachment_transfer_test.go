@@ -0,0 +1,82 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestAttachmentTransferChunks(t *testing.T) {
+	manifest := &protocoltypes.AttachmentManifest{
+		Size:      2*attachmentChunkSize + 10,
+		ChunkCids: [][]byte{[]byte("1"), []byte("2"), []byte("3")},
+	}
+
+	transfer := newAttachmentTransfer([]byte("attachment"))
+	setAttachmentTransferManifest(transfer, manifest)
+	require.Equal(t, uint32(3), transfer.ChunkCount)
+	require.False(t, transfer.Completed)
+
+	require.True(t, setAttachmentTransferChunk(transfer, 2, 10))
+	require.True(t, hasAttachmentTransferChunk(transfer, 2))
+	require.False(t, hasAttachmentTransferChunk(transfer, 0))
+
+	// chunks are only counted once
+	require.False(t, setAttachmentTransferChunk(transfer, 2, 10))
+	require.False(t, setAttachmentTransferChunk(transfer, 3, 10))
+	require.Equal(t, uint64(10), transfer.TransferredBytes)
+
+	require.True(t, setAttachmentTransferChunk(transfer, 0, attachmentChunkSize))
+	require.True(t, setAttachmentTransferChunk(transfer, 1, attachmentChunkSize))
+	require.True(t, transfer.Completed)
+	require.Equal(t, manifest.Size, transfer.TransferredBytes)
+
+	// the manifest of a started transfer isn't applied again
+	setAttachmentTransferManifest(transfer, &protocoltypes.AttachmentManifest{})
+	require.Equal(t, uint32(3), transfer.ChunkCount)
+}
+
+func TestAttachmentTransferPersistence(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	manifest := &protocoltypes.AttachmentManifest{
+		Size:      attachmentChunkSize + 10,
+		ChunkCids: [][]byte{[]byte("1"), []byte("2")},
+	}
+
+	a := newAttachmentStore(datastore, nil, newSendLanes(), zap.NewNop())
+
+	transfer, version, err := a.transferStatus(ctx, []byte("attachment"))
+	require.NoError(t, err)
+	require.Nil(t, transfer)
+
+	require.NoError(t, a.recordChunk(ctx, []byte("attachment"), manifest, 0, attachmentChunkSize))
+
+	// the watchers are notified of the progress
+	a.waitForChange(ctx, version)
+
+	// the progress is kept after a restart
+	a = newAttachmentStore(datastore, nil, newSendLanes(), zap.NewNop())
+
+	transfer, _, err = a.transferStatus(ctx, []byte("attachment"))
+	require.NoError(t, err)
+	require.NotNil(t, transfer)
+	require.Equal(t, uint64(attachmentChunkSize), transfer.TransferredBytes)
+	require.True(t, hasAttachmentTransferChunk(transfer, 0))
+	require.False(t, hasAttachmentTransferChunk(transfer, 1))
+	require.False(t, transfer.Completed)
+
+	require.NoError(t, a.recordChunk(ctx, []byte("attachment"), manifest, 1, 10))
+
+	transfer, _, err = a.transferStatus(ctx, []byte("attachment"))
+	require.NoError(t, err)
+	require.True(t, transfer.Completed)
+}
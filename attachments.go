@@ -0,0 +1,855 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	coreiface "github.com/ipfs/kubo/core/coreiface"
+	"github.com/ipfs/kubo/core/coreiface/options"
+	mh "github.com/multiformats/go-multihash"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// attachmentChunkSize is the size of the chunks of an attachment before
+	// their encryption
+	attachmentChunkSize = 256 * 1024
+
+	// attachmentManifestIndex is used in place of a chunk index to derive
+	// the nonce of the manifest
+	attachmentManifestIndex = math.MaxUint64
+
+	// attachmentConvergentChunkContext and attachmentConvergentManifestContext
+	// separate the keys derived from the content of the chunks and of the
+	// manifests of the deduplicated attachments
+	attachmentConvergentChunkContext    = "weshnet attachment chunk"
+	attachmentConvergentManifestContext = "weshnet attachment manifest"
+)
+
+const (
+	// dsNamespaceAttachmentKeys stores the key of each attachment known
+	// locally, prepared by the account or attached to a received message
+	dsNamespaceAttachmentKeys = "keys"
+
+	// dsNamespaceAttachmentMessages stores the attachments of each message
+	dsNamespaceAttachmentMessages = "messages"
+
+	// dsNamespaceAttachmentRefs stores the messages referencing each
+	// attachment with the key they sent, an attachment is deleted with the
+	// last one
+	dsNamespaceAttachmentRefs = "refs"
+
+	// dsNamespaceAttachmentTransfers stores the progress of the transfer of
+	// each attachment
+	dsNamespaceAttachmentTransfers = "transfers"
+
+	// dsNamespaceAttachmentPrepared stores the time at which the attachments
+	// have been prepared locally or found without reference, those which are
+	// never sent are pruned once they are old enough
+	dsNamespaceAttachmentPrepared = "prepared"
+
+	// dsNamespaceAttachmentChunks stores the attachments using each chunk
+	// available locally, a chunk shared by several attachments is deleted
+	// with the last one
+	dsNamespaceAttachmentChunks = "chunks"
+)
+
+// attachmentStore stores the attachments as chunks encrypted using a key
+// generated for each of them and sent in the messages referencing them. The
+// blocks of an attachment are deleted when all the messages referencing it
+// are pruned, the attachments prepared but never sent are kept.
+type attachmentStore struct {
+	datastore datastore.Datastore
+	ipfs      coreiface.CoreAPI
+	logger    *zap.Logger
+
+	// lanes throttles the background transfers
+	lanes *sendLanes
+
+	// running stores the cancel functions of the transfers in progress
+	running map[string]context.CancelFunc
+
+	// version is incremented on each change of a transfer
+	version uint64
+	notify  *notify.Notify
+	mu      sync.Mutex
+
+	// muTransfers serializes the updates of the stored transfers
+	muTransfers sync.Mutex
+}
+
+func newAttachmentStore(ds datastore.Datastore, ipfs coreiface.CoreAPI, lanes *sendLanes, logger *zap.Logger) *attachmentStore {
+	a := &attachmentStore{
+		datastore: ds,
+		ipfs:      ipfs,
+		lanes:     lanes,
+		logger:    logger.Named("attachments"),
+		running:   make(map[string]context.CancelFunc),
+	}
+	a.notify = notify.New(&a.mu)
+
+	return a
+}
+
+func dsKeyForAttachment(namespace string, parts ...[]byte) datastore.Key {
+	namespaces := []string{namespace}
+	for _, part := range parts {
+		namespaces = append(namespaces, base64.RawURLEncoding.EncodeToString(part))
+	}
+
+	return datastore.KeyWithNamespaces(namespaces)
+}
+
+// attachmentNonce returns the nonce of a chunk, the key being used for a
+// single attachment the index of the chunk is enough to make it unique
+func attachmentNonce(index uint64) *[24]byte {
+	nonce := &[24]byte{}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+
+	return nonce
+}
+
+func sealAttachmentBlock(key *[32]byte, index uint64, data []byte) []byte {
+	return secretbox.Seal(nil, data, attachmentNonce(index), key)
+}
+
+// convergentAttachmentKey derives the key of a deduplicated chunk or manifest
+// from its content, the same content is always sealed into the same block
+func convergentAttachmentKey(context string, data []byte) *[32]byte {
+	h := sha256.New()
+	h.Write([]byte(context))
+	h.Write(data)
+
+	key := &[32]byte{}
+	copy(key[:], h.Sum(nil))
+
+	return key
+}
+
+func openAttachmentBlock(key *[32]byte, index uint64, sealed []byte) ([]byte, error) {
+	data, ok := secretbox.Open(nil, sealed, attachmentNonce(index), key)
+	if !ok {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open attachment block %d", index))
+	}
+
+	return data, nil
+}
+
+// putBlock encrypts the block and adds it to the ipfs node
+func (a *attachmentStore) putBlock(ctx context.Context, key *[32]byte, index uint64, data []byte) (cid.Cid, error) {
+	node, err := cbornode.WrapObject(sealAttachmentBlock(key, index, data), mh.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := a.ipfs.Dag().Add(ctx, node); err != nil {
+		return cid.Undef, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	return node.Cid(), nil
+}
+
+// getAttachmentBlock fetches the block using dag, from the network if it is
+// online, and decrypts it
+func getAttachmentBlock(ctx context.Context, dag coreiface.APIDagService, key *[32]byte, index uint64, id cid.Cid) ([]byte, error) {
+	node, err := dag.Get(ctx, id)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(err)
+	}
+
+	var sealed []byte
+	if err := cbornode.DecodeInto(node.RawData(), &sealed); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return openAttachmentBlock(key, index, sealed)
+}
+
+// attachmentChunkKey returns the key of a chunk of the attachment, the key of
+// the attachment unless it is deduplicated
+func attachmentChunkKey(key *[32]byte, manifest *protocoltypes.AttachmentManifest, index uint64) *[32]byte {
+	if len(manifest.ChunkKeys) == 0 {
+		return key
+	}
+
+	chunkKey := &[32]byte{}
+	copy(chunkKey[:], manifest.ChunkKeys[index])
+
+	return chunkKey
+}
+
+// attachmentWriter splits the written data in chunks, the attachment is
+// complete once closed
+type attachmentWriter struct {
+	ctx      context.Context
+	store    *attachmentStore
+	key      *[32]byte
+	buf      []byte
+	sizes    []uint64
+	manifest *protocoltypes.AttachmentManifest
+
+	// deduplicate derives the keys from the content instead of generating
+	// one for the attachment
+	deduplicate bool
+}
+
+func (a *attachmentStore) newWriter(ctx context.Context, deduplicate bool) (*attachmentWriter, error) {
+	w := &attachmentWriter{
+		ctx:         ctx,
+		store:       a,
+		manifest:    &protocoltypes.AttachmentManifest{},
+		deduplicate: deduplicate,
+	}
+
+	// the key of a deduplicated attachment is derived from its manifest
+	if !deduplicate {
+		w.key = &[32]byte{}
+		if _, err := crand.Read(w.key[:]); err != nil {
+			return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		}
+	}
+
+	return w, nil
+}
+
+func (w *attachmentWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	for len(w.buf) >= attachmentChunkSize {
+		if err := w.flush(attachmentChunkSize); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *attachmentWriter) flush(size int) error {
+	key := w.key
+	if w.deduplicate {
+		key = convergentAttachmentKey(attachmentConvergentChunkContext, w.buf[:size])
+		w.manifest.ChunkKeys = append(w.manifest.ChunkKeys, key[:])
+	}
+
+	id, err := w.store.putBlock(w.ctx, key, uint64(len(w.manifest.ChunkCids)), w.buf[:size])
+	if err != nil {
+		return err
+	}
+
+	w.manifest.ChunkCids = append(w.manifest.ChunkCids, id.Bytes())
+	w.manifest.Size += uint64(size)
+	w.sizes = append(w.sizes, uint64(size))
+	w.buf = w.buf[size:]
+
+	return nil
+}
+
+// Close stores the last chunk and the manifest, it returns the identifier
+// of the attachment
+func (w *attachmentWriter) Close() (cid.Cid, error) {
+	if len(w.buf) > 0 {
+		if err := w.flush(len(w.buf)); err != nil {
+			return cid.Undef, err
+		}
+	}
+
+	// the same file must give the same manifest to be deduplicated
+	manifest, err := proto.MarshalOptions{Deterministic: true}.Marshal(w.manifest)
+	if err != nil {
+		return cid.Undef, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if w.deduplicate {
+		w.key = convergentAttachmentKey(attachmentConvergentManifestContext, manifest)
+	}
+
+	id, err := w.store.putBlock(w.ctx, w.key, attachmentManifestIndex, manifest)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := w.store.putChunkRefs(w.ctx, id.Bytes(), w.manifest); err != nil {
+		return cid.Undef, err
+	}
+
+	if err := w.store.datastore.Put(w.ctx, dsKeyForAttachment(dsNamespaceAttachmentKeys, id.Bytes()), w.key[:]); err != nil {
+		return cid.Undef, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := w.store.putPrepared(w.ctx, id.Bytes(), time.Now()); err != nil {
+		return cid.Undef, err
+	}
+
+	// all the chunks of a prepared attachment are available locally
+	transfer := newAttachmentTransfer(id.Bytes())
+	setAttachmentTransferManifest(transfer, w.manifest)
+	for i, size := range w.sizes {
+		setAttachmentTransferChunk(transfer, uint64(i), size)
+	}
+
+	if err := w.store.putTransfer(w.ctx, transfer); err != nil {
+		return cid.Undef, err
+	}
+
+	return id, nil
+}
+
+// getKey returns the key of an attachment known locally
+func (a *attachmentStore) getKey(ctx context.Context, id []byte) (*[32]byte, error) {
+	data, err := a.datastore.Get(ctx, dsKeyForAttachment(dsNamespaceAttachmentKeys, id))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("unknown attachment"))
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if len(data) != 32 {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid attachment key"))
+	}
+
+	key := &[32]byte{}
+	copy(key[:], data)
+
+	return key, nil
+}
+
+// manifest fetches the manifest of an attachment with its key. The key stored
+// for an attachment is never overwritten by the keys sent by the messages
+// referencing it, it is only replaced by one of them once it fails to open
+// the manifest, so a member can't replace the key of an attachment sent by
+// another one.
+func (a *attachmentStore) manifest(ctx context.Context, dag coreiface.APIDagService, attachmentCID []byte) (*[32]byte, *protocoltypes.AttachmentManifest, error) {
+	id, err := cid.Cast(attachmentCID)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	key, err := a.getKey(ctx, attachmentCID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := getAttachmentManifest(ctx, dag, key, id)
+	if err == nil || !errcode.Is(err, errcode.ErrCode_ErrCryptoDecrypt) {
+		return key, manifest, err
+	}
+
+	candidates, qerr := a.referencedKeys(ctx, attachmentCID)
+	if qerr != nil {
+		return nil, nil, qerr
+	}
+
+	for _, candidate := range candidates {
+		if *candidate == *key {
+			continue
+		}
+
+		if manifest, cerr := getAttachmentManifest(ctx, dag, candidate, id); cerr == nil {
+			if err := a.datastore.Put(ctx, dsKeyForAttachment(dsNamespaceAttachmentKeys, attachmentCID), candidate[:]); err != nil {
+				return nil, nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+
+			return candidate, manifest, nil
+		}
+	}
+
+	return nil, nil, err
+}
+
+// referencedKeys returns the keys sent by the messages referencing the
+// attachment
+func (a *attachmentStore) referencedKeys(ctx context.Context, attachmentCID []byte) ([]*[32]byte, error) {
+	results, err := a.datastore.Query(ctx, query.Query{Prefix: dsKeyForAttachment(dsNamespaceAttachmentRefs, attachmentCID).String()})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	keys := []*[32]byte{}
+	for _, entry := range entries {
+		if len(entry.Value) != 32 {
+			continue
+		}
+
+		key := &[32]byte{}
+		copy(key[:], entry.Value)
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// getAttachmentManifest fetches and decrypts the manifest of an attachment
+func getAttachmentManifest(ctx context.Context, dag coreiface.APIDagService, key *[32]byte, id cid.Cid) (*protocoltypes.AttachmentManifest, error) {
+	data, err := getAttachmentBlock(ctx, dag, key, attachmentManifestIndex, id)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &protocoltypes.AttachmentManifest{}
+	if err := proto.Unmarshal(data, manifest); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if len(manifest.ChunkKeys) > 0 {
+		if len(manifest.ChunkKeys) != len(manifest.ChunkCids) {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid number of chunk keys"))
+		}
+
+		for _, chunkKey := range manifest.ChunkKeys {
+			if len(chunkKey) != 32 {
+				return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid chunk key"))
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+// putChunkRefs records the chunks used by an attachment. The chunks of a
+// deduplicated attachment are shared, and the CID of a deduplicated chunk can
+// be derived from the content of the file, so any manifest can list it: the
+// chunks of every attachment are counted.
+func (a *attachmentStore) putChunkRefs(ctx context.Context, attachmentCID []byte, manifest *protocoltypes.AttachmentManifest) error {
+	for _, chunkCID := range manifest.ChunkCids {
+		if err := a.datastore.Put(ctx, dsKeyForAttachment(dsNamespaceAttachmentChunks, chunkCID, attachmentCID), []byte{}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// releaseChunk drops the reference of the attachment to a chunk, it returns
+// true if no other attachment uses the chunk
+func (a *attachmentStore) releaseChunk(ctx context.Context, attachmentCID []byte, chunkCID []byte) (bool, error) {
+	if err := a.datastore.Delete(ctx, dsKeyForAttachment(dsNamespaceAttachmentChunks, chunkCID, attachmentCID)); err != nil {
+		return false, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	results, err := a.datastore.Query(ctx, query.Query{
+		Prefix:   dsKeyForAttachment(dsNamespaceAttachmentChunks, chunkCID).String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return len(entries) == 0, nil
+}
+
+// retrieve fetches the chunks of an attachment from the given offset and
+// passes them in order to send once decrypted, the fetched chunks are
+// recorded in the transfer of the attachment
+func (a *attachmentStore) retrieve(ctx context.Context, attachmentCID []byte, offset uint64, send func(block []byte) error) error {
+	key, manifest, err := a.manifest(ctx, a.ipfs.Dag(), attachmentCID)
+	if err != nil {
+		return err
+	}
+
+	if offset > manifest.Size {
+		return errcode.ErrCode_ErrInvalidRange.Wrap(fmt.Errorf("offset %d exceeds the attachment size %d", offset, manifest.Size))
+	}
+
+	start := offset / attachmentChunkSize
+	size := start * attachmentChunkSize
+	for i := start; i < uint64(len(manifest.ChunkCids)); i++ {
+		chunk, err := a.fetchChunk(ctx, attachmentCID, key, manifest, i)
+		if err != nil {
+			return err
+		}
+
+		size += uint64(len(chunk))
+		if i == start {
+			chunk = chunk[offset-start*attachmentChunkSize:]
+		}
+
+		if len(chunk) == 0 {
+			continue
+		}
+
+		if err := send(chunk); err != nil {
+			return err
+		}
+	}
+
+	if size != manifest.Size {
+		return errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("attachment size mismatch, expected %d bytes, got %d", manifest.Size, size))
+	}
+
+	return nil
+}
+
+// fetchChunk fetches and decrypts a chunk of an attachment and records it
+// in its transfer, all the chunks but the last one must be full
+func (a *attachmentStore) fetchChunk(ctx context.Context, attachmentCID []byte, key *[32]byte, manifest *protocoltypes.AttachmentManifest, index uint64) ([]byte, error) {
+	id, err := cid.Cast(manifest.ChunkCids[index])
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	chunk, err := getAttachmentBlock(ctx, a.ipfs.Dag(), attachmentChunkKey(key, manifest, index), index, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if index < uint64(len(manifest.ChunkCids))-1 && len(chunk) != attachmentChunkSize {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid size for chunk %d", index))
+	}
+
+	if err := a.recordChunk(ctx, attachmentCID, manifest, index, uint64(len(chunk))); err != nil {
+		a.logger.Warn("unable to record attachment chunk", logutil.PrivateBinary("cid", attachmentCID), zap.Error(err))
+	}
+
+	return chunk, nil
+}
+
+// secrets returns the keys of the attachments to send in a message
+func (a *attachmentStore) secrets(ctx context.Context, attachmentCIDs [][]byte) ([]*protocoltypes.AttachmentSecret, error) {
+	secrets := make([]*protocoltypes.AttachmentSecret, len(attachmentCIDs))
+
+	for i, attachmentCID := range attachmentCIDs {
+		if _, err := cid.Cast(attachmentCID); err != nil {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		}
+
+		key, err := a.getKey(ctx, attachmentCID)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets[i] = &protocoltypes.AttachmentSecret{Cid: attachmentCID, Key: key[:]}
+	}
+
+	return secrets, nil
+}
+
+// record stores the keys of the attachments of a message and the
+// references used to delete them with it, the key of an attachment already
+// known is kept and the key sent by the message is only kept with its
+// reference, see manifest
+func (a *attachmentStore) record(ctx context.Context, groupPK []byte, messageID cid.Cid, attachments []*protocoltypes.AttachmentSecret) error {
+	for _, attachment := range attachments {
+		if _, err := cid.Cast(attachment.Cid); err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if len(attachment.Key) != 32 {
+			return errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid attachment key"))
+		}
+
+		keys := []datastore.Key{
+			dsKeyForAttachment(dsNamespaceAttachmentMessages, groupPK, messageID.Bytes(), attachment.Cid),
+			dsKeyForAttachment(dsNamespaceAttachmentRefs, attachment.Cid, groupPK, messageID.Bytes()),
+		}
+		values := [][]byte{{}, attachment.Key}
+
+		keyID := dsKeyForAttachment(dsNamespaceAttachmentKeys, attachment.Cid)
+		if known, err := a.datastore.Has(ctx, keyID); err != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(err)
+		} else if !known {
+			keys, values = append(keys, keyID), append(values, attachment.Key)
+		}
+
+		for i, key := range keys {
+			if err := a.datastore.Put(ctx, key, values[i]); err != nil {
+				return errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// release drops the references of a message to its attachments, the
+// attachments not referenced anymore are deleted
+func (a *attachmentStore) release(ctx context.Context, groupPK []byte, messageID cid.Cid) error {
+	_, err := a.releasePrefix(ctx, groupPK, dsKeyForAttachment(dsNamespaceAttachmentMessages, groupPK, messageID.Bytes()))
+	return err
+}
+
+// releaseGroup drops the references of all the messages of a group to their
+// attachments, it returns the size of the chunks of the deleted attachments
+func (a *attachmentStore) releaseGroup(ctx context.Context, groupPK []byte) (uint64, error) {
+	return a.releasePrefix(ctx, groupPK, dsKeyForAttachment(dsNamespaceAttachmentMessages, groupPK))
+}
+
+func (a *attachmentStore) releasePrefix(ctx context.Context, groupPK []byte, prefix datastore.Key) (uint64, error) {
+	results, err := a.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	groupPrefix := dsKeyForAttachment(dsNamespaceAttachmentMessages, groupPK).String() + "/"
+	reclaimed := uint64(0)
+
+	for _, entry := range entries {
+		// the keys are made of the message and the attachment
+		parts := strings.Split(strings.TrimPrefix(entry.Key, groupPrefix), "/")
+		if len(parts) != 2 {
+			return reclaimed, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid attachment reference"))
+		}
+
+		messageID, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return reclaimed, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		attachmentCID, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return reclaimed, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if err := a.datastore.Delete(ctx, datastore.NewKey(entry.Key)); err != nil {
+			return reclaimed, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if err := a.datastore.Delete(ctx, dsKeyForAttachment(dsNamespaceAttachmentRefs, attachmentCID, groupPK, messageID)); err != nil {
+			return reclaimed, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		referenced, err := a.isReferenced(ctx, attachmentCID)
+		if err != nil {
+			return reclaimed, err
+		}
+
+		if !referenced {
+			reclaimed += a.transferredBytes(ctx, attachmentCID)
+			a.remove(ctx, attachmentCID)
+		}
+	}
+
+	return reclaimed, nil
+}
+
+// isReferenced returns true if a message still references the attachment
+func (a *attachmentStore) isReferenced(ctx context.Context, attachmentCID []byte) (bool, error) {
+	results, err := a.datastore.Query(ctx, query.Query{
+		Prefix:   dsKeyForAttachment(dsNamespaceAttachmentRefs, attachmentCID).String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return len(entries) > 0, nil
+}
+
+// remove deletes the blocks of the attachment kept locally and its key, the
+// blocks which haven't been fetched are ignored
+func (a *attachmentStore) remove(ctx context.Context, attachmentCID []byte) {
+	logger := a.logger.With(logutil.PrivateBinary("cid", attachmentCID))
+
+	a.stopTransfer(attachmentCID)
+
+	id, err := cid.Cast(attachmentCID)
+	if err != nil {
+		logger.Warn("invalid attachment cid", zap.Error(err))
+		return
+	}
+
+	// only the blocks available locally are looked up
+	offline, err := a.ipfs.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		logger.Warn("unable to get offline ipfs api", zap.Error(err))
+		return
+	}
+
+	if _, manifest, err := a.manifest(ctx, offline.Dag(), attachmentCID); err == nil {
+		for _, chunkCID := range manifest.ChunkCids {
+			// the chunks can be used by other attachments
+			if unused, err := a.releaseChunk(ctx, attachmentCID, chunkCID); err != nil || !unused {
+				continue
+			}
+
+			if chunkID, err := cid.Cast(chunkCID); err == nil {
+				_ = offline.Dag().Remove(ctx, chunkID)
+			}
+		}
+	}
+
+	_ = offline.Dag().Remove(ctx, id)
+
+	if err := a.datastore.Delete(ctx, dsKeyForAttachment(dsNamespaceAttachmentTransfers, attachmentCID)); err != nil {
+		logger.Warn("unable to delete attachment transfer", zap.Error(err))
+		return
+	}
+
+	if err := a.datastore.Delete(ctx, dsKeyForAttachment(dsNamespaceAttachmentPrepared, attachmentCID)); err != nil {
+		logger.Warn("unable to delete attachment preparation time", zap.Error(err))
+		return
+	}
+
+	if err := a.datastore.Delete(ctx, dsKeyForAttachment(dsNamespaceAttachmentKeys, attachmentCID)); err != nil {
+		logger.Warn("unable to delete attachment key", zap.Error(err))
+		return
+	}
+
+	logger.Debug("attachment deleted")
+}
+
+func (a *attachmentStore) putPrepared(ctx context.Context, attachmentCID []byte, at time.Time) error {
+	value := binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+	if err := a.datastore.Put(ctx, dsKeyForAttachment(dsNamespaceAttachmentPrepared, attachmentCID), value); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// transferredBytes returns the size of the chunks of the attachment
+// available locally, 0 if it can't be read
+func (a *attachmentStore) transferredBytes(ctx context.Context, attachmentCID []byte) uint64 {
+	transfer, err := a.getTransfer(ctx, attachmentCID)
+	if err != nil || transfer == nil {
+		return 0
+	}
+
+	return transfer.TransferredBytes
+}
+
+// listKnown returns the identifiers of the attachments known locally
+func (a *attachmentStore) listKnown(ctx context.Context) ([][]byte, error) {
+	prefix := dsKeyForAttachment(dsNamespaceAttachmentKeys).String() + "/"
+
+	results, err := a.datastore.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	ids := make([][]byte, len(entries))
+	for i, entry := range entries {
+		if ids[i], err = base64.RawURLEncoding.DecodeString(strings.TrimPrefix(entry.Key, prefix)); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	return ids, nil
+}
+
+// usage returns the number of attachments known locally and the size of
+// their chunks available locally
+func (a *attachmentStore) usage(ctx context.Context) (uint64, uint64, error) {
+	ids, err := a.listKnown(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	size := uint64(0)
+	for _, id := range ids {
+		size += a.transferredBytes(ctx, id)
+	}
+
+	return uint64(len(ids)), size, nil
+}
+
+// pruneOrphans deletes the attachments referenced by no message which have
+// been prepared before the given time, except those in keep. The orphans
+// without preparation time are given one, so they are only pruned by a later
+// call. It returns the number of attachments deleted and the size of their
+// chunks.
+func (a *attachmentStore) pruneOrphans(ctx context.Context, keep map[string]struct{}, before time.Time) (uint64, uint64, error) {
+	ids, err := a.listKnown(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, reclaimed := uint64(0), uint64(0)
+
+	for _, id := range ids {
+		if _, ok := keep[string(id)]; ok {
+			continue
+		}
+
+		referenced, err := a.isReferenced(ctx, id)
+		if err != nil {
+			return count, reclaimed, err
+		}
+
+		if referenced {
+			continue
+		}
+
+		value, err := a.datastore.Get(ctx, dsKeyForAttachment(dsNamespaceAttachmentPrepared, id))
+		switch {
+		case err == datastore.ErrNotFound:
+			if err := a.putPrepared(ctx, id, time.Now()); err != nil {
+				return count, reclaimed, err
+			}
+
+			continue
+		case err != nil:
+			return count, reclaimed, errcode.ErrCode_ErrDBRead.Wrap(err)
+		case len(value) != 8:
+			return count, reclaimed, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid attachment preparation time"))
+		}
+
+		if !time.Unix(0, int64(binary.BigEndian.Uint64(value))).Before(before) {
+			continue
+		}
+
+		reclaimed += a.transferredBytes(ctx, id)
+		count++
+
+		a.remove(ctx, id)
+	}
+
+	return count, reclaimed, nil
+}
+
+// recordAttachments stores the keys of the attachments of the messages
+// received on the group
+func (s *service) recordAttachments(gc *GroupContext) {
+	groupPK := gc.Group().PublicKey
+
+	gc.messageStore.setAttachmentsRecorder(func(id cid.Cid, attachments []*protocoltypes.AttachmentSecret) {
+		if err := s.attachments.record(s.ctx, groupPK, id, attachments); err != nil {
+			s.logger.Warn("unable to record message attachments", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		}
+	})
+}
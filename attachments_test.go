@@ -0,0 +1,159 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestAttachmentBlock(t *testing.T) {
+	key := &[32]byte{1, 2, 3}
+
+	sealed := sealAttachmentBlock(key, 3, []byte("chunk"))
+
+	data, err := openAttachmentBlock(key, 3, sealed)
+	require.NoError(t, err)
+	require.Equal(t, []byte("chunk"), data)
+
+	// chunks can't be reordered
+	_, err = openAttachmentBlock(key, 4, sealed)
+	require.Error(t, err)
+
+	_, err = openAttachmentBlock(&[32]byte{}, 3, sealed)
+	require.Error(t, err)
+}
+
+func TestAttachmentReferences(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newAttachmentStore(dsync.MutexWrap(ds.NewMapDatastore()), nil, newSendLanes(), zap.NewNop())
+
+	newCID := func(data string) cid.Cid {
+		hash, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+		require.NoError(t, err)
+		return cid.NewCidV1(cid.DagCBOR, hash)
+	}
+
+	attachment := &protocoltypes.AttachmentSecret{Cid: newCID("attachment").Bytes(), Key: make([]byte, 32)}
+	attachment.Key[0] = 42
+
+	_, err := a.secrets(ctx, [][]byte{attachment.Cid})
+	require.Error(t, err)
+
+	require.NoError(t, a.record(ctx, []byte("group"), newCID("message 1"), []*protocoltypes.AttachmentSecret{attachment}))
+	require.NoError(t, a.record(ctx, []byte("group"), newCID("message 2"), []*protocoltypes.AttachmentSecret{attachment}))
+
+	secrets, err := a.secrets(ctx, [][]byte{attachment.Cid})
+	require.NoError(t, err)
+	require.Len(t, secrets, 1)
+	require.Equal(t, attachment.Key, secrets[0].Key)
+
+	// the attachment is kept while a message references it
+	require.NoError(t, a.release(ctx, []byte("group"), newCID("message 1")))
+
+	referenced, err := a.isReferenced(ctx, attachment.Cid)
+	require.NoError(t, err)
+	require.True(t, referenced)
+
+	_, err = a.getKey(ctx, attachment.Cid)
+	require.NoError(t, err)
+
+	// invalid keys are rejected
+	require.Error(t, a.record(ctx, []byte("group"), newCID("message 3"), []*protocoltypes.AttachmentSecret{{Cid: attachment.Cid, Key: []byte("key")}}))
+
+	// the key of a known attachment isn't overwritten, the key sent by the
+	// message is kept with its reference
+	require.NoError(t, a.record(ctx, []byte("group"), newCID("message 4"), []*protocoltypes.AttachmentSecret{{Cid: attachment.Cid, Key: make([]byte, 32)}}))
+
+	secrets, err = a.secrets(ctx, [][]byte{attachment.Cid})
+	require.NoError(t, err)
+	require.Equal(t, attachment.Key, secrets[0].Key)
+
+	keys, err := a.referencedKeys(ctx, attachment.Cid)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+}
+
+func TestAttachmentDeduplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	prepare := func(deduplicate bool, data []byte) []byte {
+		w, err := s.attachments.newWriter(ctx, deduplicate)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		id, err := w.Close()
+		require.NoError(t, err)
+
+		return id.Bytes()
+	}
+
+	retrieve := func(id []byte) []byte {
+		data := []byte{}
+		require.NoError(t, s.attachments.retrieve(ctx, id, 0, func(block []byte) error {
+			data = append(data, block...)
+			return nil
+		}))
+
+		return data
+	}
+
+	file := append(bytes.Repeat([]byte("a"), attachmentChunkSize), []byte("end of file")...)
+	other := append(bytes.Repeat([]byte("a"), attachmentChunkSize), []byte("other end")...)
+
+	// the same file gives the same attachment once deduplicated
+	id := prepare(true, file)
+	require.Equal(t, id, prepare(true, file))
+	require.NotEqual(t, id, prepare(false, file))
+	require.Equal(t, file, retrieve(id))
+
+	// the first chunk is shared with the other file
+	otherID := prepare(true, other)
+	require.NotEqual(t, id, otherID)
+
+	// and kept until the last attachment using it is deleted
+	s.attachments.remove(ctx, id)
+
+	_, err := s.attachments.getKey(ctx, id)
+	require.Error(t, err)
+	require.Equal(t, other, retrieve(otherID))
+
+	// a manifest which is not deduplicated can list the deduplicated chunks,
+	// their CID is derived from the content of the file
+	_, otherManifest, err := s.attachments.manifest(ctx, s.attachments.ipfs.Dag(), otherID)
+	require.NoError(t, err)
+
+	crafted := &protocoltypes.AttachmentManifest{ChunkCids: otherManifest.ChunkCids, Size: otherManifest.Size}
+	data, err := proto.Marshal(crafted)
+	require.NoError(t, err)
+
+	craftedKey := &[32]byte{}
+	craftedID, err := s.attachments.putBlock(ctx, craftedKey, attachmentManifestIndex, data)
+	require.NoError(t, err)
+	require.NoError(t, s.attachments.putChunkRefs(ctx, craftedID.Bytes(), crafted))
+	require.NoError(t, s.attachments.datastore.Put(ctx, dsKeyForAttachment(dsNamespaceAttachmentKeys, craftedID.Bytes()), craftedKey[:]))
+
+	_, _, err = s.attachments.manifest(ctx, s.attachments.ipfs.Dag(), craftedID.Bytes())
+	require.NoError(t, err)
+
+	// it doesn't delete the chunks of the other attachments
+	s.attachments.remove(ctx, craftedID.Bytes())
+	require.Equal(t, other, retrieve(otherID))
+}
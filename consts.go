@@ -8,6 +8,22 @@ const (
 	NamespaceOrbitDBDatastore = "orbitdb_datastore"
 	NamespaceOrbitDBDirectory = "orbitdb"
 	NamespaceIPFSDatastore    = "ipfs_datastore"
+	NamespaceMessageRetention = "message_retention"
+	NamespaceDeviceActivity   = "device_activity"
+	NamespaceHistorySync      = "history_sync"
+	NamespaceAttachments      = "attachments"
+	NamespaceOutbox           = "outbox"
+	NamespaceMessageSearch    = "message_search"
+	NamespaceMessageReactions = "message_reactions"
+	NamespaceLogCompaction    = "log_compaction"
+	NamespaceIndexCache       = "index_cache"
+	NamespaceSyncPolicy       = "sync_policy"
+	NamespaceReplicationProbe = "replication_probe"
+	NamespaceRelayCursors     = "relay_cursors"
 )
 
+// ProtocolEpoch is the epoch of the protocol implemented by this package, it is
+// advertised in the shared contacts and incremented on incompatible changes
+const ProtocolEpoch = 1
+
 var InMemoryDirectory = cacheleveldown.InMemoryDirectory
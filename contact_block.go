@@ -0,0 +1,98 @@
+package weshnet
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// setContactGroupBlocked closes the group shared with a contact when it is
+// blocked, and activates it again once the contact is unblocked
+func (s *service) setContactGroupBlocked(ctx context.Context, contactPK crypto.PubKey, blocked bool) error {
+	g, err := s.getContactGroup(contactPK)
+	if err != nil {
+		return err
+	}
+
+	pk, err := g.GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if blocked {
+		return s.deactivateGroup(pk)
+	}
+
+	if s.groupActivity != nil {
+		return s.activateGroupLazily(ctx, pk)
+	}
+
+	if _, err := s.getOpenedGroup(g.PublicKey); err == nil {
+		return nil
+	}
+
+	return s.activateGroup(ctx, pk, false)
+}
+
+// watchBlockedContacts applies the blocks and unblocks made by any device of
+// the account to the contact groups opened on this one
+func (s *service) watchBlockedContacts() {
+	sub, err := s.accountEventBus.Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/contact-block"), eventbus.BufSize(32))
+	if err != nil {
+		s.logger.Warn("unable to subscribe to account metadata events", zap.Error(err))
+		return
+	}
+
+	go func() {
+		defer sub.Close()
+
+		for {
+			var evt interface{}
+			select {
+			case evt = <-sub.Out():
+			case <-s.ctx.Done():
+				return
+			}
+
+			e := evt.(*protocoltypes.GroupMetadataEvent)
+
+			var contact interface{ GetContactPk() []byte }
+			switch e.GetMetadata().GetEventType() {
+			case protocoltypes.EventType_EventTypeAccountContactBlocked:
+				contact = &protocoltypes.AccountContactBlocked{}
+			case protocoltypes.EventType_EventTypeAccountContactUnblocked:
+				contact = &protocoltypes.AccountContactUnblocked{}
+			default:
+				continue
+			}
+
+			if err := proto.Unmarshal(e.Event, contact.(proto.Message)); err != nil {
+				continue
+			}
+
+			contactPK, err := crypto.UnmarshalEd25519PublicKey(contact.GetContactPk())
+			if err != nil {
+				continue
+			}
+
+			accountGroup := s.getAccountGroup()
+			if accountGroup == nil {
+				continue
+			}
+
+			// events may be replicated out of order, the current status of the
+			// contact is used instead of the event type
+			blocked := accountGroup.MetadataStore().checkContactStatus(contactPK, protocoltypes.ContactState_ContactStateBlocked)
+			if err := s.setContactGroupBlocked(s.ctx, contactPK, blocked); err != nil {
+				s.logger.Warn("unable to update the group of a blocked contact", logutil.PrivateBinary("pk", contact.GetContactPk()), zap.Error(err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,123 @@
+package weshnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	contactIntroductionPrefix = "wesh/contact-introduction"
+
+	// contactIntroductionTTL is the time an introduction can be accepted for,
+	// the introducer only knows the rendezvous seed the introduced account
+	// used when they became contacts
+	contactIntroductionTTL = time.Hour * 24 * 7
+)
+
+func contactIntroductionPayload(introduction *protocoltypes.ContactIntroduction) []byte {
+	introduced := introduction.GetIntroduced()
+
+	payload := []byte(contactIntroductionPrefix)
+	payload = append(payload, introduction.IntroducerPk...)
+	payload = append(payload, introduction.RecipientPk...)
+	payload = append(payload, introduced.GetPk()...)
+	payload = append(payload, introduced.GetPublicRendezvousSeed()...)
+	payload = binary.BigEndian.AppendUint32(payload, introduced.GetProofOfWorkDifficulty())
+	payload = binary.BigEndian.AppendUint64(payload, uint64(introduction.ExpiresAt))
+
+	return payload
+}
+
+// signContactIntroduction creates the introduction of a contact to another
+// one, signed by the account of the introducer, the proof of work required by
+// the introduced account is kept so the recipient can still compute it
+func signContactIntroduction(introducer crypto.PrivKey, recipientPK []byte, introduced *protocoltypes.ShareableContact, now time.Time) (*protocoltypes.ContactIntroduction, error) {
+	introducerPK, err := introducer.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	introduction := &protocoltypes.ContactIntroduction{
+		IntroducerPk: introducerPK,
+		RecipientPk:  recipientPK,
+		Introduced: &protocoltypes.ShareableContact{
+			Pk:                    introduced.Pk,
+			PublicRendezvousSeed:  introduced.PublicRendezvousSeed,
+			ProofOfWorkDifficulty: introduced.ProofOfWorkDifficulty,
+		},
+		ExpiresAt: now.Add(contactIntroductionTTL).Unix(),
+	}
+
+	if err := checkContactIntroductionFormat(introduction); err != nil {
+		return nil, err
+	}
+
+	if introduction.Sig, err = introducer.Sign(contactIntroductionPayload(introduction)); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return introduction, nil
+}
+
+func checkContactIntroductionFormat(introduction *protocoltypes.ContactIntroduction) error {
+	if introduction == nil || introduction.Introduced == nil {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if err := introduction.Introduced.CheckFormat(); err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, err := crypto.UnmarshalEd25519PublicKey(introduction.RecipientPk); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if bytes.Equal(introduction.RecipientPk, introduction.Introduced.Pk) ||
+		bytes.Equal(introduction.IntroducerPk, introduction.Introduced.Pk) ||
+		bytes.Equal(introduction.IntroducerPk, introduction.RecipientPk) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an introduction involves three distinct accounts"))
+	}
+
+	return nil
+}
+
+// verifyContactIntroduction checks that the introduction has been signed by
+// its introducer
+func verifyContactIntroduction(introduction *protocoltypes.ContactIntroduction) error {
+	if err := checkContactIntroductionFormat(introduction); err != nil {
+		return err
+	}
+
+	introducerPK, err := crypto.UnmarshalEd25519PublicKey(introduction.IntroducerPk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	ok, err := introducerPK.Verify(contactIntroductionPayload(introduction), introduction.Sig)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification
+	}
+
+	return nil
+}
+
+// checkContactIntroductionExpiry rejects the introductions which can't be
+// accepted anymore, their rendezvous seed is likely to be stale
+func checkContactIntroductionExpiry(introduction *protocoltypes.ContactIntroduction, now time.Time) error {
+	if introduction.GetExpiresAt() <= now.Unix() {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("introduction expired"))
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package weshnet
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestContactIntroduction(t *testing.T) {
+	introducer, _ := newTestingAccountKey(t)
+	other, _ := newTestingAccountKey(t)
+	_, recipientPK := newTestingAccountKey(t)
+	_, introducedPK := newTestingAccountKey(t)
+
+	introduced := &protocoltypes.ShareableContact{
+		Pk:                    introducedPK,
+		PublicRendezvousSeed:  bytes.Repeat([]byte{1}, protocoltypes.RendezvousSeedLength),
+		ProofOfWorkDifficulty: 12,
+	}
+
+	now := time.Now()
+
+	introduction, err := signContactIntroduction(introducer, recipientPK, introduced, now)
+	require.NoError(t, err)
+	require.NoError(t, verifyContactIntroduction(introduction))
+
+	// the recipient must still provide the proof of work required by the
+	// introduced account
+	require.Equal(t, uint32(12), introduction.Introduced.ProofOfWorkDifficulty)
+
+	// the introduction can't be accepted once expired
+	require.NoError(t, checkContactIntroductionExpiry(introduction, now))
+	require.Error(t, checkContactIntroductionExpiry(introduction, now.Add(contactIntroductionTTL)))
+
+	// the rendezvous seed is required to send a contact request
+	_, err = signContactIntroduction(introducer, recipientPK, &protocoltypes.ShareableContact{Pk: introducedPK}, now)
+	require.Error(t, err)
+
+	// an account can't be introduced to itself
+	_, err = signContactIntroduction(introducer, introducedPK, introduced, now)
+	require.Error(t, err)
+
+	// the introduction can't be altered
+	introduction.Introduced.PublicRendezvousSeed = bytes.Repeat([]byte{2}, protocoltypes.RendezvousSeedLength)
+	require.Error(t, verifyContactIntroduction(introduction))
+
+	// the expiry and the proof of work can't be altered either
+	introduction.Introduced.PublicRendezvousSeed = introduced.PublicRendezvousSeed
+	require.NoError(t, verifyContactIntroduction(introduction))
+
+	introduction.Introduced.ProofOfWorkDifficulty = 0
+	require.Error(t, verifyContactIntroduction(introduction))
+
+	introduction.Introduced.ProofOfWorkDifficulty = introduced.ProofOfWorkDifficulty
+	introduction.ExpiresAt += int64(contactIntroductionTTL.Seconds())
+	require.Error(t, verifyContactIntroduction(introduction))
+
+	// the introduction must be signed by the introducer
+	forged, err := signContactIntroduction(other, recipientPK, introduced, now)
+	require.NoError(t, err)
+
+	forged.IntroducerPk = introduction.IntroducerPk
+	require.Error(t, verifyContactIntroduction(forged))
+}
@@ -0,0 +1,104 @@
+package weshnet
+
+import (
+	"bytes"
+	"sort"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// filterContacts returns the contacts having one of the given states, all the
+// contacts are kept if no state is given
+func filterContacts(contacts map[string]*AccountContact, states []protocoltypes.ContactState) map[string]*AccountContact {
+	if len(states) == 0 {
+		return contacts
+	}
+
+	filtered := make(map[string]*AccountContact, len(contacts))
+	for pk, contact := range contacts {
+		for _, state := range states {
+			if contact.state == state {
+				filtered[pk] = contact
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// pageContacts returns the replies listing the contacts sorted by public key,
+// skipping the first offset ones and keeping at most limit of them, a limit
+// of 0 keeps all of them
+func pageContacts(contacts map[string]*AccountContact, offset, limit uint32) []*protocoltypes.ContactList_Reply {
+	pks := sortedContacts(contacts)
+
+	if uint64(offset) >= uint64(len(pks)) {
+		return nil
+	}
+
+	pks = pks[offset:]
+	if limit != 0 && uint64(limit) < uint64(len(pks)) {
+		pks = pks[:limit]
+	}
+
+	replies := make([]*protocoltypes.ContactList_Reply, len(pks))
+	for i, pk := range pks {
+		replies[i] = newContactListReply(contacts[pk], false)
+	}
+
+	return replies
+}
+
+// diffContactList returns the replies describing the changes between the
+// previously listed contacts and the current contacts of an account matching
+// the given states, a listed contact no longer matching them is sent as
+// removed along with its current state
+func diffContactList(previous, contacts map[string]*AccountContact, states []protocoltypes.ContactState) []*protocoltypes.ContactList_Reply {
+	var replies []*protocoltypes.ContactList_Reply
+
+	current := filterContacts(contacts, states)
+
+	for _, pk := range sortedContacts(previous) {
+		if _, ok := current[pk]; ok {
+			continue
+		}
+
+		contact, ok := contacts[pk]
+		if !ok {
+			contact = previous[pk]
+		}
+
+		replies = append(replies, newContactListReply(contact, true))
+	}
+
+	for _, pk := range sortedContacts(current) {
+		contact := current[pk]
+		if known, ok := previous[pk]; ok && known.state == contact.state && bytes.Equal(known.contact.Metadata, contact.contact.Metadata) {
+			continue
+		}
+
+		replies = append(replies, newContactListReply(contact, false))
+	}
+
+	return replies
+}
+
+func newContactListReply(contact *AccountContact, removed bool) *protocoltypes.ContactList_Reply {
+	return &protocoltypes.ContactList_Reply{
+		Contact: contact.contact,
+		State:   contact.state,
+		Removed: removed,
+	}
+}
+
+func sortedContacts(contacts map[string]*AccountContact) []string {
+	pks := make([]string, 0, len(contacts))
+	for pk := range contacts {
+		pks = append(pks, pk)
+	}
+
+	sort.Strings(pks)
+
+	return pks
+}
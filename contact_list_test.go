@@ -0,0 +1,54 @@
+package weshnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestContactList(t *testing.T) {
+	newContact := func(pk string, state protocoltypes.ContactState) *AccountContact {
+		return &AccountContact{
+			state:   state,
+			contact: &protocoltypes.ShareableContact{Pk: []byte(pk)},
+		}
+	}
+
+	contacts := map[string]*AccountContact{
+		"alice":   newContact("alice", protocoltypes.ContactState_ContactStateAdded),
+		"bob":     newContact("bob", protocoltypes.ContactState_ContactStateReceived),
+		"charlie": newContact("charlie", protocoltypes.ContactState_ContactStateAdded),
+		"dave":    newContact("dave", protocoltypes.ContactState_ContactStateBlocked),
+	}
+
+	require.Len(t, filterContacts(contacts, nil), 4)
+
+	accepted := filterContacts(contacts, []protocoltypes.ContactState{protocoltypes.ContactState_ContactStateAdded})
+	require.Len(t, accepted, 2)
+
+	// contacts are sorted by public key
+	replies := pageContacts(contacts, 1, 2)
+	require.Len(t, replies, 2)
+	require.Equal(t, []byte("bob"), replies[0].Contact.Pk)
+	require.Equal(t, []byte("charlie"), replies[1].Contact.Pk)
+
+	require.Len(t, pageContacts(contacts, 1, 0), 3)
+	require.Empty(t, pageContacts(contacts, 4, 0))
+
+	require.Empty(t, diffContactList(accepted, contacts, []protocoltypes.ContactState{protocoltypes.ContactState_ContactStateAdded}))
+
+	updated := map[string]*AccountContact{
+		"alice":   newContact("alice", protocoltypes.ContactState_ContactStateAdded),
+		"bob":     newContact("bob", protocoltypes.ContactState_ContactStateAdded),
+		"charlie": newContact("charlie", protocoltypes.ContactState_ContactStateBlocked),
+		"dave":    newContact("dave", protocoltypes.ContactState_ContactStateBlocked),
+	}
+
+	replies = diffContactList(accepted, updated, []protocoltypes.ContactState{protocoltypes.ContactState_ContactStateAdded})
+	require.Equal(t, []*protocoltypes.ContactList_Reply{
+		{Contact: updated["charlie"].contact, State: protocoltypes.ContactState_ContactStateBlocked, Removed: true},
+		{Contact: updated["bob"].contact, State: protocoltypes.ContactState_ContactStateAdded},
+	}, replies)
+}
@@ -0,0 +1,335 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+const (
+	// contactPresenceInterval is the delay between two presence beacons
+	// published on a contact group
+	contactPresenceInterval = time.Minute
+
+	// contactPresenceTimeout is the delay after which a contact is considered
+	// offline without a new beacon, older beacons are rejected
+	contactPresenceTimeout = 3 * contactPresenceInterval
+
+	contactPresencePrefix = "wesh/contact-presence"
+)
+
+// contactPresenceTopic returns the pubsub topic on which the members of a
+// contact group publish their presence beacons
+func contactPresenceTopic(g *protocoltypes.Group) string {
+	return contactPresencePrefix + "/" + g.GroupIDAsString()
+}
+
+func contactPresencePayload(groupPK, accountPK []byte, sentAt int64) []byte {
+	payload := make([]byte, 0, len(contactPresencePrefix)+len(groupPK)+len(accountPK)+8)
+	payload = append(payload, contactPresencePrefix...)
+	payload = append(payload, groupPK...)
+	payload = append(payload, accountPK...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(sentAt))
+
+	return payload
+}
+
+// sealContactPresenceBeacon creates a beacon signed by the account and sealed
+// with the secret of the contact group, only the contact can open it
+func sealContactPresenceBeacon(g *protocoltypes.Group, md secretstore.OwnMemberDevice, sentAt time.Time) ([]byte, error) {
+	accountPK, err := md.Member().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	beacon := &protocoltypes.PresenceBeacon{
+		AccountPk: accountPK,
+		SentAt:    sentAt.Unix(),
+	}
+
+	if beacon.Sig, err = md.MemberSign(contactPresencePayload(g.PublicKey, beacon.AccountPk, beacon.SentAt)); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	beaconBytes, err := proto.Marshal(beacon)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return proto.Marshal(&protocoltypes.GroupEnvelope{
+		Event: secretbox.Seal(nil, beaconBytes, nonce, g.GetSharedSecret()),
+		Nonce: nonce[:],
+	})
+}
+
+// openContactPresenceBeacon opens a beacon published on a contact group and
+// returns its time, it must have been recently signed by the contact
+func openContactPresenceBeacon(g *protocoltypes.Group, contactPK []byte, data []byte, now time.Time) (time.Time, error) {
+	env := &protocoltypes.GroupEnvelope{}
+	if err := proto.Unmarshal(data, env); err != nil {
+		return time.Time{}, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+	if err != nil {
+		return time.Time{}, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	beaconBytes, ok := secretbox.Open(nil, env.Event, nonce, g.GetSharedSecret())
+	if !ok {
+		return time.Time{}, errcode.ErrCode_ErrCryptoDecrypt
+	}
+
+	beacon := &protocoltypes.PresenceBeacon{}
+	if err := proto.Unmarshal(beaconBytes, beacon); err != nil {
+		return time.Time{}, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// beacons of the devices of the account are ignored
+	if !bytes.Equal(beacon.AccountPk, contactPK) {
+		return time.Time{}, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("beacon not sent by the contact"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(beacon.AccountPk)
+	if err != nil {
+		return time.Time{}, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if ok, err := pk.Verify(contactPresencePayload(g.PublicKey, beacon.AccountPk, beacon.SentAt), beacon.Sig); err != nil || !ok {
+		return time.Time{}, errcode.ErrCode_ErrCryptoSignatureVerification
+	}
+
+	// a beacon can't be replayed once it has expired
+	sentAt := time.Unix(beacon.SentAt, 0)
+	if now.Sub(sentAt) > contactPresenceTimeout || sentAt.Sub(now) > contactPresenceTimeout {
+		return time.Time{}, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("beacon expired"))
+	}
+
+	return sentAt, nil
+}
+
+// contactPresence keeps the time of the last beacon received from each
+// contact
+type contactPresence struct {
+	lastSeen map[string]time.Time
+	watched  map[string]context.CancelFunc
+	version  uint64
+	notify   *notify.Notify
+	mu       sync.Mutex
+}
+
+func newContactPresence() *contactPresence {
+	p := &contactPresence{
+		lastSeen: make(map[string]time.Time),
+		watched:  make(map[string]context.CancelFunc),
+	}
+	p.notify = notify.New(&p.mu)
+
+	return p
+}
+
+// seen records a beacon of a contact, older beacons are ignored
+func (p *contactPresence) seen(contactPK []byte, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !at.After(p.lastSeen[string(contactPK)]) {
+		return
+	}
+
+	p.lastSeen[string(contactPK)] = at
+	p.version++
+	p.notify.Broadcast()
+}
+
+// status returns the presence of the given contacts and the version of the
+// presence it has been computed from
+func (p *contactPresence) status(contactPKs [][]byte, now time.Time) ([]*protocoltypes.ContactPresenceWatch_Reply, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	replies := make([]*protocoltypes.ContactPresenceWatch_Reply, len(contactPKs))
+	for i, pk := range contactPKs {
+		reply := &protocoltypes.ContactPresenceWatch_Reply{ContactPk: pk}
+		if lastSeen, ok := p.lastSeen[string(pk)]; ok {
+			reply.LastSeen = lastSeen.Unix()
+			reply.Online = now.Sub(lastSeen) < contactPresenceTimeout
+		}
+
+		replies[i] = reply
+	}
+
+	return replies, p.version
+}
+
+// waitForChange waits until a beacon newer than the given version is received
+// or the context is done
+func (p *contactPresence) waitForChange(ctx context.Context, version uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.version == version {
+		if !p.notify.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// startContactPresence publishes the presence beacons of the device and
+// listens to the beacons of the contacts
+func (s *service) startContactPresence() {
+	if s.ipfsCoreAPI == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(contactPresenceInterval)
+		defer ticker.Stop()
+
+		for {
+			s.refreshContactPresence(time.Now())
+
+			select {
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// refreshContactPresence listens to the presence topics of the added contacts
+// and publishes a beacon on them, unless presence is disabled globally or for
+// the contact
+func (s *service) refreshContactPresence(now time.Time) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return
+	}
+
+	settings := accountGroup.MetadataStore().GetPresenceSettings()
+	hidden := make(map[string]struct{}, len(settings.HiddenContacts))
+	for _, pk := range settings.HiddenContacts {
+		hidden[string(pk)] = struct{}{}
+	}
+
+	added := make(map[string]struct{})
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		added[string(contact.Pk)] = struct{}{}
+
+		pk, err := contact.GetPubKey()
+		if err != nil {
+			continue
+		}
+
+		g, err := s.secretStore.GetGroupForContact(pk)
+		if err != nil {
+			s.logger.Warn("unable to get contact group", logutil.PrivateBinary("pk", contact.Pk), zap.Error(err))
+			continue
+		}
+
+		if err := s.watchContactPresence(contact.Pk, g); err != nil {
+			s.logger.Warn("unable to watch contact presence", logutil.PrivateBinary("pk", contact.Pk), zap.Error(err))
+		}
+
+		if _, ok := hidden[string(contact.Pk)]; !settings.Enabled || ok {
+			continue
+		}
+
+		if err := s.publishContactPresence(g, now); err != nil {
+			s.logger.Warn("unable to publish presence beacon", logutil.PrivateBinary("pk", contact.Pk), zap.Error(err))
+		}
+	}
+
+	// stop listening to the contacts which have been removed
+	s.presence.mu.Lock()
+	for pk, cancel := range s.presence.watched {
+		if _, ok := added[pk]; !ok {
+			cancel()
+			delete(s.presence.watched, pk)
+		}
+	}
+	s.presence.mu.Unlock()
+}
+
+func (s *service) publishContactPresence(g *protocoltypes.Group, now time.Time) error {
+	md, err := s.secretStore.GetOwnMemberDeviceForGroup(g)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	beacon, err := sealContactPresenceBeacon(g, md, now)
+	if err != nil {
+		return err
+	}
+
+	// the beacons are small, they don't wait for the bulk transfers
+	release, err := s.lanes.acquire(s.ctx, protocoltypes.SendPriority_SendPriorityNormal)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return s.ipfsCoreAPI.PubSub().Publish(s.ctx, contactPresenceTopic(g), beacon)
+}
+
+// watchContactPresence listens to the presence topic of a contact group if it
+// isn't already
+func (s *service) watchContactPresence(contactPK []byte, g *protocoltypes.Group) error {
+	s.presence.mu.Lock()
+	defer s.presence.mu.Unlock()
+
+	if _, ok := s.presence.watched[string(contactPK)]; ok {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	sub, err := s.ipfsCoreAPI.PubSub().Subscribe(ctx, contactPresenceTopic(g))
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	s.presence.watched[string(contactPK)] = cancel
+
+	go func() {
+		defer sub.Close()
+
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			sentAt, err := openContactPresenceBeacon(g, contactPK, msg.Data(), time.Now())
+			if err != nil {
+				continue
+			}
+
+			s.presence.seen(contactPK, sentAt)
+		}
+	}()
+
+	return nil
+}
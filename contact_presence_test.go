@@ -0,0 +1,73 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestContactPresenceBeacon(t *testing.T) {
+	alice, alicePK, aliceRaw := newTestingAccountSecretStore(t)
+	bob, bobPK, bobRaw := newTestingAccountSecretStore(t)
+
+	aliceGroup, err := alice.GetGroupForContact(bobPK)
+	require.NoError(t, err)
+
+	bobGroup, err := bob.GetGroupForContact(alicePK)
+	require.NoError(t, err)
+
+	md, err := alice.GetOwnMemberDeviceForGroup(aliceGroup)
+	require.NoError(t, err)
+
+	now := time.Now()
+	beacon, err := sealContactPresenceBeacon(aliceGroup, md, now)
+	require.NoError(t, err)
+
+	sentAt, err := openContactPresenceBeacon(bobGroup, aliceRaw, beacon, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Unix(), sentAt.Unix())
+
+	// the beacons of the account are ignored by its other devices
+	_, err = openContactPresenceBeacon(aliceGroup, bobRaw, beacon, now)
+	require.Error(t, err)
+
+	// an expired beacon can't be replayed
+	_, err = openContactPresenceBeacon(bobGroup, aliceRaw, beacon, now.Add(contactPresenceTimeout+time.Minute))
+	require.Error(t, err)
+
+	// only the members of the contact group can open the beacon
+	otherGroup, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = openContactPresenceBeacon(otherGroup, aliceRaw, beacon, now)
+	require.Error(t, err)
+}
+
+func TestContactPresenceStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	presence := newContactPresence()
+	now := time.Now()
+
+	replies, version := presence.status([][]byte{[]byte("alice")}, now)
+	require.Equal(t, []*protocoltypes.ContactPresenceWatch_Reply{{ContactPk: []byte("alice")}}, replies)
+
+	go presence.seen([]byte("alice"), now)
+
+	presence.waitForChange(ctx, version)
+
+	replies, _ = presence.status([][]byte{[]byte("alice")}, now)
+	require.Equal(t, []*protocoltypes.ContactPresenceWatch_Reply{{ContactPk: []byte("alice"), Online: true, LastSeen: now.Unix()}}, replies)
+
+	// older beacons are ignored
+	presence.seen([]byte("alice"), now.Add(-time.Minute))
+
+	replies, _ = presence.status([][]byte{[]byte("alice")}, now.Add(contactPresenceTimeout))
+	require.Equal(t, []*protocoltypes.ContactPresenceWatch_Reply{{ContactPk: []byte("alice"), LastSeen: now.Unix()}}, replies)
+}
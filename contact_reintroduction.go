@@ -0,0 +1,110 @@
+package weshnet
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	contactReintroductionOldAccountPrefix = "wesh/contact-reintroduction/old-account"
+	contactReintroductionNewAccountPrefix = "wesh/contact-reintroduction/new-account"
+)
+
+// contactReintroductionPayload is the data signed by an account for a
+// reintroduction, the prefix prevents using one signature in place of the other
+func contactReintroductionPayload(prefix string, oldAccountPK, newAccountPK []byte) []byte {
+	payload := make([]byte, 0, len(prefix)+len(oldAccountPK)+len(newAccountPK))
+	payload = append(payload, prefix...)
+	payload = append(payload, oldAccountPK...)
+	payload = append(payload, newAccountPK...)
+
+	return payload
+}
+
+// signContactReintroductionNewAccount creates a proof that the new account is
+// replacing the given previous account
+func signContactReintroductionNewAccount(newAccount crypto.PrivKey, oldAccountPK []byte, newContact *protocoltypes.ShareableContact) (*protocoltypes.ContactReintroductionProof, error) {
+	if _, err := crypto.UnmarshalEd25519PublicKey(oldAccountPK); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if bytes.Equal(oldAccountPK, newContact.Pk) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the previous account can't be the current one"))
+	}
+
+	sig, err := newAccount.Sign(contactReintroductionPayload(contactReintroductionNewAccountPrefix, oldAccountPK, newContact.Pk))
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return &protocoltypes.ContactReintroductionProof{
+		OldAccountPk:  oldAccountPK,
+		NewContact:    newContact,
+		NewAccountSig: sig,
+	}, nil
+}
+
+// signContactReintroductionOldAccount completes a proof created by the new
+// account with the signature of the previous one
+func signContactReintroductionOldAccount(oldAccount crypto.PrivKey, proof *protocoltypes.ContactReintroductionProof) error {
+	oldAccountPK, err := oldAccount.GetPublic().Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if !bytes.Equal(oldAccountPK, proof.OldAccountPk) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the proof has been created for another account"))
+	}
+
+	if err := verifyContactReintroductionSig(proof.NewContact.GetPk(), contactReintroductionNewAccountPrefix, proof, proof.NewAccountSig); err != nil {
+		return err
+	}
+
+	proof.OldAccountSig, err = oldAccount.Sign(contactReintroductionPayload(contactReintroductionOldAccountPrefix, proof.OldAccountPk, proof.NewContact.Pk))
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return nil
+}
+
+// verifyContactReintroductionProof checks that both accounts of the proof
+// signed it
+func verifyContactReintroductionProof(proof *protocoltypes.ContactReintroductionProof) error {
+	if proof == nil || proof.NewContact == nil {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if err := proof.NewContact.CheckFormat(protocoltypes.ShareableContactOptionsAllowMissingRDVSeed); err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if err := verifyContactReintroductionSig(proof.NewContact.Pk, contactReintroductionNewAccountPrefix, proof, proof.NewAccountSig); err != nil {
+		return err
+	}
+
+	return verifyContactReintroductionSig(proof.OldAccountPk, contactReintroductionOldAccountPrefix, proof, proof.OldAccountSig)
+}
+
+func verifyContactReintroductionSig(signerPK []byte, prefix string, proof *protocoltypes.ContactReintroductionProof, sig []byte) error {
+	pk, err := crypto.UnmarshalEd25519PublicKey(signerPK)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	ok, err := pk.Verify(contactReintroductionPayload(prefix, proof.OldAccountPk, proof.NewContact.GetPk()), sig)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package weshnet
+
+import (
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestContactReintroductionProof(t *testing.T) {
+	oldAccount, oldAccountPub, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	newAccount, newAccountPub, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	otherAccount, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	oldAccountPK, err := oldAccountPub.Raw()
+	require.NoError(t, err)
+
+	newAccountPK, err := newAccountPub.Raw()
+	require.NoError(t, err)
+
+	proof, err := signContactReintroductionNewAccount(newAccount, oldAccountPK, &protocoltypes.ShareableContact{Pk: newAccountPK})
+	require.NoError(t, err)
+
+	// the proof is incomplete until signed by the previous account
+	require.Error(t, verifyContactReintroductionProof(proof))
+
+	// only the previous account can complete the proof
+	require.Error(t, signContactReintroductionOldAccount(otherAccount, proof))
+
+	require.NoError(t, signContactReintroductionOldAccount(oldAccount, proof))
+	require.NoError(t, verifyContactReintroductionProof(proof))
+
+	// the signature of an account can't be used in place of the other one
+	swapped := &protocoltypes.ContactReintroductionProof{
+		OldAccountPk:  proof.OldAccountPk,
+		NewContact:    proof.NewContact,
+		NewAccountSig: proof.OldAccountSig,
+		OldAccountSig: proof.NewAccountSig,
+	}
+	require.Error(t, verifyContactReintroductionProof(swapped))
+
+	// the proof can't be replayed for another account
+	_, otherAccountPub, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	otherAccountPK, err := otherAccountPub.Raw()
+	require.NoError(t, err)
+
+	proof.NewContact = &protocoltypes.ShareableContact{Pk: otherAccountPK}
+	require.Error(t, verifyContactReintroductionProof(proof))
+}
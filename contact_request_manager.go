@@ -3,6 +3,7 @@ package weshnet
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -34,8 +35,13 @@ type contactRequestsManager struct {
 
 	ctx            context.Context
 	cancel         context.CancelFunc
+	announceCtx    context.Context
 	announceCancel context.CancelFunc
 
+	// linkAnnounces cancels the announces of the contact request links
+	// indexed by their nonce
+	linkAnnounces map[string]context.CancelFunc
+
 	lookupProcess   map[string]context.CancelFunc
 	muLookupProcess sync.Mutex
 
@@ -45,6 +51,7 @@ type contactRequestsManager struct {
 
 	ownRendezvousSeed []byte
 	accountPrivateKey crypto.PrivKey
+	rateLimiter       *contactRequestRateLimiter
 
 	ipfs          ipfsutil.ExtendedCoreAPI
 	swiper        *Swiper
@@ -65,6 +72,7 @@ func newContactRequestsManager(s *Swiper, store *MetadataStore, ipfs ipfsutil.Ex
 		ipfs:              ipfs,
 		logger:            logger.Named("req-mngr"),
 		accountPrivateKey: accountPrivateKey,
+		rateLimiter:       newContactRequestRateLimiter(),
 		ctx:               ctx,
 		cancel:            cancel,
 		swiper:            s,
@@ -108,6 +116,9 @@ func (c *contactRequestsManager) metadataWatcher(ctx context.Context) {
 		protocoltypes.EventType_EventTypeAccountContactRequestEnabled:          c.metadataRequestEnabled,
 		protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset:   c.metadataRequestReset,
 		protocoltypes.EventType_EventTypeAccountContactRequestOutgoingEnqueued: c.metadataRequestEnqueued,
+		protocoltypes.EventType_EventTypeAccountContactDeleted:                 c.metadataContactDeleted,
+		protocoltypes.EventType_EventTypeAccountContactBlocked:                 c.metadataContactBlocked,
+		protocoltypes.EventType_EventTypeAccountContactRequestNonceRegistered:  c.metadataRequestNonceRegistered,
 
 		// @FIXME: looks like we don't need those events
 		protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent:     c.metadataRequestSent,
@@ -304,6 +315,52 @@ func (c *contactRequestsManager) metadataRequestReceived(_ context.Context, evt
 	// another device may have successfully sent contact request, try to cancel
 	// lookup if needed
 	c.cancelContactLookup(e.ContactPk)
+
+	// stop announcing a single-use link once consumed
+	if _, ok := c.metadataStore.ListContactRequestLinks()[string(e.Nonce)]; len(e.Nonce) > 0 && !ok {
+		if cancel, ok := c.linkAnnounces[string(e.Nonce)]; ok {
+			cancel()
+			delete(c.linkAnnounces, string(e.Nonce))
+		}
+	}
+
+	return nil
+}
+
+func (c *contactRequestsManager) metadataRequestNonceRegistered(_ context.Context, evt *protocoltypes.GroupMetadataEvent) error {
+	e := &protocoltypes.AccountContactRequestNonceRegistered{}
+	if err := proto.Unmarshal(evt.Event, e); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	accPK, err := c.accountPrivateKey.GetPublic().Raw()
+	if err != nil {
+		return fmt.Errorf("unable to get raw pk: %w", err)
+	}
+
+	c.announceLink(accPK, e.Nonce, e.ExpiresAt)
+	return nil
+}
+
+func (c *contactRequestsManager) metadataContactDeleted(_ context.Context, evt *protocoltypes.GroupMetadataEvent) error {
+	e := &protocoltypes.AccountContactDeleted{}
+	if err := proto.Unmarshal(evt.Event, e); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// stop looking for the contact on its rendezvous point
+	c.cancelContactLookup(e.ContactPk)
+	return nil
+}
+
+func (c *contactRequestsManager) metadataContactBlocked(_ context.Context, evt *protocoltypes.GroupMetadataEvent) error {
+	e := &protocoltypes.AccountContactBlocked{}
+	if err := proto.Unmarshal(evt.Event, e); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// ignore the announcements of the contact on its rendezvous point
+	c.cancelContactLookup(e.ContactPk)
 	return nil
 }
 
@@ -348,6 +405,7 @@ func (c *contactRequestsManager) enableAnnounce(ctx context.Context, seed, accPK
 	}
 
 	ctx, c.announceCancel = context.WithCancel(ctx)
+	c.announceCtx = ctx
 	c.enabled = true
 
 	tyber.LogStep(ctx, c.logger, "announcing on swipper")
@@ -355,13 +413,42 @@ func (c *contactRequestsManager) enableAnnounce(ctx context.Context, seed, accPK
 	// start announcing on swiper, this method should take care ton announce as
 	// many time as needed
 	c.swiper.Announce(ctx, accPK, seed)
+
+	// the seeds of the links are derived from the permanent one
+	c.linkAnnounces = make(map[string]context.CancelFunc)
+	for nonce, expiresAt := range c.metadataStore.ListContactRequestLinks() {
+		c.announceLink(accPK, []byte(nonce), expiresAt)
+	}
+
 	return nil
 }
 
+// announceLink announces the rendezvous seed of a contact request link until
+// it expires or is consumed
+func (c *contactRequestsManager) announceLink(accPK, nonce []byte, expiresAt int64) {
+	if c.announceCtx == nil || c.ownRendezvousSeed == nil {
+		return
+	}
+
+	if _, ok := c.linkAnnounces[string(nonce)]; ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.announceCtx)
+	if expiresAt != 0 {
+		ctx, cancel = context.WithDeadline(c.announceCtx, time.Unix(expiresAt, 0))
+	}
+
+	c.linkAnnounces[string(nonce)] = cancel
+	c.swiper.Announce(ctx, accPK, contactRequestLinkSeed(c.ownRendezvousSeed, nonce))
+}
+
 func (c *contactRequestsManager) disableAnnounce() {
 	if c.announceCancel != nil {
 		c.announceCancel()
 		c.announceCancel = nil
+		c.announceCtx = nil
+		c.linkAnnounces = nil
 	}
 }
 
@@ -389,6 +476,12 @@ func (c *contactRequestsManager) enqueueRequest(ctx context.Context, to *protoco
 	go func() {
 		var err error
 		for peer := range cpeers {
+			// the contact may have been blocked since the lookup started
+			if c.metadataStore.checkContactStatus(otherPK, protocoltypes.ContactState_ContactStateBlocked) {
+				err = errcode.ErrCode_ErrContactRequestContactBlocked
+				break
+			}
+
 			// get our sharable contact to send to other contact
 			if err = c.SendContactRequest(ctx, to, otherPK, peer); err != nil {
 				c.logger.Warn("unable to send contact request", zap.Error(err))
@@ -432,6 +525,21 @@ func (c *contactRequestsManager) SendContactRequest(ctx context.Context, to *pro
 	}
 	own.Metadata = ownMetadata
 
+	// send back the nonce of the link used to reach the contact, or prove
+	// that the permanent contact reference is used
+	own.Nonce = to.Nonce
+	own.Passphrase = to.Passphrase
+	if len(to.Nonce) == 0 {
+		own.ContactedRendezvousSeed = to.PublicRendezvousSeed
+	}
+
+	if to.ProofOfWorkDifficulty > 0 {
+		tyber.LogStep(ctx, c.logger, "computing proof of work")
+		if own.ProofOfWork, err = computeContactRequestProofOfWork(ctx, own.Pk, to.Pk, to.ProofOfWorkDifficulty); err != nil {
+			return fmt.Errorf("unable to compute proof of work: %w", err)
+		}
+	}
+
 	// make sure to have connection with the remote peer
 	if err := c.ipfs.Swarm().Connect(ctx, peer); err != nil {
 		return fmt.Errorf("unable to connect: %w", err)
@@ -480,7 +588,30 @@ func (c *contactRequestsManager) handleIncomingRequest(ctx context.Context, stre
 
 	tyber.LogStep(ctx, c.logger, "responding to handshake")
 
-	otherPK, err := handshake.ResponseUsingReaderWriter(ctx, c.logger, reader, writer, c.accountPrivateKey)
+	policy := c.metadataStore.GetContactRequestPolicy()
+	allowlisted := false
+
+	// a blocked or denied contact is rejected before learning our identity
+	otherPK, err := handshake.ResponseUsingReaderWriterWithCheck(ctx, c.logger, reader, writer, c.accountPrivateKey, func(requester crypto.PubKey) error {
+		if c.metadataStore.checkContactStatus(requester, protocoltypes.ContactState_ContactStateBlocked) {
+			return errcode.ErrCode_ErrContactRequestContactBlocked
+		}
+
+		// an account we have sent a request to is always accepted
+		if c.metadataStore.checkContactStatus(requester, protocoltypes.ContactState_ContactStateToRequest) {
+			allowlisted = true
+			return nil
+		}
+
+		requesterPK, err := requester.Raw()
+		if err != nil {
+			return err
+		}
+
+		// the allowlist is checked once the request is read, as it doesn't
+		// apply to the auto-accepted requests
+		return checkContactRequestPolicyDenylist(policy, requesterPK)
+	})
 	if err != nil {
 		return fmt.Errorf("handshake failed: %w", err)
 	}
@@ -509,6 +640,36 @@ func (c *contactRequestsManager) handleIncomingRequest(ctx context.Context, stre
 		return fmt.Errorf("invalid contact information format: %w", err)
 	}
 
+	autoAccepted := isContactRequestAutoAccepted(policy, otherPKBytes, contact.Passphrase)
+
+	if !allowlisted {
+		if allowlisted, err = checkContactRequestPolicyRequester(policy, otherPKBytes, autoAccepted); err != nil {
+			return fmt.Errorf("contact request rejected: %w", err)
+		}
+	}
+
+	// a request without nonce must use the permanent contact reference, the
+	// links with an expiry or a single use only share a derived seed
+	_, own := c.metadataStore.GetIncomingContactRequestsStatus()
+	if !allowlisted && len(contact.Nonce) == 0 && (own == nil || len(own.PublicRendezvousSeed) == 0 || !hmac.Equal(own.PublicRendezvousSeed, contact.ContactedRendezvousSeed)) {
+		return fmt.Errorf("contact request rejected: %w", errcode.ErrCode_ErrContactRequestNonceInvalid)
+	}
+
+	if !allowlisted && !autoAccepted {
+		ownPK, err := c.accountPrivateKey.GetPublic().Raw()
+		if err != nil {
+			return fmt.Errorf("failed to marshal own public key: %w", err)
+		}
+
+		if err := checkContactRequestProofOfWork(otherPKBytes, ownPK, contact.ProofOfWork, policy.ProofOfWorkDifficulty); err != nil {
+			return fmt.Errorf("contact request rejected: %w", err)
+		}
+
+		if own != nil && !c.rateLimiter.allow(own.PublicRendezvousSeed, policy.MaxRequestsPerHour, time.Now()) {
+			return fmt.Errorf("contact request rejected: %w", errcode.ErrCode_ErrContactRequestRateLimited)
+		}
+	}
+
 	tyber.LogStep(ctx, c.logger, "marking contact request has received")
 
 	// mark contact request as received
@@ -516,14 +677,37 @@ func (c *contactRequestsManager) handleIncomingRequest(ctx context.Context, stre
 		Pk:                   otherPKBytes,
 		PublicRendezvousSeed: contact.PublicRendezvousSeed,
 		Metadata:             contact.Metadata,
+		Nonce:                contact.Nonce,
 	})
 	if err != nil {
 		return fmt.Errorf("invalid contact information format: %w", err)
 	}
 
+	// a mutual request has already been marked as added
+	if autoAccepted && c.metadataStore.checkContactStatus(otherPK, protocoltypes.ContactState_ContactStateReceived) {
+		tyber.LogStep(ctx, c.logger, "accepting contact request automatically")
+
+		if err := c.acceptIncomingRequest(ctx, otherPK); err != nil {
+			return fmt.Errorf("unable to accept contact request: %w", err)
+		}
+	}
+
 	return nil
 }
 
+func (c *contactRequestsManager) acceptIncomingRequest(ctx context.Context, pk crypto.PubKey) error {
+	group, err := c.metadataStore.secretStore.GetGroupForContact(pk)
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.metadataStore.ContactRequestIncomingAccept(ctx, pk); err != nil {
+		return err
+	}
+
+	return c.metadataStore.secretStore.PutGroup(ctx, group)
+}
+
 func cidBytesString(bytes []byte) string {
 	cid, err := ipfscid.Cast(bytes)
 	if err != nil {
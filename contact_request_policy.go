@@ -0,0 +1,180 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// maxContactRequestProofOfWorkDifficulty bounds the work required to send
+	// a contact request, a shared contact requiring more is rejected
+	maxContactRequestProofOfWorkDifficulty = 24
+
+	contactRequestRateLimitWindow = time.Hour
+)
+
+// checkContactRequestPolicyFormat checks that a policy can be applied
+func checkContactRequestPolicyFormat(policy *protocoltypes.ContactRequestPolicy) error {
+	if policy.ProofOfWorkDifficulty > maxContactRequestProofOfWorkDifficulty {
+		return fmt.Errorf("proof of work difficulty can't exceed %d", maxContactRequestProofOfWorkDifficulty)
+	}
+
+	for _, list := range [][][]byte{policy.Allowlist, policy.Denylist, policy.AutoAccept} {
+		for _, pk := range list {
+			if _, err := crypto.UnmarshalEd25519PublicKey(pk); err != nil {
+				return fmt.Errorf("invalid account public key: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkContactRequestPolicyDenylist rejects the accounts denied by the policy
+func checkContactRequestPolicyDenylist(policy *protocoltypes.ContactRequestPolicy, requesterPK []byte) error {
+	for _, pk := range policy.Denylist {
+		if bytes.Equal(pk, requesterPK) {
+			return errcode.ErrCode_ErrContactRequestPolicyDenied
+		}
+	}
+
+	return nil
+}
+
+// checkContactRequestPolicyRequester checks the lists of the policy against
+// the account sending a request, it returns whether the account is
+// allowlisted. The rules apply in order: the denylist, then the auto-accept
+// rules, then the allowlist, an auto-accepted request isn't subject to the
+// allowlist
+func checkContactRequestPolicyRequester(policy *protocoltypes.ContactRequestPolicy, requesterPK []byte, autoAccepted bool) (allowlisted bool, err error) {
+	if err := checkContactRequestPolicyDenylist(policy, requesterPK); err != nil {
+		return false, err
+	}
+
+	if autoAccepted || len(policy.Allowlist) == 0 {
+		return false, nil
+	}
+
+	for _, pk := range policy.Allowlist {
+		if bytes.Equal(pk, requesterPK) {
+			return true, nil
+		}
+	}
+
+	return false, errcode.ErrCode_ErrContactRequestPolicyDenied
+}
+
+// isContactRequestAutoAccepted returns whether a request can be accepted
+// without user action, either the account sending it or its passphrase has
+// been approved beforehand
+func isContactRequestAutoAccepted(policy *protocoltypes.ContactRequestPolicy, requesterPK []byte, passphrase string) bool {
+	for _, pk := range policy.AutoAccept {
+		if bytes.Equal(pk, requesterPK) {
+			return true
+		}
+	}
+
+	return policy.AutoAcceptPassphrase != "" && subtle.ConstantTimeCompare([]byte(policy.AutoAcceptPassphrase), []byte(passphrase)) == 1
+}
+
+func contactRequestProofOfWorkHash(requesterPK, responderPK, proof []byte) [sha256.Size]byte {
+	data := make([]byte, 0, len(requesterPK)+len(responderPK)+len(proof))
+	data = append(data, requesterPK...)
+	data = append(data, responderPK...)
+	data = append(data, proof...)
+
+	return sha256.Sum256(data)
+}
+
+func leadingZeroBits(hash []byte) uint32 {
+	count := uint32(0)
+	for _, b := range hash {
+		if b != 0 {
+			return count + uint32(bits.LeadingZeros8(b))
+		}
+
+		count += 8
+	}
+
+	return count
+}
+
+// computeContactRequestProofOfWork looks for a proof binding a request from
+// requesterPK to responderPK whose hash has the required leading zero bits
+func computeContactRequestProofOfWork(ctx context.Context, requesterPK, responderPK []byte, difficulty uint32) ([]byte, error) {
+	if difficulty > maxContactRequestProofOfWorkDifficulty {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("proof of work difficulty can't exceed %d", maxContactRequestProofOfWorkDifficulty))
+	}
+
+	proof := make([]byte, 8)
+	for counter := uint64(0); ; counter++ {
+		if counter%(1<<16) == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		binary.BigEndian.PutUint64(proof, counter)
+		if hash := contactRequestProofOfWorkHash(requesterPK, responderPK, proof); leadingZeroBits(hash[:]) >= difficulty {
+			return proof, nil
+		}
+	}
+}
+
+func checkContactRequestProofOfWork(requesterPK, responderPK, proof []byte, difficulty uint32) error {
+	if difficulty == 0 {
+		return nil
+	}
+
+	if hash := contactRequestProofOfWorkHash(requesterPK, responderPK, proof); len(proof) == 0 || leadingZeroBits(hash[:]) < difficulty {
+		return errcode.ErrCode_ErrContactRequestProofOfWorkInvalid
+	}
+
+	return nil
+}
+
+// contactRequestRateLimiter counts the incoming contact requests accepted on
+// each rendezvous seed over the last hour
+type contactRequestRateLimiter struct {
+	requests map[string][]time.Time
+	mu       sync.Mutex
+}
+
+func newContactRequestRateLimiter() *contactRequestRateLimiter {
+	return &contactRequestRateLimiter{
+		requests: map[string][]time.Time{},
+	}
+}
+
+// allow records a request on the given seed if less than limit requests have
+// been recorded during the last hour, a limit of 0 disables the check
+func (r *contactRequestRateLimiter) allow(seed []byte, limit uint32, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recent := r.requests[string(seed)][:0]
+	for _, t := range r.requests[string(seed)] {
+		if now.Sub(t) < contactRequestRateLimitWindow {
+			recent = append(recent, t)
+		}
+	}
+
+	if limit != 0 && uint32(len(recent)) >= limit {
+		r.requests[string(seed)] = recent
+		return false
+	}
+
+	r.requests[string(seed)] = append(recent, now)
+
+	return true
+}
@@ -0,0 +1,109 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestContactRequestPolicyRequester(t *testing.T) {
+	allowed, denied, other := newTestingAccountPK(t), newTestingAccountPK(t), newTestingAccountPK(t)
+
+	policy := &protocoltypes.ContactRequestPolicy{Denylist: [][]byte{denied}}
+	require.NoError(t, checkContactRequestPolicyFormat(policy))
+
+	allowlisted, err := checkContactRequestPolicyRequester(policy, other, false)
+	require.NoError(t, err)
+	require.False(t, allowlisted)
+
+	_, err = checkContactRequestPolicyRequester(policy, denied, false)
+	require.Equal(t, errcode.ErrCode_ErrContactRequestPolicyDenied, err)
+	require.Equal(t, errcode.ErrCode_ErrContactRequestPolicyDenied, checkContactRequestPolicyDenylist(policy, denied))
+
+	policy.Allowlist = [][]byte{allowed}
+
+	allowlisted, err = checkContactRequestPolicyRequester(policy, allowed, false)
+	require.NoError(t, err)
+	require.True(t, allowlisted)
+
+	_, err = checkContactRequestPolicyRequester(policy, other, false)
+	require.Equal(t, errcode.ErrCode_ErrContactRequestPolicyDenied, err)
+
+	// the auto-accept rules come before the allowlist, but after the denylist
+	allowlisted, err = checkContactRequestPolicyRequester(policy, other, true)
+	require.NoError(t, err)
+	require.False(t, allowlisted)
+
+	_, err = checkContactRequestPolicyRequester(policy, denied, true)
+	require.Equal(t, errcode.ErrCode_ErrContactRequestPolicyDenied, err)
+
+	require.Error(t, checkContactRequestPolicyFormat(&protocoltypes.ContactRequestPolicy{Allowlist: [][]byte{[]byte("invalid")}}))
+	require.Error(t, checkContactRequestPolicyFormat(&protocoltypes.ContactRequestPolicy{ProofOfWorkDifficulty: maxContactRequestProofOfWorkDifficulty + 1}))
+}
+
+func TestContactRequestProofOfWork(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	requesterPK, responderPK := []byte("requester"), []byte("responder")
+
+	proof, err := computeContactRequestProofOfWork(ctx, requesterPK, responderPK, 12)
+	require.NoError(t, err)
+
+	require.NoError(t, checkContactRequestProofOfWork(requesterPK, responderPK, proof, 12))
+	require.NoError(t, checkContactRequestProofOfWork(requesterPK, responderPK, nil, 0))
+	require.Equal(t, errcode.ErrCode_ErrContactRequestProofOfWorkInvalid, checkContactRequestProofOfWork(requesterPK, responderPK, nil, 12))
+
+	// the proof is bound to both accounts
+	require.Error(t, checkContactRequestProofOfWork([]byte("other"), responderPK, proof, 12))
+}
+
+func TestContactRequestRateLimiter(t *testing.T) {
+	limiter := newContactRequestRateLimiter()
+	now := time.Now()
+
+	require.True(t, limiter.allow([]byte("seed"), 2, now))
+	require.True(t, limiter.allow([]byte("seed"), 2, now))
+	require.False(t, limiter.allow([]byte("seed"), 2, now))
+
+	// the limit is applied per rendezvous seed
+	require.True(t, limiter.allow([]byte("other_seed"), 2, now))
+
+	// requests older than the window are no longer counted
+	require.True(t, limiter.allow([]byte("seed"), 2, now.Add(contactRequestRateLimitWindow)))
+
+	// no limit
+	for i := 0; i < 10; i++ {
+		require.True(t, limiter.allow([]byte("unlimited"), 0, now))
+	}
+}
+
+func TestContactRequestAutoAccept(t *testing.T) {
+	_, pk, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	approved, err := pk.Raw()
+	require.NoError(t, err)
+
+	policy := &protocoltypes.ContactRequestPolicy{}
+	require.False(t, isContactRequestAutoAccepted(policy, approved, ""))
+
+	policy.AutoAccept = [][]byte{approved}
+	require.NoError(t, checkContactRequestPolicyFormat(policy))
+	require.True(t, isContactRequestAutoAccepted(policy, approved, ""))
+	require.False(t, isContactRequestAutoAccepted(policy, []byte("other"), ""))
+
+	policy.AutoAcceptPassphrase = "onboarding"
+	require.True(t, isContactRequestAutoAccepted(policy, []byte("other"), "onboarding"))
+	require.False(t, isContactRequestAutoAccepted(policy, []byte("other"), "wrong"))
+	require.False(t, isContactRequestAutoAccepted(policy, []byte("other"), ""))
+
+	require.Error(t, checkContactRequestPolicyFormat(&protocoltypes.ContactRequestPolicy{AutoAccept: [][]byte{[]byte("invalid")}}))
+}
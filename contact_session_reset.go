@@ -0,0 +1,250 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/internal/handshake"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/protoio"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+const (
+	contactSessionResetV1 = protocol.ID("/wesh/contact_session_reset/1.0.0")
+
+	// contactSessionResetMaxMessageSize is the maximum size of a chain key
+	// sent during a session reset, it holds the metadata keys of the device
+	contactSessionResetMaxMessageSize = 1024 * 1024
+)
+
+// contactSessionResetPeers returns the connected peers known to be a device
+// of the contact
+func (s *service) contactSessionResetPeers(cg *GroupContext, contactPK crypto.PubKey) map[peer.ID][]byte {
+	peers := map[peer.ID][]byte{}
+	for _, p := range s.host.Network().Peers() {
+		pdg, ok := s.odb.GetDevicePKForPeerID(p)
+		if !ok {
+			continue
+		}
+
+		member, err := cg.MetadataStore().GetMemberByDevice(pdg.DevicePK)
+		if err != nil || !member.Equals(contactPK) {
+			continue
+		}
+
+		if raw, err := pdg.DevicePK.Raw(); err == nil {
+			peers[p] = raw
+		}
+	}
+
+	return peers
+}
+
+// newContactSessionChainKey rotates the chain key of the device for the
+// contact group, at least to the given epoch, and encrypts it for the contact
+func newContactSessionChainKey(ctx context.Context, cg *GroupContext, contactPK crypto.PubKey, epoch uint64) (*protocoltypes.GroupDeviceChainKeyAdded, error) {
+	if current := cg.MetadataStore().chainKeyEpoch() + 1; current > epoch {
+		epoch = current
+	}
+
+	if _, err := cg.SecretStore().RotateChainKey(ctx, cg.Group(), epoch); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	payload, err := cg.SecretStore().GetShareableChainKey(ctx, cg.Group(), contactPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	devicePK, err := cg.DevicePubKey().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	contactRaw, err := contactPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return &protocoltypes.GroupDeviceChainKeyAdded{
+		DevicePk:     devicePK,
+		DestMemberPk: contactRaw,
+		Payload:      payload,
+		Epoch:        epoch,
+	}, nil
+}
+
+// registerContactSessionChainKey registers the chain key sent by a device of
+// the contact during a session reset
+func registerContactSessionChainKey(ctx context.Context, cg *GroupContext, contactPK crypto.PubKey, chainKey *protocoltypes.GroupDeviceChainKeyAdded) error {
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(chainKey.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the device must belong to the account authenticated by the handshake
+	if member, err := cg.MetadataStore().GetMemberByDevice(devicePK); err != nil || !member.Equals(contactPK) {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(fmt.Errorf("device doesn't belong to the contact"))
+	}
+
+	ownPK, err := cg.MemberPubKey().Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if !bytes.Equal(chainKey.DestMemberPk, ownPK) {
+		return errcode.ErrCode_ErrGroupSecretOtherDestMember
+	}
+
+	if cg.isChainKeyRevoked(devicePK) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device revoked"))
+	}
+
+	if err := cg.SecretStore().RegisterChainKey(ctx, cg.Group(), devicePK, chainKey.Payload); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	// the messages which couldn't be opened may be opened now
+	cg.MetadataStore().processPendingEntries(ctx)
+	cg.MessageStore().ProcessMessageQueueForDevicePK(ctx, chainKey.DevicePk)
+
+	return nil
+}
+
+// resetContactSession performs a new handshake with a device of the contact
+// and exchanges freshly rotated chain keys with it
+func (s *service) resetContactSession(ctx context.Context, cg *GroupContext, contactPK crypto.PubKey, p peer.ID) error {
+	accountSK, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	stream, err := s.host.NewStream(ctx, p, contactSessionResetV1)
+	if err != nil {
+		return fmt.Errorf("unable to open stream: %w", err)
+	}
+
+	defer func() {
+		if err := stream.Close(); err != nil {
+			s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+		}
+	}()
+
+	reader := protoio.NewDelimitedReader(stream, contactSessionResetMaxMessageSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	tyber.LogStep(ctx, s.logger, "performing handshake")
+	if err := handshake.RequestUsingReaderWriter(ctx, s.logger, reader, writer, accountSK, contactPK); err != nil {
+		return fmt.Errorf("an error occurred during handshake: %w", err)
+	}
+
+	own, err := newContactSessionChainKey(ctx, cg, contactPK, 0)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.WriteMsg(own); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	peerChainKey := &protocoltypes.GroupDeviceChainKeyAdded{}
+	if err := reader.ReadMsg(peerChainKey); err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	return registerContactSessionChainKey(ctx, cg, contactPK, peerChainKey)
+}
+
+// handleContactSessionReset answers the session resets requested by the
+// devices of a contact
+func (s *service) handleContactSessionReset(stream network.Stream) {
+	ctx, _, endSection := tyber.Section(s.ctx, s.logger, "Resetting session requested by a contact")
+
+	err := s.answerContactSessionReset(ctx, stream)
+	endSection(err, "")
+
+	if err != nil {
+		s.logger.Warn("unable to reset contact session", zap.Error(err))
+
+		if err := stream.Reset(); err != nil {
+			s.logger.Error("unable to reset stream", zap.Error(err))
+		}
+
+		return
+	}
+
+	if err := stream.Close(); err != nil {
+		s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+	}
+}
+
+func (s *service) answerContactSessionReset(ctx context.Context, stream network.Stream) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	accountSK, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	reader := protoio.NewDelimitedReader(stream, contactSessionResetMaxMessageSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	// only an added contact can reset its session, the others don't learn
+	// our identity
+	contactPK, err := handshake.ResponseUsingReaderWriterWithCheck(ctx, s.logger, reader, writer, accountSK, func(requester crypto.PubKey) error {
+		if !accountGroup.MetadataStore().checkContactStatus(requester, protocoltypes.ContactState_ContactStateAdded) {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("contact not added"))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("an error occurred during handshake: %w", err)
+	}
+
+	group, err := s.getContactGroup(contactPK)
+	if err != nil {
+		return err
+	}
+
+	cg, release, err := s.retainContextGroupForID(group.PublicKey)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMissing.Wrap(err)
+	}
+	defer release()
+
+	peerChainKey := &protocoltypes.GroupDeviceChainKeyAdded{}
+	if err := reader.ReadMsg(peerChainKey); err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	if err := registerContactSessionChainKey(ctx, cg, contactPK, peerChainKey); err != nil {
+		return err
+	}
+
+	own, err := newContactSessionChainKey(ctx, cg, contactPK, peerChainKey.Epoch)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.WriteMsg(own); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	s.logger.Debug("contact session reset", logutil.PrivateBinary("group", group.PublicKey))
+
+	return nil
+}
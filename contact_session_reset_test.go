@@ -0,0 +1,50 @@
+package weshnet_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestContactResetSession(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := weshnet.TestingOpts{
+		Mocknet:     mocknet.New(),
+		Logger:      logger,
+		ConnectFunc: weshnet.ConnectAll,
+	}
+
+	nodes, cleanup := weshnet.NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	addAsContact(ctx, t, nodes, nodes)
+	sendMessageToContact(ctx, t, []string{"pre-reset"}, nodes)
+
+	// an unknown account has no session to reset
+	_, err := nodes[0].Client.ContactResetSession(ctx, &protocoltypes.ContactResetSession_Request{
+		ContactPk: getAccountPubKey(t, nodes[0]),
+	})
+	require.Error(t, err)
+
+	_, err = nodes[0].Client.ContactResetSession(ctx, &protocoltypes.ContactResetSession_Request{
+		ContactPk: getAccountPubKey(t, nodes[1]),
+	})
+	require.NoError(t, err)
+
+	// both devices use the chain keys exchanged during the handshake
+	sendMessageToContact(ctx, t, []string{"post-reset"}, nodes)
+}
@@ -0,0 +1,77 @@
+package weshnet
+
+import (
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// newTestingAccountKey returns a new account key along with its raw public
+// key
+func newTestingAccountKey(t testing.TB) (crypto.PrivKey, []byte) {
+	t.Helper()
+
+	priv, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	raw, err := pub.Raw()
+	require.NoError(t, err)
+
+	return priv, raw
+}
+
+// newTestingAccountPK returns the raw public key of a new account
+func newTestingAccountPK(t testing.TB) []byte {
+	t.Helper()
+
+	_, raw := newTestingAccountKey(t)
+
+	return raw
+}
+
+// newTestingAccountSecretStore returns the secret store of a new account
+// along with its public key
+func newTestingAccountSecretStore(t testing.TB) (secretstore.SecretStore, crypto.PubKey, []byte) {
+	t.Helper()
+
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = secretStore.Close() })
+
+	sk, err := secretStore.GetAccountPrivateKey()
+	require.NoError(t, err)
+
+	raw, err := sk.GetPublic().Raw()
+	require.NoError(t, err)
+
+	return secretStore, sk.GetPublic(), raw
+}
+
+// newTestingMemberDevice returns a new device of the member, a new member is
+// generated if none is given, along with the raw public keys of both
+func newTestingMemberDevice(t testing.TB, member crypto.PubKey) (secretstore.MemberDevice, []byte, []byte) {
+	t.Helper()
+
+	if member == nil {
+		_, pub, err := crypto.GenerateEd25519Key(crand.Reader)
+		require.NoError(t, err)
+
+		member = pub
+	}
+
+	_, device, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberRaw, err := member.Raw()
+	require.NoError(t, err)
+
+	deviceRaw, err := device.Raw()
+	require.NoError(t, err)
+
+	return secretstore.NewMemberDevice(member, device), memberRaw, deviceRaw
+}
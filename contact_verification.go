@@ -0,0 +1,61 @@
+package weshnet
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	contactFingerprintVersion    = 0
+	contactFingerprintIterations = 5200
+	contactFingerprintLength     = 30
+)
+
+// contactFingerprint derives the part of the safety number of an account by
+// iterating a hash of its public key, the slow derivation makes it costly to
+// generate a key with a colliding safety number
+func contactFingerprint(accountPK []byte) []byte {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, contactFingerprintVersion)
+
+	hash := append(version, accountPK...)
+	for i := 0; i < contactFingerprintIterations; i++ {
+		h := sha512.Sum512(append(hash, accountPK...))
+		hash = h[:]
+	}
+
+	return hash[:contactFingerprintLength]
+}
+
+// contactFingerprintDigits encodes a fingerprint as six groups of five digits
+func contactFingerprintDigits(fingerprint []byte) []string {
+	digits := make([]string, 0, contactFingerprintLength/5)
+	for i := 0; i+5 <= len(fingerprint); i += 5 {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], fingerprint[i:i+5])
+		digits = append(digits, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk)%100000))
+	}
+
+	return digits
+}
+
+// contactSafetyNumber returns the safety number of two accounts and its QR
+// code payload, both are the same whichever account computes them
+func contactSafetyNumber(ownPK, contactPK []byte) (string, []byte) {
+	first, second := contactFingerprint(ownPK), contactFingerprint(contactPK)
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
+	digits := append(contactFingerprintDigits(first), contactFingerprintDigits(second)...)
+
+	payload := make([]byte, 0, 1+2*contactFingerprintLength)
+	payload = append(payload, contactFingerprintVersion)
+	payload = append(payload, first...)
+	payload = append(payload, second...)
+
+	return strings.Join(digits, " "), payload
+}
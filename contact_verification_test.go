@@ -0,0 +1,32 @@
+package weshnet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContactSafetyNumber(t *testing.T) {
+	alice, bob, charlie := newTestingAccountPK(t), newTestingAccountPK(t), newTestingAccountPK(t)
+
+	safetyNumber, payload := contactSafetyNumber(alice, bob)
+
+	// both accounts compute the same safety number
+	otherSafetyNumber, otherPayload := contactSafetyNumber(bob, alice)
+	require.Equal(t, safetyNumber, otherSafetyNumber)
+	require.Equal(t, payload, otherPayload)
+
+	groups := strings.Split(safetyNumber, " ")
+	require.Len(t, groups, 12)
+	for _, group := range groups {
+		require.Len(t, group, 5)
+	}
+
+	require.Len(t, payload, 1+2*contactFingerprintLength)
+
+	// the safety number changes with the keys
+	otherSafetyNumber, otherPayload = contactSafetyNumber(alice, charlie)
+	require.NotEqual(t, safetyNumber, otherSafetyNumber)
+	require.NotEqual(t, payload, otherPayload)
+}
@@ -0,0 +1,347 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// deviceActivityInterval is the delay between two checks of the devices
+	// of the account
+	deviceActivityInterval = time.Hour
+
+	// deviceActivityResolution is the precision of the recorded last seen
+	// times, it limits the writes to the datastore
+	deviceActivityResolution = time.Minute
+
+	// defaultStaleDeviceDelay is the delay after which a device of the
+	// account which hasn't synced is reported as stale
+	defaultStaleDeviceDelay = 30 * 24 * time.Hour
+
+	// deviceWatchNamespace holds the time at which the devices never seen
+	// started to be watched, it can't collide with an encoded group key
+	deviceWatchNamespace = "watch"
+)
+
+// deviceActivity records, for each group, the last time an entry of each
+// device has been received
+type deviceActivity struct {
+	datastore datastore.Datastore
+	logger    *zap.Logger
+
+	// lastSeen caches the recorded times to avoid a write per entry
+	lastSeen map[datastore.Key]time.Time
+
+	// alerted stores the last seen time of the devices already reported as
+	// stale, a device is reported again if it has synced since
+	alerted map[string]time.Time
+
+	mu sync.Mutex
+}
+
+func newDeviceActivity(ds datastore.Datastore, logger *zap.Logger) *deviceActivity {
+	return &deviceActivity{
+		datastore: ds,
+		logger:    logger.Named("device-activity"),
+		lastSeen:  make(map[datastore.Key]time.Time),
+		alerted:   make(map[string]time.Time),
+	}
+}
+
+func dsKeyForDeviceActivity(groupPK []byte, devicePK []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString(groupPK),
+		base64.RawURLEncoding.EncodeToString(devicePK),
+	})
+}
+
+// seen records an entry of the device on the group sent at the given time,
+// the recorded time only moves forward
+func (a *deviceActivity) seen(ctx context.Context, groupPK []byte, devicePK []byte, sentAt time.Time) {
+	if len(devicePK) == 0 {
+		return
+	}
+
+	key := dsKeyForDeviceActivity(groupPK, devicePK)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	last, ok := a.lastSeen[key]
+	if !ok {
+		last, ok, _ = a.lastSeenOn(ctx, groupPK, devicePK)
+	}
+
+	if ok && sentAt.Sub(last) < deviceActivityResolution {
+		a.lastSeen[key] = last
+		return
+	}
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(sentAt.Unix()))
+
+	if err := a.datastore.Put(ctx, key, data); err != nil {
+		a.logger.Warn("unable to record device activity", logutil.PrivateBinary("device", devicePK), zap.Error(err))
+		return
+	}
+
+	a.lastSeen[key] = sentAt
+}
+
+// watch starts the clock of a device never seen on any group, it is kept if
+// it has already been started
+func (a *deviceActivity) watch(ctx context.Context, devicePK []byte, now time.Time) {
+	key := dsKeyForDeviceWatch(devicePK)
+	if ok, err := a.datastore.Has(ctx, key); err != nil || ok {
+		return
+	}
+
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(now.Unix()))
+
+	if err := a.datastore.Put(ctx, key, data); err != nil {
+		a.logger.Warn("unable to record device activity", logutil.PrivateBinary("device", devicePK), zap.Error(err))
+	}
+}
+
+// watchedSince returns the time at which the clock of a device never seen
+// has been started, false if it hasn't
+func (a *deviceActivity) watchedSince(ctx context.Context, devicePK []byte) (time.Time, bool, error) {
+	data, err := a.datastore.Get(ctx, dsKeyForDeviceWatch(devicePK))
+	if err == datastore.ErrNotFound || (err == nil && len(data) != 8) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return time.Unix(int64(binary.BigEndian.Uint64(data)), 0), true, nil
+}
+
+// reported marks a stale device as reported for the given last seen time
+func (a *deviceActivity) reported(evt *protocoltypes.AccountDeviceStale) {
+	a.mu.Lock()
+	a.alerted[string(evt.DevicePk)] = time.Unix(evt.LastSeen, 0)
+	a.mu.Unlock()
+}
+
+func dsKeyForDeviceWatch(devicePK []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		deviceWatchNamespace,
+		base64.RawURLEncoding.EncodeToString(devicePK),
+	})
+}
+
+// lastSeenOn returns the last time an entry of the device has been received
+// on the group, false if none has been recorded
+func (a *deviceActivity) lastSeenOn(ctx context.Context, groupPK []byte, devicePK []byte) (time.Time, bool, error) {
+	data, err := a.datastore.Get(ctx, dsKeyForDeviceActivity(groupPK, devicePK))
+	if err == datastore.ErrNotFound || (err == nil && len(data) != 8) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return time.Unix(int64(binary.BigEndian.Uint64(data)), 0), true, nil
+}
+
+// list returns the last seen time of the devices of the group, most recently
+// seen first
+func (a *deviceActivity) list(ctx context.Context, groupPK []byte) ([]*protocoltypes.GroupDeviceStatus_Reply_DeviceLastSeen, error) {
+	prefix := datastore.NewKey(base64.RawURLEncoding.EncodeToString(groupPK)).String()
+
+	results, err := a.datastore.Query(ctx, query.Query{Prefix: prefix})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	devices := []*protocoltypes.GroupDeviceStatus_Reply_DeviceLastSeen{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		if len(result.Value) != 8 {
+			continue
+		}
+
+		devicePK, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(result.Key, prefix+"/"))
+		if err != nil {
+			continue
+		}
+
+		devices = append(devices, &protocoltypes.GroupDeviceStatus_Reply_DeviceLastSeen{
+			DevicePk: devicePK,
+			LastSeen: int64(binary.BigEndian.Uint64(result.Value)),
+		})
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastSeen > devices[j].LastSeen
+	})
+
+	return devices, nil
+}
+
+// staleDevices returns the devices which haven't been seen on any of the
+// given groups for longer than delay and which haven't been reported yet, and
+// the devices never seen whose clock hasn't been started by watch.
+func (a *deviceActivity) staleDevices(ctx context.Context, groupPKs [][]byte, devicePKs [][]byte, delay time.Duration, now time.Time) (stale []*protocoltypes.AccountDeviceStale, unseen [][]byte, err error) {
+	if len(groupPKs) == 0 {
+		return nil, nil, nil
+	}
+
+	stale = []*protocoltypes.AccountDeviceStale{}
+	for _, devicePK := range devicePKs {
+		var (
+			lastSeen time.Time
+			found    bool
+		)
+
+		for _, groupPK := range groupPKs {
+			seen, ok, err := a.lastSeenOn(ctx, groupPK, devicePK)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if ok && seen.After(lastSeen) {
+				lastSeen, found = seen, true
+			}
+		}
+
+		since := lastSeen
+		if !found {
+			watched, ok, err := a.watchedSince(ctx, devicePK)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !ok {
+				unseen = append(unseen, devicePK)
+				continue
+			}
+
+			since = watched
+		}
+
+		if now.Sub(since) < delay {
+			continue
+		}
+
+		evt := &protocoltypes.AccountDeviceStale{DevicePk: devicePK}
+		if found {
+			evt.LastSeen = lastSeen.Unix()
+		}
+
+		a.mu.Lock()
+		alerted, ok := a.alerted[string(devicePK)]
+		a.mu.Unlock()
+
+		if ok && alerted.Unix() == evt.LastSeen {
+			continue
+		}
+
+		stale = append(stale, evt)
+	}
+
+	return stale, unseen, nil
+}
+
+// startDeviceActivityJanitor periodically reports the devices of the account
+// which haven't synced on the account group nor on the contact groups
+func (s *service) startDeviceActivityJanitor() {
+	go func() {
+		ticker := time.NewTicker(deviceActivityInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				return
+			}
+
+			s.checkStaleDevices(time.Now())
+		}
+	}()
+}
+
+func (s *service) checkStaleDevices(now time.Time) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return
+	}
+
+	groupPKs := [][]byte{accountGroup.Group().PublicKey}
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		pk, err := contact.GetPubKey()
+		if err != nil {
+			continue
+		}
+
+		group, err := s.getContactGroup(pk)
+		if err != nil {
+			continue
+		}
+
+		groupPKs = append(groupPKs, group.PublicKey)
+	}
+
+	devicePKs := [][]byte{}
+	for _, device := range accountGroup.MetadataStore().ListDeviceInfos() {
+		if !device.Current && !device.Revoked && !device.Retired {
+			devicePKs = append(devicePKs, device.DevicePk)
+		}
+	}
+
+	stale, unseen, err := s.deviceActivity.staleDevices(s.ctx, groupPKs, devicePKs, s.staleDeviceDelay, now)
+	if err != nil {
+		s.logger.Error("unable to check device activity", zap.Error(err))
+		return
+	}
+
+	// the clock of the devices never seen starts now
+	for _, devicePK := range unseen {
+		s.deviceActivity.watch(s.ctx, devicePK, now)
+	}
+
+	for _, evt := range stale {
+		if err := accountGroup.MetadataStore().emitLocalEvent(protocoltypes.EventType_EventTypeAccountDeviceStale, evt); err != nil {
+			s.logger.Warn("unable to emit device stale event", zap.Error(err))
+			continue
+		}
+
+		s.deviceActivity.reported(evt)
+	}
+}
+
+// recordDeviceActivity records the entries received by the stores of the
+// group, at the time reported by their author unless it is in the future or
+// missing
+func (s *service) recordDeviceActivity(gc *GroupContext) {
+	groupPK := gc.Group().PublicKey
+	recorder := func(devicePK []byte, sentAt int64) {
+		at := time.Now()
+		if sentAt > 0 && sentAt < at.Unix() {
+			at = time.Unix(sentAt, 0)
+		}
+
+		s.deviceActivity.seen(s.ctx, groupPK, devicePK, at)
+	}
+
+	gc.messageStore.setDeviceSeenRecorder(recorder)
+	gc.metadataStore.setDeviceSeenRecorder(recorder)
+}
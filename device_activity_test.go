@@ -0,0 +1,85 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestDeviceActivity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := newDeviceActivity(dsync.MutexWrap(ds.NewMapDatastore()), zap.NewNop())
+	accountPK, contactPK := []byte("account"), []byte("contact")
+	now := time.Unix(time.Now().Unix(), 0)
+
+	a.seen(ctx, accountPK, []byte("device 1"), now.Add(-time.Hour))
+	a.seen(ctx, accountPK, []byte("device 2"), now)
+
+	// the last seen time is recorded with a resolution of a minute
+	a.seen(ctx, accountPK, []byte("device 2"), now.Add(time.Second))
+
+	devices, err := a.list(ctx, accountPK)
+	require.NoError(t, err)
+	require.Equal(t, []*protocoltypes.GroupDeviceStatus_Reply_DeviceLastSeen{
+		{DevicePk: []byte("device 2"), LastSeen: now.Unix()},
+		{DevicePk: []byte("device 1"), LastSeen: now.Add(-time.Hour).Unix()},
+	}, devices)
+
+	devices, err = a.list(ctx, contactPK)
+	require.NoError(t, err)
+	require.Empty(t, devices)
+
+	// the entries are recorded at the time they have been sent, an older
+	// entry received later doesn't move the last seen time back
+	a.seen(ctx, accountPK, []byte("device 2"), now.Add(-2*time.Hour))
+
+	devices, err = a.list(ctx, accountPK)
+	require.NoError(t, err)
+	require.Equal(t, now.Unix(), devices[0].LastSeen)
+
+	// device 1 has synced more recently on the contact group
+	a.seen(ctx, contactPK, []byte("device 1"), now.Add(-time.Minute))
+
+	groupPKs := [][]byte{accountPK, contactPK}
+	devicePKs := [][]byte{[]byte("device 1"), []byte("device 2"), []byte("device 3")}
+
+	// the clock of device 3 hasn't been started, checking the devices
+	// doesn't write anything
+	stale, unseen, err := a.staleDevices(ctx, groupPKs, devicePKs, 30*time.Minute, now)
+	require.NoError(t, err)
+	require.Empty(t, stale)
+	require.Equal(t, [][]byte{[]byte("device 3")}, unseen)
+
+	a.watch(ctx, []byte("device 3"), now)
+
+	stale, unseen, err = a.staleDevices(ctx, groupPKs, devicePKs, 30*time.Minute, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, unseen)
+	require.Equal(t, []*protocoltypes.AccountDeviceStale{
+		{DevicePk: []byte("device 1"), LastSeen: now.Add(-time.Minute).Unix()},
+		{DevicePk: []byte("device 2"), LastSeen: now.Unix()},
+		{DevicePk: []byte("device 3")},
+	}, stale)
+
+	for _, evt := range stale {
+		a.reported(evt)
+	}
+
+	// the stale devices are reported once until they sync again
+	a.seen(ctx, contactPK, []byte("device 2"), now.Add(time.Hour))
+
+	stale, _, err = a.staleDevices(ctx, groupPKs, devicePKs, 30*time.Minute, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []*protocoltypes.AccountDeviceStale{
+		{DevicePk: []byte("device 2"), LastSeen: now.Add(time.Hour).Unix()},
+	}, stale)
+}
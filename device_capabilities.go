@@ -0,0 +1,33 @@
+package weshnet
+
+import (
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// defaultDeviceCapabilities returns the capabilities of this implementation,
+// the messages it receives are not limited in size
+func defaultDeviceCapabilities() *protocoltypes.DeviceCapabilities {
+	return &protocoltypes.DeviceCapabilities{
+		Flags: uint64(protocoltypes.DeviceCapability_DeviceCapabilityOutOfStore),
+	}
+}
+
+// HasDeviceCapability returns true if the capability is set in the
+// capabilities announced by a device
+func HasDeviceCapability(capabilities *protocoltypes.DeviceCapabilities, capability protocoltypes.DeviceCapability) bool {
+	flag := uint64(capability)
+	return flag != 0 && capabilities.GetFlags()&flag == flag
+}
+
+// announceDeviceCapabilities announces the capabilities of the device on the
+// group if they have changed since its last announce
+func (s *service) announceDeviceCapabilities(gc *GroupContext) {
+	go func() {
+		if _, err := gc.MetadataStore().SetDeviceCapabilities(s.ctx, s.deviceCapabilities); err != nil {
+			s.logger.Warn("unable to announce device capabilities", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,586 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/box"
+	"google.golang.org/protobuf/proto"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/protoio"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+const (
+	deviceHistorySyncV1 = protocol.ID("/wesh/history_sync/1.0.0")
+
+	// deviceHistorySyncChunkSize is the number of entries of a group whose
+	// keys are sent in a single chunk
+	deviceHistorySyncChunkSize = 200
+
+	// deviceHistorySyncHelloValidity is the maximum clock difference accepted
+	// between two devices starting a transfer
+	deviceHistorySyncHelloValidity = 5 * time.Minute
+
+	deviceHistorySyncMaxHelloSize   = 2048
+	deviceHistorySyncMaxMessageSize = 4 * 1024 * 1024
+)
+
+// deviceHistorySyncSession encrypts the messages of a transfer with the
+// ephemeral keys exchanged in the signed hellos, only the devices which signed
+// them can read the transfer
+type deviceHistorySyncSession struct {
+	ephemeralPrivateKey *[cryptoutil.KeySize]byte
+	peerEphemeralPK     *[cryptoutil.KeySize]byte
+}
+
+// newDeviceHistorySyncHello signs the ephemeral key of a transfer with the
+// key of the device in the account group
+func newDeviceHistorySyncHello(md secretstore.OwnMemberDevice, ephemeralPK *[cryptoutil.KeySize]byte, peerEphemeralPK []byte, now time.Time) (*protocoltypes.DeviceHistorySyncSignedHello, error) {
+	devicePK, err := md.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	hello, err := proto.Marshal(&protocoltypes.DeviceHistorySyncHello{
+		DevicePk:        devicePK,
+		EphemeralPk:     ephemeralPK[:],
+		PeerEphemeralPk: peerEphemeralPK,
+		Timestamp:       now.Unix(),
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	sig, err := md.DeviceSign(hello)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return &protocoltypes.DeviceHistorySyncSignedHello{Hello: hello, Sig: sig}, nil
+}
+
+// openDeviceHistorySyncHello checks the signature and the freshness of a hello,
+// the caller still has to check that its device belongs to the account
+func openDeviceHistorySyncHello(signed *protocoltypes.DeviceHistorySyncSignedHello, now time.Time) (*protocoltypes.DeviceHistorySyncHello, error) {
+	hello := &protocoltypes.DeviceHistorySyncHello{}
+	if err := proto.Unmarshal(signed.Hello, hello); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(hello.DevicePk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	ok, err := devicePK.Verify(signed.Hello, signed.Sig)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if !ok {
+		return nil, errcode.ErrCode_ErrCryptoSignatureVerification
+	}
+
+	if len(hello.EphemeralPk) != cryptoutil.KeySize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid ephemeral key"))
+	}
+
+	if d := now.Sub(time.Unix(hello.Timestamp, 0)); d > deviceHistorySyncHelloValidity || d < -deviceHistorySyncHelloValidity {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("hello timestamp out of range"))
+	}
+
+	return hello, nil
+}
+
+func newDeviceHistorySyncSession(ephemeralPrivateKey *[cryptoutil.KeySize]byte, peerEphemeralPK []byte) (*deviceHistorySyncSession, error) {
+	peerKey, err := cryptoutil.KeySliceToArray(peerEphemeralPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	return &deviceHistorySyncSession{
+		ephemeralPrivateKey: ephemeralPrivateKey,
+		peerEphemeralPK:     peerKey,
+	}, nil
+}
+
+func (s *deviceHistorySyncSession) seal(msg proto.Message) (*protocoltypes.DeviceHistorySyncBox, error) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return &protocoltypes.DeviceHistorySyncBox{
+		Nonce: nonce[:],
+		Box:   box.Seal(nil, data, nonce, s.peerEphemeralPK, s.ephemeralPrivateKey),
+	}, nil
+}
+
+func (s *deviceHistorySyncSession) open(env *protocoltypes.DeviceHistorySyncBox, msg proto.Message) error {
+	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	data, ok := box.Open(nil, env.Box, nonce, s.peerEphemeralPK, s.ephemeralPrivateKey)
+	if !ok {
+		return errcode.ErrCode_ErrCryptoDecrypt
+	}
+
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// deviceHistoryCursors records, for each group and each device of the
+// account, the CID of the last entry whose keys have been retrieved, so an
+// interrupted transfer can be resumed
+type deviceHistoryCursors struct {
+	datastore datastore.Datastore
+}
+
+func newDeviceHistoryCursors(ds datastore.Datastore) *deviceHistoryCursors {
+	return &deviceHistoryCursors{datastore: ds}
+}
+
+func dsKeyForDeviceHistoryCursor(groupPK []byte, devicePK []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString(groupPK),
+		base64.RawURLEncoding.EncodeToString(devicePK),
+	})
+}
+
+func (c *deviceHistoryCursors) get(ctx context.Context, groupPK []byte, devicePK []byte) ([]byte, error) {
+	data, err := c.datastore.Get(ctx, dsKeyForDeviceHistoryCursor(groupPK, devicePK))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return data, nil
+}
+
+func (c *deviceHistoryCursors) put(ctx context.Context, groupPK []byte, devicePK []byte, lastCID []byte) error {
+	if len(lastCID) == 0 {
+		return nil
+	}
+
+	if err := c.datastore.Put(ctx, dsKeyForDeviceHistoryCursor(groupPK, devicePK), lastCID); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// isOtherAccountDevice returns true if the device is another device of the
+// account which hasn't been revoked nor retired
+func isOtherAccountDevice(accountGroup *GroupContext, devicePK []byte) bool {
+	for _, device := range accountGroup.MetadataStore().ListDeviceInfos() {
+		if bytes.Equal(device.DevicePk, devicePK) {
+			return !device.Current && !device.Revoked && !device.Retired
+		}
+	}
+
+	return false
+}
+
+// deviceHistorySyncGroups returns the groups whose history can be transferred
+// between the devices of the account, indexed by public key
+func (s *service) deviceHistorySyncGroups(accountGroup *GroupContext) map[string]*protocoltypes.Group {
+	groups := map[string]*protocoltypes.Group{
+		string(accountGroup.Group().PublicKey): accountGroup.Group(),
+	}
+
+	for _, g := range s.deviceKeyRotationGroups(accountGroup) {
+		groups[string(g.PublicKey)] = g
+	}
+
+	return groups
+}
+
+// deviceHistorySyncPeers returns the connected peers known to be another
+// device of the account, the account and contact groups share the key of the
+// device
+func (s *service) deviceHistorySyncPeers(accountGroup *GroupContext, devicePK []byte) map[peer.ID][]byte {
+	peers := map[peer.ID][]byte{}
+	for _, p := range s.host.Network().Peers() {
+		pdg, ok := s.odb.GetDevicePKForPeerID(p)
+		if !ok {
+			continue
+		}
+
+		raw, err := pdg.DevicePK.Raw()
+		if err != nil {
+			continue
+		}
+
+		if len(devicePK) > 0 && !bytes.Equal(raw, devicePK) {
+			continue
+		}
+
+		if isOtherAccountDevice(accountGroup, raw) {
+			peers[p] = raw
+		}
+	}
+
+	return peers
+}
+
+// handleDeviceHistorySync answers the transfers requested by the other
+// devices of the account
+func (s *service) handleDeviceHistorySync(stream network.Stream) {
+	ctx, _, endSection := tyber.Section(s.ctx, s.logger, "Sending history to another device")
+
+	err := s.sendDeviceHistory(ctx, stream)
+	endSection(err, "")
+
+	if err != nil {
+		s.logger.Warn("unable to send history", zap.Error(err))
+
+		if err := stream.Reset(); err != nil {
+			s.logger.Error("unable to reset stream", zap.Error(err))
+		}
+
+		return
+	}
+
+	if err := stream.Close(); err != nil {
+		s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+	}
+}
+
+func (s *service) sendDeviceHistory(ctx context.Context, stream network.Stream) error {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return errcode.ErrCode_ErrGroupMissing
+	}
+
+	reader := protoio.NewDelimitedReader(stream, deviceHistorySyncMaxHelloSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	signed := &protocoltypes.DeviceHistorySyncSignedHello{}
+	if err := reader.ReadMsg(signed); err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	hello, err := openDeviceHistorySyncHello(signed, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if !isOtherAccountDevice(accountGroup, hello.DevicePk) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("requester is not a device of the account"))
+	}
+
+	ephemeralPK, ephemeralPrivateKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	if signed, err = newDeviceHistorySyncHello(accountGroup.ownMemberDevice, ephemeralPK, hello.EphemeralPk, time.Now()); err != nil {
+		return err
+	}
+
+	if err := writer.WriteMsg(signed); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	session, err := newDeviceHistorySyncSession(ephemeralPrivateKey, hello.EphemeralPk)
+	if err != nil {
+		return err
+	}
+
+	env := &protocoltypes.DeviceHistorySyncBox{}
+	if err := reader.ReadMsg(env); err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	cursors := &protocoltypes.DeviceHistorySyncCursors{}
+	if err := session.open(env, cursors); err != nil {
+		return err
+	}
+
+	groups := s.deviceHistorySyncGroups(accountGroup)
+	for _, cursor := range cursors.Cursors {
+		g, ok := groups[string(cursor.GroupPk)]
+		if !ok {
+			continue
+		}
+
+		gc, err := s.GetContextGroupForID(g.PublicKey)
+		if err != nil {
+			s.logger.Warn("unable to open group, its history won't be sent", logutil.PrivateBinary("pk", g.PublicKey), zap.Error(err))
+			continue
+		}
+
+		if err := s.sendGroupHistory(ctx, writer, session, gc, cursor.LastCid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// entriesAfterCursor returns the entries which aren't in the causal history
+// of the cursor, all of them if the cursor is unknown. The entries merged
+// before the cursor since the previous transfer are then sent, unlike with a
+// position which shifts as entries are merged.
+func entriesAfterCursor(entries []ipfslog.Entry, cursor []byte) []ipfslog.Entry {
+	id, err := cid.Cast(cursor)
+	if err != nil {
+		return entries
+	}
+
+	byCID := make(map[string]ipfslog.Entry, len(entries))
+	for _, e := range entries {
+		byCID[e.GetHash().KeyString()] = e
+	}
+
+	if _, ok := byCID[id.KeyString()]; !ok {
+		return entries
+	}
+
+	sent := map[string]struct{}{}
+	queue := []cid.Cid{id}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		if _, ok := sent[next.KeyString()]; ok {
+			continue
+		}
+		sent[next.KeyString()] = struct{}{}
+
+		if e, ok := byCID[next.KeyString()]; ok {
+			queue = append(queue, e.GetNext()...)
+		}
+	}
+
+	pending := make([]ipfslog.Entry, 0, len(entries))
+	for _, e := range entries {
+		if _, ok := sent[e.GetHash().KeyString()]; !ok {
+			pending = append(pending, e)
+		}
+	}
+
+	return pending
+}
+
+// sendGroupHistory sends the keys of the entries of the group after the given
+// cursor, the chain keys are only sent with the first chunk
+func (s *service) sendGroupHistory(ctx context.Context, writer protoio.Writer, session *deviceHistorySyncSession, gc *GroupContext, cursor []byte) error {
+	entries := entriesAfterCursor(gc.MessageStore().OpLog().GetEntries().Slice(), cursor)
+	total := uint64(len(entries))
+
+	var offset uint64
+	first := true
+	for first || offset < total {
+		end := offset + deviceHistorySyncChunkSize
+		if end > total {
+			end = total
+		}
+
+		ids := make([]cid.Cid, 0, end-offset)
+		for _, e := range entries[offset:end] {
+			ids = append(ids, e.GetHash())
+		}
+
+		keys, err := s.secretStore.ExportGroupKeys(ctx, gc.Group(), ids)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			keys.ChainKeys = nil
+		}
+
+		chunk := &protocoltypes.DeviceHistorySyncChunk{
+			GroupPk: gc.Group().PublicKey,
+			Offset:  end,
+			Total:   total,
+			Keys:    keys,
+		}
+
+		if end > 0 {
+			chunk.LastCid = entries[end-1].GetHash().Bytes()
+		}
+
+		env, err := session.seal(chunk)
+		if err != nil {
+			return err
+		}
+
+		if err := writer.WriteMsg(env); err != nil {
+			return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+		}
+
+		first, offset = false, end
+	}
+
+	return nil
+}
+
+// requestDeviceHistory retrieves the keys of the history of the groups from
+// another device of the account, progress is called after each imported chunk
+func (s *service) requestDeviceHistory(ctx context.Context, p peer.ID, devicePK []byte, accountGroup *GroupContext, groups []*protocoltypes.Group, restart bool, progress func(*protocoltypes.DeviceHistorySync_Reply) error) error {
+	stream, err := s.host.NewStream(ctx, p, deviceHistorySyncV1)
+	if err != nil {
+		return fmt.Errorf("unable to open stream: %w", err)
+	}
+
+	defer func() {
+		if err := stream.Close(); err != nil {
+			s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+		}
+	}()
+
+	reader := protoio.NewDelimitedReader(stream, deviceHistorySyncMaxMessageSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	ephemeralPK, ephemeralPrivateKey, err := box.GenerateKey(crand.Reader)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	signed, err := newDeviceHistorySyncHello(accountGroup.ownMemberDevice, ephemeralPK, nil, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := writer.WriteMsg(signed); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	if err := reader.ReadMsg(signed); err != nil {
+		return errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	hello, err := openDeviceHistorySyncHello(signed, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// the responder must be the expected device and must answer this request
+	if !bytes.Equal(hello.DevicePk, devicePK) || !bytes.Equal(hello.PeerEphemeralPk, ephemeralPK[:]) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("history sync hello does not match the request"))
+	}
+
+	session, err := newDeviceHistorySyncSession(ephemeralPrivateKey, hello.EphemeralPk)
+	if err != nil {
+		return err
+	}
+
+	requested := make(map[string]*protocoltypes.Group, len(groups))
+	cursors := &protocoltypes.DeviceHistorySyncCursors{}
+	for _, g := range groups {
+		var lastCID []byte
+		if !restart {
+			if lastCID, err = s.historyCursors.get(ctx, g.PublicKey, devicePK); err != nil {
+				return err
+			}
+		}
+
+		requested[string(g.PublicKey)] = g
+		cursors.Cursors = append(cursors.Cursors, &protocoltypes.DeviceHistorySyncCursors_Cursor{
+			GroupPk: g.PublicKey,
+			LastCid: lastCID,
+		})
+	}
+
+	env, err := session.seal(cursors)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.WriteMsg(env); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	for {
+		if err := reader.ReadMsg(env); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errcode.ErrCode_ErrStreamRead.Wrap(err)
+		}
+
+		chunk := &protocoltypes.DeviceHistorySyncChunk{}
+		if err := session.open(env, chunk); err != nil {
+			return err
+		}
+
+		g, ok := requested[string(chunk.GroupPk)]
+		if !ok {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("history received for a group not requested"))
+		}
+
+		if err := s.importDeviceHistoryChunk(ctx, g, chunk); err != nil {
+			return err
+		}
+
+		if err := s.historyCursors.put(ctx, g.PublicKey, devicePK, chunk.LastCid); err != nil {
+			return err
+		}
+
+		if err := progress(&protocoltypes.DeviceHistorySync_Reply{
+			GroupPk:     g.PublicKey,
+			DevicePk:    devicePK,
+			Transferred: chunk.Offset,
+			Total:       chunk.Total,
+			Done:        chunk.Offset >= chunk.Total,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// importDeviceHistoryChunk registers the keys of a chunk then retries the
+// messages of the group waiting for them
+func (s *service) importDeviceHistoryChunk(ctx context.Context, g *protocoltypes.Group, chunk *protocoltypes.DeviceHistorySyncChunk) error {
+	if chunk.Keys == nil {
+		return nil
+	}
+
+	if err := s.secretStore.ImportGroupKeys(ctx, g, chunk.Keys); err != nil {
+		return err
+	}
+
+	gc, err := s.GetContextGroupForID(g.PublicKey)
+	if err != nil {
+		// the keys are used when the group is opened
+		return nil
+	}
+
+	for _, chainKey := range chunk.Keys.ChainKeys {
+		gc.MessageStore().ProcessMessageQueueForDevicePK(ctx, chainKey.DevicePk)
+	}
+
+	return nil
+}
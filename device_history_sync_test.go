@@ -0,0 +1,118 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestDeviceHistorySyncHello(t *testing.T) {
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	_, md, err := secretStore.GetGroupForAccount()
+	require.NoError(t, err)
+
+	requesterPK, requesterPrivateKey, err := box.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	responderPK, responderPrivateKey, err := box.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	now := time.Now()
+	signed, err := newDeviceHistorySyncHello(md, responderPK, requesterPK[:], now)
+	require.NoError(t, err)
+
+	hello, err := openDeviceHistorySyncHello(signed, now)
+	require.NoError(t, err)
+	require.Equal(t, responderPK[:], hello.EphemeralPk)
+	require.Equal(t, requesterPK[:], hello.PeerEphemeralPk)
+
+	// old hellos can't be replayed
+	_, err = openDeviceHistorySyncHello(signed, now.Add(2*deviceHistorySyncHelloValidity))
+	require.Error(t, err)
+
+	// the hello can't be changed
+	tampered := &protocoltypes.DeviceHistorySyncSignedHello{Hello: append([]byte{}, signed.Hello...), Sig: signed.Sig}
+	tampered.Hello[len(tampered.Hello)-1]++
+	_, err = openDeviceHistorySyncHello(tampered, now)
+	require.Error(t, err)
+
+	requester, err := newDeviceHistorySyncSession(requesterPrivateKey, hello.EphemeralPk)
+	require.NoError(t, err)
+
+	responder, err := newDeviceHistorySyncSession(responderPrivateKey, requesterPK[:])
+	require.NoError(t, err)
+
+	env, err := responder.seal(&protocoltypes.DeviceHistorySyncChunk{GroupPk: []byte("group"), Offset: 3, Total: 5})
+	require.NoError(t, err)
+
+	chunk := &protocoltypes.DeviceHistorySyncChunk{}
+	require.NoError(t, requester.open(env, chunk))
+	require.Equal(t, []byte("group"), chunk.GroupPk)
+	require.Equal(t, uint64(3), chunk.Offset)
+	require.Equal(t, uint64(5), chunk.Total)
+
+	// only the requester can open the chunks
+	_, otherPrivateKey, err := box.GenerateKey(crand.Reader)
+	require.NoError(t, err)
+
+	other, err := newDeviceHistorySyncSession(otherPrivateKey, responderPK[:])
+	require.NoError(t, err)
+	require.Error(t, other.open(env, chunk))
+}
+
+func TestDeviceHistoryCursors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newDeviceHistoryCursors(dsync.MutexWrap(ds.NewMapDatastore()))
+
+	lastCID, err := c.get(ctx, []byte("group"), []byte("device 1"))
+	require.NoError(t, err)
+	require.Nil(t, lastCID)
+
+	require.NoError(t, c.put(ctx, []byte("group"), []byte("device 1"), []byte("cid")))
+
+	lastCID, err = c.get(ctx, []byte("group"), []byte("device 1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("cid"), lastCID)
+
+	// the progress is recorded for each device
+	lastCID, err = c.get(ctx, []byte("group"), []byte("device 2"))
+	require.NoError(t, err)
+	require.Nil(t, lastCID)
+}
+
+func TestEntriesAfterCursor(t *testing.T) {
+	ids := testLogCompactionCIDs(t)
+
+	// a <- b <- d and a <- c, c has been merged after b has been transferred
+	entries := []ipfslog.Entry{
+		&entry.Entry{Hash: ids[0]},
+		&entry.Entry{Hash: ids[1], Next: []cid.Cid{ids[0]}},
+		&entry.Entry{Hash: ids[2], Next: []cid.Cid{ids[0]}},
+		&entry.Entry{Hash: ids[3], Next: []cid.Cid{ids[1]}},
+	}
+
+	require.Equal(t, entries, entriesAfterCursor(entries, nil))
+	require.Equal(t, []ipfslog.Entry{entries[2], entries[3]}, entriesAfterCursor(entries, ids[1].Bytes()))
+	require.Equal(t, []ipfslog.Entry{entries[2]}, entriesAfterCursor(entries, ids[3].Bytes()))
+
+	// an unknown cursor transfers the whole history
+	unknown, err := cid.V0Builder{}.Sum([]byte("unknown"))
+	require.NoError(t, err)
+	require.Equal(t, entries, entriesAfterCursor(entries, unknown.Bytes()))
+}
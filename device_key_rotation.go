@@ -0,0 +1,49 @@
+package weshnet
+
+import (
+	"context"
+	"time"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// deviceKeyGracePeriod is the default delay during which the entries of a
+// rotated device key are still accepted
+const deviceKeyGracePeriod = 7 * 24 * time.Hour
+
+// deviceKeyRotationGroups returns the groups in which the current device key
+// has to be replaced, besides the account group
+func (s *service) deviceKeyRotationGroups(accountGroup *GroupContext) []*protocoltypes.Group {
+	groups := accountGroup.MetadataStore().ListMultiMemberGroups()
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		pk, err := contact.GetPubKey()
+		if err != nil {
+			continue
+		}
+
+		g, err := s.getContactGroup(pk)
+		if err != nil {
+			continue
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups
+}
+
+// announceDeviceKeyRotation links the next device key of the group to the
+// current one
+func (s *service) announceDeviceKeyRotation(ctx context.Context, gc *GroupContext, retiredAt time.Time) error {
+	next, err := s.secretStore.GetNextOwnMemberDeviceForGroup(gc.Group())
+	if err != nil {
+		return err
+	}
+
+	if _, err := gc.MetadataStore().RotateDeviceKey(ctx, next, retiredAt); err != nil {
+		return errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,479 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/internal/handshake"
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/protoio"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+const (
+	deviceLinkV1 = "/wesh/device_link/1.0.0"
+
+	// deviceLinkTimeout is the delay after which a provisioning payload can't
+	// be used anymore
+	deviceLinkTimeout = 10 * time.Minute
+
+	// deviceLinkHistoryLimit is the default number of recent messages of each
+	// group whose keys are sent to the new device
+	deviceLinkHistoryLimit = 100
+
+	// deviceLinkMaxMessageSize is the maximum size of a message exchanged
+	// during a link, the bundle contains the keys of the recent messages
+	deviceLinkMaxMessageSize = 32 * 1024 * 1024
+)
+
+// newDeviceLinkPayload creates a payload with a random rendezvous point and
+// link secret
+func newDeviceLinkPayload(accountPK []byte) (*protocoltypes.DeviceLinkPayload, error) {
+	payload := &protocoltypes.DeviceLinkPayload{
+		AccountPk:      accountPK,
+		RendezvousSeed: make([]byte, cryptoutil.KeySize),
+		LinkSecret:     make([]byte, cryptoutil.KeySize),
+	}
+
+	if _, err := crand.Read(payload.RendezvousSeed); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	if _, err := crand.Read(payload.LinkSecret); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return payload, nil
+}
+
+// checkDeviceLinkPayload checks that a payload has been created by
+// newDeviceLinkPayload
+func checkDeviceLinkPayload(payload *protocoltypes.DeviceLinkPayload) error {
+	if _, err := crypto.UnmarshalEd25519PublicKey(payload.AccountPk); err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if len(payload.RendezvousSeed) != cryptoutil.KeySize || len(payload.LinkSecret) != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid device link payload"))
+	}
+
+	return nil
+}
+
+func sealDeviceLinkEnvelope(linkSecret []byte, msg proto.Message) (*protocoltypes.DeviceLinkEnvelope, error) {
+	key, err := cryptoutil.KeySliceToArray(linkSecret)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return &protocoltypes.DeviceLinkEnvelope{
+		Nonce: nonce[:],
+		Box:   secretbox.Seal(nil, data, nonce, key),
+	}, nil
+}
+
+func openDeviceLinkEnvelope(linkSecret []byte, env *protocoltypes.DeviceLinkEnvelope, msg proto.Message) error {
+	key, err := cryptoutil.KeySliceToArray(linkSecret)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	data, ok := secretbox.Open(nil, env.Box, nonce, key)
+	if !ok {
+		return errcode.ErrCode_ErrCryptoDecrypt
+	}
+
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return nil
+}
+
+// recentMessageCIDs returns the identifiers of the most recent entries of a
+// message store
+func recentMessageCIDs(m *MessageStore, limit int) []cid.Cid {
+	entries := m.OpLog().GetEntries().Slice()
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	ids := make([]cid.Cid, len(entries))
+	for i, e := range entries {
+		ids[i] = e.GetHash()
+	}
+
+	return ids
+}
+
+// deviceLinkBundle exports the account keys, a device key linked on the
+// account group, the groups of the account and their keys, with the keys of
+// their recent messages if requested
+func (s *service) deviceLinkBundle(ctx context.Context, includeHistory bool, historyLimit int) (*protocoltypes.DeviceLinkBundle, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	bundle := &protocoltypes.DeviceLinkBundle{}
+
+	var err error
+	if bundle.AccountPrivateKey, bundle.AccountProofPrivateKey, err = s.secretStore.ExportAccountKeysForBackup(); err != nil {
+		return nil, err
+	}
+
+	// the key of the new device is generated and linked by the primary
+	// device, the devices added otherwise can't become the primary device
+	deviceSK, devicePK, err := crypto.GenerateEd25519Key(crand.Reader)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	if bundle.DevicePrivateKey, err = crypto.MarshalPrivateKey(deviceSK); err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if _, err := accountGroup.MetadataStore().DeviceLink(ctx, devicePK); err != nil {
+		return nil, err
+	}
+
+	groups := accountGroup.MetadataStore().ListMultiMemberGroups()
+	for _, contact := range accountGroup.MetadataStore().ListContactsByStatus(protocoltypes.ContactState_ContactStateAdded) {
+		pk, err := contact.GetPubKey()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		g, err := s.secretStore.GetGroupForContact(pk)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		groups = append(groups, g)
+	}
+
+	for _, g := range groups {
+		var messageCIDs []cid.Cid
+		if includeHistory {
+			if gc, err := s.GetContextGroupForID(g.PublicKey); err != nil {
+				s.logger.Warn("unable to open group, its history won't be sent", logutil.PrivateBinary("pk", g.PublicKey), zap.Error(err))
+			} else {
+				messageCIDs = recentMessageCIDs(gc.MessageStore(), historyLimit)
+			}
+		}
+
+		keys, err := s.secretStore.ExportGroupKeys(ctx, g, messageCIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		bundle.Groups = append(bundle.Groups, g)
+		bundle.GroupKeys = append(bundle.GroupKeys, &protocoltypes.DeviceLinkBundle_GroupKeys{
+			GroupPk: g.PublicKey,
+			Keys:    keys,
+		})
+	}
+
+	return bundle, nil
+}
+
+// deviceLinkSession is a provisioning payload waiting for a new device
+type deviceLinkSession struct {
+	linkSecret []byte
+	getBundle  func() (*protocoltypes.DeviceLinkBundle, error)
+	used       atomic.Bool
+	linked     chan struct{}
+}
+
+// linkDevice waits for the new device on the rendezvous point of the payload
+// and sends it the bundle, a payload can only be used by a single device
+func (s *service) linkDevice(ctx context.Context, payload *protocoltypes.DeviceLinkPayload, getBundle func() (*protocoltypes.DeviceLinkBundle, error)) error {
+	if s.swiper == nil || s.ipfsCoreAPI == nil {
+		return errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("device link requires the rendezvous points"))
+	}
+
+	session := &deviceLinkSession{
+		linkSecret: payload.LinkSecret,
+		getBundle:  getBundle,
+		linked:     make(chan struct{}),
+	}
+
+	s.muDeviceLinks.Lock()
+	s.deviceLinks[session] = struct{}{}
+	s.muDeviceLinks.Unlock()
+
+	defer func() {
+		s.muDeviceLinks.Lock()
+		delete(s.deviceLinks, session)
+		s.muDeviceLinks.Unlock()
+	}()
+
+	announceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.swiper.Announce(announceCtx, payload.AccountPk, payload.RendezvousSeed)
+
+	select {
+	case <-session.linked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleDeviceLink answers the new devices looking for a pending link, the
+// session is the one whose link secret opens the request
+func (s *service) handleDeviceLink(stream network.Stream) {
+	ctx, _, endSection := tyber.Section(s.ctx, s.logger, "receiving device link request")
+
+	session, err := s.handleDeviceLinkRequest(ctx, stream)
+	endSection(err, "")
+
+	if err != nil {
+		s.logger.Warn("unable to link device", zap.Error(err))
+
+		if err := stream.Reset(); err != nil {
+			s.logger.Error("unable to reset stream", zap.Error(err))
+		}
+
+		return
+	}
+
+	// the bundle is flushed before closing the stream
+	if err := stream.Close(); err != nil {
+		s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+	}
+
+	close(session.linked)
+}
+
+// deviceLinkSessionForRequest returns the pending session whose link secret
+// opens the request
+func (s *service) deviceLinkSessionForRequest(env *protocoltypes.DeviceLinkEnvelope, req *protocoltypes.DeviceLinkRequest) (*deviceLinkSession, error) {
+	s.muDeviceLinks.Lock()
+	defer s.muDeviceLinks.Unlock()
+
+	for session := range s.deviceLinks {
+		if err := openDeviceLinkEnvelope(session.linkSecret, env, req); err == nil {
+			return session, nil
+		}
+	}
+
+	return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("no pending device link for the request"))
+}
+
+func (s *service) handleDeviceLinkRequest(ctx context.Context, stream network.Stream) (*deviceLinkSession, error) {
+	accountPrivateKey, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	reader := protoio.NewDelimitedReader(stream, 2048)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	requesterPK, err := handshake.ResponseUsingReaderWriter(ctx, s.logger, reader, writer, accountPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	requesterPKBytes, err := requesterPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// the new device proves it has read the payload
+	env := &protocoltypes.DeviceLinkEnvelope{}
+	if err := reader.ReadMsg(env); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	req := &protocoltypes.DeviceLinkRequest{}
+	session, err := s.deviceLinkSessionForRequest(env, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(req.RequesterPk, requesterPKBytes) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device link request does not match handshake data"))
+	}
+
+	if !session.used.CompareAndSwap(false, true) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device link payload already used"))
+	}
+
+	bundle, err := session.getBundle()
+	if err != nil {
+		return nil, err
+	}
+
+	if env, err = sealDeviceLinkEnvelope(session.linkSecret, bundle); err != nil {
+		return nil, err
+	}
+
+	if err := writer.WriteMsg(env); err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	return session, nil
+}
+
+// joinDeviceLink looks for the device which created the payload on its
+// rendezvous point and retrieves the bundle from it
+func (s *service) joinDeviceLink(ctx context.Context, payload *protocoltypes.DeviceLinkPayload) (*protocoltypes.DeviceLinkBundle, error) {
+	if s.swiper == nil || s.ipfsCoreAPI == nil {
+		return nil, errcode.ErrCode_ErrNotImplemented.Wrap(fmt.Errorf("device link requires the rendezvous points"))
+	}
+
+	accountPK, err := crypto.UnmarshalEd25519PublicKey(payload.AccountPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the temporary account of the new device is only used for the handshake
+	ownPrivateKey, err := s.secretStore.GetAccountPrivateKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if ownPrivateKey.GetPublic().Equals(accountPK) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device already linked to this account"))
+	}
+
+	for peer := range s.swiper.WatchTopic(ctx, payload.AccountPk, payload.RendezvousSeed) {
+		bundle, err := s.requestDeviceLink(ctx, peer, ownPrivateKey, accountPK, payload.LinkSecret)
+		if err == nil {
+			return bundle, nil
+		}
+
+		s.logger.Warn("unable to retrieve device link bundle", zap.Error(err))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("no device found on the rendezvous point"))
+}
+
+func (s *service) requestDeviceLink(ctx context.Context, peer peer.AddrInfo, ownPrivateKey crypto.PrivKey, accountPK crypto.PubKey, linkSecret []byte) (*protocoltypes.DeviceLinkBundle, error) {
+	if err := s.ipfsCoreAPI.Swarm().Connect(ctx, peer); err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	stream, err := s.ipfsCoreAPI.NewStream(network.WithAllowLimitedConn(ctx, "device_link"), peer.ID, deviceLinkV1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open stream: %w", err)
+	}
+
+	defer func() {
+		if err := stream.Close(); err != nil {
+			s.logger.Warn("error while closing stream with other peer", zap.Error(err))
+		}
+	}()
+
+	reader := protoio.NewDelimitedReader(stream, deviceLinkMaxMessageSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	if err := handshake.RequestUsingReaderWriter(ctx, s.logger, reader, writer, ownPrivateKey, accountPK); err != nil {
+		return nil, fmt.Errorf("an error occurred during handshake: %w", err)
+	}
+
+	ownPK, err := ownPrivateKey.GetPublic().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	env, err := sealDeviceLinkEnvelope(linkSecret, &protocoltypes.DeviceLinkRequest{RequesterPk: ownPK})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writer.WriteMsg(env); err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	if err := reader.ReadMsg(env); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	bundle := &protocoltypes.DeviceLinkBundle{}
+	if err := openDeviceLinkEnvelope(linkSecret, env, bundle); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// ImportDeviceLinkBundle restores the bundle returned by DeviceLinkJoin in the
+// secret store of the new device, it must be called with a secret store
+// without account before starting the service of the device
+func ImportDeviceLinkBundle(ctx context.Context, secretStore secretstore.SecretStore, bundleBytes []byte) error {
+	bundle := &protocoltypes.DeviceLinkBundle{}
+	if err := proto.Unmarshal(bundleBytes, bundle); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the device key must be set before the account
+	if len(bundle.DevicePrivateKey) > 0 {
+		if err := secretStore.ImportDeviceKey(bundle.DevicePrivateKey); err != nil {
+			return err
+		}
+	}
+
+	if err := secretStore.ImportAccountKeys(bundle.AccountPrivateKey, bundle.AccountProofPrivateKey); err != nil {
+		return err
+	}
+
+	groups := make(map[string]*protocoltypes.Group, len(bundle.Groups))
+	for _, g := range bundle.Groups {
+		if err := secretStore.PutGroup(ctx, g); err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		groups[string(g.PublicKey)] = g
+	}
+
+	for _, keys := range bundle.GroupKeys {
+		g, ok := groups[string(keys.GroupPk)]
+		if !ok || keys.Keys == nil {
+			continue
+		}
+
+		if err := secretStore.ImportGroupKeys(ctx, g, keys.Keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestDeviceLinkEnvelope(t *testing.T) {
+	payload, err := newDeviceLinkPayload([]byte("account"))
+	require.NoError(t, err)
+
+	other, err := newDeviceLinkPayload([]byte("account"))
+	require.NoError(t, err)
+
+	env, err := sealDeviceLinkEnvelope(payload.LinkSecret, &protocoltypes.DeviceLinkRequest{RequesterPk: []byte("requester")})
+	require.NoError(t, err)
+
+	req := &protocoltypes.DeviceLinkRequest{}
+	require.NoError(t, openDeviceLinkEnvelope(payload.LinkSecret, env, req))
+	require.Equal(t, []byte("requester"), req.RequesterPk)
+
+	// only the devices which have read the payload can open the envelope
+	require.Error(t, openDeviceLinkEnvelope(other.LinkSecret, env, req))
+
+	// the account key of the payload must be valid
+	require.Error(t, checkDeviceLinkPayload(payload))
+}
+
+func TestImportDeviceLinkBundle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	existing, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+	require.NoError(t, existing.PutGroup(ctx, g))
+
+	bundle := &protocoltypes.DeviceLinkBundle{Groups: []*protocoltypes.Group{g}}
+	bundle.AccountPrivateKey, bundle.AccountProofPrivateKey, err = existing.ExportAccountKeysForBackup()
+	require.NoError(t, err)
+
+	deviceSK, devicePK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	bundle.DevicePrivateKey, err = crypto.MarshalPrivateKey(deviceSK)
+	require.NoError(t, err)
+
+	keys, err := existing.ExportGroupKeys(ctx, g, nil)
+	require.NoError(t, err)
+	bundle.GroupKeys = []*protocoltypes.DeviceLinkBundle_GroupKeys{{GroupPk: g.PublicKey, Keys: keys}}
+
+	bundleBytes, err := proto.Marshal(bundle)
+	require.NoError(t, err)
+
+	linked, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+	require.NoError(t, ImportDeviceLinkBundle(ctx, linked, bundleBytes))
+
+	existingPK, err := existing.GetAccountPrivateKey()
+	require.NoError(t, err)
+
+	linkedPK, err := linked.GetAccountPrivateKey()
+	require.NoError(t, err)
+	require.True(t, existingPK.Equals(linkedPK))
+
+	// the new device uses the key linked by the primary device
+	_, linkedDevice, err := linked.GetGroupForAccount()
+	require.NoError(t, err)
+	require.True(t, devicePK.Equals(linkedDevice.Device()))
+
+	groupPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	imported, err := linked.FetchGroupByPublicKey(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, g.PublicKey, imported.PublicKey)
+
+	// the bundle can't replace the account of a device
+	require.Error(t, ImportDeviceLinkBundle(ctx, linked, bundleBytes))
+}
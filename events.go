@@ -1,9 +1,13 @@
 package weshnet
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	"golang.org/x/crypto/nacl/secretbox"
 	"google.golang.org/protobuf/proto"
 
@@ -11,6 +15,7 @@ import (
 	"berty.tech/weshnet/v2/pkg/cryptoutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
 )
 
 var eventTypesMapper = map[protocoltypes.EventType]struct {
@@ -19,6 +24,11 @@ var eventTypesMapper = map[protocoltypes.EventType]struct {
 }{
 	protocoltypes.EventType_EventTypeGroupMemberDeviceAdded:                 {Message: &protocoltypes.GroupMemberDeviceAdded{}, SigChecker: sigCheckerGroupMemberDeviceAdded},
 	protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded:               {Message: &protocoltypes.GroupDeviceChainKeyAdded{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupDeviceCapabilitiesSet:             {Message: &protocoltypes.GroupDeviceCapabilitiesSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupDeviceKeyRotated:                  {Message: &protocoltypes.GroupDeviceKeyRotated{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupMessagesAcknowledged:              {Message: &protocoltypes.GroupMessagesAcknowledged{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupMessagesRead:                      {Message: &protocoltypes.GroupMessagesRead{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeGroupDisappearingMessagesSet:           {Message: &protocoltypes.GroupDisappearingMessagesSet{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountGroupJoined:                     {Message: &protocoltypes.AccountGroupJoined{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountGroupLeft:                       {Message: &protocoltypes.AccountGroupLeft{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountContactRequestDisabled:          {Message: &protocoltypes.AccountContactRequestDisabled{}, SigChecker: sigCheckerDeviceSigned},
@@ -31,10 +41,43 @@ var eventTypesMapper = map[protocoltypes.EventType]struct {
 	protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted:  {Message: &protocoltypes.AccountContactRequestIncomingAccepted{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountContactBlocked:                  {Message: &protocoltypes.AccountContactBlocked{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountContactUnblocked:                {Message: &protocoltypes.AccountContactUnblocked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactRequestNonceRegistered:   {Message: &protocoltypes.AccountContactRequestNonceRegistered{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactRequestPolicySet:         {Message: &protocoltypes.AccountContactRequestPolicySet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactVerified:                 {Message: &protocoltypes.AccountContactVerified{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactIntroductionAccepted:     {Message: &protocoltypes.AccountContactIntroductionAccepted{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactDeleted:                  {Message: &protocoltypes.AccountContactDeleted{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountContactMetadataSet:              {Message: &protocoltypes.AccountContactMetadataSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountPresenceSettingsSet:             {Message: &protocoltypes.AccountPresenceSettingsSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountDeviceRevoked:                   {Message: &protocoltypes.AccountDeviceRevoked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountDeviceLinked:                    {Message: &protocoltypes.AccountDeviceLinked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountDeviceNameSet:                   {Message: &protocoltypes.AccountDeviceNameSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountSettingSet:                      {Message: &protocoltypes.AccountSettingSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountPrimaryDeviceClaimed:            {Message: &protocoltypes.AccountPrimaryDeviceClaimed{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferProposed:   {Message: &protocoltypes.AccountPrimaryDeviceTransferProposed{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferAccepted:   {Message: &protocoltypes.AccountPrimaryDeviceTransferAccepted{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountReadReceiptsSet:                 {Message: &protocoltypes.AccountReadReceiptsSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeAccountGroupDeviceRegistered:           {Message: &protocoltypes.AccountGroupDeviceRegistered{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeContactAliasKeyAdded:                   {Message: &protocoltypes.ContactAliasKeyAdded{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeContactSessionReset:                    {Message: &protocoltypes.ContactSessionReset{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeContactAccountReintroduced:             {Message: &protocoltypes.ContactAccountReintroduced{}, SigChecker: sigCheckerContactAccountReintroduced},
+	protocoltypes.EventType_EventTypeContactIntroductionSent:                {Message: &protocoltypes.ContactIntroductionSent{}, SigChecker: sigCheckerContactIntroductionSent},
+	protocoltypes.EventType_EventTypeContactDeviceRevoked:                   {Message: &protocoltypes.ContactDeviceRevoked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeContactRemoved:                         {Message: &protocoltypes.ContactRemoved{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupAliasResolverAdded:     {Message: &protocoltypes.MultiMemberGroupAliasResolverAdded{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupInitialMemberAnnounced: {Message: &protocoltypes.MultiMemberGroupInitialMemberAnnounced{}, SigChecker: sigCheckerGroupSigned},
 	protocoltypes.EventType_EventTypeMultiMemberGroupAdminRoleGranted:       {Message: &protocoltypes.MultiMemberGroupAdminRoleGranted{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupMemberRemoved:          {Message: &protocoltypes.MultiMemberGroupMemberRemoved{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupMemberRoleSet:          {Message: &protocoltypes.MultiMemberGroupMemberRoleSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupInvitationRevoked:      {Message: &protocoltypes.MultiMemberGroupInvitationRevoked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupSecretRotated:          {Message: &protocoltypes.MultiMemberGroupSecretRotated{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded:          {Message: &protocoltypes.MultiMemberGroupSnapshotAdded{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupBroadcastModeSet:       {Message: &protocoltypes.MultiMemberGroupBroadcastModeSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupMemberApproved:         {Message: &protocoltypes.MultiMemberGroupMemberApproved{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupMemberBanned:           {Message: &protocoltypes.MultiMemberGroupMemberBanned{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupPublicModeSet:          {Message: &protocoltypes.MultiMemberGroupPublicModeSet{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupOwnershipTransferred:   {Message: &protocoltypes.MultiMemberGroupOwnershipTransferred{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupDeviceRevoked:          {Message: &protocoltypes.MultiMemberGroupDeviceRevoked{}, SigChecker: sigCheckerDeviceSigned},
+	protocoltypes.EventType_EventTypeMultiMemberGroupEpochCommitted:         {Message: &protocoltypes.MultiMemberGroupEpochCommitted{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeGroupMetadataPayloadSent:               {Message: &protocoltypes.GroupMetadataPayloadSent{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeGroupReplicating:                       {Message: &protocoltypes.GroupReplicating{}, SigChecker: sigCheckerDeviceSigned},
 	protocoltypes.EventType_EventTypeAccountVerifiedCredentialRegistered:    {Message: &protocoltypes.AccountVerifiedCredentialRegistered{}, SigChecker: sigCheckerDeviceSigned},
@@ -105,7 +148,18 @@ func newGroupMetadataEventFromEntry(_ ipfslog.Log, e ipfslog.Entry, metadata *pr
 	return &gme, nil
 }
 
-func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocoltypes.GroupMetadata, proto.Message, error) {
+// metadataKey is the key a device seals its metadata events with once its
+// chain key has been rotated, the members removed from the group don't
+// receive it
+type metadataKey struct {
+	devicePK []byte
+	epoch    uint64
+	key      *[cryptoutil.KeySize]byte
+}
+
+// openGroupEnvelope opens a metadata event, the keys of the devices are read
+// from the secret store when the event isn't sealed with the group secret
+func openGroupEnvelope(ctx context.Context, g *protocoltypes.Group, secretStore secretstore.SecretStore, envelopeBytes []byte) (*protocoltypes.GroupMetadata, proto.Message, error) {
 	env := &protocoltypes.GroupEnvelope{}
 	if err := proto.Unmarshal(envelopeBytes, env); err != nil {
 		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
@@ -116,7 +170,23 @@ func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocolt
 		return nil, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	data, ok := secretbox.Open(nil, env.Event, nonce, g.GetSharedSecret())
+	key := g.GetSharedSecret()
+	if len(env.DevicePk) > 0 {
+		if secretStore == nil {
+			return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen.Wrap(fmt.Errorf("no metadata key available"))
+		}
+
+		devicePK, err := crypto.UnmarshalEd25519PublicKey(env.DevicePk)
+		if err != nil {
+			return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if key, err = secretStore.GetMetadataKey(ctx, g, devicePK, env.KeyEpoch); err != nil {
+			return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen.Wrap(err)
+		}
+	}
+
+	data, ok := secretbox.Open(nil, env.Event, nonce, key)
 	if !ok {
 		return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen
 	}
@@ -142,10 +212,17 @@ func openGroupEnvelope(g *protocoltypes.Group, envelopeBytes []byte) (*protocolt
 		return nil, nil, errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
 	}
 
+	// a device can only seal its own events with its metadata key
+	if evt, ok := payload.(interface{ GetDevicePk() []byte }); ok && len(env.DevicePk) > 0 && !bytes.Equal(evt.GetDevicePk(), env.DevicePk) {
+		return nil, nil, errcode.ErrCode_ErrGroupMemberLogEventOpen.Wrap(fmt.Errorf("event sealed by another device"))
+	}
+
 	return metadataEvent, payload, nil
 }
 
-func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType, payload proto.Message, payloadSig []byte) ([]byte, error) {
+// sealGroupEnvelope seals a metadata event with the metadata key of the
+// device, or with the group secret when it is nil
+func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType, payload proto.Message, payloadSig []byte, sealKey *metadataKey) ([]byte, error) {
 	payloadBytes, err := proto.Marshal(payload)
 	if err != nil {
 		return nil, errcode.ErrCode_TODO.Wrap(err)
@@ -160,7 +237,7 @@ func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType
 		EventType:        eventType,
 		Payload:          payloadBytes,
 		Sig:              payloadSig,
-		ProtocolMetadata: &protocoltypes.ProtocolMetadata{},
+		ProtocolMetadata: &protocoltypes.ProtocolMetadata{SentAt: time.Now().Unix()},
 	}
 
 	eventClearBytes, err := proto.Marshal(event)
@@ -168,12 +245,18 @@ func sealGroupEnvelope(g *protocoltypes.Group, eventType protocoltypes.EventType
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	eventBytes := secretbox.Seal(nil, eventClearBytes, nonce, g.GetSharedSecret())
-
 	env := &protocoltypes.GroupEnvelope{
-		Event: eventBytes,
 		Nonce: nonce[:],
 	}
 
+	key := g.GetSharedSecret()
+	if sealKey != nil {
+		key = sealKey.key
+		env.DevicePk = sealKey.devicePK
+		env.KeyEpoch = sealKey.epoch
+	}
+
+	env.Event = secretbox.Seal(nil, eventClearBytes, nonce, key)
+
 	return proto.Marshal(env)
 }
@@ -78,3 +78,29 @@ func sigCheckerGroupMemberDeviceAdded(g *protocoltypes.Group, metadata *protocol
 
 	return sigCheckerDeviceSigned(g, metadata, message)
 }
+
+func sigCheckerContactAccountReintroduced(g *protocoltypes.Group, metadata *protocoltypes.GroupMetadata, message proto.Message) error {
+	msg, ok := message.(*protocoltypes.ContactAccountReintroduced)
+	if !ok {
+		return errcode.ErrCode_ErrDeserialization
+	}
+
+	if err := verifyContactReintroductionProof(msg.Proof); err != nil {
+		return err
+	}
+
+	return sigCheckerDeviceSigned(g, metadata, message)
+}
+
+func sigCheckerContactIntroductionSent(g *protocoltypes.Group, metadata *protocoltypes.GroupMetadata, message proto.Message) error {
+	msg, ok := message.(*protocoltypes.ContactIntroductionSent)
+	if !ok {
+		return errcode.ErrCode_ErrDeserialization
+	}
+
+	if err := verifyContactIntroduction(msg.Introduction); err != nil {
+		return err
+	}
+
+	return sigCheckerDeviceSigned(g, metadata, message)
+}
@@ -16,7 +16,7 @@ func NewGroupMultiMember() (*protocoltypes.Group, crypto.PrivKey, error) {
 	return protocoltypes.NewGroupMultiMember()
 }
 
-func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata, localMemberPublicKey crypto.PubKey) (crypto.PubKey, []byte, error) {
+func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata, localMemberPublicKey, localDevicePublicKey crypto.PubKey) (crypto.PubKey, []byte, error) {
 	if m == nil || m.EventType != protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded {
 		return nil, nil, errcode.ErrCode_ErrInvalidInput
 	}
@@ -26,6 +26,12 @@ func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata,
 		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
+	// the chain keys sent to all the devices of an epoch tree are registered
+	// by GroupContext.updateEpochs
+	if len(s.EpochCommitId) > 0 {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput
+	}
+
 	senderDevicePubKey, err := crypto.UnmarshalEd25519PublicKey(s.DevicePk)
 	if err != nil {
 		return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
@@ -40,5 +46,18 @@ func getAndFilterGroupDeviceChainKeyAddedPayload(m *protocoltypes.GroupMetadata,
 		return nil, nil, errcode.ErrCode_ErrGroupSecretOtherDestMember
 	}
 
+	// once a device of the member has been revoked, the chain keys are sent to
+	// each of its remaining devices
+	if len(s.DestDevicePk) > 0 {
+		destDevicePubKey, err := crypto.UnmarshalEd25519PublicKey(s.DestDevicePk)
+		if err != nil {
+			return nil, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if !localDevicePublicKey.Equals(destDevicePubKey) {
+			return nil, nil, errcode.ErrCode_ErrGroupSecretOtherDestMember
+		}
+	}
+
 	return senderDevicePubKey, s.Payload, nil
 }
@@ -0,0 +1,199 @@
+package weshnet
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/proto"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	logac "berty.tech/go-ipfs-log/accesscontroller"
+	"berty.tech/go-orbit-db/accesscontroller"
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// GroupAccessController decides which entries can be added to the stores of
+// a group, it is installed by the embedder with the GroupOptions of the
+// group. It is consulted once the entry has passed the checks of the
+// protocol, for the entries written by the device as well as for the ones
+// replicated from the peers.
+//
+// An entry of the metadata store is checked when it is added to the log, a
+// refused entry is neither added to the log of the device nor replicated
+// further by it. The devices of the group must install the same controller:
+// the log of a device refusing an entry accepted by its peers diverges from
+// theirs, the entries written after it on the other devices still reference
+// it.
+//
+// A message is checked once it has been decrypted and its signature
+// verified, the author of a message is only known at this point. A refused
+// message stays in the log and is replicated as any other entry, so the logs
+// of the devices don't diverge, but it is neither emitted, listed nor
+// indexed by the device.
+type GroupAccessController interface {
+	// CanAppend returns an error if the entry must not be added to the store
+	CanAppend(ctx context.Context, entry *GroupAccessEntry) error
+}
+
+// GroupAccessControllerFunc is a GroupAccessController implemented by a
+// function
+type GroupAccessControllerFunc func(ctx context.Context, entry *GroupAccessEntry) error
+
+func (f GroupAccessControllerFunc) CanAppend(ctx context.Context, entry *GroupAccessEntry) error {
+	return f(ctx, entry)
+}
+
+// GroupOptions are the options of the stores of a group given by the
+// embedder, they are set each time the group is opened: after its creation,
+// its join or a restart
+type GroupOptions struct {
+	// AccessController is consulted for the entries added to the stores of
+	// the group, it can be nil
+	AccessController GroupAccessController
+}
+
+// GroupAccessEntry is an entry to be added to a store of a group
+type GroupAccessEntry struct {
+	// Group is the group of the store
+	Group *protocoltypes.Group
+
+	// StoreType is the type of the store, the metadata or the message store
+	// type of the service
+	StoreType string
+
+	// Entry is the log entry, its payload is sealed with the group secret or
+	// the metadata key of the device which has written it
+	Entry logac.LogEntry
+
+	// DevicePK is the device which has written the entry, its signature has
+	// been checked, it is nil for the metadata events which can't be opened
+	DevicePK []byte
+
+	// Metadata and Event are the opened event of an entry of the metadata
+	// store, their signature has been checked, they are nil for the messages
+	// and for the metadata events sealed with a metadata key not known yet
+	Metadata *protocoltypes.GroupMetadata
+	Event    proto.Message
+
+	// Message is the opened message of an entry of the message store, it is
+	// nil for the metadata events
+	Message *protocoltypes.GroupMessageEvent
+}
+
+// newGroupAccessEntry opens the entry of a metadata store
+func newGroupAccessEntry(ctx context.Context, secretStore secretstore.SecretStore, g *protocoltypes.Group, storeType string, e logac.LogEntry) *GroupAccessEntry {
+	accessEntry := &GroupAccessEntry{
+		Group:     g,
+		StoreType: storeType,
+		Entry:     e,
+	}
+
+	logEntry, ok := e.(ipfslog.Entry)
+	if !ok {
+		return accessEntry
+	}
+
+	op, err := operation.ParseOperation(logEntry)
+	if err != nil {
+		return accessEntry
+	}
+
+	metadata, event, err := openGroupEnvelope(ctx, g, secretStore, op.GetValue())
+	if err != nil {
+		return accessEntry
+	}
+
+	accessEntry.Metadata = metadata
+	accessEntry.Event = event
+
+	if evt, ok := event.(interface{ GetDevicePk() []byte }); ok {
+		accessEntry.DevicePK = evt.GetDevicePk()
+	}
+
+	return accessEntry
+}
+
+// newAccessController returns the access controller of the group stores, it
+// applies the access controller set in the options of the group after the
+// checks of the protocol
+func (s *WeshOrbitDB) newAccessController(ctx context.Context, db iface.BaseOrbitDB, params accesscontroller.ManifestParams, options ...accesscontroller.Option) (accesscontroller.Interface, error) {
+	ac, err := NewSimpleAccessController(ctx, db, params, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	simple, ok := ac.(*simpleAccessController)
+	if !ok {
+		return ac, nil
+	}
+
+	groupIDs := simple.allowedKeys[identityGroupIDKey]
+	storeTypes := simple.allowedKeys[storeTypeKey]
+	if len(groupIDs) != 1 || len(storeTypes) != 1 {
+		return ac, nil
+	}
+
+	groupID, storeType := groupIDs[0], storeTypes[0]
+
+	// the messages are checked once opened by the message store
+	if storeType != s.groupMetadataStoreType {
+		return ac, nil
+	}
+
+	// the controller is looked up for each entry, it is replaced when the
+	// group is opened again with other options
+	simple.groupAccess = func(e logac.LogEntry) error {
+		controller := s.groupAccessController(groupID)
+		if controller == nil {
+			return nil
+		}
+
+		g, ok := s.groups.Load(groupID)
+		if !ok {
+			return errcode.ErrCode_ErrGroupUnknown
+		}
+
+		group, ok := g.(*protocoltypes.Group)
+		if !ok {
+			return errcode.ErrCode_ErrGroupUnknown
+		}
+
+		entry := newGroupAccessEntry(s.ctx, s.secretStore, group, storeType, e)
+		if err := controller.CanAppend(s.ctx, entry); err != nil {
+			return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(err)
+		}
+
+		return nil
+	}
+
+	return simple, nil
+}
+
+// groupAccessController returns the access controller set in the options of
+// the group, or nil
+func (s *WeshOrbitDB) groupAccessController(groupID string) GroupAccessController {
+	c, ok := s.groupAccessControllers.Load(groupID)
+	if !ok {
+		return nil
+	}
+
+	controller, _ := c.(GroupAccessController)
+	return controller
+}
+
+// messageAccess returns the check of the opened messages of a group, the
+// controller is looked up for each message
+func (s *WeshOrbitDB) messageAccess(groupID string) func(ctx context.Context, entry *GroupAccessEntry) error {
+	return func(ctx context.Context, entry *GroupAccessEntry) error {
+		controller := s.groupAccessController(groupID)
+		if controller == nil {
+			return nil
+		}
+
+		entry.StoreType = s.groupMessageStoreType
+		return controller.CanAppend(ctx, entry)
+	}
+}
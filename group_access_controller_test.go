@@ -0,0 +1,113 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/go-ipfs-log/identityprovider"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestGroupAccessController(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	calls := 0
+	controller := GroupAccessControllerFunc(func(_ context.Context, e *GroupAccessEntry) error {
+		calls++
+
+		if e.StoreType == "metadata" {
+			return fmt.Errorf("read-only group")
+		}
+
+		if e.Message != nil && string(e.Message.Message) == "refused" {
+			return fmt.Errorf("refused message")
+		}
+
+		return nil
+	})
+
+	odb := &WeshOrbitDB{
+		ctx:                    ctx,
+		groups:                 &GroupMap{},
+		groupAccessControllers: &GroupAccessControllerMap{},
+		groupMetadataStoreType: "metadata",
+		groupMessageStoreType:  "messages",
+	}
+	odb.groups.Store(g.GroupIDAsString(), g)
+	odb.groups.Store(other.GroupIDAsString(), other)
+	odb.groupAccessControllers.Store(g.GroupIDAsString(), controller)
+
+	newAC := func(g *protocoltypes.Group, storeType string) *simpleAccessController {
+		params, err := defaultACForGroup(g, storeType)
+		require.NoError(t, err)
+
+		ac, err := odb.newAccessController(ctx, nil, params)
+		require.NoError(t, err)
+
+		return ac.(*simpleAccessController)
+	}
+
+	signedEntry := func(g *protocoltypes.Group) *entry.Entry {
+		sigPK, err := g.GetSigningPubKey()
+		require.NoError(t, err)
+
+		sigPKBytes, err := sigPK.Raw()
+		require.NoError(t, err)
+
+		return &entry.Entry{Identity: &identityprovider.Identity{ID: hex.EncodeToString(sigPKBytes)}}
+	}
+
+	signed := signedEntry(g)
+	unsigned := &entry.Entry{Identity: &identityprovider.Identity{ID: "other"}}
+
+	require.Error(t, newAC(g, "metadata").CanAppend(signed, nil, nil))
+	require.Equal(t, 1, calls)
+
+	// the messages are added to the log whatever the controller, they are
+	// checked once opened
+	require.NoError(t, newAC(g, "messages").CanAppend(signed, nil, nil))
+	require.Equal(t, 1, calls)
+
+	// the entries refused by the protocol don't reach the installed
+	// controller
+	require.Error(t, newAC(g, "metadata").CanAppend(unsigned, nil, nil))
+	require.Equal(t, 1, calls)
+
+	// the groups opened without the controller are not affected
+	require.NoError(t, newAC(other, "metadata").CanAppend(signedEntry(other), nil, nil))
+	require.Equal(t, 1, calls)
+
+	// the opened messages are checked with their author
+	devicePK := []byte("device")
+	m := &MessageStore{group: g, access: odb.messageAccess(g.GroupIDAsString())}
+
+	evt := &protocoltypes.GroupMessageEvent{Headers: &protocoltypes.MessageHeaders{DevicePk: devicePK}, Message: []byte("accepted")}
+	require.NoError(t, m.checkAccess(ctx, signed, evt))
+	require.Equal(t, 2, calls)
+
+	evt = &protocoltypes.GroupMessageEvent{Headers: &protocoltypes.MessageHeaders{DevicePk: devicePK}, Message: []byte("refused")}
+	err = m.checkAccess(ctx, signed, evt)
+	require.Error(t, err)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrGroupPermissionDenied))
+	require.Equal(t, 3, calls)
+
+	// the controller is removed when the group is opened again without it
+	ac := newAC(g, "metadata")
+	odb.groupAccessControllers.Delete(g.GroupIDAsString())
+	require.NoError(t, ac.CanAppend(signed, nil, nil))
+	require.NoError(t, m.checkAccess(ctx, signed, evt))
+	require.Equal(t, 3, calls)
+}
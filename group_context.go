@@ -36,6 +36,12 @@ type GroupContext struct {
 	muDevicesAdded    sync.RWMutex
 	selfAnnounced     chan struct{}
 	selfAnnouncedOnce sync.Once
+
+	// epochChainKeys are the chain keys sent to the devices of an epoch tree
+	// already registered, by commit and device
+	epochChainKeys   map[string]struct{}
+	muEpochChainKeys sync.Mutex
+	epochCommitTimer uint32
 }
 
 func (gc *GroupContext) SecretStore() secretstore.SecretStore {
@@ -63,6 +69,34 @@ func (gc *GroupContext) DevicePubKey() crypto.PubKey {
 }
 
 func (gc *GroupContext) Close() error {
+	gc.stop()
+
+	// @FIXME(gfanton): should we really handle store closing here ?
+	gc.metadataStore.Close()
+	gc.messageStore.Close()
+
+	gc.logger.Debug("group context closed", zap.String("groupID", gc.group.GroupIDAsString()))
+	return nil
+}
+
+// Drop closes the group context like Close but drops its stores, they are
+// closed and their heads are deleted from the cache
+func (gc *GroupContext) Drop() error {
+	gc.stop()
+
+	if err := gc.metadataStore.Drop(); err != nil {
+		return err
+	}
+
+	if err := gc.messageStore.Drop(); err != nil {
+		return err
+	}
+
+	gc.logger.Debug("group context dropped", zap.String("groupID", gc.group.GroupIDAsString()))
+	return nil
+}
+
+func (gc *GroupContext) stop() {
 	gc.cancel()
 
 	// @NOTE(gfanton): wait for active tasks to end, doing this we avoid to do
@@ -71,13 +105,6 @@ func (gc *GroupContext) Close() error {
 
 	// mark group context has closed
 	atomic.StoreUint32(&gc.closed, 1)
-
-	// @FIXME(gfanton): should we really handle store closing here ?
-	gc.metadataStore.Close()
-	gc.messageStore.Close()
-
-	gc.logger.Debug("group context closed", zap.String("groupID", gc.group.GroupIDAsString()))
-	return nil
 }
 
 func (gc *GroupContext) IsClosed() bool {
@@ -91,6 +118,11 @@ func NewContextGroup(group *protocoltypes.Group, metadataStore *MetadataStore, m
 		logger = zap.NewNop()
 	}
 
+	if messageStore != nil && metadataStore != nil {
+		messageStore.setPublishChecker(metadataStore.canDevicePublishAt)
+		messageStore.setDeviceMatcher(metadataStore.isSameDevice)
+	}
+
 	return &GroupContext{
 		ctx:             ctx,
 		cancel:          cancel,
@@ -103,6 +135,7 @@ func NewContextGroup(group *protocoltypes.Group, metadataStore *MetadataStore, m
 		closed:          0,
 		devicesAdded:    make(map[string]chan struct{}),
 		selfAnnounced:   make(chan struct{}),
+		epochChainKeys:  make(map[string]struct{}),
 	}
 }
 
@@ -133,11 +166,24 @@ func (gc *GroupContext) ActivateGroupContext(contactPK crypto.PubKey) (err error
 
 				// @TODO(gfanton): should we handle this in a sub gorouting ?
 				e := evt.(*protocoltypes.GroupMetadataEvent)
+				if e.GetEventContext().GetLocal() {
+					continue
+				}
+
 				// start := time.Now()
 				if err := gc.handleGroupMetadataEvent(e); err != nil {
 					gc.logger.Error("unable to handle EventTypeGroupDeviceSecretAdded", zap.Error(err))
 				}
 
+				gc.updateEpochs()
+
+				// a snapshot never triggers another one
+				if e.Metadata.EventType != protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded && gc.MetadataStore().shouldAddSnapshot() {
+					if _, err := gc.MetadataStore().AddSnapshot(gc.ctx); err != nil {
+						gc.logger.Error("unable to add group snapshot", zap.Error(err))
+					}
+				}
+
 				// if t := time.Since(start).Milliseconds(); t > 0 {
 				// 	fmt.Printf("elapsed: %dms\n", t)
 				// }
@@ -205,14 +251,47 @@ func (gc *GroupContext) handleGroupMetadataEvent(e *protocoltypes.GroupMetadataE
 			gc.selfAnnouncedOnce.Do(func() { close(gc.selfAnnounced) }) // mark has self announced
 		}
 
-		if _, err := gc.MetadataStore().SendSecret(gc.ctx, memberPK); err != nil {
-			if !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) {
+		if _, err := gc.MetadataStore().SendSecret(gc.ctx, memberPK); errcode.Is(err, errcode.ErrCode_ErrGroupMemberRemoved) {
+			// a member rejected because of its invitation starts a new
+			// epoch, as a removed member
+			gc.sendSecretsToExistingMembers(nil)
+		} else if err != nil {
+			if !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) && !errcode.Is(err, errcode.ErrCode_ErrGroupMemberPendingApproval) && !errcode.Is(err, errcode.ErrCode_ErrGroupMemberBanned) {
 				return fmt.Errorf("unable to send secret to member: %w", err)
 			}
 		}
 
+	case protocoltypes.EventType_EventTypeMultiMemberGroupMemberApproved:
+		// the approved member is now listed in the group members and didn't
+		// receive any secret yet
+		gc.sendSecretsToExistingMembers(nil)
+
+	case protocoltypes.EventType_EventTypeMultiMemberGroupMemberBanned:
+		// banning a member starts a new epoch, unbanning it lists it again
+		// in the group members
+		gc.sendSecretsToExistingMembers(nil)
+
+	case protocoltypes.EventType_EventTypeMultiMemberGroupMemberRemoved,
+		protocoltypes.EventType_EventTypeMultiMemberGroupSecretRotated:
+		// Remaining members need a chain key unknown to the removed member,
+		// or to whoever got the previous keys, it is rotated when sending it
+		gc.sendSecretsToExistingMembers(nil)
+
+	case protocoltypes.EventType_EventTypeContactSessionReset:
+		// the chain keys published so far are registered again in case some
+		// of them have been missed, then a rotated chain key is sent
+		gc.fillMessageKeysHolderUsingPreviousData()
+		gc.sendSecretsToExistingMembers(nil)
+
+	case protocoltypes.EventType_EventTypeAccountDeviceRevoked,
+		protocoltypes.EventType_EventTypeContactDeviceRevoked,
+		protocoltypes.EventType_EventTypeMultiMemberGroupDeviceRevoked:
+		// the chain key of the revoked device isn't used anymore, the members
+		// send rotated chain keys
+		gc.sendSecretsToExistingMembers(nil)
+
 	case protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded:
-		senderPublicKey, encryptedDeviceChainKey, err := getAndFilterGroupDeviceChainKeyAddedPayload(e.Metadata, gc.ownMemberDevice.Member())
+		senderPublicKey, encryptedDeviceChainKey, err := getAndFilterGroupDeviceChainKeyAddedPayload(e.Metadata, gc.ownMemberDevice.Member(), gc.ownMemberDevice.Device())
 		switch err {
 		case nil: // ok
 		case errcode.ErrCode_ErrInvalidInput, errcode.ErrCode_ErrGroupSecretOtherDestMember:
@@ -222,10 +301,17 @@ func (gc *GroupContext) handleGroupMetadataEvent(e *protocoltypes.GroupMetadataE
 			return fmt.Errorf("an error occurred while opening device secrets: %w", err)
 		}
 
+		if gc.isChainKeyRevoked(senderPublicKey) {
+			return nil
+		}
+
 		if err = gc.SecretStore().RegisterChainKey(gc.ctx, gc.Group(), senderPublicKey, encryptedDeviceChainKey); err != nil {
 			return fmt.Errorf("unable to register chain key: %w", err)
 		}
 
+		// the metadata keys sent with the chain key may open queued events
+		gc.MetadataStore().processPendingEntries(gc.ctx)
+
 		if rawPK, err := senderPublicKey.Raw(); err == nil {
 			// A new chainKey has been registered, notify watcher
 			go gc.notifyDeviceAdded(rawPK)
@@ -241,6 +327,10 @@ func (gc *GroupContext) fillMessageKeysHolderUsingPreviousData() {
 	publishedSecrets := gc.metadataStoreListSecrets()
 
 	for senderPublicKey, encryptedSecret := range publishedSecrets {
+		if gc.isChainKeyRevoked(senderPublicKey) {
+			continue
+		}
+
 		if err := gc.SecretStore().RegisterChainKey(gc.ctx, gc.Group(), senderPublicKey, encryptedSecret); err != nil {
 			gc.logger.Error("unable to register chain key", zap.Error(err))
 			continue
@@ -250,6 +340,107 @@ func (gc *GroupContext) fillMessageKeysHolderUsingPreviousData() {
 			gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, rawPK)
 		}
 	}
+
+	gc.updateEpochs()
+	gc.MetadataStore().processPendingEntries(gc.ctx)
+}
+
+// updateEpochs processes the commits of the epoch tree of a multi-member
+// group, registers the chain keys sent to the devices of the epochs the
+// current device is part of, then sends its own chain key for the current
+// epoch and commits the pending membership changes. The first device of the
+// current epoch commits them at once, the next ones wait in turn in case it
+// is offline, see epochCommitDelay.
+func (gc *GroupContext) updateEpochs() {
+	if gc.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return
+	}
+
+	m := gc.MetadataStore()
+	m.processEpochCommits(gc.ctx)
+
+	registered := false
+	for _, k := range m.Index().(*metadataStoreIndex).listEpochChainKeys() {
+		key := string(k.commitID) + string(k.event.DevicePk)
+
+		gc.muEpochChainKeys.Lock()
+		_, ok := gc.epochChainKeys[key]
+		gc.muEpochChainKeys.Unlock()
+
+		if ok || !gc.SecretStore().IsGroupEpochKnown(gc.ctx, gc.group, k.commitID) {
+			continue
+		}
+
+		senderPublicKey, err := crypto.UnmarshalEd25519PublicKey(k.event.DevicePk)
+		if err != nil || senderPublicKey.Equals(gc.DevicePubKey()) || gc.isChainKeyRevoked(senderPublicKey) {
+			continue
+		}
+
+		if err := gc.SecretStore().RegisterEpochChainKey(gc.ctx, gc.group, k.commitID, senderPublicKey, k.event.Payload); err != nil {
+			gc.logger.Error("unable to register epoch chain key", zap.Error(err))
+			continue
+		}
+
+		gc.muEpochChainKeys.Lock()
+		gc.epochChainKeys[key] = struct{}{}
+		gc.muEpochChainKeys.Unlock()
+
+		registered = true
+
+		// A new chainKey has been registered, notify watcher
+		go gc.notifyDeviceAdded(k.event.DevicePk)
+		// process queued message and check if cached messages can be opened with it
+		gc.MessageStore().ProcessMessageQueueForDevicePK(gc.ctx, k.event.DevicePk)
+	}
+
+	if registered {
+		// the metadata keys sent with the chain keys may open queued events
+		m.processPendingEntries(gc.ctx)
+	}
+
+	if _, err := m.sendEpochChainKey(gc.ctx); err != nil {
+		gc.logger.Error("unable to send the chain key to the epoch devices", zap.Error(err))
+	}
+
+	rank := m.epochCommitRank(gc.ctx)
+	if rank == 0 {
+		if _, err := m.commitEpoch(gc.ctx, false); err != nil {
+			gc.logger.Error("unable to commit the group epoch", zap.Error(err))
+		}
+
+		return
+	}
+
+	if rank < 0 || !atomic.CompareAndSwapUint32(&gc.epochCommitTimer, 0, 1) {
+		return
+	}
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+		defer atomic.StoreUint32(&gc.epochCommitTimer, 0)
+
+		select {
+		case <-gc.ctx.Done():
+			return
+		case <-time.After(time.Duration(rank) * epochCommitDelay):
+		}
+
+		if m.epochCommitRank(gc.ctx) < 0 {
+			return
+		}
+
+		if _, err := m.commitEpoch(gc.ctx, false); err != nil {
+			gc.logger.Error("unable to commit the group epoch", zap.Error(err))
+		}
+	}()
+}
+
+// isChainKeyRevoked returns true if the chain keys of the device aren't
+// registered anymore as it has been revoked by its member
+func (gc *GroupContext) isChainKeyRevoked(devicePK crypto.PubKey) bool {
+	rawPK, err := devicePK.Raw()
+	return err == nil && gc.MetadataStore().IsDeviceRevoked(rawPK)
 }
 
 func (gc *GroupContext) metadataStoreListSecrets() map[crypto.PubKey][]byte {
@@ -266,7 +457,7 @@ func (gc *GroupContext) metadataStoreListSecrets() map[crypto.PubKey][]byte {
 			continue
 		}
 
-		pk, encryptedDeviceChainKey, err := getAndFilterGroupDeviceChainKeyAddedPayload(metadata.Metadata, gc.MemberPubKey())
+		pk, encryptedDeviceChainKey, err := getAndFilterGroupDeviceChainKeyAddedPayload(metadata.Metadata, gc.MemberPubKey(), gc.DevicePubKey())
 		if errcode.Is(err, errcode.ErrCode_ErrInvalidInput) || errcode.Is(err, errcode.ErrCode_ErrGroupSecretOtherDestMember) {
 			continue
 		}
@@ -0,0 +1,329 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/protoio"
+	"berty.tech/weshnet/v2/pkg/tyber"
+)
+
+const (
+	groupDirectoryV1 = protocol.ID("/wesh/group_directory/1.0.0")
+
+	// DefaultGroupDirectoryTopic is the rendezvous topic used to announce the
+	// public groups which don't specify one
+	DefaultGroupDirectoryTopic = "weshnet/group-directory"
+
+	groupDirectoryMaxAnswerSize = 256 * 1024
+)
+
+// groupDirectoryTopic holds the public groups announced on a rendezvous topic
+type groupDirectoryTopic struct {
+	cancel      context.CancelFunc
+	descriptors map[string]*protocoltypes.GroupPublicDescriptor
+}
+
+// groupDirectory announces the public groups opened on this device and
+// answers the queries of the peers looking for them
+type groupDirectory struct {
+	ctx    context.Context
+	host   host.Host
+	swiper *Swiper
+	logger *zap.Logger
+
+	topics   map[string]*groupDirectoryTopic
+	muTopics sync.Mutex
+}
+
+func newGroupDirectory(ctx context.Context, h host.Host, swiper *Swiper, logger *zap.Logger) *groupDirectory {
+	d := &groupDirectory{
+		ctx:    ctx,
+		host:   h,
+		swiper: swiper,
+		logger: logger.Named("directory"),
+		topics: make(map[string]*groupDirectoryTopic),
+	}
+
+	h.SetStreamHandler(groupDirectoryV1, d.handleQuery)
+
+	return d
+}
+
+func (d *groupDirectory) close() {
+	d.host.RemoveStreamHandler(groupDirectoryV1)
+
+	d.muTopics.Lock()
+	for topic, t := range d.topics {
+		t.cancel()
+		delete(d.topics, topic)
+	}
+	d.muTopics.Unlock()
+}
+
+// topicSeed returns the rendezvous seed of a directory topic, it must be
+// known by anyone looking for the groups
+func (d *groupDirectory) topicSeed(topic string) []byte {
+	return []byte(groupDirectoryV1 + "/" + protocol.ID(topic))
+}
+
+// watchGroup keeps the announce of the group in line with its public
+// descriptor until the group context is closed
+func (d *groupDirectory) watchGroup(gc *GroupContext) error {
+	if gc.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil
+	}
+
+	sub, err := gc.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent))
+	if err != nil {
+		return fmt.Errorf("unable to subscribe to group metadata event: %w", err)
+	}
+
+	groupPK := string(gc.group.PublicKey)
+	d.setDescriptor(groupPK, gc.MetadataStore().PublicDescriptor())
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+		defer sub.Close()
+		defer d.setDescriptor(groupPK, nil)
+
+		for {
+			var evt interface{}
+			select {
+			case <-gc.ctx.Done():
+				return
+			case evt = <-sub.Out():
+			}
+
+			switch evt.(*protocoltypes.GroupMetadataEvent).Metadata.EventType {
+			case protocoltypes.EventType_EventTypeMultiMemberGroupPublicModeSet,
+				protocoltypes.EventType_EventTypeMultiMemberGroupInvitationRevoked,
+				protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded,
+				protocoltypes.EventType_EventTypeMultiMemberGroupAdminRoleGranted,
+				protocoltypes.EventType_EventTypeMultiMemberGroupMemberRoleSet:
+				d.setDescriptor(groupPK, gc.MetadataStore().PublicDescriptor())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// setDescriptor announces the given group descriptor on its topic, or stops
+// announcing the group if descriptor is nil
+func (d *groupDirectory) setDescriptor(groupPK string, descriptor *protocoltypes.GroupPublicDescriptor) {
+	d.muTopics.Lock()
+	defer d.muTopics.Unlock()
+
+	for topic, t := range d.topics {
+		current, ok := t.descriptors[groupPK]
+		if !ok {
+			continue
+		}
+
+		if descriptor != nil && proto.Equal(current, descriptor) {
+			return
+		}
+
+		delete(t.descriptors, groupPK)
+		if len(t.descriptors) == 0 {
+			t.cancel()
+			delete(d.topics, topic)
+		}
+	}
+
+	if descriptor == nil {
+		return
+	}
+
+	t, ok := d.topics[descriptor.Topic]
+	if !ok {
+		ctx, cancel := context.WithCancel(d.ctx)
+		t = &groupDirectoryTopic{
+			cancel:      cancel,
+			descriptors: make(map[string]*protocoltypes.GroupPublicDescriptor),
+		}
+		d.topics[descriptor.Topic] = t
+
+		d.swiper.Announce(ctx, []byte(descriptor.Topic), d.topicSeed(descriptor.Topic))
+	}
+
+	t.descriptors[groupPK] = descriptor
+}
+
+// listDescriptors returns the descriptors announced on the given topic
+func (d *groupDirectory) listDescriptors(topic string) []*protocoltypes.GroupPublicDescriptor {
+	d.muTopics.Lock()
+	defer d.muTopics.Unlock()
+
+	t, ok := d.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	descriptors := make([]*protocoltypes.GroupPublicDescriptor, 0, len(t.descriptors))
+	for _, descriptor := range t.descriptors {
+		descriptors = append(descriptors, descriptor)
+	}
+
+	return descriptors
+}
+
+func (d *groupDirectory) handleQuery(stream network.Stream) {
+	defer stream.Close()
+
+	reader := protoio.NewDelimitedReader(stream, 2048)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	query := &protocoltypes.GroupDirectoryQuery{}
+	if err := reader.ReadMsg(query); err != nil {
+		d.logger.Debug("unable to read group directory query", zap.Error(err))
+		return
+	}
+
+	if err := writer.WriteMsg(&protocoltypes.GroupDirectoryAnswer{
+		Descriptors: d.listDescriptors(query.Topic),
+	}); err != nil {
+		d.logger.Debug("unable to write group directory answer", zap.Error(err))
+	}
+}
+
+// search looks for the peers announcing public groups on the given topic and
+// queries their descriptors until the context is done, the local public groups
+// are returned first
+func (d *groupDirectory) search(ctx context.Context, topic string) <-chan *protocoltypes.GroupPublicDescriptor {
+	ctx, _, endSection := tyber.Section(ctx, d.logger, "searching group directory: "+topic)
+
+	out := make(chan *protocoltypes.GroupPublicDescriptor)
+
+	go func() {
+		defer endSection(nil, "group directory search ended")
+		defer close(out)
+
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		found := map[string]struct{}{}
+		var muFound sync.Mutex
+
+		send := func(descriptor *protocoltypes.GroupPublicDescriptor) {
+			muFound.Lock()
+			if _, ok := found[string(descriptor.Group.PublicKey)]; ok {
+				muFound.Unlock()
+				return
+			}
+			found[string(descriptor.Group.PublicKey)] = struct{}{}
+			muFound.Unlock()
+
+			select {
+			case out <- descriptor:
+			case <-ctx.Done():
+			}
+		}
+
+		for _, descriptor := range d.listDescriptors(topic) {
+			send(descriptor)
+		}
+
+		for p := range d.swiper.WatchTopic(ctx, []byte(topic), d.topicSeed(topic)) {
+			if p.ID == d.host.ID() {
+				continue
+			}
+
+			wg.Add(1)
+			go func(p peer.AddrInfo) {
+				defer wg.Done()
+
+				descriptors, err := d.queryPeer(ctx, p, topic)
+				if err != nil {
+					d.logger.Debug("unable to query group directory", logutil.PrivateStringer("peer", p.ID), zap.Error(err))
+					return
+				}
+
+				for _, descriptor := range descriptors {
+					send(descriptor)
+				}
+			}(p)
+		}
+	}()
+
+	return out
+}
+
+// queryPeer returns the valid descriptors announced by a peer on a topic
+func (d *groupDirectory) queryPeer(ctx context.Context, p peer.AddrInfo, topic string) ([]*protocoltypes.GroupPublicDescriptor, error) {
+	if err := d.host.Connect(ctx, p); err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	stream, err := d.host.NewStream(network.WithAllowLimitedConn(ctx, "group_directory"), p.ID, groupDirectoryV1)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open stream: %w", err)
+	}
+	defer stream.Close()
+
+	reader := protoio.NewDelimitedReader(stream, groupDirectoryMaxAnswerSize)
+	writer := protoio.NewDelimitedWriter(stream)
+
+	if err := writer.WriteMsg(&protocoltypes.GroupDirectoryQuery{Topic: topic}); err != nil {
+		return nil, errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	answer := &protocoltypes.GroupDirectoryAnswer{}
+	if err := reader.ReadMsg(answer); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	descriptors := make([]*protocoltypes.GroupPublicDescriptor, 0, len(answer.Descriptors))
+	for _, descriptor := range answer.Descriptors {
+		if err := checkGroupPublicDescriptor(descriptor, topic); err != nil {
+			d.logger.Debug("ignoring invalid group descriptor", logutil.PrivateStringer("peer", p.ID), zap.Error(err))
+			continue
+		}
+
+		descriptors = append(descriptors, descriptor)
+	}
+
+	return descriptors, nil
+}
+
+// checkGroupPublicDescriptor checks that a descriptor received from a peer
+// contains a usable invitation to a multi-member group
+func checkGroupPublicDescriptor(descriptor *protocoltypes.GroupPublicDescriptor, topic string) error {
+	if descriptor.Topic != topic {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("descriptor announced on another topic"))
+	}
+
+	g := descriptor.Group
+	if g == nil || g.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("descriptor doesn't contain a multi-member group"))
+	}
+
+	if err := g.IsValid(); err != nil {
+		return err
+	}
+
+	return verifyGroupInvitationToken(g, g.Invitation)
+}
+
+// matchGroupPublicDescriptor returns true if the name or the description of
+// the group contains the query, case insensitive
+func matchGroupPublicDescriptor(descriptor *protocoltypes.GroupPublicDescriptor, query string) bool {
+	query = strings.ToLower(query)
+
+	return strings.Contains(strings.ToLower(descriptor.Name), query) ||
+		strings.Contains(strings.ToLower(descriptor.Description), query)
+}
@@ -0,0 +1,100 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestCheckGroupPublicDescriptor(t *testing.T) {
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	md, err := secretStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	g.Invitation, err = newGroupInvitationToken(g, md, 0, false)
+	require.NoError(t, err)
+
+	descriptor := &protocoltypes.GroupPublicDescriptor{
+		Name:  "Gardening",
+		Topic: DefaultGroupDirectoryTopic,
+		Group: g,
+	}
+
+	require.NoError(t, checkGroupPublicDescriptor(descriptor, DefaultGroupDirectoryTopic))
+	require.Error(t, checkGroupPublicDescriptor(descriptor, "other-topic"))
+
+	require.True(t, matchGroupPublicDescriptor(descriptor, "garden"))
+	require.False(t, matchGroupPublicDescriptor(descriptor, "cooking"))
+
+	// an invitation signed for another group is rejected
+	otherGroup, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	otherGroup.Invitation = g.Invitation
+	descriptor.Group = otherGroup
+	require.Error(t, checkGroupPublicDescriptor(descriptor, DefaultGroupDirectoryTopic))
+}
+
+func TestGroupDirectorySearch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	logger, cleanup := testutil.Logger(t)
+	defer cleanup()
+
+	opts := TestingOpts{
+		Mocknet: mocknet.New(),
+		Logger:  logger,
+	}
+
+	pts, cleanup := NewTestingProtocolWithMockedPeers(ctx, t, &opts, nil, 2)
+	defer cleanup()
+
+	created, err := pts[0].Client.MultiMemberGroupCreate(ctx, &protocoltypes.MultiMemberGroupCreate_Request{})
+	require.NoError(t, err)
+
+	// ownership is claimed asynchronously
+	require.Eventually(t, func() bool {
+		_, err := pts[0].Client.GroupSetPublic(ctx, &protocoltypes.GroupSetPublic_Request{
+			GroupPk:     created.GroupPk,
+			Enabled:     true,
+			Name:        "Gardening",
+			Description: "Tips for growing vegetables",
+		})
+		return err == nil
+	}, time.Second*5, time.Millisecond*100)
+
+	searchCtx, searchCancel := context.WithTimeout(ctx, time.Second*20)
+	defer searchCancel()
+
+	sub, err := pts[1].Client.GroupDirectorySearch(searchCtx, &protocoltypes.GroupDirectorySearch_Request{
+		Query: "vegetables",
+	})
+	require.NoError(t, err)
+
+	reply, err := sub.Recv()
+	require.NoError(t, err)
+	searchCancel()
+
+	descriptor := reply.GroupDescriptor
+	require.Equal(t, "Gardening", descriptor.Name)
+	require.Equal(t, DefaultGroupDirectoryTopic, descriptor.Topic)
+	require.Equal(t, created.GroupPk, descriptor.Group.PublicKey)
+	require.NotNil(t, descriptor.Group.Invitation)
+
+	_, err = pts[1].Client.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{
+		Group: descriptor.Group,
+	})
+	require.NoError(t, err)
+}
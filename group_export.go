@@ -0,0 +1,279 @@
+package weshnet
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	exportGroupFilename     = "group"
+	exportGroupKeysFilename = "keys"
+
+	// groupBundleNonceSize is the size of the nonce prepended by
+	// cryptoutil.AESGCMEncrypt to the encrypted archive
+	groupBundleNonceSize = 12
+)
+
+// exportGroup writes an archive of a group to output, it contains the group
+// secrets, the keys of its devices, its metadata store and optionally its
+// message store.
+func (s *service) exportGroup(ctx context.Context, gc *GroupContext, includeMessages bool, output io.Writer) error {
+	tw := tar.NewWriter(output)
+	defer tw.Close()
+
+	groupBytes, err := proto.Marshal(gc.Group())
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := exportPrivateKey(tw, groupBytes, exportGroupFilename); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	var (
+		messageCIDs   []cid.Cid
+		messagesHeads []cid.Cid
+	)
+
+	if includeMessages {
+		if messageCIDs, err = storeEntryCIDs(ctx, gc.messageStore, s.odb.logCompaction); err != nil {
+			return err
+		}
+
+		for _, raw := range gc.messageStore.OpLog().RawHeads().Slice() {
+			messagesHeads = append(messagesHeads, raw.GetHash())
+		}
+	}
+
+	keys, err := s.secretStore.ExportGroupKeys(ctx, gc.Group(), messageCIDs)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	keysBytes, err := proto.Marshal(keys)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := exportPrivateKey(tw, keysBytes, exportGroupKeysFilename); err != nil {
+		return errcode.ErrCode_ErrStreamWrite.Wrap(err)
+	}
+
+	if err := s.exportOrbitDBStore(ctx, gc.metadataStore, tw); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if includeMessages {
+		if err := s.exportOrbitDBStore(ctx, gc.messageStore, tw); err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	metadataHeads := []cid.Cid(nil)
+	for _, raw := range gc.metadataStore.OpLog().RawHeads().Slice() {
+		metadataHeads = append(metadataHeads, raw.GetHash())
+	}
+
+	if err := s.exportOrbitDBGroupHeads(gc, metadataHeads, messagesHeads, tw); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	return nil
+}
+
+// sealGroupBundle encrypts an archive using a key derived from the
+// passphrase, the salt used is prepended to the bundle
+func sealGroupBundle(passphrase []byte, archive []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a passphrase is required"))
+	}
+
+	key, salt, err := cryptoutil.DeriveKey(passphrase, nil)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encrypted, err := cryptoutil.AESGCMEncrypt(key, archive)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	return append(salt, encrypted...), nil
+}
+
+// openGroupBundle decrypts a bundle created by sealGroupBundle
+func openGroupBundle(passphrase []byte, bundle []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a passphrase is required"))
+	}
+
+	if len(bundle) <= cryptoutil.ScryptKeyLen+groupBundleNonceSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("bundle is too short"))
+	}
+
+	key, _, err := cryptoutil.DeriveKey(passphrase, bundle[:cryptoutil.ScryptKeyLen])
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	archive, err := cryptoutil.AESGCMDecrypt(key, bundle[cryptoutil.ScryptKeyLen:])
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return archive, nil
+}
+
+type restoreGroupState struct {
+	group *protocoltypes.Group
+	keys  *protocoltypes.GroupBundleKeys
+}
+
+func (state *restoreGroupState) readGroup(accountGroup *GroupContext) RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if header.Name != exportGroupFilename {
+				return false, nil
+			}
+
+			if state.group != nil {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("multiple groups found in archive"))
+			}
+
+			data, err := readExportSecretKeyFile(header.Size, reader)
+			if err != nil {
+				return true, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			g := &protocoltypes.Group{}
+			if err := proto.Unmarshal(data, g); err != nil {
+				return true, errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			if err := g.IsValid(); err != nil {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+			}
+
+			if g.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+				return true, errcode.ErrCode_ErrGroupInvalidType
+			}
+
+			if accountGroup.MetadataStore().checkIfInGroup(g.PublicKey) {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group already joined"))
+			}
+
+			state.group = g
+
+			return true, nil
+		},
+	}
+}
+
+func (state *restoreGroupState) readKeys() RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if header.Name != exportGroupKeysFilename {
+				return false, nil
+			}
+
+			data, err := readExportSecretKeyFile(header.Size, reader)
+			if err != nil {
+				return true, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			state.keys = &protocoltypes.GroupBundleKeys{}
+			if err := proto.Unmarshal(data, state.keys); err != nil {
+				return true, errcode.ErrCode_ErrDeserialization.Wrap(err)
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// restoreHeads restores the heads of the stores of the imported group, the
+// heads of other groups are rejected
+func (state *restoreGroupState) restoreHeads(ctx context.Context, odb *WeshOrbitDB) RestoreAccountHandler {
+	return RestoreAccountHandler{
+		Handler: func(header *tar.Header, reader *tar.Reader) (bool, error) {
+			if !strings.HasPrefix(header.Name, exportOrbitDBHeadsPrefix) {
+				return false, nil
+			}
+
+			if state.group == nil {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group heads found before the group"))
+			}
+
+			heads, metaCIDs, messageCIDs, err := readExportOrbitDBGroupHeads(header.Size, reader)
+			if err != nil {
+				return true, errcode.ErrCode_ErrInternal.Wrap(err)
+			}
+
+			if !bytes.Equal(heads.PublicKey, state.group.PublicKey) {
+				return true, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("heads don't belong to the exported group"))
+			}
+
+			if err := odb.setHeadsForGroup(ctx, state.group, metaCIDs, messageCIDs); err != nil {
+				return true, errcode.ErrCode_ErrOrbitDBAppend.Wrap(fmt.Errorf("error while restoring db head: %w", err))
+			}
+
+			return true, nil
+		},
+	}
+}
+
+// importGroup restores a group archive created by exportGroup and joins the
+// group from the account group
+func (s *service) importGroup(ctx context.Context, archive io.Reader) (*protocoltypes.Group, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, errcode.ErrCode_ErrGroupMissing
+	}
+
+	state := &restoreGroupState{}
+
+	handlers := []RestoreAccountHandler{
+		state.readGroup(accountGroup),
+		state.readKeys(),
+		restoreOrbitDBEntry(ctx, s.ipfsCoreAPI),
+		state.restoreHeads(ctx, s.odb),
+	}
+
+	if err := restoreExport(tar.NewReader(archive), s.logger, handlers); err != nil {
+		return nil, err
+	}
+
+	if state.group == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no group found in archive"))
+	}
+
+	if err := s.secretStore.PutGroup(ctx, state.group); err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if state.keys != nil {
+		if err := s.secretStore.ImportGroupKeys(ctx, state.group, state.keys); err != nil {
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	if _, err := accountGroup.MetadataStore().GroupJoin(ctx, state.group); err != nil {
+		return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+	}
+
+	s.logger.Info("group imported", zap.Int("chain keys", len(state.keys.GetChainKeys())), zap.Int("message keys", len(state.keys.GetMessageKeys())))
+
+	return state.group, nil
+}
@@ -0,0 +1,28 @@
+package weshnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupBundleSealOpen(t *testing.T) {
+	archive := []byte("group archive")
+
+	_, err := sealGroupBundle(nil, archive)
+	require.Error(t, err)
+
+	bundle, err := sealGroupBundle([]byte("passphrase"), archive)
+	require.NoError(t, err)
+	require.NotContains(t, string(bundle), string(archive))
+
+	opened, err := openGroupBundle([]byte("passphrase"), bundle)
+	require.NoError(t, err)
+	require.Equal(t, archive, opened)
+
+	_, err = openGroupBundle([]byte("wrong passphrase"), bundle)
+	require.Error(t, err)
+
+	_, err = openGroupBundle([]byte("passphrase"), bundle[:20])
+	require.Error(t, err)
+}
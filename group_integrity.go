@@ -0,0 +1,163 @@
+package weshnet
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// verifyGroupIntegrity walks the metadata and message logs of a group and
+// reports the entries which are missing, invalid or can't be decrypted. Only
+// the payload of the messages already opened is verified, opening the others
+// would consume their message keys. The entries removed by the compaction of
+// the logs aren't reported as missing, compaction can be nil.
+func verifyGroupIntegrity(ctx context.Context, gc *GroupContext, compaction *logCompaction) (*protocoltypes.GroupVerifyIntegrity_Reply, error) {
+	metadataStore, messageStore := gc.MetadataStore(), gc.MessageStore()
+	groupPublicKey := messageStore.groupPublicKey
+
+	compactedFrom := func(store orbitdb.Store) func(cid.Cid) bool {
+		address := store.Address().String()
+
+		return func(id cid.Cid) bool {
+			return compaction != nil && compaction.isCompacted(ctx, address, id)
+		}
+	}
+
+	reply := &protocoltypes.GroupVerifyIntegrity_Reply{}
+
+	// the signatures of the metadata events, including the member proofs of
+	// the devices, are checked when the entry is opened
+	metadataEntries := metadataStore.OpLog().GetEntries().Slice()
+	reply.MetadataCount = uint64(len(metadataEntries))
+	reply.MissingMetadata = listMissingEntries(metadataStore.OpLog(), metadataEntries, compactedFrom(metadataStore))
+
+	for _, e := range metadataEntries {
+		if _, _, err := openMetadataEntry(ctx, metadataStore.OpLog(), e, gc.group, gc.secretStore); err != nil {
+			reply.InvalidMetadata = append(reply.InvalidMetadata, e.GetHash().String())
+		}
+	}
+
+	messageEntries := messageStore.OpLog().GetEntries().Slice()
+	reply.MessageCount = uint64(len(messageEntries))
+	reply.MissingMessages = listMissingEntries(messageStore.OpLog(), messageEntries, compactedFrom(messageStore))
+
+	ids := make([]cid.Cid, len(messageEntries))
+	for i, e := range messageEntries {
+		ids[i] = e.GetHash()
+	}
+
+	keys, err := gc.secretStore.ExportGroupKeys(ctx, gc.group, ids)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	opened := make(map[string]struct{}, len(keys.MessageKeys))
+	for _, k := range keys.MessageKeys {
+		opened[string(k.Cid)] = struct{}{}
+	}
+
+	// devices seen in the logs or in the secret store, in order of appearance
+	var seenDevices [][]byte
+	seen := map[string]struct{}{}
+	addSeenDevice := func(devicePK []byte) {
+		if _, ok := seen[string(devicePK)]; !ok {
+			seen[string(devicePK)] = struct{}{}
+			seenDevices = append(seenDevices, devicePK)
+		}
+	}
+
+	for _, e := range messageEntries {
+		if messageStore.isPruned(e.GetHash()) {
+			continue
+		}
+
+		op, err := operation.ParseOperation(e)
+		if err != nil {
+			reply.UndecryptableMessages = append(reply.UndecryptableMessages, e.GetHash().String())
+			continue
+		}
+
+		env, headers, err := gc.secretStore.OpenEnvelopeHeaders(op.GetValue(), gc.group)
+		if err != nil {
+			reply.UndecryptableMessages = append(reply.UndecryptableMessages, e.GetHash().String())
+			continue
+		}
+
+		addSeenDevice(headers.DevicePk)
+
+		devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(headers.DevicePk)
+		if err != nil || !gc.secretStore.IsChainKeyKnownForDevice(ctx, groupPublicKey, devicePublicKey) {
+			reply.UndecryptableMessages = append(reply.UndecryptableMessages, e.GetHash().String())
+			continue
+		}
+
+		if _, ok := opened[string(e.GetHash().Bytes())]; !ok {
+			continue
+		}
+
+		if _, err := gc.secretStore.OpenEnvelopePayload(ctx, env, headers, groupPublicKey, gc.DevicePubKey(), e.GetHash()); err != nil {
+			reply.UndecryptableMessages = append(reply.UndecryptableMessages, e.GetHash().String())
+		}
+	}
+
+	for _, chainKey := range keys.ChainKeys {
+		addSeenDevice(chainKey.DevicePk)
+	}
+
+	for _, devicePK := range seenDevices {
+		devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+		if err == nil {
+			_, err = metadataStore.GetMemberByDevice(devicePublicKey)
+		}
+
+		if err != nil {
+			reply.OrphanDevices = append(reply.OrphanDevices, devicePK)
+		}
+	}
+
+	for _, device := range metadataStore.ListDevices() {
+		if gc.secretStore.IsChainKeyKnownForDevice(ctx, groupPublicKey, device) {
+			continue
+		}
+
+		devicePK, err := device.Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		reply.DevicesWithoutSecret = append(reply.DevicesWithoutSecret, devicePK)
+	}
+
+	return reply, nil
+}
+
+// listMissingEntries returns the CIDs of the entries referenced by the given
+// entries which are not available in the log and haven't been compacted
+func listMissingEntries(log ipfslog.Log, entries []ipfslog.Entry, compacted func(cid.Cid) bool) []string {
+	var missing []string
+	found := map[string]struct{}{}
+
+	for _, e := range entries {
+		for _, next := range e.GetNext() {
+			if _, ok := log.Get(next); ok || compacted(next) {
+				continue
+			}
+
+			if _, ok := found[next.KeyString()]; ok {
+				continue
+			}
+
+			found[next.KeyString()] = struct{}{}
+			missing = append(missing, next.String())
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,54 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/testutil"
+)
+
+func TestVerifyGroupIntegrity(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/integrity_test", 2, 1)
+	defer cleanup()
+
+	dPK0Raw, err := peers[0].GC.DevicePubKey().Raw()
+	require.NoError(t, err)
+
+	cadded, err := peers[1].GC.MessageStore().EventBus().Subscribe(new(messageItem))
+	require.NoError(t, err)
+	defer cadded.Close()
+
+	_, err = peers[0].GC.MessageStore().AddMessage(ctx, []byte("test message"))
+	require.NoError(t, err)
+
+	select {
+	case <-cadded.Out():
+	case <-time.After(time.Second * 5):
+		require.FailNow(t, "timeout while waiting for replicated event")
+	}
+
+	// the sender can open its own message
+	report, err := verifyGroupIntegrity(ctx, peers[0].GC, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), report.MessageCount)
+	require.Empty(t, report.MissingMessages)
+	require.Empty(t, report.UndecryptableMessages)
+	require.Empty(t, report.InvalidMetadata)
+
+	// the device of peer 0 has never been added to the group and its chain key
+	// hasn't been shared with peer 1
+	report, err = verifyGroupIntegrity(ctx, peers[1].GC, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), report.MessageCount)
+	require.Empty(t, report.MissingMessages)
+	require.Len(t, report.UndecryptableMessages, 1)
+	require.Contains(t, report.OrphanDevices, dPK0Raw)
+}
@@ -0,0 +1,101 @@
+package weshnet
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+const groupInvitationIDSize = 16
+
+// newGroupInvitationToken creates a revocable invitation token signed by the
+// given device, expiresAt is a unix timestamp in seconds, 0 if the invitation
+// doesn't expire
+func newGroupInvitationToken(g *protocoltypes.Group, md secretstore.OwnMemberDevice, expiresAt int64, approvalRequired bool) (*protocoltypes.GroupInvitationToken, error) {
+	id := make([]byte, groupInvitationIDSize)
+	if _, err := crand.Read(id); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	devicePK, err := md.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	token := &protocoltypes.GroupInvitationToken{
+		Id:               id,
+		ExpiresAt:        expiresAt,
+		DevicePk:         devicePK,
+		ApprovalRequired: approvalRequired,
+	}
+
+	data, err := groupInvitationTokenSignedData(g, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Sig, err = md.DeviceSign(data); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return token, nil
+}
+
+// groupInvitationTokenSignedData returns the data signed by the device which
+// created the token, binding it to the group
+func groupInvitationTokenSignedData(g *protocoltypes.Group, token *protocoltypes.GroupInvitationToken) ([]byte, error) {
+	unsigned := &protocoltypes.GroupInvitationToken{
+		Id:               token.Id,
+		ExpiresAt:        token.ExpiresAt,
+		DevicePk:         token.DevicePk,
+		ApprovalRequired: token.ApprovalRequired,
+	}
+
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return append(append([]byte(nil), g.PublicKey...), data...), nil
+}
+
+// verifyGroupInvitationToken checks the signature of the token, it doesn't
+// check whether the signing device is an admin of the group
+func verifyGroupInvitationToken(g *protocoltypes.Group, token *protocoltypes.GroupInvitationToken) error {
+	if token == nil || len(token.Id) != groupInvitationIDSize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid invitation token"))
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(token.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	data, err := groupInvitationTokenSignedData(g, token)
+	if err != nil {
+		return err
+	}
+
+	ok, err := devicePK.Verify(data, token.Sig)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
+	}
+
+	if !ok {
+		return errcode.ErrCode_ErrCryptoSignatureVerification
+	}
+
+	return nil
+}
+
+// isGroupInvitationExpired returns true if the token can't be used anymore
+func isGroupInvitationExpired(token *protocoltypes.GroupInvitationToken, now time.Time) bool {
+	return token != nil && token.ExpiresAt != 0 && now.Unix() > token.ExpiresAt
+}
@@ -0,0 +1,126 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+func TestGroupInvitationToken(t *testing.T) {
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	otherGroup, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	md, err := secretStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	token, err := newGroupInvitationToken(g, md, now.Add(time.Hour).Unix(), false)
+	require.NoError(t, err)
+	require.NoError(t, verifyGroupInvitationToken(g, token))
+
+	// tokens are bound to their group
+	require.Error(t, verifyGroupInvitationToken(otherGroup, token))
+
+	// expiration can't be extended
+	token.ExpiresAt += 3600
+	require.Error(t, verifyGroupInvitationToken(g, token))
+	token.ExpiresAt -= 3600
+
+	require.False(t, isGroupInvitationExpired(token, now))
+	require.True(t, isGroupInvitationExpired(token, now.Add(2*time.Hour)))
+
+	token, err = newGroupInvitationToken(g, md, 0, false)
+	require.NoError(t, err)
+	require.False(t, isGroupInvitationExpired(token, now.Add(24*365*time.Hour)))
+	require.False(t, isGroupInvitationExpired(nil, now))
+}
+
+func TestMetadataIndexInvitations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, err := secretStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	ownerRaw, err := owner.Member().Raw()
+	require.NoError(t, err)
+
+	legacyMember, memberA, memberB, memberC := newTestingAccountPK(t), newTestingAccountPK(t), newTestingAccountPK(t), newTestingAccountPK(t)
+	knockingMember, approvedMember := newTestingAccountPK(t), newTestingAccountPK(t)
+	intimeMember, lateMember, undatedMember := newTestingAccountPK(t), newTestingAccountPK(t), newTestingAccountPK(t)
+
+	validToken, err := newGroupInvitationToken(g, owner, 0, false)
+	require.NoError(t, err)
+
+	revokedToken, err := newGroupInvitationToken(g, owner, 0, false)
+	require.NoError(t, err)
+
+	approvalToken, err := newGroupInvitationToken(g, owner, 0, true)
+	require.NoError(t, err)
+
+	expiresAt := time.Now().Unix()
+	expiringToken, err := newGroupInvitationToken(g, owner, expiresAt, false)
+	require.NoError(t, err)
+
+	ownerDeviceRaw, err := owner.Device().Raw()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	m.admins[owner.Device()] = struct{}{}
+	m.devices[string(ownerDeviceRaw)] = owner
+	m.members[string(ownerRaw)] = []secretstore.MemberDevice{owner}
+
+	// positions are given in chronological order
+	m.eventsMemberJoined = []memberJoin{
+		{position: 4, memberPK: memberC, invitation: revokedToken},
+		{position: 0, memberPK: ownerRaw},
+		{position: 1, memberPK: legacyMember},
+		{position: 2, memberPK: memberA, invitation: validToken},
+		{position: 5, memberPK: memberB},
+		{position: 6, memberPK: knockingMember, invitation: approvalToken},
+		{position: 7, memberPK: approvedMember, invitation: approvalToken},
+		{position: 8, memberPK: intimeMember, invitation: expiringToken, joinedAt: expiresAt},
+		{position: 9, memberPK: lateMember, invitation: expiringToken, joinedAt: expiresAt + 1},
+		{position: 10, memberPK: undatedMember, invitation: expiringToken},
+	}
+	m.eventsInvitationRevoked = []invitationRevocation{
+		{position: 3, event: &protocoltypes.MultiMemberGroupInvitationRevoked{DevicePk: ownerDeviceRaw, InvitationId: revokedToken.Id}},
+	}
+
+	m.approvedMembers[string(approvedMember)] = struct{}{}
+
+	require.NoError(t, m.postHandlerInvitations())
+
+	require.Equal(t, map[string]struct{}{
+		string(memberB):       {},
+		string(memberC):       {},
+		string(lateMember):    {},
+		string(undatedMember): {},
+	}, m.removedMembers)
+
+	// the rejected members may have received keys before the rejection was
+	// known, each of them starts a new epoch
+	require.Equal(t, uint64(4), m.getChainKeyEpoch())
+
+	require.Equal(t, map[string][]byte{
+		string(knockingMember): approvalToken.Id,
+	}, m.pendingMembers)
+}
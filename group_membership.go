@@ -0,0 +1,84 @@
+package weshnet
+
+import (
+	"sort"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// groupMembership is the state of the members of a group as materialized by
+// the metadata store index
+type groupMembership struct {
+	// devices are the devices of the active members, indexed by member
+	devices map[string][]string
+
+	// banned are the banned members
+	banned map[string]struct{}
+}
+
+// diffGroupMembership returns the events describing the changes between two
+// states of the members of a group, a nil previous state is handled as an
+// empty group
+func diffGroupMembership(previous, current *groupMembership) []*protocoltypes.GroupMembershipWatch_Reply {
+	if previous == nil {
+		previous = &groupMembership{}
+	}
+
+	var events []*protocoltypes.GroupMembershipWatch_Reply
+
+	for _, memberPK := range sortedMembers(previous.devices) {
+		if _, ok := current.devices[memberPK]; ok {
+			continue
+		}
+
+		eventType := protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberRemoved
+		if _, ok := current.banned[memberPK]; ok {
+			eventType = protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberBanned
+		}
+
+		events = append(events, &protocoltypes.GroupMembershipWatch_Reply{
+			Type:     eventType,
+			MemberPk: []byte(memberPK),
+		})
+	}
+
+	for _, memberPK := range sortedMembers(current.devices) {
+		previousDevices, ok := previous.devices[memberPK]
+		if !ok {
+			events = append(events, &protocoltypes.GroupMembershipWatch_Reply{
+				Type:     protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberJoined,
+				MemberPk: []byte(memberPK),
+			})
+		}
+
+		known := make(map[string]struct{}, len(previousDevices))
+		for _, devicePK := range previousDevices {
+			known[devicePK] = struct{}{}
+		}
+
+		for _, devicePK := range current.devices[memberPK] {
+			if _, ok := known[devicePK]; ok {
+				continue
+			}
+
+			events = append(events, &protocoltypes.GroupMembershipWatch_Reply{
+				Type:     protocoltypes.GroupMembershipEventType_GroupMembershipEventDeviceAdded,
+				MemberPk: []byte(memberPK),
+				DevicePk: []byte(devicePK),
+			})
+		}
+	}
+
+	return events
+}
+
+func sortedMembers(devices map[string][]string) []string {
+	members := make([]string, 0, len(devices))
+	for memberPK := range devices {
+		members = append(members, memberPK)
+	}
+
+	sort.Strings(members)
+
+	return members
+}
@@ -0,0 +1,53 @@
+package weshnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestDiffGroupMembership(t *testing.T) {
+	initial := &groupMembership{
+		devices: map[string][]string{
+			"alice": {"alice-1"},
+			"bob":   {"bob-1"},
+		},
+	}
+
+	// the current members are sent first
+	events := diffGroupMembership(nil, initial)
+	require.Equal(t, []*protocoltypes.GroupMembershipWatch_Reply{
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberJoined, MemberPk: []byte("alice")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventDeviceAdded, MemberPk: []byte("alice"), DevicePk: []byte("alice-1")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberJoined, MemberPk: []byte("bob")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventDeviceAdded, MemberPk: []byte("bob"), DevicePk: []byte("bob-1")},
+	}, events)
+
+	require.Empty(t, diffGroupMembership(initial, initial))
+
+	current := &groupMembership{
+		devices: map[string][]string{
+			"alice":   {"alice-1", "alice-2"},
+			"charlie": {"charlie-1"},
+		},
+		banned: map[string]struct{}{"bob": {}},
+	}
+
+	events = diffGroupMembership(initial, current)
+	require.Equal(t, []*protocoltypes.GroupMembershipWatch_Reply{
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberBanned, MemberPk: []byte("bob")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventDeviceAdded, MemberPk: []byte("alice"), DevicePk: []byte("alice-2")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberJoined, MemberPk: []byte("charlie")},
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventDeviceAdded, MemberPk: []byte("charlie"), DevicePk: []byte("charlie-1")},
+	}, events)
+
+	// a member neither active nor banned has been removed
+	events = diffGroupMembership(current, &groupMembership{
+		devices: map[string][]string{"alice": {"alice-1", "alice-2"}},
+	})
+	require.Equal(t, []*protocoltypes.GroupMembershipWatch_Reply{
+		{Type: protocoltypes.GroupMembershipEventType_GroupMembershipEventMemberRemoved, MemberPk: []byte("charlie")},
+	}, events)
+}
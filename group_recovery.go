@@ -0,0 +1,324 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap"
+
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/replicationtypes"
+)
+
+const (
+	// groupRecoveryTimeout is the maximum duration of a recovery if the
+	// request doesn't set one
+	groupRecoveryTimeout = time.Minute
+
+	// groupRecoveryHeadsTimeout is the maximum duration given to the peers
+	// connected to the group to send their heads once the stores of the
+	// group are opened again
+	groupRecoveryHeadsTimeout = 20 * time.Second
+)
+
+// recoveryGroup returns the group to recover from its invitation material,
+// a multi-member group unknown to the account is joined
+func (s *service) recoveryGroup(ctx context.Context, g *protocoltypes.Group) (*protocoltypes.Group, error) {
+	if g == nil || len(g.PublicKey) == 0 || len(g.Secret) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing group public key or secret"))
+	}
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the account group is recovered with an account restore"))
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(g.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	known, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		if g.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+			return nil, errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+		}
+
+		accountGroup := s.getAccountGroup()
+		if accountGroup == nil {
+			return nil, errcode.ErrCode_ErrGroupMissing
+		}
+
+		if _, err := accountGroup.MetadataStore().GroupJoin(ctx, g); err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBAppend.Wrap(err)
+		}
+
+		if known, err = s.getGroupForPK(ctx, pk); err != nil {
+			return nil, err
+		}
+	}
+
+	if !bytes.Equal(known.Secret, g.Secret) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the group secret doesn't match the known group"))
+	}
+
+	return known, nil
+}
+
+// recoverGroup rebuilds the logs of the group. The stores are dropped, so
+// their entries are read again from their heads and their indexes rebuilt,
+// then they are opened again and exchange their heads with the peers
+// connected on their topics. The heads known before the recovery, the ones
+// sent by the peers and the latest heads of the replication services of the
+// group are then loaded, from the local blockstore when their entries are
+// still pinned, from the network otherwise. The stores are rebuilt once the
+// other calls using the group have returned, and the message store of a
+// group in metadata-only mode is only rebuilt from the heads known before
+// the recovery.
+func (s *service) recoverGroup(ctx context.Context, g *protocoltypes.Group) (*protocoltypes.GroupRecoverFromNetwork_Reply, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(g.PublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	cg, err := s.getOpenedGroup(g.PublicKey)
+	if err == errcode.ErrCode_ErrGroupUnknown {
+		if err := s.activateGroup(ctx, pk, true); err != nil {
+			return nil, errcode.ErrCode_ErrGroupActivate.Wrap(err)
+		}
+
+		cg, err = s.getOpenedGroup(g.PublicKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the replication services are read from the index before it is dropped
+	replicationServers := replicationServerNames(cg.metadataStore.ListReplicationServers(time.Now()))
+
+	knownHeads := map[string][]cid.Cid{}
+	peers := map[string][]peer.ID{}
+
+	for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+		address := store.Address().String()
+		for _, head := range store.OpLog().RawHeads().Slice() {
+			knownHeads[address] = append(knownHeads[address], head.GetHash())
+		}
+
+		peers[address] = s.storeTopicPeers(ctx, address)
+	}
+
+	// the message entries of a group in metadata-only mode are only fetched
+	// on demand, the recovery only loads the ones known before
+	mode, err := s.syncPolicies.getMode(ctx, g.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	version := s.odb.syncState.getVersion()
+
+	// the group must not be used by other calls while its stores are
+	// dropped and opened again, the recovery waits for the calls using it
+	// and the new ones wait for the recovery
+	rebuilt, err := s.groupRetains.rebuild(ctx, string(g.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	err = s.unsafeRebuildGroup(ctx, g, cg)
+	s.lock.Unlock()
+	rebuilt()
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the group opened while it is recovered
+	defer s.retainGroup(g.PublicKey)()
+
+	if cg, err = s.getOpenedGroup(g.PublicKey); err != nil {
+		return nil, err
+	}
+
+	complete := s.waitForRecoveryHeads(ctx, cg, peers, version)
+
+	serviceHeads := s.replicationServiceHeads(ctx, g, cg.metadataStore.Address().String(), cg.messageStore.Address().String(), replicationServers)
+
+	for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+		address := store.Address().String()
+		heads := knownHeads[address]
+		if store != orbitdb.Store(cg.messageStore) || mode != protocoltypes.GroupSyncMode_GroupSyncModeMetadataOnly {
+			heads = append(heads, serviceHeads[address]...)
+			heads = append(heads, s.odb.syncState.pendingHeads(address)...)
+		}
+
+		missing := []cid.Cid{}
+		seen := map[string]struct{}{}
+		for _, head := range heads {
+			if _, ok := seen[head.KeyString()]; ok {
+				continue
+			}
+			seen[head.KeyString()] = struct{}{}
+
+			if _, ok := store.OpLog().Get(head); !ok {
+				missing = append(missing, head)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		if err := s.odb.loadHeads(ctx, store, missing); err != nil {
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+				return nil, errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+			}
+
+			complete = false
+		}
+	}
+
+	reply := &protocoltypes.GroupRecoverFromNetwork_Reply{
+		GroupPk:            g.PublicKey,
+		MetadataEntryCount: uint64(cg.metadataStore.OpLog().GetEntries().Len()),
+		MessageEntryCount:  uint64(cg.messageStore.OpLog().GetEntries().Len()),
+		Complete:           complete,
+	}
+
+	s.logger.Info("recovered group logs",
+		logutil.PrivateBinary("group", g.PublicKey),
+		zap.Uint64("metadata-entries", reply.MetadataEntryCount),
+		zap.Uint64("message-entries", reply.MessageEntryCount),
+		zap.Int("replication-servers", len(replicationServers)),
+		zap.Bool("complete", complete),
+	)
+
+	return reply, nil
+}
+
+// unsafeRebuildGroup drops the stores of the opened group then opens them
+// again, s.lock must be held
+func (s *service) unsafeRebuildGroup(ctx context.Context, g *protocoltypes.Group, cg *GroupContext) error {
+	if s.openedGroups[string(g.PublicKey)] != cg {
+		return errcode.ErrCode_ErrGroupActivate.Wrap(fmt.Errorf("the group has been closed during the recovery"))
+	}
+
+	// drop closes the stores and deletes their heads from the cache
+	if err := cg.Drop(); err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	delete(s.openedGroups, string(g.PublicKey))
+
+	for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+		if err := s.odb.indexCache.reset(ctx, store.Address().String()); err != nil {
+			return err
+		}
+	}
+
+	if err := s.unsafeActivateGroup(ctx, g.PublicKey, g, false); err != nil {
+		return errcode.ErrCode_ErrGroupActivate.Wrap(err)
+	}
+
+	return nil
+}
+
+// storeTopicPeers returns the peers connected on the topic of a store
+func (s *service) storeTopicPeers(ctx context.Context, address string) []peer.ID {
+	topic, err := s.odb.pubSub.TopicSubscribe(ctx, address)
+	if err != nil {
+		s.logger.Warn("unable to subscribe to store topic", zap.Error(err))
+		return nil
+	}
+
+	peers, err := topic.Peers(ctx)
+	if err != nil {
+		s.logger.Warn("unable to list store topic peers", zap.Error(err))
+		return nil
+	}
+
+	return peers
+}
+
+// waitForRecoveryHeads waits until the peers connected on the topics of the
+// stores before the recovery have sent their heads again. It returns false
+// if some of them haven't before groupRecoveryHeadsTimeout.
+func (s *service) waitForRecoveryHeads(ctx context.Context, cg *GroupContext, peers map[string][]peer.ID, since uint64) bool {
+	ctx, cancel := context.WithTimeout(ctx, groupRecoveryHeadsTimeout)
+	defer cancel()
+
+	for {
+		version := s.odb.syncState.getVersion()
+
+		exchanged := true
+		for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+			address := store.Address().String()
+			for _, pid := range peers[address] {
+				if !s.odb.syncState.hasExchangedHeads(address, pid, since) {
+					exchanged = false
+				}
+			}
+		}
+
+		if exchanged {
+			return true
+		}
+
+		s.odb.syncState.waitForChange(ctx, version)
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+// replicationServiceHeads returns the latest heads of the stores of the group
+// known by its replication services, indexed by the address of the store.
+// The services which can't be queried are skipped.
+func (s *service) replicationServiceHeads(ctx context.Context, g *protocoltypes.Group, metadataAddress, messageAddress string, servers []string) map[string][]cid.Cid {
+	heads := map[string][]cid.Cid{}
+
+	for _, server := range servers {
+		client, closeClient, err := s.replicationServiceClient(server, "")
+		if err != nil {
+			s.logger.Warn("unable to dial replication service", logutil.PrivateString("server", server), zap.Error(err))
+			continue
+		}
+
+		reply, err := client.ReplicateGroupStats(ctx, &replicationtypes.ReplicateGroupStats_Request{
+			GroupPublicKey: base64.RawURLEncoding.EncodeToString(g.PublicKey),
+		})
+		closeClient()
+		if err != nil {
+			s.logger.Warn("unable to get replicated group heads", logutil.PrivateString("server", server), zap.Error(err))
+			continue
+		}
+
+		for address, head := range map[string]string{
+			metadataAddress: reply.GetGroup().GetMetadataLatestHead(),
+			messageAddress:  reply.GetGroup().GetMessageLatestHead(),
+		} {
+			if head == "" {
+				continue
+			}
+
+			id, err := cid.Decode(head)
+			if err != nil {
+				s.logger.Warn("invalid replicated group head", logutil.PrivateString("server", server), zap.Error(err))
+				continue
+			}
+
+			heads[address] = append(heads[address], id)
+		}
+	}
+
+	return heads
+}
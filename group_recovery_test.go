@@ -0,0 +1,57 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestGroupRecoverFromNetwork(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPk: g.PublicKey, Payload: []byte("message")})
+	require.NoError(t, err)
+
+	gc, err := s.GetContextGroupForID(g.PublicKey)
+	require.NoError(t, err)
+
+	metadataCount := gc.MetadataStore().OpLog().GetEntries().Len()
+
+	// the secret must match the known group
+	forged := proto.Clone(g).(*protocoltypes.Group)
+	forged.Secret = []byte("forged secret")
+	_, err = s.GroupRecoverFromNetwork(ctx, &protocoltypes.GroupRecoverFromNetwork_Request{Group: forged})
+	require.Error(t, err)
+
+	// the entries still pinned locally are loaded again
+	reply, err := s.GroupRecoverFromNetwork(ctx, &protocoltypes.GroupRecoverFromNetwork_Request{Group: g})
+	require.NoError(t, err)
+	require.True(t, reply.Complete)
+	require.Equal(t, g.PublicKey, reply.GroupPk)
+	// the device may announce itself again while the log is rebuilt
+	require.GreaterOrEqual(t, reply.MetadataEntryCount, uint64(metadataCount))
+	require.Equal(t, uint64(1), reply.MessageEntryCount)
+
+	// the account group can't be recovered this way
+	_, err = s.GroupRecoverFromNetwork(ctx, &protocoltypes.GroupRecoverFromNetwork_Request{Group: s.getAccountGroup().Group()})
+	require.Error(t, err)
+}
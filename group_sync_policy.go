@@ -0,0 +1,125 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// groupSyncPolicies stores which logs of each group are replicated from the
+// peers. The groups in metadata-only mode still exchange the heads of their
+// message store, so their peers are known and the sync state reports the
+// messages left to fetch, but the message entries are only replicated on
+// demand.
+type groupSyncPolicies struct {
+	datastore datastore.Datastore
+}
+
+func newGroupSyncPolicies(ds datastore.Datastore) *groupSyncPolicies {
+	return &groupSyncPolicies{datastore: ds}
+}
+
+func dsKeyForSyncPolicy(groupPK []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(groupPK))
+}
+
+// getMode returns the sync mode of the group, the full mode if none has been
+// set
+func (p *groupSyncPolicies) getMode(ctx context.Context, groupPK []byte) (protocoltypes.GroupSyncMode, error) {
+	data, err := p.datastore.Get(ctx, dsKeyForSyncPolicy(groupPK))
+	if err == datastore.ErrNotFound {
+		return protocoltypes.GroupSyncMode_GroupSyncModeFull, nil
+	} else if err != nil {
+		return protocoltypes.GroupSyncMode_GroupSyncModeFull, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if len(data) != 1 {
+		return protocoltypes.GroupSyncMode_GroupSyncModeFull, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid sync mode"))
+	}
+
+	return protocoltypes.GroupSyncMode(data[0]), nil
+}
+
+// setMode sets the sync mode of the group, the full mode removes it
+func (p *groupSyncPolicies) setMode(ctx context.Context, groupPK []byte, mode protocoltypes.GroupSyncMode) error {
+	key := dsKeyForSyncPolicy(groupPK)
+
+	switch mode {
+	case protocoltypes.GroupSyncMode_GroupSyncModeFull:
+		if err := p.datastore.Delete(ctx, key); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+	case protocoltypes.GroupSyncMode_GroupSyncModeMetadataOnly:
+		if err := p.datastore.Put(ctx, key, []byte{byte(mode)}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+	default:
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown sync mode %d", mode))
+	}
+
+	return nil
+}
+
+// applyGroupSyncPolicy defers the replication of the message store of the
+// group if it is in metadata-only mode, it is called before the group is
+// opened and each time its policy changes
+func (s *service) applyGroupSyncPolicy(ctx context.Context, g *protocoltypes.Group) error {
+	mode, err := s.syncPolicies.getMode(ctx, g.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	topics, err := s.odb.groupStoreTopics(ctx, g)
+	if err != nil {
+		return err
+	}
+
+	// the metadata log is always replicated, the members and their keys are
+	// needed to send and to open the messages
+	messageTopic := topics[1]
+	s.odb.messageMarshaler.setDeferredTopic(messageTopic, mode == protocoltypes.GroupSyncMode_GroupSyncModeMetadataOnly)
+
+	return nil
+}
+
+// fetchMessageHistory replicates the message entries announced by the peers
+// of the group and missing from its log, it returns the number of entries
+// added to the log
+func (s *service) fetchMessageHistory(ctx context.Context, gc *GroupContext) (uint64, error) {
+	store := gc.MessageStore()
+	before := store.OpLog().GetEntries().Len()
+
+	heads := []cid.Cid{}
+	for _, head := range s.odb.syncState.pendingHeads(store.Address().String()) {
+		if _, ok := store.OpLog().Get(head); !ok {
+			heads = append(heads, head)
+		}
+	}
+
+	if len(heads) == 0 {
+		return 0, nil
+	}
+
+	s.logger.Debug("fetching message history", logutil.PrivateBinary("group", gc.Group().PublicKey), zap.Int("heads", len(heads)))
+
+	if err := s.odb.loadHeads(ctx, store, heads); err != nil {
+		return 0, errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+	}
+
+	fetched := store.OpLog().GetEntries().Len() - before
+	if fetched < 0 {
+		fetched = 0
+	}
+
+	return uint64(fetched), nil
+}
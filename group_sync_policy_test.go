@@ -0,0 +1,67 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestGroupSyncPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	topics, err := s.odb.groupStoreTopics(ctx, g)
+	require.NoError(t, err)
+
+	isDeferred := func(topic string) bool {
+		s.odb.messageMarshaler.muMarshall.RLock()
+		defer s.odb.messageMarshaler.muMarshall.RUnlock()
+
+		_, ok := s.odb.messageMarshaler.deferredTopics[topic]
+		return ok
+	}
+
+	policy, err := s.GroupSyncPolicyGet(ctx, &protocoltypes.GroupSyncPolicyGet_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.GroupSyncMode_GroupSyncModeFull, policy.Mode)
+
+	_, err = s.GroupSyncPolicySet(ctx, &protocoltypes.GroupSyncPolicySet_Request{GroupPk: g.PublicKey, Mode: protocoltypes.GroupSyncMode_GroupSyncModeMetadataOnly})
+	require.NoError(t, err)
+
+	policy, err = s.GroupSyncPolicyGet(ctx, &protocoltypes.GroupSyncPolicyGet_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.GroupSyncMode_GroupSyncModeMetadataOnly, policy.Mode)
+
+	// only the message store is deferred
+	require.False(t, isDeferred(topics[0]))
+	require.True(t, isDeferred(topics[1]))
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	// nothing has been announced by the peers
+	fetched, err := s.GroupMessageHistoryFetch(ctx, &protocoltypes.GroupMessageHistoryFetch_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+	require.Zero(t, fetched.FetchedEntryCount)
+
+	_, err = s.GroupSyncPolicySet(ctx, &protocoltypes.GroupSyncPolicySet_Request{GroupPk: g.PublicKey, Mode: protocoltypes.GroupSyncMode_GroupSyncModeFull})
+	require.NoError(t, err)
+	require.False(t, isDeferred(topics[1]))
+
+	_, err = s.GroupSyncPolicySet(ctx, &protocoltypes.GroupSyncPolicySet_Request{GroupPk: g.PublicKey, Mode: protocoltypes.GroupSyncMode(42)})
+	require.Error(t, err)
+}
@@ -0,0 +1,284 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"berty.tech/go-ipfs-log/entry"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// maxRemoteHeadsPerStore is the maximum number of heads kept for a store
+	// and of peers whose exchanges are kept, the oldest are forgotten first
+	maxRemoteHeadsPerStore = 64
+
+	// remoteHeadTTL is the duration after which a head announced by a peer
+	// and not replicated is forgotten, the peers announce their heads again
+	// while they are connected
+	remoteHeadTTL = 10 * time.Minute
+)
+
+// storeSyncState keeps the heads of the stores announced by the peers, they
+// are compared to the local heads to report the progress of the replication
+type storeSyncState struct {
+	// heads are the remote heads of each store, indexed by the address of
+	// the store then by CID, they are forgotten once replicated or expired
+	heads map[string]map[string]remoteHead
+
+	// exchanges are the versions of the state at which each peer has last
+	// sent the heads of a store, indexed by the address of the store
+	exchanges map[string]map[peer.ID]uint64
+
+	// version is incremented on each change of the remote heads or of the
+	// local logs
+	version uint64
+	notify  *notify.Notify
+	mu      sync.Mutex
+}
+
+// remoteHead is a head announced by a peer, with the device which
+// announced it, nil for a replication server, and the time it was announced
+type remoteHead struct {
+	id       cid.Cid
+	devicePK []byte
+	seenAt   time.Time
+}
+
+func newStoreSyncState() *storeSyncState {
+	s := &storeSyncState{
+		heads:     map[string]map[string]remoteHead{},
+		exchanges: map[string]map[peer.ID]uint64{},
+	}
+	s.notify = notify.New(&s.mu)
+
+	return s
+}
+
+// addRemoteHeads records the heads of a store announced by a device, or by
+// a replication server if devicePK is nil, once the box holding them has been
+// opened and its sender identified
+func (s *storeSyncState) addRemoteHeads(address string, devicePK []byte, heads []*entry.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	storeHeads, ok := s.heads[address]
+	if !ok {
+		storeHeads = map[string]remoteHead{}
+		s.heads[address] = storeHeads
+	}
+
+	now := time.Now()
+	for _, head := range heads {
+		if head == nil || !head.Hash.Defined() {
+			continue
+		}
+
+		storeHeads[head.Hash.KeyString()] = remoteHead{id: head.Hash, devicePK: devicePK, seenAt: now}
+	}
+
+	s.unsafeExpireHeads(address, now)
+	s.unsafeChanged()
+}
+
+// unsafeExpireHeads forgets the expired heads of the store and the oldest
+// ones above maxRemoteHeadsPerStore, s.mu must be locked
+func (s *storeSyncState) unsafeExpireHeads(address string, now time.Time) {
+	storeHeads := s.heads[address]
+	for key, head := range storeHeads {
+		if now.Sub(head.seenAt) > remoteHeadTTL {
+			delete(storeHeads, key)
+		}
+	}
+
+	if len(storeHeads) <= maxRemoteHeadsPerStore {
+		return
+	}
+
+	keys := make([]string, 0, len(storeHeads))
+	for key := range storeHeads {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return storeHeads[keys[i]].seenAt.Before(storeHeads[keys[j]].seenAt)
+	})
+
+	for _, key := range keys[:len(keys)-maxRemoteHeadsPerStore] {
+		delete(storeHeads, key)
+	}
+}
+
+// addHeadsExchange records that a peer has sent the heads of a store
+func (s *storeSyncState) addHeadsExchange(address string, pid peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peers, ok := s.exchanges[address]
+	if !ok {
+		peers = map[peer.ID]uint64{}
+		s.exchanges[address] = peers
+	}
+
+	s.unsafeChanged()
+	peers[pid] = s.version
+
+	// the peer with the oldest exchange is forgotten
+	if len(peers) > maxRemoteHeadsPerStore {
+		var oldest peer.ID
+		for p, version := range peers {
+			if oldest == "" || version < peers[oldest] {
+				oldest = p
+			}
+		}
+
+		delete(peers, oldest)
+	}
+}
+
+// hasExchangedHeads returns true if the peer has sent the heads of the store
+// since the given version of the state
+func (s *storeSyncState) hasExchangedHeads(address string, pid peer.ID, since uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version, ok := s.exchanges[address][pid]
+	return ok && version > since
+}
+
+// changed notifies the watchers that a local log has changed
+func (s *storeSyncState) changed() {
+	s.mu.Lock()
+	s.unsafeChanged()
+	s.mu.Unlock()
+}
+
+func (s *storeSyncState) unsafeChanged() {
+	s.version++
+	s.notify.Broadcast()
+}
+
+// getVersion returns the current version of the state, to be given to
+// waitForChange
+func (s *storeSyncState) getVersion() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.version
+}
+
+// waitForChange blocks until the state changes from the given version or
+// ctx is done
+func (s *storeSyncState) waitForChange(ctx context.Context, version uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.version == version {
+		if !s.notify.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// pendingHeads returns the heads announced by the peers for the store
+func (s *storeSyncState) pendingHeads(address string) []cid.Cid {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unsafeExpireHeads(address, time.Now())
+
+	heads := make([]cid.Cid, 0, len(s.heads[address]))
+	for _, head := range s.heads[address] {
+		heads = append(heads, head.id)
+	}
+
+	return heads
+}
+
+// hasRemoteHead returns true if a peer has announced the head for the store
+// and it hasn't been forgotten since
+func (s *storeSyncState) hasRemoteHead(address string, head cid.Cid) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.heads[address][head.KeyString()]
+	return ok
+}
+
+// storeState compares the local log of the store with the heads announced
+// by the peers, the remote heads available locally are forgotten as well as
+// the heads announced by a device which isn't a device of the group.
+// Only the missing heads are counted, the entries they depend on can't be
+// known before they are fetched.
+func (s *storeSyncState) storeState(store orbitdb.Store, isGroupDevice func(devicePK []byte) bool) *protocoltypes.GroupSyncState_Store {
+	log := store.OpLog()
+	state := &protocoltypes.GroupSyncState_Store{
+		LocalEntryCount: uint64(log.GetEntries().Len()),
+	}
+
+	for _, head := range log.RawHeads().Slice() {
+		state.LocalHeadCids = append(state.LocalHeadCids, head.GetHash().Bytes())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	address := store.Address().String()
+	s.unsafeExpireHeads(address, time.Now())
+
+	for key, head := range s.heads[address] {
+		if _, ok := log.Get(head.id); ok || (head.devicePK != nil && !isGroupDevice(head.devicePK)) {
+			delete(s.heads[address], key)
+			continue
+		}
+
+		state.RemoteHeadCids = append(state.RemoteHeadCids, head.id.Bytes())
+	}
+
+	sort.Slice(state.RemoteHeadCids, func(i, j int) bool {
+		return bytes.Compare(state.RemoteHeadCids[i], state.RemoteHeadCids[j]) < 0
+	})
+
+	state.MissingEntryCount = uint64(len(state.RemoteHeadCids))
+
+	return state
+}
+
+// groupState returns the replication state of the logs of the group
+func (s *storeSyncState) groupState(gc *GroupContext) *protocoltypes.GroupSyncState {
+	isGroupDevice := func(devicePK []byte) bool {
+		pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+		if err != nil {
+			return false
+		}
+
+		_, err = gc.MetadataStore().GetMemberByDevice(pk)
+		return err == nil
+	}
+
+	state := &protocoltypes.GroupSyncState{
+		GroupPk:  gc.Group().GetPublicKey(),
+		Metadata: s.storeState(gc.MetadataStore(), isGroupDevice),
+		Messages: s.storeState(gc.MessageStore(), isGroupDevice),
+	}
+
+	local := state.Metadata.LocalEntryCount + state.Messages.LocalEntryCount
+	missing := state.Metadata.MissingEntryCount + state.Messages.MissingEntryCount
+
+	state.Synced = missing == 0
+	state.Completion = 1
+	if missing > 0 {
+		state.Completion = float32(local) / float32(local+missing)
+	}
+
+	return state
+}
@@ -0,0 +1,147 @@
+package weshnet
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestStoreSyncStateWaitForChange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ids := testLogCompactionCIDs(t)
+	syncState := newStoreSyncState()
+	version := syncState.getVersion()
+
+	done := make(chan struct{})
+	go func() {
+		syncState.waitForChange(ctx, version)
+		close(done)
+	}()
+
+	syncState.addRemoteHeads("/orbitdb/store", nil, []*entry.Entry{{Hash: ids[0]}, nil})
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		require.FailNow(t, "the change has not been notified")
+	}
+
+	require.NotEqual(t, version, syncState.getVersion())
+	require.Len(t, syncState.heads["/orbitdb/store"], 1)
+
+	// waiting returns once the context is done
+	waitCtx, waitCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer waitCancel()
+
+	syncState.waitForChange(waitCtx, syncState.getVersion())
+	require.Error(t, waitCtx.Err())
+}
+
+func TestStoreSyncStateHeadsExchange(t *testing.T) {
+	syncState := newStoreSyncState()
+	pid := peer.ID("peer")
+
+	syncState.addHeadsExchange("/orbitdb/store", pid)
+	version := syncState.getVersion()
+
+	require.True(t, syncState.hasExchangedHeads("/orbitdb/store", pid, version-1))
+	require.False(t, syncState.hasExchangedHeads("/orbitdb/store", pid, version))
+	require.False(t, syncState.hasExchangedHeads("/orbitdb/other", pid, 0))
+
+	// a new exchange is seen since the previous version
+	syncState.addHeadsExchange("/orbitdb/store", pid)
+	require.True(t, syncState.hasExchangedHeads("/orbitdb/store", pid, version))
+}
+
+func TestGroupSyncState(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	gc, err := s.GetContextGroupForID(g.PublicKey)
+	require.NoError(t, err)
+
+	_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPk: g.PublicKey, Payload: []byte("message")})
+	require.NoError(t, err)
+
+	state := s.odb.syncState.groupState(gc)
+	require.Equal(t, g.PublicKey, state.GroupPk)
+	require.True(t, state.Synced)
+	require.Equal(t, float32(1), state.Completion)
+	require.Equal(t, uint64(1), state.Messages.LocalEntryCount)
+	require.Len(t, state.Messages.LocalHeadCids, 1)
+
+	// a head announced by a device of the group and not replicated yet is
+	// missing, the heads announced by the other devices are ignored
+	ids := testLogCompactionCIDs(t)
+	devicePK, err := gc.DevicePubKey().Raw()
+	require.NoError(t, err)
+
+	_, otherPK, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	otherDevicePK, err := otherPK.Raw()
+	require.NoError(t, err)
+
+	s.odb.syncState.addRemoteHeads(gc.MessageStore().Address().String(), devicePK, []*entry.Entry{{Hash: ids[0]}})
+	s.odb.syncState.addRemoteHeads(gc.MessageStore().Address().String(), otherDevicePK, []*entry.Entry{{Hash: ids[1]}})
+
+	state = s.odb.syncState.groupState(gc)
+	require.False(t, state.Synced)
+	require.Equal(t, uint64(1), state.Messages.MissingEntryCount)
+	require.Equal(t, [][]byte{ids[0].Bytes()}, state.Messages.RemoteHeadCids)
+	require.Less(t, state.Completion, float32(1))
+}
+
+func TestStoreSyncStateExpireHeads(t *testing.T) {
+	syncState := newStoreSyncState()
+	address := "/orbitdb/store"
+
+	ids := make([]cid.Cid, maxRemoteHeadsPerStore+1)
+	for i := range ids {
+		id, err := cid.V0Builder{}.Sum([]byte{byte(i)})
+		require.NoError(t, err)
+
+		ids[i] = id
+		syncState.addRemoteHeads(address, nil, []*entry.Entry{{Hash: id}})
+	}
+
+	// the oldest head is forgotten above the limit
+	require.Len(t, syncState.pendingHeads(address), maxRemoteHeadsPerStore)
+	require.False(t, syncState.hasRemoteHead(address, ids[0]))
+	require.True(t, syncState.hasRemoteHead(address, ids[1]))
+
+	// the heads which aren't announced again expire
+	syncState.mu.Lock()
+	for key, head := range syncState.heads[address] {
+		head.seenAt = head.seenAt.Add(-remoteHeadTTL - time.Second)
+		syncState.heads[address][key] = head
+	}
+	syncState.mu.Unlock()
+
+	syncState.addRemoteHeads(address, nil, []*entry.Entry{{Hash: ids[1]}})
+	require.Equal(t, []cid.Cid{ids[1]}, syncState.pendingHeads(address))
+}
@@ -77,6 +77,46 @@ func TestValidHandshake(t *testing.T) {
 	runHandshakeTest(t, requesterTest, responderTest)
 }
 
+func TestRejectedRequester(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Slow)
+
+	var requesterTest requesterTestFunc = func(
+		t *testing.T,
+		stream p2pnetwork.Stream,
+		mh *mockedHandshake,
+	) {
+		defer ipfsutil.FullClose(stream)
+
+		err := Request(
+			stream,
+			mh.requester.accountID,
+			mh.responder.accountID.GetPublic(),
+		)
+		require.Error(t, err, "handshake request should fail")
+	}
+
+	var responderTest responderTestFunc = func(
+		t *testing.T,
+		stream p2pnetwork.Stream,
+		mh *mockedHandshake,
+		wg *sync.WaitGroup,
+	) {
+		defer wg.Done()
+		defer ipfsutil.FullClose(stream)
+
+		reader := protoio.NewDelimitedReader(stream, 2048)
+		writer := protoio.NewDelimitedWriter(stream)
+
+		_, err := ResponseUsingReaderWriterWithCheck(context.TODO(), zap.NewNop(), reader, writer, mh.responder.accountID, func(requester p2pcrypto.PubKey) error {
+			require.True(t, requester.Equals(mh.requester.accountID.GetPublic()))
+			return errcode.ErrCode_ErrContactRequestContactBlocked
+		})
+		require.Equal(t, []errcode.ErrCode{errcode.ErrCode_ErrHandshakeRequesterAuthenticate, errcode.ErrCode_ErrContactRequestContactBlocked}, errcode.Codes(err))
+	}
+
+	runHandshakeTest(t, requesterTest, responderTest)
+}
+
 func TestInvalidRequesterHello(t *testing.T) {
 	testutil.FilterSpeed(t, testutil.Slow)
 
@@ -17,6 +17,14 @@ import (
 
 // ResponseUsingReaderWriter handle the handshake inited by the requester, using provided io reader and writer
 func ResponseUsingReaderWriter(ctx context.Context, logger *zap.Logger, reader protoio.Reader, writer protoio.Writer, ownAccountID p2pcrypto.PrivKey) (p2pcrypto.PubKey, error) {
+	return ResponseUsingReaderWriterWithCheck(ctx, logger, reader, writer, ownAccountID, nil)
+}
+
+// ResponseUsingReaderWriterWithCheck handle the handshake inited by the
+// requester like ResponseUsingReaderWriter, checkRequester is called once the
+// requester is authenticated and can abort the handshake before the responder
+// reveals its own identity
+func ResponseUsingReaderWriterWithCheck(ctx context.Context, logger *zap.Logger, reader protoio.Reader, writer protoio.Writer, ownAccountID p2pcrypto.PrivKey, checkRequester func(p2pcrypto.PubKey) error) (p2pcrypto.PubKey, error) {
 	hc := &handshakeContext{
 		reader:          reader,
 		writer:          writer,
@@ -37,6 +45,11 @@ func ResponseUsingReaderWriter(ctx context.Context, logger *zap.Logger, reader p
 		return nil, errcode.ErrCode_ErrHandshakeRequesterAuthenticate.Wrap(err)
 	}
 	tyber.LogStep(ctx, logger, "Received authenticate", hc.toTyberStepMutator(), tyber.ForceReopen)
+	if checkRequester != nil {
+		if err := checkRequester(hc.peerAccountID); err != nil {
+			return nil, errcode.ErrCode_ErrHandshakeRequesterAuthenticate.Wrap(err)
+		}
+	}
 	if err := hc.sendResponderAccept(); err != nil {
 		return nil, errcode.ErrCode_ErrHandshakeResponderAccept.Wrap(err)
 	}
@@ -0,0 +1,625 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	coreiface "github.com/ipfs/kubo/core/coreiface"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	orbitdb "berty.tech/go-orbit-db"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// logCompactionInterval is the delay between two runs of the log compaction
+// janitor
+const logCompactionInterval = time.Hour
+
+const (
+	// dsNamespaceLogCheckpoints stores the checkpoint of each compacted log
+	dsNamespaceLogCheckpoints = "checkpoints"
+
+	// dsNamespaceLogCompacted stores the CIDs of the entries removed from
+	// each log
+	dsNamespaceLogCompacted = "compacted"
+)
+
+// logCompaction keeps track of the entries removed from the logs of the
+// stores. The logs are rewritten into a checkpoint, summarizing the removed
+// entries, and a tail of entries kept as is. The entries of the tail still
+// reference the removed ones by their CIDs, so their signatures and their
+// links can be verified, but the removed entries are neither loaded nor
+// fetched from the peers anymore.
+type logCompaction struct {
+	datastore datastore.Datastore
+
+	// compacted are the CIDs of the entries removed from each log, indexed by
+	// the address of its store, they are read from the datastore when the
+	// log is first used
+	compacted map[string]map[string]struct{}
+	mu        sync.RWMutex
+
+	// running serializes the compactions, a log is compacted by the janitor
+	// and when its disappearing messages expire
+	running sync.Mutex
+}
+
+func newLogCompaction(ds datastore.Datastore) *logCompaction {
+	return &logCompaction{
+		datastore: ds,
+		compacted: map[string]map[string]struct{}{},
+	}
+}
+
+func dsKeyForLogCompaction(namespace string, address string, parts ...string) datastore.Key {
+	return datastore.KeyWithNamespaces(append([]string{
+		namespace,
+		base64.RawURLEncoding.EncodeToString([]byte(address)),
+	}, parts...))
+}
+
+// checkpoint returns the checkpoint of the log of the store, an empty
+// checkpoint if the log has never been compacted
+func (c *logCompaction) checkpoint(ctx context.Context, address string) (*protocoltypes.LogCheckpoint, error) {
+	data, err := c.datastore.Get(ctx, dsKeyForLogCompaction(dsNamespaceLogCheckpoints, address))
+	if err == datastore.ErrNotFound {
+		return &protocoltypes.LogCheckpoint{}, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	checkpoint := &protocoltypes.LogCheckpoint{}
+	if err := proto.Unmarshal(data, checkpoint); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return checkpoint, nil
+}
+
+// compactedEntries returns the CIDs of the entries removed from the log of
+// the store
+func (c *logCompaction) compactedEntries(ctx context.Context, address string) (map[string]struct{}, error) {
+	c.mu.RLock()
+	compacted, ok := c.compacted[address]
+	c.mu.RUnlock()
+
+	if ok {
+		return compacted, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if compacted, ok := c.compacted[address]; ok {
+		return compacted, nil
+	}
+
+	prefix := dsKeyForLogCompaction(dsNamespaceLogCompacted, address)
+
+	results, err := c.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	compacted = map[string]struct{}{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		id, err := cid.Decode(datastore.RawKey(result.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		compacted[id.KeyString()] = struct{}{}
+	}
+
+	c.compacted[address] = compacted
+
+	return compacted, nil
+}
+
+// isCompacted returns true if the entry has been removed from the log of the
+// store
+func (c *logCompaction) isCompacted(ctx context.Context, address string, id cid.Cid) bool {
+	compacted, err := c.compactedEntries(ctx, address)
+	if err != nil {
+		return false
+	}
+
+	c.mu.RLock()
+	_, ok := compacted[id.KeyString()]
+	c.mu.RUnlock()
+
+	return ok
+}
+
+// record marks the entries as removed from the log of the store and replaces
+// its checkpoint
+func (c *logCompaction) record(ctx context.Context, address string, ids []cid.Cid, checkpoint *protocoltypes.LogCheckpoint) error {
+	compacted, err := c.compactedEntries(ctx, address)
+	if err != nil {
+		return err
+	}
+
+	data, err := proto.Marshal(checkpoint)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	for _, id := range ids {
+		if err := c.datastore.Put(ctx, dsKeyForLogCompaction(dsNamespaceLogCompacted, address, id.String()), []byte{}); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		c.mu.Lock()
+		compacted[id.KeyString()] = struct{}{}
+		c.mu.Unlock()
+	}
+
+	if err := c.datastore.Put(ctx, dsKeyForLogCompaction(dsNamespaceLogCheckpoints, address), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// reset forgets the compaction of the log of the store, used once its
+// entries have been deleted
+func (c *logCompaction) reset(ctx context.Context, address string) error {
+	prefix := dsKeyForLogCompaction(dsNamespaceLogCompacted, address)
+
+	results, err := c.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := c.datastore.Delete(ctx, datastore.RawKey(entry.Key)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := c.datastore.Delete(ctx, dsKeyForLogCompaction(dsNamespaceLogCheckpoints, address)); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	c.mu.Lock()
+	delete(c.compacted, address)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// wrapCoreAPI returns an API on which the entries removed from the log of the
+// store are not found, so loading or replicating the log stops at its
+// checkpoint instead of fetching them from the network
+func (c *logCompaction) wrapCoreAPI(api coreiface.CoreAPI, address string) coreiface.CoreAPI {
+	return &compactedCoreAPI{
+		CoreAPI: api,
+		dag: &compactedDagService{
+			APIDagService: api.Dag(),
+			isCompacted: func(id cid.Cid) bool {
+				return c.isCompacted(context.Background(), address, id)
+			},
+		},
+	}
+}
+
+type compactedCoreAPI struct {
+	coreiface.CoreAPI
+	dag coreiface.APIDagService
+}
+
+func (a *compactedCoreAPI) Dag() coreiface.APIDagService {
+	return a.dag
+}
+
+type compactedDagService struct {
+	coreiface.APIDagService
+	isCompacted func(id cid.Cid) bool
+}
+
+func (d *compactedDagService) Get(ctx context.Context, id cid.Cid) (ipld.Node, error) {
+	if d.isCompacted(id) {
+		return nil, ipld.ErrNotFound{Cid: id}
+	}
+
+	return d.APIDagService.Get(ctx, id)
+}
+
+func (d *compactedDagService) GetMany(ctx context.Context, ids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(ids))
+
+	kept := make([]cid.Cid, 0, len(ids))
+	for _, id := range ids {
+		if d.isCompacted(id) {
+			out <- &ipld.NodeOption{Err: ipld.ErrNotFound{Cid: id}}
+		} else {
+			kept = append(kept, id)
+		}
+	}
+
+	if len(kept) == 0 {
+		close(out)
+		return out
+	}
+
+	go func() {
+		defer close(out)
+
+		for opt := range d.APIDagService.GetMany(ctx, kept) {
+			select {
+			case out <- opt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// compactableEntries returns the entries which can be removed from the log:
+// the superseded entries whose parents are all removed, so the removed
+// entries are never needed to load the others. The heads are always kept.
+// The entries are ordered from the oldest to the newest, the entries already
+// removed are skipped.
+func compactableEntries(entries []ipfslog.Entry, superseded func(ipfslog.Entry) bool, compacted func(cid.Cid) bool) []ipfslog.Entry {
+	referenced := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		for _, next := range e.GetNext() {
+			referenced[next.KeyString()] = struct{}{}
+		}
+	}
+
+	removed := map[string]struct{}{}
+	isRemoved := func(id cid.Cid) bool {
+		if _, ok := removed[id.KeyString()]; ok {
+			return true
+		}
+
+		return compacted(id)
+	}
+
+	var compactable []ipfslog.Entry
+
+	for _, e := range entries {
+		if compacted(e.GetHash()) {
+			continue
+		}
+
+		if _, ok := referenced[e.GetHash().KeyString()]; !ok || !superseded(e) {
+			continue
+		}
+
+		parentsRemoved := true
+		for _, next := range e.GetNext() {
+			if !isRemoved(next) {
+				parentsRemoved = false
+				break
+			}
+		}
+
+		if !parentsRemoved {
+			continue
+		}
+
+		removed[e.GetHash().KeyString()] = struct{}{}
+		compactable = append(compactable, e)
+	}
+
+	return compactable
+}
+
+// logAncestors returns the CIDs of the entries of the log preceding the given
+// entry
+func logAncestors(log ipfslog.Log, id cid.Cid) map[string]struct{} {
+	ancestors := map[string]struct{}{}
+
+	entry, ok := log.Get(id)
+	if !ok {
+		return ancestors
+	}
+
+	queue := entry.GetNext()
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+
+		if _, ok := ancestors[next.KeyString()]; ok {
+			continue
+		}
+
+		ancestors[next.KeyString()] = struct{}{}
+
+		if parent, ok := log.Get(next); ok {
+			queue = append(queue, parent.GetNext()...)
+		}
+	}
+
+	return ancestors
+}
+
+// isSummarizedMetadataEvent returns true if the state set by the event is
+// part of the snapshots of multi-member groups, the acknowledgements and the
+// reads are summarized once all their messages have been pruned
+func isSummarizedMetadataEvent(event proto.Message, isPruned func(cid.Cid) bool) bool {
+	var ids [][]byte
+
+	switch e := event.(type) {
+	case *protocoltypes.GroupMemberDeviceAdded,
+		*protocoltypes.GroupDeviceChainKeyAdded,
+		*protocoltypes.GroupDisappearingMessagesSet,
+		*protocoltypes.MultiMemberGroupInitialMemberAnnounced,
+		*protocoltypes.MultiMemberGroupAdminRoleGranted,
+		*protocoltypes.MultiMemberGroupMemberRemoved,
+		*protocoltypes.MultiMemberGroupMemberRoleSet,
+		*protocoltypes.MultiMemberGroupInvitationRevoked,
+		*protocoltypes.MultiMemberGroupSecretRotated,
+		*protocoltypes.MultiMemberGroupSnapshotAdded,
+		*protocoltypes.MultiMemberGroupBroadcastModeSet,
+		*protocoltypes.MultiMemberGroupMemberApproved,
+		*protocoltypes.MultiMemberGroupMemberBanned,
+		*protocoltypes.MultiMemberGroupPublicModeSet,
+		*protocoltypes.MultiMemberGroupOwnershipTransferred:
+		return true
+
+	case *protocoltypes.GroupMessagesAcknowledged:
+		ids = e.Cids
+
+	case *protocoltypes.GroupMessagesRead:
+		ids = e.Cids
+
+	default:
+		return false
+	}
+
+	for _, raw := range ids {
+		id, err := cid.Cast(raw)
+		if err != nil || !isPruned(id) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compactStore removes the superseded entries from the log of the store, the
+// sent secrets are recorded in the checkpoint of metadata logs. It returns
+// the number of entries removed and their size in bytes.
+func (s *service) compactStore(ctx context.Context, store orbitdb.Store, superseded func(ipfslog.Entry) bool, sentSecrets map[string]uint64) (uint64, uint64, error) {
+	compaction := s.odb.logCompaction
+	address := store.Address().String()
+
+	compaction.running.Lock()
+	defer compaction.running.Unlock()
+
+	isCompacted := func(id cid.Cid) bool {
+		return compaction.isCompacted(ctx, address, id)
+	}
+
+	entries := store.OpLog().GetEntries().Slice()
+
+	toCompact := compactableEntries(entries, superseded, isCompacted)
+	if len(toCompact) == 0 {
+		return 0, 0, nil
+	}
+
+	checkpoint, err := compaction.checkpoint(ctx, address)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := make(map[string]struct{}, len(toCompact))
+	ids := make([]cid.Cid, len(toCompact))
+	size := uint64(0)
+
+	for i, e := range toCompact {
+		dagNode, err := s.ipfsCoreAPI.Dag().Get(ctx, e.GetHash())
+		if err != nil {
+			return 0, 0, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		size += uint64(len(dagNode.RawData()))
+		removed[e.GetHash().KeyString()] = struct{}{}
+		ids[i] = e.GetHash()
+	}
+
+	// the frontier links the tail of the log to the checkpoint
+	frontier := map[string]struct{}{}
+	checkpoint.FrontierCids = nil
+
+	for _, e := range entries {
+		if _, ok := removed[e.GetHash().KeyString()]; ok || isCompacted(e.GetHash()) {
+			continue
+		}
+
+		for _, next := range e.GetNext() {
+			if _, ok := removed[next.KeyString()]; !ok && !isCompacted(next) {
+				continue
+			}
+
+			if _, ok := frontier[next.KeyString()]; !ok {
+				frontier[next.KeyString()] = struct{}{}
+				checkpoint.FrontierCids = append(checkpoint.FrontierCids, next.Bytes())
+			}
+		}
+	}
+
+	if sentSecrets == nil {
+		sentSecrets = map[string]uint64{}
+	}
+
+	for _, sent := range checkpoint.SentSecrets {
+		if epoch, ok := sentSecrets[string(sent.MemberPk)]; !ok || epoch < sent.Epoch {
+			sentSecrets[string(sent.MemberPk)] = sent.Epoch
+		}
+	}
+
+	checkpoint.SentSecrets = nil
+	for memberPK, epoch := range sentSecrets {
+		checkpoint.SentSecrets = append(checkpoint.SentSecrets, &protocoltypes.LogCheckpoint_SentSecret{
+			MemberPk: []byte(memberPK),
+			Epoch:    epoch,
+		})
+	}
+
+	checkpoint.CompactedCount += uint64(len(ids))
+	checkpoint.CompactedBytes += size
+	checkpoint.CompactedAt = time.Now().Unix()
+
+	// the entries are hidden from the log before their blocks are deleted,
+	// so an interrupted compaction never leaves the log referencing deleted
+	// blocks
+	if err := compaction.record(ctx, address, ids, checkpoint); err != nil {
+		return 0, 0, err
+	}
+
+	for _, id := range ids {
+		if err := s.ipfsCoreAPI.Dag().Remove(ctx, id); err != nil {
+			return 0, 0, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	return uint64(len(ids)), size, nil
+}
+
+// compactGroupLogs removes from the message log of the group the entries
+// pruned by its retention policy and, for multi-member groups, removes from
+// its metadata log the entries summarized by the latest snapshot. It returns
+// the number of entries removed and their size in bytes.
+func (s *service) compactGroupLogs(ctx context.Context, gc *GroupContext) (uint64, uint64, error) {
+	groupPK := gc.Group().GetPublicKey()
+
+	isPruned := func(id cid.Cid) bool {
+		return s.retention.isPruned(ctx, groupPK, id)
+	}
+
+	count, size, err := s.compactMessageLog(ctx, gc)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return count, size, nil
+	}
+
+	metadataStore := gc.MetadataStore()
+
+	snapshot := metadataStore.snapshotCheckpoint()
+	if !snapshot.Defined() {
+		return count, size, nil
+	}
+
+	log := metadataStore.OpLog()
+	summarized := logAncestors(log, snapshot)
+
+	metadataCount, metadataSize, err := s.compactStore(ctx, metadataStore, func(e ipfslog.Entry) bool {
+		if _, ok := summarized[e.GetHash().KeyString()]; !ok {
+			return false
+		}
+
+		_, event, err := openMetadataEntry(ctx, log, e, gc.Group(), gc.SecretStore())
+		if err != nil {
+			return false
+		}
+
+		return isSummarizedMetadataEvent(event, isPruned)
+	}, metadataStore.sentSecretEpochs())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count + metadataCount, size + metadataSize, nil
+}
+
+// compactMessageLog removes from the message log of the group the entries
+// pruned by its retention policy or its disappearing messages
+func (s *service) compactMessageLog(ctx context.Context, gc *GroupContext) (uint64, uint64, error) {
+	groupPK := gc.Group().GetPublicKey()
+
+	return s.compactStore(ctx, gc.MessageStore(), func(e ipfslog.Entry) bool {
+		return s.retention.isPruned(ctx, groupPK, e.GetHash())
+	}, nil)
+}
+
+// compactLogs compacts the logs of the activated groups, a group which can't
+// be compacted doesn't prevent the others from being compacted
+func (s *service) compactLogs(ctx context.Context) (uint64, uint64, error) {
+	s.lock.RLock()
+	groups := make([]*GroupContext, 0, len(s.openedGroups))
+	for _, gc := range s.openedGroups {
+		if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeAccount {
+			groups = append(groups, gc)
+		}
+	}
+	s.lock.RUnlock()
+
+	var count, size uint64
+
+	for _, gc := range groups {
+		if err := ctx.Err(); err != nil {
+			return count, size, err
+		}
+
+		if gc.IsClosed() {
+			continue
+		}
+
+		groupCount, groupSize, err := s.compactGroupLogs(ctx, gc)
+		if err != nil {
+			s.logger.Warn("unable to compact group logs", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+			continue
+		}
+
+		count += groupCount
+		size += groupSize
+	}
+
+	return count, size, nil
+}
+
+// startLogCompactionJanitor periodically compacts the logs of the opened
+// groups
+func (s *service) startLogCompactionJanitor() {
+	go func() {
+		ticker := time.NewTicker(logCompactionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				return
+			}
+
+			count, size, err := s.compactLogs(s.ctx)
+			if err != nil {
+				s.logger.Error("unable to compact logs", zap.Error(err))
+				continue
+			}
+
+			if count > 0 {
+				s.logger.Debug("compacted logs", zap.Uint64("entries", count), zap.Uint64("reclaimed", size))
+			}
+		}
+	}()
+}
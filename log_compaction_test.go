@@ -0,0 +1,219 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/stretchr/testify/require"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func testLogCompactionCIDs(t *testing.T) []cid.Cid {
+	t.Helper()
+
+	cids := make([]cid.Cid, 4)
+	for i := range cids {
+		id, err := cid.V0Builder{}.Sum([]byte{byte(i)})
+		require.NoError(t, err)
+
+		cids[i] = id
+	}
+
+	return cids
+}
+
+func TestCompactableEntries(t *testing.T) {
+	ids := testLogCompactionCIDs(t)
+
+	// a <- b <- c <- d, entries are ordered from the oldest to the newest
+	entries := []ipfslog.Entry{
+		&entry.Entry{Hash: ids[0]},
+		&entry.Entry{Hash: ids[1], Next: []cid.Cid{ids[0]}},
+		&entry.Entry{Hash: ids[2], Next: []cid.Cid{ids[1]}},
+		&entry.Entry{Hash: ids[3], Next: []cid.Cid{ids[2]}},
+	}
+
+	supersededSet := func(superseded ...cid.Cid) func(ipfslog.Entry) bool {
+		return func(e ipfslog.Entry) bool {
+			for _, id := range superseded {
+				if id.Equals(e.GetHash()) {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	notCompacted := func(cid.Cid) bool { return false }
+
+	// the head is kept even if it is superseded
+	compactable := compactableEntries(entries, supersededSet(ids...), notCompacted)
+	require.Equal(t, entries[:3], compactable)
+
+	// an entry is kept if one of its parents is kept
+	compactable = compactableEntries(entries, supersededSet(ids[0], ids[2]), notCompacted)
+	require.Equal(t, entries[:1], compactable)
+
+	compactable = compactableEntries(entries, supersededSet(ids[1], ids[2]), notCompacted)
+	require.Empty(t, compactable)
+
+	// the entries compacted previously are skipped and don't prevent their
+	// children from being compacted
+	compactable = compactableEntries(entries, supersededSet(ids[1]), func(id cid.Cid) bool { return id.Equals(ids[0]) })
+	require.Equal(t, entries[1:2], compactable)
+}
+
+func TestLogCompactionRecord(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	ids := testLogCompactionCIDs(t)
+	address := "/orbitdb/store"
+
+	compaction := newLogCompaction(datastore)
+
+	checkpoint, err := compaction.checkpoint(ctx, address)
+	require.NoError(t, err)
+	require.Zero(t, checkpoint.CompactedCount)
+	require.False(t, compaction.isCompacted(ctx, address, ids[0]))
+
+	require.NoError(t, compaction.record(ctx, address, ids[:2], &protocoltypes.LogCheckpoint{
+		FrontierCids:   [][]byte{ids[1].Bytes()},
+		CompactedCount: 2,
+	}))
+
+	require.True(t, compaction.isCompacted(ctx, address, ids[0]))
+	require.True(t, compaction.isCompacted(ctx, address, ids[1]))
+	require.False(t, compaction.isCompacted(ctx, address, ids[2]))
+
+	// other stores are not affected
+	require.False(t, compaction.isCompacted(ctx, "/orbitdb/other", ids[0]))
+
+	// the compacted entries are read from the datastore
+	compaction = newLogCompaction(datastore)
+	require.True(t, compaction.isCompacted(ctx, address, ids[1]))
+
+	checkpoint, err = compaction.checkpoint(ctx, address)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), checkpoint.CompactedCount)
+	require.Equal(t, [][]byte{ids[1].Bytes()}, checkpoint.FrontierCids)
+
+	require.NoError(t, compaction.reset(ctx, address))
+	require.False(t, compaction.isCompacted(ctx, address, ids[1]))
+
+	checkpoint, err = compaction.checkpoint(ctx, address)
+	require.NoError(t, err)
+	require.Zero(t, checkpoint.CompactedCount)
+}
+
+func TestCompactedDagService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ids := testLogCompactionCIDs(t)
+
+	// the compacted entries are never requested to the underlying service
+	dag := &compactedDagService{isCompacted: func(cid.Cid) bool { return true }}
+
+	_, err := dag.Get(ctx, ids[0])
+	require.True(t, ipld.IsNotFound(err))
+
+	count := 0
+	for opt := range dag.GetMany(ctx, ids) {
+		require.True(t, ipld.IsNotFound(opt.Err))
+		count++
+	}
+	require.Equal(t, len(ids), count)
+}
+
+func TestIsSummarizedMetadataEvent(t *testing.T) {
+	ids := testLogCompactionCIDs(t)
+	isPruned := func(id cid.Cid) bool { return !id.Equals(ids[1]) }
+
+	require.True(t, isSummarizedMetadataEvent(&protocoltypes.GroupMemberDeviceAdded{}, isPruned))
+	require.True(t, isSummarizedMetadataEvent(&protocoltypes.MultiMemberGroupSnapshotAdded{}, isPruned))
+	require.False(t, isSummarizedMetadataEvent(&protocoltypes.GroupMetadataPayloadSent{}, isPruned))
+	require.False(t, isSummarizedMetadataEvent(&protocoltypes.GroupDeviceKeyRotated{}, isPruned))
+
+	// acknowledgements are summarized once all their messages are pruned
+	require.True(t, isSummarizedMetadataEvent(&protocoltypes.GroupMessagesAcknowledged{Cids: [][]byte{ids[0].Bytes(), ids[2].Bytes()}}, isPruned))
+	require.False(t, isSummarizedMetadataEvent(&protocoltypes.GroupMessagesRead{Cids: [][]byte{ids[0].Bytes(), ids[1].Bytes()}}, isPruned))
+}
+
+func TestCompactGroupLogs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	for _, payload := range []string{"first", "second", "third"} {
+		_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPk: g.PublicKey, Payload: []byte(payload)})
+		require.NoError(t, err)
+	}
+
+	gc, err := s.GetContextGroupForID(g.PublicKey)
+	require.NoError(t, err)
+
+	// nothing is superseded before the retention policy applies
+	count, _, err := s.compactGroupLogs(ctx, gc)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	require.NoError(t, s.retention.setPolicy(ctx, g.PublicKey, &protocoltypes.MessageRetentionPolicy{MaxCount: 1}))
+	evicted, err := s.retention.enforce(ctx, gc, time.Now())
+	require.NoError(t, err)
+	require.Len(t, evicted.MessageIds, 2)
+
+	count, reclaimed, err := s.compactGroupLogs(ctx, gc)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), count)
+	require.NotZero(t, reclaimed)
+
+	address := gc.MessageStore().Address().String()
+	for _, id := range evicted.MessageIds {
+		c, err := cid.Cast(id)
+		require.NoError(t, err)
+		require.True(t, s.odb.logCompaction.isCompacted(ctx, address, c))
+	}
+
+	checkpoint, err := s.odb.logCompaction.checkpoint(ctx, address)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), checkpoint.CompactedCount)
+	require.Len(t, checkpoint.FrontierCids, 1)
+
+	// the compacted entries are not listed nor reported as missing
+	ids, err := storeEntryCIDs(ctx, gc.MessageStore(), s.odb.logCompaction)
+	require.NoError(t, err)
+	require.Len(t, ids, 1)
+
+	report, err := s.GroupVerifyIntegrity(ctx, &protocoltypes.GroupVerifyIntegrity_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+	require.Empty(t, report.MissingMessages)
+
+	// compacting again is a no-op
+	count, _, err = s.compactGroupLogs(ctx, gc)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
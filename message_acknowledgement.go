@@ -0,0 +1,98 @@
+package weshnet
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// messageAckDelay is the delay without new messages after which the
+	// received messages are acknowledged with a single event
+	messageAckDelay = 5 * time.Second
+
+	// messageAckMaxDelay is the maximum delay before acknowledging the
+	// received messages while new ones keep arriving
+	messageAckMaxDelay = time.Minute
+
+	// messageAckMaxBatch is the maximum number of messages acknowledged by a
+	// single event
+	messageAckMaxBatch = 100
+)
+
+// acknowledgeMessages acknowledges the messages received from the other
+// devices of the group until the group is closed, the acknowledgements are
+// delayed while messages keep arriving so a conversation only writes a few
+// events
+func (s *service) acknowledgeMessages(gc *GroupContext) {
+	sub, err := gc.MessageStore().EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent), eventbus.Name("weshnet/message-ack"), eventbus.BufSize(messageAckMaxBatch))
+	if err != nil {
+		s.logger.Warn("unable to subscribe to group messages", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+		return
+	}
+
+	devicePK := gc.MetadataStore().devicePublicKeyRaw
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+		defer sub.Close()
+
+		var (
+			pending   = [][]byte{}
+			pendingAt time.Time
+			deadline  <-chan time.Time
+		)
+
+		flush := func() {
+			deadline = nil
+			if len(pending) == 0 {
+				return
+			}
+
+			if _, err := gc.MetadataStore().AcknowledgeMessages(gc.ctx, pending); err != nil {
+				s.logger.Warn("unable to acknowledge messages", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+			}
+
+			pending = [][]byte{}
+		}
+
+		for {
+			select {
+			case <-gc.ctx.Done():
+				return
+
+			case <-deadline:
+				flush()
+
+			case evt := <-sub.Out():
+				e, ok := evt.(*protocoltypes.GroupMessageEvent)
+				if !ok || bytes.Equal(e.GetHeaders().GetDevicePk(), devicePK) {
+					continue
+				}
+
+				if len(pending) == 0 {
+					pendingAt = time.Now()
+				}
+
+				pending = append(pending, e.GetEventContext().GetId())
+				if len(pending) >= messageAckMaxBatch {
+					flush()
+					continue
+				}
+
+				delay := messageAckDelay
+				if remaining := messageAckMaxDelay - time.Since(pendingAt); remaining < delay {
+					delay = remaining
+				}
+
+				deadline = time.After(delay)
+			}
+		}
+	}()
+}
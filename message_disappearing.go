@@ -0,0 +1,196 @@
+package weshnet
+
+import (
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// disappearingMessagesResolution is the maximum delay between the expiration
+// of a disappearing message and the deletion of its key
+const disappearingMessagesResolution = time.Second
+
+// enforceDisappearingMessages deletes the keys of the messages of the group
+// once the delay set by its members, or the expiry of the message, has
+// elapsed since their reception, until the group is closed. The messages
+// received before the delay has been set are kept. The expired
+// entries are then compacted out of the log and their blocks are deleted, the
+// entries still at the head of the log are kept until a newer entry links
+// them, they can't be decrypted anymore and are not listed, or listed as
+// expired for the messages sent with an expiry.
+func (s *service) enforceDisappearingMessages(gc *GroupContext) {
+	msgSub, err := gc.MessageStore().EventBus().Subscribe(new(*protocoltypes.GroupMessageEvent), eventbus.Name("weshnet/disappearing-messages"), eventbus.BufSize(32))
+	if err != nil {
+		s.logger.Warn("unable to subscribe to group messages", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+		return
+	}
+
+	metaSub, err := gc.MetadataStore().EventBus().Subscribe(new(*protocoltypes.GroupMetadataEvent), eventbus.Name("weshnet/disappearing-messages"), eventbus.BufSize(32))
+	if err != nil {
+		msgSub.Close()
+		s.logger.Warn("unable to subscribe to group metadata", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+		return
+	}
+
+	gc.tasks.Add(1)
+	go func() {
+		defer gc.tasks.Done()
+		defer msgSub.Close()
+		defer metaSub.Close()
+
+		ticker := time.NewTicker(disappearingMessagesResolution)
+		defer ticker.Stop()
+
+		expiring, since := s.listExpiringMessages(gc)
+		for {
+			select {
+			case <-gc.ctx.Done():
+				return
+
+			case evt := <-metaSub.Out():
+				if e, ok := evt.(*protocoltypes.GroupMetadataEvent); ok && e.GetMetadata().GetEventType() == protocoltypes.EventType_EventTypeGroupDisappearingMessagesSet {
+					expiring, since = s.listExpiringMessages(gc)
+				}
+
+			case evt := <-msgSub.Out():
+				e, ok := evt.(*protocoltypes.GroupMessageEvent)
+				if !ok || gc.MetadataStore().GetDisappearingMessages() == 0 {
+					continue
+				}
+
+				id, err := cid.Cast(e.GetEventContext().GetId())
+				if err != nil {
+					continue
+				}
+
+				seen, err := s.retention.firstSeen(gc.ctx, gc.Group().GetPublicKey(), id, time.Now())
+				if err != nil {
+					s.logger.Warn("unable to record message reception", zap.Error(err))
+					continue
+				}
+
+				if seen.Before(since) {
+					continue
+				}
+
+				expiring[id] = seen
+
+			case now := <-ticker.C:
+				s.deleteExpiredMessages(gc, expiring, now)
+				s.expireMessages(gc, now)
+			}
+		}
+	}()
+}
+
+// listExpiringMessages returns the messages of the group which haven't been
+// deleted yet with the time they have been received, none if the disappearing
+// messages are disabled. It also returns the time the current delay has been
+// applied on the device, the messages received before are left out so
+// setting a delay doesn't delete the existing history.
+func (s *service) listExpiringMessages(gc *GroupContext) (map[cid.Cid]time.Time, time.Time) {
+	expiring := map[cid.Cid]time.Time{}
+	if gc.MetadataStore().GetDisappearingMessages() == 0 {
+		return expiring, time.Time{}
+	}
+
+	groupPK := gc.Group().GetPublicKey()
+	now := time.Now()
+
+	// the entry setting the delay is seen for the first time when the delay
+	// is applied
+	var since time.Time
+	if entry := gc.MetadataStore().disappearingMessagesEntry(); entry.Defined() {
+		var err error
+		if since, err = s.retention.firstSeen(gc.ctx, groupPK, entry, now); err != nil {
+			s.logger.Warn("unable to record disappearing messages change", zap.Error(err))
+			since = now
+		}
+	}
+
+	for _, entry := range gc.MessageStore().OpLog().GetEntries().Slice() {
+		id := entry.GetHash()
+		if s.retention.isPruned(gc.ctx, groupPK, id) {
+			continue
+		}
+
+		seen, err := s.retention.firstSeen(gc.ctx, groupPK, id, now)
+		if err != nil {
+			s.logger.Warn("unable to record message reception", zap.Error(err))
+			continue
+		}
+
+		if seen.Before(since) {
+			continue
+		}
+
+		expiring[id] = seen
+	}
+
+	return expiring, since
+}
+
+// deleteExpiredMessages deletes the keys of the expired messages, removes
+// them from expiring and compacts them out of the message log
+func (s *service) deleteExpiredMessages(gc *GroupContext, expiring map[cid.Cid]time.Time, now time.Time) {
+	duration := gc.MetadataStore().GetDisappearingMessages()
+	if duration == 0 || len(expiring) == 0 {
+		return
+	}
+
+	evicted := &protocoltypes.GroupMessagesEvicted{}
+	for id, seen := range expiring {
+		if now.Sub(seen) < duration {
+			continue
+		}
+
+		entry, ok := gc.MessageStore().OpLog().Get(id)
+		if !ok {
+			delete(expiring, id)
+			continue
+		}
+
+		if err := s.retention.prune(gc.ctx, gc, entry); err != nil {
+			s.logger.Warn("unable to delete expired message", logutil.PrivateString("cid", id.String()), zap.Error(err))
+			continue
+		}
+
+		delete(expiring, id)
+		evicted.MessageIds = append(evicted.MessageIds, id.Bytes())
+		evicted.EvictedBytes += uint64(len(entry.GetPayload()))
+	}
+
+	s.emitMessagesEvicted(gc, evicted)
+
+	if len(evicted.MessageIds) == 0 {
+		return
+	}
+
+	if _, _, err := s.compactMessageLog(gc.ctx, gc); err != nil {
+		s.logger.Warn("unable to compact expired messages", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+	}
+}
+
+// emitMessagesEvicted completes the summary of the deleted messages with the
+// size of the remaining ones and emits it, if any message has been deleted
+func (s *service) emitMessagesEvicted(gc *GroupContext, evicted *protocoltypes.GroupMessagesEvicted) {
+	if len(evicted.MessageIds) == 0 {
+		return
+	}
+
+	groupPK := gc.Group().GetPublicKey()
+	for _, entry := range gc.MessageStore().OpLog().GetEntries().Slice() {
+		if !s.retention.isPruned(gc.ctx, groupPK, entry.GetHash()) {
+			evicted.StoredBytes += uint64(len(entry.GetPayload()))
+		}
+	}
+
+	if err := gc.MetadataStore().emitLocalEvent(protocoltypes.EventType_EventTypeGroupMessagesEvicted, evicted); err != nil {
+		s.logger.Warn("unable to emit messages evicted event", zap.Error(err))
+	}
+}
@@ -0,0 +1,310 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// checkSupersede checks that the message edited or retracted by evt has been
+// sent by the same device, its key may have been rotated since then
+func (m *MessageStore) checkSupersede(evt *protocoltypes.GroupMessageEvent) error {
+	if len(evt.Supersedes) == 0 {
+		if evt.Retract {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing retracted message"))
+		}
+
+		return nil
+	}
+
+	id, err := cid.Cast(evt.Supersedes)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	senderPK, err := m.messageSender(id)
+	if err != nil {
+		return err
+	}
+
+	// the edits of a message pruned before its sender was recorded can't be
+	// checked, they are kept as they can't be applied to it anymore
+	if senderPK == nil {
+		return nil
+	}
+
+	if !m.isSameDevice(senderPK, evt.GetHeaders().GetDevicePk()) {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the device which sent a message can edit or retract it"))
+	}
+
+	return nil
+}
+
+// messageSender returns the device which sent the message id. The sender of
+// a pruned message removed from the log by a compaction is the one recorded
+// when it has been pruned, nil if it is unknown.
+func (m *MessageStore) messageSender(id cid.Cid) ([]byte, error) {
+	op, err := m.GetMessageByCID(id)
+	if err != nil {
+		if !m.isPruned(id) {
+			return nil, err
+		}
+
+		return m.getPrunedSender(id), nil
+	}
+
+	_, headers, err := m.secretStore.OpenEnvelopeHeaders(op.GetValue(), m.group)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return headers.DevicePk, nil
+}
+
+// EditMessage adds a message replacing the payload of the message id, it
+// must have been sent by the current device
+func (m *MessageStore) EditMessage(ctx context.Context, id []byte, payload []byte) (operation.Operation, error) {
+	return m.supersedeMessage(ctx, id, payload, false)
+}
+
+// RetractMessage adds a tombstone deleting the message id, it must have been
+// sent by the current device
+func (m *MessageStore) RetractMessage(ctx context.Context, id []byte) (operation.Operation, error) {
+	return m.supersedeMessage(ctx, id, nil, true)
+}
+
+func (m *MessageStore) supersedeMessage(ctx context.Context, id []byte, payload []byte, retract bool) (operation.Operation, error) {
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
+	c, err := cid.Cast(id)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	entry, ok := m.OpLog().Get(c)
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown message"))
+	}
+
+	original, err := m.openMessage(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !m.isSameDevice(original.GetHeaders().GetDevicePk(), m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the device which sent a message can edit or retract it"))
+	}
+
+	// edits always supersede the original message so they can be collapsed
+	// in a single pass
+	if len(original.Supersedes) > 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an edit or a retraction can't be superseded"))
+	}
+
+	if original.Reaction != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a reaction can't be superseded, it can be removed with another reaction"))
+	}
+
+	// the edits expire with the original message
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{
+		ThreadId:        original.ThreadId,
+		Supersedes:      id,
+		Retract:         retract,
+		ExpireAfter:     original.ExpireAfter,
+		ExpireAfterRead: original.ExpireAfterRead,
+	})
+}
+
+// listCollapsedEvents lists the messages in their latest version, the edits
+// and retractions are applied to the messages they supersede. As the edits of
+// a message can be written after until, the log after since is read first to
+// keep the latest edit of each message, then the messages in range are
+// streamed, only the edits are kept in memory.
+func (m *MessageStore) listCollapsedEvents(ctx context.Context, opts *listEventsOptions) (<-chan *protocoltypes.GroupMessageEvent, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	events, err := m.listEvents(ctx, &listEventsOptions{
+		since:     opts.since,
+		until:     opts.until,
+		exclusive: opts.exclusive,
+		reverse:   opts.reverse,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	out := make(chan *protocoltypes.GroupMessageEvent)
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		history, err := m.listEvents(ctx, &listEventsOptions{since: opts.since})
+		if err != nil {
+			m.logger.Error("unable to list message edits", zap.Error(err))
+			return
+		}
+
+		edits := latestMessageEdits(history)
+
+		count := uint32(0)
+		for evt := range events {
+			evt = m.collapseMessageEvent(evt, edits)
+			if evt == nil {
+				continue
+			}
+
+			if opts.filter != nil && !opts.filter(evt) {
+				continue
+			}
+
+			select {
+			case out <- evt:
+			case <-ctx.Done():
+				return
+			}
+
+			count++
+			if opts.limit > 0 && count >= opts.limit {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// latestMessageEdits returns the latest edit or retraction of each message
+// indexed by the id of the message, events are ordered from the oldest to the
+// newest. The edits following a retraction are ignored.
+func latestMessageEdits(events <-chan *protocoltypes.GroupMessageEvent) map[string]*protocoltypes.GroupMessageEvent {
+	edits := map[string]*protocoltypes.GroupMessageEvent{}
+	for evt := range events {
+		if len(evt.Supersedes) == 0 {
+			continue
+		}
+
+		if previous, ok := edits[string(evt.Supersedes)]; ok && previous.Retract {
+			continue
+		}
+
+		edits[string(evt.Supersedes)] = evt
+	}
+
+	return edits
+}
+
+// collapseMessageEvent returns the latest version of the message evt, nil if
+// it is retracted, a reaction or an edit. The latest edit of a pruned message
+// stands for it as the message isn't listed anymore, the expired messages are
+// listed as expired whatever their edits.
+func (m *MessageStore) collapseMessageEvent(evt *protocoltypes.GroupMessageEvent, edits map[string]*protocoltypes.GroupMessageEvent) *protocoltypes.GroupMessageEvent {
+	if evt.Reaction != nil {
+		return nil
+	}
+
+	if evt.Expired && len(evt.Supersedes) == 0 {
+		return evt
+	}
+
+	if len(evt.Supersedes) == 0 {
+		edit, ok := edits[string(evt.GetEventContext().GetId())]
+		switch {
+		case !ok:
+			return evt
+		case edit.Retract:
+			return nil
+		default:
+			return applyMessageEdit(evt, edit)
+		}
+	}
+
+	// only the latest edit of a pruned message is listed
+	edit, ok := edits[string(evt.Supersedes)]
+	if !ok || edit.Retract || !bytes.Equal(edit.GetEventContext().GetId(), evt.GetEventContext().GetId()) {
+		return nil
+	}
+
+	id, err := cid.Cast(evt.Supersedes)
+	if err != nil || !m.isPruned(id) || m.isExpired(id) {
+		return nil
+	}
+
+	edited := proto.Clone(evt).(*protocoltypes.GroupMessageEvent)
+	edited.EventContext.Id = evt.Supersedes
+	edited.EditId = evt.GetEventContext().GetId()
+	edited.Supersedes = nil
+
+	return edited
+}
+
+// applyMessageEdit returns a copy of the original message with the payload of
+// its edit
+func applyMessageEdit(original, edit *protocoltypes.GroupMessageEvent) *protocoltypes.GroupMessageEvent {
+	edited := proto.Clone(original).(*protocoltypes.GroupMessageEvent)
+	edited.Message = edit.Message
+	edited.AttachmentCids = edit.AttachmentCids
+	edited.EditId = edit.GetEventContext().GetId()
+
+	return edited
+}
+
+// collapseMessageEvents returns the latest version of the messages, events
+// are ordered from the oldest to the newest. The edits replace the payload
+// of the message they supersede, the retracted messages are omitted as well
+// as the edits of unknown messages and the reactions. The expired messages
+// are kept as they are.
+func collapseMessageEvents(events []*protocoltypes.GroupMessageEvent) []*protocoltypes.GroupMessageEvent {
+	var (
+		latest = map[string]*protocoltypes.GroupMessageEvent{}
+		order  = []string(nil)
+	)
+
+	for _, evt := range events {
+		if evt.Reaction != nil {
+			continue
+		}
+
+		if len(evt.Supersedes) == 0 {
+			id := string(evt.GetEventContext().GetId())
+			if _, ok := latest[id]; !ok {
+				latest[id] = evt
+				order = append(order, id)
+			}
+
+			continue
+		}
+
+		original, ok := latest[string(evt.Supersedes)]
+		if !ok || original == nil || original.Expired {
+			continue
+		}
+
+		if evt.Retract {
+			latest[string(evt.Supersedes)] = nil
+			continue
+		}
+
+		latest[string(evt.Supersedes)] = applyMessageEdit(original, evt)
+	}
+
+	collapsed := make([]*protocoltypes.GroupMessageEvent, 0, len(order))
+	for _, id := range order {
+		if evt := latest[id]; evt != nil {
+			collapsed = append(collapsed, evt)
+		}
+	}
+
+	return collapsed
+}
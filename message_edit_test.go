@@ -0,0 +1,154 @@
+package weshnet
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestCollapseMessageEvents(t *testing.T) {
+	newEvent := func(id string, payload string, supersedes string, retract bool) *protocoltypes.GroupMessageEvent {
+		evt := &protocoltypes.GroupMessageEvent{
+			EventContext: &protocoltypes.EventContext{Id: []byte(id)},
+			Message:      []byte(payload),
+			Retract:      retract,
+		}
+
+		if supersedes != "" {
+			evt.Supersedes = []byte(supersedes)
+		}
+
+		return evt
+	}
+
+	events := []*protocoltypes.GroupMessageEvent{
+		newEvent("1", "first", "", false),
+		newEvent("2", "second", "", false),
+		newEvent("3", "first edited", "1", false),
+		newEvent("4", "third", "", false),
+		newEvent("5", "", "2", true),
+		newEvent("6", "first edited again", "1", false),
+		// edits of retracted or unknown messages are ignored
+		newEvent("7", "second edited", "2", false),
+		newEvent("8", "unknown edited", "unknown", false),
+	}
+
+	collapsed := collapseMessageEvents(events)
+	require.Len(t, collapsed, 2)
+
+	require.Equal(t, []byte("1"), collapsed[0].EventContext.Id)
+	require.Equal(t, []byte("first edited again"), collapsed[0].Message)
+	require.Equal(t, []byte("6"), collapsed[0].EditId)
+
+	require.Equal(t, []byte("4"), collapsed[1].EventContext.Id)
+	require.Equal(t, []byte("third"), collapsed[1].Message)
+	require.Empty(t, collapsed[1].EditId)
+
+	// the raw history is left untouched
+	require.Equal(t, []byte("first"), events[0].Message)
+
+	// the edits of an expired message are ignored
+	expired := &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{Id: []byte("1")}, Expired: true}
+	collapsed = collapseMessageEvents([]*protocoltypes.GroupMessageEvent{expired, events[2]})
+	require.Equal(t, []*protocoltypes.GroupMessageEvent{expired}, collapsed)
+}
+
+func TestCollapseMessageEvent(t *testing.T) {
+	ids := make([]cid.Cid, 6)
+	for i := range ids {
+		id, err := cid.V0Builder{}.Sum([]byte{byte(i)})
+		require.NoError(t, err)
+
+		ids[i] = id
+	}
+
+	newEvent := func(id cid.Cid, payload string, supersedes *cid.Cid, retract bool) *protocoltypes.GroupMessageEvent {
+		evt := &protocoltypes.GroupMessageEvent{
+			EventContext: &protocoltypes.EventContext{Id: id.Bytes()},
+			Message:      []byte(payload),
+			Retract:      retract,
+		}
+
+		if supersedes != nil {
+			evt.Supersedes = supersedes.Bytes()
+		}
+
+		return evt
+	}
+
+	// the message 0 has been pruned, the message 1 is listed
+	m := &MessageStore{}
+	m.setPrunedChecker(func(id cid.Cid) bool { return id.Equals(ids[0]) })
+
+	history := []*protocoltypes.GroupMessageEvent{
+		newEvent(ids[1], "listed", nil, false),
+		newEvent(ids[2], "pruned edited", &ids[0], false),
+		newEvent(ids[3], "listed edited", &ids[1], false),
+		newEvent(ids[4], "pruned edited again", &ids[0], false),
+		newEvent(ids[5], "", &ids[1], true),
+	}
+
+	events := make(chan *protocoltypes.GroupMessageEvent, len(history))
+	for _, evt := range history {
+		events <- evt
+	}
+	close(events)
+
+	edits := latestMessageEdits(events)
+	require.Len(t, edits, 2)
+
+	// the retraction of the message 1 is kept
+	require.Nil(t, m.collapseMessageEvent(history[0], edits))
+
+	// only the latest edit of the pruned message is listed, in its place
+	require.Nil(t, m.collapseMessageEvent(history[1], edits))
+
+	collapsed := m.collapseMessageEvent(history[3], edits)
+	require.NotNil(t, collapsed)
+	require.Equal(t, ids[0].Bytes(), collapsed.EventContext.Id)
+	require.Equal(t, ids[4].Bytes(), collapsed.EditId)
+	require.Equal(t, []byte("pruned edited again"), collapsed.Message)
+	require.Empty(t, collapsed.Supersedes)
+
+	// the edits of the listed messages are applied to them
+	require.Nil(t, m.collapseMessageEvent(history[2], edits))
+	delete(edits, string(ids[1].Bytes()))
+	require.Equal(t, history[0], m.collapseMessageEvent(history[0], edits))
+
+	// the expired messages are listed as expired, their edits are dropped
+	m.setExpiredChecker(func(id cid.Cid) bool { return id.Equals(ids[0]) })
+	require.Nil(t, m.collapseMessageEvent(history[3], edits))
+
+	expired := &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{Id: ids[1].Bytes()}, Expired: true}
+	edits[string(ids[1].Bytes())] = history[2]
+	require.Equal(t, expired, m.collapseMessageEvent(expired, edits))
+}
+
+func TestMessageStoreIsSameDevice(t *testing.T) {
+	idx := &metadataStoreIndex{
+		rotatedDevices: map[string]*protocoltypes.GroupDeviceKeyRotated{
+			"a": {DevicePk: []byte("a"), NewDevicePk: []byte("b")},
+			"b": {DevicePk: []byte("b"), NewDevicePk: []byte("c")},
+			// a cycle of rotations is followed once
+			"x": {DevicePk: []byte("x"), NewDevicePk: []byte("y")},
+			"y": {DevicePk: []byte("y"), NewDevicePk: []byte("x")},
+		},
+	}
+
+	m := &MessageStore{}
+	require.True(t, m.isSameDevice([]byte("a"), []byte("a")))
+	require.False(t, m.isSameDevice([]byte("a"), []byte("c")))
+
+	m.setDeviceMatcher(idx.isSameDevice)
+
+	// the messages of a device can be edited with the keys which replaced
+	// its key
+	require.True(t, m.isSameDevice([]byte("a"), []byte("c")))
+	require.True(t, m.isSameDevice([]byte("b"), []byte("c")))
+	require.False(t, m.isSameDevice([]byte("c"), []byte("a")))
+	require.False(t, m.isSameDevice([]byte("a"), []byte("z")))
+	require.False(t, m.isSameDevice([]byte("x"), []byte("z")))
+}
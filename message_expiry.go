@@ -0,0 +1,373 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+
+	ipfslog "berty.tech/go-ipfs-log"
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// dsNamespaceRetentionExpiry stores the time at which the messages sent
+	// with an expiry must be deleted
+	dsNamespaceRetentionExpiry = "expiry"
+
+	// dsNamespaceRetentionExpired stores the CIDs of the expired messages,
+	// they are listed as expired rather than omitted like the pruned ones
+	dsNamespaceRetentionExpired = "expired"
+
+	// dsNamespaceRetentionExpiryOnRead stores the expiry of the messages
+	// sent to be deleted once read, until they are read on the device
+	dsNamespaceRetentionExpiryOnRead = "expiry-on-read"
+
+	// dsNamespaceRetentionEdits stores the CIDs of the edits and
+	// retractions of each message, they expire with it
+	dsNamespaceRetentionEdits = "edits"
+)
+
+// recordExpiry schedules the deletion of a message sent with an expiry, the
+// delay starts when the message is seen for the first time
+func (r *messageRetention) recordExpiry(ctx context.Context, groupPK []byte, id cid.Cid, expireAfter time.Duration, now time.Time) error {
+	if r.isPruned(ctx, groupPK, id) {
+		return nil
+	}
+
+	seen, err := r.firstSeen(ctx, groupPK, id, now)
+	if err != nil {
+		return err
+	}
+
+	return r.scheduleExpiry(ctx, groupPK, id, seen.Add(expireAfter))
+}
+
+// recordExpiryOnRead records the expiry of a message deleted once read, the
+// delay starts when startExpiryOnRead is called
+func (r *messageRetention) recordExpiryOnRead(ctx context.Context, groupPK []byte, id cid.Cid, expireAfter time.Duration) error {
+	if r.isPruned(ctx, groupPK, id) {
+		return nil
+	}
+
+	// the delay may already have started
+	if scheduled, err := r.datastore.Has(ctx, dsKeyForRetention(dsNamespaceRetentionExpiry, groupPK, id.String())); err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	} else if scheduled {
+		return nil
+	}
+
+	data := binary.BigEndian.AppendUint64(nil, uint64(expireAfter/time.Second))
+	if err := r.datastore.Put(ctx, dsKeyForRetention(dsNamespaceRetentionExpiryOnRead, groupPK, id.String()), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// startExpiryOnRead starts the delay of a message deleted once read, it does
+// nothing for the other messages
+func (r *messageRetention) startExpiryOnRead(ctx context.Context, groupPK []byte, id cid.Cid, now time.Time) error {
+	key := dsKeyForRetention(dsNamespaceRetentionExpiryOnRead, groupPK, id.String())
+
+	data, err := r.datastore.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if len(data) == 8 {
+		expireAfter := time.Duration(binary.BigEndian.Uint64(data)) * time.Second
+		if err := r.scheduleExpiry(ctx, groupPK, id, now.Add(expireAfter)); err != nil {
+			return err
+		}
+	}
+
+	if err := r.datastore.Delete(ctx, key); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// recordEdit records an edit or a retraction of a message, it is deleted
+// when the message expires, right away if it already has
+func (r *messageRetention) recordEdit(ctx context.Context, groupPK []byte, original, edit cid.Cid, now time.Time) error {
+	if r.isPruned(ctx, groupPK, edit) {
+		return nil
+	}
+
+	if r.isExpired(ctx, groupPK, original) {
+		return r.scheduleExpiry(ctx, groupPK, edit, now)
+	}
+
+	if err := r.datastore.Put(ctx, dsKeyForRetention(dsNamespaceRetentionEdits, groupPK, original.String(), edit.String()), []byte{}); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// takeEdits returns and forgets the edits and retractions recorded for a
+// message
+func (r *messageRetention) takeEdits(ctx context.Context, groupPK []byte, original cid.Cid) ([]cid.Cid, error) {
+	results, err := r.datastore.Query(ctx, query.Query{Prefix: dsKeyForRetention(dsNamespaceRetentionEdits, groupPK, original.String()).String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	edits := make([]cid.Cid, 0, len(entries))
+	for _, entry := range entries {
+		key := datastore.RawKey(entry.Key)
+		if err := r.datastore.Delete(ctx, key); err != nil {
+			return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if id, err := cid.Decode(key.BaseNamespace()); err == nil {
+			edits = append(edits, id)
+		}
+	}
+
+	return edits, nil
+}
+
+// scheduleExpiry records the time at which a message must be deleted
+func (r *messageRetention) scheduleExpiry(ctx context.Context, groupPK []byte, id cid.Cid, expiresAt time.Time) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(expiresAt.Unix()))
+
+	if err := r.datastore.Put(ctx, dsKeyForRetention(dsNamespaceRetentionExpiry, groupPK, id.String()), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	r.muExpiry.Lock()
+	if next, ok := r.nextExpiry[string(groupPK)]; ok && (next.IsZero() || expiresAt.Before(next)) {
+		r.nextExpiry[string(groupPK)] = expiresAt
+	}
+	r.muExpiry.Unlock()
+
+	return nil
+}
+
+// dueExpiries returns the messages of the group whose expiry has elapsed, the
+// datastore is only read once the next expiry of the group is due
+func (r *messageRetention) dueExpiries(ctx context.Context, groupPK []byte, now time.Time) ([]cid.Cid, error) {
+	r.muExpiry.Lock()
+	next, known := r.nextExpiry[string(groupPK)]
+	r.muExpiry.Unlock()
+
+	if known && (next.IsZero() || now.Before(next)) {
+		return nil, nil
+	}
+
+	results, err := r.datastore.Query(ctx, query.Query{Prefix: dsKeyForRetention(dsNamespaceRetentionExpiry, groupPK).String()})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	var (
+		due      []cid.Cid
+		upcoming time.Time
+	)
+
+	for _, entry := range entries {
+		id, err := cid.Decode(datastore.RawKey(entry.Key).BaseNamespace())
+		if err != nil || len(entry.Value) != 8 {
+			continue
+		}
+
+		expiresAt := time.Unix(int64(binary.BigEndian.Uint64(entry.Value)), 0)
+		if !now.Before(expiresAt) {
+			due = append(due, id)
+		} else if upcoming.IsZero() || expiresAt.Before(upcoming) {
+			upcoming = expiresAt
+		}
+	}
+
+	r.muExpiry.Lock()
+	// an expiry recorded while the datastore was read is kept, at worst the
+	// datastore is read again on the next run
+	if current, ok := r.nextExpiry[string(groupPK)]; ok && !current.IsZero() && current != next && (upcoming.IsZero() || current.Before(upcoming)) {
+		upcoming = current
+	}
+	r.nextExpiry[string(groupPK)] = upcoming
+	r.muExpiry.Unlock()
+
+	return due, nil
+}
+
+// markExpired records that a message has expired, once it has been pruned
+func (r *messageRetention) markExpired(ctx context.Context, groupPK []byte, id cid.Cid) error {
+	if err := r.datastore.Put(ctx, dsKeyForRetention(dsNamespaceRetentionExpired, groupPK, id.String()), []byte{}); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return r.forgetExpiry(ctx, groupPK, id)
+}
+
+func (r *messageRetention) forgetExpiry(ctx context.Context, groupPK []byte, id cid.Cid) error {
+	if err := r.datastore.Delete(ctx, dsKeyForRetention(dsNamespaceRetentionExpiry, groupPK, id.String())); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// isExpired returns true if the message has been deleted because of its
+// expiry
+func (r *messageRetention) isExpired(ctx context.Context, groupPK []byte, id cid.Cid) bool {
+	has, err := r.datastore.Has(ctx, dsKeyForRetention(dsNamespaceRetentionExpired, groupPK, id.String()))
+	return err == nil && has
+}
+
+// expiredMessage returns the event listed in place of an expired message,
+// its headers are still readable as they don't depend on the message key
+func (m *MessageStore) expiredMessage(e ipfslog.Entry) (*protocoltypes.GroupMessageEvent, error) {
+	op, err := operation.ParseOperation(e)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	_, headers, err := m.secretStore.OpenEnvelopeHeaders(op.GetValue(), m.group)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	return &protocoltypes.GroupMessageEvent{
+		EventContext: newEventContext(e.GetHash(), e.GetNext(), m.group),
+		Headers:      headers,
+		Expired:      true,
+	}, nil
+}
+
+// isOwnMessage returns true if the message has been sent by a device of the
+// current member
+func isOwnMessage(gc *GroupContext, evt *protocoltypes.GroupMessageEvent) bool {
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(evt.GetHeaders().GetDevicePk())
+	if err != nil {
+		return false
+	}
+
+	member, err := gc.MetadataStore().GetMemberByDevice(devicePK)
+	return err == nil && member.Equals(gc.MemberPubKey())
+}
+
+// recordMessageExpiries schedules the deletion of the messages of the group
+// sent with an expiry as they are opened. The edits and retractions of a
+// message are deleted with it, the delay of a message deleted once read
+// starts when it is read, except on the devices of its sender.
+func (s *service) recordMessageExpiries(gc *GroupContext) {
+	groupPK := gc.Group().GetPublicKey()
+
+	gc.messageStore.setExpiryRecorder(func(id cid.Cid, evt *protocoltypes.GroupMessageEvent) {
+		var (
+			expireAfter = time.Duration(evt.ExpireAfter) * time.Second
+			err         error
+		)
+
+		switch {
+		case len(evt.Supersedes) > 0:
+			original, errCast := cid.Cast(evt.Supersedes)
+			if errCast != nil || (expireAfter <= 0 && !s.retention.isExpired(s.ctx, groupPK, original)) {
+				return
+			}
+
+			err = s.retention.recordEdit(s.ctx, groupPK, original, id, time.Now())
+		case expireAfter <= 0:
+			return
+		case evt.ExpireAfterRead && !isOwnMessage(gc, evt):
+			err = s.retention.recordExpiryOnRead(s.ctx, groupPK, id, expireAfter)
+		default:
+			err = s.retention.recordExpiry(s.ctx, groupPK, id, expireAfter, time.Now())
+		}
+
+		if err != nil {
+			s.logger.Warn("unable to record message expiry", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		}
+	})
+}
+
+// expireMessages deletes the keys of the messages of the group whose expiry
+// has elapsed, they are then listed as expired
+func (s *service) expireMessages(gc *GroupContext, now time.Time) {
+	groupPK := gc.Group().GetPublicKey()
+
+	due, err := s.retention.dueExpiries(gc.ctx, groupPK, now)
+	if err != nil {
+		s.logger.Warn("unable to list expired messages", zap.Error(err))
+		return
+	}
+
+	evicted := &protocoltypes.GroupMessagesEvicted{}
+	for _, id := range due {
+		entry, ok := gc.MessageStore().OpLog().Get(id)
+
+		// the messages already pruned by the retention policy aren't
+		// listed as expired
+		if !ok || s.retention.isPruned(gc.ctx, groupPK, id) {
+			if err := s.retention.forgetExpiry(gc.ctx, groupPK, id); err != nil {
+				s.logger.Warn("unable to delete message expiry", zap.Error(err))
+			}
+
+			continue
+		}
+
+		if !s.expireMessage(gc, entry, evicted) {
+			continue
+		}
+
+		// the edits and retractions of the message expire with it
+		edits, err := s.retention.takeEdits(gc.ctx, groupPK, id)
+		if err != nil {
+			s.logger.Warn("unable to list the edits of an expired message", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		}
+
+		for _, edit := range edits {
+			if entry, ok := gc.MessageStore().OpLog().Get(edit); ok && !s.retention.isPruned(gc.ctx, groupPK, edit) {
+				s.expireMessage(gc, entry, evicted)
+			}
+		}
+	}
+
+	s.emitMessagesEvicted(gc, evicted)
+}
+
+// expireMessage deletes the key of an expired message and adds it to
+// evicted, it returns false if it couldn't be deleted
+func (s *service) expireMessage(gc *GroupContext, entry ipfslog.Entry, evicted *protocoltypes.GroupMessagesEvicted) bool {
+	groupPK := gc.Group().GetPublicKey()
+	id := entry.GetHash()
+
+	if err := s.retention.prune(gc.ctx, gc, entry); err != nil {
+		s.logger.Warn("unable to delete expired message", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		return false
+	}
+
+	if err := s.retention.markExpired(gc.ctx, groupPK, id); err != nil {
+		s.logger.Warn("unable to mark message as expired", logutil.PrivateString("cid", id.String()), zap.Error(err))
+	}
+
+	evicted.MessageIds = append(evicted.MessageIds, id.Bytes())
+	evicted.EvictedBytes += uint64(len(entry.GetPayload()))
+
+	return true
+}
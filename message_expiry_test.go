@@ -0,0 +1,145 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMessageRetentionExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	r := newMessageRetention(datastore, nil, nil, nil, nil, 0, zap.NewNop())
+	groupPK := []byte("group")
+
+	id1, err := cid.Parse("QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ")
+	require.NoError(t, err)
+	id2, err := cid.Parse("QmbdQXQh9B2bWZgZJqfbjNPV5jGN2owbQ3vjeYsaDaCDqU")
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	due, err := r.dueExpiries(ctx, groupPK, now)
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	// the delay starts when the message is seen for the first time
+	require.NoError(t, r.recordExpiry(ctx, groupPK, id1, time.Minute, now))
+	require.NoError(t, r.recordExpiry(ctx, groupPK, id1, time.Minute, now.Add(time.Hour)))
+	require.NoError(t, r.recordExpiry(ctx, groupPK, id2, time.Hour, now))
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(30*time.Second))
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{id1}, due)
+
+	require.False(t, r.isExpired(ctx, groupPK, id1))
+	require.NoError(t, r.markExpired(ctx, groupPK, id1))
+	require.True(t, r.isExpired(ctx, groupPK, id1))
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	// the pending expiries are read again after a restart
+	r = newMessageRetention(datastore, nil, nil, nil, nil, 0, zap.NewNop())
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{id2}, due)
+
+	due, err = r.dueExpiries(ctx, []byte("other group"), now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, due)
+}
+
+func TestMessageRetentionExpiryOnRead(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageRetention(dsync.MutexWrap(ds.NewMapDatastore()), nil, nil, nil, nil, 0, zap.NewNop())
+	groupPK := []byte("group")
+
+	id, err := cid.Parse("QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ")
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// the delay only starts once the message is read
+	require.NoError(t, r.recordExpiryOnRead(ctx, groupPK, id, time.Minute))
+
+	due, err := r.dueExpiries(ctx, groupPK, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	require.NoError(t, r.startExpiryOnRead(ctx, groupPK, id, now.Add(time.Hour)))
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(time.Hour+30*time.Second))
+	require.NoError(t, err)
+	require.Empty(t, due)
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(time.Hour+2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{id}, due)
+
+	// reading it again doesn't restart the delay
+	require.NoError(t, r.recordExpiryOnRead(ctx, groupPK, id, time.Minute))
+	require.NoError(t, r.startExpiryOnRead(ctx, groupPK, id, now.Add(2*time.Hour)))
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(time.Hour+2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{id}, due)
+}
+
+func TestMessageRetentionExpiryEdits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageRetention(dsync.MutexWrap(ds.NewMapDatastore()), nil, nil, nil, nil, 0, zap.NewNop())
+	groupPK := []byte("group")
+
+	ids := make([]cid.Cid, 3)
+	for i := range ids {
+		id, err := cid.V0Builder{}.Sum([]byte{byte(i)})
+		require.NoError(t, err)
+
+		ids[i] = id
+	}
+
+	now := time.Now()
+
+	// the edits are deleted with the message
+	require.NoError(t, r.recordExpiry(ctx, groupPK, ids[0], time.Minute, now))
+	require.NoError(t, r.recordEdit(ctx, groupPK, ids[0], ids[1], now))
+
+	due, err := r.dueExpiries(ctx, groupPK, now.Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{ids[0]}, due)
+
+	edits, err := r.takeEdits(ctx, groupPK, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{ids[1]}, edits)
+
+	edits, err = r.takeEdits(ctx, groupPK, ids[0])
+	require.NoError(t, err)
+	require.Empty(t, edits)
+
+	// the edits received once the message has expired are deleted right away
+	require.NoError(t, r.markExpired(ctx, groupPK, ids[0]))
+	require.NoError(t, r.recordEdit(ctx, groupPK, ids[0], ids[2], now.Add(time.Hour)))
+
+	due, err = r.dueExpiries(ctx, groupPK, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{ids[2]}, due)
+}
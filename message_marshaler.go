@@ -33,6 +33,13 @@ type OrbitDBMessageMarshaler struct {
 
 	// in Replication Mode DeviceKey should not be sent
 	useReplicationMode bool
+
+	// syncState records the heads received from the peers, it can be nil
+	syncState *storeSyncState
+
+	// deferredTopics are the stores whose heads received from the peers are
+	// not replicated, they are only recorded in syncState
+	deferredTopics map[string]struct{}
 }
 
 func NewOrbitDBMessageMarshaler(selfid peer.ID, secretStore secretstore.SecretStore, rp *rendezvous.RotationInterval, useReplicationMode bool) *OrbitDBMessageMarshaler {
@@ -41,6 +48,7 @@ func NewOrbitDBMessageMarshaler(selfid peer.ID, secretStore secretstore.SecretSt
 		sharedKeys:         make(map[string]enc.SharedKey),
 		deviceCaches:       make(map[peer.ID]*PeerDeviceGroup),
 		topicGroup:         make(map[string]*protocoltypes.Group),
+		deferredTopics:     make(map[string]struct{}),
 		rp:                 rp,
 		secretStore:        secretStore,
 		useReplicationMode: useReplicationMode,
@@ -59,6 +67,18 @@ func (m *OrbitDBMessageMarshaler) RegisterGroup(sid string, group *protocoltypes
 	m.muMarshall.Unlock()
 }
 
+// setDeferredTopic sets whether the heads received for the store are
+// replicated, the heads of a deferred store are fetched on demand
+func (m *OrbitDBMessageMarshaler) setDeferredTopic(topic string, deferred bool) {
+	m.muMarshall.Lock()
+	if deferred {
+		m.deferredTopics[topic] = struct{}{}
+	} else {
+		delete(m.deferredTopics, topic)
+	}
+	m.muMarshall.Unlock()
+}
+
 func (m *OrbitDBMessageMarshaler) GetDevicePKForPeerID(id peer.ID) (pdg *PeerDeviceGroup, ok bool) {
 	m.muMarshall.RLock()
 	pdg, ok = m.deviceCaches[id]
@@ -168,9 +188,19 @@ func (m *OrbitDBMessageMarshaler) Unmarshal(payload []byte, msg *iface.MessageEx
 	msg.Address = box.Address
 	msg.Heads = entries
 
+	// the peers are still identified but the store doesn't replicate the
+	// heads
+	if _, ok := m.deferredTopics[box.Address]; ok {
+		msg.Heads = nil
+	}
+
 	if box.DevicePk == nil {
 		// @NOTE(gfanton): this is probably a message from a replication server
 		// which should not have a DevicePK
+		if pid, err := peer.IDFromBytes(box.PeerId); err == nil {
+			m.recordRemoteHeads(box.Address, nil, pid, entries)
+		}
+
 		return nil
 	}
 
@@ -187,6 +217,10 @@ func (m *OrbitDBMessageMarshaler) Unmarshal(payload []byte, msg *iface.MessageEx
 		return fmt.Errorf("unable to unmarshal remote device pk: %w", err)
 	}
 
+	// the device is checked against the members of the group when the
+	// state of the replication is reported
+	m.recordRemoteHeads(box.Address, box.DevicePk, pid, entries)
+
 	pdg.DevicePK = pub
 	group, ok := m.topicGroup[msg.Address]
 	if ok {
@@ -198,6 +232,17 @@ func (m *OrbitDBMessageMarshaler) Unmarshal(payload []byte, msg *iface.MessageEx
 	return nil
 }
 
+// recordRemoteHeads records the heads sent by a peer once its box has been
+// opened and its sender identified
+func (m *OrbitDBMessageMarshaler) recordRemoteHeads(address string, devicePK []byte, pid peer.ID, entries []*entry.Entry) {
+	if m.syncState == nil {
+		return
+	}
+
+	m.syncState.addRemoteHeads(address, devicePK, entries)
+	m.syncState.addHeadsExchange(address, pid)
+}
+
 func (m *OrbitDBMessageMarshaler) sealBox(topic string, box *protocoltypes.OrbitDBMessageHeads_Box) ([]byte, error) {
 	sk, ok := m.getSharedKeyFor(topic)
 	if !ok {
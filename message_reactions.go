@@ -0,0 +1,416 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// messageReactionMaxCodeLength is the maximum size in bytes of the code of a
+// reaction
+const messageReactionMaxCodeLength = 64
+
+// messageReactions aggregates the reactions to the messages of the groups by
+// member, so the devices of a member share their reactions. The state of the
+// reaction of a member with a code is the one of its latest reaction event,
+// ordered by lamport clock then by CID, so the replicas converge regardless
+// of the order in which the events are received.
+type messageReactions struct {
+	datastore datastore.Datastore
+
+	// mu serializes the updates of the reactions
+	mu sync.Mutex
+}
+
+func newMessageReactions(ds datastore.Datastore) *messageReactions {
+	return &messageReactions{datastore: ds}
+}
+
+func dsKeyForReaction(parts ...[]byte) datastore.Key {
+	namespaces := make([]string, len(parts))
+	for i, part := range parts {
+		namespaces[i] = base64.RawURLEncoding.EncodeToString(part)
+	}
+
+	return datastore.KeyWithNamespaces(namespaces)
+}
+
+// dsKeyForRetractedReactions marks a retracted message, its reactions are
+// ignored
+func dsKeyForRetractedReactions(groupPK, target []byte) datastore.Key {
+	return dsKeyForReaction(groupPK, target).ChildString("retracted")
+}
+
+// checkReactionCode checks that the code of a reaction is a short non empty
+// text
+func checkReactionCode(code string) error {
+	if len(code) == 0 || len(code) > messageReactionMaxCodeLength || !utf8.ValidString(code) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid reaction code"))
+	}
+
+	return nil
+}
+
+// reactionState is the value of the reaction of a member with a code: the
+// lamport clock of its latest event, whether it removes the reaction and its
+// CID, the CID is missing from the states recorded before it was used to
+// order the events
+type reactionState []byte
+
+func newReactionState(clock uint64, remove bool, id []byte) reactionState {
+	state := binary.BigEndian.AppendUint64(nil, clock)
+	if remove {
+		state = append(state, 1)
+	} else {
+		state = append(state, 0)
+	}
+
+	return append(state, id...)
+}
+
+func (s reactionState) valid() bool {
+	return len(s) >= 9
+}
+
+func (s reactionState) clock() uint64 {
+	return binary.BigEndian.Uint64(s)
+}
+
+func (s reactionState) removed() bool {
+	return s[8] != 0
+}
+
+func (s reactionState) id() []byte {
+	return s[9:]
+}
+
+// newerThan returns true if the state comes from an event more recent than
+// the given one
+func (s reactionState) newerThan(clock uint64, id []byte) bool {
+	if s.clock() != clock {
+		return s.clock() > clock
+	}
+
+	return bytes.Compare(s.id(), id) >= 0
+}
+
+// record applies a reaction event of a member, it is ignored if the member
+// has already reacted with the same code in a more recent event or if the
+// message has been retracted
+func (r *messageReactions) record(ctx context.Context, groupPK, memberPK []byte, reaction *protocoltypes.MessageReaction, clock uint64, id []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	retracted, err := r.datastore.Has(ctx, dsKeyForRetractedReactions(groupPK, reaction.Target))
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	} else if retracted {
+		return nil
+	}
+
+	key := dsKeyForReaction(groupPK, reaction.Target, memberPK, []byte(reaction.Code))
+
+	current, err := r.datastore.Get(ctx, key)
+	switch {
+	case err == datastore.ErrNotFound:
+	case err != nil:
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	case reactionState(current).valid() && reactionState(current).newerThan(clock, id):
+		return nil
+	}
+
+	if err := r.datastore.Put(ctx, key, newReactionState(clock, reaction.Remove, id)); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// forget deletes the state of a reaction once its event has been pruned,
+// unless a more recent event of the member has replaced it
+func (r *messageReactions) forget(ctx context.Context, groupPK, memberPK []byte, reaction *protocoltypes.MessageReaction, clock uint64, id []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := dsKeyForReaction(groupPK, reaction.Target, memberPK, []byte(reaction.Code))
+
+	current, err := r.datastore.Get(ctx, key)
+	switch {
+	case err == datastore.ErrNotFound:
+		return nil
+	case err != nil:
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	case !reactionState(current).valid():
+	case len(reactionState(current).id()) > 0 && !bytes.Equal(reactionState(current).id(), id):
+		return nil
+	case reactionState(current).clock() > clock:
+		return nil
+	}
+
+	if err := r.datastore.Delete(ctx, key); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// retract deletes the reactions to a retracted message, the reactions
+// received after the retraction are ignored
+func (r *messageReactions) retract(ctx context.Context, groupPK, target []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.unsafeRemovePrefix(ctx, dsKeyForReaction(groupPK, target)); err != nil {
+		return err
+	}
+
+	if err := r.datastore.Put(ctx, dsKeyForRetractedReactions(groupPK, target), []byte{}); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// remove deletes the reactions to a message
+func (r *messageReactions) remove(ctx context.Context, groupPK, target []byte) error {
+	return r.removePrefix(ctx, dsKeyForReaction(groupPK, target))
+}
+
+// removeGroup deletes the reactions to all the messages of a group
+func (r *messageReactions) removeGroup(ctx context.Context, groupPK []byte) error {
+	return r.removePrefix(ctx, dsKeyForReaction(groupPK))
+}
+
+func (r *messageReactions) removePrefix(ctx context.Context, prefix datastore.Key) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.unsafeRemovePrefix(ctx, prefix)
+}
+
+func (r *messageReactions) unsafeRemovePrefix(ctx context.Context, prefix datastore.Key) error {
+	results, err := r.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := r.datastore.Delete(ctx, datastore.RawKey(entry.Key)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// list returns the reactions to the given messages of the group, or to all
+// of them if messageIDs is empty, the messages without reactions are omitted
+func (r *messageReactions) list(ctx context.Context, groupPK []byte, messageIDs [][]byte, ownMemberPK []byte) ([]*protocoltypes.MessageReactionList_Message, error) {
+	prefixes := []datastore.Key{dsKeyForReaction(groupPK)}
+	if len(messageIDs) > 0 {
+		prefixes = prefixes[:0]
+		for _, id := range messageIDs {
+			prefixes = append(prefixes, dsKeyForReaction(groupPK, id))
+		}
+	}
+
+	var (
+		messages = []*protocoltypes.MessageReactionList_Message(nil)
+		byID     = map[string]*protocoltypes.MessageReactionList_Message{}
+		byCode   = map[string]*protocoltypes.MessageReactionList_Reaction{}
+	)
+
+	for _, prefix := range prefixes {
+		results, err := r.datastore.Query(ctx, query.Query{Prefix: prefix.String(), Orders: []query.Order{query.OrderByKey{}}})
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		entries, err := results.Rest()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		for _, entry := range entries {
+			// the removed reactions are kept to order the next events
+			if state := reactionState(entry.Value); !state.valid() || state.removed() {
+				continue
+			}
+
+			namespaces := datastore.RawKey(entry.Key).Namespaces()
+			if len(namespaces) != 4 {
+				continue
+			}
+
+			target, errTarget := base64.RawURLEncoding.DecodeString(namespaces[1])
+			memberPK, errMember := base64.RawURLEncoding.DecodeString(namespaces[2])
+			code, errCode := base64.RawURLEncoding.DecodeString(namespaces[3])
+			if errTarget != nil || errMember != nil || errCode != nil {
+				continue
+			}
+
+			msg, ok := byID[string(target)]
+			if !ok {
+				msg = &protocoltypes.MessageReactionList_Message{MessageId: target}
+				byID[string(target)] = msg
+				messages = append(messages, msg)
+			}
+
+			reaction, ok := byCode[string(target)+"/"+string(code)]
+			if !ok {
+				reaction = &protocoltypes.MessageReactionList_Reaction{Code: string(code)}
+				byCode[string(target)+"/"+string(code)] = reaction
+				msg.Reactions = append(msg.Reactions, reaction)
+			}
+
+			reaction.MemberPks = append(reaction.MemberPks, memberPK)
+			reaction.Own = reaction.Own || bytes.Equal(memberPK, ownMemberPK)
+		}
+	}
+
+	for _, msg := range messages {
+		sort.SliceStable(msg.Reactions, func(i, j int) bool {
+			if len(msg.Reactions[i].MemberPks) != len(msg.Reactions[j].MemberPks) {
+				return len(msg.Reactions[i].MemberPks) > len(msg.Reactions[j].MemberPks)
+			}
+
+			return msg.Reactions[i].Code < msg.Reactions[j].Code
+		})
+	}
+
+	return messages, nil
+}
+
+// checkReaction checks that the message reacted to by evt is available in
+// the log
+func (m *MessageStore) checkReaction(evt *protocoltypes.GroupMessageEvent) error {
+	if evt.Reaction == nil {
+		return nil
+	}
+
+	if len(evt.Supersedes) > 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a reaction can't supersede a message"))
+	}
+
+	if err := checkReactionCode(evt.Reaction.Code); err != nil {
+		return err
+	}
+
+	id, err := cid.Cast(evt.Reaction.Target)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, ok := m.OpLog().Get(id); !ok {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown message"))
+	}
+
+	return nil
+}
+
+// ReactToMessage adds or removes a reaction of the current device to the
+// message id
+func (m *MessageStore) ReactToMessage(ctx context.Context, id []byte, code string, remove bool) (operation.Operation, error) {
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
+	if err := checkReactionCode(code); err != nil {
+		return nil, err
+	}
+
+	c, err := cid.Cast(id)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	entry, ok := m.OpLog().Get(c)
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown message"))
+	}
+
+	target, err := m.openMessage(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reactions are aggregated on the original messages
+	if target.Reaction != nil || len(target.Supersedes) > 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("only the original messages can be reacted to"))
+	}
+
+	return messageStoreAddMessage(ctx, m.group, m, nil, &protocoltypes.ProtocolMetadata{
+		Reaction: &protocoltypes.MessageReaction{
+			Target: id,
+			Code:   code,
+			Remove: remove,
+		},
+	})
+}
+
+// reactionMember returns the member of the device which sent a reaction
+func reactionMember(gc *GroupContext, devicePK []byte) ([]byte, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	member, err := gc.MetadataStore().GetMemberByDevice(pk)
+	if err != nil {
+		return nil, err
+	}
+
+	memberPK, err := member.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return memberPK, nil
+}
+
+// recordReactions aggregates the reactions to the messages of the group as
+// they are opened, and deletes the reactions to the retracted messages
+func (s *service) recordReactions(gc *GroupContext) {
+	groupPK := gc.Group().PublicKey
+
+	gc.messageStore.setReactionRecorder(func(evt *protocoltypes.GroupMessageEvent, clock uint64) {
+		if evt.Retract {
+			if err := s.reactions.retract(s.ctx, groupPK, evt.Supersedes); err != nil {
+				s.logger.Warn("unable to delete the reactions of a retracted message", logutil.PrivateBinary("cid", evt.Supersedes), zap.Error(err))
+			}
+
+			return
+		}
+
+		memberPK, err := reactionMember(gc, evt.GetHeaders().GetDevicePk())
+		if err != nil {
+			s.logger.Warn("unable to find the member of a message reaction", logutil.PrivateBinary("cid", evt.GetEventContext().GetId()), zap.Error(err))
+			return
+		}
+
+		if err := s.reactions.record(s.ctx, groupPK, memberPK, evt.Reaction, clock, evt.GetEventContext().GetId()); err != nil {
+			s.logger.Warn("unable to record message reaction", logutil.PrivateBinary("cid", evt.GetEventContext().GetId()), zap.Error(err))
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package weshnet
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestCheckReactionCode(t *testing.T) {
+	require.NoError(t, checkReactionCode("👍"))
+	require.NoError(t, checkReactionCode(":tada:"))
+	require.Error(t, checkReactionCode(""))
+	require.Error(t, checkReactionCode(strings.Repeat("x", messageReactionMaxCodeLength+1)))
+	require.Error(t, checkReactionCode("\xff"))
+}
+
+func TestMessageReactions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageReactions(dsync.MutexWrap(ds.NewMapDatastore()))
+
+	group := []byte("group")
+	member1, member2, member3 := []byte("member 1"), []byte("member 2"), []byte("member 3")
+	m1, m2 := []byte("message 1"), []byte("message 2")
+
+	react := func(memberPK []byte, target []byte, code string, remove bool, clock uint64, id string) {
+		require.NoError(t, r.record(ctx, group, memberPK, &protocoltypes.MessageReaction{Target: target, Code: code, Remove: remove}, clock, []byte(id)))
+	}
+
+	react(member1, m1, "👍", false, 1, "a")
+	react(member2, m1, "👍", false, 2, "b")
+	react(member3, m1, "🎉", false, 2, "c")
+	react(member1, m2, "❤️", false, 3, "d")
+
+	// the devices of a member share its reactions
+	react(member1, m1, "👍", false, 2, "e")
+
+	messages, err := r.list(ctx, group, [][]byte{m1}, member1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, m1, messages[0].MessageId)
+
+	// the reactions are ordered by decreasing number of members
+	reactions := messages[0].Reactions
+	require.Len(t, reactions, 2)
+	require.Equal(t, "👍", reactions[0].Code)
+	require.ElementsMatch(t, [][]byte{member1, member2}, reactions[0].MemberPks)
+	require.True(t, reactions[0].Own)
+	require.Equal(t, "🎉", reactions[1].Code)
+	require.False(t, reactions[1].Own)
+
+	// the latest event of a member wins, whatever the order they are
+	// received in and the device they are sent from, the events with the
+	// same clock are ordered by CID
+	react(member1, m1, "👍", true, 5, "f")
+	react(member1, m1, "👍", false, 4, "g")
+	react(member1, m1, "👍", false, 5, "a")
+
+	messages, err = r.list(ctx, group, nil, member1)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	for _, msg := range messages {
+		if string(msg.MessageId) != string(m1) {
+			continue
+		}
+
+		for _, reaction := range msg.Reactions {
+			require.NotContains(t, reaction.MemberPks, member1)
+			require.False(t, reaction.Own)
+		}
+	}
+
+	// a pruned reaction event is forgotten, unless it has been replaced
+	require.NoError(t, r.forget(ctx, group, member2, &protocoltypes.MessageReaction{Target: m1, Code: "👍"}, 2, []byte("b")))
+	require.NoError(t, r.forget(ctx, group, member3, &protocoltypes.MessageReaction{Target: m1, Code: "🎉"}, 2, []byte("other")))
+
+	messages, err = r.list(ctx, group, [][]byte{m1}, member1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Len(t, messages[0].Reactions, 1)
+	require.Equal(t, "🎉", messages[0].Reactions[0].Code)
+
+	// the reactions to a pruned message are deleted
+	require.NoError(t, r.remove(ctx, group, m1))
+
+	messages, err = r.list(ctx, group, nil, member1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, m2, messages[0].MessageId)
+
+	// the reactions to a retracted message are deleted, including the ones
+	// received after the retraction
+	require.NoError(t, r.retract(ctx, group, m2))
+	react(member2, m2, "❤️", false, 6, "h")
+
+	messages, err = r.list(ctx, group, nil, member1)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	messages, err = r.list(ctx, []byte("other group"), nil, member1)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func TestCollapseMessageEventsReactions(t *testing.T) {
+	original := &protocoltypes.GroupMessageEvent{EventContext: &protocoltypes.EventContext{Id: []byte("original")}, Message: []byte("hello")}
+	reaction := &protocoltypes.GroupMessageEvent{
+		EventContext: &protocoltypes.EventContext{Id: []byte("reaction")},
+		Reaction:     &protocoltypes.MessageReaction{Target: []byte("original"), Code: "👍"},
+	}
+
+	collapsed := collapseMessageEvents([]*protocoltypes.GroupMessageEvent{original, reaction})
+	require.Len(t, collapsed, 1)
+	require.Equal(t, []byte("original"), collapsed[0].GetEventContext().GetId())
+}
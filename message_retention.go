@@ -0,0 +1,406 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	ipliface "berty.tech/go-ipfs-log/iface"
+	"berty.tech/go-orbit-db/stores/operation"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/secretstore"
+)
+
+// messageRetentionInterval is the delay between two runs of the message
+// retention janitor
+const messageRetentionInterval = 10 * time.Minute
+
+const (
+	// dsNamespaceRetentionPolicy stores the retention policy of a group
+	dsNamespaceRetentionPolicy = "policy"
+
+	// dsNamespaceRetentionSeen stores the time at which a message has been
+	// seen for the first time, used to enforce the maximum age of messages
+	dsNamespaceRetentionSeen = "seen"
+
+	// dsNamespaceRetentionPruned stores the CIDs of the pruned messages and
+	// the devices which sent them
+	dsNamespaceRetentionPruned = "pruned"
+)
+
+// messageRetention enforces the retention policies of the groups. The pruned
+// entries are kept in the message store log as they are needed to load and
+// replicate it, but their keys are deleted and they are not listed anymore.
+type messageRetention struct {
+	datastore   datastore.Datastore
+	secretStore secretstore.SecretStore
+	logger      *zap.Logger
+
+	// attachments deletes the attachments of the pruned messages, it can be
+	// nil
+	attachments *attachmentStore
+
+	// search removes the pruned messages and the messages whose indexed edit
+	// has been pruned from the search index, it can be nil
+	search *messageSearchIndex
+
+	// reactions deletes the reactions to the pruned messages and the ones
+	// of the pruned reaction events, it can be nil
+	reactions *messageReactions
+
+	// defaultMaxBytes is the storage quota of the groups whose policy
+	// doesn't set one, 0 means no quota
+	defaultMaxBytes uint64
+
+	// nextExpiry is the time of the next expiry of a message of each group,
+	// zero if none is pending. The groups are missing until their expiries
+	// have been read from the datastore.
+	nextExpiry map[string]time.Time
+	muExpiry   sync.Mutex
+}
+
+func newMessageRetention(ds datastore.Datastore, secretStore secretstore.SecretStore, attachments *attachmentStore, search *messageSearchIndex, reactions *messageReactions, defaultMaxBytes uint64, logger *zap.Logger) *messageRetention {
+	return &messageRetention{
+		datastore:       ds,
+		secretStore:     secretStore,
+		attachments:     attachments,
+		search:          search,
+		reactions:       reactions,
+		logger:          logger.Named("retention"),
+		defaultMaxBytes: defaultMaxBytes,
+		nextExpiry:      map[string]time.Time{},
+	}
+}
+
+func dsKeyForRetention(namespace string, groupPK []byte, parts ...string) datastore.Key {
+	return datastore.KeyWithNamespaces(append([]string{
+		namespace,
+		base64.RawURLEncoding.EncodeToString(groupPK),
+	}, parts...))
+}
+
+func isEmptyRetentionPolicy(policy *protocoltypes.MessageRetentionPolicy) bool {
+	return policy.GetMaxAge() <= 0 && policy.GetMaxCount() == 0 && policy.GetMaxBytes() == 0
+}
+
+// getPolicy returns the retention policy of the group, an empty policy if none
+// has been set
+func (r *messageRetention) getPolicy(ctx context.Context, groupPK []byte) (*protocoltypes.MessageRetentionPolicy, error) {
+	data, err := r.datastore.Get(ctx, dsKeyForRetention(dsNamespaceRetentionPolicy, groupPK))
+	if err == datastore.ErrNotFound {
+		return &protocoltypes.MessageRetentionPolicy{}, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	policy := &protocoltypes.MessageRetentionPolicy{}
+	if err := proto.Unmarshal(data, policy); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return policy, nil
+}
+
+// effectivePolicy returns the retention policy of the group completed by the
+// default storage quota
+func (r *messageRetention) effectivePolicy(ctx context.Context, groupPK []byte) (*protocoltypes.MessageRetentionPolicy, error) {
+	policy, err := r.getPolicy(ctx, groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy.MaxBytes == 0 {
+		policy.MaxBytes = r.defaultMaxBytes
+	}
+
+	return policy, nil
+}
+
+// setPolicy sets the retention policy of the group, an empty policy removes it
+func (r *messageRetention) setPolicy(ctx context.Context, groupPK []byte, policy *protocoltypes.MessageRetentionPolicy) error {
+	if policy.GetMaxAge() < 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("max age can't be negative"))
+	}
+
+	key := dsKeyForRetention(dsNamespaceRetentionPolicy, groupPK)
+
+	if isEmptyRetentionPolicy(policy) {
+		if err := r.datastore.Delete(ctx, key); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		return nil
+	}
+
+	data, err := proto.Marshal(policy)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := r.datastore.Put(ctx, key, data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// isPruned returns true if the message has been pruned from the group
+func (r *messageRetention) isPruned(ctx context.Context, groupPK []byte, id cid.Cid) bool {
+	has, err := r.datastore.Has(ctx, dsKeyForRetention(dsNamespaceRetentionPruned, groupPK, id.String()))
+	return err == nil && has
+}
+
+// prunedSender returns the device which sent a pruned message, nil if the
+// message hasn't been pruned or has been pruned before its sender was recorded
+func (r *messageRetention) prunedSender(ctx context.Context, groupPK []byte, id cid.Cid) []byte {
+	devicePK, err := r.datastore.Get(ctx, dsKeyForRetention(dsNamespaceRetentionPruned, groupPK, id.String()))
+	if err != nil || len(devicePK) == 0 {
+		return nil
+	}
+
+	return devicePK
+}
+
+// firstSeen returns the time at which the message has been seen for the
+// first time, now if it hasn't been seen before
+func (r *messageRetention) firstSeen(ctx context.Context, groupPK []byte, id cid.Cid, now time.Time) (time.Time, error) {
+	key := dsKeyForRetention(dsNamespaceRetentionSeen, groupPK, id.String())
+
+	data, err := r.datastore.Get(ctx, key)
+	if err == nil && len(data) == 8 {
+		return time.Unix(int64(binary.BigEndian.Uint64(data)), 0), nil
+	} else if err != nil && err != datastore.ErrNotFound {
+		return time.Time{}, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(now.Unix()))
+
+	if err := r.datastore.Put(ctx, key, data); err != nil {
+		return time.Time{}, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return now, nil
+}
+
+// entriesToPrune returns the entries exceeding the policy, entries are
+// ordered from the oldest to the newest and must not contain pruned entries
+func (r *messageRetention) entriesToPrune(ctx context.Context, groupPK []byte, policy *protocoltypes.MessageRetentionPolicy, entries []ipliface.IPFSLogEntry, now time.Time) ([]ipliface.IPFSLogEntry, error) {
+	var (
+		toPrune []ipliface.IPFSLogEntry
+		count   uint64
+		size    uint64
+	)
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		seen, err := r.firstSeen(ctx, groupPK, entries[i].GetHash(), now)
+		if err != nil {
+			return nil, err
+		}
+
+		count++
+		size += uint64(len(entries[i].GetPayload()))
+
+		switch {
+		case policy.MaxCount > 0 && count > policy.MaxCount,
+			policy.MaxBytes > 0 && size > policy.MaxBytes,
+			policy.MaxAge > 0 && now.Sub(seen) > time.Duration(policy.MaxAge)*time.Second:
+			toPrune = append(toPrune, entries[i])
+		}
+	}
+
+	return toPrune, nil
+}
+
+// enforce prunes the messages of the group exceeding its retention policy,
+// it returns a summary of the pruned messages, nil if none has been pruned
+func (r *messageRetention) enforce(ctx context.Context, gc *GroupContext, now time.Time) (*protocoltypes.GroupMessagesEvicted, error) {
+	groupPK := gc.Group().GetPublicKey()
+
+	policy, err := r.effectivePolicy(ctx, groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	if isEmptyRetentionPolicy(policy) {
+		return nil, nil
+	}
+
+	entries := []ipliface.IPFSLogEntry(nil)
+	stored := uint64(0)
+	for _, entry := range gc.MessageStore().OpLog().GetEntries().Reverse().Slice() {
+		if !r.isPruned(ctx, groupPK, entry.GetHash()) {
+			entries = append(entries, entry)
+			stored += uint64(len(entry.GetPayload()))
+		}
+	}
+
+	toPrune, err := r.entriesToPrune(ctx, groupPK, policy, entries, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(toPrune) == 0 {
+		return nil, nil
+	}
+
+	evicted := &protocoltypes.GroupMessagesEvicted{}
+	for _, entry := range toPrune {
+		if err := r.prune(ctx, gc, entry); err != nil {
+			return nil, err
+		}
+
+		evicted.MessageIds = append(evicted.MessageIds, entry.GetHash().Bytes())
+		evicted.EvictedBytes += uint64(len(entry.GetPayload()))
+	}
+
+	evicted.StoredBytes = stored - evicted.EvictedBytes
+
+	return evicted, nil
+}
+
+// prune deletes the key, the attachments, the search entry and the reactions
+// of the message and marks it as pruned. The edits, retractions and reactions
+// are aggregated on the message they target, what they contributed is removed
+// along with them.
+func (r *messageRetention) prune(ctx context.Context, gc *GroupContext, entry ipliface.IPFSLogEntry) error {
+	groupPK := gc.Group().GetPublicKey()
+	id := entry.GetHash()
+
+	// the message can't be opened anymore once its key is deleted
+	evt, err := gc.MessageStore().openMessage(ctx, entry)
+	if err != nil {
+		r.logger.Debug("unable to open pruned message", logutil.PrivateString("cid", id.String()), zap.Error(err))
+		evt = nil
+	}
+
+	op, err := operation.ParseOperation(entry)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	_, headers, err := r.secretStore.OpenEnvelopeHeaders(op.GetValue(), gc.Group())
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(headers.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	groupPublicKey, err := gc.Group().GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if err := r.secretStore.DeleteMessageKey(ctx, groupPublicKey, devicePK, headers.Counter, id); err != nil {
+		return err
+	}
+
+	if r.attachments != nil {
+		if err := r.attachments.release(ctx, groupPK, id); err != nil {
+			return err
+		}
+	}
+
+	if r.search != nil {
+		if err := r.search.remove(ctx, groupPK, id.Bytes()); err != nil {
+			return err
+		}
+
+		if len(evt.GetSupersedes()) > 0 {
+			if err := r.search.removeVersion(ctx, groupPK, evt.Supersedes, id.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.reactions != nil {
+		if err := r.reactions.remove(ctx, groupPK, id.Bytes()); err != nil {
+			return err
+		}
+
+		if reaction := evt.GetReaction(); reaction != nil {
+			memberPK, err := reactionMember(gc, headers.DevicePk)
+			if err != nil {
+				r.logger.Debug("unable to find the member of a pruned reaction", logutil.PrivateString("cid", id.String()), zap.Error(err))
+			} else if err := r.reactions.forget(ctx, groupPK, memberPK, reaction, uint64(entry.GetClock().GetTime()), id.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+
+	// the sender is kept to check the edits of the message once it has
+	// been removed from the log
+	if err := r.datastore.Put(ctx, dsKeyForRetention(dsNamespaceRetentionPruned, groupPK, id.String()), headers.DevicePk); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := r.datastore.Delete(ctx, dsKeyForRetention(dsNamespaceRetentionSeen, groupPK, id.String())); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	r.logger.Debug("message pruned", logutil.PrivateString("cid", id.String()))
+
+	return nil
+}
+
+// startMessageRetentionJanitor periodically prunes the messages of the opened
+// groups according to their retention policy
+func (s *service) startMessageRetentionJanitor() {
+	go func() {
+		ticker := time.NewTicker(messageRetentionInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.ctx.Done():
+				return
+			}
+
+			s.lock.RLock()
+			groups := make([]*GroupContext, 0, len(s.openedGroups))
+			for _, gc := range s.openedGroups {
+				if gc.Group().GroupType != protocoltypes.GroupType_GroupTypeAccount {
+					groups = append(groups, gc)
+				}
+			}
+			s.lock.RUnlock()
+
+			for _, gc := range groups {
+				if gc.IsClosed() {
+					continue
+				}
+
+				evicted, err := s.retention.enforce(s.ctx, gc, time.Now())
+				if err != nil {
+					s.logger.Error("unable to enforce message retention policy", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Error(err))
+					continue
+				}
+
+				if evicted == nil {
+					continue
+				}
+
+				s.logger.Debug("pruned messages", logutil.PrivateBinary("group", gc.Group().GetPublicKey()), zap.Int("count", len(evicted.MessageIds)))
+
+				if err := gc.MetadataStore().emitLocalEvent(protocoltypes.EventType_EventTypeGroupMessagesEvicted, evicted); err != nil {
+					s.logger.Warn("unable to emit messages evicted event", zap.Error(err))
+				}
+			}
+		}
+	}()
+}
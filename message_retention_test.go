@@ -0,0 +1,118 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"berty.tech/go-ipfs-log/entry"
+	ipliface "berty.tech/go-ipfs-log/iface"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestMessageRetentionPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageRetention(dsync.MutexWrap(ds.NewMapDatastore()), nil, nil, nil, nil, 0, zap.NewNop())
+	groupPK := []byte("group")
+
+	policy, err := r.getPolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.True(t, isEmptyRetentionPolicy(policy))
+
+	require.Error(t, r.setPolicy(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxAge: -1}))
+
+	require.NoError(t, r.setPolicy(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxCount: 10}))
+	policy, err = r.getPolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), policy.MaxCount)
+
+	// other groups are not affected
+	policy, err = r.getPolicy(ctx, []byte("other group"))
+	require.NoError(t, err)
+	require.True(t, isEmptyRetentionPolicy(policy))
+
+	require.NoError(t, r.setPolicy(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{}))
+	policy, err = r.getPolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.True(t, isEmptyRetentionPolicy(policy))
+}
+
+func TestMessageRetentionEntriesToPrune(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageRetention(dsync.MutexWrap(ds.NewMapDatastore()), nil, nil, nil, nil, 0, zap.NewNop())
+	groupPK := []byte("group")
+
+	ids := []string{
+		"QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ",
+		"QmbdQXQh9B2bWZgZJqfbjNPV5jGN2owbQ3vjeYsaDaCDqU",
+		"Qmf8oj9wbfu73prNAA1cRQVDqA52gD5B3ApnYQQjcjffH4",
+	}
+
+	// entries are ordered from the oldest to the newest
+	entries := make([]ipliface.IPFSLogEntry, len(ids))
+	for i, idStr := range ids {
+		id, err := cid.Parse(idStr)
+		require.NoError(t, err)
+
+		entries[i] = &entry.Entry{Hash: id, Payload: make([]byte, 10)}
+	}
+
+	now := time.Now()
+
+	toPrune, err := r.entriesToPrune(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxCount: 2}, entries, now)
+	require.NoError(t, err)
+	require.Equal(t, []ipliface.IPFSLogEntry{entries[0]}, toPrune)
+
+	toPrune, err = r.entriesToPrune(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxBytes: 15}, entries, now)
+	require.NoError(t, err)
+	require.Equal(t, []ipliface.IPFSLogEntry{entries[1], entries[0]}, toPrune)
+
+	// entries have been seen for the first time during the previous calls
+	toPrune, err = r.entriesToPrune(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxAge: 3600}, entries, now.Add(30*time.Minute))
+	require.NoError(t, err)
+	require.Empty(t, toPrune)
+
+	toPrune, err = r.entriesToPrune(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxAge: 3600}, entries, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, toPrune, 3)
+}
+
+func TestMessageRetentionDefaultQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newMessageRetention(dsync.MutexWrap(ds.NewMapDatastore()), nil, nil, nil, nil, 1024, zap.NewNop())
+	groupPK := []byte("group")
+
+	// the default quota applies to groups without a policy
+	policy, err := r.effectivePolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1024), policy.MaxBytes)
+
+	require.NoError(t, r.setPolicy(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxCount: 10}))
+	policy, err = r.effectivePolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), policy.MaxCount)
+	require.Equal(t, uint64(1024), policy.MaxBytes)
+
+	// a quota set for the group replaces the default one
+	require.NoError(t, r.setPolicy(ctx, groupPK, &protocoltypes.MessageRetentionPolicy{MaxBytes: 4096}))
+	policy, err = r.effectivePolicy(ctx, groupPK)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4096), policy.MaxBytes)
+
+	// the stored policy is left untouched
+	policy, err = r.getPolicy(ctx, []byte("other group"))
+	require.NoError(t, err)
+	require.True(t, isEmptyRetentionPolicy(policy))
+}
@@ -0,0 +1,569 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// dsNamespaceSearchTerms stores the postings of the terms, keyed by the
+	// keyed hash of the term, the group and the message
+	dsNamespaceSearchTerms = "terms"
+
+	// dsNamespaceSearchDocs stores the terms of the indexed messages, used to
+	// update and remove their postings
+	dsNamespaceSearchDocs = "docs"
+
+	// dsNamespaceSearchTombstones stores the messages which are not indexed
+	// anymore, so they aren't indexed again when they are listed
+	dsNamespaceSearchTombstones = "tombstones"
+
+	// namespaceMessageSearchKey is used to derive the keys of the index from
+	// the secret of the account group
+	namespaceMessageSearchKey = "weshnet/message-search"
+
+	// messageSearchDefaultLimit is the number of results returned when the
+	// request doesn't set a limit
+	messageSearchDefaultLimit = 20
+
+	messageSearchMinTermLength = 2
+	messageSearchMaxTermLength = 64
+
+	// messageSearchK1 controls the saturation of the frequency of the terms
+	// in the ranking of the results
+	messageSearchK1 = 1.2
+)
+
+// messageSearchIndex is a full-text index of the decrypted messages. The
+// terms are stored as keyed hashes and the values are sealed with a key
+// derived from the account group secret, so the index doesn't leak the
+// content of the messages. The edits replace the indexed text of the message
+// they supersede and the retracted messages are removed.
+type messageSearchIndex struct {
+	datastore datastore.Datastore
+	sealKey   *[32]byte
+	termKey   []byte
+
+	// mu serializes the updates of the indexed messages
+	mu sync.Mutex
+}
+
+type messageSearchDoc struct {
+	// clock is the lamport time of the indexed version of the message, an
+	// update is only applied if it is more recent
+	clock uint64
+
+	// version is the CID of the indexed version, the message itself or its
+	// latest edit
+	version []byte
+
+	terms map[string]uint32
+}
+
+type messageSearchResult struct {
+	groupPK []byte
+	id      []byte
+	score   float64
+}
+
+func newMessageSearchIndex(ds datastore.Datastore, secret []byte) (*messageSearchIndex, error) {
+	if len(secret) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no secret provided"))
+	}
+
+	keys := make([]byte, cryptoutil.KeySize*2)
+	kdf := hkdf.New(sha3.New256, secret, nil, []byte(namespaceMessageSearchKey))
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	sealKey, err := cryptoutil.KeySliceToArray(keys[:cryptoutil.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &messageSearchIndex{
+		datastore: ds,
+		sealKey:   sealKey,
+		termKey:   keys[cryptoutil.KeySize:],
+	}, nil
+}
+
+// tokenizeMessage returns the terms of a text and their frequency, the terms
+// are the lowercased runs of letters and digits
+func tokenizeMessage(text string) map[string]uint32 {
+	terms := map[string]uint32{}
+
+	for _, term := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if l := utf8.RuneCountInString(term); l < messageSearchMinTermLength || l > messageSearchMaxTermLength {
+			continue
+		}
+
+		terms[term]++
+	}
+
+	return terms
+}
+
+func dsKeyForSearch(namespace string, parts ...[]byte) datastore.Key {
+	namespaces := []string{namespace}
+	for _, part := range parts {
+		namespaces = append(namespaces, base64.RawURLEncoding.EncodeToString(part))
+	}
+
+	return datastore.KeyWithNamespaces(namespaces)
+}
+
+func (idx *messageSearchIndex) hashTerm(term string) []byte {
+	mac := hmac.New(sha256.New, idx.termKey)
+	mac.Write([]byte(term))
+
+	return mac.Sum(nil)
+}
+
+func (idx *messageSearchIndex) seal(data []byte) ([]byte, error) {
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], data, nonce, idx.sealKey), nil
+}
+
+func (idx *messageSearchIndex) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < cryptoutil.NonceSize {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("sealed value too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secretbox.Open(nil, sealed[cryptoutil.NonceSize:], nonce, idx.sealKey)
+	if !ok {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open index value"))
+	}
+
+	return data, nil
+}
+
+// marshalSearchDoc encodes the clock, the version and the hashes of the terms
+// with their frequency
+func marshalSearchDoc(doc *messageSearchDoc) []byte {
+	buf := make([]byte, 0, 10+len(doc.version)+len(doc.terms)*(sha256.Size+4))
+	buf = binary.BigEndian.AppendUint64(buf, doc.clock)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(doc.version)))
+	buf = append(buf, doc.version...)
+
+	for hash, tf := range doc.terms {
+		buf = append(buf, hash...)
+		buf = binary.BigEndian.AppendUint32(buf, tf)
+	}
+
+	return buf
+}
+
+func unmarshalSearchDoc(data []byte) (*messageSearchDoc, error) {
+	if len(data) < 10 {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid index document"))
+	}
+
+	doc := &messageSearchDoc{
+		clock: binary.BigEndian.Uint64(data),
+		terms: map[string]uint32{},
+	}
+
+	l := int(binary.BigEndian.Uint16(data[8:]))
+	data = data[10:]
+	if len(data) < l || (len(data)-l)%(sha256.Size+4) != 0 {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid index document"))
+	}
+
+	doc.version, data = data[:l], data[l:]
+	for ; len(data) > 0; data = data[sha256.Size+4:] {
+		doc.terms[string(data[:sha256.Size])] = binary.BigEndian.Uint32(data[sha256.Size:])
+	}
+
+	return doc, nil
+}
+
+// getDoc returns the indexed message, or its tombstone, nil if the message
+// has never been indexed
+func (idx *messageSearchIndex) getDoc(ctx context.Context, groupPK, id []byte) (*messageSearchDoc, error) {
+	for _, namespace := range []string{dsNamespaceSearchDocs, dsNamespaceSearchTombstones} {
+		sealed, err := idx.datastore.Get(ctx, dsKeyForSearch(namespace, groupPK, id))
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		data, err := idx.open(sealed)
+		if err != nil {
+			return nil, err
+		}
+
+		return unmarshalSearchDoc(data)
+	}
+
+	return nil, nil
+}
+
+func (idx *messageSearchIndex) putSealed(ctx context.Context, key datastore.Key, data []byte) error {
+	sealed, err := idx.seal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := idx.datastore.Put(ctx, key, sealed); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// update replaces the indexed text of the message id with text, the message
+// is removed from the index if text is nil. The update is ignored if the
+// message has been updated with a more recent clock.
+func (idx *messageSearchIndex) update(ctx context.Context, groupPK, id []byte, clock uint64, version []byte, text []byte) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	current, err := idx.getDoc(ctx, groupPK, id)
+	if err != nil {
+		return err
+	} else if current != nil && current.clock >= clock {
+		return nil
+	}
+
+	if current != nil {
+		for hash := range current.terms {
+			if err := idx.datastore.Delete(ctx, dsKeyForSearch(dsNamespaceSearchTerms, []byte(hash), groupPK, id)); err != nil {
+				return errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+		}
+	}
+
+	doc := &messageSearchDoc{clock: clock, version: version, terms: map[string]uint32{}}
+	if utf8.Valid(text) {
+		for term, tf := range tokenizeMessage(string(text)) {
+			doc.terms[string(idx.hashTerm(term))] = tf
+		}
+	}
+
+	// the messages without terms are recorded as tombstones, they don't
+	// count in the ranking of the results
+	if len(doc.terms) == 0 {
+		if err := idx.datastore.Delete(ctx, dsKeyForSearch(dsNamespaceSearchDocs, groupPK, id)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		return idx.putSealed(ctx, dsKeyForSearch(dsNamespaceSearchTombstones, groupPK, id), marshalSearchDoc(doc))
+	}
+
+	for hash, tf := range doc.terms {
+		if err := idx.putSealed(ctx, dsKeyForSearch(dsNamespaceSearchTerms, []byte(hash), groupPK, id), binary.BigEndian.AppendUint32(nil, tf)); err != nil {
+			return err
+		}
+	}
+
+	if err := idx.putSealed(ctx, dsKeyForSearch(dsNamespaceSearchDocs, groupPK, id), marshalSearchDoc(doc)); err != nil {
+		return err
+	}
+
+	if err := idx.datastore.Delete(ctx, dsKeyForSearch(dsNamespaceSearchTombstones, groupPK, id)); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// add indexes a message, the edits update the message they supersede and
+// the retractions remove it, the reactions aren't indexed
+func (idx *messageSearchIndex) add(ctx context.Context, evt *protocoltypes.GroupMessageEvent, clock uint64) error {
+	groupPK := evt.GetEventContext().GetGroupPk()
+	id := evt.GetEventContext().GetId()
+
+	switch {
+	case evt.Reaction != nil:
+		return nil
+	case evt.Retract:
+		return idx.update(ctx, groupPK, evt.Supersedes, clock, id, nil)
+	case len(evt.Supersedes) > 0:
+		return idx.update(ctx, groupPK, evt.Supersedes, clock, id, evt.Message)
+	default:
+		return idx.update(ctx, groupPK, id, clock, id, evt.Message)
+	}
+}
+
+// remove deletes a message from the index, it won't be indexed again
+func (idx *messageSearchIndex) remove(ctx context.Context, groupPK, id []byte) error {
+	return idx.update(ctx, groupPK, id, math.MaxUint64, id, nil)
+}
+
+// removeVersion deletes a message from the index if its indexed text is the
+// one of the given version, it is called once an edit has been pruned
+func (idx *messageSearchIndex) removeVersion(ctx context.Context, groupPK, id, version []byte) error {
+	current, err := idx.version(ctx, groupPK, id)
+	if err != nil || !bytes.Equal(current, version) {
+		return err
+	}
+
+	return idx.remove(ctx, groupPK, id)
+}
+
+// removeGroup deletes the messages of a group from the index along with their
+// tombstones, so they are indexed again if the group is replicated again
+func (idx *messageSearchIndex) removeGroup(ctx context.Context, groupPK []byte) error {
+	for _, namespace := range []string{dsNamespaceSearchDocs, dsNamespaceSearchTombstones} {
+		prefix := dsKeyForSearch(namespace, groupPK).String() + "/"
+
+		results, err := idx.datastore.Query(ctx, query.Query{Prefix: prefix, KeysOnly: true})
+		if err != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		entries, err := results.Rest()
+		if err != nil {
+			return errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		for _, entry := range entries {
+			// removing an indexed message drops its postings and leaves a
+			// tombstone, deleted with the others
+			if namespace == dsNamespaceSearchDocs {
+				id, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(entry.Key, prefix))
+				if err != nil {
+					return errcode.ErrCode_ErrDeserialization.Wrap(err)
+				}
+
+				if err := idx.remove(ctx, groupPK, id); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err := idx.datastore.Delete(ctx, datastore.RawKey(entry.Key)); err != nil {
+				return errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// version returns the CID of the indexed version of the message, nil if it
+// isn't indexed
+func (idx *messageSearchIndex) version(ctx context.Context, groupPK, id []byte) ([]byte, error) {
+	doc, err := idx.getDoc(ctx, groupPK, id)
+	if err != nil || doc == nil || len(doc.terms) == 0 {
+		return nil, err
+	}
+
+	return doc.version, nil
+}
+
+func (idx *messageSearchIndex) count(ctx context.Context, prefix datastore.Key) (int, error) {
+	results, err := idx.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return len(entries), nil
+}
+
+// search returns the messages containing all the terms of the query, in the
+// group if groupPK is set, ranked by decreasing relevance, and the number of
+// matching messages
+func (idx *messageSearchIndex) search(ctx context.Context, q string, groupPK []byte, offset, limit uint32) ([]*messageSearchResult, uint32, error) {
+	terms := tokenizeMessage(q)
+	if len(terms) == 0 {
+		return nil, 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no term to search"))
+	}
+
+	if limit == 0 {
+		limit = messageSearchDefaultLimit
+	}
+
+	scope := [][]byte(nil)
+	if len(groupPK) > 0 {
+		scope = append(scope, groupPK)
+	}
+
+	total, err := idx.count(ctx, dsKeyForSearch(dsNamespaceSearchDocs, scope...))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		results = map[string]*messageSearchResult{}
+		matches = map[string]int{}
+	)
+
+	for term := range terms {
+		postings, err := idx.datastore.Query(ctx, query.Query{Prefix: dsKeyForSearch(dsNamespaceSearchTerms, append([][]byte{idx.hashTerm(term)}, scope...)...).String()})
+		if err != nil {
+			return nil, 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		entries, err := postings.Rest()
+		if err != nil {
+			return nil, 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		idf := math.Log(1 + float64(total)/float64(len(entries)))
+
+		for _, entry := range entries {
+			namespaces := datastore.RawKey(entry.Key).Namespaces()
+			if len(namespaces) != 4 {
+				continue
+			}
+
+			data, err := idx.open(entry.Value)
+			if err != nil || len(data) != 4 {
+				continue
+			}
+
+			tf := float64(binary.BigEndian.Uint32(data))
+
+			key := namespaces[2] + "/" + namespaces[3]
+			result, ok := results[key]
+			if !ok {
+				group, errGroup := base64.RawURLEncoding.DecodeString(namespaces[2])
+				id, errID := base64.RawURLEncoding.DecodeString(namespaces[3])
+				if errGroup != nil || errID != nil {
+					continue
+				}
+
+				result = &messageSearchResult{groupPK: group, id: id}
+				results[key] = result
+			}
+
+			result.score += idf * tf * (messageSearchK1 + 1) / (tf + messageSearchK1)
+			matches[key]++
+		}
+	}
+
+	ranked := []*messageSearchResult(nil)
+	for key, result := range results {
+		if matches[key] == len(terms) {
+			ranked = append(ranked, result)
+		}
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+
+		if c := bytes.Compare(ranked[i].groupPK, ranked[j].groupPK); c != 0 {
+			return c < 0
+		}
+
+		return bytes.Compare(ranked[i].id, ranked[j].id) < 0
+	})
+
+	count := uint32(len(ranked))
+	if offset >= count {
+		return nil, count, nil
+	}
+
+	ranked = ranked[offset:]
+	if uint32(len(ranked)) > limit {
+		ranked = ranked[:limit]
+	}
+
+	return ranked, count, nil
+}
+
+// indexMessages maintains the search index as the messages of the group are
+// decrypted
+func (s *service) indexMessages(gc *GroupContext) {
+	if s.messageSearch == nil {
+		return
+	}
+
+	gc.messageStore.setMessageIndexer(func(evt *protocoltypes.GroupMessageEvent, clock uint64) {
+		if err := s.messageSearch.add(s.ctx, evt, clock); err != nil {
+			s.logger.Warn("unable to index message", logutil.PrivateBinary("cid", evt.GetEventContext().GetId()), zap.Error(err))
+		}
+	})
+}
+
+// openSearchResult returns the indexed version of a message, the group must
+// be activated
+func (s *service) openSearchResult(ctx context.Context, result *messageSearchResult) (*protocoltypes.GroupMessageEvent, error) {
+	gc, err := s.getOpenedGroup(result.groupPK)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := s.messageSearch.version(ctx, result.groupPK, result.id)
+	if err != nil {
+		return nil, err
+	}
+
+	open := func(id []byte) (*protocoltypes.GroupMessageEvent, error) {
+		c, err := cid.Cast(id)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		}
+
+		entry, ok := gc.MessageStore().OpLog().Get(c)
+		if !ok {
+			return nil, errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("unknown message"))
+		}
+
+		return gc.MessageStore().openMessage(ctx, entry)
+	}
+
+	evt, err := open(result.id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(version) == 0 || bytes.Equal(version, result.id) {
+		return evt, nil
+	}
+
+	edit, err := open(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return collapseMessageEvents([]*protocoltypes.GroupMessageEvent{evt, edit})[0], nil
+}
@@ -0,0 +1,165 @@
+package weshnet
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func newTestSearchEvent(groupPK []byte, id string, message string) *protocoltypes.GroupMessageEvent {
+	return &protocoltypes.GroupMessageEvent{
+		EventContext: &protocoltypes.EventContext{GroupPk: groupPK, Id: []byte(id)},
+		Message:      []byte(message),
+	}
+}
+
+func searchResultIDs(results []*messageSearchResult) []string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = string(result.id)
+	}
+
+	return ids
+}
+
+func TestTokenizeMessage(t *testing.T) {
+	require.Equal(t, map[string]uint32{
+		"hello":   2,
+		"world":   1,
+		"café":    1,
+		"42":      1,
+		"weshnet": 1,
+	}, tokenizeMessage("Hello, world! HELLO café a 42 weshnet"))
+
+	require.Empty(t, tokenizeMessage("a b c "+strings.Repeat("x", messageSearchMaxTermLength+1)))
+}
+
+func TestMessageSearchIndex(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	idx, err := newMessageSearchIndex(datastore, []byte("account group secret"))
+	require.NoError(t, err)
+
+	group1, group2 := []byte("group 1"), []byte("group 2")
+
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group1, "m1", "lunch at noon"), 1))
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group1, "m2", "lunch lunch lunch tomorrow"), 2))
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group2, "m3", "no lunch today"), 1))
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group2, "m4", "something else"), 2))
+
+	// the terms and the messages are not stored in clear
+	results, err := datastore.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Key, "lunch")
+		require.NotContains(t, string(entry.Value), "lunch")
+	}
+
+	// the message with the most occurrences is ranked first
+	found, total, err := idx.search(ctx, "LUNCH", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), total)
+	require.Equal(t, "m2", string(found[0].id))
+	require.ElementsMatch(t, []string{"m1", "m2", "m3"}, searchResultIDs(found))
+
+	// all the terms must match
+	found, total, err = idx.search(ctx, "lunch today", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), total)
+	require.Equal(t, []string{"m3"}, searchResultIDs(found))
+	require.Equal(t, group2, found[0].groupPK)
+
+	// per group search
+	found, total, err = idx.search(ctx, "lunch", group1, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), total)
+	require.Equal(t, []string{"m2", "m1"}, searchResultIDs(found))
+
+	// pagination
+	found, total, err = idx.search(ctx, "lunch", nil, 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), total)
+	require.Len(t, found, 1)
+
+	found, _, err = idx.search(ctx, "lunch", nil, 3, 1)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	_, _, err = idx.search(ctx, "a !", nil, 0, 0)
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	// an edit replaces the indexed text of the message it supersedes
+	edit := newTestSearchEvent(group1, "e1", "dinner at eight")
+	edit.Supersedes = []byte("m1")
+	require.NoError(t, idx.add(ctx, edit, 3))
+
+	found, _, err = idx.search(ctx, "lunch", group1, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"m2"}, searchResultIDs(found))
+
+	found, _, err = idx.search(ctx, "dinner", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"m1"}, searchResultIDs(found))
+
+	version, err := idx.version(ctx, group1, []byte("m1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("e1"), version)
+
+	// listing the original message again doesn't restore its text
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group1, "m1", "lunch at noon"), 1))
+	found, _, err = idx.search(ctx, "noon", nil, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	// pruning an older edit keeps the indexed one
+	require.NoError(t, idx.removeVersion(ctx, group1, []byte("m1"), []byte("e0")))
+	found, _, err = idx.search(ctx, "dinner", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"m1"}, searchResultIDs(found))
+
+	// pruning the indexed edit removes the message
+	require.NoError(t, idx.removeVersion(ctx, group1, []byte("m1"), []byte("e1")))
+	found, _, err = idx.search(ctx, "dinner", nil, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	// a retraction removes the message
+	retract := newTestSearchEvent(group1, "r1", "")
+	retract.Supersedes = []byte("m2")
+	retract.Retract = true
+	require.NoError(t, idx.add(ctx, retract, 4))
+
+	found, total, err = idx.search(ctx, "lunch", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), total)
+	require.Equal(t, []string{"m3"}, searchResultIDs(found))
+
+	// the removed messages are not indexed again
+	require.NoError(t, idx.remove(ctx, group2, []byte("m3")))
+	require.NoError(t, idx.add(ctx, newTestSearchEvent(group2, "m3", "no lunch today"), 1))
+
+	found, total, err = idx.search(ctx, "lunch", nil, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), total)
+	require.Empty(t, found)
+
+	// the index can't be read with another secret
+	other, err := newMessageSearchIndex(datastore, []byte("another secret"))
+	require.NoError(t, err)
+
+	found, _, err = other.search(ctx, "dinner", nil, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, found)
+}
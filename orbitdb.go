@@ -28,6 +28,7 @@ import (
 	"berty.tech/go-orbit-db/iface"
 	"berty.tech/go-orbit-db/pubsub/pubsubcoreapi"
 	"berty.tech/go-orbit-db/stores"
+	"berty.tech/weshnet/v2/internal/datastoreutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
@@ -98,9 +99,10 @@ func (n *NewOrbitDBOptions) applyDefaults() {
 }
 
 type (
-	GroupMap           = sync.Map
-	GroupContextMap    = sync.Map
-	GroupsSigPubKeyMap = sync.Map
+	GroupMap                 = sync.Map
+	GroupContextMap          = sync.Map
+	GroupsSigPubKeyMap       = sync.Map
+	GroupAccessControllerMap = sync.Map
 )
 
 type WeshOrbitDB struct {
@@ -108,8 +110,12 @@ type WeshOrbitDB struct {
 	keyStore           *BertySignedKeyStore
 	secretStore        secretstore.SecretStore
 	pubSub             iface.PubSubInterface
+	lanes              *sendLanes
 	rotationInterval   *rendezvous.RotationInterval
 	messageMarshaler   *OrbitDBMessageMarshaler
+	logCompaction      *logCompaction
+	indexCache         *metadataIndexCache
+	syncState          *storeSyncState
 	replicationMode    bool
 	prometheusRegister prometheus.Registerer
 
@@ -121,6 +127,8 @@ type WeshOrbitDB struct {
 	groups          *GroupMap           // map[string]*protocoltypes.Group
 	groupContexts   *GroupContextMap    // map[string]*GroupContext
 	groupsSigPubKey *GroupsSigPubKeyMap // map[string]crypto.PubKey
+
+	groupAccessControllers *GroupAccessControllerMap // map[string]GroupAccessController
 }
 
 func (s *WeshOrbitDB) registerGroupPrivateKey(g *protocoltypes.Group) error {
@@ -186,7 +194,14 @@ func NewWeshOrbitDB(ctx context.Context, ipfs coreiface.CoreAPI, options *NewOrb
 		options.PubSub = pubsubcoreapi.NewPubSub(ipfs, self.ID(), time.Second, options.Logger, options.Tracer)
 	}
 
+	// the heads of the stores are published in the lanes of their entries
+	lanes := newSendLanes()
+	options.PubSub = &prioritizedPubSub{PubSubInterface: options.PubSub, lanes: lanes}
+
+	syncState := newStoreSyncState()
+
 	mm := NewOrbitDBMessageMarshaler(self.ID(), options.SecretStore, options.RotationInterval, options.ReplicationMode)
+	mm.syncState = syncState
 	options.MessageMarshaler = mm
 
 	orbitDB, err := baseorbitdb.NewOrbitDB(ctx, ipfs, &options.NewOrbitDBOptions)
@@ -202,16 +217,21 @@ func NewWeshOrbitDB(ctx context.Context, ipfs coreiface.CoreAPI, options *NewOrb
 		secretStore:            options.SecretStore,
 		rotationInterval:       options.RotationInterval,
 		pubSub:                 options.PubSub,
+		lanes:                  lanes,
 		groups:                 &GroupMap{},
-		groupContexts:          &GroupContextMap{},    // map[string]*GroupContext
-		groupsSigPubKey:        &GroupsSigPubKeyMap{}, // map[string]crypto.PubKey
+		groupContexts:          &GroupContextMap{},          // map[string]*GroupContext
+		groupsSigPubKey:        &GroupsSigPubKeyMap{},       // map[string]crypto.PubKey
+		groupAccessControllers: &GroupAccessControllerMap{}, // map[string]GroupAccessController
 		groupMetadataStoreType: options.GroupMetadataStoreType,
 		groupMessageStoreType:  options.GroupMessageStoreType,
 		replicationMode:        options.ReplicationMode,
 		prometheusRegister:     options.PrometheusRegister,
+		syncState:              syncState,
+		logCompaction:          newLogCompaction(datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceLogCompaction))),
+		indexCache:             newMetadataIndexCache(datastoreutil.NewNamespacedDatastore(options.Datastore, datastore.NewKey(NamespaceIndexCache))),
 	}
 
-	if err := bertyDB.RegisterAccessControllerType(NewSimpleAccessController); err != nil {
+	if err := bertyDB.RegisterAccessControllerType(bertyDB.newAccessController); err != nil {
 		return nil, errcode.ErrCode_TODO.Wrap(err)
 	}
 	bertyDB.RegisterStoreType(bertyDB.groupMetadataStoreType, constructorFactoryGroupMetadata(bertyDB, options.Logger))
@@ -371,6 +391,9 @@ func (s *WeshOrbitDB) loadHeads(ctx context.Context, store iface.Store, heads []
 				}
 			}
 
+		case <-ctx.Done():
+			return ctx.Err()
+
 		case <-s.ctx.Done():
 			return s.ctx.Err()
 		}
@@ -380,6 +403,13 @@ func (s *WeshOrbitDB) loadHeads(ctx context.Context, store iface.Store, heads []
 }
 
 func (s *WeshOrbitDB) OpenGroup(ctx context.Context, g *protocoltypes.Group, options *orbitdb.CreateDBOptions) (*GroupContext, error) {
+	return s.OpenGroupWithOptions(ctx, g, options, nil)
+}
+
+// OpenGroupWithOptions opens the stores of the group like OpenGroup, the
+// access controller of groupOptions is installed on them, groupOptions can be
+// nil. The options of a group already opened are left unchanged.
+func (s *WeshOrbitDB) OpenGroupWithOptions(ctx context.Context, g *protocoltypes.Group, options *orbitdb.CreateDBOptions, groupOptions *GroupOptions) (*GroupContext, error) {
 	if s.secretStore == nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("db open in naive mode"))
 	}
@@ -396,6 +426,12 @@ func (s *WeshOrbitDB) OpenGroup(ctx context.Context, g *protocoltypes.Group, opt
 
 	s.groups.Store(groupID, g)
 
+	if groupOptions != nil && groupOptions.AccessController != nil {
+		s.groupAccessControllers.Store(groupID, groupOptions.AccessController)
+	} else {
+		s.groupAccessControllers.Delete(groupID)
+	}
+
 	if err := s.registerGroupPrivateKey(g); err != nil {
 		return nil, err
 	}
@@ -586,6 +622,30 @@ func (s *WeshOrbitDB) storeForGroup(ctx context.Context, o iface.BaseOrbitDB, g
 	return store, nil
 }
 
+// groupStoreTopics returns the pubsub topics of the metadata and message stores
+// of a group without opening them
+func (s *WeshOrbitDB) groupStoreTopics(ctx context.Context, g *protocoltypes.Group) ([]string, error) {
+	topics := []string{}
+
+	for _, storeType := range []string{s.groupMetadataStoreType, s.groupMessageStoreType} {
+		ac, err := defaultACForGroup(g, storeType)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
+		}
+
+		name := fmt.Sprintf("%s_%s", g.GroupIDAsString(), storeType)
+
+		addr, err := s.DetermineAddress(ctx, name, storeType, &orbitdb.DetermineAddressOptions{AccessController: ac})
+		if err != nil {
+			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
+		}
+
+		topics = append(topics, addr.String())
+	}
+
+	return topics, nil
+}
+
 func (s *WeshOrbitDB) groupMetadataStore(ctx context.Context, g *protocoltypes.Group, options *orbitdb.CreateDBOptions) (*MetadataStore, error) {
 	if options == nil {
 		options = &orbitdb.CreateDBOptions{}
@@ -21,6 +21,10 @@ type simpleAccessController struct {
 	allowedKeys map[string][]string
 	logger      *zap.Logger
 	lock        sync.RWMutex
+
+	// groupAccess applies the access controller set in the options of the
+	// group, it can be nil
+	groupAccess func(e logac.LogEntry) error
 }
 
 func (o *simpleAccessController) SetLogger(logger *zap.Logger) {
@@ -95,6 +99,10 @@ func (o *simpleAccessController) GetAuthorizedByRole(role string) ([]string, err
 func (o *simpleAccessController) CanAppend(e logac.LogEntry, _ identityprovider.Interface, _ accesscontroller.CanAppendAdditionalContext) error {
 	for _, id := range o.allowedKeys["write"] {
 		if e.GetIdentity().ID == id || id == "*" {
+			if o.groupAccess != nil {
+				return o.groupAccess(e)
+			}
+
 			return nil
 		}
 	}
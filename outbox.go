@@ -0,0 +1,561 @@
+package weshnet
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// outboxInterval is the delay between two runs of the outbox, the
+	// queued messages are retried and the replication of the sent ones is
+	// checked
+	outboxInterval = 5 * time.Second
+
+	// outboxRetryMaxDelay is the maximum delay between two attempts to send
+	// a queued message, the delay doubles from outboxInterval on each failure
+	outboxRetryMaxDelay = 10 * time.Minute
+
+	// outboxInteractiveRetryMaxDelay is the maximum delay between two
+	// attempts to send a queued interactive message
+	outboxInteractiveRetryMaxDelay = time.Minute
+
+	// outboxRetention is the delay after which the replicated and failed
+	// messages are removed from the outbox
+	outboxRetention = 24 * time.Hour
+)
+
+// outbox journals the messages sent with a client message id until they are
+// replicated, the messages which can't be added to their group are retried and
+// the scheduled messages are sent at their scheduled time
+type outbox struct {
+	datastore datastore.Datastore
+
+	// locks serialize the attempts to send each message, so a message isn't
+	// sent twice while a slow group activation doesn't block the others
+	locks   map[string]*outboxLock
+	muLocks sync.Mutex
+
+	// wake triggers an attempt to send the queued messages regardless of
+	// their backoff, when the connectivity returns for instance
+	wake chan struct{}
+
+	// version is incremented on each change of a message
+	version uint64
+	notify  *notify.Notify
+	mu      sync.Mutex
+}
+
+// outboxLock is the lock of a message of the outbox, it is removed once no
+// attempt to send the message is pending
+type outboxLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newOutbox(ds datastore.Datastore) *outbox {
+	o := &outbox{
+		datastore: ds,
+		wake:      make(chan struct{}, 1),
+		locks:     map[string]*outboxLock{},
+	}
+	o.notify = notify.New(&o.mu)
+
+	return o
+}
+
+// lock locks a message of the outbox until the returned function is called
+func (o *outbox) lock(clientMessageID []byte) func() {
+	key := string(clientMessageID)
+
+	o.muLocks.Lock()
+	l, ok := o.locks[key]
+	if !ok {
+		l = &outboxLock{}
+		o.locks[key] = l
+	}
+	l.refs++
+	o.muLocks.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		o.muLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(o.locks, key)
+		}
+		o.muLocks.Unlock()
+	}
+}
+
+// newClientMessageID generates the client message id of a scheduled message
+// sent without one
+func newClientMessageID() ([]byte, error) {
+	id := make([]byte, 16)
+	if _, err := crand.Read(id); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return id, nil
+}
+
+func dsKeyForOutbox(clientMessageID []byte) datastore.Key {
+	return datastore.NewKey(base64.RawURLEncoding.EncodeToString(clientMessageID))
+}
+
+// outboxRetryDelay returns the delay before the next attempt to send a
+// message which failed the given number of times, the interactive messages
+// are retried more often
+func outboxRetryDelay(attempts uint32, priority protocoltypes.SendPriority) time.Duration {
+	maxDelay := outboxRetryMaxDelay
+	if sendLane(priority) == protocoltypes.SendPriority_SendPriorityInteractive {
+		maxDelay = outboxInteractiveRetryMaxDelay
+	}
+
+	delay := outboxInterval
+	for i := uint32(1); i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay
+}
+
+// isPermanentSendError returns true for the errors which won't be fixed by
+// sending the message again
+func isPermanentSendError(err error) bool {
+	return errcode.Has(err, errcode.ErrCode_ErrInvalidInput) ||
+		errcode.Has(err, errcode.ErrCode_ErrGroupPermissionDenied) ||
+		errcode.Has(err, errcode.ErrCode_ErrNotFound)
+}
+
+// get returns a message of the outbox, nil if there is none
+func (o *outbox) get(ctx context.Context, clientMessageID []byte) (*protocoltypes.OutboxMessage, error) {
+	data, err := o.datastore.Get(ctx, dsKeyForOutbox(clientMessageID))
+	if err == datastore.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	msg := &protocoltypes.OutboxMessage{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return msg, nil
+}
+
+// put stores a message of the outbox and notifies the watchers
+func (o *outbox) put(ctx context.Context, msg *protocoltypes.OutboxMessage) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := o.datastore.Put(ctx, dsKeyForOutbox(msg.ClientMessageId), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	o.mu.Lock()
+	o.version++
+	o.notify.Broadcast()
+	o.mu.Unlock()
+
+	return nil
+}
+
+// list returns the messages of the outbox
+func (o *outbox) list(ctx context.Context) ([]*protocoltypes.OutboxMessage, error) {
+	results, err := o.datastore.Query(ctx, query.Query{})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	messages := make([]*protocoltypes.OutboxMessage, 0, len(entries))
+	for _, entry := range entries {
+		msg := &protocoltypes.OutboxMessage{}
+		if err := proto.Unmarshal(entry.Value, msg); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// status returns the requested messages of the outbox, all of them if
+// clientMessageIDs is empty, and the version they have been read at
+func (o *outbox) status(ctx context.Context, clientMessageIDs [][]byte) ([]*protocoltypes.OutboxMessage, uint64, error) {
+	o.mu.Lock()
+	version := o.version
+	o.mu.Unlock()
+
+	if len(clientMessageIDs) == 0 {
+		messages, err := o.list(ctx)
+		return messages, version, err
+	}
+
+	messages := make([]*protocoltypes.OutboxMessage, 0, len(clientMessageIDs))
+	for _, id := range clientMessageIDs {
+		msg, err := o.get(ctx, id)
+		if err != nil {
+			return nil, 0, err
+		} else if msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, version, nil
+}
+
+// scheduled returns the scheduled messages of the group, or of all the groups
+// if groupPK is empty, ordered by scheduled time
+func (o *outbox) scheduled(ctx context.Context, groupPK []byte) ([]*protocoltypes.OutboxMessage, error) {
+	messages, err := o.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := []*protocoltypes.OutboxMessage(nil)
+	for _, msg := range messages {
+		if msg.Status != protocoltypes.SendStatus_SendStatusScheduled {
+			continue
+		}
+
+		if len(groupPK) > 0 && !bytes.Equal(msg.GroupPk, groupPK) {
+			continue
+		}
+
+		scheduled = append(scheduled, msg)
+	}
+
+	sort.SliceStable(scheduled, func(i, j int) bool {
+		return scheduled[i].ScheduledAt < scheduled[j].ScheduledAt
+	})
+
+	return scheduled, nil
+}
+
+// waitForChange waits until a message changes after the given version or
+// the context is done
+func (o *outbox) waitForChange(ctx context.Context, version uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for o.version == version {
+		if !o.notify.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// trigger wakes up the outbox to send the queued messages
+func (o *outbox) trigger() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// attemptSend tries to add a message of the outbox to its group and records
+// the result
+func (s *service) attemptSend(ctx context.Context, msg *protocoltypes.OutboxMessage, now time.Time) error {
+	id, err := s.sendAppMessage(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk:         msg.GroupPk,
+		Payload:         msg.Payload,
+		ThreadId:        msg.ThreadId,
+		AttachmentCids:  msg.AttachmentCids,
+		Priority:        msg.Priority,
+		ExpireAfter:     msg.ExpireAfter,
+		ExpireAfterRead: msg.ExpireAfterRead,
+	})
+
+	if err != nil {
+		msg.Attempts++
+		msg.LastError = err.Error()
+
+		if isPermanentSendError(err) {
+			msg.Status = protocoltypes.SendStatus_SendStatusFailed
+		}
+	} else {
+		msg.Status = protocoltypes.SendStatus_SendStatusStored
+		msg.Cid = id
+		msg.LastError = ""
+
+		if gc, err := s.getOpenedGroup(msg.GroupPk); err == nil && s.hasGroupPeers(ctx, gc) {
+			msg.Status = protocoltypes.SendStatus_SendStatusSent
+		}
+	}
+
+	msg.UpdatedAt = now.Unix()
+
+	return s.outbox.put(ctx, msg)
+}
+
+// hasGroupPeers returns true if a peer is connected on the topic of the
+// message store of the group, the heads of the store are sent to the peers
+// of the topic on each write and when they join it
+func (s *service) hasGroupPeers(ctx context.Context, gc *GroupContext) bool {
+	if s.odb == nil {
+		return false
+	}
+
+	return len(s.storeTopicPeers(ctx, gc.MessageStore().Address().String())) > 0
+}
+
+// sendOutboxMessage journals the message then tries to send it, unless it
+// is scheduled later. A message already journaled with the same client
+// message id isn't sent again.
+func (s *service) sendOutboxMessage(ctx context.Context, req *protocoltypes.AppMessageSend_Request) (*protocoltypes.AppMessageSend_Reply, error) {
+	defer s.outbox.lock(req.ClientMessageId)()
+
+	msg, err := s.outbox.get(ctx, req.ClientMessageId)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg == nil {
+		now := time.Now()
+		msg = &protocoltypes.OutboxMessage{
+			ClientMessageId: req.ClientMessageId,
+			GroupPk:         req.GroupPk,
+			Payload:         req.Payload,
+			ThreadId:        req.ThreadId,
+			AttachmentCids:  req.AttachmentCids,
+			Priority:        req.Priority,
+			ExpireAfter:     req.ExpireAfter,
+			ExpireAfterRead: req.ExpireAfterRead,
+			Status:          protocoltypes.SendStatus_SendStatusQueued,
+			UpdatedAt:       now.Unix(),
+		}
+
+		scheduled := req.Schedule > now.Unix()
+		if scheduled {
+			msg.Status = protocoltypes.SendStatus_SendStatusScheduled
+			msg.ScheduledAt = req.Schedule
+		}
+
+		if err := s.outbox.put(ctx, msg); err != nil {
+			return nil, err
+		}
+
+		if !scheduled {
+			if err := s.attemptSend(ctx, msg, now); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if msg.Status == protocoltypes.SendStatus_SendStatusFailed {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to send message: %s", msg.LastError))
+	}
+
+	return &protocoltypes.AppMessageSend_Reply{Cid: msg.Cid, Status: msg.Status, ClientMessageId: msg.ClientMessageId}, nil
+}
+
+// cancelScheduledMessage cancels a scheduled message which hasn't been sent
+// yet
+func (s *service) cancelScheduledMessage(ctx context.Context, clientMessageID []byte) error {
+	defer s.outbox.lock(clientMessageID)()
+
+	msg, err := s.outbox.get(ctx, clientMessageID)
+	if err != nil {
+		return err
+	} else if msg == nil {
+		return errcode.ErrCode_ErrNotFound.Wrap(fmt.Errorf("unknown message"))
+	}
+
+	if msg.Status != protocoltypes.SendStatus_SendStatusScheduled {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("only the scheduled messages which haven't been sent can be canceled"))
+	}
+
+	msg.Status = protocoltypes.SendStatus_SendStatusCanceled
+	msg.UpdatedAt = time.Now().Unix()
+
+	return s.outbox.put(ctx, msg)
+}
+
+// sendPendingMessage sends a message of the outbox if its status is still
+// the given one, as it may have changed since the outbox has been listed
+func (s *service) sendPendingMessage(clientMessageID []byte, status protocoltypes.SendStatus, now time.Time) {
+	defer s.outbox.lock(clientMessageID)()
+
+	msg, err := s.outbox.get(s.ctx, clientMessageID)
+	if err != nil || msg == nil || msg.Status != status {
+		return
+	}
+
+	msg.Status = protocoltypes.SendStatus_SendStatusQueued
+	if err := s.attemptSend(s.ctx, msg, now); err != nil {
+		s.logger.Warn("unable to record outbox message", zap.Error(err))
+	}
+}
+
+// isMessageReplicated returns true if another device of the group has
+// acknowledged the message
+func isMessageReplicated(gc *GroupContext, id []byte) bool {
+	for _, device := range gc.MetadataStore().ListMessageDeliveryStatus(id, gc.MetadataStore().devicePublicKeyRaw) {
+		if device.Acknowledged {
+			return true
+		}
+	}
+
+	return false
+}
+
+// processOutbox sends the queued messages whose backoff is over, or all of
+// them if force is set, and the scheduled messages whose time has come, from
+// the highest priority to the lowest. It checks whether the stored ones have
+// been sent to a peer and the replication of the sent ones, and removes the
+// old ones.
+func (s *service) processOutbox(now time.Time, force bool) {
+	messages, err := s.outbox.list(s.ctx)
+	if err != nil {
+		s.logger.Error("unable to list outbox messages", zap.Error(err))
+		return
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return sendLaneRank(messages[i].Priority) < sendLaneRank(messages[j].Priority)
+	})
+
+	for _, msg := range messages {
+		updatedAt := time.Unix(msg.UpdatedAt, 0)
+
+		switch msg.Status {
+		case protocoltypes.SendStatus_SendStatusQueued:
+			if !force && now.Before(updatedAt.Add(outboxRetryDelay(msg.Attempts, msg.Priority))) {
+				continue
+			}
+
+			s.sendPendingMessage(msg.ClientMessageId, msg.Status, now)
+
+		case protocoltypes.SendStatus_SendStatusScheduled:
+			if now.Unix() < msg.ScheduledAt {
+				continue
+			}
+
+			s.sendPendingMessage(msg.ClientMessageId, msg.Status, now)
+
+		case protocoltypes.SendStatus_SendStatusStored, protocoltypes.SendStatus_SendStatusSent:
+			// the groups aren't activated only to check the replication
+			gc, err := s.getOpenedGroup(msg.GroupPk)
+			if err != nil {
+				continue
+			}
+
+			switch {
+			case isMessageReplicated(gc, msg.Cid):
+				msg.Status = protocoltypes.SendStatus_SendStatusReplicated
+			case msg.Status == protocoltypes.SendStatus_SendStatusStored && s.hasGroupPeers(s.ctx, gc):
+				msg.Status = protocoltypes.SendStatus_SendStatusSent
+			default:
+				continue
+			}
+
+			msg.UpdatedAt = now.Unix()
+			if err := s.outbox.put(s.ctx, msg); err != nil {
+				s.logger.Warn("unable to record outbox message", zap.Error(err))
+			}
+
+		default:
+			if now.Sub(updatedAt) < outboxRetention {
+				continue
+			}
+
+			if err := s.outbox.datastore.Delete(s.ctx, dsKeyForOutbox(msg.ClientMessageId)); err != nil {
+				s.logger.Warn("unable to delete outbox message", logutil.PrivateBinary("id", msg.ClientMessageId), zap.Error(err))
+			}
+		}
+	}
+}
+
+// startOutbox periodically processes the outbox, the queued messages are sent
+// again as soon as a peer is connected. The messages scheduled while the
+// service was stopped are sent on startup.
+func (s *service) startOutbox() {
+	var connectedness <-chan interface{}
+	if s.host != nil {
+		sub, err := s.host.EventBus().Subscribe(new(event.EvtPeerConnectednessChanged), eventbus.Name("weshnet/outbox"))
+		if err != nil {
+			s.logger.Warn("unable to subscribe to peer connectedness", zap.Error(err))
+		} else {
+			connectedness = sub.Out()
+			go func() {
+				<-s.ctx.Done()
+				sub.Close()
+			}()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(outboxInterval)
+		defer ticker.Stop()
+
+		s.processOutbox(time.Now(), false)
+
+		lastForced := time.Time{}
+		for {
+			force := false
+
+			select {
+			case <-ticker.C:
+			case <-s.outbox.wake:
+				force = true
+			case evt := <-connectedness:
+				e, ok := evt.(event.EvtPeerConnectednessChanged)
+				if !ok || e.Connectedness != network.Connected {
+					continue
+				}
+
+				force = true
+			case <-s.ctx.Done():
+				return
+			}
+
+			// the connections of several peers don't trigger as many
+			// attempts
+			now := time.Now()
+			if force {
+				if now.Sub(lastForced) < outboxInterval {
+					continue
+				}
+
+				lastForced = now
+			}
+
+			s.processOutbox(now, force)
+		}
+	}()
+}
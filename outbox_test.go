@@ -0,0 +1,154 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	normal := protocoltypes.SendPriority_SendPriorityUndefined
+	require.Equal(t, outboxInterval, outboxRetryDelay(0, normal))
+	require.Equal(t, outboxInterval, outboxRetryDelay(1, normal))
+	require.Equal(t, 2*outboxInterval, outboxRetryDelay(2, normal))
+	require.Equal(t, 4*outboxInterval, outboxRetryDelay(3, normal))
+	require.Equal(t, outboxRetryMaxDelay, outboxRetryDelay(100, normal))
+	require.Equal(t, outboxRetryMaxDelay, outboxRetryDelay(100, protocoltypes.SendPriority_SendPriorityBulk))
+
+	// the interactive messages are retried more often
+	require.Equal(t, 2*outboxInterval, outboxRetryDelay(2, protocoltypes.SendPriority_SendPriorityInteractive))
+	require.Equal(t, outboxInteractiveRetryMaxDelay, outboxRetryDelay(100, protocoltypes.SendPriority_SendPriorityInteractive))
+}
+
+func TestOutboxPermanentSendError(t *testing.T) {
+	require.True(t, isPermanentSendError(errcode.ErrCode_ErrOrbitDBAppend.Wrap(errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("broadcast mode")))))
+	require.False(t, isPermanentSendError(errcode.ErrCode_ErrGroupMissing.Wrap(fmt.Errorf("group not opened"))))
+}
+
+func TestOutboxStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	o := newOutbox(datastore)
+
+	msg, err := o.get(ctx, []byte("message 1"))
+	require.NoError(t, err)
+	require.Nil(t, msg)
+
+	messages, version, err := o.status(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	require.NoError(t, o.put(ctx, &protocoltypes.OutboxMessage{
+		ClientMessageId: []byte("message 1"),
+		Status:          protocoltypes.SendStatus_SendStatusQueued,
+		UpdatedAt:       time.Now().Unix(),
+	}))
+	require.NoError(t, o.put(ctx, &protocoltypes.OutboxMessage{
+		ClientMessageId: []byte("message 2"),
+		Status:          protocoltypes.SendStatus_SendStatusSent,
+		Cid:             []byte("cid"),
+	}))
+
+	// the watchers are notified of the changes
+	o.waitForChange(ctx, version)
+
+	messages, _, err = o.status(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	messages, _, err = o.status(ctx, [][]byte{[]byte("message 2"), []byte("unknown")})
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, protocoltypes.SendStatus_SendStatusSent, messages[0].Status)
+
+	// the outbox is kept after a restart
+	o = newOutbox(datastore)
+
+	msg, err = o.get(ctx, []byte("message 1"))
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	require.Equal(t, protocoltypes.SendStatus_SendStatusQueued, msg.Status)
+}
+
+func TestOutboxScheduled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &service{ctx: ctx, outbox: newOutbox(dsync.MutexWrap(ds.NewMapDatastore()))}
+
+	now := time.Now().Unix()
+	for _, msg := range []*protocoltypes.OutboxMessage{
+		{ClientMessageId: []byte("later"), GroupPk: []byte("group 1"), Status: protocoltypes.SendStatus_SendStatusScheduled, ScheduledAt: now + 3600},
+		{ClientMessageId: []byte("sooner"), GroupPk: []byte("group 1"), Status: protocoltypes.SendStatus_SendStatusScheduled, ScheduledAt: now + 60},
+		{ClientMessageId: []byte("other group"), GroupPk: []byte("group 2"), Status: protocoltypes.SendStatus_SendStatusScheduled, ScheduledAt: now + 600},
+		{ClientMessageId: []byte("sent"), GroupPk: []byte("group 1"), Status: protocoltypes.SendStatus_SendStatusSent},
+	} {
+		require.NoError(t, s.outbox.put(ctx, msg))
+	}
+
+	// the scheduled messages are ordered by scheduled time
+	messages, err := s.outbox.scheduled(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	require.Equal(t, []byte("sooner"), messages[0].ClientMessageId)
+	require.Equal(t, []byte("other group"), messages[1].ClientMessageId)
+	require.Equal(t, []byte("later"), messages[2].ClientMessageId)
+
+	messages, err = s.outbox.scheduled(ctx, []byte("group 1"))
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	// only the scheduled messages can be canceled
+	require.NoError(t, s.cancelScheduledMessage(ctx, []byte("later")))
+	require.True(t, errcode.Has(s.cancelScheduledMessage(ctx, []byte("later")), errcode.ErrCode_ErrInvalidInput))
+	require.True(t, errcode.Has(s.cancelScheduledMessage(ctx, []byte("sent")), errcode.ErrCode_ErrInvalidInput))
+	require.True(t, errcode.Has(s.cancelScheduledMessage(ctx, []byte("unknown")), errcode.ErrCode_ErrNotFound))
+
+	msg, err := s.outbox.get(ctx, []byte("later"))
+	require.NoError(t, err)
+	require.Equal(t, protocoltypes.SendStatus_SendStatusCanceled, msg.Status)
+
+	messages, err = s.outbox.scheduled(ctx, []byte("group 1"))
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Equal(t, []byte("sooner"), messages[0].ClientMessageId)
+}
+
+func TestOutboxLock(t *testing.T) {
+	o := newOutbox(dsync.MutexWrap(ds.NewMapDatastore()))
+
+	unlock := o.lock([]byte("message 1"))
+
+	// the other messages aren't blocked by a pending attempt
+	o.lock([]byte("message 2"))()
+
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		o.lock([]byte("message 1"))()
+	}()
+
+	select {
+	case <-locked:
+		require.FailNow(t, "the message should be locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+
+	// the locks are removed once released
+	o.muLocks.Lock()
+	require.Empty(t, o.locks)
+	o.muLocks.Unlock()
+}
@@ -132,6 +132,19 @@ func Test_OutOfStoreMessageFlow(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, message, encryptedMessage.Plaintext)
+
+	// verify the out of store message along with an invalid one in a batch
+	batchReply, err := s.OutOfStoreReceiveBatch(ctx, &protocoltypes.OutOfStoreReceiveBatch_Request{
+		Payloads: [][]byte{craftReply.Encrypted, []byte("invalid")},
+	})
+	require.NoError(t, err)
+	require.Len(t, batchReply.Results, 2)
+
+	require.Empty(t, batchReply.Results[0].Error)
+	require.Equal(t, openReply.Cleartext, batchReply.Results[0].Reply.Cleartext)
+
+	require.Nil(t, batchReply.Results[1].Reply)
+	require.NotEmpty(t, batchReply.Results[1].Error)
 }
 
 func createVirtualOtherPeerSecrets(t testing.TB, ctx context.Context, gc *GroupContext) (secretstore.SecretStore, func()) {
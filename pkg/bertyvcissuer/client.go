@@ -30,10 +30,20 @@ type Client struct {
 }
 
 func NewClient(serverRoot string) *Client {
+	return NewClientWithHTTPClient(serverRoot, http.DefaultClient)
+}
+
+// NewClientWithHTTPClient creates a client issuing its requests through the
+// given http.Client, http.DefaultClient is used if nil
+func NewClientWithHTTPClient(serverRoot string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
 	return &Client{
 		serverRoot:  serverRoot,
 		redirectURI: DefaultRedirectURI,
-		httpClient:  http.DefaultClient,
+		httpClient:  httpClient,
 	}
 }
 
@@ -104,7 +114,7 @@ func (c *Client) Complete(uri string) (string, string, *verifiable.Credential, e
 	parsedCredential, err := verifiable.ParseCredential(
 		credentials,
 		verifiable.WithPublicKeyFetcher(EmbeddedPublicKeyFetcher),
-		verifiable.WithJSONLDDocumentLoader(ld.NewDefaultDocumentLoader(http.DefaultClient)),
+		verifiable.WithJSONLDDocumentLoader(ld.NewDefaultDocumentLoader(c.httpClient)),
 	)
 	if err != nil {
 		return "", "", nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
@@ -4,12 +4,27 @@ import (
 	"fmt"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
+	"google.golang.org/protobuf/proto"
 
 	"berty.tech/weshnet/v2/pkg/errcode"
 )
 
 const RendezvousSeedLength = 32
 
+const (
+	// ShareableContactEnvelopeVersion is the version of the format of the
+	// envelopes encoded by EncodeShareableContact
+	ShareableContactEnvelopeVersion = 1
+
+	// shareableContactEnvelopeMinVersion is the oldest version able to read the
+	// envelopes encoded by this version
+	shareableContactEnvelopeMinVersion = 1
+
+	// shareableContactEnvelopeMarker prefixes the envelopes, the legacy
+	// encoding never starts with a zero byte as 0 isn't a valid field number
+	shareableContactEnvelopeMarker = 0x00
+)
+
 type ShareableContactOptions uint64
 
 const (
@@ -73,3 +88,56 @@ func (m *ShareableContact) GetPubKey() (crypto.PubKey, error) {
 
 	return pk, nil
 }
+
+// EncodeShareableContact encodes a contact to be shared in a versioned envelope
+// along with the capabilities of the device
+func EncodeShareableContact(contact *ShareableContact, capabilities *ShareableContactCapabilities) ([]byte, error) {
+	envelope, err := proto.Marshal(&ShareableContactEnvelope{
+		Version:      ShareableContactEnvelopeVersion,
+		MinVersion:   shareableContactEnvelopeMinVersion,
+		Contact:      contact,
+		Capabilities: capabilities,
+	})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return append([]byte{shareableContactEnvelopeMarker}, envelope...), nil
+}
+
+// DecodeShareableContact decodes a shared contact, either a versioned envelope
+// or the legacy encoding of a ShareableContact which is returned as a version
+// 0 envelope without capabilities. The fields added by newer versions are
+// ignored, an envelope which can't be read by this version is rejected.
+func DecodeShareableContact(data []byte) (*ShareableContactEnvelope, error) {
+	if len(data) == 0 || data[0] != shareableContactEnvelopeMarker {
+		contact := &ShareableContact{}
+		if err := proto.Unmarshal(data, contact); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		return &ShareableContactEnvelope{
+			Contact:      contact,
+			Capabilities: &ShareableContactCapabilities{},
+		}, nil
+	}
+
+	envelope := &ShareableContactEnvelope{}
+	if err := proto.Unmarshal(data[1:], envelope); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if envelope.MinVersion > ShareableContactEnvelopeVersion {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("shared contact requires version %d, only version %d is supported", envelope.MinVersion, ShareableContactEnvelopeVersion))
+	}
+
+	if envelope.Contact == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("shared contact is missing"))
+	}
+
+	if envelope.Capabilities == nil {
+		envelope.Capabilities = &ShareableContactCapabilities{}
+	}
+
+	return envelope, nil
+}
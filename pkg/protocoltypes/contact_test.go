@@ -0,0 +1,80 @@
+package protocoltypes_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestShareableContactEncoding(t *testing.T) {
+	contact := &protocoltypes.ShareableContact{
+		Pk:                   []byte("pk"),
+		PublicRendezvousSeed: []byte("seed"),
+	}
+
+	capabilities := &protocoltypes.ShareableContactCapabilities{
+		Transports:    []string{"tcp", "quic-v1"},
+		ProtocolEpoch: 1,
+	}
+
+	encoded, err := protocoltypes.EncodeShareableContact(contact, capabilities)
+	require.NoError(t, err)
+
+	envelope, err := protocoltypes.DecodeShareableContact(encoded)
+	require.NoError(t, err)
+	require.Equal(t, uint32(protocoltypes.ShareableContactEnvelopeVersion), envelope.Version)
+	require.True(t, proto.Equal(contact, envelope.Contact))
+	require.True(t, proto.Equal(capabilities, envelope.Capabilities))
+
+	// the legacy encoding is decoded as version 0
+	legacy, err := proto.Marshal(contact)
+	require.NoError(t, err)
+
+	envelope, err = protocoltypes.DecodeShareableContact(legacy)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), envelope.Version)
+	require.True(t, proto.Equal(contact, envelope.Contact))
+	require.NotNil(t, envelope.Capabilities)
+}
+
+func TestShareableContactEncodingFutureVersions(t *testing.T) {
+	encode := func(envelope *protocoltypes.ShareableContactEnvelope, extra []byte) []byte {
+		data, err := proto.Marshal(envelope)
+		require.NoError(t, err)
+
+		return append(append([]byte{0x00}, data...), extra...)
+	}
+
+	contact := &protocoltypes.ShareableContact{Pk: []byte("pk")}
+
+	// fields added by a newer version readable by this one are ignored
+	unknownField := protowire.AppendTag(nil, 99, protowire.BytesType)
+	unknownField = protowire.AppendBytes(unknownField, []byte("future"))
+
+	envelope, err := protocoltypes.DecodeShareableContact(encode(&protocoltypes.ShareableContactEnvelope{
+		Version:    protocoltypes.ShareableContactEnvelopeVersion + 1,
+		MinVersion: protocoltypes.ShareableContactEnvelopeVersion,
+		Contact:    contact,
+	}, unknownField))
+	require.NoError(t, err)
+	require.Equal(t, uint32(protocoltypes.ShareableContactEnvelopeVersion+1), envelope.Version)
+	require.Equal(t, contact.Pk, envelope.Contact.Pk)
+
+	// a newer version not readable by this one is rejected
+	_, err = protocoltypes.DecodeShareableContact(encode(&protocoltypes.ShareableContactEnvelope{
+		Version:    protocoltypes.ShareableContactEnvelopeVersion + 1,
+		MinVersion: protocoltypes.ShareableContactEnvelopeVersion + 1,
+		Contact:    contact,
+	}, nil))
+	require.Error(t, err)
+
+	_, err = protocoltypes.DecodeShareableContact(encode(&protocoltypes.ShareableContactEnvelope{
+		Version:    protocoltypes.ShareableContactEnvelopeVersion,
+		MinVersion: protocoltypes.ShareableContactEnvelopeVersion,
+	}, nil))
+	require.Error(t, err)
+}
@@ -84,6 +84,46 @@ func (m *MultiMemberGroupAdminRoleGranted) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
 
+func (m *MultiMemberGroupMemberRemoved) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupMemberRoleSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupInvitationRevoked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupSecretRotated) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupSnapshotAdded) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupBroadcastModeSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupMemberApproved) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupMemberBanned) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupPublicModeSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupOwnershipTransferred) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
 func (m *GroupMetadataPayloadSent) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
@@ -95,3 +135,127 @@ func (m *GroupReplicating) SetDevicePK(pk []byte) {
 func (m *AccountVerifiedCredentialRegistered) SetDevicePK(pk []byte) {
 	m.DevicePk = pk
 }
+
+func (m *AccountContactRequestNonceRegistered) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactRequestPolicySet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactVerified) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactVerified) SetContactPK(pk []byte) {
+	m.ContactPk = pk
+}
+
+func (m *ContactSessionReset) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *ContactAccountReintroduced) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *ContactRemoved) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactIntroductionAccepted) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *ContactIntroductionSent) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactDeleted) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactDeleted) SetContactPK(pk []byte) {
+	m.ContactPk = pk
+}
+
+func (m *AccountContactMetadataSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountContactMetadataSet) SetContactPK(pk []byte) {
+	m.ContactPk = pk
+}
+
+func (m *AccountPresenceSettingsSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountDeviceRevoked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountDeviceLinked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *ContactDeviceRevoked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupDeviceRevoked) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *MultiMemberGroupEpochCommitted) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountGroupDeviceRegistered) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountDeviceNameSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupDeviceCapabilitiesSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupDeviceKeyRotated) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountSettingSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountPrimaryDeviceClaimed) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountPrimaryDeviceTransferProposed) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountPrimaryDeviceTransferAccepted) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupMessagesAcknowledged) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupMessagesRead) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *AccountReadReceiptsSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
+
+func (m *GroupDisappearingMessagesSet) SetDevicePK(pk []byte) {
+	m.DevicePk = pk
+}
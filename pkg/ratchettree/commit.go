@@ -0,0 +1,323 @@
+package ratchettree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/box"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+const (
+	labelNode  = "weshnet ratchet tree node"
+	labelPath  = "weshnet ratchet tree path"
+	labelEpoch = "weshnet ratchet tree epoch"
+	labelKey   = "weshnet ratchet tree key "
+)
+
+// PathNode is a node of the path of a committer
+type PathNode struct {
+	// PublicKey is the new key of the node
+	PublicKey []byte
+
+	// EncryptedPathSecrets contains the path secret of the node encrypted to
+	// each node of the resolution of the sibling of its child on the path
+	EncryptedPathSecrets [][]byte
+}
+
+// Commit advances a tree to a new epoch
+type Commit struct {
+	// Committer is the ID of the leaf creating the commit
+	Committer []byte
+
+	// Removes are the IDs of the removed leaves
+	Removes [][]byte
+
+	// Adds are the added leaves
+	Adds []*Leaf
+
+	// Path contains the new keys of the parents of the committer, from its
+	// parent up to the root
+	Path []*PathNode
+
+	// Welcomes contains the new epoch secret encrypted to each added leaf
+	Welcomes [][]byte
+}
+
+// State is the private state of a leaf for an epoch
+type State struct {
+	// Secret is the epoch secret
+	Secret []byte
+
+	// Keys contains the private keys of the parent nodes known to the leaf,
+	// by node index
+	Keys map[int][]byte
+}
+
+// Key returns a key derived from the epoch secret for the given usage
+func (s *State) Key(label string) ([]byte, error) {
+	return derive(s.Secret, nil, labelKey+label)
+}
+
+func derive(secret, salt []byte, label string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(label)), key); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	return key, nil
+}
+
+// nodeKeys returns the key pair of a node derived from its path secret
+func nodeKeys(pathSecret []byte) ([]byte, []byte, error) {
+	priv, err := derive(pathSecret, nil, labelNode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return priv, pub, nil
+}
+
+func toArray(key []byte) *[KeySize]byte {
+	var a [KeySize]byte
+	copy(a[:], key)
+	return &a
+}
+
+// NextEpochSecret returns the secret of an epoch, derived from the secret of
+// the previous epoch and the secret of the root of the commit path
+func NextEpochSecret(previous, commitSecret []byte) ([]byte, error) {
+	return derive(commitSecret, previous, labelEpoch)
+}
+
+// CreateCommit removes and adds leaves to the tree and refreshes the path of
+// the committer. It returns the commit to publish with the new tree and the
+// new state of the committer. The state is nil for the first commit of a
+// tree, the committer must then add itself.
+func CreateCommit(rand io.Reader, t *Tree, state *State, committer []byte, removes [][]byte, adds []*Leaf) (*Commit, *Tree, *State, error) {
+	nt := t.Clone()
+	if err := nt.apply(removes, adds); err != nil {
+		return nil, nil, nil, err
+	}
+
+	self := nt.Find(committer)
+	if self < 0 {
+		return nil, nil, nil, errcode.ErrCode_ErrGroupMemberRemoved.Wrap(fmt.Errorf("committer not in the tree"))
+	}
+
+	if state == nil && t.Find(committer) >= 0 {
+		return nil, nil, nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("missing state of the committer"))
+	}
+
+	pathSecret := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand, pathSecret); err != nil {
+		return nil, nil, nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	c := &Commit{
+		Committer: committer,
+		Removes:   removes,
+		Adds:      adds,
+	}
+
+	keys := map[int][]byte{}
+	child := 2 * self
+	for _, x := range nt.directPath(child) {
+		priv, pub, err := nodeKeys(pathSecret)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		node := &PathNode{PublicKey: pub}
+		for _, r := range nt.resolution(sibling(child)) {
+			encrypted, err := box.SealAnonymous(nil, pathSecret, toArray(nt.publicKey(r)), rand)
+			if err != nil {
+				return nil, nil, nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+			}
+
+			node.EncryptedPathSecrets = append(node.EncryptedPathSecrets, encrypted)
+		}
+
+		c.Path = append(c.Path, node)
+		nt.parents[(x-1)/2] = pub
+		keys[x] = priv
+
+		if pathSecret, err = derive(pathSecret, nil, labelPath); err != nil {
+			return nil, nil, nil, err
+		}
+
+		child = x
+	}
+
+	commitSecret, err := derive(pathSecret, nil, labelPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var previous []byte
+	if state != nil {
+		previous = state.Secret
+	}
+
+	secret, err := NextEpochSecret(previous, commitSecret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, leaf := range adds {
+		welcome, err := box.SealAnonymous(nil, secret, toArray(leaf.PublicKey), rand)
+		if err != nil {
+			return nil, nil, nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+		}
+
+		c.Welcomes = append(c.Welcomes, welcome)
+	}
+
+	return c, nt, &State{Secret: secret, Keys: keys}, nil
+}
+
+// ProcessCommit applies a commit created by another leaf and returns the new
+// tree with the new state of the leaf self. The state is nil if the leaf
+// didn't take part in the previous epoch, it must then be added by the
+// commit. The private key of the leaf is the X25519 key of the device.
+func ProcessCommit(t *Tree, state *State, self []byte, selfPrivateKey []byte, c *Commit) (*Tree, *State, error) {
+	if bytes.Equal(self, c.Committer) {
+		return nil, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("commit created by the same leaf"))
+	}
+
+	nt, err := t.Apply(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leaf := nt.Find(self)
+	if leaf < 0 {
+		return nil, nil, errcode.ErrCode_ErrGroupMemberRemoved
+	}
+
+	privateKey := func(x int) []byte {
+		if x == 2*leaf {
+			return selfPrivateKey
+		}
+
+		if state == nil {
+			return nil
+		}
+
+		return state.Keys[x]
+	}
+
+	// the path secret is encrypted to the subtree of the leaf below the
+	// lowest node shared with the committer
+	path := nt.directPath(2 * nt.Find(c.Committer))
+	child := 2 * nt.Find(c.Committer)
+	start := -1
+	var pathSecret []byte
+
+	for i, x := range path {
+		copath := sibling(child)
+		child = x
+
+		if !contains(copath, 2*leaf) {
+			continue
+		}
+
+		for j, r := range nt.resolution(copath) {
+			if !contains(r, 2*leaf) {
+				continue
+			}
+
+			priv := privateKey(r)
+			if priv == nil {
+				return nil, nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("missing key of node %d", r))
+			}
+
+			var ok bool
+			pathSecret, ok = box.OpenAnonymous(nil, c.Path[i].EncryptedPathSecrets[j], toArray(nt.publicKey(r)), toArray(priv))
+			if !ok {
+				return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to decrypt the path secret"))
+			}
+
+			break
+		}
+
+		start = i
+		break
+	}
+
+	if pathSecret == nil {
+		return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("no path secret for the leaf"))
+	}
+
+	keys := map[int][]byte{}
+	for i := start; i < len(path); i++ {
+		priv, pub, err := nodeKeys(pathSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !bytes.Equal(pub, c.Path[i].PublicKey) {
+			return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("path secret doesn't match the key of node %d", path[i]))
+		}
+
+		keys[path[i]] = priv
+
+		if pathSecret, err = derive(pathSecret, nil, labelPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// the other keys of the path of the leaf are kept unless the commit
+	// blanked them
+	for _, x := range nt.directPath(2 * leaf) {
+		if _, ok := keys[x]; ok || nt.publicKey(x) == nil {
+			continue
+		}
+
+		if priv := privateKey(x); priv != nil {
+			if pub, err := curve25519.X25519(priv, curve25519.Basepoint); err == nil && bytes.Equal(pub, nt.publicKey(x)) {
+				keys[x] = priv
+			}
+		}
+	}
+
+	commitSecret, err := derive(pathSecret, nil, labelPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state != nil && t.Find(self) >= 0 {
+		secret, err := NextEpochSecret(state.Secret, commitSecret)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nt, &State{Secret: secret, Keys: keys}, nil
+	}
+
+	// an added leaf can't derive the epoch secret, it is sent in its welcome
+	for i, added := range c.Adds {
+		if !bytes.Equal(added.ID, self) {
+			continue
+		}
+
+		secret, ok := box.OpenAnonymous(nil, c.Welcomes[i], toArray(added.PublicKey), toArray(selfPrivateKey))
+		if !ok {
+			return nil, nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to decrypt the welcome"))
+		}
+
+		return nt, &State{Secret: secret, Keys: keys}, nil
+	}
+
+	return nil, nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("missing state of the previous epoch"))
+}
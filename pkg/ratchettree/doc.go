@@ -0,0 +1,18 @@
+// Package ratchettree contains the tree ratchet deriving the epoch secrets of
+// a multi-member group, inspired by the ratchet tree of MLS (RFC 9420).
+//
+// The leaves of the tree are the devices of the group, their keys are the
+// X25519 conversion of the device keys. Each parent node has a key pair
+// known to the leaves below it. A commit removes and adds leaves, then the
+// committer replaces the keys of its path to the root with new ones derived
+// from a fresh path secret. The path secret of each node is encrypted to the
+// sibling subtree, so every remaining leaf decrypts the secret of the lowest
+// node shared with the committer and derives the ones above it, while a
+// removed leaf can't decrypt any of them. The secret of the new epoch mixes
+// the previous epoch secret with the secret of the root, a device holding
+// the state of an epoch can't derive the one of the epochs committed after a
+// commit it isn't part of.
+//
+// The added leaves receive the new epoch secret in a welcome encrypted to
+// their key, they can't derive the secrets of the previous epochs.
+package ratchettree
@@ -0,0 +1,289 @@
+package ratchettree
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// KeySize is the size of the X25519 keys of the nodes
+const KeySize = 32
+
+// Leaf is a device of the group
+type Leaf struct {
+	// ID identifies the device, usually its public key
+	ID []byte
+
+	// PublicKey is the X25519 public key of the device
+	PublicKey []byte
+}
+
+// Tree is the public part of a ratchet tree, the nodes are stored as an
+// array: the leaf i is the node 2i, the parent nodes have odd indexes and
+// the root of a tree of w leaves is the node w-1. The width of the tree is
+// always a power of two, the blank leaves are nil.
+type Tree struct {
+	leaves  []*Leaf
+	parents [][]byte
+}
+
+// Load returns the tree having the given leaves and parent public keys, the
+// blank nodes are nil
+func Load(leaves []*Leaf, parents [][]byte) (*Tree, error) {
+	if len(leaves) == 0 {
+		if len(parents) != 0 {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("parents without leaves"))
+		}
+
+		return &Tree{}, nil
+	}
+
+	if bits.OnesCount(uint(len(leaves))) != 1 || len(parents) != len(leaves)-1 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid tree size, %d leaves and %d parents", len(leaves), len(parents)))
+	}
+
+	seen := map[string]struct{}{}
+	for _, leaf := range leaves {
+		if leaf == nil {
+			continue
+		}
+
+		if len(leaf.ID) == 0 || len(leaf.PublicKey) != KeySize {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid leaf"))
+		}
+
+		if _, ok := seen[string(leaf.ID)]; ok {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("duplicate leaf"))
+		}
+		seen[string(leaf.ID)] = struct{}{}
+	}
+
+	for _, key := range parents {
+		if key != nil && len(key) != KeySize {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid parent key"))
+		}
+	}
+
+	t := &Tree{}
+	t.leaves = append(t.leaves, leaves...)
+	t.parents = append(t.parents, parents...)
+
+	return t, nil
+}
+
+// Leaves returns the leaves of the tree, the blank ones are nil
+func (t *Tree) Leaves() []*Leaf {
+	return append([]*Leaf(nil), t.leaves...)
+}
+
+// Parents returns the public keys of the parent nodes, the blank ones are nil
+func (t *Tree) Parents() [][]byte {
+	return append([][]byte(nil), t.parents...)
+}
+
+// Size returns the number of non-blank leaves
+func (t *Tree) Size() int {
+	size := 0
+	for _, leaf := range t.leaves {
+		if leaf != nil {
+			size++
+		}
+	}
+
+	return size
+}
+
+// Find returns the index of the leaf having the given ID, or -1
+func (t *Tree) Find(id []byte) int {
+	for i, leaf := range t.leaves {
+		if leaf != nil && bytes.Equal(leaf.ID, id) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Clone returns a copy of the tree, the keys are shared
+func (t *Tree) Clone() *Tree {
+	return &Tree{
+		leaves:  append([]*Leaf(nil), t.leaves...),
+		parents: append([][]byte(nil), t.parents...),
+	}
+}
+
+func (t *Tree) width() int {
+	return len(t.leaves)
+}
+
+func (t *Tree) root() int {
+	return t.width() - 1
+}
+
+// level returns the height of the node x, the leaves are at the level 0
+func level(x int) int {
+	return bits.TrailingZeros(^uint(x))
+}
+
+func left(x int) int {
+	return x ^ (1 << (level(x) - 1))
+}
+
+func right(x int) int {
+	return x ^ (3 << (level(x) - 1))
+}
+
+func parent(x int) int {
+	k := level(x)
+	b := (x >> (k + 1)) & 1
+	return (x | 1<<k) ^ (b << (k + 1))
+}
+
+func sibling(x int) int {
+	p := parent(x)
+	if x < p {
+		return right(p)
+	}
+
+	return left(p)
+}
+
+// contains returns true if the node x is in the subtree of the node n
+func contains(n, x int) bool {
+	span := 1<<level(n) - 1
+	return x >= n-span && x <= n+span
+}
+
+// directPath returns the parents of the node x up to the root
+func (t *Tree) directPath(x int) []int {
+	path := []int(nil)
+	for r := t.root(); x != r; {
+		x = parent(x)
+		path = append(path, x)
+	}
+
+	return path
+}
+
+// publicKey returns the key of the node x, nil if blank
+func (t *Tree) publicKey(x int) []byte {
+	if x%2 == 0 {
+		if leaf := t.leaves[x/2]; leaf != nil {
+			return leaf.PublicKey
+		}
+
+		return nil
+	}
+
+	return t.parents[(x-1)/2]
+}
+
+// resolution returns the non-blank nodes covering the subtree of the node x
+func (t *Tree) resolution(x int) []int {
+	if t.publicKey(x) != nil {
+		return []int{x}
+	}
+
+	if x%2 == 0 {
+		return nil
+	}
+
+	return append(t.resolution(left(x)), t.resolution(right(x))...)
+}
+
+// blankPath blanks the parents of the leaf i, their keys are known to the
+// leaves removed from the subtree or unknown to the ones added to it
+func (t *Tree) blankPath(i int) {
+	for _, x := range t.directPath(2 * i) {
+		t.parents[(x-1)/2] = nil
+	}
+}
+
+// apply removes and adds leaves, the added leaves fill the leftmost blank
+// leaves and the tree is widened when it is full
+func (t *Tree) apply(removes [][]byte, adds []*Leaf) error {
+	for _, id := range removes {
+		i := t.Find(id)
+		if i < 0 {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("removed leaf not found"))
+		}
+
+		t.leaves[i] = nil
+		t.blankPath(i)
+	}
+
+	for _, leaf := range adds {
+		if leaf == nil || len(leaf.ID) == 0 || len(leaf.PublicKey) != KeySize {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid added leaf"))
+		}
+
+		if t.Find(leaf.ID) >= 0 {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("added leaf already in the tree"))
+		}
+
+		i := 0
+		for i < t.width() && t.leaves[i] != nil {
+			i++
+		}
+
+		if i == t.width() {
+			width := 2 * t.width()
+			if width == 0 {
+				width = 1
+			}
+
+			t.leaves = append(t.leaves, make([]*Leaf, width-t.width())...)
+			t.parents = append(t.parents, make([][]byte, width-1-len(t.parents))...)
+		}
+
+		t.leaves[i] = leaf
+		t.blankPath(i)
+	}
+
+	return nil
+}
+
+// Apply returns the tree updated by the public part of a commit, it checks
+// the path has a key and a path secret for each node of the committer path
+func (t *Tree) Apply(c *Commit) (*Tree, error) {
+	nt := t.Clone()
+	if err := nt.apply(c.Removes, c.Adds); err != nil {
+		return nil, err
+	}
+
+	if len(c.Welcomes) != len(c.Adds) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expected %d welcomes, got %d", len(c.Adds), len(c.Welcomes)))
+	}
+
+	committer := nt.Find(c.Committer)
+	if committer < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("committer not in the tree"))
+	}
+
+	path := nt.directPath(2 * committer)
+	if len(c.Path) != len(path) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expected %d path nodes, got %d", len(path), len(c.Path)))
+	}
+
+	child := 2 * committer
+	for i, x := range path {
+		node := c.Path[i]
+		if node == nil || len(node.PublicKey) != KeySize {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid path node"))
+		}
+
+		if expected := len(nt.resolution(sibling(child))); len(node.EncryptedPathSecrets) != expected {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("expected %d path secrets, got %d", expected, len(node.EncryptedPathSecrets)))
+		}
+
+		child = x
+	}
+
+	for i, x := range path {
+		nt.parents[(x-1)/2] = c.Path[i].PublicKey
+	}
+
+	return nt, nil
+}
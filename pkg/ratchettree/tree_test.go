@@ -0,0 +1,212 @@
+package ratchettree
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/curve25519"
+)
+
+type testLeaf struct {
+	leaf       *Leaf
+	privateKey []byte
+	state      *State
+}
+
+func newTestLeaf(t *testing.T, name string) *testLeaf {
+	t.Helper()
+
+	priv := make([]byte, KeySize)
+	_, err := crand.Read(priv)
+	require.NoError(t, err)
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	require.NoError(t, err)
+
+	return &testLeaf{leaf: &Leaf{ID: []byte(name), PublicKey: pub}, privateKey: priv}
+}
+
+func TestTreeMath(t *testing.T) {
+	// a tree of 8 leaves, the root is the node 7
+	require.Equal(t, 0, level(4))
+	require.Equal(t, 1, level(5))
+	require.Equal(t, 3, level(7))
+
+	require.Equal(t, 3, left(7))
+	require.Equal(t, 11, right(7))
+	require.Equal(t, 1, parent(0))
+	require.Equal(t, 3, parent(1))
+	require.Equal(t, 7, parent(3))
+	require.Equal(t, 11, parent(9))
+	require.Equal(t, 2, sibling(0))
+	require.Equal(t, 11, sibling(3))
+
+	require.True(t, contains(3, 6))
+	require.False(t, contains(3, 8))
+	require.True(t, contains(7, 14))
+
+	tree := &Tree{leaves: make([]*Leaf, 8), parents: make([][]byte, 7)}
+	require.Equal(t, []int{1, 3, 7}, tree.directPath(0))
+	require.Equal(t, []int{13, 11, 7}, tree.directPath(12))
+}
+
+func TestCommit(t *testing.T) {
+	leaves := []*testLeaf{}
+	for i := 0; i < 5; i++ {
+		leaves = append(leaves, newTestLeaf(t, fmt.Sprintf("leaf %d", i)))
+	}
+
+	process := func(tree *Tree, c *Commit, except ...*testLeaf) *Tree {
+		var next *Tree
+	leaves:
+		for _, l := range leaves {
+			for _, e := range except {
+				if e == l {
+					continue leaves
+				}
+			}
+
+			if tree.Find(l.leaf.ID) < 0 && (len(c.Adds) == 0 || !containsLeaf(c.Adds, l.leaf)) {
+				continue
+			}
+
+			nt, state, err := ProcessCommit(tree, l.state, l.leaf.ID, l.privateKey, c)
+			require.NoError(t, err)
+
+			l.state = state
+			next = nt
+		}
+
+		return next
+	}
+
+	requireSameSecret := func(tree *Tree) {
+		var secret []byte
+		for _, l := range leaves {
+			if tree.Find(l.leaf.ID) < 0 {
+				continue
+			}
+
+			require.NotNil(t, l.state)
+			if secret == nil {
+				secret = l.state.Secret
+			}
+			require.Equal(t, secret, l.state.Secret)
+		}
+	}
+
+	// the first commit adds the committer
+	c, tree, state, err := CreateCommit(crand.Reader, &Tree{}, nil, leaves[0].leaf.ID, nil, []*Leaf{leaves[0].leaf, leaves[1].leaf, leaves[2].leaf})
+	require.NoError(t, err)
+	leaves[0].state = state
+
+	processed := process(&Tree{}, c, leaves[0])
+	require.Equal(t, tree.Leaves(), processed.Leaves())
+	require.Equal(t, tree.Parents(), processed.Parents())
+	requireSameSecret(tree)
+	require.Equal(t, 3, tree.Size())
+
+	// a leaf is added by another one
+	previous := tree
+	c, tree, state, err = CreateCommit(crand.Reader, previous, leaves[1].state, leaves[1].leaf.ID, nil, []*Leaf{leaves[3].leaf})
+	require.NoError(t, err)
+	leaves[1].state = state
+
+	process(previous, c, leaves[1])
+	requireSameSecret(tree)
+
+	// a removed leaf can't process the commit removing it, nor the next ones
+	removedState := leaves[2].state
+	previous = tree
+	c, tree, state, err = CreateCommit(crand.Reader, previous, leaves[3].state, leaves[3].leaf.ID, [][]byte{leaves[2].leaf.ID}, nil)
+	require.NoError(t, err)
+	leaves[3].state = state
+
+	_, _, err = ProcessCommit(previous, removedState, leaves[2].leaf.ID, leaves[2].privateKey, c)
+	require.Error(t, err)
+
+	process(previous, c, leaves[2], leaves[3])
+	leaves[2].state = nil
+	requireSameSecret(tree)
+	require.NotEqual(t, removedState.Secret, leaves[0].state.Secret)
+
+	// the removed leaf isn't in the resolution of the new path
+	previous = tree
+	c, tree, state, err = CreateCommit(crand.Reader, previous, leaves[0].state, leaves[0].leaf.ID, nil, []*Leaf{leaves[4].leaf})
+	require.NoError(t, err)
+	leaves[0].state = state
+
+	_, _, err = ProcessCommit(previous, removedState, leaves[2].leaf.ID, leaves[2].privateKey, c)
+	require.Error(t, err)
+
+	process(previous, c, leaves[0], leaves[2])
+	requireSameSecret(tree)
+
+	// a commit without changes refreshes the path of the committer
+	previous = tree
+	c, tree, state, err = CreateCommit(crand.Reader, previous, leaves[4].state, leaves[4].leaf.ID, nil, nil)
+	require.NoError(t, err)
+	leaves[4].state = state
+
+	process(previous, c, leaves[2], leaves[4])
+	requireSameSecret(tree)
+
+	key, err := leaves[0].state.Key("chain key")
+	require.NoError(t, err)
+	other, err := leaves[1].state.Key("chain key")
+	require.NoError(t, err)
+	require.Equal(t, key, other)
+
+	// the tree is loaded from its public part
+	loaded, err := Load(tree.Leaves(), tree.Parents())
+	require.NoError(t, err)
+	require.Equal(t, tree, loaded)
+
+	_, err = Load(tree.Leaves()[:3], tree.Parents()[:2])
+	require.Error(t, err)
+}
+
+func TestCommitInvalid(t *testing.T) {
+	a, b := newTestLeaf(t, "a"), newTestLeaf(t, "b")
+
+	c, tree, state, err := CreateCommit(crand.Reader, &Tree{}, nil, a.leaf.ID, nil, []*Leaf{a.leaf, b.leaf})
+	require.NoError(t, err)
+	a.state = state
+
+	_, b.state, err = ProcessCommit(&Tree{}, nil, b.leaf.ID, b.privateKey, c)
+	require.NoError(t, err)
+
+	// the path doesn't match the tree
+	invalid := *c
+	invalid.Path = nil
+	_, _, err = ProcessCommit(&Tree{}, nil, b.leaf.ID, b.privateKey, &invalid)
+	require.Error(t, err)
+
+	// a leaf can't be added twice
+	_, _, _, err = CreateCommit(crand.Reader, tree, a.state, a.leaf.ID, nil, []*Leaf{b.leaf})
+	require.Error(t, err)
+
+	// a leaf not in the tree can't commit
+	_, _, _, err = CreateCommit(crand.Reader, tree, a.state, a.leaf.ID, [][]byte{a.leaf.ID}, nil)
+	require.Error(t, err)
+
+	// a path secret encrypted to another key is refused
+	c, _, _, err = CreateCommit(crand.Reader, tree, a.state, a.leaf.ID, nil, nil)
+	require.NoError(t, err)
+
+	c.Path[0].EncryptedPathSecrets[0] = append([]byte(nil), c.Path[0].PublicKey...)
+	_, _, err = ProcessCommit(tree, b.state, b.leaf.ID, b.privateKey, c)
+	require.Error(t, err)
+}
+
+func containsLeaf(leaves []*Leaf, leaf *Leaf) bool {
+	for _, l := range leaves {
+		if string(l.ID) == string(leaf.ID) {
+			return true
+		}
+	}
+
+	return false
+}
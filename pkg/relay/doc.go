@@ -0,0 +1,4 @@
+// Package relay contains an untrusted store-and-forward relay: it keeps the
+// sealed envelopes deposited for offline recipients in rotating mailboxes
+// until they are fetched or expire, without replicating the group logs.
+package relay
@@ -0,0 +1,547 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/relaytypes"
+)
+
+const (
+	// DefaultTTL is the duration an envelope is kept for if the deposit
+	// doesn't set one
+	DefaultTTL = 24 * time.Hour
+
+	// DefaultMaxTTL is the maximum duration an envelope is kept for
+	DefaultMaxTTL = 7 * 24 * time.Hour
+
+	// DefaultMaxEnvelopeSize is the maximum size of the payload of an
+	// envelope
+	DefaultMaxEnvelopeSize = 64 << 10
+
+	// DefaultMaxMailboxEnvelopes is the maximum number of envelopes waiting in
+	// a mailbox
+	DefaultMaxMailboxEnvelopes = 1000
+
+	// DefaultMaxStorageSize is the maximum size of the envelopes stored by the
+	// relay, for all the mailboxes
+	DefaultMaxStorageSize = 1 << 30
+
+	// DefaultFetchLimit is the number of envelopes returned by a fetch which
+	// doesn't set a limit
+	DefaultFetchLimit = 100
+
+	// maxMailboxSize is the maximum size of a mailbox address, the mailboxes
+	// of the protocol are 32 bytes long
+	maxMailboxSize = 64
+)
+
+var (
+	dsKeyEnvelopes = ds.NewKey("envelopes")
+	dsKeyCursor    = ds.NewKey("cursor")
+)
+
+type Options struct {
+	Logger *zap.Logger
+
+	DefaultTTL          time.Duration
+	MaxTTL              time.Duration
+	MaxEnvelopeSize     int
+	MaxMailboxEnvelopes int
+
+	// MaxStorageSize bounds the size of the stored envelopes, the deposits
+	// are unauthenticated and anyone knowing a mailbox can fill it
+	MaxStorageSize int64
+}
+
+func (o *Options) applyDefaults() {
+	if o.Logger == nil {
+		o.Logger = zap.NewNop()
+	}
+
+	if o.MaxTTL <= 0 {
+		o.MaxTTL = DefaultMaxTTL
+	}
+
+	if o.DefaultTTL <= 0 {
+		o.DefaultTTL = DefaultTTL
+	}
+
+	if o.DefaultTTL > o.MaxTTL {
+		o.DefaultTTL = o.MaxTTL
+	}
+
+	if o.MaxEnvelopeSize <= 0 {
+		o.MaxEnvelopeSize = DefaultMaxEnvelopeSize
+	}
+
+	if o.MaxMailboxEnvelopes <= 0 {
+		o.MaxMailboxEnvelopes = DefaultMaxMailboxEnvelopes
+	}
+
+	if o.MaxStorageSize <= 0 {
+		o.MaxStorageSize = DefaultMaxStorageSize
+	}
+}
+
+var _ relaytypes.RelayServiceServer = (*Server)(nil)
+
+// Server is an untrusted store-and-forward relay. It keeps the envelopes
+// deposited in each mailbox until they expire, it doesn't know the groups nor
+// the members behind the mailboxes and can't open the envelopes.
+type Server struct {
+	relaytypes.UnimplementedRelayServiceServer
+
+	datastore ds.Datastore
+	opts      Options
+
+	// mu serializes the deposits, they increase the cursor and count the
+	// envelopes of the mailbox and the size of the stored envelopes
+	mu     sync.Mutex
+	cursor uint64
+	size   int64
+
+	muSubscribers sync.Mutex
+	subscribers   map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	mailboxes map[string]struct{}
+
+	// notify is signaled when an envelope is deposited in one of the
+	// mailboxes, the subscriber fetches them from its cursor
+	notify chan struct{}
+}
+
+// NewServer returns a relay storing the envelopes in the datastore
+func NewServer(ctx context.Context, datastore ds.Datastore, opts *Options) (*Server, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.applyDefaults()
+
+	s := &Server{
+		datastore:   datastore,
+		opts:        *opts,
+		subscribers: map[*subscriber]struct{}{},
+	}
+
+	data, err := datastore.Get(ctx, dsKeyCursor)
+	switch err {
+	case nil:
+		if len(data) != 8 {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid cursor"))
+		}
+		s.cursor = binary.BigEndian.Uint64(data)
+	case ds.ErrNotFound:
+	default:
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if s.size, err = s.storedSize(ctx); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// storedSize returns the size of the stored envelopes
+func (s *Server) storedSize(ctx context.Context) (int64, error) {
+	results, err := s.datastore.Query(ctx, dsq.Query{Prefix: dsKeyEnvelopes.String(), ReturnsSizes: true, KeysOnly: true})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	size := int64(0)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		size += int64(result.Size)
+	}
+
+	return size, nil
+}
+
+func (s *Server) Deposit(ctx context.Context, req *relaytypes.RelayDeposit_Request) (*relaytypes.RelayDeposit_Reply, error) {
+	if err := checkMailbox(req.Mailbox); err != nil {
+		return nil, err
+	}
+
+	if len(req.Payload) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("empty payload"))
+	}
+
+	if len(req.Payload) > s.opts.MaxEnvelopeSize {
+		return nil, errcode.ErrCode_ErrServiceRelayEnvelopeTooLarge.Wrap(fmt.Errorf("the envelope is %d bytes long, the maximum is %d", len(req.Payload), s.opts.MaxEnvelopeSize))
+	}
+
+	if req.Ttl < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid ttl"))
+	}
+
+	ttl := s.opts.DefaultTTL
+	if req.Ttl > 0 {
+		ttl = time.Duration(req.Ttl) * time.Second
+	}
+	if ttl > s.opts.MaxTTL {
+		ttl = s.opts.MaxTTL
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	count, err := s.dropExpiredMailbox(ctx, req.Mailbox, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if count >= s.opts.MaxMailboxEnvelopes {
+		return nil, errcode.ErrCode_ErrServiceRelayMailboxFull.Wrap(fmt.Errorf("the mailbox holds %d envelopes", count))
+	}
+
+	envelope := &relaytypes.RelayEnvelope{
+		Mailbox:     req.Mailbox,
+		Payload:     req.Payload,
+		Cursor:      s.cursor + 1,
+		DepositedAt: now.UnixNano(),
+		ExpiresAt:   now.Add(ttl).UnixNano(),
+	}
+
+	data, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// the expired envelopes of all the mailboxes are dropped before the
+	// relay is considered full
+	if s.size+int64(len(data)) > s.opts.MaxStorageSize {
+		if _, err := s.unsafeDropExpired(ctx, now); err != nil {
+			return nil, err
+		}
+
+		if s.size+int64(len(data)) > s.opts.MaxStorageSize {
+			return nil, errcode.ErrCode_ErrServiceRelayFull.Wrap(fmt.Errorf("the relay stores %d bytes", s.size))
+		}
+	}
+
+	cursor := make([]byte, 8)
+	binary.BigEndian.PutUint64(cursor, envelope.Cursor)
+
+	// the cursor is written first so it is never reused, even if the
+	// envelope is lost
+	if err := s.datastore.Put(ctx, dsKeyCursor, cursor); err != nil {
+		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+	s.cursor = envelope.Cursor
+
+	if err := s.datastore.Put(ctx, envelopeKey(req.Mailbox, envelope.Cursor), data); err != nil {
+		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+	s.size += int64(len(data))
+
+	s.notify(req.Mailbox)
+
+	return &relaytypes.RelayDeposit_Reply{
+		Cursor:    envelope.Cursor,
+		ExpiresAt: envelope.ExpiresAt,
+	}, nil
+}
+
+func (s *Server) Fetch(ctx context.Context, req *relaytypes.RelayFetch_Request) (*relaytypes.RelayFetch_Reply, error) {
+	if err := checkMailboxes(req.Mailboxes); err != nil {
+		return nil, err
+	}
+
+	limit := DefaultFetchLimit
+	if req.Limit > 0 {
+		limit = int(req.Limit)
+	}
+
+	envelopes, more, err := s.fetch(ctx, req.Mailboxes, req.Cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := req.Cursor
+	if len(envelopes) > 0 {
+		cursor = envelopes[len(envelopes)-1].Cursor
+	}
+
+	return &relaytypes.RelayFetch_Reply{
+		Envelopes: envelopes,
+		Cursor:    cursor,
+		More:      more,
+	}, nil
+}
+
+func (s *Server) Subscribe(req *relaytypes.RelaySubscribe_Request, srv relaytypes.RelayService_SubscribeServer) error {
+	if err := checkMailboxes(req.Mailboxes); err != nil {
+		return err
+	}
+
+	ctx := srv.Context()
+
+	// the subscriber is registered before the first fetch so the envelopes
+	// deposited meanwhile aren't missed
+	sub := s.subscribe(req.Mailboxes)
+	defer s.unsubscribe(sub)
+
+	cursor := req.Cursor
+	for {
+		envelopes, more, err := s.fetch(ctx, req.Mailboxes, cursor, DefaultFetchLimit)
+		if err != nil {
+			return err
+		}
+
+		for _, envelope := range envelopes {
+			if err := srv.Send(envelope); err != nil {
+				return err
+			}
+
+			cursor = envelope.Cursor
+		}
+
+		if more {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sub.notify:
+		}
+	}
+}
+
+// DropExpired drops the envelopes expired at now, it is called periodically
+// by the operators of the relay, the expired envelopes are never returned
+// even if they haven't been dropped yet
+func (s *Server) DropExpired(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unsafeDropExpired(ctx, now)
+}
+
+// unsafeDropExpired drops the envelopes expired at now, s.mu must be held
+func (s *Server) unsafeDropExpired(ctx context.Context, now time.Time) (int, error) {
+	results, err := s.datastore.Query(ctx, dsq.Query{Prefix: dsKeyEnvelopes.String()})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	expired := map[ds.Key]int{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		envelope := &relaytypes.RelayEnvelope{}
+		if err := proto.Unmarshal(result.Value, envelope); err != nil || envelope.ExpiresAt <= now.UnixNano() {
+			expired[ds.NewKey(result.Key)] = len(result.Value)
+		}
+	}
+
+	if err := s.unsafeDelete(ctx, expired); err != nil {
+		return 0, err
+	}
+
+	if len(expired) > 0 {
+		s.opts.Logger.Debug("dropped expired envelopes", zap.Int("count", len(expired)))
+	}
+
+	return len(expired), nil
+}
+
+// unsafeDelete deletes the envelopes of the keys given with their size, s.mu
+// must be held
+func (s *Server) unsafeDelete(ctx context.Context, envelopes map[ds.Key]int) error {
+	for key, size := range envelopes {
+		if err := s.datastore.Delete(ctx, key); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		s.size -= int64(size)
+	}
+
+	return nil
+}
+
+// fetch returns the envelopes of the mailboxes after the cursor ordered by
+// cursor, more is true if some were left out because of the limit. The
+// mailboxes are read one after the other, the envelopes deposited meanwhile
+// are left to the next fetch so the returned cursor never skips one of them.
+func (s *Server) fetch(ctx context.Context, mailboxes [][]byte, cursor uint64, limit int) ([]*relaytypes.RelayEnvelope, bool, error) {
+	now := time.Now().UnixNano()
+	envelopes := []*relaytypes.RelayEnvelope{}
+
+	// the envelopes up to the current cursor are all written, the deposits
+	// write them before releasing s.mu
+	s.mu.Lock()
+	last := s.cursor
+	s.mu.Unlock()
+
+	seen := map[string]struct{}{}
+	for _, mailbox := range mailboxes {
+		if _, ok := seen[string(mailbox)]; ok {
+			continue
+		}
+		seen[string(mailbox)] = struct{}{}
+
+		results, err := s.datastore.Query(ctx, dsq.Query{Prefix: mailboxKey(mailbox).String()})
+		if err != nil {
+			return nil, false, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		for result := range results.Next() {
+			if result.Error != nil {
+				_ = results.Close()
+				return nil, false, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+			}
+
+			envelope := &relaytypes.RelayEnvelope{}
+			if err := proto.Unmarshal(result.Value, envelope); err != nil {
+				continue
+			}
+
+			if envelope.Cursor <= cursor || envelope.Cursor > last || envelope.ExpiresAt <= now {
+				continue
+			}
+
+			envelopes = append(envelopes, envelope)
+		}
+
+		_ = results.Close()
+	}
+
+	sort.Slice(envelopes, func(i, j int) bool {
+		return envelopes[i].Cursor < envelopes[j].Cursor
+	})
+
+	if len(envelopes) > limit {
+		return envelopes[:limit], true, nil
+	}
+
+	return envelopes, false, nil
+}
+
+// dropExpiredMailbox drops the expired envelopes of the mailbox and returns
+// the number of envelopes left, s.mu must be held
+func (s *Server) dropExpiredMailbox(ctx context.Context, mailbox []byte, now time.Time) (int, error) {
+	results, err := s.datastore.Query(ctx, dsq.Query{Prefix: mailboxKey(mailbox).String()})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	count := 0
+	expired := map[ds.Key]int{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		envelope := &relaytypes.RelayEnvelope{}
+		if err := proto.Unmarshal(result.Value, envelope); err != nil || envelope.ExpiresAt <= now.UnixNano() {
+			expired[ds.NewKey(result.Key)] = len(result.Value)
+			continue
+		}
+
+		count++
+	}
+
+	if err := s.unsafeDelete(ctx, expired); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *Server) subscribe(mailboxes [][]byte) *subscriber {
+	sub := &subscriber{
+		mailboxes: make(map[string]struct{}, len(mailboxes)),
+		notify:    make(chan struct{}, 1),
+	}
+
+	for _, mailbox := range mailboxes {
+		sub.mailboxes[string(mailbox)] = struct{}{}
+	}
+
+	s.muSubscribers.Lock()
+	s.subscribers[sub] = struct{}{}
+	s.muSubscribers.Unlock()
+
+	return sub
+}
+
+func (s *Server) unsubscribe(sub *subscriber) {
+	s.muSubscribers.Lock()
+	delete(s.subscribers, sub)
+	s.muSubscribers.Unlock()
+}
+
+func (s *Server) notify(mailbox []byte) {
+	s.muSubscribers.Lock()
+	defer s.muSubscribers.Unlock()
+
+	for sub := range s.subscribers {
+		if _, ok := sub.mailboxes[string(mailbox)]; !ok {
+			continue
+		}
+
+		// a pending notification already makes the subscriber fetch the
+		// new envelope
+		select {
+		case sub.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func checkMailbox(mailbox []byte) error {
+	if len(mailbox) == 0 || len(mailbox) > maxMailboxSize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid mailbox"))
+	}
+
+	return nil
+}
+
+func checkMailboxes(mailboxes [][]byte) error {
+	if len(mailboxes) == 0 {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no mailbox"))
+	}
+
+	for _, mailbox := range mailboxes {
+		if err := checkMailbox(mailbox); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mailboxKey(mailbox []byte) ds.Key {
+	return dsKeyEnvelopes.ChildString(base64.RawURLEncoding.EncodeToString(mailbox))
+}
+
+// envelopeKey orders the envelopes of a mailbox by cursor
+func envelopeKey(mailbox []byte, cursor uint64) ds.Key {
+	return mailboxKey(mailbox).ChildString(fmt.Sprintf("%020d", cursor))
+}
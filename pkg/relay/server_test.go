@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/grpcutil"
+	"berty.tech/weshnet/v2/pkg/relaytypes"
+)
+
+func TestServerDepositFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := ds_sync.MutexWrap(ds.NewMapDatastore())
+
+	s, err := NewServer(ctx, datastore, &Options{MaxEnvelopeSize: 8, MaxMailboxEnvelopes: 2})
+	require.NoError(t, err)
+
+	mailboxA, mailboxB := []byte("mailbox-a"), []byte("mailbox-b")
+
+	for _, deposit := range []*relaytypes.RelayDeposit_Request{
+		{Mailbox: mailboxA, Payload: []byte("a1")},
+		{Mailbox: mailboxB, Payload: []byte("b1")},
+		{Mailbox: mailboxA, Payload: []byte("a2"), Ttl: 60},
+	} {
+		_, err := s.Deposit(ctx, deposit)
+		require.NoError(t, err)
+	}
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailboxA, Payload: []byte("a3")})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceRelayMailboxFull))
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailboxB, Payload: []byte("too large")})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceRelayEnvelopeTooLarge))
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Payload: []byte("b2")})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrInvalidInput))
+
+	// the envelopes of the mailboxes are returned in the order of the relay
+	reply, err := s.Fetch(ctx, &relaytypes.RelayFetch_Request{Mailboxes: [][]byte{mailboxA, mailboxB}, Limit: 2})
+	require.NoError(t, err)
+	require.True(t, reply.More)
+	require.Len(t, reply.Envelopes, 2)
+	require.Equal(t, []byte("a1"), reply.Envelopes[0].Payload)
+	require.Equal(t, []byte("b1"), reply.Envelopes[1].Payload)
+
+	reply, err = s.Fetch(ctx, &relaytypes.RelayFetch_Request{Mailboxes: [][]byte{mailboxA, mailboxB}, Cursor: reply.Cursor})
+	require.NoError(t, err)
+	require.False(t, reply.More)
+	require.Len(t, reply.Envelopes, 1)
+	require.Equal(t, []byte("a2"), reply.Envelopes[0].Payload)
+
+	// the cursor survives a restart
+	s, err = NewServer(ctx, datastore, nil)
+	require.NoError(t, err)
+
+	deposit, err := s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailboxB, Payload: []byte("b2")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), deposit.Cursor)
+
+	// only the envelope deposited with the default ttl is left after the ttl
+	// of a2
+	dropped, err := s.DropExpired(ctx, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, dropped)
+
+	dropped, err = s.DropExpired(ctx, time.Now().Add(DefaultMaxTTL))
+	require.NoError(t, err)
+	require.Equal(t, 3, dropped)
+
+	reply, err = s.Fetch(ctx, &relaytypes.RelayFetch_Request{Mailboxes: [][]byte{mailboxA, mailboxB}})
+	require.NoError(t, err)
+	require.Empty(t, reply.Envelopes)
+}
+
+func TestServerFetchDepositInProgress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := ds_sync.MutexWrap(ds.NewMapDatastore())
+
+	s, err := NewServer(ctx, datastore, nil)
+	require.NoError(t, err)
+
+	mailboxA, mailboxB := []byte("mailbox-a"), []byte("mailbox-b")
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailboxA, Payload: []byte("a1")})
+	require.NoError(t, err)
+
+	// an envelope written after the fetch has read the cursor of the relay,
+	// as a deposit landing in a mailbox already read, is left to the next
+	// fetch so the returned cursor doesn't skip it
+	data, err := proto.Marshal(&relaytypes.RelayEnvelope{Mailbox: mailboxB, Payload: []byte("b1"), Cursor: 2, ExpiresAt: time.Now().Add(time.Hour).UnixNano()})
+	require.NoError(t, err)
+	require.NoError(t, datastore.Put(ctx, envelopeKey(mailboxB, 2), data))
+
+	reply, err := s.Fetch(ctx, &relaytypes.RelayFetch_Request{Mailboxes: [][]byte{mailboxA, mailboxB}})
+	require.NoError(t, err)
+	require.Len(t, reply.Envelopes, 1)
+	require.Equal(t, uint64(1), reply.Cursor)
+}
+
+func TestServerMaxStorageSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := ds_sync.MutexWrap(ds.NewMapDatastore())
+	opts := &Options{MaxStorageSize: 200}
+
+	s, err := NewServer(ctx, datastore, opts)
+	require.NoError(t, err)
+
+	payload := make([]byte, 40)
+
+	// the limit applies to all the mailboxes
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("mailbox-a"), Payload: payload, Ttl: 1})
+	require.NoError(t, err)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("mailbox-b"), Payload: payload})
+	require.NoError(t, err)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("mailbox-c"), Payload: payload})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceRelayFull))
+
+	// the size is counted again on restart
+	s, err = NewServer(ctx, datastore, opts)
+	require.NoError(t, err)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("mailbox-c"), Payload: payload})
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceRelayFull))
+
+	// the expired envelopes are dropped to make room
+	time.Sleep(1100 * time.Millisecond)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("mailbox-c"), Payload: payload})
+	require.NoError(t, err)
+}
+
+func TestServerSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, err := NewServer(ctx, ds_sync.MutexWrap(ds.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	defer server.Stop()
+
+	relaytypes.RegisterRelayServiceServer(server, s)
+
+	l := grpcutil.NewBufListener(1024 * 1024)
+	go func() { _ = server.Serve(l) }()
+
+	cc, err := l.NewClientConn(ctx)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	client := relaytypes.NewRelayServiceClient(cc)
+
+	mailbox := []byte("mailbox")
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailbox, Payload: []byte("stored")})
+	require.NoError(t, err)
+
+	sub, err := client.Subscribe(ctx, &relaytypes.RelaySubscribe_Request{Mailboxes: [][]byte{mailbox}})
+	require.NoError(t, err)
+
+	// the stored envelopes are sent first
+	envelope, err := sub.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("stored"), envelope.Payload)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: []byte("other"), Payload: []byte("other")})
+	require.NoError(t, err)
+
+	_, err = s.Deposit(ctx, &relaytypes.RelayDeposit_Request{Mailbox: mailbox, Payload: []byte("live")})
+	require.NoError(t, err)
+
+	envelope, err = sub.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("live"), envelope.Payload)
+	require.Equal(t, uint64(3), envelope.Cursor)
+}
@@ -0,0 +1,138 @@
+package replicationtypes
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const replicationMetricNamespace = "bty_replication"
+
+// replicationStatsTimeout bounds the collection of the stats on each scrape
+const replicationStatsTimeout = 10 * time.Second
+
+var (
+	replicationRegisteredGroupsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "registered_groups"),
+		"number of replicated groups",
+		nil, nil,
+	)
+	replicationTenantsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "tenants"),
+		"number of tokens registering groups",
+		nil, nil,
+	)
+	replicationConnectedPeersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "connected_peers"),
+		"number of peers connected to the service",
+		nil, nil,
+	)
+	replicationStoredBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "stored_bytes"),
+		"size of the entries stored for the replicated groups",
+		nil, nil,
+	)
+	replicationEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "entries"),
+		"number of entries stored for the replicated groups",
+		[]string{"log"}, nil,
+	)
+	replicationErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "errors_total"),
+		"number of errors met while replicating the groups",
+		nil, nil,
+	)
+	replicationLagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "lag_seconds"),
+		"replication lag of the groups",
+		nil, nil,
+	)
+	replicationLaggingGroupsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(replicationMetricNamespace, "", "lagging_groups"),
+		"number of groups with heads left to replicate",
+		nil, nil,
+	)
+)
+
+// replicationLagBuckets are the buckets of the replication lag, in seconds
+var replicationLagBuckets = []float64{1, 5, 15, 60, 300, 900, 3600, 21600, 86400}
+
+// ReplicationCollector is a prometheus.Collector exposing the stats returned
+// by ReplicateAdminStats. The groups aren't used as labels, their public
+// keys would be exposed to the scrapers and multiply the series, they are
+// inspected with the admin API instead.
+var _ prometheus.Collector = (*ReplicationCollector)(nil)
+
+type ReplicationCollector struct {
+	stats func(ctx context.Context) (*ReplicateAdminStats_Reply, error)
+}
+
+// NewReplicationCollector returns a collector reading the stats from the
+// function, usually the ReplicateAdminStats handler of the replication server.
+// The server isn't part of this module, neither the handler nor the
+// registration of the collector are implemented here.
+func NewReplicationCollector(stats func(ctx context.Context) (*ReplicateAdminStats_Reply, error)) *ReplicationCollector {
+	return &ReplicationCollector{stats: stats}
+}
+
+func (rc *ReplicationCollector) Collect(cmetric chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicationStatsTimeout)
+	defer cancel()
+
+	stats, err := rc.stats(ctx)
+	if err != nil {
+		cmetric <- prometheus.NewInvalidMetric(replicationRegisteredGroupsDesc, err)
+		return
+	}
+
+	cmetric <- prometheus.MustNewConstMetric(replicationRegisteredGroupsDesc, prometheus.GaugeValue, float64(stats.RegisteredGroups))
+	cmetric <- prometheus.MustNewConstMetric(replicationTenantsDesc, prometheus.GaugeValue, float64(stats.Tenants))
+	cmetric <- prometheus.MustNewConstMetric(replicationConnectedPeersDesc, prometheus.GaugeValue, float64(stats.ConnectedPeers))
+	cmetric <- prometheus.MustNewConstMetric(replicationStoredBytesDesc, prometheus.GaugeValue, float64(stats.StoredBytes))
+	cmetric <- prometheus.MustNewConstMetric(replicationErrorsDesc, prometheus.CounterValue, float64(stats.ErrorCount))
+
+	metadataEntries, messageEntries := int64(0), int64(0)
+	lagging := 0
+	lagSum := 0.0
+	lagBuckets := make(map[float64]uint64, len(replicationLagBuckets))
+
+	for _, group := range stats.Groups {
+		metadataEntries += group.MetadataEntriesCount
+		messageEntries += group.MessageEntriesCount
+
+		lag := time.Duration(group.ReplicationLag).Seconds()
+		if lag > 0 {
+			lagging++
+		}
+
+		lagSum += lag
+		for _, bucket := range replicationLagBuckets {
+			if lag <= bucket {
+				lagBuckets[bucket]++
+			}
+		}
+	}
+
+	cmetric <- prometheus.MustNewConstMetric(replicationEntriesDesc, prometheus.GaugeValue, float64(metadataEntries), "metadata")
+	cmetric <- prometheus.MustNewConstMetric(replicationEntriesDesc, prometheus.GaugeValue, float64(messageEntries), "message")
+	cmetric <- prometheus.MustNewConstMetric(replicationLaggingGroupsDesc, prometheus.GaugeValue, float64(lagging))
+	cmetric <- prometheus.MustNewConstHistogram(replicationLagDesc, uint64(len(stats.Groups)), lagSum, lagBuckets)
+}
+
+// Describe sends the descriptions without collecting the stats, which can be
+// unavailable when the collector is registered
+func (rc *ReplicationCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		replicationRegisteredGroupsDesc,
+		replicationTenantsDesc,
+		replicationConnectedPeersDesc,
+		replicationStoredBytesDesc,
+		replicationEntriesDesc,
+		replicationErrorsDesc,
+		replicationLagDesc,
+		replicationLaggingGroupsDesc,
+	} {
+		ch <- desc
+	}
+}
@@ -0,0 +1,60 @@
+package replicationtypes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicationCollector(t *testing.T) {
+	stats := &ReplicateAdminStats_Reply{
+		RegisteredGroups: 2,
+		Tenants:          1,
+		ConnectedPeers:   3,
+		StoredBytes:      1024,
+		ErrorCount:       4,
+		Groups: []*ReplicatedGroupStatus{
+			{GroupPublicKey: "a", MetadataEntriesCount: 2, MessageEntriesCount: 10},
+			{GroupPublicKey: "b", MetadataEntriesCount: 3, MessageEntriesCount: 20, ReplicationLag: int64(30 * time.Second)},
+		},
+	}
+
+	collector := NewReplicationCollector(func(context.Context) (*ReplicateAdminStats_Reply, error) {
+		return stats, nil
+	})
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	require.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP bty_replication_entries number of entries stored for the replicated groups
+# TYPE bty_replication_entries gauge
+bty_replication_entries{log="message"} 30
+bty_replication_entries{log="metadata"} 5
+# HELP bty_replication_errors_total number of errors met while replicating the groups
+# TYPE bty_replication_errors_total counter
+bty_replication_errors_total 4
+# HELP bty_replication_lagging_groups number of groups with heads left to replicate
+# TYPE bty_replication_lagging_groups gauge
+bty_replication_lagging_groups 1
+`), "bty_replication_entries", "bty_replication_errors_total", "bty_replication_lagging_groups"))
+
+	require.Equal(t, 9, testutil.CollectAndCount(collector))
+
+	// the stats which can't be collected are reported to the scraper
+	failing := NewReplicationCollector(func(context.Context) (*ReplicateAdminStats_Reply, error) {
+		return nil, fmt.Errorf("unavailable")
+	})
+
+	registry = prometheus.NewRegistry()
+	require.NoError(t, registry.Register(failing))
+
+	_, err := registry.Gather()
+	require.Error(t, err)
+}
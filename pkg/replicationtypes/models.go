@@ -2,7 +2,11 @@ package replicationtypes
 
 import (
 	"encoding/base64"
+	"fmt"
+	"sort"
+	"time"
 
+	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 )
 
@@ -28,3 +32,66 @@ func (m *ReplicatedGroup) ToGroup() (*protocoltypes.Group, error) {
 		LinkKey:   linkKey,
 	}, nil
 }
+
+// RegistrationExpiry returns the expiry in unix nanoseconds of a registration
+// made at now for ttl seconds, 0 if ttl is 0 and the registration doesn't
+// expire
+func RegistrationExpiry(ttl int64, now time.Time) (int64, error) {
+	switch {
+	case ttl < 0:
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid ttl %d", ttl))
+	case ttl == 0:
+		return 0, nil
+	}
+
+	return now.Add(time.Duration(ttl) * time.Second).UnixNano(), nil
+}
+
+// Expired returns true if the registration has expired at now
+func (m *ReplicatedGroupToken) Expired(now time.Time) bool {
+	return m.ExpiresAt != 0 && m.ExpiresAt <= now.UnixNano()
+}
+
+// ExpiredGroups returns the public keys of the groups whose registrations have
+// all expired at now, the janitor of the service drops their logs along with
+// the ones of the groups unregistered by all their tokens
+func ExpiredGroups(registrations []*ReplicatedGroupToken, now time.Time) []string {
+	live := map[string]bool{}
+	for _, registration := range registrations {
+		pk := registration.ReplicatedGroupPublicKey
+		live[pk] = live[pk] || !registration.Expired(now)
+	}
+
+	expired := []string{}
+	for pk, isLive := range live {
+		if !isLive {
+			expired = append(expired, pk)
+		}
+	}
+
+	sort.Strings(expired)
+
+	return expired
+}
+
+// ProviderHints merges the lists of replication servers into the hints sent
+// to a server, without duplicates nor the server itself, sorted
+func ProviderHints(self string, hints ...[]string) []string {
+	seen := map[string]struct{}{}
+	providers := []string{}
+
+	for _, list := range hints {
+		for _, server := range list {
+			if _, ok := seen[server]; ok || server == "" || server == self {
+				continue
+			}
+
+			seen[server] = struct{}{}
+			providers = append(providers, server)
+		}
+	}
+
+	sort.Strings(providers)
+
+	return providers
+}
@@ -0,0 +1,49 @@
+package replicationtypes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiredGroups(t *testing.T) {
+	now := time.Now()
+
+	expiry, err := RegistrationExpiry(60, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute).UnixNano(), expiry)
+
+	expiry, err = RegistrationExpiry(0, now)
+	require.NoError(t, err)
+	require.Zero(t, expiry)
+
+	_, err = RegistrationExpiry(-1, now)
+	require.Error(t, err)
+
+	registrations := []*ReplicatedGroupToken{
+		{ReplicatedGroupPublicKey: "expired", TokenId: "1", ExpiresAt: now.Add(-time.Second).UnixNano()},
+		{ReplicatedGroupPublicKey: "expired", TokenId: "2", ExpiresAt: now.UnixNano()},
+		{ReplicatedGroupPublicKey: "renewed", TokenId: "1", ExpiresAt: now.Add(-time.Second).UnixNano()},
+		{ReplicatedGroupPublicKey: "renewed", TokenId: "2", ExpiresAt: now.Add(time.Second).UnixNano()},
+		{ReplicatedGroupPublicKey: "permanent", TokenId: "1"},
+	}
+
+	require.True(t, registrations[1].Expired(now))
+	require.False(t, registrations[4].Expired(now))
+
+	// a group is kept while a token registers it
+	require.Equal(t, []string{"expired"}, ExpiredGroups(registrations, now))
+	require.Equal(t, []string{"expired", "renewed"}, ExpiredGroups(registrations, now.Add(time.Second)))
+}
+
+func TestProviderHints(t *testing.T) {
+	require.Empty(t, ProviderHints("a"))
+	require.Empty(t, ProviderHints("a", []string{"a", ""}))
+
+	// the hints of the members and of the server are merged
+	require.Equal(t, []string{"b", "c", "d"}, ProviderHints("a",
+		[]string{"c", "a", "b"},
+		[]string{"d", "b"},
+	))
+}
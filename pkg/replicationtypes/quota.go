@@ -0,0 +1,89 @@
+package replicationtypes
+
+import (
+	"fmt"
+	"time"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// The quotas are only accounted by the helpers of this file, they are enforced
+// by the replication server which isn't part of this module: nothing in this
+// module rejects a registration or an entry over quota.
+
+// DefaultBandwidthWindow is the bandwidth window of the quotas which don't set
+// one
+const DefaultBandwidthWindow = 24 * time.Hour
+
+// BandwidthWindow returns the duration after which the bandwidth of a tenant
+// is reset
+func (q *ReplicationTenantQuota) BandwidthWindow() time.Duration {
+	if q.GetBandwidthWindowSeconds() <= 0 {
+		return DefaultBandwidthWindow
+	}
+
+	return time.Duration(q.GetBandwidthWindowSeconds()) * time.Second
+}
+
+// CheckRegisterGroup returns an error if the tenant can't register one more
+// group, it is checked when a group is registered with ReplicateGroup
+func (t *ReplicationTenant) CheckRegisterGroup() error {
+	if limit := t.GetQuota().GetMaxGroups(); limit > 0 && t.GroupCount >= limit {
+		return errcode.ErrCode_ErrServiceReplicationQuotaExceeded.Wrap(fmt.Errorf("the token has registered %d groups out of %d", t.GroupCount, limit))
+	}
+
+	return nil
+}
+
+// CheckStore returns an error if the tenant can't store size more bytes, it
+// is checked before an entry of one of its groups is stored
+func (t *ReplicationTenant) CheckStore(size int64) error {
+	if limit := t.GetQuota().GetMaxStoredBytes(); limit > 0 && t.StoredBytes+size > limit {
+		return errcode.ErrCode_ErrServiceReplicationQuotaExceeded.Wrap(fmt.Errorf("the token stores %d bytes out of %d", t.StoredBytes, limit))
+	}
+
+	return nil
+}
+
+// CheckBandwidth returns an error if the tenant can't exchange size more
+// bytes during the current bandwidth window, the window is reset once it has
+// elapsed
+func (t *ReplicationTenant) CheckBandwidth(size int64, now time.Time) error {
+	t.resetBandwidth(now)
+
+	if limit := t.GetQuota().GetMaxBandwidthBytes(); limit > 0 && t.BandwidthBytes+size > limit {
+		return errcode.ErrCode_ErrServiceReplicationQuotaExceeded.Wrap(fmt.Errorf("the token has exchanged %d bytes out of %d since %s", t.BandwidthBytes, limit, time.Unix(0, t.BandwidthWindowStart).UTC().Format(time.RFC3339)))
+	}
+
+	return nil
+}
+
+// AddGroup records a group registered by the tenant
+func (t *ReplicationTenant) AddGroup() {
+	t.GroupCount++
+}
+
+// AddStored records the size of the entries stored for the tenant, negative
+// when entries are deleted
+func (t *ReplicationTenant) AddStored(size int64) {
+	t.StoredBytes += size
+	if t.StoredBytes < 0 {
+		t.StoredBytes = 0
+	}
+}
+
+// AddBandwidth records the size of the entries exchanged for the tenant
+func (t *ReplicationTenant) AddBandwidth(size int64, now time.Time) {
+	t.resetBandwidth(now)
+	t.BandwidthBytes += size
+}
+
+func (t *ReplicationTenant) resetBandwidth(now time.Time) {
+	start := time.Unix(0, t.BandwidthWindowStart)
+	if t.BandwidthWindowStart != 0 && now.Sub(start) < t.GetQuota().BandwidthWindow() {
+		return
+	}
+
+	t.BandwidthWindowStart = now.UnixNano()
+	t.BandwidthBytes = 0
+}
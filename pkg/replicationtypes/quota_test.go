@@ -0,0 +1,56 @@
+package replicationtypes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+func TestReplicationTenantQuota(t *testing.T) {
+	now := time.Now()
+
+	tenant := &ReplicationTenant{
+		TokenIssuer: "issuer",
+		TokenId:     "token",
+		Quota: &ReplicationTenantQuota{
+			MaxGroups:              2,
+			MaxStoredBytes:         100,
+			MaxBandwidthBytes:      50,
+			BandwidthWindowSeconds: 60,
+		},
+	}
+
+	require.NoError(t, tenant.CheckRegisterGroup())
+	tenant.AddGroup()
+	require.NoError(t, tenant.CheckRegisterGroup())
+	tenant.AddGroup()
+
+	err := tenant.CheckRegisterGroup()
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrServiceReplicationQuotaExceeded))
+
+	require.NoError(t, tenant.CheckStore(100))
+	tenant.AddStored(80)
+	require.Error(t, tenant.CheckStore(21))
+
+	// the deleted entries free the quota
+	tenant.AddStored(-30)
+	require.NoError(t, tenant.CheckStore(21))
+
+	require.NoError(t, tenant.CheckBandwidth(50, now))
+	tenant.AddBandwidth(40, now)
+	require.Error(t, tenant.CheckBandwidth(11, now.Add(time.Second)))
+
+	// the bandwidth is reset with the window
+	require.NoError(t, tenant.CheckBandwidth(50, now.Add(time.Minute)))
+	require.Zero(t, tenant.BandwidthBytes)
+
+	// a tenant without quota is unlimited
+	unlimited := &ReplicationTenant{GroupCount: 1000, StoredBytes: 1 << 40}
+	require.NoError(t, unlimited.CheckRegisterGroup())
+	require.NoError(t, unlimited.CheckStore(1<<40))
+	require.NoError(t, unlimited.CheckBandwidth(1<<40, now))
+	require.Equal(t, DefaultBandwidthWindow, unlimited.GetQuota().BandwidthWindow())
+}
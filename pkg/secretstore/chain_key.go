@@ -27,6 +27,30 @@ func newDeviceChainKey() (*protocoltypes.DeviceChainKey, error) {
 	}, nil
 }
 
+// newRotatedDeviceChainKey creates a new random chain key replacing the given
+// one, the counter is kept so message counters of the device keep increasing
+func newRotatedDeviceChainKey(current *protocoltypes.DeviceChainKey, epoch uint64) (*protocoltypes.DeviceChainKey, error) {
+	deviceChainKey, err := newDeviceChainKey()
+	if err != nil {
+		return nil, err
+	}
+
+	deviceChainKey.Counter = current.Counter
+	deviceChainKey.Epoch = epoch
+
+	return deviceChainKey, nil
+}
+
+// newMetadataKey creates a new random key for the metadata events of a device
+func newMetadataKey() ([]byte, error) {
+	metadataKey := make([]byte, cryptoutil.KeySize)
+	if _, err := crand.Read(metadataKey); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoRandomGeneration.Wrap(err)
+	}
+
+	return metadataKey, nil
+}
+
 // encryptDeviceChainKey encrypts a device chain key for a target member
 func encryptDeviceChainKey(localDevicePrivateKey crypto.PrivKey, remoteMemberPubKey crypto.PubKey, deviceChainKey *protocoltypes.DeviceChainKey, group *protocoltypes.Group) ([]byte, error) {
 	chainKeyBytes, err := proto.Marshal(deviceChainKey)
@@ -39,8 +63,21 @@ func encryptDeviceChainKey(localDevicePrivateKey crypto.PrivKey, remoteMemberPub
 		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
 	}
 
-	nonce := groupIDToNonce(group)
-	encryptedChainKey := box.Seal(nil, chainKeyBytes, nonce, mongPub, mongPriv)
+	if deviceChainKey.Epoch == 0 {
+		nonce := groupIDToNonce(group)
+		encryptedChainKey := box.Seal(nil, chainKeyBytes, nonce, mongPub, mongPriv)
+
+		return encryptedChainKey, nil
+	}
+
+	// A rotated chain key is another payload for the same sender+receiver
+	// set, a random nonce is used and prepended to the encrypted chain key
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	encryptedChainKey := box.Seal(nonce[:], chainKeyBytes, nonce, mongPub, mongPriv)
 
 	return encryptedChainKey, nil
 }
@@ -55,6 +92,16 @@ func decryptDeviceChainKey(encryptedDeviceChainKey []byte, group *protocoltypes.
 	nonce := groupIDToNonce(group)
 	decryptedSecret := &protocoltypes.DeviceChainKey{}
 	decryptedMessage, ok := box.Open(nil, encryptedDeviceChainKey, nonce, mongPub, mongPriv)
+	if !ok && len(encryptedDeviceChainKey) > cryptoutil.NonceSize {
+		// Rotated chain keys are prefixed by their nonce
+		nonce, err = cryptoutil.NonceSliceToArray(encryptedDeviceChainKey[:cryptoutil.NonceSize])
+		if err != nil {
+			return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+		}
+
+		decryptedMessage, ok = box.Open(nil, encryptedDeviceChainKey[cryptoutil.NonceSize:], nonce, mongPub, mongPriv)
+	}
+
 	if !ok {
 		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to decrypt message"))
 	}
@@ -46,6 +46,21 @@ const (
 	// dsNamespaceGroupDatastore is a namespace to store groups by their public
 	// key
 	dsNamespaceGroupDatastore = "groupByPublicKey"
+
+	// dsNamespaceMetadataKeyForDeviceOnGroup is a namespace storing the keys
+	// a device encrypts its metadata events with for a given group and chain
+	// key epoch.
+	dsNamespaceMetadataKeyForDeviceOnGroup = "metadataKeyForDeviceOnGroup"
+
+	// dsNamespaceGroupEpochState is a namespace storing the epoch secret and
+	// the known tree keys of the current device for a given group and epoch
+	// commit.
+	dsNamespaceGroupEpochState = "groupEpochState"
+
+	// dsNamespaceGroupEpochPendingState is a namespace storing the state of
+	// the epochs committed by the current device until the commit is read
+	// back from the metadata store.
+	dsNamespaceGroupEpochPendingState = "groupEpochPendingState"
 )
 
 func dsKeyForGroup(key []byte) datastore.Key {
@@ -86,6 +101,43 @@ func dsKeyForCurrentChainKey(groupPublicKey crypto.PubKey, devicePublicKey crypt
 	}), nil
 }
 
+// dsKeyForMetadataKey returns a datastore.Key where will be stored the
+// metadata key of a device for a given group and epoch.
+func dsKeyForMetadataKey(groupPublicKey, devicePublicKey []byte, epoch uint64) datastore.Key {
+	return dsKeyPrefixForMetadataKeys(groupPublicKey, devicePublicKey).ChildString(fmt.Sprintf("%d", epoch))
+}
+
+// dsKeyPrefixForMetadataKeys returns the prefix of the datastore.Key storing
+// the metadata keys of a device for a given group.
+func dsKeyPrefixForMetadataKeys(groupPublicKey, devicePublicKey []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceMetadataKeyForDeviceOnGroup,
+		hex.EncodeToString(groupPublicKey),
+		hex.EncodeToString(devicePublicKey),
+	})
+}
+
+// dsKeyForGroupEpochState returns a datastore.Key where will be stored the
+// state of the current device for the epoch started by a given commit.
+func dsKeyForGroupEpochState(groupPublicKey, commitID []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceGroupEpochState,
+		hex.EncodeToString(groupPublicKey),
+		hex.EncodeToString(commitID),
+	})
+}
+
+// dsKeyForPendingGroupEpochState returns a datastore.Key where will be stored
+// the state of the epoch started by a commit of the current device, until the
+// commit is read back from the metadata store.
+func dsKeyForPendingGroupEpochState(groupPublicKey, commitHash []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceGroupEpochPendingState,
+		hex.EncodeToString(groupPublicKey),
+		hex.EncodeToString(commitHash),
+	})
+}
+
 // dsKeyForMessageKeyByCID returns a datastore.Key where will be stored a
 // message decryption key for a given message CID.
 func dsKeyForMessageKeyByCID(id cid.Cid) datastore.Key {
@@ -115,3 +167,46 @@ func dsKeyForOutOfStoreFirstLastCounters(groupPK, devicePK []byte) datastore.Key
 		base64.RawURLEncoding.EncodeToString(devicePK),
 	})
 }
+
+// dsKeyPrefixesForGroup returns the prefixes of the datastore.Key storing
+// chain keys, precomputed message keys, metadata keys and epoch states for a
+// given group.
+func dsKeyPrefixesForGroup(groupPublicKey []byte) []datastore.Key {
+	return []datastore.Key{
+		dsKeyPrefixForChainKeys(groupPublicKey),
+		datastore.KeyWithNamespaces([]string{
+			dsNamespacePrecomputedMessageKeys,
+			hex.EncodeToString(groupPublicKey),
+		}),
+		datastore.KeyWithNamespaces([]string{
+			dsNamespaceMetadataKeyForDeviceOnGroup,
+			hex.EncodeToString(groupPublicKey),
+		}),
+		datastore.KeyWithNamespaces([]string{
+			dsNamespaceGroupEpochState,
+			hex.EncodeToString(groupPublicKey),
+		}),
+		datastore.KeyWithNamespaces([]string{
+			dsNamespaceGroupEpochPendingState,
+			hex.EncodeToString(groupPublicKey),
+		}),
+	}
+}
+
+// dsKeyPrefixForChainKeys returns the prefix of the datastore.Key storing the
+// device chain keys for a given group.
+func dsKeyPrefixForChainKeys(groupPublicKey []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceChainKeyForDeviceOnGroup,
+		hex.EncodeToString(groupPublicKey),
+	})
+}
+
+// dsKeyPrefixForOutOfStoreFirstLastCounters returns the prefix of the
+// datastore.Key storing the first and last counters for a given group.
+func dsKeyPrefixForOutOfStoreFirstLastCounters(groupPK []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		dsNamespaceOutOfStoreGroupHintCounters,
+		base64.RawURLEncoding.EncodeToString(groupPK),
+	})
+}
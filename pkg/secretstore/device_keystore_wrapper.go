@@ -25,6 +25,10 @@ const (
 	keyMemberDevice = "memberDeviceSK"
 	keyMember       = "memberSK"
 	keyContactGroup = "contactGroupSK"
+
+	// keyNextSuffix is appended to the name of a device key to store the key
+	// replacing it on the next rotation
+	keyNextSuffix = "next"
 )
 
 // deviceKeystore is a wrapper around a keystore.Keystore object.
@@ -164,9 +168,78 @@ func (a *deviceKeystore) getOrGenerateDeviceKeyForMultiMemberGroup(groupPublicKe
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	name := strings.Join([]string{keyMemberDevice, hex.EncodeToString(groupPublicKeyRaw)}, "_")
+	return a.getOrGenerateNamedKey(multiMemberDeviceKeyName(groupPublicKeyRaw))
+}
+
+func multiMemberDeviceKeyName(groupPublicKeyRaw []byte) string {
+	return strings.Join([]string{keyMemberDevice, hex.EncodeToString(groupPublicKeyRaw)}, "_")
+}
+
+// nextMemberDeviceForGroup returns the member key of the group with the
+// device key which will replace the current one on the next rotation, the
+// device key is generated if needed. The account and contact groups share the
+// same next device key.
+func (a *deviceKeystore) nextMemberDeviceForGroup(group *protocoltypes.Group) (*ownMemberDevice, error) {
+	current, err := a.memberDeviceForGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	name := keyDevice
+	if group.GetGroupType() == protocoltypes.GroupType_GroupTypeMultiMember {
+		name = multiMemberDeviceKeyName(group.GetPublicKey())
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	devicePrivateKey, err := a.getOrGenerateNamedKey(strings.Join([]string{name, keyNextSuffix}, "_"))
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	return newOwnMemberDevice(current.member, devicePrivateKey), nil
+}
+
+// rotateDeviceKeys replaces the device keys by the next ones generated by
+// nextMemberDeviceForGroup, it returns the number of keys rotated
+func (a *deviceKeystore) rotateDeviceKeys() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names, err := a.keystore.List()
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	rotated := 0
+	for _, nextName := range names {
+		name := strings.TrimSuffix(nextName, "_"+keyNextSuffix)
+		if name == nextName {
+			continue
+		}
+
+		next, err := a.keystore.Get(nextName)
+		if err != nil {
+			return rotated, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
 
-	return a.getOrGenerateNamedKey(name)
+		if err := a.keystore.Delete(name); err != nil && err.Error() != keystore.ErrNoSuchKey.Error() {
+			return rotated, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if err := a.keystore.Put(name, next); err != nil {
+			return rotated, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if err := a.keystore.Delete(nextName); err != nil {
+			return rotated, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		rotated++
+	}
+
+	return rotated, nil
 }
 
 // getOrComputeECDH fetches a named private key or computes one via an
@@ -257,3 +330,27 @@ func (a *deviceKeystore) restoreAccountKeys(accountPrivateKeyBytes []byte, accou
 
 	return nil
 }
+
+// restoreDeviceKey replaces the device key used on the account and contact
+// groups, the account must not be set yet
+func (a *deviceKeystore) restoreDeviceKey(devicePrivateKeyBytes []byte) error {
+	devicePrivateKey, err := getEd25519PrivateKeyFromLibP2PFormattedBytes(devicePrivateKeyBytes)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if exists, err := a.keystore.Has(keyAccount); err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	} else if exists {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("an account is already set in this keystore"))
+	}
+
+	if err := a.keystore.Put(keyDevice, devicePrivateKey); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
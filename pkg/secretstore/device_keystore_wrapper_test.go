@@ -205,3 +205,46 @@ func Test_MemberDeviceForGroup_multimember(t *testing.T) {
 	assert.True(t, omd1M.Equals(omd2M))
 	assert.False(t, omd1D.Equals(omd2D))
 }
+
+func Test_RotateDeviceKeys(t *testing.T) {
+	acc, err := secretstore.NewInMemSecretStore(nil)
+	assert.NoError(t, err)
+
+	accountGroup, _, err := acc.GetGroupForAccount()
+	assert.NoError(t, err)
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	assert.NoError(t, err)
+
+	current := map[*protocoltypes.Group]secretstore.OwnMemberDevice{}
+	next := map[*protocoltypes.Group]secretstore.OwnMemberDevice{}
+	for _, group := range []*protocoltypes.Group{accountGroup, g} {
+		current[group], err = acc.GetOwnMemberDeviceForGroup(group)
+		assert.NoError(t, err)
+
+		next[group], err = acc.GetNextOwnMemberDeviceForGroup(group)
+		assert.NoError(t, err)
+
+		// the next key is kept until the rotation
+		again, err := acc.GetNextOwnMemberDeviceForGroup(group)
+		assert.NoError(t, err)
+		assert.True(t, next[group].Device().Equals(again.Device()))
+
+		assert.True(t, current[group].Member().Equals(next[group].Member()))
+		assert.False(t, current[group].Device().Equals(next[group].Device()))
+	}
+
+	assert.NoError(t, acc.RotateDeviceKeys())
+
+	for _, group := range []*protocoltypes.Group{accountGroup, g} {
+		rotated, err := acc.GetOwnMemberDeviceForGroup(group)
+		assert.NoError(t, err)
+		assert.True(t, rotated.Member().Equals(current[group].Member()))
+		assert.True(t, rotated.Device().Equals(next[group].Device()))
+
+		// a new next key is generated after a rotation
+		nextAfterRotation, err := acc.GetNextOwnMemberDeviceForGroup(group)
+		assert.NoError(t, err)
+		assert.False(t, nextAfterRotation.Device().Equals(rotated.Device()))
+	}
+}
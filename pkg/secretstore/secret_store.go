@@ -31,6 +31,7 @@ type secretStore struct {
 	deviceKeystore *deviceKeystore
 
 	messageMutex sync.RWMutex
+	epochMutex   sync.Mutex
 
 	preComputedKeysCount               int
 	precomputeOutOfStoreGroupRefsCount uint64
@@ -139,7 +140,41 @@ func (s *secretStore) GetOwnMemberDeviceForGroup(g *protocoltypes.Group) (OwnMem
 	return s.deviceKeystore.memberDeviceForGroup(g)
 }
 
+func (s *secretStore) GetNextOwnMemberDeviceForGroup(g *protocoltypes.Group) (OwnMemberDevice, error) {
+	return s.deviceKeystore.nextMemberDeviceForGroup(g)
+}
+
+func (s *secretStore) RotateDeviceKeys() error {
+	rotated, err := s.deviceKeystore.rotateDeviceKeys()
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug("rotated device keys", zap.Int("count", rotated))
+
+	return nil
+}
+
 func (s *secretStore) OpenOutOfStoreMessage(ctx context.Context, payload []byte) (*protocoltypes.OutOfStoreMessage, *protocoltypes.Group, []byte, bool, error) {
+	return s.openOutOfStoreMessage(ctx, payload, nil)
+}
+
+func (s *secretStore) OpenOutOfStoreMessages(ctx context.Context, payloads [][]byte) []*OpenedOutOfStoreMessage {
+	// groups are shared across the batch, payloads received together are
+	// likely to belong to a few groups only
+	groups := map[string]*protocoltypes.Group{}
+	results := make([]*OpenedOutOfStoreMessage, len(payloads))
+
+	for i, payload := range payloads {
+		result := &OpenedOutOfStoreMessage{}
+		result.Message, result.Group, result.ClearPayload, result.AlreadyDecrypted, result.Err = s.openOutOfStoreMessage(ctx, payload, groups)
+		results[i] = result
+	}
+
+	return results
+}
+
+func (s *secretStore) openOutOfStoreMessage(ctx context.Context, payload []byte, groups map[string]*protocoltypes.Group) (*protocoltypes.OutOfStoreMessage, *protocoltypes.Group, []byte, bool, error) {
 	oosMessageEnv := &protocoltypes.OutOfStoreMessageEnvelope{}
 	if err := proto.Unmarshal(payload, oosMessageEnv); err != nil {
 		return nil, nil, nil, false, errcode.ErrCode_ErrDeserialization.Wrap(err)
@@ -150,7 +185,12 @@ func (s *secretStore) OpenOutOfStoreMessage(ctx context.Context, payload []byte)
 		return nil, nil, nil, false, errcode.ErrCode_ErrNotFound.Wrap(err)
 	}
 
-	oosMessage, err := s.decryptOutOfStoreMessageEnv(ctx, oosMessageEnv, groupPublicKey)
+	group, err := s.fetchGroupWithCache(ctx, groupPublicKey, groups)
+	if err != nil {
+		return nil, nil, nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to find group, err: %w", err))
+	}
+
+	oosMessage, err := decryptOutOfStoreMessageEnvForGroup(oosMessageEnv, group)
 	if err != nil {
 		return nil, nil, nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 	}
@@ -160,25 +200,43 @@ func (s *secretStore) OpenOutOfStoreMessage(ctx context.Context, payload []byte)
 		return nil, nil, nil, false, errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
 	}
 
-	group, err := s.FetchGroupByPublicKey(ctx, groupPublicKey)
-	if err == nil {
-		if err := s.UpdateOutOfStoreGroupReferences(ctx, oosMessage.DevicePk, oosMessage.Counter, group); err != nil {
-			s.logger.Error("unable to update push group references", zap.Error(err))
-		}
+	if err := s.UpdateOutOfStoreGroupReferences(ctx, oosMessage.DevicePk, oosMessage.Counter, group); err != nil {
+		s.logger.Error("unable to update push group references", zap.Error(err))
 	}
 
 	return oosMessage, group, clear, !newlyDecrypted, nil
 }
 
-func (s *secretStore) decryptOutOfStoreMessageEnv(ctx context.Context, env *protocoltypes.OutOfStoreMessageEnvelope, groupPK crypto.PubKey) (*protocoltypes.OutOfStoreMessage, error) {
-	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+// fetchGroupWithCache fetches a group from the store, looking it up first in
+// the given cache if not nil
+func (s *secretStore) fetchGroupWithCache(ctx context.Context, groupPublicKey crypto.PubKey, groups map[string]*protocoltypes.Group) (*protocoltypes.Group, error) {
+	if groups == nil {
+		return s.FetchGroupByPublicKey(ctx, groupPublicKey)
+	}
+
+	keyBytes, err := groupPublicKey.Raw()
 	if err != nil {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if group, ok := groups[string(keyBytes)]; ok {
+		return group, nil
 	}
 
-	g, err := s.FetchGroupByPublicKey(ctx, groupPK)
+	group, err := s.FetchGroupByPublicKey(ctx, groupPublicKey)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unable to find group, err: %w", err))
+		return nil, err
+	}
+
+	groups[string(keyBytes)] = group
+
+	return group, nil
+}
+
+func decryptOutOfStoreMessageEnvForGroup(env *protocoltypes.OutOfStoreMessageEnvelope, g *protocoltypes.Group) (*protocoltypes.OutOfStoreMessage, error) {
+	nonce, err := cryptoutil.NonceSliceToArray(env.Nonce)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
 	secret := g.GetSharedSecret()
@@ -228,6 +286,10 @@ func (s *secretStore) ImportAccountKeys(accountPrivateKeyBytes []byte, accountPr
 	return s.deviceKeystore.restoreAccountKeys(accountPrivateKeyBytes, accountProofPrivateKeyBytes)
 }
 
+func (s *secretStore) ImportDeviceKey(devicePrivateKeyBytes []byte) error {
+	return s.deviceKeystore.restoreDeviceKey(devicePrivateKeyBytes)
+}
+
 func (s *secretStore) ExportAccountKeysForBackup() (accountPrivateKeyBytes []byte, accountProofPrivateKeyBytes []byte, err error) {
 	accountPrivateKey, err := s.deviceKeystore.getAccountPrivateKey()
 	if err != nil {
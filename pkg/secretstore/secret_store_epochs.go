@@ -0,0 +1,450 @@
+package secretstore
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"golang.org/x/crypto/nacl/secretbox"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/ratchettree"
+)
+
+// epochChainKeyLabel is the usage of the key derived from an epoch secret to
+// encrypt the chain keys sent to the devices of the epoch
+const epochChainKeyLabel = "chain key"
+
+// EpochTreeLeaf returns the leaf of a device in the epoch tree of a
+// multi-member group, its key is the X25519 conversion of the device key
+func EpochTreeLeaf(devicePublicKeyBytes []byte) (*ratchettree.Leaf, error) {
+	devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(devicePublicKeyBytes)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	mongPub, err := cryptoutil.EdwardsToMontgomeryPub(devicePublicKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	return &ratchettree.Leaf{ID: devicePublicKeyBytes, PublicKey: mongPub[:]}, nil
+}
+
+// EpochCommitFromEvent returns the commit of the epoch tree published by the
+// given event
+func EpochCommitFromEvent(e *protocoltypes.MultiMemberGroupEpochCommitted) (*ratchettree.Commit, error) {
+	c := &ratchettree.Commit{
+		Committer: e.DevicePk,
+		Removes:   e.RemovedDevicePks,
+		Welcomes:  e.Welcomes,
+	}
+
+	for _, devicePK := range e.AddedDevicePks {
+		leaf, err := EpochTreeLeaf(devicePK)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Adds = append(c.Adds, leaf)
+	}
+
+	for _, node := range e.Path {
+		c.Path = append(c.Path, &ratchettree.PathNode{
+			PublicKey:            node.PublicKey,
+			EncryptedPathSecrets: node.EncryptedPathSecrets,
+		})
+	}
+
+	return c, nil
+}
+
+// LoadEpochTree returns the epoch tree summarized by a snapshot, the leaves
+// are the device public keys and the blank nodes are empty
+func LoadEpochTree(leaves [][]byte, parents [][]byte) (*ratchettree.Tree, error) {
+	treeLeaves := make([]*ratchettree.Leaf, len(leaves))
+	for i, devicePK := range leaves {
+		if len(devicePK) == 0 {
+			continue
+		}
+
+		leaf, err := EpochTreeLeaf(devicePK)
+		if err != nil {
+			return nil, err
+		}
+
+		treeLeaves[i] = leaf
+	}
+
+	treeParents := make([][]byte, len(parents))
+	for i, key := range parents {
+		if len(key) > 0 {
+			treeParents[i] = key
+		}
+	}
+
+	return ratchettree.Load(treeLeaves, treeParents)
+}
+
+// EpochTreeNodes returns the leaves and the parents of an epoch tree as
+// summarized by a snapshot, see LoadEpochTree
+func EpochTreeNodes(t *ratchettree.Tree) (leaves [][]byte, parents [][]byte) {
+	for _, leaf := range t.Leaves() {
+		if leaf == nil {
+			leaves = append(leaves, []byte{})
+			continue
+		}
+
+		leaves = append(leaves, leaf.ID)
+	}
+
+	for _, key := range t.Parents() {
+		if key == nil {
+			key = []byte{}
+		}
+
+		parents = append(parents, key)
+	}
+
+	return leaves, parents
+}
+
+// epochCommitHash identifies a commit created by the current device until
+// it is appended to the log and gets a CID
+func epochCommitHash(e *protocoltypes.MultiMemberGroupEpochCommitted) ([]byte, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(e)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+func (s *secretStore) CreateGroupEpochCommit(ctx context.Context, group *protocoltypes.Group, parentID []byte, parent *ratchettree.Tree, epoch uint64, removedDevicePKs [][]byte, addedDevicePKs [][]byte) (*protocoltypes.MultiMemberGroupEpochCommitted, error) {
+	if s.deviceKeystore == nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	md, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := md.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	s.epochMutex.Lock()
+	defer s.epochMutex.Unlock()
+
+	var state *ratchettree.State
+	if parent.Find(devicePublicKeyBytes) >= 0 {
+		if state, err = s.getGroupEpochState(ctx, group, parentID); err != nil {
+			return nil, err
+		}
+	}
+
+	adds := make([]*ratchettree.Leaf, len(addedDevicePKs))
+	for i, devicePK := range addedDevicePKs {
+		if adds[i], err = EpochTreeLeaf(devicePK); err != nil {
+			return nil, err
+		}
+	}
+
+	c, _, nextState, err := ratchettree.CreateCommit(crand.Reader, parent, state, devicePublicKeyBytes, removedDevicePKs, adds)
+	if err != nil {
+		return nil, err
+	}
+
+	event := &protocoltypes.MultiMemberGroupEpochCommitted{
+		DevicePk:         devicePublicKeyBytes,
+		ParentId:         parentID,
+		Epoch:            epoch,
+		RemovedDevicePks: removedDevicePKs,
+		AddedDevicePks:   addedDevicePKs,
+		Welcomes:         c.Welcomes,
+	}
+
+	for _, node := range c.Path {
+		event.Path = append(event.Path, &protocoltypes.MultiMemberGroupEpochCommitted_PathNode{
+			PublicKey:            node.PublicKey,
+			EncryptedPathSecrets: node.EncryptedPathSecrets,
+		})
+	}
+
+	hash, err := epochCommitHash(event)
+	if err != nil {
+		return nil, err
+	}
+
+	// the state is kept until the commit is read back from the log
+	if err := s.putGroupEpochState(ctx, dsKeyForPendingGroupEpochState(group.GetPublicKey(), hash), nextState); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+func (s *secretStore) ProcessGroupEpochCommit(ctx context.Context, group *protocoltypes.Group, commitID []byte, parent *ratchettree.Tree, e *protocoltypes.MultiMemberGroupEpochCommitted) (bool, error) {
+	if s.deviceKeystore == nil {
+		return false, errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	md, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return false, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := md.Device().Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	s.epochMutex.Lock()
+	defer s.epochMutex.Unlock()
+
+	stateKey := dsKeyForGroupEpochState(group.GetPublicKey(), commitID)
+	if has, err := s.datastore.Has(ctx, stateKey); err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	} else if has {
+		return true, nil
+	}
+
+	// the state of a commit of the current device has been derived when
+	// creating it
+	if bytes.Equal(e.DevicePk, devicePublicKeyBytes) {
+		hash, err := epochCommitHash(e)
+		if err != nil {
+			return false, err
+		}
+
+		pendingKey := dsKeyForPendingGroupEpochState(group.GetPublicKey(), hash)
+		state, err := s.getGroupEpochStateForKey(ctx, pendingKey)
+		if errcode.Is(err, errcode.ErrCode_ErrMissingInput) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		if err := s.putGroupEpochState(ctx, stateKey, state); err != nil {
+			return false, err
+		}
+
+		if err := s.datastore.Delete(ctx, pendingKey); err != nil {
+			return false, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		return true, nil
+	}
+
+	var state *ratchettree.State
+	if parent.Find(devicePublicKeyBytes) >= 0 {
+		state, err = s.getGroupEpochState(ctx, group, e.ParentId)
+		if errcode.Is(err, errcode.ErrCode_ErrMissingInput) {
+			// the secret of the previous epoch is unknown, the device can
+			// only get the next ones once a commit adds it again
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	} else if !containsDevicePK(e.AddedDevicePks, devicePublicKeyBytes) {
+		return false, nil
+	}
+
+	c, err := EpochCommitFromEvent(e)
+	if err != nil {
+		return false, err
+	}
+
+	devicePrivateKey, err := cryptoutil.EdwardsToMontgomeryPriv(md.device)
+	if err != nil {
+		return false, errcode.ErrCode_ErrCryptoKeyConversion.Wrap(err)
+	}
+
+	_, nextState, err := ratchettree.ProcessCommit(parent, state, devicePublicKeyBytes, devicePrivateKey[:], c)
+	if errcode.Is(err, errcode.ErrCode_ErrGroupMemberRemoved) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := s.putGroupEpochState(ctx, stateKey, nextState); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *secretStore) IsGroupEpochKnown(ctx context.Context, group *protocoltypes.Group, commitID []byte) bool {
+	has, err := s.datastore.Has(ctx, dsKeyForGroupEpochState(group.GetPublicKey(), commitID))
+	return err == nil && has
+}
+
+func (s *secretStore) GetEpochShareableChainKey(ctx context.Context, group *protocoltypes.Group, commitID []byte) ([]byte, error) {
+	deviceChainKey, err := s.getOwnDeviceChainKeyForGroup(ctx, group)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	md, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := md.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// the devices added by the epoch need the metadata keys of the previous
+	// epochs to read the history of the group
+	if deviceChainKey.MetadataKeys, err = s.listMetadataKeys(ctx, group.GetPublicKey(), devicePublicKeyBytes); err != nil {
+		return nil, err
+	}
+
+	key, err := s.getEpochChainKeySecret(ctx, group, commitID)
+	if err != nil {
+		return nil, err
+	}
+
+	chainKeyBytes, err := proto.Marshal(deviceChainKey)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoNonceGeneration.Wrap(err)
+	}
+
+	return secretbox.Seal(nonce[:], chainKeyBytes, nonce, key), nil
+}
+
+func (s *secretStore) RegisterEpochChainKey(ctx context.Context, group *protocoltypes.Group, commitID []byte, senderDevicePublicKey crypto.PubKey, encryptedDeviceChainKey []byte) error {
+	if s.deviceKeystore == nil {
+		return errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	localMemberDevice, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	key, err := s.getEpochChainKeySecret(ctx, group, commitID)
+	if err != nil {
+		return err
+	}
+
+	if len(encryptedDeviceChainKey) < cryptoutil.NonceSize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("encrypted chain key too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(encryptedDeviceChainKey[:cryptoutil.NonceSize])
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+	}
+
+	chainKeyBytes, ok := secretbox.Open(nil, encryptedDeviceChainKey[cryptoutil.NonceSize:], nonce, key)
+	if !ok {
+		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to decrypt the chain key"))
+	}
+
+	deviceChainKey := &protocoltypes.DeviceChainKey{}
+	if err := proto.Unmarshal(chainKeyBytes, deviceChainKey); err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	senderDevicePublicKeyBytes, err := senderDevicePublicKey.Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := s.putMetadataKeys(ctx, group.GetPublicKey(), senderDevicePublicKeyBytes, deviceChainKey.MetadataKeys); err != nil {
+		return err
+	}
+
+	deviceChainKey.MetadataKeys = nil
+
+	return s.registerChainKey(ctx, group, senderDevicePublicKey, deviceChainKey, localMemberDevice.Device().Equals(senderDevicePublicKey))
+}
+
+// getEpochChainKeySecret returns the key encrypting the chain keys sent for
+// the epoch started by the given commit
+func (s *secretStore) getEpochChainKeySecret(ctx context.Context, group *protocoltypes.Group, commitID []byte) (*[cryptoutil.KeySize]byte, error) {
+	state, err := s.getGroupEpochState(ctx, group, commitID)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := state.Key(epochChainKeyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	return cryptoutil.KeySliceToArray(key)
+}
+
+func (s *secretStore) getGroupEpochState(ctx context.Context, group *protocoltypes.Group, commitID []byte) (*ratchettree.State, error) {
+	return s.getGroupEpochStateForKey(ctx, dsKeyForGroupEpochState(group.GetPublicKey(), commitID))
+}
+
+func (s *secretStore) getGroupEpochStateForKey(ctx context.Context, key datastore.Key) (*ratchettree.State, error) {
+	data, err := s.datastore.Get(ctx, key)
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("unknown epoch"))
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	stored := &protocoltypes.GroupEpochState{}
+	if err := proto.Unmarshal(data, stored); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	state := &ratchettree.State{Secret: stored.Secret, Keys: map[int][]byte{}}
+	for _, node := range stored.NodeKeys {
+		state.Keys[int(node.Index)] = node.PrivateKey
+	}
+
+	return state, nil
+}
+
+func (s *secretStore) putGroupEpochState(ctx context.Context, key datastore.Key, state *ratchettree.State) error {
+	stored := &protocoltypes.GroupEpochState{Secret: state.Secret}
+	for index, privateKey := range state.Keys {
+		stored.NodeKeys = append(stored.NodeKeys, &protocoltypes.GroupEpochState_NodeKey{
+			Index:      uint32(index),
+			PrivateKey: privateKey,
+		})
+	}
+
+	data, err := proto.Marshal(stored)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if err := s.datastore.Put(ctx, key, data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+func containsDevicePK(devicePKs [][]byte, devicePK []byte) bool {
+	for _, pk := range devicePKs {
+		if bytes.Equal(pk, devicePK) {
+			return true
+		}
+	}
+
+	return false
+}
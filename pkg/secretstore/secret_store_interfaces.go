@@ -8,7 +8,9 @@ import (
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/ratchettree"
 )
 
 const (
@@ -29,6 +31,9 @@ type SecretStore interface {
 	// ImportAccountKeys restores backup of account keys into the SecretStore, it should fail if the store is already used by an account
 	ImportAccountKeys(accountPrivateKey []byte, accountProofPrivateKey []byte) error
 
+	// ImportDeviceKey sets the key of the current device on the account and contact groups, it should fail if the store is already used by an account
+	ImportDeviceKey(devicePrivateKey []byte) error
+
 	// ExportAccountKeysForBackup returns the account's private key and proof private key of the user for a backup
 	ExportAccountKeysForBackup() (accountPrivateKey []byte, accountProofPrivateKey []byte, err error)
 
@@ -71,19 +76,66 @@ type SecretStore interface {
 	// GetOwnMemberDeviceForGroup gets a member and device key-pairs representing the current device in a given group
 	GetOwnMemberDeviceForGroup(group *protocoltypes.Group) (OwnMemberDevice, error)
 
+	// GetNextOwnMemberDeviceForGroup gets the member and device key-pairs which will represent the current device in a given group once RotateDeviceKeys is called
+	GetNextOwnMemberDeviceForGroup(group *protocoltypes.Group) (OwnMemberDevice, error)
+
+	// RotateDeviceKeys replaces the device keys of the current device by the ones returned by GetNextOwnMemberDeviceForGroup, the groups have to be reopened to use them
+	RotateDeviceKeys() error
+
 	//
 	// Chain-keys methods
 	//
 
-	// RegisterChainKey records another device chain-key
+	// RegisterChainKey records another device chain-key, encrypted for the
+	// member of the current device or for the device itself
 	RegisterChainKey(ctx context.Context, group *protocoltypes.Group, senderDevicePublicKey crypto.PubKey, encryptedDeviceChainKey []byte) error
 
-	// GetShareableChainKey returns a chain-key that can be decrypted by the provided member of a group
+	// GetShareableChainKey returns a chain-key that can be decrypted by the provided member of a group, or by the provided device
 	GetShareableChainKey(ctx context.Context, group *protocoltypes.Group, targetMemberPublicKey crypto.PubKey) (encryptedDeviceChainKey []byte, err error)
 
+	// RotateChainKey replaces the current device chain-key by a new random one for the given epoch, returns false if it was already rotated
+	RotateChainKey(ctx context.Context, group *protocoltypes.Group, epoch uint64) (rotated bool, err error)
+
+	// GetMetadataKey returns the key a device encrypts its metadata events with for a chain-key epoch
+	GetMetadataKey(ctx context.Context, group *protocoltypes.Group, devicePublicKey crypto.PubKey, epoch uint64) (metadataKey *[cryptoutil.KeySize]byte, err error)
+
+	// GetOwnMetadataKey returns the epoch and the key the current device encrypts its metadata events with, the key is nil until its chain-key is rotated
+	GetOwnMetadataKey(ctx context.Context, group *protocoltypes.Group) (epoch uint64, metadataKey *[cryptoutil.KeySize]byte, err error)
+
 	// IsChainKeyKnownForDevice checks whether a chain key of a device is already known
 	IsChainKeyKnownForDevice(ctx context.Context, groupPublicKey crypto.PubKey, devicePublicKey crypto.PubKey) (isKnown bool)
 
+	// DeleteMessageKey deletes the key of a message, whether it has already been used to open the message or is still precomputed
+	DeleteMessageKey(ctx context.Context, groupPublicKey crypto.PubKey, devicePublicKey crypto.PubKey, counter uint64, messageCID cid.Cid) error
+
+	// PurgeGroupKeys deletes the chain-keys, message keys and out-of-store references derived for a group, messageCIDs are the entries of its message store
+	PurgeGroupKeys(ctx context.Context, group *protocoltypes.Group, messageCIDs []cid.Cid) error
+
+	// ExportGroupKeys returns the chain keys of the devices of a group and the keys of the given messages, messages not opened yet are skipped
+	ExportGroupKeys(ctx context.Context, group *protocoltypes.Group, messageCIDs []cid.Cid) (*protocoltypes.GroupBundleKeys, error)
+
+	// ImportGroupKeys registers the keys exported by ExportGroupKeys, the chain keys of already known devices are ignored
+	ImportGroupKeys(ctx context.Context, group *protocoltypes.Group, keys *protocoltypes.GroupBundleKeys) error
+
+	//
+	// Group epochs methods
+	//
+
+	// CreateGroupEpochCommit creates the commit advancing the epoch tree of a multi-member group from the given parent commit, removing and adding the given devices, the state of the new epoch is kept until the commit is processed
+	CreateGroupEpochCommit(ctx context.Context, group *protocoltypes.Group, parentID []byte, parent *ratchettree.Tree, epoch uint64, removedDevicePKs [][]byte, addedDevicePKs [][]byte) (*protocoltypes.MultiMemberGroupEpochCommitted, error)
+
+	// ProcessGroupEpochCommit derives the state of the epoch started by a commit, returns false if the current device isn't part of the epoch or can't derive it
+	ProcessGroupEpochCommit(ctx context.Context, group *protocoltypes.Group, commitID []byte, parent *ratchettree.Tree, commit *protocoltypes.MultiMemberGroupEpochCommitted) (known bool, err error)
+
+	// IsGroupEpochKnown checks whether the state of the epoch started by a commit is known
+	IsGroupEpochKnown(ctx context.Context, group *protocoltypes.Group, commitID []byte) (isKnown bool)
+
+	// GetEpochShareableChainKey returns the current device chain-key encrypted for the devices of the epoch started by a commit
+	GetEpochShareableChainKey(ctx context.Context, group *protocoltypes.Group, commitID []byte) (encryptedDeviceChainKey []byte, err error)
+
+	// RegisterEpochChainKey records another device chain-key sent to the devices of the epoch started by a commit
+	RegisterEpochChainKey(ctx context.Context, group *protocoltypes.Group, commitID []byte, senderDevicePublicKey crypto.PubKey, encryptedDeviceChainKey []byte) error
+
 	//
 	// Out-of-store messages methods
 	//
@@ -94,6 +146,9 @@ type SecretStore interface {
 	// OpenOutOfStoreMessage opens a message received outside a synchronized store
 	OpenOutOfStoreMessage(ctx context.Context, payload []byte) (outOfStoreMessage *protocoltypes.OutOfStoreMessage, group *protocoltypes.Group, clearPayload []byte, alreadyDecrypted bool, err error)
 
+	// OpenOutOfStoreMessages opens several messages received outside a synchronized store, results are in the same order as the payloads
+	OpenOutOfStoreMessages(ctx context.Context, payloads [][]byte) []*OpenedOutOfStoreMessage
+
 	// UpdateOutOfStoreGroupReferences computes references of messages which might be received outside a synchronized store
 	UpdateOutOfStoreGroupReferences(ctx context.Context, devicePublicKeyBytes []byte, first uint64, group *protocoltypes.Group) error
 
@@ -124,6 +179,18 @@ type NewSecretStoreOptions struct {
 	DisableOutOfStoreSupport bool
 }
 
+// OpenedOutOfStoreMessage is the result of opening a single payload of a
+// batch received outside a synchronized store
+type OpenedOutOfStoreMessage struct {
+	Message          *protocoltypes.OutOfStoreMessage
+	Group            *protocoltypes.Group
+	ClearPayload     []byte
+	AlreadyDecrypted bool
+
+	// Err is set if the payload couldn't be opened, other fields are empty
+	Err error
+}
+
 // MemberDevice is the public keys of a device and its member
 type MemberDevice interface {
 	// Member returns the member public key
@@ -3,12 +3,16 @@ package secretstore
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"strconv"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/hkdf"
@@ -166,6 +170,17 @@ func (s *secretStore) GetShareableChainKey(ctx context.Context, group *protocolt
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
+	devicePublicKeyBytes, err := privateMemberDevice.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// The member needs the metadata keys of the previous epochs to read the
+	// metadata events sent before it received the chain key
+	if deviceChainKey.MetadataKeys, err = s.listMetadataKeys(ctx, group.GetPublicKey(), devicePublicKeyBytes); err != nil {
+		return nil, err
+	}
+
 	encryptedDeviceChainKey, err := encryptDeviceChainKey(privateMemberDevice.device, targetMemberPublicKey, deviceChainKey, group)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
@@ -241,10 +256,27 @@ func (s *secretStore) RegisterChainKey(ctx context.Context, group *protocoltypes
 
 	deviceChainKey, err := decryptDeviceChainKey(encryptedDeviceChainKey, group, localMemberDevice.member, senderDevicePublicKey)
 	if err != nil {
-		return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+		// once a device of the member has been revoked, the chain keys are
+		// encrypted for each of its remaining devices
+		if deviceChainKey, err = decryptDeviceChainKey(encryptedDeviceChainKey, group, localMemberDevice.device, senderDevicePublicKey); err != nil {
+			return errcode.ErrCode_ErrCryptoDecrypt.Wrap(err)
+		}
+	}
+
+	senderDevicePublicKeyBytes, err := senderDevicePublicKey.Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	hasSecretBeenSentByCurrentDevice := localMemberDevice.Member().Equals(senderDevicePublicKey)
+	// The metadata keys are stored apart from the chain key, which is
+	// replaced as it is derived
+	if err := s.putMetadataKeys(ctx, group.GetPublicKey(), senderDevicePublicKeyBytes, deviceChainKey.MetadataKeys); err != nil {
+		return err
+	}
+
+	deviceChainKey.MetadataKeys = nil
+
+	hasSecretBeenSentByCurrentDevice := localMemberDevice.Device().Equals(senderDevicePublicKey)
 
 	return s.registerChainKey(ctx, group, senderDevicePublicKey, deviceChainKey, hasSecretBeenSentByCurrentDevice)
 }
@@ -262,7 +294,11 @@ func (s *secretStore) registerChainKey(ctx context.Context, group *protocoltypes
 		return errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	if _, err := s.getDeviceChainKeyForGroupAndDevice(ctx, groupPublicKey, devicePublicKey); err == nil {
+	if knownDeviceChainKey, err := s.getDeviceChainKeyForGroupAndDevice(ctx, groupPublicKey, devicePublicKey); err == nil {
+		if !isCurrentDeviceChainKey && deviceChainKey.Epoch > knownDeviceChainKey.Epoch {
+			return s.replaceChainKey(ctx, group, devicePublicKey, knownDeviceChainKey, deviceChainKey)
+		}
+
 		// Device is already registered, ignore it
 		s.logger.Debug("device already registered in group",
 			logutil.PrivateBinary("devicePublicKey", logutil.CryptoKeyToBytes(devicePublicKey)),
@@ -309,6 +345,259 @@ func (s *secretStore) registerChainKey(ctx context.Context, group *protocoltypes
 	return nil
 }
 
+// replaceChainKey replaces the known chain key of another device by a rotated
+// one. The message keys precomputed from the previous chain key for counters
+// the device won't use anymore are discarded, messages sent before the
+// rotation can still be opened using the remaining precomputed keys.
+func (s *secretStore) replaceChainKey(ctx context.Context, group *protocoltypes.Group, devicePublicKey crypto.PubKey, knownDeviceChainKey *protocoltypes.DeviceChainKey, deviceChainKey *protocoltypes.DeviceChainKey) error {
+	groupPublicKey, err := group.GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	s.logger.Debug("replacing chain key",
+		logutil.PrivateBinary("devicePublicKey", logutil.CryptoKeyToBytes(devicePublicKey)),
+		logutil.PrivateBinary("groupPublicKey", logutil.CryptoKeyToBytes(groupPublicKey)),
+		zap.Uint64("epoch", deviceChainKey.Epoch),
+	)
+
+	s.messageMutex.Lock()
+
+	// Only the last precomputed keys can be ahead of the rotated chain key
+	from := deviceChainKey.Counter
+	if window := uint64(s.getPrecomputedKeyExpectedCount()); knownDeviceChainKey.Counter > window && from < knownDeviceChainKey.Counter-window {
+		from = knownDeviceChainKey.Counter - window
+	}
+
+	for counter := from + 1; counter <= knownDeviceChainKey.Counter; counter++ {
+		if err := s.delPrecomputedKey(ctx, groupPublicKey, devicePublicKey, counter); err != nil {
+			s.messageMutex.Unlock()
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	if deviceChainKey, err = s.preComputeKeys(ctx, devicePublicKey, groupPublicKey, deviceChainKey); err != nil {
+		s.messageMutex.Unlock()
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	if err := s.putDeviceChainKey(ctx, groupPublicKey, devicePublicKey, deviceChainKey); err != nil {
+		s.messageMutex.Unlock()
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	s.messageMutex.Unlock()
+
+	devicePublicKeyBytes, err := devicePublicKey.Raw()
+	if err == nil {
+		if err := s.UpdateOutOfStoreGroupReferences(ctx, devicePublicKeyBytes, deviceChainKey.Counter, group); err != nil {
+			s.logger.Error("updating out of store group references failed", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// RotateChainKey replaces the chain key of the current device for the given
+// group by a new random one, unless it has already been rotated for the given
+// epoch. A new metadata key is created for the epoch, it is sent along with
+// the chain key so the members the chain key isn't sent to anymore can't read
+// the metadata events of the device either.
+func (s *secretStore) RotateChainKey(ctx context.Context, group *protocoltypes.Group, epoch uint64) (bool, error) {
+	if s == nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	if s.deviceKeystore == nil {
+		return false, errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	md, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return false, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	groupPublicKey, err := group.GetPubKey()
+	if err != nil {
+		return false, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	current, err := s.getDeviceChainKeyForGroupAndDevice(ctx, groupPublicKey, md.Device())
+	if errcode.Is(err, errcode.ErrCode_ErrMissingInput) {
+		current = &protocoltypes.DeviceChainKey{}
+	} else if err != nil {
+		return false, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	} else if current.Epoch >= epoch {
+		return false, nil
+	}
+
+	deviceChainKey, err := newRotatedDeviceChainKey(current, epoch)
+	if err != nil {
+		return false, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	metadataKey, err := newMetadataKey()
+	if err != nil {
+		return false, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := md.Device().Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	// The metadata key is stored first, the chain key of an epoch always
+	// has one
+	if err := s.putMetadataKeys(ctx, group.GetPublicKey(), devicePublicKeyBytes, map[uint64][]byte{epoch: metadataKey}); err != nil {
+		return false, err
+	}
+
+	if err := s.putDeviceChainKey(ctx, groupPublicKey, md.Device(), deviceChainKey); err != nil {
+		return false, errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return true, nil
+}
+
+// GetMetadataKey returns the key the given device encrypts its metadata
+// events with for the given epoch.
+func (s *secretStore) GetMetadataKey(ctx context.Context, group *protocoltypes.Group, devicePublicKey crypto.PubKey, epoch uint64) (*[cryptoutil.KeySize]byte, error) {
+	if s == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	devicePublicKeyBytes, err := devicePublicKey.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return s.getMetadataKey(ctx, group.GetPublicKey(), devicePublicKeyBytes, epoch)
+}
+
+// GetOwnMetadataKey returns the epoch and the key the current device encrypts
+// its metadata events with. The key is nil until the chain key of the device
+// is rotated, the events are then encrypted with the group secret.
+func (s *secretStore) GetOwnMetadataKey(ctx context.Context, group *protocoltypes.Group) (uint64, *[cryptoutil.KeySize]byte, error) {
+	if s == nil {
+		return 0, nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("calling method of a non instantiated message keystore"))
+	}
+
+	if s.deviceKeystore == nil {
+		return 0, nil, errcode.ErrCode_ErrCryptoSignature.Wrap(fmt.Errorf("message keystore is opened in read-only mode"))
+	}
+
+	md, err := s.deviceKeystore.memberDeviceForGroup(group)
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	groupPublicKey, err := group.GetPubKey()
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	devicePublicKeyBytes, err := md.Device().Raw()
+	if err != nil {
+		return 0, nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	deviceChainKey, err := s.getDeviceChainKeyForGroupAndDevice(ctx, groupPublicKey, md.Device())
+	if errcode.Is(err, errcode.ErrCode_ErrMissingInput) {
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	} else if deviceChainKey.Epoch == 0 {
+		return 0, nil, nil
+	}
+
+	key, err := s.getMetadataKey(ctx, group.GetPublicKey(), devicePublicKeyBytes, deviceChainKey.Epoch)
+	if errcode.Is(err, errcode.ErrCode_ErrMissingInput) {
+		// The chain key has been rotated before the metadata keys were
+		// introduced
+		return 0, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	return deviceChainKey.Epoch, key, nil
+}
+
+// getMetadataKey returns the metadata key of the given device for the given
+// group and epoch.
+func (s *secretStore) getMetadataKey(ctx context.Context, groupPublicKey []byte, devicePublicKey []byte, epoch uint64) (*[cryptoutil.KeySize]byte, error) {
+	key, err := s.datastore.Get(ctx, dsKeyForMetadataKey(groupPublicKey, devicePublicKey, epoch))
+	if err == datastore.ErrNotFound {
+		return nil, errcode.ErrCode_ErrMissingInput.Wrap(err)
+	} else if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	keyArray, err := cryptoutil.KeySliceToArray(key)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return keyArray, nil
+}
+
+// listMetadataKeys returns the metadata keys of the given device for the given
+// group, by epoch.
+func (s *secretStore) listMetadataKeys(ctx context.Context, groupPublicKey []byte, devicePublicKey []byte) (map[uint64][]byte, error) {
+	results, err := s.datastore.Query(ctx, query.Query{Prefix: dsKeyPrefixForMetadataKeys(groupPublicKey, devicePublicKey).String()})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	keys := make(map[uint64][]byte, len(entries))
+	for _, entry := range entries {
+		epoch, err := strconv.ParseUint(datastore.NewKey(entry.Key).BaseNamespace(), 10, 64)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		keys[epoch] = entry.Value
+	}
+
+	return keys, nil
+}
+
+// putMetadataKeys stores the metadata keys of the given device for the given
+// group. The key of an epoch is never replaced, a device can't change the key
+// of the events it has already sent.
+func (s *secretStore) putMetadataKeys(ctx context.Context, groupPublicKey []byte, devicePublicKey []byte, keys map[uint64][]byte) error {
+	for epoch, key := range keys {
+		if epoch == 0 || len(key) != cryptoutil.KeySize {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid metadata key for epoch %d", epoch))
+		}
+
+		datastoreKey := dsKeyForMetadataKey(groupPublicKey, devicePublicKey, epoch)
+
+		if has, err := s.datastore.Has(ctx, datastoreKey); err != nil {
+			return errcode.ErrCode_ErrMessageKeyPersistenceGet.Wrap(err)
+		} else if has {
+			continue
+		}
+
+		if err := s.datastore.Put(ctx, datastoreKey, key); err != nil {
+			return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
 // preComputeKeys precomputes the next m.preComputedKeysCount keys for the given device and group and put them in the cache namespace.
 func (s *secretStore) preComputeKeys(ctx context.Context, devicePublicKey crypto.PubKey, groupPublicKey crypto.PubKey, deviceChainKey *protocoltypes.DeviceChainKey) (*protocoltypes.DeviceChainKey, error) {
 	if s == nil {
@@ -361,6 +650,7 @@ func (s *secretStore) preComputeKeys(ctx context.Context, devicePublicKey crypto
 	return &protocoltypes.DeviceChainKey{
 		Counter:  counter,
 		ChainKey: chainKeyValue,
+		Epoch:    deviceChainKey.Epoch,
 	}, nil
 }
 
@@ -410,6 +700,7 @@ func (s *secretStore) preComputeNextKey(ctx context.Context, groupPublicKey cryp
 	return &protocoltypes.DeviceChainKey{
 		Counter:  newCounter,
 		ChainKey: newCK,
+		Epoch:    ds.Epoch,
 	}, nil
 }
 
@@ -962,6 +1253,216 @@ func (s *secretStore) putFirstLastCachedGroupRefsForMember(ctx context.Context,
 	return s.datastore.Put(ctx, key, bytes)
 }
 
+// DeleteMessageKey deletes the message key for the given message, both from
+// the CID namespace and from the cache namespace if the message hasn't been
+// opened yet.
+func (s *secretStore) DeleteMessageKey(ctx context.Context, groupPublicKey crypto.PubKey, devicePublicKey crypto.PubKey, counter uint64, messageCID cid.Cid) error {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	if err := s.delPrecomputedKey(ctx, groupPublicKey, devicePublicKey, counter); err != nil {
+		return err
+	}
+
+	if err := s.datastore.Delete(ctx, dsKeyForMessageKeyByCID(messageCID)); err != nil {
+		return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+	}
+
+	return nil
+}
+
+// PurgeGroupKeys deletes the chain keys, precomputed message keys, message
+// keys of the given CIDs and out of store group references derived for the
+// given group.
+func (s *secretStore) PurgeGroupKeys(ctx context.Context, group *protocoltypes.Group, messageCIDs []cid.Cid) error {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	for _, prefix := range dsKeyPrefixesForGroup(group.GetPublicKey()) {
+		if err := s.deleteKeysWithPrefix(ctx, prefix); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range messageCIDs {
+		if err := s.datastore.Delete(ctx, dsKeyForMessageKeyByCID(id)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	countersPrefix := dsKeyPrefixForOutOfStoreFirstLastCounters(group.GetPublicKey())
+	results, err := s.datastore.Query(ctx, query.Query{Prefix: countersPrefix.String()})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		devicePublicKey, err := base64.RawURLEncoding.DecodeString(datastore.NewKey(entry.Key).BaseNamespace())
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		counters := protocoltypes.FirstLastCounters{}
+		if err := proto.Unmarshal(entry.Value, &counters); err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		for i := counters.First; i != counters.Last; i++ {
+			ref, err := createOutOfStoreGroupReference(group, devicePublicKey, i)
+			if err != nil {
+				return err
+			}
+
+			if err := s.datastore.Delete(ctx, dsKeyForOutOfStoreMessageGroupHint(ref)); err != nil {
+				return errcode.ErrCode_ErrDBWrite.Wrap(err)
+			}
+		}
+
+		if err := s.datastore.Delete(ctx, datastore.NewKey(entry.Key)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// ExportGroupKeys returns the chain keys of the devices of the given group and
+// the message keys of the given CIDs, so the group can be read from another
+// account. Messages which haven't been opened yet are skipped.
+func (s *secretStore) ExportGroupKeys(ctx context.Context, group *protocoltypes.Group, messageCIDs []cid.Cid) (*protocoltypes.GroupBundleKeys, error) {
+	s.messageMutex.Lock()
+	defer s.messageMutex.Unlock()
+
+	results, err := s.datastore.Query(ctx, query.Query{Prefix: dsKeyPrefixForChainKeys(group.GetPublicKey()).String()})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	keys := &protocoltypes.GroupBundleKeys{}
+
+	for _, entry := range entries {
+		devicePublicKey, err := hex.DecodeString(datastore.NewKey(entry.Key).BaseNamespace())
+		if err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		chainKey := &protocoltypes.DeviceChainKey{}
+		if err := proto.Unmarshal(entry.Value, chainKey); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if chainKey.MetadataKeys, err = s.listMetadataKeys(ctx, group.GetPublicKey(), devicePublicKey); err != nil {
+			return nil, err
+		}
+
+		keys.ChainKeys = append(keys.ChainKeys, &protocoltypes.GroupBundleKeys_ChainKey{
+			DevicePk: devicePublicKey,
+			ChainKey: chainKey,
+		})
+	}
+
+	for _, id := range messageCIDs {
+		key, err := s.datastore.Get(ctx, dsKeyForMessageKeyByCID(id))
+		if err == datastore.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+		}
+
+		keys.MessageKeys = append(keys.MessageKeys, &protocoltypes.GroupBundleKeys_MessageKey{
+			Cid: id.Bytes(),
+			Key: key,
+		})
+	}
+
+	return keys, nil
+}
+
+// ImportGroupKeys registers the chain keys and message keys exported by
+// ExportGroupKeys. The chain keys of the devices already known for the group
+// are left untouched.
+func (s *secretStore) ImportGroupKeys(ctx context.Context, group *protocoltypes.Group, keys *protocoltypes.GroupBundleKeys) error {
+	var ownDevicePublicKey crypto.PubKey
+	if s.deviceKeystore != nil {
+		md, err := s.deviceKeystore.memberDeviceForGroup(group)
+		if err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		ownDevicePublicKey = md.Device()
+	}
+
+	for _, chainKey := range keys.GetChainKeys() {
+		devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(chainKey.DevicePk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		isOwnDevice := ownDevicePublicKey != nil && ownDevicePublicKey.Equals(devicePublicKey)
+
+		if err := s.putMetadataKeys(ctx, group.GetPublicKey(), chainKey.DevicePk, chainKey.ChainKey.GetMetadataKeys()); err != nil {
+			return err
+		}
+
+		deviceChainKey := proto.Clone(chainKey.ChainKey).(*protocoltypes.DeviceChainKey)
+		deviceChainKey.MetadataKeys = nil
+
+		if err := s.registerChainKey(ctx, group, devicePublicKey, deviceChainKey, isOwnDevice); err != nil {
+			return errcode.ErrCode_ErrMessageKeyPersistencePut.Wrap(err)
+		}
+	}
+
+	for _, k := range keys.GetMessageKeys() {
+		id, err := cid.Cast(k.Cid)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		key, err := cryptoutil.KeySliceToArray(k.Key)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		if err := s.putKeyForCID(ctx, id, (*messageKey)(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteKeysWithPrefix deletes every key of the datastore starting with the
+// given prefix.
+func (s *secretStore) deleteKeysWithPrefix(ctx context.Context, prefix datastore.Key) error {
+	results, err := s.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		if err := s.datastore.Delete(ctx, datastore.NewKey(entry.Key)); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
 func sealPayload(payload []byte, ds *protocoltypes.DeviceChainKey, devicePrivateKey crypto.PrivKey, g *protocoltypes.Group) ([]byte, []byte, error) {
 	var (
 		msgKey [32]byte
@@ -9,11 +9,13 @@ import (
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 
+	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 )
 
@@ -148,7 +150,10 @@ func Test_SealOutOfStoreMessageEnvelope_OpenOutOfStoreMessage(t *testing.T) {
 	groupPublicKey, err := acc2.OutOfStoreGetGroupPublicKeyByGroupReference(ctx, outOfStoreEnv.GroupReference)
 	require.NoError(t, err)
 
-	outOfStoreMessage, err := accUnrelated.decryptOutOfStoreMessageEnv(ctx, outOfStoreEnv, groupPublicKey)
+	unrelatedGroup, err := accUnrelated.FetchGroupByPublicKey(ctx, groupPublicKey)
+	require.NoError(t, err)
+
+	outOfStoreMessage, err := decryptOutOfStoreMessageEnvForGroup(outOfStoreEnv, unrelatedGroup)
 	require.NoError(t, err)
 
 	payload, newlyDecrypted, err := acc2.OutOfStoreMessageOpen(ctx, outOfStoreMessage, groupPublicKey)
@@ -315,6 +320,271 @@ func Test_EncryptMessageEnvelopeAndDerive(t *testing.T) {
 	}
 }
 
+func Test_RotateChainKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	stores := make([]*secretStore, 3)
+	omds := make([]OwnMemberDevice, 3)
+	for i := range stores {
+		stores[i], err = newInMemSecretStore(nil)
+		require.NoError(t, err)
+
+		s := stores[i]
+		t.Cleanup(func() { _ = s.Close() })
+
+		omds[i], err = stores[i].GetOwnMemberDeviceForGroup(g)
+		require.NoError(t, err)
+	}
+
+	sender, remaining, removed := stores[0], stores[1], stores[2]
+
+	sealAndOpen := func(s *secretStore, omd OwnMemberDevice) error {
+		payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: []byte("test payload")})
+		require.NoError(t, err)
+
+		envEncrypted, err := sender.SealEnvelope(ctx, g, payload)
+		require.NoError(t, err)
+
+		env, headers, err := s.OpenEnvelopeHeaders(envEncrypted, g)
+		require.NoError(t, err)
+
+		_, err = s.OpenEnvelopePayload(ctx, env, headers, gPK, omd.Device(), cid.Undef)
+		return err
+	}
+
+	for i := 1; i < 3; i++ {
+		chainKey, err := sender.GetShareableChainKey(ctx, g, omds[i].Member())
+		require.NoError(t, err)
+		require.NoError(t, stores[i].RegisterChainKey(ctx, g, omds[0].Device(), chainKey))
+	}
+
+	oldChainKeyForRemaining, err := sender.GetShareableChainKey(ctx, g, omds[1].Member())
+	require.NoError(t, err)
+
+	require.NoError(t, sealAndOpen(remaining, omds[1]))
+	require.NoError(t, sealAndOpen(removed, omds[2]))
+
+	// metadata events are sealed with the group secret until the first
+	// rotation
+	epoch, metadataKey, err := sender.GetOwnMetadataKey(ctx, g)
+	require.NoError(t, err)
+	require.Zero(t, epoch)
+	require.Nil(t, metadataKey)
+
+	rotated, err := sender.RotateChainKey(ctx, g, 1)
+	require.NoError(t, err)
+	require.True(t, rotated)
+
+	rotated, err = sender.RotateChainKey(ctx, g, 1)
+	require.NoError(t, err)
+	require.False(t, rotated)
+
+	epoch, metadataKey, err = sender.GetOwnMetadataKey(ctx, g)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch)
+	require.NotNil(t, metadataKey)
+
+	chainKey, err := sender.GetShareableChainKey(ctx, g, omds[1].Member())
+	require.NoError(t, err)
+	require.NoError(t, remaining.RegisterChainKey(ctx, g, omds[0].Device(), chainKey))
+
+	// a chain key from a previous epoch is ignored
+	require.NoError(t, remaining.RegisterChainKey(ctx, g, omds[0].Device(), oldChainKeyForRemaining))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sealAndOpen(remaining, omds[1]))
+		require.Error(t, sealAndOpen(removed, omds[2]))
+	}
+
+	// the metadata key is only sent along with the rotated chain key
+	remainingMetadataKey, err := remaining.GetMetadataKey(ctx, g, omds[0].Device(), 1)
+	require.NoError(t, err)
+	require.Equal(t, metadataKey, remainingMetadataKey)
+
+	_, err = removed.GetMetadataKey(ctx, g, omds[0].Device(), 1)
+	require.True(t, errcode.Is(err, errcode.ErrCode_ErrMissingInput))
+
+	// a member receiving the chain key later gets the keys of the previous
+	// epochs
+	rotated, err = sender.RotateChainKey(ctx, g, 2)
+	require.NoError(t, err)
+	require.True(t, rotated)
+
+	late, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = late.Close() })
+
+	lateMD, err := late.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	chainKey, err = sender.GetShareableChainKey(ctx, g, lateMD.Member())
+	require.NoError(t, err)
+	require.NoError(t, late.RegisterChainKey(ctx, g, omds[0].Device(), chainKey))
+
+	for _, epoch := range []uint64{1, 2} {
+		_, err := late.GetMetadataKey(ctx, g, omds[0].Device(), epoch)
+		require.NoError(t, err)
+	}
+}
+
+func Test_PurgeGroupKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	otherGroup, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	otherGroupPK, err := otherGroup.GetPubKey()
+	require.NoError(t, err)
+
+	sender, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sender.Close() })
+
+	receiver, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = receiver.Close() })
+
+	dummyCID, err := cid.Parse("QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ")
+	require.NoError(t, err)
+
+	var senderDevice crypto.PubKey
+	for _, group := range []*protocoltypes.Group{g, otherGroup} {
+		senderMD, err := sender.GetOwnMemberDeviceForGroup(group)
+		require.NoError(t, err)
+
+		receiverMD, err := receiver.GetOwnMemberDeviceForGroup(group)
+		require.NoError(t, err)
+
+		chainKey, err := sender.GetShareableChainKey(ctx, group, receiverMD.Member())
+		require.NoError(t, err)
+		require.NoError(t, receiver.RegisterChainKey(ctx, group, senderMD.Device(), chainKey))
+
+		senderDevice = senderMD.Device()
+	}
+
+	payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: []byte("test payload")})
+	require.NoError(t, err)
+
+	envEncrypted, err := sender.SealEnvelope(ctx, g, payload)
+	require.NoError(t, err)
+
+	env, headers, err := receiver.OpenEnvelopeHeaders(envEncrypted, g)
+	require.NoError(t, err)
+
+	receiverMD, err := receiver.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	_, err = receiver.OpenEnvelopePayload(ctx, env, headers, gPK, receiverMD.Device(), dummyCID)
+	require.NoError(t, err)
+
+	pushGroupRef, err := createOutOfStoreGroupReference(g, headers.DevicePk, headers.Counter)
+	require.NoError(t, err)
+
+	_, err = receiver.OutOfStoreGetGroupPublicKeyByGroupReference(ctx, pushGroupRef)
+	require.NoError(t, err)
+
+	require.NoError(t, receiver.PurgeGroupKeys(ctx, g, []cid.Cid{dummyCID}))
+
+	_, err = receiver.getKeyForCID(ctx, dummyCID)
+	require.Error(t, err)
+
+	_, err = receiver.OutOfStoreGetGroupPublicKeyByGroupReference(ctx, pushGroupRef)
+	require.Error(t, err)
+
+	for _, key := range dsKeyPrefixesForGroup(g.GetPublicKey()) {
+		results, err := receiver.datastore.Query(ctx, query.Query{Prefix: key.String(), KeysOnly: true})
+		require.NoError(t, err)
+
+		entries, err := results.Rest()
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+
+	// keys of other groups are kept
+	require.True(t, receiver.IsChainKeyKnownForDevice(ctx, otherGroupPK, senderDevice))
+}
+
+func Test_ExportImportGroupKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := protocoltypes.NewGroupMultiMember()
+	require.NoError(t, err)
+
+	gPK, err := g.GetPubKey()
+	require.NoError(t, err)
+
+	sender, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sender.Close() })
+
+	receiver, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = receiver.Close() })
+
+	importer, err := newInMemSecretStore(nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = importer.Close() })
+
+	senderMD, err := sender.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	receiverMD, err := receiver.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	chainKey, err := sender.GetShareableChainKey(ctx, g, receiverMD.Member())
+	require.NoError(t, err)
+	require.NoError(t, receiver.RegisterChainKey(ctx, g, senderMD.Device(), chainKey))
+
+	payload, err := proto.Marshal(&protocoltypes.EncryptedMessage{Plaintext: []byte("test payload")})
+	require.NoError(t, err)
+
+	envEncrypted, err := sender.SealEnvelope(ctx, g, payload)
+	require.NoError(t, err)
+
+	env, headers, err := receiver.OpenEnvelopeHeaders(envEncrypted, g)
+	require.NoError(t, err)
+
+	openedCID, err := cid.Parse("QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ")
+	require.NoError(t, err)
+
+	unopenedCID, err := cid.Parse("QmbdQXQh9B2bWZgZJqfbjNPV5jGN2owbQ3vjeYsaDaCDqU")
+	require.NoError(t, err)
+
+	_, err = receiver.OpenEnvelopePayload(ctx, env, headers, gPK, receiverMD.Device(), openedCID)
+	require.NoError(t, err)
+
+	keys, err := receiver.ExportGroupKeys(ctx, g, []cid.Cid{openedCID, unopenedCID})
+	require.NoError(t, err)
+	require.Len(t, keys.ChainKeys, 1)
+	require.Len(t, keys.MessageKeys, 1)
+
+	require.False(t, importer.IsChainKeyKnownForDevice(ctx, gPK, senderMD.Device()))
+	require.NoError(t, importer.ImportGroupKeys(ctx, g, keys))
+	require.True(t, importer.IsChainKeyKnownForDevice(ctx, gPK, senderMD.Device()))
+
+	importerMD, err := importer.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	msg, err := importer.OpenEnvelopePayload(ctx, env, headers, gPK, importerMD.Device(), openedCID)
+	require.NoError(t, err)
+	require.Equal(t, []byte("test payload"), msg.Plaintext)
+}
+
 func mustDeviceChainKey(t testing.TB) func(ds *protocoltypes.DeviceChainKey, err error) *protocoltypes.DeviceChainKey {
 	return func(ds *protocoltypes.DeviceChainKey, err error) *protocoltypes.DeviceChainKey {
 		t.Helper()
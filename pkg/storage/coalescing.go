@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+const (
+	// DefaultFlushInterval is the maximum delay before the pending writes
+	// of a coalescing datastore are flushed
+	DefaultFlushInterval = 50 * time.Millisecond
+
+	// DefaultFlushSize is the number of pending writes of a coalescing
+	// datastore triggering a flush
+	DefaultFlushSize = 256
+)
+
+// Durability is the guarantee given on the writes of a coalescing datastore
+// once they have returned
+type Durability int
+
+const (
+	// DurabilityBatched flushes the writes in a single batch, synced to
+	// disk, after the flush interval or once the flush size is reached. The
+	// writes pending when the process crashes are lost.
+	DurabilityBatched Durability = iota
+
+	// DurabilityRelaxed flushes the writes like DurabilityBatched without
+	// syncing them, they are persisted when the underlying datastore decides
+	// to, a crash of the system can lose them.
+	DurabilityRelaxed
+
+	// DurabilitySync writes and syncs each write before returning, as
+	// without coalescing.
+	DurabilitySync
+)
+
+// CoalescingOptions configures a coalescing datastore, the zero value uses
+// the default flush interval and size with DurabilityBatched
+type CoalescingOptions struct {
+	// FlushInterval is the maximum delay before the pending writes are
+	// flushed
+	FlushInterval time.Duration
+
+	// FlushSize is the number of pending writes triggering a flush
+	FlushSize int
+
+	// Durability is the guarantee given on the writes
+	Durability Durability
+}
+
+// CoalescingDatastore groups the writes made to a datastore in batches. Each
+// small write to a persistent datastore is a transaction of its own, which
+// dominates the time spent appending many small entries, such as the
+// acknowledgements or the reactions of a busy group. The pending writes are
+// served to the reads and flushed before the queries.
+type CoalescingDatastore struct {
+	child ds.Batching
+	opts  CoalescingOptions
+
+	// pending are the writes not flushed yet, a nil value is a deletion.
+	// flushing are the writes of the flush in progress, they are still read
+	// from here until the batch is committed.
+	pending  map[ds.Key][]byte
+	flushing map[ds.Key][]byte
+	timer    *time.Timer
+
+	// flushErr is the error of the latest background flush, returned by the
+	// next write once it is queued, the failed writes are retried with the
+	// next flush
+	flushErr error
+	mu       sync.RWMutex
+
+	// muFlush serializes the flushes
+	muFlush sync.Mutex
+}
+
+var (
+	_ ds.Batching            = (*CoalescingDatastore)(nil)
+	_ ds.GCDatastore         = (*CoalescingDatastore)(nil)
+	_ ds.PersistentDatastore = (*CoalescingDatastore)(nil)
+)
+
+// NewCoalescing returns a datastore grouping the writes made to child in
+// batches, opts can be nil
+func NewCoalescing(child ds.Batching, opts *CoalescingOptions) *CoalescingDatastore {
+	d := &CoalescingDatastore{
+		child:   child,
+		pending: map[ds.Key][]byte{},
+	}
+
+	if opts != nil {
+		d.opts = *opts
+	}
+
+	if d.opts.FlushInterval <= 0 {
+		d.opts.FlushInterval = DefaultFlushInterval
+	}
+
+	if d.opts.FlushSize <= 0 {
+		d.opts.FlushSize = DefaultFlushSize
+	}
+
+	return d
+}
+
+// write adds the writes to the pending ones, a nil value is a deletion
+func (d *CoalescingDatastore) write(ctx context.Context, writes map[ds.Key][]byte) error {
+	if d.opts.Durability == DurabilitySync {
+		return d.commit(ctx, writes)
+	}
+
+	d.mu.Lock()
+
+	for key, value := range writes {
+		d.pending[key] = value
+	}
+
+	// the failed writes are retried with the pending ones, the writes are
+	// queued before the error of the background flush is reported
+	if err := d.flushErr; err != nil {
+		d.flushErr = nil
+		if d.timer == nil {
+			d.timer = time.AfterFunc(d.opts.FlushInterval, d.flushInBackground)
+		}
+
+		d.mu.Unlock()
+		return err
+	}
+
+	full := len(d.pending) >= d.opts.FlushSize
+	if !full && d.timer == nil {
+		d.timer = time.AfterFunc(d.opts.FlushInterval, d.flushInBackground)
+	}
+
+	d.mu.Unlock()
+
+	if full {
+		return d.Flush(ctx)
+	}
+
+	return nil
+}
+
+func (d *CoalescingDatastore) flushInBackground() {
+	if err := d.Flush(context.Background()); err != nil {
+		d.mu.Lock()
+		d.flushErr = err
+		d.mu.Unlock()
+	}
+}
+
+// commit writes a batch to the underlying datastore and syncs it if the
+// durability requires it
+func (d *CoalescingDatastore) commit(ctx context.Context, writes map[ds.Key][]byte) error {
+	batch, err := d.child.Batch(ctx)
+	if err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	for key, value := range writes {
+		if value == nil {
+			err = batch.Delete(ctx, key)
+		} else {
+			err = batch.Put(ctx, key, value)
+		}
+
+		if err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if d.opts.Durability == DurabilityRelaxed {
+		return nil
+	}
+
+	if err := d.child.Sync(ctx, ds.NewKey("/")); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// Flush writes the pending writes to the underlying datastore
+func (d *CoalescingDatastore) Flush(ctx context.Context) error {
+	d.muFlush.Lock()
+	defer d.muFlush.Unlock()
+
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	if len(d.pending) == 0 {
+		d.mu.Unlock()
+		return nil
+	}
+
+	d.flushing, d.pending = d.pending, map[ds.Key][]byte{}
+	writes := d.flushing
+	d.mu.Unlock()
+
+	err := d.commit(ctx, writes)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err != nil {
+		// the writes are retried with the next flush, unless they have been
+		// replaced in the meantime
+		for key, value := range writes {
+			if _, ok := d.pending[key]; !ok {
+				d.pending[key] = value
+			}
+		}
+
+		if d.timer == nil {
+			d.timer = time.AfterFunc(d.opts.FlushInterval, d.flushInBackground)
+		}
+	}
+
+	d.flushing = nil
+
+	return err
+}
+
+// lookup returns the pending write of the key, if any
+func (d *CoalescingDatastore) lookup(key ds.Key) (value []byte, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if value, ok = d.pending[key]; ok {
+		return value, ok
+	}
+
+	value, ok = d.flushing[key]
+	return value, ok
+}
+
+func (d *CoalescingDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	// the value is kept until it is flushed
+	stored := make([]byte, len(value))
+	copy(stored, value)
+
+	return d.write(ctx, map[ds.Key][]byte{key: stored})
+}
+
+func (d *CoalescingDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.write(ctx, map[ds.Key][]byte{key: nil})
+}
+
+func (d *CoalescingDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	if value, ok := d.lookup(key); ok {
+		if value == nil {
+			return nil, ds.ErrNotFound
+		}
+
+		return value, nil
+	}
+
+	return d.child.Get(ctx, key)
+}
+
+func (d *CoalescingDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	if value, ok := d.lookup(key); ok {
+		return value != nil, nil
+	}
+
+	return d.child.Has(ctx, key)
+}
+
+func (d *CoalescingDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	if value, ok := d.lookup(key); ok {
+		if value == nil {
+			return -1, ds.ErrNotFound
+		}
+
+		return len(value), nil
+	}
+
+	return d.child.GetSize(ctx, key)
+}
+
+// Query flushes the pending writes before querying the underlying datastore
+func (d *CoalescingDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	if err := d.Flush(ctx); err != nil {
+		return nil, err
+	}
+
+	return d.child.Query(ctx, q)
+}
+
+func (d *CoalescingDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	if err := d.Flush(ctx); err != nil {
+		return err
+	}
+
+	return d.child.Sync(ctx, prefix)
+}
+
+// CollectGarbage collects the garbage of the underlying datastore if it
+// supports it
+func (d *CoalescingDatastore) CollectGarbage(ctx context.Context) error {
+	if gc, ok := d.child.(ds.GCFeature); ok {
+		return gc.CollectGarbage(ctx)
+	}
+
+	return nil
+}
+
+// DiskUsage returns the disk usage of the underlying datastore, 0 if it isn't
+// persistent
+func (d *CoalescingDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.child)
+}
+
+// Close flushes the pending writes and closes the underlying datastore
+func (d *CoalescingDatastore) Close() error {
+	if err := d.Flush(context.Background()); err != nil {
+		return err
+	}
+
+	return d.child.Close()
+}
+
+func (d *CoalescingDatastore) Batch(context.Context) (ds.Batch, error) {
+	return &coalescingBatch{datastore: d, writes: map[ds.Key][]byte{}}, nil
+}
+
+// coalescingBatch adds its writes to the pending writes of the datastore at
+// once when it is committed
+type coalescingBatch struct {
+	datastore *CoalescingDatastore
+	writes    map[ds.Key][]byte
+}
+
+func (b *coalescingBatch) Put(_ context.Context, key ds.Key, value []byte) error {
+	stored := make([]byte, len(value))
+	copy(stored, value)
+
+	b.writes[key] = stored
+	return nil
+}
+
+func (b *coalescingBatch) Delete(_ context.Context, key ds.Key) error {
+	b.writes[key] = nil
+	return nil
+}
+
+func (b *coalescingBatch) Commit(ctx context.Context) error {
+	return b.datastore.write(ctx, b.writes)
+}
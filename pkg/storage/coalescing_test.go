@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescingDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := dsync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, child.Put(ctx, ds.NewKey("/acks/0"), []byte("stored")))
+
+	datastore := NewCoalescing(child, &CoalescingOptions{FlushInterval: time.Hour, FlushSize: 10})
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/1"), []byte("ack 1")))
+	require.NoError(t, datastore.Delete(ctx, ds.NewKey("/acks/0")))
+
+	batch, err := datastore.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/acks/2"), []byte("ack 2")))
+	require.NoError(t, batch.Commit(ctx))
+
+	// the writes are pending
+	has, err := child.Has(ctx, ds.NewKey("/acks/1"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	has, err = child.Has(ctx, ds.NewKey("/acks/0"))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// but read from the coalescing datastore
+	value, err := datastore.Get(ctx, ds.NewKey("/acks/1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack 1"), value)
+
+	size, err := datastore.GetSize(ctx, ds.NewKey("/acks/2"))
+	require.NoError(t, err)
+	require.Equal(t, len("ack 2"), size)
+
+	_, err = datastore.Get(ctx, ds.NewKey("/acks/0"))
+	require.Equal(t, ds.ErrNotFound, err)
+
+	has, err = datastore.Has(ctx, ds.NewKey("/acks/0"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// a query flushes the pending writes
+	results, err := datastore.Query(ctx, query.Query{Prefix: "/acks"})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	value, err = child.Get(ctx, ds.NewKey("/acks/2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack 2"), value)
+
+	has, err = child.Has(ctx, ds.NewKey("/acks/0"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the pending writes are flushed once the flush size is reached
+	for i := 0; i < 10; i++ {
+		require.NoError(t, datastore.Put(ctx, ds.NewKey(fmt.Sprintf("/reactions/%d", i)), []byte("reaction")))
+	}
+
+	has, err = child.Has(ctx, ds.NewKey("/reactions/9"))
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// and when the datastore is closed
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/3"), []byte("ack 3")))
+	require.NoError(t, datastore.Close())
+
+	value, err = child.Get(ctx, ds.NewKey("/acks/3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack 3"), value)
+}
+
+func TestCoalescingDatastoreFlushInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := dsync.MutexWrap(ds.NewMapDatastore())
+	datastore := NewCoalescing(child, &CoalescingOptions{FlushInterval: 10 * time.Millisecond, Durability: DurabilityRelaxed})
+	defer datastore.Close()
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/1"), []byte("ack 1")))
+
+	require.Eventually(t, func() bool {
+		has, err := child.Has(ctx, ds.NewKey("/acks/1"))
+		return err == nil && has
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCoalescingDatastoreSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := dsync.MutexWrap(ds.NewMapDatastore())
+	datastore := NewCoalescing(child, &CoalescingOptions{FlushInterval: time.Hour, Durability: DurabilitySync})
+	defer datastore.Close()
+
+	// each write is applied before returning
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/1"), []byte("ack 1")))
+
+	value, err := child.Get(ctx, ds.NewKey("/acks/1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack 1"), value)
+
+	require.NoError(t, datastore.Delete(ctx, ds.NewKey("/acks/1")))
+
+	has, err := child.Has(ctx, ds.NewKey("/acks/1"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+// failingDatastore fails the commits of its batches while fail is set
+type failingDatastore struct {
+	ds.Batching
+	fail atomic.Bool
+}
+
+func (d *failingDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	if d.fail.Load() {
+		return nil, fmt.Errorf("disk full")
+	}
+
+	return d.Batching.Batch(ctx)
+}
+
+func TestCoalescingDatastoreFlushError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := &failingDatastore{Batching: dsync.MutexWrap(ds.NewMapDatastore())}
+	child.fail.Store(true)
+
+	datastore := NewCoalescing(child, &CoalescingOptions{FlushInterval: 10 * time.Millisecond, Durability: DurabilityRelaxed})
+	defer datastore.Close()
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/1"), []byte("ack 1")))
+
+	require.Eventually(t, func() bool {
+		datastore.mu.RLock()
+		defer datastore.mu.RUnlock()
+
+		return datastore.flushErr != nil
+	}, time.Second, 5*time.Millisecond)
+
+	child.fail.Store(false)
+
+	// the error of the background flush is returned by the next write, which
+	// is queued anyway
+	require.Error(t, datastore.Put(ctx, ds.NewKey("/acks/2"), []byte("ack 2")))
+
+	value, err := datastore.Get(ctx, ds.NewKey("/acks/2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("ack 2"), value)
+
+	require.NoError(t, datastore.Flush(ctx))
+
+	for _, key := range []string{"/acks/1", "/acks/2"} {
+		has, err := child.Has(ctx, ds.NewKey(key))
+		require.NoError(t, err)
+		require.True(t, has, key)
+	}
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/acks/3"), []byte("ack 3")))
+}
+
+// BenchmarkCoalescingDatastore compares the appends of small entries synced
+// one by one, as without coalescing, with the batched ones
+func BenchmarkCoalescingDatastore(b *testing.B) {
+	for _, durability := range []struct {
+		name       string
+		durability Durability
+	}{
+		{"sync", DurabilitySync},
+		{"batched", DurabilityBatched},
+		{"relaxed", DurabilityRelaxed},
+	} {
+		b.Run(durability.name, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			dir, err := os.MkdirTemp("", "weshnet-bench-storage")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			child, err := Open(dir, Badger(nil))
+			require.NoError(b, err)
+
+			datastore := NewCoalescing(child, &CoalescingOptions{Durability: durability.durability})
+			defer datastore.Close()
+
+			value := make([]byte, 128)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := datastore.Put(ctx, ds.NewKey(fmt.Sprintf("/acks/%d", i)), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			if err := datastore.Flush(ctx); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
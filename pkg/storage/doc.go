@@ -0,0 +1,11 @@
+// Package storage contains the drivers of the persistent datastore backing a
+// node: the keystore, the OrbitDB stores and their caches, and the wrappers
+// encrypting its content or coalescing its writes.
+//
+// The Badger, LevelDB and SQLite drivers are available. The Pebble driver
+// isn't implemented: Pebble isn't a dependency of the module and its sources
+// aren't available to its build, LevelDB is shipped instead as the LSM tree
+// alternative to Badger. The datastore of a directory is moved to another
+// driver with MigrateDirectory, or with the tool/datastore-migrate command
+// while the node is stopped, the files of the previous driver are deleted.
+package storage
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v2/options"
+	ds "github.com/ipfs/go-datastore"
+	badger "github.com/ipfs/go-ds-badger2"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+const (
+	DriverBadger  = "badger"
+	DriverLevelDB = "leveldb"
+	DriverSQLite  = "sqlite"
+
+	// driverFileName is the file recording the driver of the datastore of a
+	// directory
+	driverFileName = "datastore_driver"
+
+	// badgerManifestFileName is used to recognize the directories created
+	// before the driver was recorded, they were all using badger
+	badgerManifestFileName = "MANIFEST"
+)
+
+// Driver opens the persistent datastore of a node in a directory
+type Driver interface {
+	// Name identifies the driver, it is recorded in the directory so the
+	// datastore can't be opened with another driver by mistake
+	Name() string
+
+	// Open opens the datastore stored in dir, creating it if needed
+	Open(dir string) (ds.Batching, error)
+
+	// Remove deletes the files of the datastore stored in dir, the other
+	// files of the directory are left untouched. The datastore must be
+	// closed.
+	Remove(dir string) error
+}
+
+type badgerDriver struct {
+	opts *badger.Options
+}
+
+// Badger returns the driver storing the datastore with badger, it is the
+// default one. If opts is nil, the value log is read with standard file I/O
+// to limit the memory usage on mobile devices.
+func Badger(opts *badger.Options) Driver {
+	if opts == nil {
+		bopts := badger.DefaultOptions
+		bopts.ValueLogLoadingMode = options.FileIO
+		opts = &bopts
+	}
+
+	return &badgerDriver{opts: opts}
+}
+
+func (d *badgerDriver) Name() string { return DriverBadger }
+
+func (d *badgerDriver) Open(dir string) (ds.Batching, error) {
+	// badger files are kept at the root of the directory for compatibility
+	// with the existing nodes
+	datastore, err := badger.NewDatastore(dir, d.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return datastore, nil
+}
+
+// badgerFilePatterns match the files written by badger at the root of the
+// directory
+var badgerFilePatterns = []string{badgerManifestFileName, "KEYREGISTRY", "LOCK", "*.sst", "*.vlog"}
+
+func (d *badgerDriver) Remove(dir string) error {
+	for _, pattern := range badgerFilePatterns {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+
+		for _, path := range paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type levelDBDriver struct {
+	opts *leveldb.Options
+}
+
+// LevelDB returns the driver storing the datastore with leveldb, opts can be
+// nil. It is shipped instead of the requested Pebble driver, whose sources
+// aren't available to the build of the module.
+func LevelDB(opts *leveldb.Options) Driver {
+	return &levelDBDriver{opts: opts}
+}
+
+func (d *levelDBDriver) Name() string { return DriverLevelDB }
+
+func (d *levelDBDriver) Open(dir string) (ds.Batching, error) {
+	datastore, err := leveldb.NewDatastore(filepath.Join(dir, DriverLevelDB), d.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelDBDatastore{Datastore: datastore}, nil
+}
+
+func (d *levelDBDriver) Remove(dir string) error {
+	return os.RemoveAll(filepath.Join(dir, DriverLevelDB))
+}
+
+// levelDBDatastore adds the compaction of the database to the leveldb
+// datastore
+type levelDBDatastore struct {
+	*leveldb.Datastore
+}
+
+var _ ds.GCDatastore = (*levelDBDatastore)(nil)
+
+// CollectGarbage compacts the whole database to release the space of the
+// deleted entries
+func (d *levelDBDatastore) CollectGarbage(context.Context) error {
+	return d.DB.CompactRange(util.Range{})
+}
+
+// RecordedDriver returns the name of the driver of the datastore stored in
+// dir, or an empty string if dir doesn't contain a datastore
+func RecordedDriver(dir string) (string, error) {
+	name, err := os.ReadFile(filepath.Join(dir, driverFileName))
+	switch {
+	case err == nil:
+		return string(bytes.TrimSpace(name)), nil
+	case !os.IsNotExist(err):
+		return "", errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, badgerManifestFileName)); err == nil {
+		return DriverBadger, nil
+	}
+
+	return "", nil
+}
+
+func recordDriver(dir string, name string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, driverFileName), []byte(name), 0o600); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// Open opens the datastore stored in dir with driver, it fails if the
+// datastore has been created with another driver, MigrateDirectory must be
+// used to switch to another driver
+func Open(dir string, driver Driver) (ds.Batching, error) {
+	recorded, err := RecordedDriver(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if recorded != "" && recorded != driver.Name() {
+		return nil, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("the datastore uses the %s driver, it must be migrated to be opened with the %s driver", recorded, driver.Name()))
+	}
+
+	if err := recordDriver(dir, driver.Name()); err != nil {
+		return nil, err
+	}
+
+	datastore, err := driver.Open(dir)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("unable to init %s datastore: %w", driver.Name(), err))
+	}
+
+	return datastore, nil
+}
@@ -0,0 +1,637 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+const (
+	encryptionHeaderVersion = 1
+
+	// encryptionKeysInfo is used to derive the keys of an encrypted
+	// datastore from its master key
+	encryptionKeysInfo = "weshnet/storage-encryption"
+
+	// encryptedKeySize is the size of the hashes replacing the namespaces of
+	// the keys
+	encryptedKeySize = 16
+)
+
+// encryptionHeaderKey stores the master key of an encrypted datastore, sealed
+// with a key derived from the passphrase. It can't collide with the
+// encrypted keys as their namespaces are longer.
+var encryptionHeaderKey = ds.NewKey("/storage_encryption")
+
+// encryptionPendingHeaderKey stores the master key of a datastore being
+// encrypted in place by EncryptInPlace, until all its entries are encrypted
+var encryptionPendingHeaderKey = ds.NewKey("/storage_encryption_pending")
+
+// EncryptedDatastore seals the entries of a datastore with a master key,
+// which is itself sealed with a key derived from a passphrase, so changing
+// the passphrase doesn't require to encrypt the entries again.
+//
+// The namespaces of the keys are replaced by chained HMACs, so the queries
+// by prefix are still served by the underlying datastore, while the other
+// query parameters are applied once the entries are opened.
+type EncryptedDatastore struct {
+	child   ds.Batching
+	sealKey *[cryptoutil.KeySize]byte
+	hashKey []byte
+
+	// muHeader serializes the passphrase changes
+	muHeader sync.Mutex
+}
+
+var (
+	_ ds.Batching            = (*EncryptedDatastore)(nil)
+	_ ds.GCDatastore         = (*EncryptedDatastore)(nil)
+	_ ds.PersistentDatastore = (*EncryptedDatastore)(nil)
+)
+
+// IsEncrypted returns true if the datastore has been encrypted with
+// OpenEncrypted
+func IsEncrypted(ctx context.Context, datastore ds.Read) (bool, error) {
+	has, err := datastore.Has(ctx, encryptionHeaderKey)
+	if err != nil {
+		return false, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return has, nil
+}
+
+func marshalEncryptionHeader(passphrase []byte, masterKey []byte) ([]byte, error) {
+	key, salt, err := cryptoutil.DeriveKey(passphrase, nil)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	sealKey, err := cryptoutil.KeySliceToArray(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{encryptionHeaderVersion}, salt...)
+	header = append(header, nonce[:]...)
+
+	return secretbox.Seal(header, masterKey, nonce, sealKey), nil
+}
+
+func unmarshalEncryptionHeader(header []byte, passphrase []byte) ([]byte, error) {
+	if len(header) < 1+cryptoutil.ScryptKeyLen+cryptoutil.NonceSize || header[0] != encryptionHeaderVersion {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid storage encryption header"))
+	}
+
+	salt := header[1 : 1+cryptoutil.ScryptKeyLen]
+	header = header[1+cryptoutil.ScryptKeyLen:]
+
+	key, _, err := cryptoutil.DeriveKey(passphrase, salt)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyDerivation.Wrap(err)
+	}
+
+	sealKey, err := cryptoutil.KeySliceToArray(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(header[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, ok := secretbox.Open(nil, header[cryptoutil.NonceSize:], nonce, sealKey)
+	if !ok {
+		return nil, errcode.ErrCode_ErrStorageInvalidPassphrase
+	}
+
+	return masterKey, nil
+}
+
+// OpenEncrypted unlocks the datastore encrypted with passphrase, an empty
+// datastore is encrypted with a new master key, a datastore with unencrypted
+// entries must first be encrypted with EncryptInPlace. The passphrase can also
+// be a key retrieved from the OS keychain.
+func OpenEncrypted(ctx context.Context, datastore ds.Batching, passphrase []byte) (*EncryptedDatastore, error) {
+	if len(passphrase) == 0 {
+		return nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	header, err := datastore.Get(ctx, encryptionHeaderKey)
+	switch err {
+	case nil:
+	case ds.ErrNotFound:
+		return initEncrypted(ctx, datastore, passphrase)
+	default:
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	masterKey, err := unmarshalEncryptionHeader(header, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEncryptedDatastore(datastore, masterKey)
+}
+
+func initEncrypted(ctx context.Context, datastore ds.Batching, passphrase []byte) (*EncryptedDatastore, error) {
+	// the existing entries would be left in clear
+	results, err := datastore.Query(ctx, query.Query{KeysOnly: true, Limit: 1})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if len(entries) > 0 {
+		return nil, errcode.ErrCode_ErrStorageNotEncrypted.Wrap(fmt.Errorf("the datastore already contains unencrypted entries"))
+	}
+
+	masterKey, err := cryptoutil.GenerateNonceSize(cryptoutil.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := marshalEncryptionHeader(passphrase, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := datastore.Put(ctx, encryptionHeaderKey, header); err != nil {
+		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := datastore.Sync(ctx, encryptionHeaderKey); err != nil {
+		return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return newEncryptedDatastore(datastore, masterKey)
+}
+
+// EncryptInPlace encrypts the entries of an unencrypted datastore with a new
+// master key sealed with passphrase, so it can then be opened by
+// OpenEncrypted. It returns the number of entries encrypted. The datastore
+// can only be opened once all its entries have been encrypted, an interrupted
+// encryption is resumed by calling EncryptInPlace again with the same
+// passphrase. The garbage of the datastore is then collected if it supports
+// it, to remove the unencrypted values from its files. Some may still remain
+// on disk until the engine compacts its files by itself, as badger only
+// rewrites the value log files holding enough garbage.
+func EncryptInPlace(ctx context.Context, datastore ds.Batching, passphrase []byte) (uint64, error) {
+	if len(passphrase) == 0 {
+		return 0, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	if encrypted, err := IsEncrypted(ctx, datastore); err != nil {
+		return 0, err
+	} else if encrypted {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the datastore is already encrypted"))
+	}
+
+	var masterKey []byte
+
+	header, err := datastore.Get(ctx, encryptionPendingHeaderKey)
+	switch err {
+	case nil:
+		if masterKey, err = unmarshalEncryptionHeader(header, passphrase); err != nil {
+			return 0, err
+		}
+
+	case ds.ErrNotFound:
+		if masterKey, err = cryptoutil.GenerateNonceSize(cryptoutil.KeySize); err != nil {
+			return 0, err
+		}
+
+		if header, err = marshalEncryptionHeader(passphrase, masterKey); err != nil {
+			return 0, err
+		}
+
+		if err := datastore.Put(ctx, encryptionPendingHeaderKey, header); err != nil {
+			return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if err := datastore.Sync(ctx, encryptionPendingHeaderKey); err != nil {
+			return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+	default:
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	encrypted, err := newEncryptedDatastore(datastore, masterKey)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := encrypted.encryptEntries(ctx)
+	if err != nil {
+		return count, err
+	}
+
+	// the header is written once all the entries are encrypted, the
+	// datastore can't be opened with unencrypted entries left
+	if err := datastore.Put(ctx, encryptionHeaderKey, header); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := datastore.Sync(ctx, encryptionHeaderKey); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := datastore.Delete(ctx, encryptionPendingHeaderKey); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if gc, ok := datastore.(ds.GCFeature); ok {
+		if err := gc.CollectGarbage(ctx); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return count, nil
+}
+
+// encryptEntries replaces the unencrypted entries of the underlying datastore
+// by their encrypted counterpart, the entries already encrypted by an
+// interrupted encryption are skipped
+func (d *EncryptedDatastore) encryptEntries(ctx context.Context) (uint64, error) {
+	results, err := d.child.Query(ctx, query.Query{})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	batch, err := d.child.Batch(ctx)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	var count, pending uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		result, ok := results.NextSync()
+		if !ok {
+			break
+		}
+
+		if result.Error != nil {
+			return count, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		key := ds.RawKey(result.Key)
+		if key.Equal(encryptionPendingHeaderKey) || d.isSealed(key, result.Value) {
+			continue
+		}
+
+		sealed, err := d.seal(key, result.Value)
+		if err != nil {
+			return count, err
+		}
+
+		if err := batch.Delete(ctx, key); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if err := batch.Put(ctx, d.childKey(key), sealed); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if pending++; pending < migrateBatchSize {
+			continue
+		}
+
+		if err := batch.Commit(ctx); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		count += pending
+		pending = 0
+
+		if batch, err = d.child.Batch(ctx); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	count += pending
+
+	if err := d.child.Sync(ctx, ds.NewKey("/")); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return count, nil
+}
+
+func newEncryptedDatastore(child ds.Batching, masterKey []byte) (*EncryptedDatastore, error) {
+	keys := make([]byte, cryptoutil.KeySize*2)
+	kdf := hkdf.New(sha3.New256, masterKey, nil, []byte(encryptionKeysInfo))
+	if _, err := io.ReadFull(kdf, keys); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	sealKey, err := cryptoutil.KeySliceToArray(keys[:cryptoutil.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedDatastore{
+		child:   child,
+		sealKey: sealKey,
+		hashKey: keys[cryptoutil.KeySize:],
+	}, nil
+}
+
+// CheckPassphrase returns ErrStorageInvalidPassphrase if passphrase doesn't
+// unseal the master key of the datastore
+func (d *EncryptedDatastore) CheckPassphrase(ctx context.Context, passphrase []byte) error {
+	d.muHeader.Lock()
+	defer d.muHeader.Unlock()
+
+	header, err := d.child.Get(ctx, encryptionHeaderKey)
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if _, err := unmarshalEncryptionHeader(header, passphrase); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ChangePassphrase seals the master key with a new passphrase
+func (d *EncryptedDatastore) ChangePassphrase(ctx context.Context, current []byte, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	d.muHeader.Lock()
+	defer d.muHeader.Unlock()
+
+	header, err := d.child.Get(ctx, encryptionHeaderKey)
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	masterKey, err := unmarshalEncryptionHeader(header, current)
+	if err != nil {
+		return err
+	}
+
+	if header, err = marshalEncryptionHeader(passphrase, masterKey); err != nil {
+		return err
+	}
+
+	if err := d.child.Put(ctx, encryptionHeaderKey, header); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	if err := d.child.Sync(ctx, encryptionHeaderKey); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// childKey replaces each namespace of key by the HMAC of its path, so the
+// keys sharing a prefix share the same hashed prefix
+func (d *EncryptedDatastore) childKey(key ds.Key) ds.Key {
+	if key.String() == "/" {
+		return key
+	}
+
+	namespaces := key.Namespaces()
+	hashes := make([]string, len(namespaces))
+
+	var parent []byte
+	for i, namespace := range namespaces {
+		mac := hmac.New(sha256.New, d.hashKey)
+		mac.Write(parent)
+		mac.Write([]byte(namespace))
+		parent = mac.Sum(nil)[:encryptedKeySize]
+
+		hashes[i] = base64.RawURLEncoding.EncodeToString(parent)
+	}
+
+	return ds.KeyWithNamespaces(hashes)
+}
+
+// seal encrypts the entry, the key is kept with the value to be listed by
+// the queries
+func (d *EncryptedDatastore) seal(key ds.Key, value []byte) ([]byte, error) {
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	data := binary.AppendUvarint(nil, uint64(len(key.String())))
+	data = append(data, key.String()...)
+	data = append(data, value...)
+
+	return secretbox.Seal(nonce[:], data, nonce, d.sealKey), nil
+}
+
+func (d *EncryptedDatastore) open(sealed []byte) (string, []byte, error) {
+	if len(sealed) < cryptoutil.NonceSize {
+		return "", nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("sealed value too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return "", nil, err
+	}
+
+	data, ok := secretbox.Open(nil, sealed[cryptoutil.NonceSize:], nonce, d.sealKey)
+	if !ok {
+		return "", nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open datastore value"))
+	}
+
+	size, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < size {
+		return "", nil, errcode.ErrCode_ErrDeserialization.Wrap(fmt.Errorf("invalid datastore value"))
+	}
+
+	return string(data[n : n+int(size)]), data[n+int(size):], nil
+}
+
+// isSealed returns true if value is an entry sealed by the datastore and
+// stored under childKey
+func (d *EncryptedDatastore) isSealed(childKey ds.Key, value []byte) bool {
+	key, _, err := d.open(value)
+	return err == nil && d.childKey(ds.RawKey(key)).Equal(childKey)
+}
+
+func (d *EncryptedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := d.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	return d.child.Put(ctx, d.childKey(key), sealed)
+}
+
+func (d *EncryptedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.child.Delete(ctx, d.childKey(key))
+}
+
+func (d *EncryptedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	sealed, err := d.child.Get(ctx, d.childKey(key))
+	if err != nil {
+		return nil, err
+	}
+
+	opened, value, err := d.open(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	// the value of another entry could have been moved under this key
+	if opened != key.String() {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("datastore value doesn't match its key"))
+	}
+
+	return value, nil
+}
+
+func (d *EncryptedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return d.child.Has(ctx, d.childKey(key))
+}
+
+func (d *EncryptedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	value, err := d.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+
+	return len(value), nil
+}
+
+func (d *EncryptedDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	var childQuery query.Query
+	if prefix := path.Clean("/" + q.Prefix); prefix != "/" {
+		childQuery.Prefix = d.childKey(ds.NewKey(prefix)).String()
+	}
+
+	results, err := d.child.Query(ctx, childQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	opened := query.ResultsFromIterator(q, query.Iterator{
+		Next: func() (query.Result, bool) {
+			for {
+				result, ok := results.NextSync()
+				if !ok || result.Error != nil {
+					return result, ok
+				}
+
+				if result.Key == encryptionHeaderKey.String() {
+					continue
+				}
+
+				key, value, err := d.open(result.Value)
+				if err != nil {
+					return query.Result{Error: err}, true
+				}
+
+				if d.childKey(ds.RawKey(key)).String() != result.Key {
+					return query.Result{Error: errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("datastore value doesn't match its key"))}, true
+				}
+
+				entry := query.Entry{Key: key, Value: value, Size: len(value)}
+				if q.KeysOnly {
+					entry.Value = nil
+				}
+
+				return query.Result{Entry: entry}, true
+			}
+		},
+		Close: results.Close,
+	})
+
+	return query.NaiveQueryApply(q, opened), nil
+}
+
+func (d *EncryptedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.child.Sync(ctx, d.childKey(prefix))
+}
+
+// CollectGarbage collects the garbage of the underlying datastore if it
+// supports it
+func (d *EncryptedDatastore) CollectGarbage(ctx context.Context) error {
+	if gc, ok := d.child.(ds.GCFeature); ok {
+		return gc.CollectGarbage(ctx)
+	}
+
+	return nil
+}
+
+// DiskUsage returns the disk usage of the underlying datastore, 0 if it isn't
+// persistent
+func (d *EncryptedDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.child)
+}
+
+func (d *EncryptedDatastore) Close() error {
+	return d.child.Close()
+}
+
+func (d *EncryptedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	batch, err := d.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedBatch{datastore: d, child: batch}, nil
+}
+
+type encryptedBatch struct {
+	datastore *EncryptedDatastore
+	child     ds.Batch
+}
+
+func (b *encryptedBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := b.datastore.seal(key, value)
+	if err != nil {
+		return err
+	}
+
+	return b.child.Put(ctx, b.datastore.childKey(key), sealed)
+}
+
+func (b *encryptedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return b.child.Delete(ctx, b.datastore.childKey(key))
+}
+
+func (b *encryptedBatch) Commit(ctx context.Context) error {
+	return b.child.Commit(ctx)
+}
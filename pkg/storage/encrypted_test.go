@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+func TestEncryptedDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	child := dsync.MutexWrap(ds.NewMapDatastore())
+
+	encrypted, err := IsEncrypted(ctx, child)
+	require.NoError(t, err)
+	require.False(t, encrypted)
+
+	datastore, err := OpenEncrypted(ctx, child, []byte("passphrase"))
+	require.NoError(t, err)
+
+	encrypted, err = IsEncrypted(ctx, child)
+	require.NoError(t, err)
+	require.True(t, encrypted)
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/keys/account"), []byte("secret key")))
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/keys/device"), []byte("device key")))
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/keystore"), []byte("other")))
+
+	batch, err := datastore.Batch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/logs/1"), []byte("entry 1")))
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/logs/2"), []byte("entry 2")))
+	require.NoError(t, batch.Commit(ctx))
+
+	// nothing is stored in clear
+	results, err := child.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 6)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Key, "keys")
+		require.NotContains(t, entry.Key, "logs")
+		require.NotContains(t, string(entry.Value), "key")
+		require.NotContains(t, string(entry.Value), "entry")
+	}
+
+	value, err := datastore.Get(ctx, ds.NewKey("/keys/account"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret key"), value)
+
+	size, err := datastore.GetSize(ctx, ds.NewKey("/logs/2"))
+	require.NoError(t, err)
+	require.Equal(t, len("entry 2"), size)
+
+	_, err = datastore.Get(ctx, ds.NewKey("/keys/unknown"))
+	require.Equal(t, ds.ErrNotFound, err)
+
+	// a value moved under the key of another entry isn't returned
+	sealed, err := child.Get(ctx, datastore.childKey(ds.NewKey("/keys/account")))
+	require.NoError(t, err)
+	require.NoError(t, child.Put(ctx, datastore.childKey(ds.NewKey("/keystore")), sealed))
+
+	_, err = datastore.Get(ctx, ds.NewKey("/keystore"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrCryptoDecrypt))
+
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/keystore"), []byte("other")))
+
+	// the queries by prefix only list the entries under the namespace
+	results, err = datastore.Query(ctx, query.Query{Prefix: "/keys", Orders: []query.Order{query.OrderByKey{}}})
+	require.NoError(t, err)
+	entries, err = results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/keys/account", entries[0].Key)
+	require.Equal(t, []byte("secret key"), entries[0].Value)
+	require.Equal(t, "/keys/device", entries[1].Key)
+
+	results, err = datastore.Query(ctx, query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err = results.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+
+	require.NoError(t, datastore.Delete(ctx, ds.NewKey("/logs/1")))
+	has, err := datastore.Has(ctx, ds.NewKey("/logs/1"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the passphrase must match
+	_, err = OpenEncrypted(ctx, child, []byte("wrong passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	err = datastore.ChangePassphrase(ctx, []byte("wrong passphrase"), []byte("new passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	require.NoError(t, datastore.ChangePassphrase(ctx, []byte("passphrase"), []byte("new passphrase")))
+
+	_, err = OpenEncrypted(ctx, child, []byte("passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	reopened, err := OpenEncrypted(ctx, child, []byte("new passphrase"))
+	require.NoError(t, err)
+
+	value, err = reopened.Get(ctx, ds.NewKey("/keys/device"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("device key"), value)
+
+	// an unencrypted datastore must be encrypted in place first
+	plain := dsync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, plain.Put(ctx, ds.NewKey("/keys/account"), []byte("secret key")))
+
+	_, err = OpenEncrypted(ctx, plain, []byte("passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageNotEncrypted))
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	plain := dsync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, plain.Put(ctx, ds.NewKey("/keys/account"), []byte("secret key")))
+	require.NoError(t, plain.Put(ctx, ds.NewKey("/logs/1"), []byte("entry 1")))
+
+	// the encryption is interrupted once a single entry has been encrypted
+	interrupted, cancelEncryption := context.WithCancel(ctx)
+	cancelEncryption()
+
+	_, err := EncryptInPlace(interrupted, plain, []byte("passphrase"))
+	require.Error(t, err)
+
+	header, err := plain.Get(ctx, encryptionPendingHeaderKey)
+	require.NoError(t, err)
+	masterKey, err := unmarshalEncryptionHeader(header, []byte("passphrase"))
+	require.NoError(t, err)
+	partial, err := newEncryptedDatastore(plain, masterKey)
+	require.NoError(t, err)
+	require.NoError(t, partial.Put(ctx, ds.NewKey("/logs/1"), []byte("entry 1")))
+	require.NoError(t, plain.Delete(ctx, ds.NewKey("/logs/1")))
+
+	// the partially encrypted datastore can't be opened
+	_, err = OpenEncrypted(ctx, plain, []byte("passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageNotEncrypted))
+
+	_, err = EncryptInPlace(ctx, plain, []byte("wrong passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	// the encryption is resumed with the same master key
+	count, err := EncryptInPlace(ctx, plain, []byte("passphrase"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+
+	_, err = EncryptInPlace(ctx, plain, []byte("passphrase"))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	results, err := plain.Query(ctx, query.Query{})
+	require.NoError(t, err)
+	entries, err := results.Rest()
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Key, "keys")
+		require.NotContains(t, string(entry.Value), "secret")
+	}
+
+	datastore, err := OpenEncrypted(ctx, plain, []byte("passphrase"))
+	require.NoError(t, err)
+
+	require.NoError(t, datastore.CheckPassphrase(ctx, []byte("passphrase")))
+	require.True(t, errcode.Has(datastore.CheckPassphrase(ctx, []byte("wrong passphrase")), errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	value, err := datastore.Get(ctx, ds.NewKey("/keys/account"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret key"), value)
+
+	value, err = datastore.Get(ctx, ds.NewKey("/logs/1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("entry 1"), value)
+}
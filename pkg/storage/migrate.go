@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.uber.org/multierr"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// migrateBatchSize is the number of entries written at once by Migrate
+const migrateBatchSize = 1024
+
+// Migrate copies all the entries of src to dst and returns the number of
+// entries copied
+func Migrate(ctx context.Context, dst ds.Batching, src ds.Datastore) (uint64, error) {
+	results, err := src.Query(ctx, query.Query{})
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	batch, err := dst.Batch(ctx)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	var count, pending uint64
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+
+		result, ok := results.NextSync()
+		if !ok {
+			break
+		}
+
+		if result.Error != nil {
+			return count, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		if err := batch.Put(ctx, ds.RawKey(result.Key), result.Value); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		if pending++; pending < migrateBatchSize {
+			continue
+		}
+
+		if err := batch.Commit(ctx); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		count += pending
+		pending = 0
+
+		if batch, err = dst.Batch(ctx); err != nil {
+			return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	if err := batch.Commit(ctx); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	count += pending
+
+	if err := dst.Sync(ctx, ds.NewKey("/")); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return count, nil
+}
+
+// MigrateDirectory copies the datastore stored in dir with the from driver
+// to a datastore managed by the to driver in the same directory, which is
+// then used by Open. The files left by the to driver, by a previous
+// migration or an interrupted one, are deleted first so the deleted entries
+// can't come back, and the files of the from driver are deleted once the
+// driver is switched. An interrupted migration can be started again.
+func MigrateDirectory(ctx context.Context, dir string, from Driver, to Driver) (_ uint64, err error) {
+	if from.Name() == to.Name() {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the datastore already uses the %s driver", to.Name()))
+	}
+
+	recorded, err := RecordedDriver(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if recorded != from.Name() {
+		return 0, errcode.ErrCode_ErrDBMigrate.Wrap(fmt.Errorf("the datastore doesn't use the %s driver", from.Name()))
+	}
+
+	src, err := from.Open(dir)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("unable to init %s datastore: %w", from.Name(), err))
+	}
+	defer func() {
+		if src == nil {
+			return
+		}
+
+		if closeErr := src.Close(); closeErr != nil {
+			err = multierr.Append(err, errcode.ErrCode_ErrDBClose.Wrap(closeErr))
+		}
+	}()
+
+	// the destination must start empty, a datastore left by a previous
+	// migration holds entries deleted since then
+	if err := to.Remove(dir); err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(fmt.Errorf("unable to clear %s datastore: %w", to.Name(), err))
+	}
+
+	dst, err := to.Open(dir)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBOpen.Wrap(fmt.Errorf("unable to init %s datastore: %w", to.Name(), err))
+	}
+
+	count, err := Migrate(ctx, dst, src)
+	if closeErr := dst.Close(); err == nil && closeErr != nil {
+		err = errcode.ErrCode_ErrDBClose.Wrap(closeErr)
+	}
+
+	if err != nil {
+		return count, errcode.ErrCode_ErrDBMigrate.Wrap(err)
+	}
+
+	// the driver is only switched once all the entries have been copied
+	if err := recordDriver(dir, to.Name()); err != nil {
+		return count, err
+	}
+
+	closeErr := src.Close()
+	src = nil
+	if closeErr != nil {
+		return count, errcode.ErrCode_ErrDBClose.Wrap(closeErr)
+	}
+
+	if err := from.Remove(dir); err != nil {
+		return count, errcode.ErrCode_ErrDBWrite.Wrap(fmt.Errorf("unable to remove %s datastore: %w", from.Name(), err))
+	}
+
+	return count, nil
+}
+
+// Compact reclaims the space of the deleted entries of the datastore if it
+// supports it, it returns the number of bytes reclaimed
+func Compact(ctx context.Context, datastore ds.Datastore) (uint64, error) {
+	gc, ok := datastore.(ds.GCFeature)
+	if !ok {
+		return 0, nil
+	}
+
+	before, err := ds.DiskUsage(ctx, datastore)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if err := gc.CollectGarbage(ctx); err != nil {
+		return 0, errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	after, err := ds.DiskUsage(ctx, datastore)
+	if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	if after >= before {
+		return 0, nil
+	}
+
+	return before - after, nil
+}
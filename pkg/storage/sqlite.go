@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path"
+	"path/filepath"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+const (
+	// sqliteFileName is the database file of the sqlite driver
+	sqliteFileName = "datastore.sqlite"
+
+	// sqliteDefaultSQLDriverName is the name under which
+	// github.com/mattn/go-sqlite3 registers itself
+	sqliteDefaultSQLDriverName = "sqlite3"
+)
+
+type sqliteDriver struct {
+	sqlDriverName string
+}
+
+// SQLite returns the driver storing the datastore in a SQLite database. The
+// application must register a database/sql driver for SQLite, such as
+// github.com/mattn/go-sqlite3, sqlDriverName is the name of this driver and
+// defaults to "sqlite3".
+func SQLite(sqlDriverName string) Driver {
+	if sqlDriverName == "" {
+		sqlDriverName = sqliteDefaultSQLDriverName
+	}
+
+	return &sqliteDriver{sqlDriverName: sqlDriverName}
+}
+
+func (d *sqliteDriver) Name() string { return DriverSQLite }
+
+func (d *sqliteDriver) Open(dir string) (ds.Batching, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, sqliteFileName)
+
+	db, err := sql.Open(d.sqlDriverName, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only supports a single writer, sharing a single connection
+	// avoids the "database is locked" errors
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS datastore (key TEXT PRIMARY KEY NOT NULL, value BLOB NOT NULL)`); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &sqliteDatastore{db: db, path: path}, nil
+}
+
+func (d *sqliteDriver) Remove(dir string) error {
+	// the journal files are left by an interrupted transaction
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(filepath.Join(dir, sqliteFileName+suffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type sqliteDatastore struct {
+	db   *sql.DB
+	path string
+}
+
+var (
+	_ ds.Batching            = (*sqliteDatastore)(nil)
+	_ ds.GCDatastore         = (*sqliteDatastore)(nil)
+	_ ds.PersistentDatastore = (*sqliteDatastore)(nil)
+)
+
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func sqlitePut(ctx context.Context, db sqlExecer, key ds.Key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+
+	_, err := db.ExecContext(ctx, `INSERT OR REPLACE INTO datastore (key, value) VALUES (?, ?)`, key.String(), value)
+	return err
+}
+
+func sqliteDelete(ctx context.Context, db sqlExecer, key ds.Key) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM datastore WHERE key = ?`, key.String())
+	return err
+}
+
+func (d *sqliteDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	return sqlitePut(ctx, d.db, key, value)
+}
+
+func (d *sqliteDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return sqliteDelete(ctx, d.db, key)
+}
+
+func (d *sqliteDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	var value []byte
+	switch err := d.db.QueryRowContext(ctx, `SELECT value FROM datastore WHERE key = ?`, key.String()).Scan(&value); err {
+	case nil:
+		return value, nil
+	case sql.ErrNoRows:
+		return nil, ds.ErrNotFound
+	default:
+		return nil, err
+	}
+}
+
+func (d *sqliteDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, err := d.GetSize(ctx, key)
+	switch err {
+	case nil:
+		return true, nil
+	case ds.ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (d *sqliteDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	var size int
+	switch err := d.db.QueryRowContext(ctx, `SELECT length(value) FROM datastore WHERE key = ?`, key.String()).Scan(&size); err {
+	case nil:
+		return size, nil
+	case sql.ErrNoRows:
+		return -1, ds.ErrNotFound
+	default:
+		return -1, err
+	}
+}
+
+// sqliteQueryPageSize is the number of entries read at once by Query
+const sqliteQueryPageSize = 256
+
+// Query streams the entries under the prefix of q in key order, the other
+// parameters of q are applied as the entries are read. The entries are read
+// by pages, each page releases the connection before the results are
+// consumed so the datastore can be written meanwhile with a single
+// connection.
+func (d *sqliteDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	it := &sqliteIterator{
+		ctx:      ctx,
+		db:       d.db,
+		keysOnly: q.KeysOnly,
+	}
+
+	if prefix := path.Clean("/" + q.Prefix); prefix != "/" {
+		// '0' follows '/' in the ASCII table, so the range contains all the
+		// keys under the prefix
+		it.after, it.before = prefix+"/", prefix+"0"
+	}
+
+	// the entries are already in key order, sorting them again would read
+	// all of them before returning the first one
+	naive := q
+	if len(q.Orders) == 1 {
+		if _, ok := q.Orders[0].(query.OrderByKey); ok {
+			naive.Orders = nil
+		}
+	}
+
+	return query.NaiveQueryApply(naive, query.ResultsFromIterator(q, query.Iterator{
+		Next: it.next,
+	})), nil
+}
+
+// sqliteIterator reads the entries of a range by pages, the next page starts
+// after the last key read
+type sqliteIterator struct {
+	ctx      context.Context
+	db       *sql.DB
+	keysOnly bool
+
+	// after is the last key read, or the inclusive start of the range before
+	// the first page, before is the exclusive end of the range if not empty
+	after, before string
+	started       bool
+
+	page []query.Entry
+	done bool
+}
+
+func (it *sqliteIterator) next() (query.Result, bool) {
+	if len(it.page) == 0 {
+		if it.done {
+			return query.Result{}, false
+		}
+
+		if err := it.readPage(); err != nil {
+			it.done = true
+			return query.Result{Error: err}, true
+		}
+
+		if len(it.page) == 0 {
+			return query.Result{}, false
+		}
+	}
+
+	entry := it.page[0]
+	it.page = it.page[1:]
+
+	return query.Result{Entry: entry}, true
+}
+
+func (it *sqliteIterator) readPage() error {
+	value := "value"
+	if it.keysOnly {
+		value = "NULL"
+	}
+
+	lower := ">"
+	if !it.started {
+		lower = ">="
+	}
+
+	stmt := `SELECT key, ` + value + `, length(value) FROM datastore WHERE key ` + lower + ` ?`
+	args := []interface{}{it.after}
+	if it.before != "" {
+		stmt += ` AND key < ?`
+		args = append(args, it.before)
+	}
+	stmt += ` ORDER BY key LIMIT ?`
+	args = append(args, sqliteQueryPageSize)
+
+	rows, err := it.db.QueryContext(it.ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry query.Entry
+		if err := rows.Scan(&entry.Key, &entry.Value, &entry.Size); err != nil {
+			return err
+		}
+
+		it.page = append(it.page, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	it.started = true
+	if n := len(it.page); n > 0 {
+		it.after = it.page[n-1].Key
+	}
+
+	it.done = len(it.page) < sqliteQueryPageSize
+
+	return nil
+}
+
+// Sync is a no-op, the writes are durable once they return
+func (d *sqliteDatastore) Sync(context.Context, ds.Key) error {
+	return nil
+}
+
+// CollectGarbage rebuilds the database file to release the pages of the
+// deleted entries
+func (d *sqliteDatastore) CollectGarbage(ctx context.Context) error {
+	_, err := d.db.ExecContext(ctx, `VACUUM`)
+	return err
+}
+
+// DiskUsage returns the size of the database file
+func (d *sqliteDatastore) DiskUsage(context.Context) (uint64, error) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.Size()), nil
+}
+
+func (d *sqliteDatastore) Close() error {
+	return d.db.Close()
+}
+
+func (d *sqliteDatastore) Batch(context.Context) (ds.Batch, error) {
+	return &sqliteBatch{datastore: d}, nil
+}
+
+type sqliteBatchOp struct {
+	key    ds.Key
+	value  []byte
+	delete bool
+}
+
+// sqliteBatch applies its operations in a single transaction
+type sqliteBatch struct {
+	datastore *sqliteDatastore
+	ops       []sqliteBatchOp
+}
+
+func (b *sqliteBatch) Put(_ context.Context, key ds.Key, value []byte) error {
+	b.ops = append(b.ops, sqliteBatchOp{key: key, value: value})
+	return nil
+}
+
+func (b *sqliteBatch) Delete(_ context.Context, key ds.Key) error {
+	b.ops = append(b.ops, sqliteBatchOp{key: key, delete: true})
+	return nil
+}
+
+func (b *sqliteBatch) Commit(ctx context.Context) error {
+	tx, err := b.datastore.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range b.ops {
+		if op.delete {
+			err = sqliteDelete(ctx, tx, op.key)
+		} else {
+			err = sqlitePut(ctx, tx, op.key, op.value)
+		}
+
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	b.ops = nil
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteDatastore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "weshnet-test-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	datastore, err := Open(dir, SQLite(""))
+	require.NoError(t, err)
+	defer datastore.Close()
+
+	key := ds.NewKey("/account/key")
+
+	_, err = datastore.Get(ctx, key)
+	require.Equal(t, ds.ErrNotFound, err)
+
+	has, err := datastore.Has(ctx, key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, datastore.Put(ctx, key, []byte("value")))
+
+	value, err := datastore.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	size, err := datastore.GetSize(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 5, size)
+
+	require.NoError(t, datastore.Delete(ctx, key))
+
+	has, err = datastore.Has(ctx, key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// the batch is only visible once committed
+	batch, err := datastore.Batch(ctx)
+	require.NoError(t, err)
+
+	const entries = sqliteQueryPageSize*2 + 10
+	for i := 0; i < entries; i++ {
+		require.NoError(t, batch.Put(ctx, ds.NewKey(fmt.Sprintf("/ns/%04d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+	require.NoError(t, batch.Put(ctx, ds.NewKey("/nsx/0"), []byte("other")))
+	require.NoError(t, batch.Delete(ctx, ds.NewKey("/ns/0000")))
+
+	has, err = datastore.Has(ctx, ds.NewKey("/ns/0001"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, batch.Commit(ctx))
+
+	// the results are read by pages, the datastore can be written while they
+	// are consumed
+	results, err := datastore.Query(ctx, query.Query{Prefix: "/ns"})
+	require.NoError(t, err)
+
+	i := 1
+	for result := range results.Next() {
+		require.NoError(t, result.Error)
+		require.Equal(t, fmt.Sprintf("/ns/%04d", i), result.Key)
+		require.Equal(t, fmt.Sprintf("value %d", i), string(result.Value))
+
+		require.NoError(t, datastore.Put(ctx, ds.NewKey(fmt.Sprintf("/written/%d", i)), []byte("value")))
+		i++
+	}
+	require.NoError(t, results.Close())
+	require.Equal(t, entries, i)
+
+	// the parameters of the query are applied to the streamed entries
+	results, err = datastore.Query(ctx, query.Query{
+		Prefix:   "/ns",
+		KeysOnly: true,
+		Orders:   []query.Order{query.OrderByKeyDescending{}},
+		Offset:   1,
+		Limit:    2,
+	})
+	require.NoError(t, err)
+
+	rest, err := results.Rest()
+	require.NoError(t, err)
+	require.Len(t, rest, 2)
+	require.Equal(t, fmt.Sprintf("/ns/%04d", entries-2), rest[0].Key)
+	require.Nil(t, rest[0].Value)
+	require.Equal(t, len(fmt.Sprintf("value %d", entries-2)), rest[0].Size)
+	require.Equal(t, fmt.Sprintf("/ns/%04d", entries-3), rest[1].Key)
+
+	results, err = datastore.Query(ctx, query.Query{})
+	require.NoError(t, err)
+
+	rest, err = results.Rest()
+	require.NoError(t, err)
+	require.Len(t, rest, 2*(entries-1)+1)
+}
+
+func TestSQLiteMigrateDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "weshnet-test-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key := ds.NewKey("/account/key")
+	deleted := ds.NewKey("/messages/pruned")
+
+	datastore, err := Open(dir, Badger(nil))
+	require.NoError(t, err)
+	require.NoError(t, datastore.Put(ctx, key, []byte("value")))
+	require.NoError(t, datastore.Put(ctx, deleted, []byte("secret")))
+	require.NoError(t, datastore.Close())
+
+	count, err := MigrateDirectory(ctx, dir, Badger(nil), SQLite(""))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), count)
+
+	datastore, err = Open(dir, SQLite(""))
+	require.NoError(t, err)
+	require.NoError(t, datastore.Delete(ctx, deleted))
+
+	value, err := datastore.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+
+	require.NoError(t, datastore.Put(ctx, key, []byte("updated")))
+	require.NoError(t, datastore.Close())
+
+	// the datastore can be migrated back
+	count, err = MigrateDirectory(ctx, dir, SQLite(""), Badger(nil))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+
+	datastore, err = Open(dir, Badger(nil))
+	require.NoError(t, err)
+	defer datastore.Close()
+
+	value, err = datastore.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+
+	// the entries deleted since the first migration don't come back
+	_, err = datastore.Get(ctx, deleted)
+	require.ErrorIs(t, err, ds.ErrNotFound)
+
+	_, err = os.Stat(filepath.Join(dir, sqliteFileName))
+	require.True(t, os.IsNotExist(err))
+}
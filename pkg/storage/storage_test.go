@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := dsync.MutexWrap(ds.NewMapDatastore())
+	dst := dsync.MutexWrap(ds.NewMapDatastore())
+
+	const entries = migrateBatchSize*2 + 10
+	for i := 0; i < entries; i++ {
+		require.NoError(t, src.Put(ctx, ds.NewKey(fmt.Sprintf("/ns/%d", i)), []byte(fmt.Sprintf("value %d", i))))
+	}
+
+	count, err := Migrate(ctx, dst, src)
+	require.NoError(t, err)
+	require.Equal(t, uint64(entries), count)
+
+	for i := 0; i < entries; i++ {
+		value, err := dst.Get(ctx, ds.NewKey(fmt.Sprintf("/ns/%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value %d", i), string(value))
+	}
+}
+
+func TestMigrateDirectory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "weshnet-test-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorded, err := RecordedDriver(dir)
+	require.NoError(t, err)
+	require.Empty(t, recorded)
+
+	key := ds.NewKey("/account/key")
+
+	datastore, err := Open(dir, Badger(nil))
+	require.NoError(t, err)
+	require.NoError(t, datastore.Put(ctx, key, []byte("value")))
+	require.NoError(t, datastore.Close())
+
+	// the directories created before the driver was recorded use badger
+	require.NoError(t, os.Remove(filepath.Join(dir, driverFileName)))
+	recorded, err = RecordedDriver(dir)
+	require.NoError(t, err)
+	require.Equal(t, DriverBadger, recorded)
+
+	// the datastore can't be opened with another driver
+	_, err = Open(dir, LevelDB(nil))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrDBOpen))
+
+	_, err = MigrateDirectory(ctx, dir, LevelDB(nil), Badger(nil))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrDBMigrate))
+
+	count, err := MigrateDirectory(ctx, dir, Badger(nil), LevelDB(nil))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+
+	recorded, err = RecordedDriver(dir)
+	require.NoError(t, err)
+	require.Equal(t, DriverLevelDB, recorded)
+
+	// the files of badger are deleted
+	_, err = os.Stat(filepath.Join(dir, badgerManifestFileName))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = Open(dir, Badger(nil))
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrDBOpen))
+
+	datastore, err = Open(dir, LevelDB(nil))
+	require.NoError(t, err)
+	defer datastore.Close()
+
+	value, err := datastore.Get(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
+
+func TestCompact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "weshnet-test-storage")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	datastore, err := Open(dir, LevelDB(nil))
+	require.NoError(t, err)
+	defer datastore.Close()
+
+	value := make([]byte, 1024)
+	for i := 0; i < 4096; i++ {
+		require.NoError(t, datastore.Put(ctx, ds.NewKey(fmt.Sprintf("/ns/%d", i)), value))
+	}
+
+	for i := 0; i < 4096; i++ {
+		require.NoError(t, datastore.Delete(ctx, ds.NewKey(fmt.Sprintf("/ns/%d", i))))
+	}
+
+	reclaimed, err := Compact(ctx, datastore)
+	require.NoError(t, err)
+	require.NotZero(t, reclaimed)
+
+	// the datastores without garbage collection are left untouched
+	reclaimed, err = Compact(ctx, dsync.MutexWrap(ds.NewMapDatastore()))
+	require.NoError(t, err)
+	require.Zero(t, reclaimed)
+}
@@ -0,0 +1,141 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/rendezvous"
+)
+
+const (
+	// relayMailboxLookback is the duration the mailboxes of a group are
+	// fetched for, it matches the maximum ttl of the relays
+	relayMailboxLookback = 7 * 24 * time.Hour
+
+	// relayMailboxTopic separates the mailboxes from the rendezvous points of
+	// the group logs, the relays can't link them to the pubsub topics
+	relayMailboxTopic = "relay_mailbox/"
+)
+
+// relayMailbox returns the mailbox of the group on the relays for the period
+// of at, it is derived like the rendezvous points so only the members of the
+// group know it and it changes with each period
+func relayMailbox(g *protocoltypes.Group, rp *rendezvous.RotationInterval, at time.Time) ([]byte, error) {
+	linkKey, err := g.GetLinkKeyArray()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	topic := append([]byte(relayMailboxTopic), g.PublicKey...)
+
+	return rendezvous.GenerateRendezvousPointForPeriod(topic, linkKey[:], rp.RoundTimePeriod(at)), nil
+}
+
+// relayMailboxes returns the mailboxes of the group for the periods of the
+// lookback, an envelope is deposited in the mailbox of the period it is sent
+func relayMailboxes(g *protocoltypes.Group, rp *rendezvous.RotationInterval, now time.Time) ([][]byte, error) {
+	mailboxes := [][]byte{}
+	seen := map[string]struct{}{}
+
+	for at := now; !at.Before(now.Add(-relayMailboxLookback)); at = rp.RoundTimePeriod(at).Add(-time.Second) {
+		mailbox, err := relayMailbox(g, rp, at)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[string(mailbox)]; ok {
+			break
+		}
+
+		seen[string(mailbox)] = struct{}{}
+		mailboxes = append(mailboxes, mailbox)
+	}
+
+	return mailboxes, nil
+}
+
+// relayCursors records, for each relay, each group and each mailbox, the
+// cursor of the last envelope received so the next fetch only returns the
+// new ones
+type relayCursors struct {
+	datastore datastore.Datastore
+}
+
+func newRelayCursors(ds datastore.Datastore) *relayCursors {
+	return &relayCursors{datastore: ds}
+}
+
+func dsKeyForRelayCursors(server string, groupPK []byte) datastore.Key {
+	return datastore.KeyWithNamespaces([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(server)),
+		base64.RawURLEncoding.EncodeToString(groupPK),
+	})
+}
+
+func dsKeyForRelayCursor(server string, groupPK []byte, mailbox []byte) datastore.Key {
+	return dsKeyForRelayCursors(server, groupPK).ChildString(base64.RawURLEncoding.EncodeToString(mailbox))
+}
+
+func (c *relayCursors) get(ctx context.Context, server string, groupPK []byte, mailbox []byte) (uint64, error) {
+	data, err := c.datastore.Get(ctx, dsKeyForRelayCursor(server, groupPK, mailbox))
+	if err == datastore.ErrNotFound || (err == nil && len(data) != 8) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (c *relayCursors) put(ctx context.Context, server string, groupPK []byte, mailbox []byte, cursor uint64) error {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, cursor)
+
+	if err := c.datastore.Put(ctx, dsKeyForRelayCursor(server, groupPK, mailbox), data); err != nil {
+		return errcode.ErrCode_ErrDBWrite.Wrap(err)
+	}
+
+	return nil
+}
+
+// prune deletes the cursors of the mailboxes of the group which aren't in
+// the lookback anymore
+func (c *relayCursors) prune(ctx context.Context, server string, groupPK []byte, mailboxes [][]byte) error {
+	keep := map[datastore.Key]struct{}{}
+	for _, mailbox := range mailboxes {
+		keep[dsKeyForRelayCursor(server, groupPK, mailbox)] = struct{}{}
+	}
+
+	results, err := c.datastore.Query(ctx, query.Query{
+		Prefix:   dsKeyForRelayCursors(server, groupPK).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	entries, err := results.Rest()
+	if err != nil {
+		return errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	for _, entry := range entries {
+		key := datastore.NewKey(entry.Key)
+		if _, ok := keep[key]; ok {
+			continue
+		}
+
+		if err := c.datastore.Delete(ctx, key); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
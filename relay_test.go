@@ -0,0 +1,165 @@
+package weshnet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/relay"
+	"berty.tech/weshnet/v2/pkg/relaytypes"
+	"berty.tech/weshnet/v2/pkg/rendezvous"
+)
+
+func TestRelayMailboxes(t *testing.T) {
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	now := time.Now()
+	rp := rendezvous.NewRotationInterval(rendezvous.DefaultRotationInterval)
+
+	mailbox, err := relayMailbox(g, rp, now)
+	require.NoError(t, err)
+
+	// the mailbox is the same during a period and differs between groups
+	again, err := relayMailbox(g, rp, rp.RoundTimePeriod(now))
+	require.NoError(t, err)
+	require.Equal(t, mailbox, again)
+
+	otherMailbox, err := relayMailbox(other, rp, now)
+	require.NoError(t, err)
+	require.NotEqual(t, mailbox, otherMailbox)
+
+	next, err := relayMailbox(g, rp, rp.NextTimePeriod(now))
+	require.NoError(t, err)
+	require.NotEqual(t, mailbox, next)
+
+	// the mailboxes of the lookback are fetched, the current one first
+	mailboxes, err := relayMailboxes(g, rp, now)
+	require.NoError(t, err)
+	require.Len(t, mailboxes, int(relayMailboxLookback/rendezvous.DefaultRotationInterval)+1)
+	require.Equal(t, mailbox, mailboxes[0])
+
+	mailboxes, err = relayMailboxes(g, rendezvous.NewStaticRotationInterval(), now)
+	require.NoError(t, err)
+	require.Len(t, mailboxes, 1)
+}
+
+func TestRelayServiceDepositFetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	relayServer, err := relay.NewServer(ctx, ds_sync.MutexWrap(ds.NewMapDatastore()), nil)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	defer server.Stop()
+
+	relaytypes.RegisterRelayServiceServer(server, relayServer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() { _ = server.Serve(l) }()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+	s.grpcInsecure = true
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	sendReply, err := s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{
+		GroupPk: g.PublicKey,
+		Payload: []byte("relayed"),
+	})
+	require.NoError(t, err)
+
+	_, err = s.RelayServiceDeposit(ctx, &protocoltypes.RelayServiceDeposit_Request{
+		GroupPk: g.PublicKey,
+		Cid:     sendReply.Cid,
+	})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	depositReply, err := s.RelayServiceDeposit(ctx, &protocoltypes.RelayServiceDeposit_Request{
+		GroupPk:     g.PublicKey,
+		Cid:         sendReply.Cid,
+		RelayServer: l.Addr().String(),
+		Ttl:         60,
+	})
+	require.NoError(t, err)
+	require.NotZero(t, depositReply.ExpiresAt)
+
+	fetchReply, err := s.RelayServiceFetch(ctx, &protocoltypes.RelayServiceFetch_Request{
+		GroupPk:     g.PublicKey,
+		RelayServer: l.Addr().String(),
+	})
+	require.NoError(t, err)
+	require.Len(t, fetchReply.Results, 1)
+	require.Empty(t, fetchReply.Results[0].Error)
+	require.Equal(t, g.PublicKey, fetchReply.Results[0].Reply.GroupPublicKey)
+
+	encryptedMessage := &protocoltypes.EncryptedMessage{}
+	require.NoError(t, proto.Unmarshal(fetchReply.Results[0].Reply.Cleartext, encryptedMessage))
+	require.Equal(t, []byte("relayed"), encryptedMessage.Plaintext)
+
+	// the cursor is kept, the envelope isn't fetched twice
+	fetchReply, err = s.RelayServiceFetch(ctx, &protocoltypes.RelayServiceFetch_Request{
+		GroupPk:     g.PublicKey,
+		RelayServer: l.Addr().String(),
+	})
+	require.NoError(t, err)
+	require.Empty(t, fetchReply.Results)
+}
+
+func TestRelayCursorsPrune(t *testing.T) {
+	ctx := context.Background()
+	cursors := newRelayCursors(ds_sync.MutexWrap(ds.NewMapDatastore()))
+
+	groupPK := []byte("group")
+	current, past := []byte("current"), []byte("past")
+
+	require.NoError(t, cursors.put(ctx, "relay", groupPK, current, 2))
+	require.NoError(t, cursors.put(ctx, "relay", groupPK, past, 1))
+	require.NoError(t, cursors.put(ctx, "other", groupPK, past, 3))
+
+	// each mailbox has its own cursor
+	cursor, err := cursors.get(ctx, "relay", groupPK, past)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), cursor)
+
+	// the cursors of the mailboxes out of the lookback are dropped, the
+	// ones of the other relays are kept
+	require.NoError(t, cursors.prune(ctx, "relay", groupPK, [][]byte{current}))
+
+	cursor, err = cursors.get(ctx, "relay", groupPK, past)
+	require.NoError(t, err)
+	require.Zero(t, cursor)
+
+	cursor, err = cursors.get(ctx, "relay", groupPK, current)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), cursor)
+
+	cursor, err = cursors.get(ctx, "other", groupPK, past)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), cursor)
+}
@@ -0,0 +1,169 @@
+package weshnet
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/replicationtypes"
+)
+
+const (
+	// replicationProbeTimeout is the maximum duration of a probe if the
+	// request doesn't set one
+	replicationProbeTimeout = 30 * time.Second
+
+	// replicationProbeTTL is the duration the probe group is registered for,
+	// each probe extends it so the services drop it once they aren't probed
+	// anymore
+	replicationProbeTTL = 24 * time.Hour
+
+	// replicationProbePayload is the payload of the canary entries
+	replicationProbePayload = "replication probe"
+)
+
+var dsKeyReplicationProbeGroups = datastore.NewKey("groups")
+
+// replicationProbe keeps the groups used to probe the replication services.
+// The groups aren't part of the account and each one is only registered with
+// a single service using a single token, so the heads announced for it come
+// from that service and the group has been accepted with that token.
+type replicationProbe struct {
+	datastore datastore.Datastore
+
+	// mu serializes the probes, they write to the same group
+	mu sync.Mutex
+}
+
+func newReplicationProbe(ds datastore.Datastore) *replicationProbe {
+	return &replicationProbe{datastore: ds}
+}
+
+// dsKeyForReplicationProbeGroup returns the key of the probe group of a
+// server and a token, the token is hashed as it isn't kept by the probe
+func dsKeyForReplicationProbeGroup(server string, token string) datastore.Key {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	return dsKeyReplicationProbeGroups.
+		ChildString(base64.RawURLEncoding.EncodeToString([]byte(server))).
+		ChildString(base64.RawURLEncoding.EncodeToString(tokenHash[:]))
+}
+
+// group returns the probe group of the server and the token, it is created
+// on first use
+func (p *replicationProbe) group(ctx context.Context, server string, token string) (*protocoltypes.Group, error) {
+	key := dsKeyForReplicationProbeGroup(server, token)
+
+	data, err := p.datastore.Get(ctx, key)
+	switch err {
+	case nil:
+		g := &protocoltypes.Group{}
+		if err := proto.Unmarshal(data, g); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		return g, nil
+
+	case datastore.ErrNotFound:
+		g, _, err := NewGroupMultiMember()
+		if err != nil {
+			return nil, err
+		}
+
+		if data, err = proto.Marshal(g); err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if err := p.datastore.Put(ctx, key, data); err != nil {
+			return nil, errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+
+		return g, nil
+
+	default:
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+}
+
+// probeReplication registers the probe group with the replication server,
+// writes a canary entry to its message store and waits until the server
+// announces it as a head, the probe isn't replicated if ctx is done first
+func (s *service) probeReplication(ctx context.Context, server string, token string) (*protocoltypes.ReplicationServiceProbe_Reply, error) {
+	s.replicationProbe.mu.Lock()
+	defer s.replicationProbe.mu.Unlock()
+
+	g, err := s.replicationProbe.group(ctx, server, token)
+	if err != nil {
+		return nil, err
+	}
+
+	gc, err := s.odb.OpenGroup(ctx, g, nil)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrGroupOpen.Wrap(err)
+	}
+	defer gc.Close()
+
+	replGroup, err := FilterGroupForReplication(g)
+	if err != nil {
+		return nil, errcode.ErrCode_TODO.Wrap(err)
+	}
+
+	client, closeClient, err := s.replicationServiceClient(server, token)
+	if err != nil {
+		return nil, err
+	}
+	defer closeClient()
+
+	if _, err := client.ReplicateGroup(ctx, &replicationtypes.ReplicationServiceReplicateGroup_Request{
+		Group: replGroup,
+		Ttl:   int64(replicationProbeTTL.Seconds()),
+	}); err != nil {
+		return nil, errcode.ErrCode_ErrServiceReplicationServer.Wrap(err)
+	}
+
+	op, err := gc.MessageStore().AddMessage(ctx, []byte(replicationProbePayload))
+	if err != nil {
+		return nil, err
+	}
+
+	written := time.Now()
+	canary := op.GetEntry().GetHash()
+	address := gc.MessageStore().Address().String()
+
+	reply := &protocoltypes.ReplicationServiceProbe_Reply{
+		CanaryCid:    canary.Bytes(),
+		ProbeGroupPk: g.PublicKey,
+	}
+
+	for {
+		version := s.odb.syncState.getVersion()
+
+		if s.odb.syncState.hasRemoteHead(address, canary) {
+			reply.Replicated = true
+			reply.Latency = int64(time.Since(written))
+			break
+		}
+
+		s.odb.syncState.waitForChange(ctx, version)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	s.logger.Info("replication probe",
+		logutil.PrivateString("server", server),
+		zap.Bool("replicated", reply.Replicated),
+		zap.Duration("latency", time.Duration(reply.Latency)),
+	)
+
+	return reply, nil
+}
@@ -0,0 +1,71 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/go-ipfs-log/entry"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestReplicationServiceProbe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	// the probe group of a server is kept between the probes
+	g, err := s.replicationProbe.group(ctx, "127.0.0.1:1", "token")
+	require.NoError(t, err)
+
+	again, err := s.replicationProbe.group(ctx, "127.0.0.1:1", "token")
+	require.NoError(t, err)
+	require.Equal(t, g.PublicKey, again.PublicKey)
+	require.Equal(t, g.Secret, again.Secret)
+
+	// the servers don't share a probe group, the heads announced by one of
+	// them can't make the probe of another one succeed
+	other, err := s.replicationProbe.group(ctx, "127.0.0.1:2", "token")
+	require.NoError(t, err)
+	require.NotEqual(t, g.PublicKey, other.PublicKey)
+
+	// nor the tokens, the group registered with a token can't make the
+	// probe of another one succeed
+	otherToken, err := s.replicationProbe.group(ctx, "127.0.0.1:1", "other token")
+	require.NoError(t, err)
+	require.NotEqual(t, g.PublicKey, otherToken.PublicKey)
+
+	// it isn't part of the account
+	_, err = s.GetContextGroupForID(g.PublicKey)
+	require.Error(t, err)
+
+	_, err = s.ReplicationServiceProbe(ctx, &protocoltypes.ReplicationServiceProbe_Request{ReplicationServer: "127.0.0.1:1"})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	_, err = s.ReplicationServiceProbe(ctx, &protocoltypes.ReplicationServiceProbe_Request{Token: "token", ReplicationServer: "127.0.0.1:1", Timeout: -1})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrInvalidInput))
+
+	// the server must accept the probe group
+	_, err = s.ReplicationServiceProbe(ctx, &protocoltypes.ReplicationServiceProbe_Request{Token: "token", ReplicationServer: "127.0.0.1:1", Timeout: 5})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrServiceReplicationServer))
+}
+
+func TestStoreSyncStateHasRemoteHead(t *testing.T) {
+	ids := testLogCompactionCIDs(t)
+	syncState := newStoreSyncState()
+
+	require.False(t, syncState.hasRemoteHead("/orbitdb/store", ids[0]))
+
+	syncState.addRemoteHeads("/orbitdb/store", nil, []*entry.Entry{{Hash: ids[0]}})
+
+	require.True(t, syncState.hasRemoteHead("/orbitdb/store", ids[0]))
+	require.False(t, syncState.hasRemoteHead("/orbitdb/store", ids[1]))
+	require.False(t, syncState.hasRemoteHead("/orbitdb/other", ids[0]))
+}
@@ -0,0 +1,184 @@
+package weshnet
+
+import (
+	"context"
+	"sync"
+
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// sendLanesConcurrency is the number of normal and bulk sends in progress
+	// at once, the interactive sends aren't limited
+	sendLanesConcurrency = 4
+
+	// sendLanesBulkConcurrency is the number of bulk sends in progress at
+	// once, a slow transfer doesn't stall the other ones
+	sendLanesBulkConcurrency = 2
+)
+
+// sendLanes schedules the outgoing envelopes by priority, so the background
+// traffic can't delay the interactive messages on constrained links. The
+// interactive sends start immediately, the normal ones wait for a free slot
+// and the bulk ones only start when no other send is waiting and no
+// interactive send is in progress.
+type sendLanes struct {
+	active  map[protocoltypes.SendPriority]int
+	waiting map[protocoltypes.SendPriority]int
+
+	// topics are the priorities of the entries written to each store and
+	// not published yet, indexed by the pubsub topic of the store
+	topics map[string]protocoltypes.SendPriority
+
+	notify *notify.Notify
+	mu     sync.Mutex
+}
+
+func newSendLanes() *sendLanes {
+	l := &sendLanes{
+		active:  map[protocoltypes.SendPriority]int{},
+		waiting: map[protocoltypes.SendPriority]int{},
+		topics:  map[string]protocoltypes.SendPriority{},
+	}
+	l.notify = notify.New(&l.mu)
+
+	return l
+}
+
+// sendLane returns the lane of a priority, the undefined and unknown
+// priorities are sent in the normal lane
+func sendLane(priority protocoltypes.SendPriority) protocoltypes.SendPriority {
+	switch priority {
+	case protocoltypes.SendPriority_SendPriorityInteractive, protocoltypes.SendPriority_SendPriorityBulk:
+		return priority
+	default:
+		return protocoltypes.SendPriority_SendPriorityNormal
+	}
+}
+
+// sendLaneRank orders the lanes from the highest priority to the lowest
+func sendLaneRank(priority protocoltypes.SendPriority) int {
+	switch sendLane(priority) {
+	case protocoltypes.SendPriority_SendPriorityInteractive:
+		return 0
+	case protocoltypes.SendPriority_SendPriorityNormal:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func (l *sendLanes) canStart(lane protocoltypes.SendPriority) bool {
+	throttled := l.active[protocoltypes.SendPriority_SendPriorityNormal] + l.active[protocoltypes.SendPriority_SendPriorityBulk]
+
+	switch lane {
+	case protocoltypes.SendPriority_SendPriorityInteractive:
+		return true
+	case protocoltypes.SendPriority_SendPriorityNormal:
+		return throttled < sendLanesConcurrency
+	default:
+		return throttled < sendLanesConcurrency &&
+			l.active[protocoltypes.SendPriority_SendPriorityBulk] < sendLanesBulkConcurrency &&
+			l.active[protocoltypes.SendPriority_SendPriorityInteractive] == 0 &&
+			l.waiting[protocoltypes.SendPriority_SendPriorityNormal] == 0
+	}
+}
+
+// acquire waits until a send of the given priority can start, release must
+// be called once it is done
+func (l *sendLanes) acquire(ctx context.Context, priority protocoltypes.SendPriority) (release func(), err error) {
+	lane := sendLane(priority)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waiting[lane]++
+	for !l.canStart(lane) {
+		if !l.notify.Wait(ctx) {
+			l.waiting[lane]--
+
+			// the lower priority sends may have been waiting for this one
+			l.notify.Broadcast()
+
+			return nil, ctx.Err()
+		}
+	}
+	l.waiting[lane]--
+	l.active[lane]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			l.active[lane]--
+			l.notify.Broadcast()
+			l.mu.Unlock()
+		})
+	}, nil
+}
+
+// setTopicPriority records the priority of an entry written to the store of
+// the topic, the next publication of its heads is sent in the highest lane of
+// the entries written since the previous one
+func (l *sendLanes) setTopicPriority(topic string, priority protocoltypes.SendPriority) {
+	lane := sendLane(priority)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if current, ok := l.topics[topic]; !ok || sendLaneRank(lane) < sendLaneRank(current) {
+		l.topics[topic] = lane
+	}
+}
+
+// takeTopicPriority returns the lane of the next publication of the heads of
+// a store, the normal lane if no entry has been written with a priority
+func (l *sendLanes) takeTopicPriority(topic string) protocoltypes.SendPriority {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lane, ok := l.topics[topic]
+	if !ok {
+		return protocoltypes.SendPriority_SendPriorityNormal
+	}
+
+	delete(l.topics, topic)
+
+	return lane
+}
+
+// prioritizedPubSub publishes the heads of the stores through the send lanes,
+// in the lane of the entries written since the previous publication
+type prioritizedPubSub struct {
+	iface.PubSubInterface
+
+	lanes *sendLanes
+}
+
+func (p *prioritizedPubSub) TopicSubscribe(ctx context.Context, topic string) (iface.PubSubTopic, error) {
+	t, err := p.PubSubInterface.TopicSubscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return &prioritizedPubSubTopic{PubSubTopic: t, topic: topic, lanes: p.lanes}, nil
+}
+
+type prioritizedPubSubTopic struct {
+	iface.PubSubTopic
+
+	topic string
+	lanes *sendLanes
+}
+
+func (t *prioritizedPubSubTopic) Publish(ctx context.Context, message []byte) error {
+	release, err := t.lanes.acquire(ctx, t.lanes.takeTopicPriority(t.topic))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return t.PubSubTopic.Publish(ctx, message)
+}
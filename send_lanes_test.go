@@ -0,0 +1,163 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/go-orbit-db/iface"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestSendLanes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := newSendLanes()
+
+	acquired := func(priority protocoltypes.SendPriority) (func(), bool) {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		release, err := l.acquire(ctx, priority)
+		return release, err == nil
+	}
+
+	// the bulk lane is limited to a few sends
+	releasesBulk := []func(){}
+	for i := 0; i < sendLanesBulkConcurrency; i++ {
+		release, ok := acquired(protocoltypes.SendPriority_SendPriorityBulk)
+		require.True(t, ok)
+		releasesBulk = append(releasesBulk, release)
+	}
+
+	_, ok := acquired(protocoltypes.SendPriority_SendPriorityBulk)
+	require.False(t, ok)
+
+	// the normal sends fill the remaining slots
+	releases := []func(){}
+	for i := sendLanesBulkConcurrency; i < sendLanesConcurrency; i++ {
+		release, ok := acquired(protocoltypes.SendPriority_SendPriorityUndefined)
+		require.True(t, ok)
+		releases = append(releases, release)
+	}
+
+	_, ok = acquired(protocoltypes.SendPriority_SendPriorityNormal)
+	require.False(t, ok)
+
+	// the interactive sends are never throttled
+	releaseInteractive, ok := acquired(protocoltypes.SendPriority_SendPriorityInteractive)
+	require.True(t, ok)
+
+	for _, release := range append(releasesBulk, releases...) {
+		release()
+	}
+
+	// the bulk sends wait for the interactive ones
+	_, ok = acquired(protocoltypes.SendPriority_SendPriorityBulk)
+	require.False(t, ok)
+
+	// releasing a send twice doesn't free another slot
+	releaseInteractive()
+	releaseInteractive()
+
+	releaseBulk, ok := acquired(protocoltypes.SendPriority_SendPriorityBulk)
+	require.True(t, ok)
+	releaseBulk()
+
+	// a waiting normal send is started before a bulk one
+	releases = releases[:0]
+	for i := 0; i < sendLanesConcurrency; i++ {
+		release, ok := acquired(protocoltypes.SendPriority_SendPriorityNormal)
+		require.True(t, ok)
+		releases = append(releases, release)
+	}
+
+	started := make(chan protocoltypes.SendPriority, 2)
+	for _, priority := range []protocoltypes.SendPriority{protocoltypes.SendPriority_SendPriorityNormal, protocoltypes.SendPriority_SendPriorityBulk} {
+		go func(priority protocoltypes.SendPriority) {
+			release, err := l.acquire(ctx, priority)
+			if err == nil {
+				started <- priority
+				release()
+			}
+		}(priority)
+	}
+
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.waiting[protocoltypes.SendPriority_SendPriorityNormal] == 1 && l.waiting[protocoltypes.SendPriority_SendPriorityBulk] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	releases[0]()
+	require.Equal(t, protocoltypes.SendPriority_SendPriorityNormal, <-started)
+	require.Equal(t, protocoltypes.SendPriority_SendPriorityBulk, <-started)
+
+	for _, release := range releases[1:] {
+		release()
+	}
+}
+
+type testPubSubTopic struct {
+	iface.PubSubTopic
+
+	published chan []byte
+}
+
+func (t *testPubSubTopic) Publish(_ context.Context, message []byte) error {
+	t.published <- message
+	return nil
+}
+
+func TestSendLanesTopicPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := newSendLanes()
+
+	// the heads are published in the highest lane of the entries written
+	// since the previous publication
+	require.Equal(t, protocoltypes.SendPriority_SendPriorityNormal, l.takeTopicPriority("topic"))
+
+	l.setTopicPriority("topic", protocoltypes.SendPriority_SendPriorityBulk)
+	l.setTopicPriority("topic", protocoltypes.SendPriority_SendPriorityInteractive)
+	l.setTopicPriority("topic", protocoltypes.SendPriority_SendPriorityUndefined)
+	require.Equal(t, protocoltypes.SendPriority_SendPriorityInteractive, l.takeTopicPriority("topic"))
+	require.Equal(t, protocoltypes.SendPriority_SendPriorityNormal, l.takeTopicPriority("topic"))
+
+	// the publications wait for a free slot of their lane
+	releases := []func(){}
+	for i := 0; i < sendLanesConcurrency; i++ {
+		release, err := l.acquire(ctx, protocoltypes.SendPriority_SendPriorityNormal)
+		require.NoError(t, err)
+		releases = append(releases, release)
+	}
+
+	published := make(chan []byte, 2)
+	topic := &prioritizedPubSubTopic{PubSubTopic: &testPubSubTopic{published: published}, topic: "topic", lanes: l}
+
+	l.setTopicPriority("topic", protocoltypes.SendPriority_SendPriorityInteractive)
+	require.NoError(t, topic.Publish(ctx, []byte("interactive")))
+	require.Equal(t, []byte("interactive"), <-published)
+
+	go func() {
+		_ = topic.Publish(ctx, []byte("normal"))
+	}()
+
+	require.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.waiting[protocoltypes.SendPriority_SendPriorityNormal] == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Empty(t, published)
+
+	releases[0]()
+	require.Equal(t, []byte("normal"), <-published)
+
+	for _, release := range releases[1:] {
+		release()
+	}
+}
@@ -2,18 +2,19 @@ package weshnet
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	mrand "math/rand"
+	"net/http"
+	"net/url"
 	"path/filepath"
 	"sync"
 	"time"
 	"unsafe"
 
-	"github.com/dgraph-io/badger/v2/options"
 	ds "github.com/ipfs/go-datastore"
 	ds_sync "github.com/ipfs/go-datastore/sync"
-	badger "github.com/ipfs/go-ds-badger2"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -40,6 +41,7 @@ import (
 	ipfs_mobile "berty.tech/weshnet/v2/pkg/ipfsutil/mobile"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/secretstore"
+	"berty.tech/weshnet/v2/pkg/storage"
 	tinder "berty.tech/weshnet/v2/pkg/tinder"
 	"berty.tech/weshnet/v2/pkg/tyber"
 )
@@ -72,11 +74,40 @@ type service struct {
 	refreshprocess         map[string]context.CancelFunc
 	muRefreshprocess       sync.RWMutex
 	swiper                 *Swiper
+	groupDirectory         *groupDirectory
 	peerStatusManager      *ConnectednessManager
 	accountEventBus        event.Bus
 	contactRequestsManager *contactRequestsManager
 	vcClient               *bertyvcissuer.Client
+	httpClient             *http.Client
+	tlsPins                TLSPins
+	tlsClientCertificates  []tls.Certificate
 	secretStore            secretstore.SecretStore
+	groupActivity          *groupActivity
+	groupRetains           *groupRetains
+	retention              *messageRetention
+	syncPolicies           *groupSyncPolicies
+	replicationProbe       *replicationProbe
+	relayCursors           *relayCursors
+	attachments            *attachmentStore
+	messageSearch          *messageSearchIndex
+	lanes                  *sendLanes
+	reactions              *messageReactions
+	encryptedStorage       *storage.EncryptedDatastore
+	rootDatastore          ds.Batching
+	outbox                 *outbox
+	presence               *contactPresence
+	deviceActivity         *deviceActivity
+	historyCursors         *deviceHistoryCursors
+	staleDeviceDelay       time.Duration
+	deviceCapabilities     *protocoltypes.DeviceCapabilities
+	groupOptions           func(g *protocoltypes.Group) *GroupOptions
+	dormantGroups          map[string]context.CancelFunc
+	muDormantGroups        sync.Mutex
+	registeredGroupDevices map[string]struct{}
+	muRegisteredDevices    sync.Mutex
+	deviceLinks            map[*deviceLinkSession]struct{}
+	muDeviceLinks          sync.Mutex
 
 	protocoltypes.UnimplementedProtocolServiceServer
 }
@@ -97,9 +128,97 @@ type Opts struct {
 	SecretStore        secretstore.SecretStore
 	PrometheusRegister prometheus.Registerer
 
+	// HTTPClient is used for the outgoing HTTP requests made by the service,
+	// such as the ones sent to credential verification services.
+	HTTPClient *http.Client
+
+	// HTTPProxy is used to build HTTPClient when it is nil, it can be set to
+	// a socks5:// URL to route the HTTP requests through Tor.
+	HTTPProxy *url.URL
+
+	// TLSPins restricts the public keys accepted from the given service
+	// hosts, it applies to replication servers and to HTTPClient when it is
+	// built by the service.
+	TLSPins TLSPins
+
+	// TLSClientCertificates are presented to the service endpoints requiring
+	// a client certificate (mTLS), they apply to the same connections as
+	// TLSPins.
+	TLSClientCertificates []tls.Certificate
+
+	// LazyGroupActivation delays the opening of the group stores until a
+	// subscription, a send or an incoming pubsub message targets the group,
+	// ActivateGroup only watches the group pubsub topics in this mode.
+	LazyGroupActivation bool
+
+	// MaxActiveGroups is the number of group stores kept opened when
+	// LazyGroupActivation is enabled, the least recently used ones are closed
+	// first. 0 means no limit.
+	MaxActiveGroups int
+
+	// GroupStorageQuota is the default storage quota in bytes of the groups
+	// whose retention policy doesn't set one, the oldest messages exceeding
+	// it are evicted locally. 0 means no quota.
+	GroupStorageQuota uint64
+
+	// StaleDeviceDelay is the delay after which a device of the account which
+	// hasn't synced is reported with an EventTypeAccountDeviceStale event.
+	// Defaults to 30 days.
+	StaleDeviceDelay time.Duration
+
+	// DeviceCapabilities are the capabilities announced by the device on the
+	// groups it activates. Defaults to the capabilities of this
+	// implementation.
+	DeviceCapabilities *protocoltypes.DeviceCapabilities
+
+	// MessageSearchIndex maintains a local full-text index of the decrypted
+	// messages, sealed with a key derived from the account, used by
+	// MessageSearch.
+	MessageSearchIndex bool
+
+	// DatastoreDriver opens the datastore stored in DatastoreDir when
+	// RootDatastore is nil. Defaults to badger. A directory created with a
+	// driver must be migrated with storage.MigrateDirectory to be opened
+	// with another one.
+	DatastoreDriver storage.Driver
+
+	// EncryptedStorage encrypts the datastore at rest with a master key
+	// sealed by StoragePassphrase. If StoragePassphrase is empty, the service
+	// starts locked until StorageUnlock is called.
+	EncryptedStorage bool
+
+	// StoragePassphrase unlocks the encrypted storage, it can also be a key
+	// retrieved from the OS keychain.
+	StoragePassphrase []byte
+	encryptedStorage  *storage.EncryptedDatastore
+
+	// EncryptExistingStorage encrypts in place the entries of a datastore
+	// created without EncryptedStorage, instead of failing with
+	// ErrStorageNotEncrypted. An interrupted encryption is resumed on the
+	// next start.
+	EncryptExistingStorage bool
+
+	// WriteCoalescing groups the writes made to the datastore in batches
+	// flushed after an interval or a number of writes, which speeds up the
+	// appends of busy groups. Its durability sets whether the batches are
+	// synced to disk. Disabled if nil. The secret store isn't coalesced, a
+	// lost write of its chain keys would reuse their message keys.
+	WriteCoalescing *storage.CoalescingOptions
+
+	// secretDatastore is the datastore of the secret store, the root
+	// datastore without write coalescing
+	secretDatastore ds.Batching
+
 	// These are used if OrbitDB is nil.
 	GroupMetadataStoreType string
 	GroupMessageStoreType  string
+
+	// GroupOptions returns the options of a contact or multi-member group
+	// each time its stores are opened, after its creation, its join or a
+	// restart. The access controller of the options can refuse entries
+	// allowed by the protocol, such as the messages of the members without a
+	// given role. It can be nil, as well as the returned options.
+	GroupOptions func(g *protocoltypes.Group) *GroupOptions
 }
 
 func (opts *Opts) applyPushDefaults() {
@@ -112,18 +231,20 @@ func (opts *Opts) applyPushDefaults() {
 	}
 }
 
-func (opts *Opts) applyDefaultsGetDatastore() error {
+func (opts *Opts) applyDefaultsGetDatastore(ctx context.Context) error {
 	if opts.RootDatastore == nil {
 		if opts.DatastoreDir == "" || opts.DatastoreDir == InMemoryDirectory {
 			opts.RootDatastore = ds_sync.MutexWrap(ds.NewMapDatastore())
 		} else {
-			bopts := badger.DefaultOptions
-			bopts.ValueLogLoadingMode = options.FileIO
+			if opts.DatastoreDriver == nil {
+				opts.DatastoreDriver = storage.Badger(nil)
+			}
 
-			ds, err := badger.NewDatastore(opts.DatastoreDir, &bopts)
+			ds, err := storage.Open(opts.DatastoreDir, opts.DatastoreDriver)
 			if err != nil {
-				return fmt.Errorf("unable to init badger datastore: %w", err)
+				return err
 			}
+
 			opts.RootDatastore = ds
 
 			oldClose := opts.close
@@ -142,6 +263,49 @@ func (opts *Opts) applyDefaultsGetDatastore() error {
 		}
 	}
 
+	if opts.EncryptedStorage {
+		encrypted, err := storage.OpenEncrypted(ctx, opts.RootDatastore, opts.StoragePassphrase)
+		if errcode.Has(err, errcode.ErrCode_ErrStorageNotEncrypted) && opts.EncryptExistingStorage {
+			if _, err = storage.EncryptInPlace(ctx, opts.RootDatastore, opts.StoragePassphrase); err == nil {
+				encrypted, err = storage.OpenEncrypted(ctx, opts.RootDatastore, opts.StoragePassphrase)
+			}
+		}
+		if err != nil {
+			// the datastore is closed so the unlock can be retried
+			if opts.close != nil {
+				_ = opts.close()
+				opts.close = nil
+			}
+
+			return err
+		}
+
+		opts.RootDatastore = encrypted
+		opts.encryptedStorage = encrypted
+	}
+
+	opts.secretDatastore = opts.RootDatastore
+
+	if opts.WriteCoalescing != nil {
+		coalescing := storage.NewCoalescing(opts.RootDatastore, opts.WriteCoalescing)
+		opts.RootDatastore = coalescing
+
+		// the pending writes are flushed before the datastore is closed
+		oldClose := opts.close
+		opts.close = func() error {
+			err := coalescing.Flush(context.Background())
+			if err != nil {
+				err = fmt.Errorf("unable to flush datastore: %w", err)
+			}
+
+			if oldClose != nil {
+				err = multierr.Append(err, oldClose())
+			}
+
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -152,14 +316,29 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 
 	rng := mrand.New(mrand.NewSource(srand.MustSecure())) // nolint:gosec // we need to use math/rand here, but it is seeded from crypto/rand
 
-	if err := opts.applyDefaultsGetDatastore(); err != nil {
+	if err := opts.applyDefaultsGetDatastore(ctx); err != nil {
 		return err
 	}
 
 	opts.applyPushDefaults()
 
+	if opts.HTTPClient == nil {
+		if opts.HTTPProxy != nil || len(opts.TLSPins) > 0 || len(opts.TLSClientCertificates) > 0 {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = opts.TLSPins.tlsConfig()
+			transport.TLSClientConfig.Certificates = opts.TLSClientCertificates
+			if opts.HTTPProxy != nil {
+				transport.Proxy = http.ProxyURL(opts.HTTPProxy)
+			}
+
+			opts.HTTPClient = &http.Client{Transport: transport}
+		} else {
+			opts.HTTPClient = http.DefaultClient
+		}
+	}
+
 	if opts.SecretStore == nil {
-		secretStore, err := secretstore.NewSecretStore(opts.RootDatastore, &secretstore.NewSecretStoreOptions{
+		secretStore, err := secretstore.NewSecretStore(opts.secretDatastore, &secretstore.NewSecretStoreOptions{
 			Logger: opts.Logger,
 		})
 		if err != nil {
@@ -311,7 +490,13 @@ func (opts *Opts) applyDefaults(ctx context.Context) error {
 // If opts.RootDatastore is nil and opts.DatastoreDir is "" or InMemoryDirectory, then set
 // opts.RootDatastore to an in-memory data store. Otherwise, if opts.RootDatastore is nil then set
 // opts.RootDatastore to a persistent data store at opts.DatastoreDir .
+// If opts.EncryptedStorage is set without opts.StoragePassphrase, the service
+// is locked until StorageUnlock is called.
 func NewService(opts Opts) (_ Service, err error) {
+	if opts.EncryptedStorage && len(opts.StoragePassphrase) == 0 {
+		return newLockedService(opts), nil
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	if err := opts.applyDefaults(ctx); err != nil {
@@ -359,6 +544,18 @@ func NewService(opts Opts) (_ Service, err error) {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unable to add account group to group datastore, err: %w", err))
 	}
 
+	var messageSearch *messageSearchIndex
+	if opts.MessageSearchIndex {
+		if messageSearch, err = newMessageSearchIndex(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceMessageSearch)), accountGroupCtx.Group().Secret); err != nil {
+			cancel()
+			return nil, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	lanes := opts.OrbitDB.lanes
+	reactions := newMessageReactions(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceMessageReactions)))
+	attachments := newAttachmentStore(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceAttachments)), opts.IpfsCoreAPI, lanes, opts.Logger)
+
 	s := &service{
 		ctx:             ctx,
 		ctxCancel:       cancel,
@@ -379,9 +576,66 @@ func NewService(opts Opts) (_ Service, err error) {
 		peerStatusManager:      NewConnectednessManager(),
 		accountEventBus:        accountEventBus,
 		contactRequestsManager: contactRequestsManager,
+		httpClient:             opts.HTTPClient,
+		tlsPins:                opts.TLSPins,
+		tlsClientCertificates:  opts.TLSClientCertificates,
+		dormantGroups:          make(map[string]context.CancelFunc),
+		registeredGroupDevices: make(map[string]struct{}),
+		deviceLinks:            make(map[*deviceLinkSession]struct{}),
+		retention:              newMessageRetention(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceMessageRetention)), opts.SecretStore, attachments, messageSearch, reactions, opts.GroupStorageQuota, opts.Logger),
+		syncPolicies:           newGroupSyncPolicies(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceSyncPolicy))),
+		groupRetains:           newGroupRetains(),
+		replicationProbe:       newReplicationProbe(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceReplicationProbe))),
+		relayCursors:           newRelayCursors(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceRelayCursors))),
+		attachments:            attachments,
+		lanes:                  lanes,
+		reactions:              reactions,
+		messageSearch:          messageSearch,
+		encryptedStorage:       opts.encryptedStorage,
+		rootDatastore:          opts.RootDatastore,
+		outbox:                 newOutbox(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceOutbox))),
+		presence:               newContactPresence(),
+		deviceActivity:         newDeviceActivity(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceDeviceActivity)), opts.Logger),
+		historyCursors:         newDeviceHistoryCursors(datastoreutil.NewNamespacedDatastore(opts.RootDatastore, ds.NewKey(NamespaceHistorySync))),
+		staleDeviceDelay:       opts.StaleDeviceDelay,
+		deviceCapabilities:     opts.DeviceCapabilities,
+		groupOptions:           opts.GroupOptions,
+	}
+
+	if s.deviceCapabilities == nil {
+		s.deviceCapabilities = defaultDeviceCapabilities()
+	}
+
+	if s.staleDeviceDelay <= 0 {
+		s.staleDeviceDelay = defaultStaleDeviceDelay
+	}
+
+	if opts.LazyGroupActivation {
+		s.groupActivity = newGroupActivity(opts.MaxActiveGroups, s.groupRetains)
+	}
+
+	if swiper != nil && opts.Host != nil {
+		s.groupDirectory = newGroupDirectory(ctx, opts.Host, swiper, opts.Logger)
+	}
+
+	if opts.Host != nil {
+		opts.Host.SetStreamHandler(deviceHistorySyncV1, s.handleDeviceHistorySync)
+		opts.Host.SetStreamHandler(contactSessionResetV1, s.handleContactSessionReset)
+		opts.Host.SetStreamHandler(deviceLinkV1, s.handleDeviceLink)
 	}
 
 	s.startGroupDeviceMonitor()
+	s.startMessageRetentionJanitor()
+	s.startLogCompactionJanitor()
+	s.startContactPresence()
+	s.watchBlockedContacts()
+	s.resumeAttachmentTransfers()
+	s.startOutbox()
+	s.recordDeviceActivity(accountGroupCtx)
+	s.announceDeviceCapabilities(accountGroupCtx)
+	s.indexMessages(accountGroupCtx)
+	s.recordReactions(accountGroupCtx)
+	s.startDeviceActivityJanitor()
 
 	return s, nil
 }
@@ -404,6 +658,16 @@ func (s *service) Close() error {
 		s.contactRequestsManager = nil
 	}
 
+	if s.groupDirectory != nil {
+		s.groupDirectory.close()
+	}
+
+	if s.host != nil {
+		s.host.RemoveStreamHandler(deviceHistorySyncV1)
+		s.host.RemoveStreamHandler(contactSessionResetV1)
+		s.host.RemoveStreamHandler(deviceLinkV1)
+	}
+
 	for _, gc := range s.openedGroups {
 		pk, subErr := gc.group.GetPubKey()
 		if subErr != nil {
@@ -3,12 +3,16 @@ package weshnet
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 
+	orbitdb "berty.tech/go-orbit-db"
 	"berty.tech/go-orbit-db/iface"
 	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
 	"berty.tech/weshnet/v2/pkg/secretstore"
 )
@@ -50,12 +54,24 @@ func (s *service) getGroupForPK(ctx context.Context, pk crypto.PubKey) (*protoco
 }
 
 func (s *service) deactivateGroup(pk crypto.PubKey) error {
+	return s.closeGroup(pk, false)
+}
+
+// closeGroup removes the group from the opened groups then closes its
+// context, its stores are dropped instead of closed if drop is true
+func (s *service) closeGroup(pk crypto.PubKey, drop bool) error {
 	id, err := pk.Raw()
 	if err != nil {
 		return errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	cg, err := s.GetContextGroupForID(id)
+	s.stopDormantWatch(id)
+
+	if s.groupActivity != nil {
+		s.groupActivity.remove(string(id))
+	}
+
+	cg, err := s.getOpenedGroup(id)
 	if err != nil || cg == nil {
 		// @FIXME(gfanton): should return an error code
 		return nil
@@ -64,18 +80,130 @@ func (s *service) deactivateGroup(pk crypto.PubKey) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	delete(s.openedGroups, string(id))
+
+	if cg.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		s.accountGroupCtx = nil
+	}
+
+	if drop {
+		// drop closes the stores and deletes their heads from the cache
+		if err := cg.Drop(); err != nil {
+			return errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+
+		return nil
+	}
+
 	err = cg.Close()
 	if err != nil {
 		s.logger.Error("unable to close group context", zap.Error(err))
 	}
 
-	delete(s.openedGroups, string(id))
+	return nil
+}
 
-	if cg.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
-		s.accountGroupCtx = nil
+// purgeGroupLocalData closes the given group then deletes the entries of its
+// stores, the keys derived for it, the attachments of its messages and their
+// reactions and search index, it returns the size in bytes of the deleted
+// entries and attachments. The group itself is kept in the secret store, activating it
+// again will replicate its stores from other peers.
+func (s *service) purgeGroupLocalData(ctx context.Context, pk crypto.PubKey) (uint64, error) {
+	id, err := pk.Raw()
+	if err != nil {
+		return 0, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	return nil
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return 0, err
+	}
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return 0, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("can't purge the account group"))
+	}
+
+	// stores must be opened to list their entries
+	cg, err := s.getOpenedGroup(id)
+	if err == errcode.ErrCode_ErrGroupUnknown {
+		if err := s.activateGroup(ctx, pk, true); err != nil {
+			return 0, errcode.ErrCode_ErrGroupActivate.Wrap(err)
+		}
+
+		cg, err = s.getOpenedGroup(id)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// message keys are indexed by the CID of their message
+	messageEntries, err := storeEntryCIDs(ctx, cg.messageStore, s.odb.logCompaction)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed := uint64(0)
+	entries := []cid.Cid(nil)
+
+	for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+		size, err := s.storeDiskUsage(ctx, store)
+		if err != nil {
+			return 0, err
+		}
+
+		ids, err := storeEntryCIDs(ctx, store, s.odb.logCompaction)
+		if err != nil {
+			return 0, err
+		}
+
+		reclaimed += size
+		entries = append(entries, ids...)
+	}
+
+	if err := s.closeGroup(pk, true); err != nil {
+		return 0, err
+	}
+
+	for _, store := range []orbitdb.Store{cg.metadataStore, cg.messageStore} {
+		if err := s.odb.logCompaction.reset(ctx, store.Address().String()); err != nil {
+			return 0, err
+		}
+
+		if err := s.odb.indexCache.reset(ctx, store.Address().String()); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := s.ipfsCoreAPI.Dag().Remove(ctx, entry); err != nil {
+			return 0, errcode.ErrCode_ErrInternal.Wrap(err)
+		}
+	}
+
+	if err := s.secretStore.PurgeGroupKeys(ctx, g, messageEntries); err != nil {
+		return 0, errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	attachmentsBytes, err := s.attachments.releaseGroup(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed += attachmentsBytes
+
+	if err := s.reactions.removeGroup(ctx, id); err != nil {
+		return 0, err
+	}
+
+	if s.messageSearch != nil {
+		if err := s.messageSearch.removeGroup(ctx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	s.logger.Debug("purged group local data", logutil.PrivateBinary("group", id), zap.Uint64("reclaimed", reclaimed))
+
+	return reclaimed, nil
 }
 
 func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly bool) error {
@@ -84,7 +212,7 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 		return errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	_, err = s.GetContextGroupForID(id)
+	_, err = s.getOpenedGroup(id)
 	if err != nil && err != errcode.ErrCode_ErrGroupUnknown {
 		return err
 	}
@@ -97,6 +225,11 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	return s.unsafeActivateGroup(ctx, id, g, localOnly)
+}
+
+// unsafeActivateGroup opens the stores of the group, s.lock must be held
+func (s *service) unsafeActivateGroup(ctx context.Context, id []byte, g *protocoltypes.Group, localOnly bool) (err error) {
 	// @WIP(gfanton): do we need to use contactPK
 	var contactPK crypto.PubKey
 	switch g.GroupType {
@@ -114,6 +247,12 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 			if err != nil {
 				return errcode.ErrCode_TODO.Wrap(err)
 			}
+
+			// the group of a blocked contact stays closed so the contact
+			// can't observe any activity
+			if s.accountGroupCtx.metadataStore.checkContactStatus(contactPK, protocoltypes.ContactState_ContactStateBlocked) {
+				return errcode.ErrCode_ErrGroupActivate.Wrap(errcode.ErrCode_ErrContactRequestContactBlocked)
+			}
 		}
 	case protocoltypes.GroupType_GroupTypeAccount:
 		localOnly = true
@@ -121,6 +260,8 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 			return err
 		}
 		s.openedGroups[string(id)] = s.accountGroupCtx
+		s.recordDeviceActivity(s.accountGroupCtx)
+		s.announceDeviceCapabilities(s.accountGroupCtx)
 
 		// reinitialize contactRequestsManager
 		if s.contactRequestsManager != nil {
@@ -135,8 +276,17 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 		return errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("unknown group type"))
 	}
 
+	if err := s.applyGroupSyncPolicy(ctx, g); err != nil {
+		return errcode.ErrCode_ErrGroupOpen.Wrap(err)
+	}
+
+	var groupOpts *GroupOptions
+	if s.groupOptions != nil {
+		groupOpts = s.groupOptions(g)
+	}
+
 	dbOpts := &iface.CreateDBOptions{LocalOnly: &localOnly}
-	gc, err := s.odb.OpenGroup(ctx, g, dbOpts)
+	gc, err := s.odb.OpenGroupWithOptions(ctx, g, dbOpts, groupOpts)
 	if err != nil {
 		return errcode.ErrCode_ErrGroupOpen.Wrap(err)
 	}
@@ -146,13 +296,100 @@ func (s *service) activateGroup(ctx context.Context, pk crypto.PubKey, localOnly
 		return errcode.ErrCode_ErrGroupActivate.Wrap(err)
 	}
 
+	if s.groupDirectory != nil {
+		if err := s.groupDirectory.watchGroup(gc); err != nil {
+			gc.Close()
+			return errcode.ErrCode_ErrGroupActivate.Wrap(err)
+		}
+	}
+
+	gc.messageStore.setPrunedChecker(func(c cid.Cid) bool {
+		return s.retention.isPruned(s.ctx, id, c)
+	})
+
+	gc.messageStore.setPrunedSenderGetter(func(c cid.Cid) []byte {
+		return s.retention.prunedSender(s.ctx, id, c)
+	})
+
+	gc.messageStore.setSeenAtRecorder(func(c cid.Cid) time.Time {
+		now := time.Now()
+		seen, err := s.retention.firstSeen(s.ctx, id, c, now)
+		if err != nil {
+			return now
+		}
+
+		return seen
+	})
+
+	gc.messageStore.setExpiredChecker(func(c cid.Cid) bool {
+		return s.retention.isExpired(s.ctx, id, c)
+	})
+
+	// the member keys of multi-member groups are derived for each group and
+	// can't be matched with a contact
+	if accountGroup := s.accountGroupCtx; g.GroupType == protocoltypes.GroupType_GroupTypeContact {
+		gc.messageStore.setBlockedChecker(func(devicePK []byte) bool {
+			return isDeviceBlocked(accountGroup.metadataStore, gc.metadataStore, devicePK)
+		})
+	}
+
+	if accountGroup := s.accountGroupCtx; accountGroup != nil && g.GroupType == protocoltypes.GroupType_GroupTypeMultiMember {
+		s.registerGroupDevice(accountGroup, gc)
+	}
+
+	s.recordDeviceActivity(gc)
+	s.announceDeviceCapabilities(gc)
+	s.acknowledgeMessages(gc)
+	s.enforceDisappearingMessages(gc)
+	s.recordAttachments(gc)
+	s.indexMessages(gc)
+	s.recordReactions(gc)
+	s.recordMessageExpiries(gc)
+
 	s.openedGroups[string(id)] = gc
 
+	// the messages queued for the group can now be sent
+	s.outbox.trigger()
+
+	// the stores are now listening to the group topics by themselves
+	s.stopDormantWatch(id)
+
 	gc.TagGroupContextPeers(s.ipfsCoreAPI, 42)
 	return nil
 }
 
+// GetContextGroupForID returns the context of an opened group, when lazy group
+// activation is enabled a dormant group is opened if needed and marked as
+// recently used.
 func (s *service) GetContextGroupForID(id []byte) (*GroupContext, error) {
+	cg, err := s.getOpenedGroup(id)
+	if s.groupActivity == nil {
+		return cg, err
+	}
+
+	if err == errcode.ErrCode_ErrGroupUnknown {
+		// groups deactivated by the user stay closed
+		if !s.isDormantGroup(id) {
+			return nil, err
+		}
+
+		if cg, err = s.activateGroupOnDemand(id); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if cg.group.GroupType != protocoltypes.GroupType_GroupTypeAccount {
+		s.touchGroup(id)
+	}
+
+	return cg, nil
+}
+
+// getOpenedGroup returns the context of an opened group without activating
+// it.
+func (s *service) getOpenedGroup(id []byte) (*GroupContext, error) {
 	if len(id) == 0 {
 		return nil, errcode.ErrCode_ErrInternal.Wrap(fmt.Errorf("no group id provided"))
 	}
@@ -206,6 +443,22 @@ func reindexGroupDatastore(ctx context.Context, secretStore secretstore.SecretSt
 	return nil
 }
 
+// isDeviceBlocked returns true if the device belongs to a member of the group
+// blocked by the account, the contact is matched by its account key
+func isDeviceBlocked(accountStore *MetadataStore, groupStore *MetadataStore, devicePK []byte) bool {
+	devicePublicKey, err := crypto.UnmarshalEd25519PublicKey(devicePK)
+	if err != nil {
+		return false
+	}
+
+	memberPublicKey, err := groupStore.GetMemberByDevice(devicePublicKey)
+	if err != nil {
+		return false
+	}
+
+	return accountStore.checkContactStatus(memberPublicKey, protocoltypes.ContactState_ContactStateBlocked)
+}
+
 func (s *service) getAccountGroup() *GroupContext {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -0,0 +1,337 @@
+package weshnet
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/internal/notify"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// groupActivity keeps track of the recently used groups when lazy group
+// activation is enabled, the least recently used groups which are not
+// retained are closed once more than maxActive groups are opened.
+type groupActivity struct {
+	maxActive int
+	retains   *groupRetains
+
+	order    *list.List // group ids, most recently used first
+	elements map[string]*list.Element
+
+	muActivity sync.Mutex
+}
+
+func newGroupActivity(maxActive int, retains *groupRetains) *groupActivity {
+	return &groupActivity{
+		maxActive: maxActive,
+		retains:   retains,
+		order:     list.New(),
+		elements:  make(map[string]*list.Element),
+	}
+}
+
+// touch marks the group as recently used, it returns the groups to close
+func (a *groupActivity) touch(id string) (evicted []string) {
+	a.muActivity.Lock()
+	defer a.muActivity.Unlock()
+
+	if e, ok := a.elements[id]; ok {
+		a.order.MoveToFront(e)
+	} else {
+		a.elements[id] = a.order.PushFront(id)
+	}
+
+	if a.maxActive <= 0 {
+		return nil
+	}
+
+	for e := a.order.Back(); e != nil && a.order.Len() > a.maxActive; {
+		prev := e.Prev()
+
+		if gid := e.Value.(string); gid != id && !a.retains.isRetained(gid) {
+			a.order.Remove(e)
+			delete(a.elements, gid)
+			evicted = append(evicted, gid)
+		}
+
+		e = prev
+	}
+
+	return evicted
+}
+
+// remove stops tracking the group, it is called once the group is closed
+func (a *groupActivity) remove(id string) {
+	a.muActivity.Lock()
+	defer a.muActivity.Unlock()
+
+	if e, ok := a.elements[id]; ok {
+		a.order.Remove(e)
+		delete(a.elements, id)
+	}
+}
+
+// groupRetains counts the calls using each group, a retained group is
+// neither closed when idle nor rebuilt by a recovery. The retains of a group
+// being rebuilt wait until it is opened again.
+type groupRetains struct {
+	retained   map[string]int
+	rebuilding map[string]bool
+
+	notify *notify.Notify
+	mu     sync.Mutex
+}
+
+func newGroupRetains() *groupRetains {
+	r := &groupRetains{
+		retained:   make(map[string]int),
+		rebuilding: make(map[string]bool),
+	}
+	r.notify = notify.New(&r.mu)
+
+	return r
+}
+
+// retain prevents the group from being closed until the returned function is
+// called
+func (r *groupRetains) retain(id string) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.rebuilding[id] {
+		r.notify.Wait(context.Background())
+	}
+
+	r.retained[id]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if r.retained[id]--; r.retained[id] <= 0 {
+				delete(r.retained, id)
+			}
+
+			r.notify.Broadcast()
+		})
+	}
+}
+
+func (r *groupRetains) isRetained(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.retained[id] > 0
+}
+
+// rebuild waits until the group is no longer retained and blocks the new
+// retains until the returned function is called, it fails once ctx is done
+func (r *groupRetains) rebuild(ctx context.Context, id string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.retained[id] > 0 || r.rebuilding[id] {
+		if !r.notify.Wait(ctx) {
+			return nil, errcode.ErrCode_ErrGroupActivate.Wrap(fmt.Errorf("the group is used by other calls: %w", ctx.Err()))
+		}
+	}
+
+	r.rebuilding[id] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			delete(r.rebuilding, id)
+			r.notify.Broadcast()
+		})
+	}, nil
+}
+
+// retainGroup prevents a group from being closed or rebuilt while it is used
+// by a call, the returned function must be called once done
+func (s *service) retainGroup(id []byte) func() {
+	if s.groupRetains == nil {
+		return func() {}
+	}
+
+	return s.groupRetains.retain(string(id))
+}
+
+// retainContextGroupForID returns the context of a group like
+// GetContextGroupForID and prevents it from being closed until the returned
+// function is called, RPCs using a group keep it until they return
+func (s *service) retainContextGroupForID(id []byte) (*GroupContext, func(), error) {
+	release := s.retainGroup(id)
+
+	cg, err := s.GetContextGroupForID(id)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+
+	return cg, release, nil
+}
+
+// touchGroup marks the group as recently used and closes the idle groups
+// exceeding MaxActiveGroups, these are woken up by their pubsub topics.
+func (s *service) touchGroup(id []byte) {
+	for _, evicted := range s.groupActivity.touch(string(id)) {
+		cg, err := s.getOpenedGroup([]byte(evicted))
+		if err != nil {
+			continue
+		}
+
+		if err := s.hibernateGroup(cg.group); err != nil {
+			s.logger.Error("unable to close idle group", logutil.PrivateBinary("group", cg.group.PublicKey), zap.Error(err))
+		}
+	}
+}
+
+// activateGroupOnDemand opens a known group targeted by a request
+func (s *service) activateGroupOnDemand(id []byte) (*GroupContext, error) {
+	pk, err := crypto.UnmarshalEd25519PublicKey(id)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if err := s.activateGroup(s.ctx, pk, false); err != nil {
+		return nil, errcode.ErrCode_ErrGroupActivate.Wrap(err)
+	}
+
+	s.logger.Debug("group activated on demand", logutil.PrivateBinary("group", id))
+
+	return s.getOpenedGroup(id)
+}
+
+// activateGroupLazily watches the pubsub topics of a group instead of opening
+// its stores, the account group is always opened
+func (s *service) activateGroupLazily(ctx context.Context, pk crypto.PubKey) error {
+	id, err := pk.Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if _, err := s.getOpenedGroup(id); err == nil {
+		return nil
+	}
+
+	g, err := s.getGroupForPK(ctx, pk)
+	if err != nil {
+		return errcode.ErrCode_ErrInternal.Wrap(err)
+	}
+
+	if g.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		return s.activateGroup(ctx, pk, true)
+	}
+
+	return s.watchDormantGroup(g)
+}
+
+// hibernateGroup closes the stores of the group and opens them again as soon
+// as a message is received on one of their pubsub topics
+func (s *service) hibernateGroup(g *protocoltypes.Group) error {
+	pk, err := g.GetPubKey()
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if err := s.deactivateGroup(pk); err != nil {
+		return errcode.ErrCode_ErrGroupDeactivate.Wrap(err)
+	}
+
+	return s.watchDormantGroup(g)
+}
+
+// watchDormantGroup listens to the pubsub topics of the stores of a group
+// which isn't opened, the group is activated on the first message received.
+func (s *service) watchDormantGroup(g *protocoltypes.Group) error {
+	topics, err := s.odb.groupStoreTopics(s.ctx, g)
+	if err != nil {
+		return err
+	}
+
+	id := g.GetPublicKey()
+	ctx, cancel := context.WithCancel(s.ctx)
+
+	s.muDormantGroups.Lock()
+	if previous, ok := s.dormantGroups[string(id)]; ok {
+		previous()
+	}
+	s.dormantGroups[string(id)] = cancel
+	s.muDormantGroups.Unlock()
+
+	wake := make(chan struct{}, 1)
+	for _, topic := range topics {
+		t, err := s.odb.pubSub.TopicSubscribe(ctx, topic)
+		if err != nil {
+			s.stopDormantWatch(id)
+			return errcode.ErrCode_ErrGroupActivate.Wrap(fmt.Errorf("unable to subscribe to group topic: %w", err))
+		}
+
+		msgs, err := t.WatchMessages(ctx)
+		if err != nil {
+			s.stopDormantWatch(id)
+			return errcode.ErrCode_ErrGroupActivate.Wrap(fmt.Errorf("unable to watch group topic: %w", err))
+		}
+
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-msgs:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		}
+
+		s.logger.Debug("waking up dormant group", logutil.PrivateBinary("group", id))
+
+		if _, err := s.GetContextGroupForID(id); err != nil {
+			s.logger.Error("unable to wake up dormant group", logutil.PrivateBinary("group", id), zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+// isDormantGroup returns true if the pubsub topics of the group are watched
+// while its stores are closed
+func (s *service) isDormantGroup(id []byte) bool {
+	s.muDormantGroups.Lock()
+	defer s.muDormantGroups.Unlock()
+
+	_, ok := s.dormantGroups[string(id)]
+	return ok
+}
+
+// stopDormantWatch stops listening to the pubsub topics of a dormant group
+func (s *service) stopDormantWatch(id []byte) {
+	s.muDormantGroups.Lock()
+	defer s.muDormantGroups.Unlock()
+
+	if cancel, ok := s.dormantGroups[string(id)]; ok {
+		cancel()
+		delete(s.dormantGroups, string(id))
+	}
+}
@@ -0,0 +1,94 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupActivity(t *testing.T) {
+	retains := newGroupRetains()
+	a := newGroupActivity(2, retains)
+
+	require.Empty(t, a.touch("a"))
+	require.Empty(t, a.touch("b"))
+
+	// "a" is the least recently used group
+	require.Equal(t, []string{"a"}, a.touch("c"))
+
+	// using "b" makes "c" the least recently used group
+	require.Empty(t, a.touch("b"))
+	require.Equal(t, []string{"c"}, a.touch("d"))
+
+	// retained groups are kept opened
+	release := retains.retain("b")
+	require.Equal(t, []string{"d"}, a.touch("e"))
+	require.Equal(t, []string{"e"}, a.touch("f"))
+
+	// releasing several times has no effect
+	release()
+	release()
+	require.Equal(t, []string{"b"}, a.touch("g"))
+
+	// removed groups aren't evicted
+	a.remove("f")
+	require.Empty(t, a.touch("h"))
+
+	// no limit
+	a = newGroupActivity(0, retains)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.Empty(t, a.touch(id))
+	}
+}
+
+func TestGroupRetainsRebuild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := newGroupRetains()
+
+	// a retained group can't be rebuilt
+	release := r.retain("a")
+	require.True(t, r.isRetained("a"))
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err := r.rebuild(timeoutCtx, "a")
+	timeoutCancel()
+	require.Error(t, err)
+
+	// the rebuild waits for the calls using the group
+	rebuilt := make(chan func())
+	go func() {
+		done, err := r.rebuild(ctx, "a")
+		assert.NoError(t, err)
+		rebuilt <- done
+	}()
+
+	release()
+	done := <-rebuilt
+	require.False(t, r.isRetained("a"))
+
+	// the new calls wait for the rebuild
+	retained := make(chan func())
+	go func() {
+		retained <- r.retain("a")
+	}()
+
+	select {
+	case <-retained:
+		require.FailNow(t, "group retained while rebuilt")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done()
+	release = <-retained
+	require.True(t, r.isRetained("a"))
+	release()
+
+	// the other groups are not affected
+	_, err = r.rebuild(ctx, "b")
+	require.NoError(t, err)
+}
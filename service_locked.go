@@ -0,0 +1,1205 @@
+package weshnet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	coreiface "github.com/ipfs/kubo/core/coreiface"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+// lockedService is returned by NewService when the storage is encrypted and
+// its passphrase isn't provided, as the datastore is required to start the
+// service. Once StorageUnlock has started the service, every call is
+// forwarded to it, until then they fail with ErrStorageLocked.
+type lockedService struct {
+	protocoltypes.UnimplementedProtocolServiceServer
+
+	opts    Opts
+	service Service
+	mu      sync.RWMutex
+}
+
+func newLockedService(opts Opts) *lockedService {
+	return &lockedService{opts: opts}
+}
+
+func (l *lockedService) unlocked() Service {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.service
+}
+
+// unlockedService returns the started service, or ErrStorageLocked until the
+// storage is unlocked
+func (l *lockedService) unlockedService() (Service, error) {
+	if service := l.unlocked(); service != nil {
+		return service, nil
+	}
+
+	return nil, errcode.ErrCode_ErrStorageLocked
+}
+
+// StorageUnlock starts the service with the passphrase of its storage, once
+// started the passphrase is checked by the service
+func (l *lockedService) StorageUnlock(ctx context.Context, req *protocoltypes.StorageUnlock_Request) (*protocoltypes.StorageUnlock_Reply, error) {
+	if len(req.Passphrase) == 0 {
+		return nil, errcode.ErrCode_ErrMissingInput.Wrap(fmt.Errorf("no passphrase provided"))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.service != nil {
+		return l.service.StorageUnlock(ctx, req)
+	}
+
+	opts := l.opts
+	opts.StoragePassphrase = req.Passphrase
+
+	service, err := NewService(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l.service = service
+
+	return &protocoltypes.StorageUnlock_Reply{}, nil
+}
+
+func (l *lockedService) Close() error {
+	if service := l.unlocked(); service != nil {
+		return service.Close()
+	}
+
+	return nil
+}
+
+func (l *lockedService) Status() Status {
+	if service := l.unlocked(); service != nil {
+		return service.Status()
+	}
+
+	return Status{Protocol: errcode.ErrCode_ErrStorageLocked}
+}
+
+func (l *lockedService) IpfsCoreAPI() coreiface.CoreAPI {
+	if service := l.unlocked(); service != nil {
+		return service.IpfsCoreAPI()
+	}
+
+	return nil
+}
+
+// the calls are forwarded to the started service
+
+func (l *lockedService) ServiceExportData(req *protocoltypes.ServiceExportData_Request, server protocoltypes.ProtocolService_ServiceExportDataServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.ServiceExportData(req, server)
+}
+
+func (l *lockedService) ServiceGetConfiguration(ctx context.Context, req *protocoltypes.ServiceGetConfiguration_Request) (*protocoltypes.ServiceGetConfiguration_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ServiceGetConfiguration(ctx, req)
+}
+
+func (l *lockedService) StorageChangePassphrase(ctx context.Context, req *protocoltypes.StorageChangePassphrase_Request) (*protocoltypes.StorageChangePassphrase_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.StorageChangePassphrase(ctx, req)
+}
+
+func (l *lockedService) StorageStats(ctx context.Context, req *protocoltypes.StorageStats_Request) (*protocoltypes.StorageStats_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.StorageStats(ctx, req)
+}
+
+func (l *lockedService) StorageGC(ctx context.Context, req *protocoltypes.StorageGC_Request) (*protocoltypes.StorageGC_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.StorageGC(ctx, req)
+}
+
+func (l *lockedService) DeviceRevoke(ctx context.Context, req *protocoltypes.DeviceRevoke_Request) (*protocoltypes.DeviceRevoke_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeviceRevoke(ctx, req)
+}
+
+func (l *lockedService) DeviceSetName(ctx context.Context, req *protocoltypes.DeviceSetName_Request) (*protocoltypes.DeviceSetName_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeviceSetName(ctx, req)
+}
+
+func (l *lockedService) DeviceList(ctx context.Context, req *protocoltypes.DeviceList_Request) (*protocoltypes.DeviceList_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeviceList(ctx, req)
+}
+
+func (l *lockedService) DeviceRotateKey(ctx context.Context, req *protocoltypes.DeviceRotateKey_Request) (*protocoltypes.DeviceRotateKey_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeviceRotateKey(ctx, req)
+}
+
+func (l *lockedService) DevicePrimaryTransferStart(ctx context.Context, req *protocoltypes.DevicePrimaryTransferStart_Request) (*protocoltypes.DevicePrimaryTransferStart_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DevicePrimaryTransferStart(ctx, req)
+}
+
+func (l *lockedService) DevicePrimaryTransferAccept(ctx context.Context, req *protocoltypes.DevicePrimaryTransferAccept_Request) (*protocoltypes.DevicePrimaryTransferAccept_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DevicePrimaryTransferAccept(ctx, req)
+}
+
+func (l *lockedService) DeviceLinkStart(req *protocoltypes.DeviceLinkStart_Request, server protocoltypes.ProtocolService_DeviceLinkStartServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.DeviceLinkStart(req, server)
+}
+
+func (l *lockedService) DeviceLinkJoin(ctx context.Context, req *protocoltypes.DeviceLinkJoin_Request) (*protocoltypes.DeviceLinkJoin_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeviceLinkJoin(ctx, req)
+}
+
+func (l *lockedService) DeviceHistorySync(req *protocoltypes.DeviceHistorySync_Request, server protocoltypes.ProtocolService_DeviceHistorySyncServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.DeviceHistorySync(req, server)
+}
+
+func (l *lockedService) ContactRequestReference(ctx context.Context, req *protocoltypes.ContactRequestReference_Request) (*protocoltypes.ContactRequestReference_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestReference(ctx, req)
+}
+
+func (l *lockedService) ContactRequestDisable(ctx context.Context, req *protocoltypes.ContactRequestDisable_Request) (*protocoltypes.ContactRequestDisable_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestDisable(ctx, req)
+}
+
+func (l *lockedService) ContactRequestEnable(ctx context.Context, req *protocoltypes.ContactRequestEnable_Request) (*protocoltypes.ContactRequestEnable_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestEnable(ctx, req)
+}
+
+func (l *lockedService) ContactRequestResetReference(ctx context.Context, req *protocoltypes.ContactRequestResetReference_Request) (*protocoltypes.ContactRequestResetReference_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestResetReference(ctx, req)
+}
+
+func (l *lockedService) ContactRequestSend(ctx context.Context, req *protocoltypes.ContactRequestSend_Request) (*protocoltypes.ContactRequestSend_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestSend(ctx, req)
+}
+
+func (l *lockedService) ContactRequestAccept(ctx context.Context, req *protocoltypes.ContactRequestAccept_Request) (*protocoltypes.ContactRequestAccept_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestAccept(ctx, req)
+}
+
+func (l *lockedService) ContactRequestDiscard(ctx context.Context, req *protocoltypes.ContactRequestDiscard_Request) (*protocoltypes.ContactRequestDiscard_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestDiscard(ctx, req)
+}
+
+func (l *lockedService) ShareContact(ctx context.Context, req *protocoltypes.ShareContact_Request) (*protocoltypes.ShareContact_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ShareContact(ctx, req)
+}
+
+func (l *lockedService) DecodeContact(ctx context.Context, req *protocoltypes.DecodeContact_Request) (*protocoltypes.DecodeContact_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DecodeContact(ctx, req)
+}
+
+func (l *lockedService) ContactRequestPolicySet(ctx context.Context, req *protocoltypes.ContactRequestPolicySet_Request) (*protocoltypes.ContactRequestPolicySet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestPolicySet(ctx, req)
+}
+
+func (l *lockedService) ContactRequestPolicyGet(ctx context.Context, req *protocoltypes.ContactRequestPolicyGet_Request) (*protocoltypes.ContactRequestPolicyGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactRequestPolicyGet(ctx, req)
+}
+
+func (l *lockedService) ContactBlock(ctx context.Context, req *protocoltypes.ContactBlock_Request) (*protocoltypes.ContactBlock_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactBlock(ctx, req)
+}
+
+func (l *lockedService) ContactUnblock(ctx context.Context, req *protocoltypes.ContactUnblock_Request) (*protocoltypes.ContactUnblock_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactUnblock(ctx, req)
+}
+
+func (l *lockedService) ContactSetMetadata(ctx context.Context, req *protocoltypes.ContactSetMetadata_Request) (*protocoltypes.ContactSetMetadata_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactSetMetadata(ctx, req)
+}
+
+func (l *lockedService) ContactGetMetadata(ctx context.Context, req *protocoltypes.ContactGetMetadata_Request) (*protocoltypes.ContactGetMetadata_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactGetMetadata(ctx, req)
+}
+
+func (l *lockedService) ContactDelete(ctx context.Context, req *protocoltypes.ContactDelete_Request) (*protocoltypes.ContactDelete_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactDelete(ctx, req)
+}
+
+func (l *lockedService) ContactVerificationInfo(ctx context.Context, req *protocoltypes.ContactVerificationInfo_Request) (*protocoltypes.ContactVerificationInfo_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactVerificationInfo(ctx, req)
+}
+
+func (l *lockedService) ContactMarkVerified(ctx context.Context, req *protocoltypes.ContactMarkVerified_Request) (*protocoltypes.ContactMarkVerified_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactMarkVerified(ctx, req)
+}
+
+func (l *lockedService) ContactResetSession(ctx context.Context, req *protocoltypes.ContactResetSession_Request) (*protocoltypes.ContactResetSession_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactResetSession(ctx, req)
+}
+
+func (l *lockedService) ContactReintroductionProofCreate(ctx context.Context, req *protocoltypes.ContactReintroductionProofCreate_Request) (*protocoltypes.ContactReintroductionProofCreate_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactReintroductionProofCreate(ctx, req)
+}
+
+func (l *lockedService) ContactReintroduce(ctx context.Context, req *protocoltypes.ContactReintroduce_Request) (*protocoltypes.ContactReintroduce_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactReintroduce(ctx, req)
+}
+
+func (l *lockedService) ContactIntroduce(ctx context.Context, req *protocoltypes.ContactIntroduce_Request) (*protocoltypes.ContactIntroduce_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactIntroduce(ctx, req)
+}
+
+func (l *lockedService) ContactIntroductionAccept(ctx context.Context, req *protocoltypes.ContactIntroductionAccept_Request) (*protocoltypes.ContactIntroductionAccept_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactIntroductionAccept(ctx, req)
+}
+
+func (l *lockedService) ContactList(req *protocoltypes.ContactList_Request, server protocoltypes.ProtocolService_ContactListServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.ContactList(req, server)
+}
+
+func (l *lockedService) PresenceSettingsSet(ctx context.Context, req *protocoltypes.PresenceSettingsSet_Request) (*protocoltypes.PresenceSettingsSet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.PresenceSettingsSet(ctx, req)
+}
+
+func (l *lockedService) PresenceSettingsGet(ctx context.Context, req *protocoltypes.PresenceSettingsGet_Request) (*protocoltypes.PresenceSettingsGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.PresenceSettingsGet(ctx, req)
+}
+
+func (l *lockedService) ReadReceiptsSet(ctx context.Context, req *protocoltypes.ReadReceiptsSet_Request) (*protocoltypes.ReadReceiptsSet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReadReceiptsSet(ctx, req)
+}
+
+func (l *lockedService) ReadReceiptsGet(ctx context.Context, req *protocoltypes.ReadReceiptsGet_Request) (*protocoltypes.ReadReceiptsGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReadReceiptsGet(ctx, req)
+}
+
+func (l *lockedService) ContactPresenceWatch(req *protocoltypes.ContactPresenceWatch_Request, server protocoltypes.ProtocolService_ContactPresenceWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.ContactPresenceWatch(req, server)
+}
+
+func (l *lockedService) AccountSettingsSet(ctx context.Context, req *protocoltypes.AccountSettingsSet_Request) (*protocoltypes.AccountSettingsSet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AccountSettingsSet(ctx, req)
+}
+
+func (l *lockedService) AccountSettingsGet(ctx context.Context, req *protocoltypes.AccountSettingsGet_Request) (*protocoltypes.AccountSettingsGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AccountSettingsGet(ctx, req)
+}
+
+func (l *lockedService) AccountSettingsWatch(req *protocoltypes.AccountSettingsWatch_Request, server protocoltypes.ProtocolService_AccountSettingsWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.AccountSettingsWatch(req, server)
+}
+
+func (l *lockedService) ContactAliasKeySend(ctx context.Context, req *protocoltypes.ContactAliasKeySend_Request) (*protocoltypes.ContactAliasKeySend_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ContactAliasKeySend(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupCreate(ctx context.Context, req *protocoltypes.MultiMemberGroupCreate_Request) (*protocoltypes.MultiMemberGroupCreate_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupCreate(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupJoin(ctx context.Context, req *protocoltypes.MultiMemberGroupJoin_Request) (*protocoltypes.MultiMemberGroupJoin_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupJoin(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupLeave(ctx context.Context, req *protocoltypes.MultiMemberGroupLeave_Request) (*protocoltypes.MultiMemberGroupLeave_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupLeave(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupAliasResolverDisclose(ctx context.Context, req *protocoltypes.MultiMemberGroupAliasResolverDisclose_Request) (*protocoltypes.MultiMemberGroupAliasResolverDisclose_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupAliasResolverDisclose(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupAdminRoleGrant(ctx context.Context, req *protocoltypes.MultiMemberGroupAdminRoleGrant_Request) (*protocoltypes.MultiMemberGroupAdminRoleGrant_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupAdminRoleGrant(ctx, req)
+}
+
+func (l *lockedService) GroupMemberRemove(ctx context.Context, req *protocoltypes.GroupMemberRemove_Request) (*protocoltypes.GroupMemberRemove_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupMemberRemove(ctx, req)
+}
+
+func (l *lockedService) GroupBanMember(ctx context.Context, req *protocoltypes.GroupBanMember_Request) (*protocoltypes.GroupBanMember_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupBanMember(ctx, req)
+}
+
+func (l *lockedService) GroupBanList(ctx context.Context, req *protocoltypes.GroupBanList_Request) (*protocoltypes.GroupBanList_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupBanList(ctx, req)
+}
+
+func (l *lockedService) GroupTransferOwnership(ctx context.Context, req *protocoltypes.GroupTransferOwnership_Request) (*protocoltypes.GroupTransferOwnership_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupTransferOwnership(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupRotateSecret(ctx context.Context, req *protocoltypes.MultiMemberGroupRotateSecret_Request) (*protocoltypes.MultiMemberGroupRotateSecret_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupRotateSecret(ctx, req)
+}
+
+func (l *lockedService) GroupSetMemberRole(ctx context.Context, req *protocoltypes.GroupSetMemberRole_Request) (*protocoltypes.GroupSetMemberRole_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupSetMemberRole(ctx, req)
+}
+
+func (l *lockedService) GroupGetRoles(ctx context.Context, req *protocoltypes.GroupGetRoles_Request) (*protocoltypes.GroupGetRoles_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupGetRoles(ctx, req)
+}
+
+func (l *lockedService) GroupSetBroadcastMode(ctx context.Context, req *protocoltypes.GroupSetBroadcastMode_Request) (*protocoltypes.GroupSetBroadcastMode_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupSetBroadcastMode(ctx, req)
+}
+
+func (l *lockedService) MultiMemberGroupInvitationCreate(ctx context.Context, req *protocoltypes.MultiMemberGroupInvitationCreate_Request) (*protocoltypes.MultiMemberGroupInvitationCreate_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MultiMemberGroupInvitationCreate(ctx, req)
+}
+
+func (l *lockedService) GroupInvitationRevoke(ctx context.Context, req *protocoltypes.GroupInvitationRevoke_Request) (*protocoltypes.GroupInvitationRevoke_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupInvitationRevoke(ctx, req)
+}
+
+func (l *lockedService) GroupJoinRequestList(req *protocoltypes.GroupJoinRequestList_Request, server protocoltypes.ProtocolService_GroupJoinRequestListServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupJoinRequestList(req, server)
+}
+
+func (l *lockedService) GroupJoinRequestApprove(ctx context.Context, req *protocoltypes.GroupJoinRequestApprove_Request) (*protocoltypes.GroupJoinRequestApprove_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupJoinRequestApprove(ctx, req)
+}
+
+func (l *lockedService) GroupMembershipWatch(req *protocoltypes.GroupMembershipWatch_Request, server protocoltypes.ProtocolService_GroupMembershipWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupMembershipWatch(req, server)
+}
+
+func (l *lockedService) GroupSetPublic(ctx context.Context, req *protocoltypes.GroupSetPublic_Request) (*protocoltypes.GroupSetPublic_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupSetPublic(ctx, req)
+}
+
+func (l *lockedService) GroupDirectorySearch(req *protocoltypes.GroupDirectorySearch_Request, server protocoltypes.ProtocolService_GroupDirectorySearchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupDirectorySearch(req, server)
+}
+
+func (l *lockedService) AppMetadataSend(ctx context.Context, req *protocoltypes.AppMetadataSend_Request) (*protocoltypes.AppMetadataSend_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AppMetadataSend(ctx, req)
+}
+
+func (l *lockedService) AppMessageSend(ctx context.Context, req *protocoltypes.AppMessageSend_Request) (*protocoltypes.AppMessageSend_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AppMessageSend(ctx, req)
+}
+
+func (l *lockedService) AppMessageEdit(ctx context.Context, req *protocoltypes.AppMessageEdit_Request) (*protocoltypes.AppMessageEdit_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AppMessageEdit(ctx, req)
+}
+
+func (l *lockedService) SendStatusWatch(req *protocoltypes.SendStatusWatch_Request, server protocoltypes.ProtocolService_SendStatusWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.SendStatusWatch(req, server)
+}
+
+func (l *lockedService) ScheduledMessageList(ctx context.Context, req *protocoltypes.ScheduledMessageList_Request) (*protocoltypes.ScheduledMessageList_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ScheduledMessageList(ctx, req)
+}
+
+func (l *lockedService) ScheduledMessageCancel(ctx context.Context, req *protocoltypes.ScheduledMessageCancel_Request) (*protocoltypes.ScheduledMessageCancel_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ScheduledMessageCancel(ctx, req)
+}
+
+func (l *lockedService) AppMessageRetract(ctx context.Context, req *protocoltypes.AppMessageRetract_Request) (*protocoltypes.AppMessageRetract_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AppMessageRetract(ctx, req)
+}
+
+func (l *lockedService) AppMessageReact(ctx context.Context, req *protocoltypes.AppMessageReact_Request) (*protocoltypes.AppMessageReact_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AppMessageReact(ctx, req)
+}
+
+func (l *lockedService) MessageReactionList(ctx context.Context, req *protocoltypes.MessageReactionList_Request) (*protocoltypes.MessageReactionList_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MessageReactionList(ctx, req)
+}
+
+func (l *lockedService) AttachmentPrepare(server protocoltypes.ProtocolService_AttachmentPrepareServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.AttachmentPrepare(server)
+}
+
+func (l *lockedService) AttachmentRetrieve(req *protocoltypes.AttachmentRetrieve_Request, server protocoltypes.ProtocolService_AttachmentRetrieveServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.AttachmentRetrieve(req, server)
+}
+
+func (l *lockedService) AttachmentTransferStart(ctx context.Context, req *protocoltypes.AttachmentTransferStart_Request) (*protocoltypes.AttachmentTransferStart_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.AttachmentTransferStart(ctx, req)
+}
+
+func (l *lockedService) AttachmentTransferWatch(req *protocoltypes.AttachmentTransferWatch_Request, server protocoltypes.ProtocolService_AttachmentTransferWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.AttachmentTransferWatch(req, server)
+}
+
+func (l *lockedService) GroupMetadataList(req *protocoltypes.GroupMetadataList_Request, server protocoltypes.ProtocolService_GroupMetadataListServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupMetadataList(req, server)
+}
+
+func (l *lockedService) GroupMessageList(req *protocoltypes.GroupMessageList_Request, server protocoltypes.ProtocolService_GroupMessageListServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupMessageList(req, server)
+}
+
+func (l *lockedService) GroupInfo(ctx context.Context, req *protocoltypes.GroupInfo_Request) (*protocoltypes.GroupInfo_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupInfo(ctx, req)
+}
+
+func (l *lockedService) GroupStats(ctx context.Context, req *protocoltypes.GroupStats_Request) (*protocoltypes.GroupStats_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupStats(ctx, req)
+}
+
+func (l *lockedService) GroupVerifyIntegrity(ctx context.Context, req *protocoltypes.GroupVerifyIntegrity_Request) (*protocoltypes.GroupVerifyIntegrity_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupVerifyIntegrity(ctx, req)
+}
+
+func (l *lockedService) GroupSyncStateWatch(req *protocoltypes.GroupSyncStateWatch_Request, server protocoltypes.ProtocolService_GroupSyncStateWatchServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupSyncStateWatch(req, server)
+}
+
+func (l *lockedService) GroupRetentionPolicySet(ctx context.Context, req *protocoltypes.GroupRetentionPolicySet_Request) (*protocoltypes.GroupRetentionPolicySet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupRetentionPolicySet(ctx, req)
+}
+
+func (l *lockedService) GroupRetentionPolicyGet(ctx context.Context, req *protocoltypes.GroupRetentionPolicyGet_Request) (*protocoltypes.GroupRetentionPolicyGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupRetentionPolicyGet(ctx, req)
+}
+
+func (l *lockedService) GroupSyncPolicySet(ctx context.Context, req *protocoltypes.GroupSyncPolicySet_Request) (*protocoltypes.GroupSyncPolicySet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupSyncPolicySet(ctx, req)
+}
+
+func (l *lockedService) GroupSyncPolicyGet(ctx context.Context, req *protocoltypes.GroupSyncPolicyGet_Request) (*protocoltypes.GroupSyncPolicyGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupSyncPolicyGet(ctx, req)
+}
+
+func (l *lockedService) GroupMessageHistoryFetch(ctx context.Context, req *protocoltypes.GroupMessageHistoryFetch_Request) (*protocoltypes.GroupMessageHistoryFetch_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupMessageHistoryFetch(ctx, req)
+}
+
+func (l *lockedService) GroupRecoverFromNetwork(ctx context.Context, req *protocoltypes.GroupRecoverFromNetwork_Request) (*protocoltypes.GroupRecoverFromNetwork_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupRecoverFromNetwork(ctx, req)
+}
+
+func (l *lockedService) DisappearingMessagesSet(ctx context.Context, req *protocoltypes.DisappearingMessagesSet_Request) (*protocoltypes.DisappearingMessagesSet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DisappearingMessagesSet(ctx, req)
+}
+
+func (l *lockedService) DisappearingMessagesGet(ctx context.Context, req *protocoltypes.DisappearingMessagesGet_Request) (*protocoltypes.DisappearingMessagesGet_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DisappearingMessagesGet(ctx, req)
+}
+
+func (l *lockedService) GroupExport(req *protocoltypes.GroupExport_Request, server protocoltypes.ProtocolService_GroupExportServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupExport(req, server)
+}
+
+func (l *lockedService) GroupImport(server protocoltypes.ProtocolService_GroupImportServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupImport(server)
+}
+
+func (l *lockedService) ActivateGroup(ctx context.Context, req *protocoltypes.ActivateGroup_Request) (*protocoltypes.ActivateGroup_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ActivateGroup(ctx, req)
+}
+
+func (l *lockedService) DeactivateGroup(ctx context.Context, req *protocoltypes.DeactivateGroup_Request) (*protocoltypes.DeactivateGroup_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DeactivateGroup(ctx, req)
+}
+
+func (l *lockedService) GroupPurgeLocalData(ctx context.Context, req *protocoltypes.GroupPurgeLocalData_Request) (*protocoltypes.GroupPurgeLocalData_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupPurgeLocalData(ctx, req)
+}
+
+func (l *lockedService) GroupDeviceStatus(req *protocoltypes.GroupDeviceStatus_Request, server protocoltypes.ProtocolService_GroupDeviceStatusServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.GroupDeviceStatus(req, server)
+}
+
+func (l *lockedService) GroupDeviceCapabilities(ctx context.Context, req *protocoltypes.GroupDeviceCapabilities_Request) (*protocoltypes.GroupDeviceCapabilities_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.GroupDeviceCapabilities(ctx, req)
+}
+
+func (l *lockedService) MessageDeliveryStatus(ctx context.Context, req *protocoltypes.MessageDeliveryStatus_Request) (*protocoltypes.MessageDeliveryStatus_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MessageDeliveryStatus(ctx, req)
+}
+
+func (l *lockedService) MessageSearch(ctx context.Context, req *protocoltypes.MessageSearch_Request) (*protocoltypes.MessageSearch_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MessageSearch(ctx, req)
+}
+
+func (l *lockedService) MessageMarkRead(ctx context.Context, req *protocoltypes.MessageMarkRead_Request) (*protocoltypes.MessageMarkRead_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.MessageMarkRead(ctx, req)
+}
+
+func (l *lockedService) DebugListGroups(req *protocoltypes.DebugListGroups_Request, server protocoltypes.ProtocolService_DebugListGroupsServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.DebugListGroups(req, server)
+}
+
+func (l *lockedService) DebugInspectGroupStore(req *protocoltypes.DebugInspectGroupStore_Request, server protocoltypes.ProtocolService_DebugInspectGroupStoreServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.DebugInspectGroupStore(req, server)
+}
+
+func (l *lockedService) DebugGroup(ctx context.Context, req *protocoltypes.DebugGroup_Request) (*protocoltypes.DebugGroup_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.DebugGroup(ctx, req)
+}
+
+func (l *lockedService) SystemInfo(ctx context.Context, req *protocoltypes.SystemInfo_Request) (*protocoltypes.SystemInfo_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.SystemInfo(ctx, req)
+}
+
+func (l *lockedService) CredentialVerificationServiceInitFlow(ctx context.Context, req *protocoltypes.CredentialVerificationServiceInitFlow_Request) (*protocoltypes.CredentialVerificationServiceInitFlow_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.CredentialVerificationServiceInitFlow(ctx, req)
+}
+
+func (l *lockedService) CredentialVerificationServiceCompleteFlow(ctx context.Context, req *protocoltypes.CredentialVerificationServiceCompleteFlow_Request) (*protocoltypes.CredentialVerificationServiceCompleteFlow_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.CredentialVerificationServiceCompleteFlow(ctx, req)
+}
+
+func (l *lockedService) VerifiedCredentialsList(req *protocoltypes.VerifiedCredentialsList_Request, server protocoltypes.ProtocolService_VerifiedCredentialsListServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.VerifiedCredentialsList(req, server)
+}
+
+func (l *lockedService) ReplicationServiceRegisterGroup(ctx context.Context, req *protocoltypes.ReplicationServiceRegisterGroup_Request) (*protocoltypes.ReplicationServiceRegisterGroup_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReplicationServiceRegisterGroup(ctx, req)
+}
+
+func (l *lockedService) ReplicationServiceUnregisterGroup(ctx context.Context, req *protocoltypes.ReplicationServiceUnregisterGroup_Request) (*protocoltypes.ReplicationServiceUnregisterGroup_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReplicationServiceUnregisterGroup(ctx, req)
+}
+
+func (l *lockedService) ReplicationServiceListProviders(ctx context.Context, req *protocoltypes.ReplicationServiceListProviders_Request) (*protocoltypes.ReplicationServiceListProviders_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReplicationServiceListProviders(ctx, req)
+}
+
+func (l *lockedService) ReplicationServiceProbe(ctx context.Context, req *protocoltypes.ReplicationServiceProbe_Request) (*protocoltypes.ReplicationServiceProbe_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.ReplicationServiceProbe(ctx, req)
+}
+
+func (l *lockedService) RelayServiceDeposit(ctx context.Context, req *protocoltypes.RelayServiceDeposit_Request) (*protocoltypes.RelayServiceDeposit_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.RelayServiceDeposit(ctx, req)
+}
+
+func (l *lockedService) RelayServiceFetch(ctx context.Context, req *protocoltypes.RelayServiceFetch_Request) (*protocoltypes.RelayServiceFetch_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.RelayServiceFetch(ctx, req)
+}
+
+func (l *lockedService) RelayServiceSubscribe(req *protocoltypes.RelayServiceSubscribe_Request, server protocoltypes.ProtocolService_RelayServiceSubscribeServer) error {
+	service, err := l.unlockedService()
+	if err != nil {
+		return err
+	}
+
+	return service.RelayServiceSubscribe(req, server)
+}
+
+func (l *lockedService) PeerList(ctx context.Context, req *protocoltypes.PeerList_Request) (*protocoltypes.PeerList_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.PeerList(ctx, req)
+}
+
+func (l *lockedService) OutOfStoreReceive(ctx context.Context, req *protocoltypes.OutOfStoreReceive_Request) (*protocoltypes.OutOfStoreReceive_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.OutOfStoreReceive(ctx, req)
+}
+
+func (l *lockedService) OutOfStoreReceiveBatch(ctx context.Context, req *protocoltypes.OutOfStoreReceiveBatch_Request) (*protocoltypes.OutOfStoreReceiveBatch_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.OutOfStoreReceiveBatch(ctx, req)
+}
+
+func (l *lockedService) OutOfStoreSeal(ctx context.Context, req *protocoltypes.OutOfStoreSeal_Request) (*protocoltypes.OutOfStoreSeal_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.OutOfStoreSeal(ctx, req)
+}
+
+func (l *lockedService) RefreshContactRequest(ctx context.Context, req *protocoltypes.RefreshContactRequest_Request) (*protocoltypes.RefreshContactRequest_Reply, error) {
+	service, err := l.unlockedService()
+	if err != nil {
+		return nil, err
+	}
+
+	return service.RefreshContactRequest(ctx, req)
+}
@@ -0,0 +1,132 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/ipfsutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestLockedService(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+
+	start := func() (Service, protocoltypes.ProtocolServiceClient, func()) {
+		svc, err := NewService(Opts{
+			Logger:           zap.NewNop(),
+			IpfsCoreAPI:      ipfsutil.TestingCoreAPI(ctx, t).API(),
+			RootDatastore:    datastore,
+			EncryptedStorage: true,
+		})
+		require.NoError(t, err)
+
+		client, cleanup := TestingClient(ctx, t, svc, nil, nil)
+
+		return svc, client, func() {
+			cleanup()
+			require.NoError(t, svc.Close())
+		}
+	}
+
+	svc, client, cleanup := start()
+
+	// the service is locked until the storage is unlocked
+	_, err := client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageLocked))
+	require.True(t, errcode.Has(svc.Status().Protocol, errcode.ErrCode_ErrStorageLocked))
+
+	_, err = client.StorageUnlock(ctx, &protocoltypes.StorageUnlock_Request{Passphrase: []byte("passphrase")})
+	require.NoError(t, err)
+
+	config, err := client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+	require.NoError(t, svc.Status().Protocol)
+
+	// the calls made in process are forwarded too
+	direct, err := svc.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+	require.Equal(t, config.AccountPk, direct.AccountPk)
+
+	// the passphrase is still checked once unlocked
+	_, err = client.StorageUnlock(ctx, &protocoltypes.StorageUnlock_Request{Passphrase: []byte("wrong passphrase")})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	_, err = client.StorageUnlock(ctx, &protocoltypes.StorageUnlock_Request{Passphrase: []byte("passphrase")})
+	require.NoError(t, err)
+
+	_, err = client.StorageChangePassphrase(ctx, &protocoltypes.StorageChangePassphrase_Request{
+		CurrentPassphrase: []byte("wrong passphrase"),
+		NewPassphrase:     []byte("new passphrase"),
+	})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	_, err = client.StorageChangePassphrase(ctx, &protocoltypes.StorageChangePassphrase_Request{
+		CurrentPassphrase: []byte("passphrase"),
+		NewPassphrase:     []byte("new passphrase"),
+	})
+	require.NoError(t, err)
+
+	cleanup()
+
+	// the account is restored with the new passphrase
+	_, client, cleanup = start()
+	defer cleanup()
+
+	_, err = client.StorageUnlock(ctx, &protocoltypes.StorageUnlock_Request{Passphrase: []byte("passphrase")})
+	require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageInvalidPassphrase))
+
+	_, err = client.StorageUnlock(ctx, &protocoltypes.StorageUnlock_Request{Passphrase: []byte("new passphrase")})
+	require.NoError(t, err)
+
+	reopened, err := client.ServiceGetConfiguration(ctx, &protocoltypes.ServiceGetConfiguration_Request{})
+	require.NoError(t, err)
+	require.Equal(t, config.AccountPk, reopened.AccountPk)
+}
+
+// lockedServerStream is a server stream receiving empty messages
+type lockedServerStream struct {
+	grpc.ServerStream
+
+	ctx context.Context
+}
+
+func (s *lockedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *lockedServerStream) RecvMsg(interface{}) error {
+	return nil
+}
+
+func TestLockedServiceForwardsAllMethods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	locked := newLockedService(Opts{})
+	noop := func(interface{}) error { return nil }
+
+	// a method left unimplemented would fail with Unimplemented
+	for _, method := range protocoltypes.ProtocolService_ServiceDesc.Methods {
+		if method.MethodName == "StorageUnlock" {
+			continue
+		}
+
+		_, err := method.Handler(locked, ctx, noop, nil)
+		require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageLocked), method.MethodName)
+	}
+
+	for _, stream := range protocoltypes.ProtocolService_ServiceDesc.Streams {
+		err := stream.Handler(locked, &lockedServerStream{ctx: ctx})
+		require.True(t, errcode.Has(err, errcode.ErrCode_ErrStorageLocked), stream.StreamName)
+	}
+}
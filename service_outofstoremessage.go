@@ -149,6 +149,10 @@ func (s *oosmService) OutOfStoreReceive(ctx context.Context, request *protocolty
 	}, nil
 }
 
+func (s *oosmService) OutOfStoreReceiveBatch(ctx context.Context, request *protocoltypes.OutOfStoreReceiveBatch_Request) (*protocoltypes.OutOfStoreReceiveBatch_Reply, error) {
+	return outOfStoreReceiveBatch(ctx, s.secretStore, request.Payloads), nil
+}
+
 // FallBackOption is a structure that permit to fallback to a default option if the option is not set.
 type FallBackOption struct {
 	fallback func(s *oosmService) bool
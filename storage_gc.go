@@ -0,0 +1,211 @@
+package weshnet
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"go.uber.org/zap"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/logutil"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/storage"
+)
+
+// storageGCAttachmentGracePeriod is the time during which an attachment
+// prepared but referenced by no message is kept, so it can still be sent
+const storageGCAttachmentGracePeriod = 24 * time.Hour
+
+// datastoreNamespaceUsage returns the number of entries and the size of the
+// keys and values stored under each top-level namespace of the datastore
+func datastoreNamespaceUsage(ctx context.Context, datastore ds.Datastore) ([]*protocoltypes.StorageStats_Namespace, error) {
+	results, err := datastore.Query(ctx, query.Query{KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	namespaces := map[string]*protocoltypes.StorageStats_Namespace{}
+
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		name := strings.SplitN(strings.TrimPrefix(result.Key, "/"), "/", 2)[0]
+
+		namespace, ok := namespaces[name]
+		if !ok {
+			namespace = &protocoltypes.StorageStats_Namespace{Name: name}
+			namespaces[name] = namespace
+		}
+
+		namespace.EntryCount++
+		namespace.Bytes += uint64(len(result.Key))
+		if result.Size > 0 {
+			namespace.Bytes += uint64(result.Size)
+		}
+	}
+
+	usage := make([]*protocoltypes.StorageStats_Namespace, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		usage = append(usage, namespace)
+	}
+
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Name < usage[j].Name })
+
+	return usage, nil
+}
+
+// storageStats reports the disk usage of the datastore, of the activated
+// groups and of the attachments
+func (s *service) storageStats(ctx context.Context) (*protocoltypes.StorageStats_Reply, error) {
+	diskUsage, err := ds.DiskUsage(ctx, s.rootDatastore)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+
+	namespaces, err := datastoreNamespaceUsage(ctx, s.rootDatastore)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &protocoltypes.StorageStats_Reply{
+		DiskUsage:  diskUsage,
+		Namespaces: namespaces,
+	}
+
+	s.lock.RLock()
+	groups := make([]*GroupContext, 0, len(s.openedGroups))
+	for _, gc := range s.openedGroups {
+		groups = append(groups, gc)
+	}
+	s.lock.RUnlock()
+
+	for _, gc := range groups {
+		metadataBytes, err := s.storeDiskUsage(ctx, gc.MetadataStore())
+		if err != nil {
+			return nil, err
+		}
+
+		messageBytes, err := s.storeDiskUsage(ctx, gc.MessageStore())
+		if err != nil {
+			return nil, err
+		}
+
+		reply.Groups = append(reply.Groups, &protocoltypes.StorageStats_Group{
+			GroupPk:            gc.Group().PublicKey,
+			MetadataStoreBytes: metadataBytes,
+			MessageStoreBytes:  messageBytes,
+		})
+	}
+
+	if reply.AttachmentCount, reply.AttachmentsBytes, err = s.attachments.usage(ctx); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// purgeLeftGroups deletes the local data of the groups left by the account:
+// the entries of their stores, their keys, the attachments of their messages
+// and their reactions and search index. It returns the groups which had local
+// data and the size in bytes deleted.
+func (s *service) purgeLeftGroups(ctx context.Context) ([][]byte, uint64, error) {
+	accountGroup := s.getAccountGroup()
+	if accountGroup == nil {
+		return nil, 0, errcode.ErrCode_ErrGroupMissing
+	}
+
+	purged, reclaimed := [][]byte(nil), uint64(0)
+
+	for _, groupPK := range accountGroup.MetadataStore().ListLeftGroupPKs() {
+		pk, err := crypto.UnmarshalEd25519PublicKey(groupPK)
+		if err != nil {
+			return purged, reclaimed, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		// a group which can't be purged doesn't prevent the others from
+		// being purged
+		groupBytes, err := s.purgeGroupLocalData(ctx, pk)
+		if err != nil {
+			s.logger.Warn("unable to purge left group", logutil.PrivateBinary("group", groupPK), zap.Error(err))
+			continue
+		}
+
+		if groupBytes > 0 {
+			purged = append(purged, groupPK)
+			reclaimed += groupBytes
+		}
+	}
+
+	return purged, reclaimed, nil
+}
+
+// pruneAttachments deletes the attachments referenced by no message, except
+// those waiting in the outbox or prepared recently
+func (s *service) pruneAttachments(ctx context.Context, now time.Time) (uint64, uint64, error) {
+	messages, err := s.outbox.list(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	keep := map[string]struct{}{}
+	for _, msg := range messages {
+		for _, attachmentCID := range msg.AttachmentCids {
+			keep[string(attachmentCID)] = struct{}{}
+		}
+	}
+
+	return s.attachments.pruneOrphans(ctx, keep, now.Add(-storageGCAttachmentGracePeriod))
+}
+
+// collectGarbage runs the collections selected by the request, all of them
+// if none is selected. The datastore is compacted last so it releases the
+// space of the entries deleted by the other collections.
+func (s *service) collectGarbage(ctx context.Context, req *protocoltypes.StorageGC_Request) (*protocoltypes.StorageGC_Reply, error) {
+	all := !req.PurgeLeftGroups && !req.PruneAttachments && !req.CompactDatastore && !req.CompactLogs
+	reply := &protocoltypes.StorageGC_Reply{}
+
+	var err error
+
+	if all || req.PurgeLeftGroups {
+		if reply.PurgedGroupPks, reply.GroupsReclaimedBytes, err = s.purgeLeftGroups(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if all || req.PruneAttachments {
+		if reply.PrunedAttachmentCount, reply.AttachmentsReclaimedBytes, err = s.pruneAttachments(ctx, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	if all || req.CompactLogs {
+		if reply.CompactedEntryCount, reply.LogsReclaimedBytes, err = s.compactLogs(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if all || req.CompactDatastore {
+		if reply.DatastoreReclaimedBytes, err = storage.Compact(ctx, s.rootDatastore); err != nil {
+			return nil, err
+		}
+	}
+
+	reply.ReclaimedBytes = reply.GroupsReclaimedBytes + reply.AttachmentsReclaimedBytes + reply.LogsReclaimedBytes + reply.DatastoreReclaimedBytes
+
+	s.logger.Debug("storage garbage collected",
+		zap.Int("purged groups", len(reply.PurgedGroupPks)),
+		zap.Uint64("pruned attachments", reply.PrunedAttachmentCount),
+		zap.Uint64("compacted entries", reply.CompactedEntryCount),
+		zap.Uint64("reclaimed", reply.ReclaimedBytes),
+	)
+
+	return reply, nil
+}
@@ -0,0 +1,106 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestDatastoreNamespaceUsage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/outbox/a"), []byte("12345")))
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/outbox/b"), []byte("123")))
+	require.NoError(t, datastore.Put(ctx, ds.NewKey("/attachments/keys/a"), []byte("1")))
+
+	usage, err := datastoreNamespaceUsage(ctx, datastore)
+	require.NoError(t, err)
+	require.Len(t, usage, 2)
+
+	require.Equal(t, "attachments", usage[0].Name)
+	require.Equal(t, uint64(1), usage[0].EntryCount)
+	require.Equal(t, uint64(len("/attachments/keys/a")+1), usage[0].Bytes)
+
+	require.Equal(t, "outbox", usage[1].Name)
+	require.Equal(t, uint64(2), usage[1].EntryCount)
+	require.Equal(t, uint64(len("/outbox/a")*2+8), usage[1].Bytes)
+}
+
+func TestStorageGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp, cancel := NewTestingProtocol(ctx, t, &TestingOpts{}, nil)
+	defer cancel()
+
+	s := tp.Service.(*service)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	_, err = s.MultiMemberGroupJoin(ctx, &protocoltypes.MultiMemberGroupJoin_Request{Group: g})
+	require.NoError(t, err)
+
+	_, err = s.ActivateGroup(ctx, &protocoltypes.ActivateGroup_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	_, err = s.AppMessageSend(ctx, &protocoltypes.AppMessageSend_Request{GroupPk: g.PublicKey, Payload: []byte("message")})
+	require.NoError(t, err)
+
+	w, err := s.attachments.newWriter(ctx, false)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("attachment"))
+	require.NoError(t, err)
+	_, err = w.Close()
+	require.NoError(t, err)
+
+	stats, err := s.StorageStats(ctx, &protocoltypes.StorageStats_Request{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), stats.AttachmentCount)
+	require.Equal(t, uint64(len("attachment")), stats.AttachmentsBytes)
+	require.NotEmpty(t, stats.Namespaces)
+
+	found := false
+	for _, group := range stats.Groups {
+		if string(group.GroupPk) == string(g.PublicKey) {
+			found = true
+			require.NotZero(t, group.MetadataStoreBytes)
+			require.NotZero(t, group.MessageStoreBytes)
+		}
+	}
+	require.True(t, found)
+
+	_, err = s.MultiMemberGroupLeave(ctx, &protocoltypes.MultiMemberGroupLeave_Request{GroupPk: g.PublicKey})
+	require.NoError(t, err)
+
+	// the local data of the left group is deleted, the attachment prepared
+	// recently is kept
+	reply, err := s.StorageGC(ctx, &protocoltypes.StorageGC_Request{})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{g.PublicKey}, reply.PurgedGroupPks)
+	require.NotZero(t, reply.GroupsReclaimedBytes)
+	require.Zero(t, reply.PrunedAttachmentCount)
+
+	// nothing is left to purge
+	reply, err = s.StorageGC(ctx, &protocoltypes.StorageGC_Request{PurgeLeftGroups: true})
+	require.NoError(t, err)
+	require.Empty(t, reply.PurgedGroupPks)
+
+	// the attachment is pruned once it is old enough
+	count, reclaimed, err := s.pruneAttachments(ctx, time.Now().Add(2*storageGCAttachmentGracePeriod))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+	require.Equal(t, uint64(len("attachment")), reclaimed)
+
+	stats, err = s.StorageStats(ctx, &protocoltypes.StorageStats_Request{})
+	require.NoError(t, err)
+	require.Zero(t, stats.AttachmentCount)
+}
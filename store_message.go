@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
@@ -17,7 +19,6 @@ import (
 
 	ipfslog "berty.tech/go-ipfs-log"
 	"berty.tech/go-ipfs-log/identityprovider"
-	ipliface "berty.tech/go-ipfs-log/iface"
 	"berty.tech/go-orbit-db/address"
 	"berty.tech/go-orbit-db/iface"
 	"berty.tech/go-orbit-db/stores"
@@ -51,6 +52,84 @@ type MessageStore struct {
 
 	messagesQueue *simpleMessageQueue
 
+	// canPublish checks whether a device is allowed to send messages at the
+	// given time, it is set by the group context as it depends on the
+	// metadata store
+	canPublish   func(devicePK []byte, at time.Time) bool
+	muCanPublish sync.RWMutex
+
+	// sameDevice checks whether a device key is the one which sent a message
+	// or has replaced it through key rotations, it is set by the group
+	// context as it depends on the metadata store
+	sameDevice   func(previousPK, devicePK []byte) bool
+	muSameDevice sync.RWMutex
+
+	// pruned checks whether a message has been pruned by the retention
+	// policy of the group, it is set by the service
+	pruned   func(id cid.Cid) bool
+	muPruned sync.RWMutex
+
+	// compacted checks whether an entry has been removed from the log by a
+	// compaction, it is set when the store is created
+	compacted func(id cid.Cid) bool
+
+	// access applies the access controller set in the options of the group
+	// to an opened message, it is set when the store is created
+	access func(ctx context.Context, entry *GroupAccessEntry) error
+
+	// prunedSender returns the device which sent a pruned message, the
+	// message may have been removed from the log by a compaction, it is set
+	// by the service
+	prunedSender   func(id cid.Cid) []byte
+	muPrunedSender sync.RWMutex
+
+	// blocked checks whether a device belongs to a contact blocked by the
+	// account, it is set by the service
+	blocked   func(devicePK []byte) bool
+	muBlocked sync.RWMutex
+
+	// seenAt returns the time at which a message has been received for the
+	// first time, the retired device keys are checked at this time, it is set
+	// by the service
+	seenAt   func(id cid.Cid) time.Time
+	muSeenAt sync.RWMutex
+
+	// deviceSeen records the device of each received entry, it is set by
+	// the service
+	deviceSeen   func(devicePK []byte, sentAt int64)
+	muDeviceSeen sync.RWMutex
+
+	// attachmentsSeen records the keys of the attachments of each opened
+	// message, it is set by the service
+	attachmentsSeen   func(id cid.Cid, attachments []*protocoltypes.AttachmentSecret)
+	muAttachmentsSeen sync.RWMutex
+
+	// indexer adds each opened message to the search index, it is set by
+	// the service
+	indexer   func(evt *protocoltypes.GroupMessageEvent, clock uint64)
+	muIndexer sync.RWMutex
+
+	// reactionSeen aggregates the reactions of each opened message and
+	// deletes the reactions to the retracted messages, it is set by the
+	// service
+	reactionSeen   func(evt *protocoltypes.GroupMessageEvent, clock uint64)
+	muReactionSeen sync.RWMutex
+
+	// expirySeen schedules the deletion of each opened message sent with an
+	// expiry and of the edits of the expiring messages, it is set by the
+	// service
+	expirySeen   func(id cid.Cid, evt *protocoltypes.GroupMessageEvent)
+	muExpirySeen sync.RWMutex
+
+	// expired checks whether a pruned message has expired, it is listed as
+	// such, it is set by the service
+	expired   func(id cid.Cid) bool
+	muExpired sync.RWMutex
+
+	// lastActivity is the unix timestamp in milliseconds of the last entry
+	// written or replicated since the store has been opened
+	lastActivity int64
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -92,12 +171,302 @@ func (m *MessageStore) openMessage(ctx context.Context, e ipfslog.Entry) (*proto
 		return nil, fmt.Errorf("no secret for device")
 	}
 
-	return m.processMessage(ctx, &messageItem{
+	// the messages received from a retired key before the end of its grace
+	// period stay readable
+	if !m.isPublisherAt(headers.DevicePk, m.firstSeen(e.GetHash())) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("device not allowed to send messages"))
+	}
+
+	if m.isBlocked(headers.DevicePk) {
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked.Wrap(fmt.Errorf("message sent by a blocked contact"))
+	}
+
+	evt, err := m.processMessage(ctx, &messageItem{
 		op:      op,
 		env:     env,
 		headers: headers,
 		hash:    e.GetHash(),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.checkThreadID(evt.ThreadId); err != nil {
+		return nil, err
+	}
+
+	if err := m.checkSupersede(evt); err != nil {
+		return nil, err
+	}
+
+	if err := m.checkReaction(evt); err != nil {
+		return nil, err
+	}
+
+	m.indexMessage(evt, uint64(e.GetClock().GetTime()))
+	m.recordReaction(evt, uint64(e.GetClock().GetTime()))
+
+	return evt, nil
+}
+
+// checkThreadID checks that the message starting a thread is known, the
+// messages of a thread are always written after it so it is replicated before
+// them. A pruned or expired message may have been removed from the log by a
+// compaction, its thread is still valid.
+func (m *MessageStore) checkThreadID(threadID []byte) error {
+	if len(threadID) == 0 {
+		return nil
+	}
+
+	id, err := cid.Cast(threadID)
+	if err != nil {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if _, ok := m.OpLog().Get(id); ok || m.isPruned(id) || m.isCompacted(id) {
+		return nil
+	}
+
+	return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown thread message"))
+}
+
+func (m *MessageStore) isCompacted(id cid.Cid) bool {
+	return m.compacted != nil && m.compacted(id)
+}
+
+// checkAccess consults the access controller of the group once the signature
+// of the message has been verified, a refused message stays in the log
+func (m *MessageStore) checkAccess(ctx context.Context, entry ipfslog.Entry, evt *protocoltypes.GroupMessageEvent) error {
+	if m.access == nil {
+		return nil
+	}
+
+	accessEntry := &GroupAccessEntry{
+		Group:    m.group,
+		Entry:    entry,
+		DevicePK: evt.Headers.DevicePk,
+		Message:  evt,
+	}
+
+	if err := m.access(ctx, accessEntry); err != nil {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(err)
+	}
+
+	return nil
+}
+
+func (m *MessageStore) setPublishChecker(canPublish func(devicePK []byte, at time.Time) bool) {
+	m.muCanPublish.Lock()
+	m.canPublish = canPublish
+	m.muCanPublish.Unlock()
+}
+
+func (m *MessageStore) isPublisher(devicePK []byte) bool {
+	return m.isPublisherAt(devicePK, time.Now())
+}
+
+// isPublisherAt returns true if the device was allowed to send messages at
+// the given time
+func (m *MessageStore) isPublisherAt(devicePK []byte, at time.Time) bool {
+	m.muCanPublish.RLock()
+	canPublish := m.canPublish
+	m.muCanPublish.RUnlock()
+
+	return canPublish == nil || canPublish(devicePK, at)
+}
+
+func (m *MessageStore) setDeviceMatcher(sameDevice func(previousPK, devicePK []byte) bool) {
+	m.muSameDevice.Lock()
+	m.sameDevice = sameDevice
+	m.muSameDevice.Unlock()
+}
+
+// isSameDevice returns true if devicePK is previousPK or has replaced it
+// through key rotations
+func (m *MessageStore) isSameDevice(previousPK, devicePK []byte) bool {
+	if bytes.Equal(previousPK, devicePK) {
+		return true
+	}
+
+	m.muSameDevice.RLock()
+	sameDevice := m.sameDevice
+	m.muSameDevice.RUnlock()
+
+	return sameDevice != nil && sameDevice(previousPK, devicePK)
+}
+
+func (m *MessageStore) setPrunedSenderGetter(prunedSender func(id cid.Cid) []byte) {
+	m.muPrunedSender.Lock()
+	m.prunedSender = prunedSender
+	m.muPrunedSender.Unlock()
+}
+
+// getPrunedSender returns the device which sent a pruned message, nil if it
+// hasn't been recorded
+func (m *MessageStore) getPrunedSender(id cid.Cid) []byte {
+	m.muPrunedSender.RLock()
+	prunedSender := m.prunedSender
+	m.muPrunedSender.RUnlock()
+
+	if prunedSender == nil {
+		return nil
+	}
+
+	return prunedSender(id)
+}
+
+func (m *MessageStore) setPrunedChecker(pruned func(id cid.Cid) bool) {
+	m.muPruned.Lock()
+	m.pruned = pruned
+	m.muPruned.Unlock()
+}
+
+func (m *MessageStore) setBlockedChecker(blocked func(devicePK []byte) bool) {
+	m.muBlocked.Lock()
+	m.blocked = blocked
+	m.muBlocked.Unlock()
+}
+
+func (m *MessageStore) setDeviceSeenRecorder(deviceSeen func(devicePK []byte, sentAt int64)) {
+	m.muDeviceSeen.Lock()
+	m.deviceSeen = deviceSeen
+	m.muDeviceSeen.Unlock()
+}
+
+func (m *MessageStore) recordDeviceSeen(devicePK []byte, sentAt int64) {
+	m.muDeviceSeen.RLock()
+	deviceSeen := m.deviceSeen
+	m.muDeviceSeen.RUnlock()
+
+	if deviceSeen != nil {
+		deviceSeen(devicePK, sentAt)
+	}
+}
+
+func (m *MessageStore) setAttachmentsRecorder(attachmentsSeen func(id cid.Cid, attachments []*protocoltypes.AttachmentSecret)) {
+	m.muAttachmentsSeen.Lock()
+	m.attachmentsSeen = attachmentsSeen
+	m.muAttachmentsSeen.Unlock()
+}
+
+func (m *MessageStore) recordAttachments(id cid.Cid, attachments []*protocoltypes.AttachmentSecret) {
+	if len(attachments) == 0 {
+		return
+	}
+
+	m.muAttachmentsSeen.RLock()
+	attachmentsSeen := m.attachmentsSeen
+	m.muAttachmentsSeen.RUnlock()
+
+	if attachmentsSeen != nil {
+		attachmentsSeen(id, attachments)
+	}
+}
+
+func (m *MessageStore) setMessageIndexer(indexer func(evt *protocoltypes.GroupMessageEvent, clock uint64)) {
+	m.muIndexer.Lock()
+	m.indexer = indexer
+	m.muIndexer.Unlock()
+}
+
+func (m *MessageStore) indexMessage(evt *protocoltypes.GroupMessageEvent, clock uint64) {
+	m.muIndexer.RLock()
+	indexer := m.indexer
+	m.muIndexer.RUnlock()
+
+	if indexer != nil {
+		indexer(evt, clock)
+	}
+}
+
+func (m *MessageStore) setReactionRecorder(reactionSeen func(evt *protocoltypes.GroupMessageEvent, clock uint64)) {
+	m.muReactionSeen.Lock()
+	m.reactionSeen = reactionSeen
+	m.muReactionSeen.Unlock()
+}
+
+func (m *MessageStore) recordReaction(evt *protocoltypes.GroupMessageEvent, clock uint64) {
+	if evt.Reaction == nil && !evt.Retract {
+		return
+	}
+
+	m.muReactionSeen.RLock()
+	reactionSeen := m.reactionSeen
+	m.muReactionSeen.RUnlock()
+
+	if reactionSeen != nil {
+		reactionSeen(evt, clock)
+	}
+}
+
+func (m *MessageStore) setExpiryRecorder(expirySeen func(id cid.Cid, evt *protocoltypes.GroupMessageEvent)) {
+	m.muExpirySeen.Lock()
+	m.expirySeen = expirySeen
+	m.muExpirySeen.Unlock()
+}
+
+func (m *MessageStore) recordExpiry(id cid.Cid, evt *protocoltypes.GroupMessageEvent) {
+	if evt.ExpireAfter <= 0 && len(evt.Supersedes) == 0 {
+		return
+	}
+
+	m.muExpirySeen.RLock()
+	expirySeen := m.expirySeen
+	m.muExpirySeen.RUnlock()
+
+	if expirySeen != nil {
+		expirySeen(id, evt)
+	}
+}
+
+func (m *MessageStore) setExpiredChecker(expired func(id cid.Cid) bool) {
+	m.muExpired.Lock()
+	m.expired = expired
+	m.muExpired.Unlock()
+}
+
+func (m *MessageStore) isExpired(id cid.Cid) bool {
+	m.muExpired.RLock()
+	expired := m.expired
+	m.muExpired.RUnlock()
+
+	return expired != nil && expired(id)
+}
+
+func (m *MessageStore) setSeenAtRecorder(seenAt func(id cid.Cid) time.Time) {
+	m.muSeenAt.Lock()
+	m.seenAt = seenAt
+	m.muSeenAt.Unlock()
+}
+
+// firstSeen returns the time at which the message has been received for the
+// first time, now if it isn't recorded
+func (m *MessageStore) firstSeen(id cid.Cid) time.Time {
+	m.muSeenAt.RLock()
+	seenAt := m.seenAt
+	m.muSeenAt.RUnlock()
+
+	if seenAt == nil {
+		return time.Now()
+	}
+
+	return seenAt(id)
+}
+
+func (m *MessageStore) isBlocked(devicePK []byte) bool {
+	m.muBlocked.RLock()
+	blocked := m.blocked
+	m.muBlocked.RUnlock()
+
+	return blocked != nil && blocked(devicePK)
+}
+
+func (m *MessageStore) isPruned(id cid.Cid) bool {
+	m.muPruned.RLock()
+	pruned := m.pruned
+	m.muPruned.RUnlock()
+
+	return pruned != nil && pruned(id)
 }
 
 type groupCache struct {
@@ -147,12 +516,36 @@ func (m *MessageStore) processMessage(ctx context.Context, message *messageItem)
 	}
 
 	entry := message.op.GetEntry()
+	attachments := msg.GetProtocolMetadata().GetAttachments()
+
+	attachmentCIDs := make([][]byte, len(attachments))
+	for i, attachment := range attachments {
+		attachmentCIDs[i] = attachment.Cid
+	}
+
 	eventContext := newEventContext(entry.GetHash(), entry.GetNext(), m.group)
-	return &protocoltypes.GroupMessageEvent{
-		EventContext: eventContext,
-		Headers:      message.headers,
-		Message:      msg.GetPlaintext(),
-	}, nil
+	evt := &protocoltypes.GroupMessageEvent{
+		EventContext:    eventContext,
+		Headers:         message.headers,
+		Message:         msg.GetPlaintext(),
+		ThreadId:        msg.GetProtocolMetadata().GetThreadId(),
+		AttachmentCids:  attachmentCIDs,
+		Supersedes:      msg.GetProtocolMetadata().GetSupersedes(),
+		Retract:         msg.GetProtocolMetadata().GetRetract(),
+		Reaction:        msg.GetProtocolMetadata().GetReaction(),
+		ExpireAfter:     msg.GetProtocolMetadata().GetExpireAfter(),
+		ExpireAfterRead: msg.GetProtocolMetadata().GetExpireAfterRead(),
+	}
+
+	if err := m.checkAccess(ctx, entry, evt); err != nil {
+		return nil, err
+	}
+
+	m.recordDeviceSeen(message.headers.DevicePk, msg.GetProtocolMetadata().GetSentAt())
+	m.recordAttachments(entry.GetHash(), attachments)
+	m.recordExpiry(entry.GetHash(), evt)
+
+	return evt, nil
 }
 
 func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMetricsTracer) {
@@ -176,9 +569,25 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 			continue
 		}
 
+		// in broadcast mode, messages from other devices are dropped, as the
+		// messages received from a retired key after its grace period
+		if !m.isPublisherAt(message.headers.DevicePk, m.firstSeen(message.hash)) {
+			m.logger.Warn("dropping message from a device not allowed to send messages", logutil.PrivateBinary("devicepk", message.headers.DevicePk))
+			continue
+		}
+
+		if m.isBlocked(message.headers.DevicePk) {
+			m.logger.Debug("dropping message from a blocked contact", logutil.PrivateBinary("devicepk", message.headers.DevicePk))
+			continue
+		}
+
 		// actually process the message
 		evt, err := m.processMessage(ctx, message)
-		if err != nil {
+		if errcode.Is(err, errcode.ErrCode_ErrGroupPermissionDenied) {
+			m.logger.Warn("dropping message refused by the access controller of the group", logutil.PrivateBinary("devicepk", message.headers.DevicePk), zap.Error(err))
+			m.processDeviceMessagesInQueue(device)
+			continue
+		} else if err != nil {
 			m.logger.Error("unable to process message", zap.Error(err))
 
 			// if we got any error here, put (back) the message into the device queue
@@ -191,6 +600,28 @@ func (m *MessageStore) processMessageLoop(ctx context.Context, tracer *messageMe
 		// if we get here we probably can process other messages (if any) in the device queue
 		m.processDeviceMessagesInQueue(device)
 
+		// messages replying to an unknown thread are dropped
+		if err := m.checkThreadID(evt.ThreadId); err != nil {
+			m.logger.Warn("dropping message replying to an invalid thread", logutil.PrivateBinary("devicepk", message.headers.DevicePk), zap.Error(err))
+			continue
+		}
+
+		// edits and retractions of messages sent by another device are dropped
+		if err := m.checkSupersede(evt); err != nil {
+			m.logger.Warn("dropping invalid message edit", logutil.PrivateBinary("devicepk", message.headers.DevicePk), zap.Error(err))
+			continue
+		}
+
+		// reactions to unknown messages are dropped
+		if err := m.checkReaction(evt); err != nil {
+			m.logger.Warn("dropping invalid message reaction", logutil.PrivateBinary("devicepk", message.headers.DevicePk), zap.Error(err))
+			continue
+		}
+
+		clock := uint64(message.op.GetEntry().GetClock().GetTime())
+		m.indexMessage(evt, clock)
+		m.recordReaction(evt, clock)
+
 		// emit new message event
 		if err := m.emitters.groupMessage.Emit(evt); err != nil {
 			m.logger.Warn("unable to emit group message event", zap.Error(err))
@@ -262,35 +693,93 @@ func (m *MessageStore) addToMessageQueue(_ context.Context, e ipfslog.Entry) err
 
 // FIXME: use iterator instead to reduce resource usage (require go-ipfs-log improvements)
 func (m *MessageStore) ListEvents(ctx context.Context, since, until []byte, reverse bool) (<-chan *protocoltypes.GroupMessageEvent, error) {
-	entries, err := getEntriesInRange(m.OpLog().GetEntries().Reverse().Slice(), since, until)
+	return m.listEvents(ctx, &listEventsOptions{since: since, until: until, reverse: reverse})
+}
+
+// listEventsOptions selects the messages listed by listEvents
+type listEventsOptions struct {
+	since, until []byte
+
+	// exclusive excludes the since and until messages from the list, so the
+	// last message of a page can be used as the cursor of the next one
+	exclusive bool
+
+	reverse bool
+
+	// limit is the maximum number of listed messages, 0 for no limit
+	limit uint32
+
+	// filter returns false for the messages to skip, it can be nil
+	filter func(evt *protocoltypes.GroupMessageEvent) bool
+}
+
+func (m *MessageStore) listEvents(ctx context.Context, opts *listEventsOptions) (<-chan *protocoltypes.GroupMessageEvent, error) {
+	entries, err := getEntriesInRange(m.OpLog().GetEntries().Reverse().Slice(), opts.since, opts.until)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.exclusive {
+		entries = excludeRangeBounds(entries, opts.since, opts.until)
+	}
+
 	out := make(chan *protocoltypes.GroupMessageEvent)
 
 	go func() {
-		iterateOverEntries(
-			entries,
-			reverse,
-			func(entry ipliface.IPFSLogEntry) {
-				message, err := m.openMessage(ctx, entry)
-				if err != nil {
-					m.logger.Error("unable to open message", zap.Error(err))
-				} else {
-					out <- message
-					m.logger.Info("message store - sent 1 event from log history")
-				}
-			},
-		)
+		defer close(out)
+
+		count := uint32(0)
+		for i := range entries {
+			entry := entries[i]
+			if opts.reverse {
+				entry = entries[len(entries)-1-i]
+			}
+
+			var (
+				message *protocoltypes.GroupMessageEvent
+				err     error
+			)
+
+			switch {
+			case !m.isPruned(entry.GetHash()):
+				message, err = m.openMessage(ctx, entry)
+			case m.isExpired(entry.GetHash()):
+				message, err = m.expiredMessage(entry)
+			default:
+				continue
+			}
+			if err != nil {
+				m.logger.Error("unable to open message", zap.Error(err))
+				continue
+			}
+
+			if opts.filter != nil && !opts.filter(message) {
+				continue
+			}
+
+			select {
+			case out <- message:
+			case <-ctx.Done():
+				return
+			}
 
-		close(out)
+			m.logger.Info("message store - sent 1 event from log history")
+
+			count++
+			if opts.limit > 0 && count >= opts.limit {
+				return
+			}
+		}
 	}()
 
 	return out, nil
 }
 
 func (m *MessageStore) AddMessage(ctx context.Context, payload []byte) (operation.Operation, error) {
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
 	ctx, newTrace := tyber.ContextWithTraceID(ctx)
 
 	if newTrace {
@@ -307,13 +796,78 @@ func (m *MessageStore) AddMessage(ctx context.Context, payload []byte) (operatio
 		)...,
 	)
 
-	return messageStoreAddMessage(ctx, m.group, m, payload)
+	return messageStoreAddMessage(ctx, m.group, m, payload, nil)
+}
+
+// AddMessageWithAttachments adds a message carrying the keys of its
+// attachments, threadID is optional
+func (m *MessageStore) AddMessageWithAttachments(ctx context.Context, payload []byte, threadID []byte, attachments []*protocoltypes.AttachmentSecret) (operation.Operation, error) {
+	if err := m.checkThreadID(threadID); err != nil {
+		return nil, err
+	}
+
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{
+		ThreadId:    threadID,
+		Attachments: attachments,
+	})
+}
+
+// AddExpiringMessage adds a message deleted by the devices once expireAfter
+// has elapsed since they received it, or since it has been read if afterRead
+// is true, threadID and attachments are optional
+func (m *MessageStore) AddExpiringMessage(ctx context.Context, payload []byte, threadID []byte, attachments []*protocoltypes.AttachmentSecret, expireAfter time.Duration, afterRead bool) (operation.Operation, error) {
+	if expireAfter < time.Second {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the expiry must be at least one second"))
+	}
+
+	if err := m.checkThreadID(threadID); err != nil {
+		return nil, err
+	}
+
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{
+		ThreadId:        threadID,
+		Attachments:     attachments,
+		ExpireAfter:     int64(expireAfter / time.Second),
+		ExpireAfterRead: afterRead,
+	})
 }
 
-func messageStoreAddMessage(ctx context.Context, g *protocoltypes.Group, m *MessageStore, payload []byte) (operation.Operation, error) {
+// AddThreadMessage adds a message replying to the thread started by the
+// message threadID
+func (m *MessageStore) AddThreadMessage(ctx context.Context, threadID []byte, payload []byte) (operation.Operation, error) {
+	if len(threadID) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing thread id"))
+	}
+
+	if err := m.checkThreadID(threadID); err != nil {
+		return nil, err
+	}
+
+	if !m.isPublisher(m.currentDevicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only moderators and admins can send messages in broadcast mode"))
+	}
+
+	return messageStoreAddMessage(ctx, m.group, m, payload, &protocoltypes.ProtocolMetadata{ThreadId: threadID})
+}
+
+func messageStoreAddMessage(ctx context.Context, g *protocoltypes.Group, m *MessageStore, payload []byte, metadata *protocoltypes.ProtocolMetadata) (operation.Operation, error) {
+	if metadata == nil {
+		metadata = &protocoltypes.ProtocolMetadata{}
+	}
+
+	metadata.SentAt = time.Now().Unix()
+
 	msg := &protocoltypes.EncryptedMessage{
 		Plaintext:        payload,
-		ProtocolMetadata: &protocoltypes.ProtocolMetadata{},
+		ProtocolMetadata: metadata,
 	}
 	msgBytes, err := proto.Marshal(msg)
 	if err != nil {
@@ -386,6 +940,10 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 			groupPublicKey: groupPublicKey,
 			logger:         logger,
 			deviceCaches:   make(map[string]*groupCache),
+			compacted: func(id cid.Cid) bool {
+				return s.logCompaction.isCompacted(context.Background(), addr.String(), id)
+			},
+			access: s.messageAccess(g.GroupIDAsString()),
 		}
 
 		if s.replicationMode {
@@ -428,7 +986,7 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 
 		options.Index = basestore.NewNoopIndex
 
-		if err := store.InitBaseStore(ipfs, identity, addr, options); err != nil {
+		if err := store.InitBaseStore(s.logCompaction.wrapCoreAPI(ipfs, addr.String()), identity, addr, options); err != nil {
 			store.cancel()
 			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
 		}
@@ -465,6 +1023,11 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 					entries = evt.Entries
 				}
 
+				if len(entries) > 0 {
+					atomic.StoreInt64(&store.lastActivity, time.Now().UnixMilli())
+					s.syncState.changed()
+				}
+
 				for _, entry := range entries {
 					ctx = tyber.ContextWithConstantTraceID(ctx, "msgrcvd-"+entry.GetHash().String())
 					store.logger.Debug("Received message store event", tyber.FormatTraceLogFields(ctx)...)
@@ -484,6 +1047,12 @@ func constructorFactoryGroupMessage(s *WeshOrbitDB, logger *zap.Logger) iface.St
 	}
 }
 
+// LastActivity returns the unix timestamp in milliseconds of the last entry
+// written to or replicated into the store, 0 if none since it has been opened
+func (m *MessageStore) LastActivity() int64 {
+	return atomic.LoadInt64(&m.lastActivity)
+}
+
 func (m *MessageStore) GetMessageByCID(c cid.Cid) (operation.Operation, error) {
 	logEntry, ok := m.OpLog().Get(c)
 	if !ok {
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -218,3 +219,112 @@ func Test_Add_Messages_To_Cache(t *testing.T) {
 	require.True(t, ok)
 	require.Equal(t, 0, size)
 }
+
+func Test_AddThreadMessage(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/message_test", 1, 1)
+	defer cleanup()
+
+	ms := peers[0].GC.MessageStore()
+
+	root, err := ms.AddMessage(ctx, []byte("root message"))
+	require.NoError(t, err)
+	threadID := root.GetEntry().GetHash().Bytes()
+
+	_, err = ms.AddThreadMessage(ctx, threadID, []byte("reply"))
+	require.NoError(t, err)
+
+	// the message starting the thread must be known
+	unknown, err := cid.Parse("QmNR2n4zywCV61MeMLB6JwPueAPqheqpfiA4fLPMxouEmQ")
+	require.NoError(t, err)
+
+	_, err = ms.AddThreadMessage(ctx, unknown.Bytes(), []byte("reply"))
+	require.Error(t, err)
+
+	_, err = ms.AddThreadMessage(ctx, []byte("invalid"), []byte("reply"))
+	require.Error(t, err)
+
+	out, err := ms.ListEvents(ctx, nil, nil, false)
+	require.NoError(t, err)
+
+	threads := map[string][]byte{}
+	for evt := range out {
+		threads[string(evt.Message)] = evt.ThreadId
+	}
+
+	require.Len(t, threads, 2)
+	require.Empty(t, threads["root message"])
+	require.Equal(t, threadID, threads["reply"])
+}
+
+func Test_BlockedDeviceMessages(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/message_test", 1, 1)
+	defer cleanup()
+
+	ms := peers[0].GC.MessageStore()
+
+	_, err := ms.AddMessage(ctx, []byte("test message"))
+	require.NoError(t, err)
+
+	out, err := ms.ListEvents(ctx, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, countEntries(out))
+
+	// messages sent by a blocked device are dropped
+	ms.setBlockedChecker(func([]byte) bool { return true })
+
+	out, err = ms.ListEvents(ctx, nil, nil, false)
+	require.NoError(t, err)
+	require.Equal(t, 0, countEntries(out))
+}
+
+func Test_MessagePagination(t *testing.T) {
+	testutil.FilterSpeed(t, testutil.Fast)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peers, _, cleanup := CreatePeersWithGroupTest(ctx, t, "/tmp/message_test", 1, 1)
+	defer cleanup()
+
+	ms := peers[0].GC.MessageStore()
+
+	ids := make([][]byte, 5)
+	for i := range ids {
+		op, err := ms.AddMessage(ctx, []byte(fmt.Sprintf("message %d", i)))
+		require.NoError(t, err)
+		ids[i] = op.GetEntry().GetHash().Bytes()
+	}
+
+	list := func(opts *listEventsOptions) []string {
+		out, err := ms.listEvents(ctx, opts)
+		require.NoError(t, err)
+
+		messages := []string(nil)
+		for evt := range out {
+			messages = append(messages, string(evt.Message))
+		}
+
+		return messages
+	}
+
+	// the newest messages are loaded first
+	require.Equal(t, []string{"message 4", "message 3"}, list(&listEventsOptions{reverse: true, limit: 2}))
+
+	// then the previous page, using the last message as the cursor
+	require.Equal(t, []string{"message 2", "message 1"}, list(&listEventsOptions{until: ids[3], exclusive: true, reverse: true, limit: 2}))
+	require.Equal(t, []string{"message 0"}, list(&listEventsOptions{until: ids[1], exclusive: true, reverse: true, limit: 2}))
+
+	// the bounds are included by default
+	require.Equal(t, []string{"message 1", "message 2"}, list(&listEventsOptions{since: ids[1], limit: 2}))
+	require.Equal(t, []string{"message 2", "message 3"}, list(&listEventsOptions{since: ids[1], exclusive: true, limit: 2}))
+}
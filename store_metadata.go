@@ -1,17 +1,26 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
 	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	coreiface "github.com/ipfs/kubo/core/coreiface"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	mh "github.com/multiformats/go-multihash"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 
@@ -25,10 +34,29 @@ import (
 	"berty.tech/go-orbit-db/stores/operation"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/ratchettree"
 	"berty.tech/weshnet/v2/pkg/secretstore"
 	"berty.tech/weshnet/v2/pkg/tyber"
 )
 
+// maxContactMetadataSize is the maximum size of the private metadata attached
+// to a contact
+const maxContactMetadataSize = 4 * 1024
+
+// maxDeviceNameLength is the maximum length of the name and the platform of a
+// device
+const maxDeviceNameLength = 128
+
+const (
+	// maxAccountSettingKeyLength is the maximum length of the name of an
+	// account setting
+	maxAccountSettingKeyLength = 256
+
+	// maxAccountSettingValueSize is the maximum size of the value of an
+	// account setting
+	maxAccountSettingValueSize = 64 * 1024
+)
+
 type MetadataStore struct {
 	basestore.BaseStore
 	eventBus event.Bus
@@ -43,6 +71,29 @@ type MetadataStore struct {
 	secretStore        secretstore.SecretStore
 	logger             *zap.Logger
 
+	// lastActivity is the unix timestamp in milliseconds of the last entry
+	// written or replicated since the store has been opened
+	lastActivity int64
+
+	// deviceSeen records the device of each received entry, it is set by
+	// the service
+	deviceSeen   func(devicePK []byte, sentAt int64)
+	muDeviceSeen sync.RWMutex
+
+	// pendingEntries are the entries sealed with a metadata key which isn't
+	// known yet, they are opened once the chain key of their device is
+	// registered
+	pendingEntries   map[string]ipfslog.Entry
+	muPendingEntries sync.Mutex
+
+	// muEpoch serializes the commits of the epoch tree and the chain keys
+	// sent to its devices
+	muEpoch sync.Mutex
+
+	// muContactRequestNonce serializes the check and the consumption of the
+	// nonces of the contact request links
+	muContactRequestNonce sync.Mutex
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -82,13 +133,13 @@ func (m *MetadataStore) setLogger(l *zap.Logger) {
 	}
 }
 
-func openMetadataEntry(log ipfslog.Log, e ipfslog.Entry, g *protocoltypes.Group) (*protocoltypes.GroupMetadataEvent, proto.Message, error) {
+func openMetadataEntry(ctx context.Context, log ipfslog.Log, e ipfslog.Entry, g *protocoltypes.Group, secretStore secretstore.SecretStore) (*protocoltypes.GroupMetadataEvent, proto.Message, error) {
 	op, err := operation.ParseOperation(e)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	meta, event, err := openGroupEnvelope(g, op.GetValue())
+	meta, event, err := openGroupEnvelope(ctx, g, secretStore, op.GetValue())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -107,7 +158,7 @@ func openMetadataEntry(log ipfslog.Log, e ipfslog.Entry, g *protocoltypes.Group)
 // }
 
 // FIXME: use iterator instead to reduce resource usage (require go-ipfs-log improvements)
-func (m *MetadataStore) ListEvents(_ context.Context, since, until []byte, reverse bool) (<-chan *protocoltypes.GroupMetadataEvent, error) {
+func (m *MetadataStore) ListEvents(ctx context.Context, since, until []byte, reverse bool) (<-chan *protocoltypes.GroupMetadataEvent, error) {
 	entries, err := getEntriesInRange(m.OpLog().GetEntries().Reverse().Slice(), since, until)
 	if err != nil {
 		return nil, err
@@ -120,9 +171,11 @@ func (m *MetadataStore) ListEvents(_ context.Context, since, until []byte, rever
 			entries,
 			reverse,
 			func(entry ipliface.IPFSLogEntry) {
-				event, _, err := openMetadataEntry(m.OpLog(), entry, m.group)
+				event, payload, err := openMetadataEntry(ctx, m.OpLog(), entry, m.group, m.secretStore)
 				if err != nil {
 					m.logger.Error("unable to open metadata event", zap.Error(err))
+				} else if err := m.checkEventSender(event, payload); err != nil {
+					m.logger.Warn("ignoring metadata event", zap.Error(err))
 				} else {
 					out <- event
 					m.logger.Info("metadata store - sent 1 event from log history")
@@ -161,15 +214,24 @@ func MetadataStoreAddDeviceToGroup(ctx context.Context, m *MetadataStore, g *pro
 		return nil, nil
 	}
 
+	// the members reject the join once the invitation has expired, unless
+	// another device of the member has already joined
+	now := time.Now()
+	if devices, _ := m.GetDevicesForMember(md.Member()); len(devices) == 0 && isGroupInvitationExpired(g.GetInvitation(), now) {
+		return nil, errcode.ErrCode_ErrGroupInvitationExpired
+	}
+
 	memberSig, err := md.MemberSign(device)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
 	}
 
 	event := &protocoltypes.GroupMemberDeviceAdded{
-		MemberPk:  member,
-		DevicePk:  device,
-		MemberSig: memberSig,
+		MemberPk:   member,
+		DevicePk:   device,
+		MemberSig:  memberSig,
+		Invitation: g.GetInvitation(),
+		JoinedAt:   now.Unix(),
 	}
 
 	sig, err := signProtoWithDevice(event, md)
@@ -183,7 +245,38 @@ func MetadataStoreAddDeviceToGroup(ctx context.Context, m *MetadataStore, g *pro
 }
 
 func (m *MetadataStore) SendSecret(ctx context.Context, memberPK crypto.PubKey) (operation.Operation, error) {
-	ok, err := m.Index().(*metadataStoreIndex).areSecretsAlreadySent(memberPK)
+	idx := m.Index().(*metadataStoreIndex)
+
+	removed, err := idx.isMemberRemoved(memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if removed {
+		return nil, errcode.ErrCode_ErrGroupMemberRemoved
+	}
+
+	banned, err := idx.isMemberBanned(memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if banned {
+		return nil, errcode.ErrCode_ErrGroupMemberBanned
+	}
+
+	pending, err := idx.isMemberPending(memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if pending {
+		return nil, errcode.ErrCode_ErrGroupMemberPendingApproval
+	}
+
+	epoch := idx.getChainKeyEpoch()
+
+	ok, err := idx.areSecretsAlreadySent(memberPK, epoch)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
@@ -196,15 +289,76 @@ func (m *MetadataStore) SendSecret(ctx context.Context, memberPK crypto.PubKey)
 		m.logger.Warn("sending secret to an unknown group member")
 	}
 
+	// the devices of the epoch tree get the chain key encrypted with the
+	// epoch secret
+	if m.isMemberInEpoch(memberPK) {
+		if _, err := m.sendEpochChainKey(ctx); err != nil {
+			return nil, err
+		}
+
+		return nil, errcode.ErrCode_ErrGroupSecretAlreadySentToMember
+	}
+
+	// A member has been removed since the chain key has been created, a new
+	// one unknown to the removed member is sent instead
+	if epoch > 0 {
+		if _, err := m.secretStore.RotateChainKey(ctx, m.group, epoch); err != nil {
+			return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		}
+	}
+
+	// a revoked device still knows the member keys, the chain key is sent to
+	// each of the remaining devices instead
+	if devices, revoked := idx.getActiveDevicesOfRevokedMember(memberPK); revoked {
+		return m.sendSecretToDevices(ctx, memberPK, devices, epoch)
+	}
+
 	encryptedSecret, err := m.secretStore.GetShareableChainKey(ctx, m.group, memberPK)
 	if err != nil {
 		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
 	}
 
-	return MetadataStoreSendSecret(ctx, m, m.group, m.memberDevice, memberPK, encryptedSecret)
+	return metadataStoreSendSecret(ctx, m, m.group, m.memberDevice, memberPK, nil, encryptedSecret, epoch)
+}
+
+// sendSecretToDevices sends the current chain key to each of the given
+// devices of a member which haven't received it yet
+func (m *MetadataStore) sendSecretToDevices(ctx context.Context, memberPK crypto.PubKey, devices []crypto.PubKey, epoch uint64) (operation.Operation, error) {
+	idx := m.Index().(*metadataStoreIndex)
+
+	var op operation.Operation
+	for _, devicePK := range devices {
+		if devicePK.Equals(m.memberDevice.Device()) {
+			continue
+		}
+
+		if ok, err := idx.areSecretsAlreadySent(devicePK, epoch); err != nil || ok {
+			continue
+		}
+
+		encryptedSecret, err := m.secretStore.GetShareableChainKey(ctx, m.group, devicePK)
+		if err != nil {
+			return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+		}
+
+		op, err = metadataStoreSendSecret(ctx, m, m.group, m.memberDevice, memberPK, devicePK, encryptedSecret, epoch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if op == nil {
+		return nil, errcode.ErrCode_ErrGroupSecretAlreadySentToMember
+	}
+
+	return op, nil
 }
 
 func MetadataStoreSendSecret(ctx context.Context, m *MetadataStore, g *protocoltypes.Group, md secretstore.OwnMemberDevice, memberPK crypto.PubKey, encryptedSecret []byte) (operation.Operation, error) {
+	return metadataStoreSendSecret(ctx, m, g, md, memberPK, nil, encryptedSecret, 0)
+}
+
+func metadataStoreSendSecret(ctx context.Context, m *MetadataStore, g *protocoltypes.Group, md secretstore.OwnMemberDevice, memberPK, destDevicePK crypto.PubKey, encryptedSecret []byte, epoch uint64) (operation.Operation, error) {
 	devicePKRaw, err := md.Device().Raw()
 	if err != nil {
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
@@ -219,6 +373,13 @@ func MetadataStoreSendSecret(ctx context.Context, m *MetadataStore, g *protocolt
 		DevicePk:     devicePKRaw,
 		DestMemberPk: memberPKRaw,
 		Payload:      encryptedSecret,
+		Epoch:        epoch,
+	}
+
+	if destDevicePK != nil {
+		if event.DestDevicePk, err = destDevicePK.Raw(); err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
 	}
 
 	sig, err := signProtoWithDevice(event, md)
@@ -246,491 +407,2165 @@ func (m *MetadataStore) ClaimGroupOwnership(ctx context.Context, groupSK crypto.
 	return metadataStoreAddEvent(ctx, m, m.group, protocoltypes.EventType_EventTypeMultiMemberGroupInitialMemberAnnounced, event, sig)
 }
 
-func signProtoWithDevice(message proto.Message, memberDevice secretstore.OwnMemberDevice) ([]byte, error) {
-	data, err := proto.Marshal(message)
-	if err != nil {
-		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+// RemoveMember evicts a member from a multi-member group, the current device
+// must be an admin of the group. Once the event is received, other members
+// send a new chain key to the remaining members.
+func (m *MetadataStore) RemoveMember(ctx context.Context, memberPK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	sig, err := memberDevice.DeviceSign(data)
-	if err != nil {
-		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	if memberPK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
 	}
 
-	return sig, nil
-}
+	if memberPK.Equals(m.memberDevice.Member()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("can't remove own member from group"))
+	}
 
-func signProtoWithPrivateKey(message proto.Message, sk crypto.PrivKey) ([]byte, error) {
-	data, err := proto.Marshal(message)
+	memberPKRaw, err := m.checkModerationTarget(memberPK)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		return nil, err
 	}
 
-	sig, err := sk.Sign(data)
+	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupMemberRemoved{
+		MemberPk: memberPKRaw,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupMemberRemoved)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+		return nil, err
 	}
 
-	return sig, nil
+	m.commitRevokingEpoch(ctx)
+
+	return op, nil
 }
 
-func metadataStoreAddEvent(ctx context.Context, m *MetadataStore, g *protocoltypes.Group, eventType protocoltypes.EventType, event proto.Message, sig []byte) (operation.Operation, error) {
-	ctx, newTrace := tyber.ContextWithTraceID(ctx)
-	tyberLogError := tyber.LogError
-	if newTrace {
-		m.logger.Debug(fmt.Sprintf("Sending %s to %s group %s", strings.TrimPrefix(eventType.String(), "EventType"), strings.TrimPrefix(g.GroupType.String(), "GroupType"), base64.RawURLEncoding.EncodeToString(g.PublicKey)), tyber.FormatTraceLogFields(ctx)...)
-		tyberLogError = tyber.LogFatalError
+// RotateSecret requests every member of a multi-member group to rotate its
+// device chain key, the current device must be an admin of the group.
+func (m *MetadataStore) RotateSecret(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	env, err := sealGroupEnvelope(g, eventType, event, sig)
-	if err != nil {
-		return nil, tyberLogError(ctx, m.logger, "Failed to seal group envelope", errcode.ErrCode_ErrCryptoSignature.Wrap(err))
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can rotate the group secrets"))
 	}
-	m.logger.Debug(fmt.Sprintf("Sealed group envelope (%d bytes)", len(env)), tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
 
-	op := operation.NewOperation(nil, "ADD", env)
-	e, err := m.AddOperation(ctx, op, nil)
+	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupSecretRotated{}, protocoltypes.EventType_EventTypeMultiMemberGroupSecretRotated)
 	if err != nil {
-		return nil, tyberLogError(ctx, m.logger, "Failed to add operation on log", errcode.ErrCode_ErrOrbitDBAppend.Wrap(err))
+		return nil, err
 	}
-	m.logger.Debug("Added operation on log", tyber.FormatStepLogFields(ctx, []tyber.Detail{
-		{Name: "CID", Description: e.GetHash().String()},
-	})...)
 
-	op, err = operation.ParseOperation(e)
-	if err != nil {
-		return nil, tyberLogError(ctx, m.logger, "Failed to parse operation returned by log", errcode.ErrCode_ErrOrbitDBDeserialization.Wrap(err))
-	}
+	m.commitRevokingEpoch(ctx)
 
-	if newTrace {
-		m.logger.Debug("Added metadata on log successfully", tyber.FormatStepLogFields(ctx, []tyber.Detail{}, tyber.EndTrace)...)
-	}
 	return op, nil
 }
 
-func (m *MetadataStore) ListContacts() map[string]*AccountContact {
-	return m.Index().(*metadataStoreIndex).listContacts()
-}
+// BanMember bans a member from a multi-member group, or lifts its ban. Members
+// can be banned before joining the group. The current device must be an admin
+// of the group and the group creator can't be banned.
+func (m *MetadataStore) BanMember(ctx context.Context, memberPK crypto.PubKey, unban bool) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
 
-func (m *MetadataStore) ListVerifiedCredentials() []*protocoltypes.AccountVerifiedCredentialRegistered {
-	return m.Index().(*metadataStoreIndex).listVerifiedCredentials()
-}
+	if memberPK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
 
-func (m *MetadataStore) GetMemberByDevice(pk crypto.PubKey) (crypto.PubKey, error) {
-	return m.Index().(*metadataStoreIndex).getMemberByDevice(pk)
-}
+	if memberPK.Equals(m.memberDevice.Member()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("can't ban own member from group"))
+	}
 
-func (m *MetadataStore) GetDevicesForMember(pk crypto.PubKey) ([]crypto.PubKey, error) {
-	return m.Index().(*metadataStoreIndex).getDevicesForMember(pk)
-}
+	idx := m.Index().(*metadataStoreIndex)
 
-func (m *MetadataStore) ListAdmins() []crypto.PubKey {
-	if m.typeChecker(isContactGroup, isAccountGroup) {
-		return m.ListMembers()
+	if !idx.isAdminDevice(m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can ban members"))
 	}
 
-	return m.Index().(*metadataStoreIndex).listAdmins()
-}
-
-func (m *MetadataStore) GetIncomingContactRequestsStatus() (bool, *protocoltypes.ShareableContact) {
-	if !m.typeChecker(isAccountGroup) {
-		return false, nil
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	enabled := m.Index().(*metadataStoreIndex).contactRequestsEnabled()
-	seed := m.Index().(*metadataStoreIndex).contactRequestsSeed()
+	if idx.isOwner(memberPKRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("group creator can't be banned"))
+	}
 
-	rawMemberDevice, err := m.memberDevice.Member().Raw()
+	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupMemberBanned{
+		MemberPk: memberPKRaw,
+		Unban:    unban,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupMemberBanned)
 	if err != nil {
-		m.logger.Error("unable to serialize member public key", zap.Error(err))
-		return enabled, nil
+		return nil, err
 	}
 
-	contactRef := &protocoltypes.ShareableContact{
-		Pk:                   rawMemberDevice,
-		PublicRendezvousSeed: seed,
-	}
+	m.commitRevokingEpoch(ctx)
 
-	return enabled, contactRef
+	return op, nil
 }
 
-func (m *MetadataStore) ListMembers() []crypto.PubKey {
-	if m.typeChecker(isAccountGroup, isContactGroup, isMultiMemberGroup) {
-		return m.Index().(*metadataStoreIndex).listMembers()
+// ListBannedMembers returns the raw public keys of the banned members
+func (m *MetadataStore) ListBannedMembers() [][]byte {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil
 	}
 
-	return nil
+	return m.Index().(*metadataStoreIndex).listBannedMembers()
 }
 
-func (m *MetadataStore) ListDevices() []crypto.PubKey {
-	return m.Index().(*metadataStoreIndex).listDevices()
+// getMembership returns the current state of the group members
+func (m *MetadataStore) getMembership() *groupMembership {
+	return m.Index().(*metadataStoreIndex).getMembership()
 }
 
-func (m *MetadataStore) ListMultiMemberGroups() []*protocoltypes.Group {
-	if !m.typeChecker(isAccountGroup) {
-		return nil
+// ApproveMember approves the join request of a member waiting for an admin
+// approval, the current device must be an admin of the group.
+func (m *MetadataStore) ApproveMember(ctx context.Context, memberPK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	idx, ok := m.Index().(*metadataStoreIndex)
-	if !ok {
-		return nil
+	if memberPK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
 	}
-	idx.lock.Lock()
-	defer idx.lock.Unlock()
 
-	groups := []*protocoltypes.Group(nil)
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can approve join requests"))
+	}
 
-	for _, g := range idx.groups {
-		if g.state != accountGroupJoinedStateJoined {
-			continue
-		}
+	pending, err := m.Index().(*metadataStoreIndex).isMemberPending(memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
 
-		groups = append(groups, g.group)
+	if !pending {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no pending join request for this member"))
 	}
 
-	return groups
-}
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
 
-func (m *MetadataStore) ListOtherMembersDevices() []crypto.PubKey {
-	return m.Index().(*metadataStoreIndex).listOtherMembersDevices()
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupMemberApproved{
+		MemberPk: memberPKRaw,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupMemberApproved)
 }
 
-func (m *MetadataStore) GetRequestOwnMetadataForContact(pk []byte) ([]byte, error) {
-	idx, ok := m.Index().(*metadataStoreIndex)
-	if !ok {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid index type"))
+// TransferOwnership makes another member the owner of a multi-member group,
+// the current member must own the group and stays an admin of it.
+func (m *MetadataStore) TransferOwnership(ctx context.Context, memberPK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	idx.lock.Lock()
-	defer idx.lock.Unlock()
+	if memberPK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
 
-	meta, ok := idx.contactRequestMetadata[string(pk)]
-	if !ok {
-		return nil, errcode.ErrCode_ErrMissingMapKey.Wrap(fmt.Errorf("no metadata found for specified contact"))
+	if memberPK.Equals(m.memberDevice.Member()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("group is already owned by this member"))
 	}
 
-	return meta, nil
-}
+	idx := m.Index().(*metadataStoreIndex)
 
-func (m *MetadataStore) ListContactsByStatus(states ...protocoltypes.ContactState) []*protocoltypes.ShareableContact {
-	if !m.typeChecker(isAccountGroup) {
-		return nil
+	ownMemberPKRaw, err := m.memberDevice.Member().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	idx, ok := m.Index().(*metadataStoreIndex)
-	if !ok {
-		return nil
+	if !idx.isOwner(ownMemberPKRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the group owner can transfer the ownership"))
 	}
-	idx.lock.Lock()
-	defer idx.lock.Unlock()
 
-	contacts := []*protocoltypes.ShareableContact(nil)
-
-	for _, c := range idx.contacts {
-		hasState := false
-		for _, s := range states {
-			if c.state == s {
-				hasState = true
-				break
-			}
-		}
+	if devs, err := idx.getDevicesForMember(memberPK); err != nil || len(devs) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown group member"))
+	}
 
-		if hasState {
-			contacts = append(contacts, c.contact)
-		}
+	if removed, err := idx.isMemberRemoved(memberPK); err != nil || removed {
+		return nil, errcode.ErrCode_ErrGroupMemberRemoved
 	}
 
-	return contacts
-}
+	if banned, err := idx.isMemberBanned(memberPK); err != nil || banned {
+		return nil, errcode.ErrCode_ErrGroupMemberBanned
+	}
 
-func (m *MetadataStore) GetContactFromGroupPK(groupPK []byte) *protocoltypes.ShareableContact {
-	if !m.typeChecker(isAccountGroup) {
-		return nil
+	if pending, err := idx.isMemberPending(memberPK); err != nil || pending {
+		return nil, errcode.ErrCode_ErrGroupMemberPendingApproval
 	}
 
-	idx, ok := m.Index().(*metadataStoreIndex)
-	if !ok {
-		return nil
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
-	idx.lock.Lock()
-	defer idx.lock.Unlock()
 
-	contact, ok := idx.contactsFromGroupPK[string(groupPK)]
-	if !ok || contact == nil {
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupOwnershipTransferred{
+		MemberPk: memberPKRaw,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupOwnershipTransferred)
+}
+
+// ListJoinRequests returns the members waiting for an admin approval
+func (m *MetadataStore) ListJoinRequests() []*protocoltypes.GroupJoinRequestList_Reply {
+	if !m.typeChecker(isMultiMemberGroup) {
 		return nil
 	}
 
-	return contact.contact
+	return m.Index().(*metadataStoreIndex).listJoinRequests()
 }
 
-func (m *MetadataStore) checkIfInGroup(pk []byte) bool {
-	idx, ok := m.Index().(*metadataStoreIndex)
+// SetBroadcastMode enables or disables the broadcast mode of a multi-member
+// group, the current device must be an admin of the group.
+func (m *MetadataStore) SetBroadcastMode(ctx context.Context, enabled bool) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can change the broadcast mode"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupBroadcastModeSet{
+		Enabled: enabled,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupBroadcastModeSet)
+}
+
+// SetPublicMode publishes the descriptor of a multi-member group, or withdraws
+// it when descriptor is nil. A new invitation is created for the users finding
+// the group, the invitation of the previous descriptor is revoked. The current
+// device must be an admin of the group.
+func (m *MetadataStore) SetPublicMode(ctx context.Context, descriptor *protocoltypes.GroupPublicDescriptor, approvalRequired bool) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can change the public mode"))
+	}
+
+	// the new mode is built before the previous invitation is revoked, so
+	// an invalid descriptor leaves the group as it was
+	mode := &protocoltypes.MultiMemberGroupPublicModeSet{}
+	if descriptor != nil {
+		if descriptor.Name == "" {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("a public group must have a name"))
+		}
+
+		topic := descriptor.Topic
+		if topic == "" {
+			topic = DefaultGroupDirectoryTopic
+		}
+
+		token, err := newGroupInvitationToken(m.group, m.memberDevice, 0, approvalRequired)
+		if err != nil {
+			return nil, err
+		}
+
+		mode = &protocoltypes.MultiMemberGroupPublicModeSet{
+			Enabled:     true,
+			Name:        descriptor.Name,
+			Description: descriptor.Description,
+			JoinHint:    descriptor.JoinHint,
+			Topic:       topic,
+			Invitation:  token,
+		}
+	}
+
+	if previous := m.Index().(*metadataStoreIndex).getPublicMode(); previous != nil {
+		if _, err := m.RevokeInvitation(ctx, previous.Invitation.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.attributeSignAndAddEvent(ctx, mode, protocoltypes.EventType_EventTypeMultiMemberGroupPublicModeSet)
+}
+
+// PublicDescriptor returns the descriptor announced for a public multi-member
+// group, nil if the group isn't public
+func (m *MetadataStore) PublicDescriptor() *protocoltypes.GroupPublicDescriptor {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil
+	}
+
+	mode := m.Index().(*metadataStoreIndex).getPublicMode()
+	if mode == nil {
+		return nil
+	}
+
+	g := proto.Clone(m.group).(*protocoltypes.Group)
+	g.Invitation = mode.Invitation
+
+	return &protocoltypes.GroupPublicDescriptor{
+		Name:        mode.Name,
+		Description: mode.Description,
+		JoinHint:    mode.JoinHint,
+		Topic:       mode.Topic,
+		Group:       g,
+	}
+}
+
+// CanDevicePublish returns true if the given device is allowed to send
+// messages to the group
+func (m *MetadataStore) CanDevicePublish(devicePK []byte) bool {
+	return m.canDevicePublishAt(devicePK, time.Now())
+}
+
+// isSameDevice returns true if devicePK is previousPK or the key which
+// replaced it after the rotations of the device key
+func (m *MetadataStore) isSameDevice(previousPK, devicePK []byte) bool {
+	return m.Index().(*metadataStoreIndex).isSameDevice(previousPK, devicePK)
+}
+
+// canDevicePublishAt returns true if the given device was allowed to send
+// messages to the group at the given time, the key of a device is retired
+// once the grace period of its rotation is over
+func (m *MetadataStore) canDevicePublishAt(devicePK []byte, at time.Time) bool {
+	idx := m.Index().(*metadataStoreIndex)
+	if idx.isDeviceRevoked(devicePK) || idx.isDeviceRetired(devicePK, at) {
+		return false
+	}
+
+	if !m.typeChecker(isMultiMemberGroup) {
+		return true
+	}
+
+	return idx.canDevicePublish(devicePK)
+}
+
+// IsDeviceRevoked returns true if the device has been revoked by its member
+func (m *MetadataStore) IsDeviceRevoked(devicePK []byte) bool {
+	return m.Index().(*metadataStoreIndex).isDeviceRevoked(devicePK)
+}
+
+// RotateDeviceKey links the next key of the current device to its current
+// one, the entries of the current key are rejected after retiredAt
+func (m *MetadataStore) RotateDeviceKey(ctx context.Context, next secretstore.OwnMemberDevice, retiredAt time.Time) (operation.Operation, error) {
+	newDevicePK, err := next.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if bytes.Equal(newDevicePK, m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the device key is unchanged"))
+	}
+
+	sig, err := next.DeviceSign(m.devicePublicKeyRaw)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupDeviceKeyRotated{
+		NewDevicePk:  newDevicePK,
+		NewDeviceSig: sig,
+		RetiredAt:    retiredAt.Unix(),
+	}, protocoltypes.EventType_EventTypeGroupDeviceKeyRotated)
+}
+
+// SetDisappearingMessages sets the delay after which the messages of the group
+// are deleted by its members, 0 disables the disappearing messages. The
+// current device must be allowed to send messages.
+func (m *MetadataStore) SetDisappearingMessages(ctx context.Context, duration time.Duration) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup, isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if duration < 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("duration can't be negative"))
+	}
+
+	if !m.CanDevicePublish(m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the devices allowed to send messages can change the disappearing messages"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupDisappearingMessagesSet{
+		Duration: int64(duration / time.Second),
+	}, protocoltypes.EventType_EventTypeGroupDisappearingMessagesSet)
+}
+
+// GetDisappearingMessages returns the delay after which the messages of the
+// group are deleted, 0 if disabled
+func (m *MetadataStore) GetDisappearingMessages() time.Duration {
+	return m.Index().(*metadataStoreIndex).getDisappearingMessages()
+}
+
+// disappearingMessagesEntry returns the entry which has set the current delay
+// of the disappearing messages, undefined if it has never been set
+func (m *MetadataStore) disappearingMessagesEntry() cid.Cid {
+	return m.Index().(*metadataStoreIndex).getDisappearingMessagesEntry()
+}
+
+// IsDeviceRetired returns true if the key of the device has been replaced by
+// a new one and its grace period is over
+func (m *MetadataStore) IsDeviceRetired(devicePK []byte, now time.Time) bool {
+	return m.Index().(*metadataStoreIndex).isDeviceRetired(devicePK, now)
+}
+
+// SetDeviceCapabilities announces the capabilities of the current device to
+// the other members of the group, nothing is written if they are unchanged
+func (m *MetadataStore) SetDeviceCapabilities(ctx context.Context, capabilities *protocoltypes.DeviceCapabilities) (operation.Operation, error) {
+	if capabilities == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	if current := m.GetDeviceCapabilities(m.devicePublicKeyRaw); current != nil && proto.Equal(current, capabilities) {
+		return nil, nil
+	}
+
+	// the previous announce may have been made with a clock ahead of the
+	// current one, the new one must still replace it
+	updatedAt := time.Now().Unix()
+	if previous := m.Index().(*metadataStoreIndex).getDeviceCapabilitiesUpdatedAt(m.devicePublicKeyRaw); previous >= updatedAt {
+		updatedAt = previous + 1
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupDeviceCapabilitiesSet{
+		Capabilities: capabilities,
+		UpdatedAt:    updatedAt,
+	}, protocoltypes.EventType_EventTypeGroupDeviceCapabilitiesSet)
+}
+
+// GetDeviceCapabilities returns the capabilities announced by a device of the
+// group, nil if it hasn't announced any
+func (m *MetadataStore) GetDeviceCapabilities(devicePK []byte) *protocoltypes.DeviceCapabilities {
+	return m.Index().(*metadataStoreIndex).getDeviceCapabilities(devicePK)
+}
+
+// ListDeviceCapabilities returns the devices of the group with their
+// capabilities
+func (m *MetadataStore) ListDeviceCapabilities() []*protocoltypes.GroupDeviceCapabilities_Device {
+	return m.Index().(*metadataStoreIndex).listDeviceCapabilities()
+}
+
+// AcknowledgeMessages acknowledges the reception of messages by the current
+// device, the messages already acknowledged are skipped and nothing is written
+// if none remains
+func (m *MetadataStore) AcknowledgeMessages(ctx context.Context, ids [][]byte) (operation.Operation, error) {
+	pending := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		if !m.IsMessageAcknowledged(id, m.devicePublicKeyRaw) {
+			pending = append(pending, id)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupMessagesAcknowledged{
+		Cids: pending,
+	}, protocoltypes.EventType_EventTypeGroupMessagesAcknowledged)
+}
+
+// IsMessageAcknowledged returns true if the device has acknowledged the
+// reception of the message
+func (m *MetadataStore) IsMessageAcknowledged(id []byte, devicePK []byte) bool {
+	return m.Index().(*metadataStoreIndex).isMessageAcknowledged(id, devicePK)
+}
+
+// MarkMessagesRead sends a read receipt for messages of the group, the
+// messages already marked as read are skipped and nothing is written if none
+// remains. The caller must check that the account sends read receipts.
+func (m *MetadataStore) MarkMessagesRead(ctx context.Context, ids [][]byte) (operation.Operation, error) {
+	index := m.Index().(*metadataStoreIndex)
+
+	pending := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		if !index.isMessageRead(id, m.devicePublicKeyRaw) {
+			pending = append(pending, id)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupMessagesRead{
+		Cids: pending,
+	}, protocoltypes.EventType_EventTypeGroupMessagesRead)
+}
+
+// ListMessageDeliveryStatus returns the devices of the group other than the
+// sender of the message, with whether they have acknowledged and read it
+func (m *MetadataStore) ListMessageDeliveryStatus(id []byte, senderPK []byte) []*protocoltypes.MessageDeliveryStatus_Device {
+	return m.Index().(*metadataStoreIndex).listMessageDeliveryStatus(id, senderPK)
+}
+
+// IsBroadcastMode returns true if only moderators and admins can send
+// messages to the group
+func (m *MetadataStore) IsBroadcastMode() bool {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return false
+	}
+
+	return m.Index().(*metadataStoreIndex).isBroadcastMode()
+}
+
+// emitLocalEvent notifies the subscribers of the group metadata events of an
+// event which is not written to the group log. The event is flagged as local
+// and identified by a hash of its content and emission time, so it isn't
+// handled as an entry of the log.
+func (m *MetadataStore) emitLocalEvent(eventType protocoltypes.EventType, event proto.Message) error {
+	data, err := proto.Marshal(event)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	hash, err := mh.Sum(binary.BigEndian.AppendUint64(data, uint64(time.Now().UnixNano())), mh.SHA2_256, -1)
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return m.emitters.groupMetadata.Emit(&protocoltypes.GroupMetadataEvent{
+		EventContext: &protocoltypes.EventContext{
+			Id:      cid.NewCidV1(cid.Raw, hash).Bytes(),
+			GroupPk: m.group.PublicKey,
+			Local:   true,
+		},
+		Metadata: &protocoltypes.GroupMetadata{EventType: eventType},
+		Event:    data,
+	})
+}
+
+// GetEpoch returns the current key epoch of a multi-member group, it is
+// advanced by each commit of the epoch tree, see getChainKeyEpoch
+func (m *MetadataStore) GetEpoch() uint64 {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return 0
+	}
+
+	return m.Index().(*metadataStoreIndex).getChainKeyEpoch()
+}
+
+// chainKeyEpoch returns the current epoch of the chain keys of the group
+func (m *MetadataStore) chainKeyEpoch() uint64 {
+	return m.Index().(*metadataStoreIndex).getChainKeyEpoch()
+}
+
+// AddSnapshot appends a summary of the membership state of a multi-member
+// group, devices joining the group afterwards don't need to replay the older
+// entries. The current device must be an admin of the group.
+func (m *MetadataStore) AddSnapshot(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can add snapshots"))
+	}
+
+	snapshot := m.Index().(*metadataStoreIndex).newSnapshot()
+
+	return m.attributeSignAndAddEvent(ctx, snapshot, protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded)
+}
+
+func (m *MetadataStore) shouldAddSnapshot() bool {
+	return m.typeChecker(isMultiMemberGroup) && m.IsAdmin() && m.Index().(*metadataStoreIndex).shouldAddSnapshot()
+}
+
+// snapshotCheckpoint returns the entry of the newest snapshot written by a
+// trusted device, cid.Undef if there is none
+func (m *MetadataStore) snapshotCheckpoint() cid.Cid {
+	index, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return cid.Undef
+	}
+
+	return index.snapshotCheckpoint()
+}
+
+// sentSecretEpochs returns the latest epoch of the chain key of the current
+// device sent to each member
+func (m *MetadataStore) sentSecretEpochs() map[string]uint64 {
+	index, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return map[string]uint64{}
+	}
+
+	return index.sentSecretEpochs()
+}
+
+// SetMemberRole changes the role of a member of a multi-member group, the
+// current device must be an admin of the group and the role of the group
+// creator can't be changed.
+func (m *MetadataStore) SetMemberRole(ctx context.Context, memberPK crypto.PubKey, role protocoltypes.GroupMemberRole) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if memberPK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := protocoltypes.GroupMemberRole_name[int32(role)]; !ok || role == protocoltypes.GroupMemberRole_GroupMemberRoleUndefined {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member role %d", role))
+	}
+
+	memberPKRaw, err := m.checkModerationTarget(memberPK)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupMemberRoleSet{
+		MemberPk: memberPKRaw,
+		Role:     role,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupMemberRoleSet)
+}
+
+// checkModerationTarget checks that the current device is allowed to change
+// the membership of the given member and returns its raw public key
+func (m *MetadataStore) checkModerationTarget(memberPK crypto.PubKey) ([]byte, error) {
+	idx := m.Index().(*metadataStoreIndex)
+
+	if !idx.isAdminDevice(m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can moderate members"))
+	}
+
+	if devs, err := m.GetDevicesForMember(memberPK); len(devs) == 0 || err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown group member"))
+	}
+
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if idx.isOwner(memberPKRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("group creator can't be moderated"))
+	}
+
+	removed, err := idx.isMemberRemoved(memberPK)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if removed {
+		return nil, errcode.ErrCode_ErrGroupMemberRemoved
+	}
+
+	return memberPKRaw, nil
+}
+
+// CreateInvitation returns a copy of the group including an invitation token
+// signed by the current device, expiresAt is a unix timestamp in seconds or 0
+// for an invitation without expiration. If approvalRequired is set, members
+// joining using the invitation only receive the group secrets once an admin
+// approved them.
+func (m *MetadataStore) CreateInvitation(expiresAt int64, approvalRequired bool) (*protocoltypes.Group, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can create invitations"))
+	}
+
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invitation expiration is in the past"))
+	}
+
+	token, err := newGroupInvitationToken(m.group, m.memberDevice, expiresAt, approvalRequired)
+	if err != nil {
+		return nil, err
+	}
+
+	g := proto.Clone(m.group).(*protocoltypes.Group)
+	g.Invitation = token
+
+	return g, nil
+}
+
+// RevokeInvitation prevents the members who didn't join the group yet from
+// using the given invitation
+func (m *MetadataStore) RevokeInvitation(ctx context.Context, invitationID []byte) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if len(invitationID) != groupInvitationIDSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid invitation id"))
+	}
+
+	if !m.IsAdmin() {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only admins can revoke invitations"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupInvitationRevoked{
+		InvitationId: invitationID,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupInvitationRevoked)
+}
+
+// IsAdmin returns true if the current device is allowed to moderate the group
+func (m *MetadataStore) IsAdmin() bool {
+	if m.typeChecker(isContactGroup, isAccountGroup) {
+		return true
+	}
+
+	return m.Index().(*metadataStoreIndex).isAdminDevice(m.devicePublicKeyRaw)
+}
+
+// ListMemberRoles returns the role of each member of the group, indexed by
+// the raw member public key
+func (m *MetadataStore) ListMemberRoles() map[string]protocoltypes.GroupMemberRole {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil
+	}
+
+	return m.Index().(*metadataStoreIndex).listRoles()
+}
+
+func signProtoWithDevice(message proto.Message, memberDevice secretstore.OwnMemberDevice) ([]byte, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	sig, err := memberDevice.DeviceSign(data)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return sig, nil
+}
+
+func signProtoWithPrivateKey(message proto.Message, sk crypto.PrivKey) ([]byte, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	sig, err := sk.Sign(data)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return sig, nil
+}
+
+// metadataSealKey returns the key the events of the device are sealed with,
+// nil when they are sealed with the group secret. The chain keys are always
+// sealed with the group secret as the metadata key of the device is sent
+// along with them, and so are the epoch commits as they are needed to open
+// the chain keys. Once a member has been removed the group secret isn't used
+// anymore, a device which hasn't rotated its key for the current epoch yet
+// does so before sealing the event. In a multi-member group, pending changes
+// removing devices from the epoch tree are committed first.
+func (m *MetadataStore) metadataSealKey(ctx context.Context, g *protocoltypes.Group, eventType protocoltypes.EventType) (*metadataKey, error) {
+	if eventType == protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded || eventType == protocoltypes.EventType_EventTypeMultiMemberGroupEpochCommitted || m.secretStore == nil || !bytes.Equal(g.PublicKey, m.group.PublicKey) {
+		return nil, nil
+	}
+
+	if m.typeChecker(isMultiMemberGroup) {
+		if m.Index().(*metadataStoreIndex).getEpochChanges().revoking() {
+			m.commitRevokingEpoch(ctx)
+		}
+
+		if _, err := m.sendEpochChainKey(ctx); err != nil {
+			m.logger.Warn("unable to send the chain key to the epoch devices", zap.Error(err))
+		}
+	}
+
+	epoch, key, err := m.secretStore.GetOwnMetadataKey(ctx, g)
+	if err != nil {
+		return nil, err
+	}
+
+	if current := m.Index().(*metadataStoreIndex).getChainKeyEpoch(); current > epoch {
+		if err := m.rotateMetadataKey(ctx, current); err != nil {
+			return nil, err
+		}
+
+		if epoch, key, err = m.secretStore.GetOwnMetadataKey(ctx, g); err != nil {
+			return nil, err
+		} else if key == nil || epoch < current {
+			return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(fmt.Errorf("no metadata key for epoch %d", current))
+		}
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+
+	return &metadataKey{
+		devicePK: m.devicePublicKeyRaw,
+		epoch:    epoch,
+		key:      key,
+	}, nil
+}
+
+// rotateMetadataKey rotates the chain key of the device for the given epoch
+// and sends it to the members of the group along with the new metadata key,
+// the members part of the epoch tree get it from sendEpochChainKey.
+func (m *MetadataStore) rotateMetadataKey(ctx context.Context, epoch uint64) error {
+	rotated, err := m.secretStore.RotateChainKey(ctx, m.group, epoch)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	} else if !rotated {
+		return nil
+	}
+
+	for _, memberPK := range m.ListMembers() {
+		if _, err := m.SendSecret(ctx, memberPK); err != nil && !errcode.Is(err, errcode.ErrCode_ErrGroupSecretAlreadySentToMember) {
+			m.logger.Warn("unable to send the rotated chain key to a member", zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// epochCommitDelay is the delay between the devices of a multi-member group
+// committing the pending membership changes, the first device of the epoch
+// tree commits at once and the next ones only if no commit has been received
+// in the meantime
+const epochCommitDelay = time.Second * 5
+
+// commitEpoch starts a new epoch of the epoch tree of a multi-member group,
+// applying the pending membership changes. The first epoch is committed by
+// one of the devices it adds, the next ones by a device of the current epoch.
+// Nothing is committed if the current device can't commit the changes, or if
+// there are none unless update is true.
+func (m *MetadataStore) commitEpoch(ctx context.Context, update bool) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	m.muEpoch.Lock()
+	defer m.muEpoch.Unlock()
+
+	return m.unsafeCommitEpoch(ctx, update)
+}
+
+func (m *MetadataStore) unsafeCommitEpoch(ctx context.Context, update bool) (operation.Operation, error) {
+	changes := m.Index().(*metadataStoreIndex).getEpochChanges()
+	if (!changes.pending() && !update) || changes.rank(m.devicePublicKeyRaw) < 0 {
+		return nil, nil
+	}
+
+	parentID, parent, epoch := []byte(nil), &ratchettree.Tree{}, m.GetEpoch()+1
+	if changes.tip != nil {
+		if !m.secretStore.IsGroupEpochKnown(ctx, m.group, changes.tip.id.Bytes()) {
+			return nil, nil
+		}
+
+		parentID, parent, epoch = changes.tip.id.Bytes(), changes.tip.tree, changes.tip.epoch+1
+	}
+
+	event, err := m.secretStore.CreateGroupEpochCommit(ctx, m.group, parentID, parent, epoch, changes.removes, changes.adds)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	op, err := m.attributeSignAndAddEvent(ctx, event, protocoltypes.EventType_EventTypeMultiMemberGroupEpochCommitted)
+	if err != nil {
+		return nil, err
+	}
+
+	m.unsafeProcessEpochCommits(ctx)
+
+	return op, nil
+}
+
+// commitRevokingEpoch commits the pending changes once a membership change
+// removing devices has been appended, the removed devices can't read the
+// entries sealed afterwards. The change is kept if the commit fails, another
+// device of the epoch commits it later.
+func (m *MetadataStore) commitRevokingEpoch(ctx context.Context) {
+	if _, err := m.commitEpoch(ctx, false); err != nil {
+		m.logger.Warn("unable to commit the group epoch", zap.Error(err))
+	}
+}
+
+// epochCommitRank returns the position of the current device in the devices
+// allowed to commit the pending membership changes, -1 if there are no
+// changes or if the current device can't commit them
+func (m *MetadataStore) epochCommitRank(ctx context.Context) int {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return -1
+	}
+
+	changes := m.Index().(*metadataStoreIndex).getEpochChanges()
+	if !changes.pending() {
+		return -1
+	}
+
+	if changes.tip != nil && !m.secretStore.IsGroupEpochKnown(ctx, m.group, changes.tip.id.Bytes()) {
+		return -1
+	}
+
+	return changes.rank(m.devicePublicKeyRaw)
+}
+
+// processEpochCommits derives the state of the current device for each epoch
+// it is part of, in the order of the commits
+func (m *MetadataStore) processEpochCommits(ctx context.Context) {
+	m.muEpoch.Lock()
+	defer m.muEpoch.Unlock()
+
+	m.unsafeProcessEpochCommits(ctx)
+}
+
+func (m *MetadataStore) unsafeProcessEpochCommits(ctx context.Context) {
+	for _, c := range m.Index().(*metadataStoreIndex).listEpochCommits() {
+		if m.secretStore.IsGroupEpochKnown(ctx, m.group, c.id.Bytes()) {
+			continue
+		}
+
+		if _, err := m.secretStore.ProcessGroupEpochCommit(ctx, m.group, c.id.Bytes(), c.parent, c.event); err != nil {
+			m.logger.Warn("unable to process epoch commit", zap.Error(err))
+		}
+	}
+}
+
+// sendEpochChainKey rotates the chain key of the current device for the
+// current epoch and sends it to all the devices of the epoch tree at once,
+// encrypted with a key derived from the epoch secret. A device which already
+// sent its chain key for the same epoch on a fork of the chain commits a new
+// epoch instead, the devices of the fork might not be the current ones.
+func (m *MetadataStore) sendEpochChainKey(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, nil
+	}
+
+	m.muEpoch.Lock()
+	defer m.muEpoch.Unlock()
+
+	m.unsafeProcessEpochCommits(ctx)
+
+	idx := m.Index().(*metadataStoreIndex)
+
+	tip := idx.getEpochTip()
+	if tip == nil || tip.tree.Find(m.devicePublicKeyRaw) < 0 || idx.isEpochChainKeySent(tip.id, m.devicePublicKeyRaw) {
+		return nil, nil
+	}
+
+	if !m.secretStore.IsGroupEpochKnown(ctx, m.group, tip.id.Bytes()) {
+		return nil, nil
+	}
+
+	if idx.isEpochChainKeySentToFork(tip, m.devicePublicKeyRaw) {
+		return m.unsafeCommitEpoch(ctx, true)
+	}
+
+	if _, err := m.secretStore.RotateChainKey(ctx, m.group, tip.epoch); err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	encryptedSecret, err := m.secretStore.GetEpochShareableChainKey(ctx, m.group, tip.id.Bytes())
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoEncrypt.Wrap(err)
+	}
+
+	event := &protocoltypes.GroupDeviceChainKeyAdded{
+		DevicePk:      m.devicePublicKeyRaw,
+		Payload:       encryptedSecret,
+		Epoch:         tip.epoch,
+		EpochCommitId: tip.id.Bytes(),
+	}
+
+	sig, err := signProtoWithDevice(event, m.memberDevice)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
+	}
+
+	return metadataStoreAddEvent(ctx, m, m.group, protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded, event, sig)
+}
+
+// isMemberInEpoch returns true if the current device and the devices of the
+// member are part of the current epoch tree, the chain key of the current
+// device is sent to them by sendEpochChainKey
+func (m *MetadataStore) isMemberInEpoch(memberPK crypto.PubKey) bool {
+	memberPKRaw, err := memberPK.Raw()
+	if err != nil {
+		return false
+	}
+
+	return m.Index().(*metadataStoreIndex).isMemberInEpoch(memberPKRaw, m.devicePublicKeyRaw)
+}
+
+func metadataStoreAddEvent(ctx context.Context, m *MetadataStore, g *protocoltypes.Group, eventType protocoltypes.EventType, event proto.Message, sig []byte) (operation.Operation, error) {
+	ctx, newTrace := tyber.ContextWithTraceID(ctx)
+	tyberLogError := tyber.LogError
+	if newTrace {
+		m.logger.Debug(fmt.Sprintf("Sending %s to %s group %s", strings.TrimPrefix(eventType.String(), "EventType"), strings.TrimPrefix(g.GroupType.String(), "GroupType"), base64.RawURLEncoding.EncodeToString(g.PublicKey)), tyber.FormatTraceLogFields(ctx)...)
+		tyberLogError = tyber.LogFatalError
+	}
+
+	sealKey, err := m.metadataSealKey(ctx, g, eventType)
+	if err != nil {
+		return nil, tyberLogError(ctx, m.logger, "Failed to get metadata key", err)
+	}
+
+	env, err := sealGroupEnvelope(g, eventType, event, sig, sealKey)
+	if err != nil {
+		return nil, tyberLogError(ctx, m.logger, "Failed to seal group envelope", errcode.ErrCode_ErrCryptoSignature.Wrap(err))
+	}
+	m.logger.Debug(fmt.Sprintf("Sealed group envelope (%d bytes)", len(env)), tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
+
+	op := operation.NewOperation(nil, "ADD", env)
+	e, err := m.AddOperation(ctx, op, nil)
+	if err != nil {
+		return nil, tyberLogError(ctx, m.logger, "Failed to add operation on log", errcode.ErrCode_ErrOrbitDBAppend.Wrap(err))
+	}
+	m.logger.Debug("Added operation on log", tyber.FormatStepLogFields(ctx, []tyber.Detail{
+		{Name: "CID", Description: e.GetHash().String()},
+	})...)
+
+	op, err = operation.ParseOperation(e)
+	if err != nil {
+		return nil, tyberLogError(ctx, m.logger, "Failed to parse operation returned by log", errcode.ErrCode_ErrOrbitDBDeserialization.Wrap(err))
+	}
+
+	if newTrace {
+		m.logger.Debug("Added metadata on log successfully", tyber.FormatStepLogFields(ctx, []tyber.Detail{}, tyber.EndTrace)...)
+	}
+	return op, nil
+}
+
+func (m *MetadataStore) ListContacts() map[string]*AccountContact {
+	return m.Index().(*metadataStoreIndex).listContacts()
+}
+
+func (m *MetadataStore) ListVerifiedCredentials() []*protocoltypes.AccountVerifiedCredentialRegistered {
+	return m.Index().(*metadataStoreIndex).listVerifiedCredentials()
+}
+
+func (m *MetadataStore) GetMemberByDevice(pk crypto.PubKey) (crypto.PubKey, error) {
+	return m.Index().(*metadataStoreIndex).getMemberByDevice(pk)
+}
+
+func (m *MetadataStore) GetDevicesForMember(pk crypto.PubKey) ([]crypto.PubKey, error) {
+	return m.Index().(*metadataStoreIndex).getDevicesForMember(pk)
+}
+
+func (m *MetadataStore) ListAdmins() []crypto.PubKey {
+	if m.typeChecker(isContactGroup, isAccountGroup) {
+		return m.ListMembers()
+	}
+
+	return m.Index().(*metadataStoreIndex).listAdmins()
+}
+
+func (m *MetadataStore) GetIncomingContactRequestsStatus() (bool, *protocoltypes.ShareableContact) {
+	if !m.typeChecker(isAccountGroup) {
+		return false, nil
+	}
+
+	enabled := m.Index().(*metadataStoreIndex).contactRequestsEnabled()
+	seed := m.Index().(*metadataStoreIndex).contactRequestsSeed()
+
+	rawMemberDevice, err := m.memberDevice.Member().Raw()
+	if err != nil {
+		m.logger.Error("unable to serialize member public key", zap.Error(err))
+		return enabled, nil
+	}
+
+	contactRef := &protocoltypes.ShareableContact{
+		Pk:                   rawMemberDevice,
+		PublicRendezvousSeed: seed,
+	}
+
+	return enabled, contactRef
+}
+
+func (m *MetadataStore) ListMembers() []crypto.PubKey {
+	if m.typeChecker(isAccountGroup, isContactGroup, isMultiMemberGroup) {
+		return m.Index().(*metadataStoreIndex).listMembers()
+	}
+
+	return nil
+}
+
+func (m *MetadataStore) setDeviceSeenRecorder(deviceSeen func(devicePK []byte, sentAt int64)) {
+	m.muDeviceSeen.Lock()
+	m.deviceSeen = deviceSeen
+	m.muDeviceSeen.Unlock()
+}
+
+func (m *MetadataStore) recordDeviceSeen(devicePK []byte, sentAt int64) {
+	m.muDeviceSeen.RLock()
+	deviceSeen := m.deviceSeen
+	m.muDeviceSeen.RUnlock()
+
+	if deviceSeen != nil {
+		deviceSeen(devicePK, sentAt)
+	}
+}
+
+// LastActivity returns the unix timestamp in milliseconds of the last entry
+// written to or replicated into the store, 0 if none since it has been opened
+func (m *MetadataStore) LastActivity() int64 {
+	return atomic.LoadInt64(&m.lastActivity)
+}
+
+func (m *MetadataStore) ListDevices() []crypto.PubKey {
+	return m.Index().(*metadataStoreIndex).listDevices()
+}
+
+func (m *MetadataStore) ListMultiMemberGroups() []*protocoltypes.Group {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	groups := []*protocoltypes.Group(nil)
+
+	for _, g := range idx.groups {
+		if g.state != accountGroupJoinedStateJoined {
+			continue
+		}
+
+		groups = append(groups, g.group)
+	}
+
+	return groups
+}
+
+// ListLeftGroupPKs returns the public keys of the multi-member groups left
+// by the account, their local data isn't needed anymore
+func (m *MetadataStore) ListLeftGroupPKs() [][]byte {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	groupPKs := [][]byte(nil)
+
+	for pk, g := range idx.groups {
+		if g.state != accountGroupJoinedStateLeft {
+			continue
+		}
+
+		groupPKs = append(groupPKs, []byte(pk))
+	}
+
+	return groupPKs
+}
+
+func (m *MetadataStore) ListOtherMembersDevices() []crypto.PubKey {
+	return m.Index().(*metadataStoreIndex).listOtherMembersDevices()
+}
+
+func (m *MetadataStore) GetRequestOwnMetadataForContact(pk []byte) ([]byte, error) {
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid index type"))
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	meta, ok := idx.contactRequestMetadata[string(pk)]
+	if !ok {
+		return nil, errcode.ErrCode_ErrMissingMapKey.Wrap(fmt.Errorf("no metadata found for specified contact"))
+	}
+
+	return meta, nil
+}
+
+func (m *MetadataStore) ListContactsByStatus(states ...protocoltypes.ContactState) []*protocoltypes.ShareableContact {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	contacts := []*protocoltypes.ShareableContact(nil)
+
+	for _, c := range idx.contacts {
+		hasState := false
+		for _, s := range states {
+			if c.state == s {
+				hasState = true
+				break
+			}
+		}
+
+		if hasState {
+			contacts = append(contacts, c.contact)
+		}
+	}
+
+	return contacts
+}
+
+func (m *MetadataStore) GetContactFromGroupPK(groupPK []byte) *protocoltypes.ShareableContact {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	idx, ok := m.Index().(*metadataStoreIndex)
+	if !ok {
+		return nil
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	contact, ok := idx.contactsFromGroupPK[string(groupPK)]
+	if !ok || contact == nil {
+		return nil
+	}
+
+	return contact.contact
+}
+
+func (m *MetadataStore) checkIfInGroup(pk []byte) bool {
+	idx, ok := m.Index().(*metadataStoreIndex)
 	if !ok {
 		return false
 	}
 
-	idx.lock.Lock()
-	defer idx.lock.Unlock()
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	if existingGroup, ok := idx.groups[string(pk)]; ok && existingGroup.state == accountGroupJoinedStateJoined {
+		return true
+	}
+
+	return false
+}
+
+// GroupJoin indicates the payload includes that the deviceKeystore has joined a group
+func (m *MetadataStore) GroupJoin(ctx context.Context, g *protocoltypes.Group) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := g.IsValid(); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if m.checkIfInGroup(g.PublicKey) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("already present in group"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountGroupJoined{
+		Group: g,
+	}, protocoltypes.EventType_EventTypeAccountGroupJoined)
+}
+
+// GroupLeave indicates the payload includes that the deviceKeystore has left a group
+func (m *MetadataStore) GroupLeave(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if pk == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	bytes, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if !m.checkIfInGroup(bytes) {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.groupAction(ctx, pk, &protocoltypes.AccountGroupLeft{}, protocoltypes.EventType_EventTypeAccountGroupLeft)
+}
+
+// ContactRequestDisable indicates the payload includes that the deviceKeystore has disabled incoming contact requests
+func (m *MetadataStore) ContactRequestDisable(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestDisabled{}, protocoltypes.EventType_EventTypeAccountContactRequestDisabled)
+}
+
+// ContactRequestEnable indicates the payload includes that the deviceKeystore has enabled incoming contact requests
+func (m *MetadataStore) ContactRequestEnable(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestEnabled{}, protocoltypes.EventType_EventTypeAccountContactRequestEnabled)
+}
+
+// ContactRequestReferenceReset indicates the payload includes that the deviceKeystore has a new contact request reference
+func (m *MetadataStore) ContactRequestReferenceReset(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	seed, err := genNewSeed()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestReferenceReset{
+		PublicRendezvousSeed: seed,
+	}, protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset)
+}
+
+// ContactRequestNonceRegister indicates the payload includes that the account
+// has shared a contact request link identified by the given nonce, which is
+// valid until expiresAt (unix timestamp in seconds, 0 if it never expires) and
+// for a single request if singleUse is set
+func (m *MetadataStore) ContactRequestNonceRegister(ctx context.Context, nonce []byte, expiresAt int64, singleUse bool) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if len(nonce) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("missing nonce"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestNonceRegistered{
+		Nonce:     nonce,
+		ExpiresAt: expiresAt,
+		SingleUse: singleUse,
+	}, protocoltypes.EventType_EventTypeAccountContactRequestNonceRegistered)
+}
+
+// ListContactRequestLinks returns the expiry of the contact request links
+// which are still valid, indexed by their nonce
+func (m *MetadataStore) ListContactRequestLinks() map[string]int64 {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	return m.Index().(*metadataStoreIndex).listContactRequestLinks(time.Now())
+}
+
+// PresenceSettingsSet indicates the payload includes that the account has
+// replaced the settings of its presence beacons
+func (m *MetadataStore) PresenceSettingsSet(ctx context.Context, settings *protocoltypes.PresenceSettings) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	if settings == nil {
+		settings = &protocoltypes.PresenceSettings{}
+	}
+
+	for _, pk := range settings.HiddenContacts {
+		if _, err := crypto.UnmarshalEd25519PublicKey(pk); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountPresenceSettingsSet{
+		Settings: settings,
+	}, protocoltypes.EventType_EventTypeAccountPresenceSettingsSet)
+}
+
+// GetPresenceSettings returns the settings of the presence beacons, presence
+// is disabled if none have been set
+func (m *MetadataStore) GetPresenceSettings() *protocoltypes.PresenceSettings {
+	if !m.typeChecker(isAccountGroup) {
+		return &protocoltypes.PresenceSettings{}
+	}
+
+	return m.Index().(*metadataStoreIndex).getPresenceSettings()
+}
+
+// ReadReceiptsSet enables or disables the read receipts sent by the devices of
+// the account
+func (m *MetadataStore) ReadReceiptsSet(ctx context.Context, disabled bool) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountReadReceiptsSet{
+		Disabled: disabled,
+	}, protocoltypes.EventType_EventTypeAccountReadReceiptsSet)
+}
+
+// AreReadReceiptsDisabled returns true if the account has disabled its read
+// receipts, they are enabled by default
+func (m *MetadataStore) AreReadReceiptsDisabled() bool {
+	if !m.typeChecker(isAccountGroup) {
+		return false
+	}
+
+	return m.Index().(*metadataStoreIndex).areReadReceiptsDisabled()
+}
+
+// AccountSettingSet sets or deletes an application setting shared between the
+// devices of the account. The setting is dated after its current value so the
+// new value wins even if the clocks of the devices differ.
+func (m *MetadataStore) AccountSettingSet(ctx context.Context, key string, value []byte, deleted bool) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if key == "" || len(key) > maxAccountSettingKeyLength {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("setting key must be between 1 and %d bytes", maxAccountSettingKeyLength))
+	}
+
+	if deleted {
+		value = nil
+	} else if len(value) > maxAccountSettingValueSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("setting value can't exceed %d bytes", maxAccountSettingValueSize))
+	}
+
+	updatedAt := time.Now().UnixNano()
+	if current := m.Index().(*metadataStoreIndex).getSetting(key); current != nil && current.UpdatedAt >= updatedAt {
+		updatedAt = current.UpdatedAt + 1
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountSettingSet{
+		Key:       key,
+		Value:     value,
+		Deleted:   deleted,
+		UpdatedAt: updatedAt,
+	}, protocoltypes.EventType_EventTypeAccountSettingSet)
+}
+
+// ListAccountSettings returns the given application settings, or all of them
+// if keys is empty
+func (m *MetadataStore) ListAccountSettings(keys []string) []*protocoltypes.AccountSetting {
+	return m.listAccountSettings(keys, false)
+}
+
+func (m *MetadataStore) listAccountSettings(keys []string, withDeleted bool) []*protocoltypes.AccountSetting {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	return m.Index().(*metadataStoreIndex).listSettings(keys, withDeleted)
+}
+
+// ContactRequestPolicySet indicates the payload includes that the account has
+// replaced the policy applied to incoming contact requests
+func (m *MetadataStore) ContactRequestPolicySet(ctx context.Context, policy *protocoltypes.ContactRequestPolicy) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	if policy == nil {
+		policy = &protocoltypes.ContactRequestPolicy{}
+	}
+
+	if err := checkContactRequestPolicyFormat(policy); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestPolicySet{
+		Policy: policy,
+	}, protocoltypes.EventType_EventTypeAccountContactRequestPolicySet)
+}
+
+// GetContactRequestPolicy returns the policy applied to incoming contact
+// requests, an empty policy if none has been set
+func (m *MetadataStore) GetContactRequestPolicy() *protocoltypes.ContactRequestPolicy {
+	if !m.typeChecker(isAccountGroup) {
+		return &protocoltypes.ContactRequestPolicy{}
+	}
+
+	return m.Index().(*metadataStoreIndex).getContactRequestPolicy()
+}
+
+// ContactRequestOutgoingEnqueue indicates the payload includes that the deviceKeystore will attempt to send a new contact request
+func (m *MetadataStore) ContactRequestOutgoingEnqueue(ctx context.Context, contact *protocoltypes.ShareableContact, ownMetadata []byte) (operation.Operation, error) {
+	ctx, _ = tyber.ContextWithTraceID(ctx)
+
+	b64GroupPK := base64.RawURLEncoding.EncodeToString(m.group.PublicKey)
+	m.logger.Debug("Enqueuing contact request", tyber.FormatStepLogFields(ctx, []tyber.Detail{{Name: "GroupPK", Description: fmt.Sprint(b64GroupPK)}})...)
+
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := contact.CheckFormat(); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	if contact.ExpiresAt != 0 && time.Now().Unix() > contact.ExpiresAt {
+		return nil, errcode.ErrCode_ErrContactRequestExpired
+	}
+
+	accountPublicKey := m.memberDevice.Member()
+	if contact.IsSamePK(accountPublicKey) {
+		return nil, errcode.ErrCode_ErrContactRequestSameAccount
+	}
+
+	pk, err := contact.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded) {
+		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
+	}
+
+	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateRemoved, protocoltypes.ContactState_ContactStateDiscarded, protocoltypes.ContactState_ContactStateReceived) {
+		return m.ContactRequestOutgoingSent(ctx, pk)
+	}
+
+	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestOutgoingEnqueued{
+		Contact: &protocoltypes.ShareableContact{
+			Pk:                    contact.Pk,
+			PublicRendezvousSeed:  contact.PublicRendezvousSeed,
+			Metadata:              contact.Metadata,
+			ExpiresAt:             contact.ExpiresAt,
+			Nonce:                 contact.Nonce,
+			Passphrase:            contact.Passphrase,
+			ProofOfWorkDifficulty: contact.ProofOfWorkDifficulty,
+		},
+		OwnMetadata: ownMetadata,
+	}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingEnqueued)
+
+	m.logger.Debug("Enqueued contact request", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
+
+	return op, err
+}
+
+// ContactRequestOutgoingSent indicates the payload includes that the deviceKeystore has sent a contact request
+func (m *MetadataStore) ContactRequestOutgoingSent(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	switch m.getContactStatus(pk) {
+	case protocoltypes.ContactState_ContactStateToRequest:
+	case protocoltypes.ContactState_ContactStateReceived:
+	case protocoltypes.ContactState_ContactStateRemoved:
+	case protocoltypes.ContactState_ContactStateDiscarded:
+
+	case protocoltypes.ContactState_ContactStateUndefined:
+		return nil, errcode.ErrCode_ErrContactRequestContactUndefined
+	case protocoltypes.ContactState_ContactStateAdded:
+		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
+	case protocoltypes.ContactState_ContactStateBlocked:
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
+	default:
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestOutgoingSent{}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent)
+}
 
-	if existingGroup, ok := idx.groups[string(pk)]; ok && existingGroup.state == accountGroupJoinedStateJoined {
-		return true
+// ContactRequestIncomingReceived indicates the payload includes that the deviceKeystore has received a contact request
+func (m *MetadataStore) ContactRequestIncomingReceived(ctx context.Context, contact *protocoltypes.ShareableContact) (operation.Operation, error) {
+	m.logger.Debug("Sending ContactRequestIncomingReceived on Account group", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
+
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	return false
+	if err := contact.CheckFormat(protocoltypes.ShareableContactOptionsAllowMissingRDVSeed); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	accountPublicKey := m.memberDevice.Member()
+	if contact.IsSamePK(accountPublicKey) {
+		return nil, errcode.ErrCode_ErrContactRequestSameAccount
+	}
+
+	pk, err := contact.GetPubKey()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// a request sent using a restricted link is only accepted while the link
+	// is valid, requests without nonce use the permanent contact reference,
+	// the nonce is checked and consumed at once
+	if len(contact.Nonce) > 0 {
+		m.muContactRequestNonce.Lock()
+		defer m.muContactRequestNonce.Unlock()
+
+		if err := m.Index().(*metadataStoreIndex).checkContactRequestNonce(contact.Nonce, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+
+	switch m.getContactStatus(pk) {
+	case protocoltypes.ContactState_ContactStateUndefined:
+	case protocoltypes.ContactState_ContactStateRemoved:
+	case protocoltypes.ContactState_ContactStateDiscarded:
+
+	// If incoming request comes from an account for which an outgoing request
+	// is in "sending" state, mark the outgoing request as "sent"
+	case protocoltypes.ContactState_ContactStateToRequest:
+		return m.ContactRequestOutgoingSent(ctx, pk)
+
+	// Errors
+	case protocoltypes.ContactState_ContactStateReceived:
+		return nil, errcode.ErrCode_ErrContactRequestIncomingAlreadyReceived
+	case protocoltypes.ContactState_ContactStateAdded:
+		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
+	case protocoltypes.ContactState_ContactStateBlocked:
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
+	default:
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestIncomingReceived{
+		ContactPk:             contact.Pk,
+		ContactRendezvousSeed: contact.PublicRendezvousSeed,
+		ContactMetadata:       contact.Metadata,
+		Nonce:                 contact.Nonce,
+	}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived)
 }
 
-// GroupJoin indicates the payload includes that the deviceKeystore has joined a group
-func (m *MetadataStore) GroupJoin(ctx context.Context, g *protocoltypes.Group) (operation.Operation, error) {
+// ContactRequestIncomingDiscard indicates the payload includes that the deviceKeystore has ignored a contact request
+func (m *MetadataStore) ContactRequestIncomingDiscard(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if err := g.IsValid(); err != nil {
-		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateReceived) {
+		return nil, errcode.ErrCode_ErrInvalidInput
 	}
 
-	if m.checkIfInGroup(g.PublicKey) {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("already present in group"))
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestIncomingDiscarded{}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingDiscarded)
+}
+
+// ContactRequestIncomingAccept indicates the payload includes that the deviceKeystore has accepted a contact request
+func (m *MetadataStore) ContactRequestIncomingAccept(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountGroupJoined{
-		Group: g,
-	}, protocoltypes.EventType_EventTypeAccountGroupJoined)
+	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateReceived) {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestIncomingAccepted{}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted)
 }
 
-// GroupLeave indicates the payload includes that the deviceKeystore has left a group
-func (m *MetadataStore) GroupLeave(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+// ContactBlock indicates the payload includes that the deviceKeystore has blocked a contact
+func (m *MetadataStore) ContactBlock(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if pk == nil {
+	accountPublicKey := m.memberDevice.Member()
+	if accountPublicKey.Equals(pk) {
 		return nil, errcode.ErrCode_ErrInvalidInput
 	}
 
-	bytes, err := pk.Raw()
+	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateBlocked) {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactBlocked{}, protocoltypes.EventType_EventTypeAccountContactBlocked)
+}
+
+// ContactUnblock indicates the payload includes that the deviceKeystore has unblocked a contact
+func (m *MetadataStore) ContactUnblock(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateBlocked) {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactUnblocked{}, protocoltypes.EventType_EventTypeAccountContactUnblocked)
+}
+
+// ContactDelete indicates the payload includes that the deviceKeystore has
+// deleted a contact, a blocked contact must be unblocked first
+func (m *MetadataStore) ContactDelete(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	switch m.getContactStatus(pk) {
+	case protocoltypes.ContactState_ContactStateToRequest:
+	case protocoltypes.ContactState_ContactStateReceived:
+	case protocoltypes.ContactState_ContactStateAdded:
+	case protocoltypes.ContactState_ContactStateDiscarded:
+
+	case protocoltypes.ContactState_ContactStateUndefined:
+		return nil, errcode.ErrCode_ErrContactRequestContactUndefined
+	case protocoltypes.ContactState_ContactStateBlocked:
+		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
+	default:
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactDeleted{}, protocoltypes.EventType_EventTypeAccountContactDeleted)
+}
+
+// ContactSetMetadata indicates the payload includes that the deviceKeystore
+// has attached private metadata to a contact
+func (m *MetadataStore) ContactSetMetadata(ctx context.Context, pk crypto.PubKey, metadata []byte) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if len(metadata) > maxContactMetadataSize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("contact metadata can't exceed %d bytes", maxContactMetadataSize))
+	}
+
+	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateUndefined) {
+		return nil, errcode.ErrCode_ErrContactRequestContactUndefined
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactMetadataSet{Metadata: metadata}, protocoltypes.EventType_EventTypeAccountContactMetadataSet)
+}
+
+// GetContactMetadata returns the private metadata attached to a contact, nil
+// if none has been set
+func (m *MetadataStore) GetContactMetadata(pk crypto.PubKey) ([]byte, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	pkBytes, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return m.Index().(*metadataStoreIndex).getContactMetadata(pkBytes), nil
+}
+
+// ContactMarkVerified indicates the payload includes that the deviceKeystore
+// has verified the safety number of a contact, an empty fingerprint clears the
+// verification
+func (m *MetadataStore) ContactMarkVerified(ctx context.Context, pk crypto.PubKey, fingerprint []byte) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded) {
+		return nil, errcode.ErrCode_ErrInvalidInput
+	}
+
+	return m.contactAction(ctx, pk, &protocoltypes.AccountContactVerified{Fingerprint: fingerprint}, protocoltypes.EventType_EventTypeAccountContactVerified)
+}
+
+// GetContactVerification returns the verification payload of the contact at
+// the time of its last verification, nil if it isn't verified
+func (m *MetadataStore) GetContactVerification(pk crypto.PubKey) ([]byte, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	pkBytes, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	return m.Index().(*metadataStoreIndex).getContactVerification(pkBytes), nil
+}
+
+// ContactResetSession requests both members of a contact group to renew their
+// device chain keys, starting a new epoch
+func (m *MetadataStore) ContactResetSession(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.ContactSessionReset{}, protocoltypes.EventType_EventTypeContactSessionReset)
+}
+
+// ContactRemove notifies the other member of the contact group that the
+// contact has been deleted, the group isn't read anymore
+func (m *MetadataStore) ContactRemove(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.ContactRemoved{}, protocoltypes.EventType_EventTypeContactRemoved)
+}
+
+// DeviceRevoke revokes another device of the account, the messages it sends
+// afterwards are rejected. Once a primary device has been designated, it is
+// the only one which can revoke devices.
+func (m *MetadataStore) DeviceRevoke(ctx context.Context, devicePK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	devicePKRaw, err := m.checkDeviceRevocation(devicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountDeviceRevoked{
+		RevokedDevicePk: devicePKRaw,
+	}, protocoltypes.EventType_EventTypeAccountDeviceRevoked)
+}
+
+// DeviceLink links the key generated for a new device to the account, only
+// the primary device can link devices
+func (m *MetadataStore) DeviceLink(ctx context.Context, devicePK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if !bytes.Equal(m.GetPrimaryDevice(), m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the primary device can link devices"))
+	}
+
+	devicePKRaw, err := devicePK.Raw()
 	if err != nil {
 		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	if !m.checkIfInGroup(bytes) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountDeviceLinked{
+		LinkedDevicePk: devicePKRaw,
+	}, protocoltypes.EventType_EventTypeAccountDeviceLinked)
+}
+
+// DeviceSetName sets the name and the platform of the current device, the
+// time it has been named for the first time is kept
+func (m *MetadataStore) DeviceSetName(ctx context.Context, name string, platform string) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if len(name) > maxDeviceNameLength || len(platform) > maxDeviceNameLength {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device name and platform can't exceed %d bytes", maxDeviceNameLength))
+	}
+
+	createdAt := time.Now().Unix()
+	if previous := m.Index().(*metadataStoreIndex).getDeviceName(m.devicePublicKeyRaw); previous != nil {
+		createdAt = previous.CreatedAt
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountDeviceNameSet{
+		Name:      name,
+		Platform:  platform,
+		CreatedAt: createdAt,
+	}, protocoltypes.EventType_EventTypeAccountDeviceNameSet)
+}
+
+// checkPrimaryDevice checks that the current device can manage the account,
+// only the primary device can once one has been designated
+func (m *MetadataStore) checkPrimaryDevice() error {
+	if primary := m.Index().(*metadataStoreIndex).getPrimaryDevice(); primary != nil && !bytes.Equal(primary, m.devicePublicKeyRaw) {
+		return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the primary device can manage the account"))
+	}
+
+	return nil
+}
+
+// GetPrimaryDevice returns the primary device of the account, nil if none has
+// been designated yet
+func (m *MetadataStore) GetPrimaryDevice() []byte {
+	if !m.typeChecker(isAccountGroup) {
+		return nil
+	}
+
+	return m.Index().(*metadataStoreIndex).getPrimaryDevice()
+}
+
+// PrimaryDeviceClaim designates the current device as the primary device of
+// the account if it has none, nothing is written if the current device is
+// already the primary device. The first device of the account is its primary
+// device, a claim is only needed when the beginning of the account group is
+// missing.
+func (m *MetadataStore) PrimaryDeviceClaim(ctx context.Context) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	if err := m.checkPrimaryDevice(); err != nil {
+		return nil, err
+	}
+
+	if m.GetPrimaryDevice() != nil {
+		return nil, nil
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountPrimaryDeviceClaimed{}, protocoltypes.EventType_EventTypeAccountPrimaryDeviceClaimed)
+}
+
+// PrimaryDeviceTransferPropose proposes the primary role to another device of
+// the account, the pending proposal is cancelled if devicePK is nil
+func (m *MetadataStore) PrimaryDeviceTransferPropose(ctx context.Context, devicePK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isAccountGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	idx := m.Index().(*metadataStoreIndex)
+	if !bytes.Equal(idx.getPrimaryDevice(), m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("only the primary device can transfer its role"))
+	}
+
+	newPrimaryPK := m.devicePublicKeyRaw
+	if devicePK != nil {
+		if devicePK.Equals(m.memberDevice.Device()) {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("current device is already the primary device"))
+		}
+
+		if _, err := idx.getMemberByDevice(devicePK); err != nil {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("unknown device"))
+		}
+
+		raw, err := devicePK.Raw()
+		if err != nil {
+			return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if idx.isDeviceRevoked(raw) {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device has been revoked"))
+		}
+
+		if !idx.isDeviceLinked(raw) {
+			return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device hasn't been linked by the primary device"))
+		}
+
+		newPrimaryPK = raw
 	}
 
-	return m.groupAction(ctx, pk, &protocoltypes.AccountGroupLeft{}, protocoltypes.EventType_EventTypeAccountGroupLeft)
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountPrimaryDeviceTransferProposed{
+		NewPrimaryDevicePk: newPrimaryPK,
+	}, protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferProposed)
 }
 
-// ContactRequestDisable indicates the payload includes that the deviceKeystore has disabled incoming contact requests
-func (m *MetadataStore) ContactRequestDisable(ctx context.Context) (operation.Operation, error) {
+// PrimaryDeviceTransferAccept accepts the primary role proposed to the
+// current device
+func (m *MetadataStore) PrimaryDeviceTransferAccept(ctx context.Context) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestDisabled{}, protocoltypes.EventType_EventTypeAccountContactRequestDisabled)
+	idx := m.Index().(*metadataStoreIndex)
+	if transfer := idx.getPrimaryTransfer(); transfer == nil || !bytes.Equal(transfer, m.devicePublicKeyRaw) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the primary role hasn't been proposed to the current device"))
+	}
+
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountPrimaryDeviceTransferAccepted{
+		PreviousPrimaryDevicePk: idx.getPrimaryDevice(),
+	}, protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferAccepted)
 }
 
-// ContactRequestEnable indicates the payload includes that the deviceKeystore has enabled incoming contact requests
-func (m *MetadataStore) ContactRequestEnable(ctx context.Context) (operation.Operation, error) {
+// ListDeviceInfos returns the devices linked to the account with their names
+func (m *MetadataStore) ListDeviceInfos() []*protocoltypes.DeviceInfo {
 	if !m.typeChecker(isAccountGroup) {
-		return nil, errcode.ErrCode_ErrGroupInvalidType
+		return nil
 	}
 
-	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestEnabled{}, protocoltypes.EventType_EventTypeAccountContactRequestEnabled)
+	devices := m.Index().(*metadataStoreIndex).listDeviceInfos()
+	for _, device := range devices {
+		device.Current = bytes.Equal(device.DevicePk, m.devicePublicKeyRaw)
+	}
+
+	return devices
 }
 
-// ContactRequestReferenceReset indicates the payload includes that the deviceKeystore has a new contact request reference
-func (m *MetadataStore) ContactRequestReferenceReset(ctx context.Context) (operation.Operation, error) {
-	if !m.typeChecker(isAccountGroup) {
+// ContactRevokeDevice informs the contact that a device of the account has
+// been revoked, both members renew their device chain keys
+func (m *MetadataStore) ContactRevokeDevice(ctx context.Context, devicePK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	seed, err := genNewSeed()
+	devicePKRaw, err := m.checkDeviceRevocation(devicePK)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrCryptoKeyGeneration.Wrap(err)
+		return nil, err
 	}
 
-	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestReferenceReset{
-		PublicRendezvousSeed: seed,
-	}, protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset)
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.ContactDeviceRevoked{
+		RevokedDevicePk: devicePKRaw,
+	}, protocoltypes.EventType_EventTypeContactDeviceRevoked)
 }
 
-// ContactRequestOutgoingEnqueue indicates the payload includes that the deviceKeystore will attempt to send a new contact request
-func (m *MetadataStore) ContactRequestOutgoingEnqueue(ctx context.Context, contact *protocoltypes.ShareableContact, ownMetadata []byte) (operation.Operation, error) {
-	ctx, _ = tyber.ContextWithTraceID(ctx)
+// MultiMemberGroupRevokeDevice revokes on the group the device key used by a
+// revoked device of the account, the members renew their chain keys
+func (m *MetadataStore) MultiMemberGroupRevokeDevice(ctx context.Context, devicePK crypto.PubKey) (operation.Operation, error) {
+	if !m.typeChecker(isMultiMemberGroup) {
+		return nil, errcode.ErrCode_ErrGroupInvalidType
+	}
 
-	b64GroupPK := base64.RawURLEncoding.EncodeToString(m.group.PublicKey)
-	m.logger.Debug("Enqueuing contact request", tyber.FormatStepLogFields(ctx, []tyber.Detail{{Name: "GroupPK", Description: fmt.Sprint(b64GroupPK)}})...)
+	devicePKRaw, err := m.checkDeviceRevocation(devicePK)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.MultiMemberGroupDeviceRevoked{
+		RevokedDevicePk: devicePKRaw,
+	}, protocoltypes.EventType_EventTypeMultiMemberGroupDeviceRevoked)
+	if err != nil {
+		return nil, err
+	}
+
+	m.commitRevokingEpoch(ctx)
+
+	return op, nil
+}
 
+// GroupDeviceRegister links the device key used by the current device on a
+// multi-member group to the device, it does nothing if it is already linked
+func (m *MetadataStore) GroupDeviceRegister(ctx context.Context, g *protocoltypes.Group, groupDevice secretstore.OwnMemberDevice) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if err := contact.CheckFormat(); err != nil {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	groupDevicePK, err := groupDevice.Device().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	accountPublicKey := m.memberDevice.Member()
-	if contact.IsSamePK(accountPublicKey) {
-		return nil, errcode.ErrCode_ErrContactRequestSameAccount
+	if bytes.Equal(m.Index().(*metadataStoreIndex).getGroupDevice(g.PublicKey, m.devicePublicKeyRaw), groupDevicePK) {
+		return nil, nil
 	}
 
-	pk, err := contact.GetPubKey()
+	sig, err := groupDevice.DeviceSign(m.devicePublicKeyRaw)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		return nil, errcode.ErrCode_ErrCryptoSignature.Wrap(err)
 	}
 
-	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateAdded) {
-		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
-	}
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountGroupDeviceRegistered{
+		GroupPk:        g.PublicKey,
+		GroupDevicePk:  groupDevicePK,
+		GroupDeviceSig: sig,
+	}, protocoltypes.EventType_EventTypeAccountGroupDeviceRegistered)
+}
 
-	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateRemoved, protocoltypes.ContactState_ContactStateDiscarded, protocoltypes.ContactState_ContactStateReceived) {
-		return m.ContactRequestOutgoingSent(ctx, pk)
+// checkDeviceRevocation checks that the device is another known device of the
+// current member which isn't revoked yet
+func (m *MetadataStore) checkDeviceRevocation(devicePK crypto.PubKey) ([]byte, error) {
+	if devicePK == nil {
+		return nil, errcode.ErrCode_ErrInvalidInput
 	}
 
-	op, err := m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestOutgoingEnqueued{
-		Contact: &protocoltypes.ShareableContact{
-			Pk:                   contact.Pk,
-			PublicRendezvousSeed: contact.PublicRendezvousSeed,
-			Metadata:             contact.Metadata,
-		},
-		OwnMetadata: ownMetadata,
-	}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingEnqueued)
+	if devicePK.Equals(m.memberDevice.Device()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("can't revoke current device"))
+	}
 
-	m.logger.Debug("Enqueued contact request", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
+	devicePKRaw, err := devicePK.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
 
-	return op, err
-}
+	idx := m.Index().(*metadataStoreIndex)
 
-// ContactRequestOutgoingSent indicates the payload includes that the deviceKeystore has sent a contact request
-func (m *MetadataStore) ContactRequestOutgoingSent(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
-	if !m.typeChecker(isAccountGroup) {
-		return nil, errcode.ErrCode_ErrGroupInvalidType
+	member, err := idx.getMemberByDevice(devicePK)
+	if err != nil || !member.Equals(m.memberDevice.Member()) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device doesn't belong to the account"))
 	}
 
-	switch m.getContactStatus(pk) {
-	case protocoltypes.ContactState_ContactStateToRequest:
-	case protocoltypes.ContactState_ContactStateReceived:
-	case protocoltypes.ContactState_ContactStateRemoved:
-	case protocoltypes.ContactState_ContactStateDiscarded:
-
-	case protocoltypes.ContactState_ContactStateUndefined:
-		return nil, errcode.ErrCode_ErrContactRequestContactUndefined
-	case protocoltypes.ContactState_ContactStateAdded:
-		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
-	case protocoltypes.ContactState_ContactStateBlocked:
-		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
-	default:
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if idx.isDeviceRevoked(devicePKRaw) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("device already revoked"))
 	}
 
-	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestOutgoingSent{}, protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent)
+	return devicePKRaw, nil
 }
 
-// ContactRequestIncomingReceived indicates the payload includes that the deviceKeystore has received a contact request
-func (m *MetadataStore) ContactRequestIncomingReceived(ctx context.Context, contact *protocoltypes.ShareableContact) (operation.Operation, error) {
-	m.logger.Debug("Sending ContactRequestIncomingReceived on Account group", tyber.FormatStepLogFields(ctx, []tyber.Detail{})...)
-
-	if !m.typeChecker(isAccountGroup) {
+// ContactReintroduce sends to the contact group the proof that the account of
+// the current member is replaced by a new one
+func (m *MetadataStore) ContactReintroduce(ctx context.Context, proof *protocoltypes.ContactReintroductionProof) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if err := contact.CheckFormat(protocoltypes.ShareableContactOptionsAllowMissingRDVSeed); err != nil {
+	if err := verifyContactReintroductionProof(proof); err != nil {
 		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	accountPublicKey := m.memberDevice.Member()
-	if contact.IsSamePK(accountPublicKey) {
-		return nil, errcode.ErrCode_ErrContactRequestSameAccount
-	}
-
-	pk, err := contact.GetPubKey()
+	memberPK, err := m.memberDevice.Member().Raw()
 	if err != nil {
-		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	switch m.getContactStatus(pk) {
-	case protocoltypes.ContactState_ContactStateUndefined:
-	case protocoltypes.ContactState_ContactStateRemoved:
-	case protocoltypes.ContactState_ContactStateDiscarded:
-
-	// If incoming request comes from an account for which an outgoing request
-	// is in "sending" state, mark the outgoing request as "sent"
-	case protocoltypes.ContactState_ContactStateToRequest:
-		return m.ContactRequestOutgoingSent(ctx, pk)
-
-	// Errors
-	case protocoltypes.ContactState_ContactStateReceived:
-		return nil, errcode.ErrCode_ErrContactRequestIncomingAlreadyReceived
-	case protocoltypes.ContactState_ContactStateAdded:
-		return nil, errcode.ErrCode_ErrContactRequestContactAlreadyAdded
-	case protocoltypes.ContactState_ContactStateBlocked:
-		return nil, errcode.ErrCode_ErrContactRequestContactBlocked
-	default:
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if !bytes.Equal(memberPK, proof.OldAccountPk) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("the proof has been created for another account"))
 	}
 
-	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactRequestIncomingReceived{
-		ContactPk:             contact.Pk,
-		ContactRendezvousSeed: contact.PublicRendezvousSeed,
-		ContactMetadata:       contact.Metadata,
-	}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived)
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.ContactAccountReintroduced{
+		Proof: proof,
+	}, protocoltypes.EventType_EventTypeContactAccountReintroduced)
 }
 
-// ContactRequestIncomingDiscard indicates the payload includes that the deviceKeystore has ignored a contact request
-func (m *MetadataStore) ContactRequestIncomingDiscard(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
-	if !m.typeChecker(isAccountGroup) {
+// ContactIntroductionSend sends to the contact group the introduction of
+// another contact of the current member
+func (m *MetadataStore) ContactIntroductionSend(ctx context.Context, introduction *protocoltypes.ContactIntroduction) (operation.Operation, error) {
+	if !m.typeChecker(isContactGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateReceived) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if err := verifyContactIntroduction(introduction); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestIncomingDiscarded{}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingDiscarded)
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.ContactIntroductionSent{
+		Introduction: introduction,
+	}, protocoltypes.EventType_EventTypeContactIntroductionSent)
 }
 
-// ContactRequestIncomingAccept indicates the payload includes that the deviceKeystore has accepted a contact request
-func (m *MetadataStore) ContactRequestIncomingAccept(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
+// ContactIntroductionAccept indicates the payload includes that the
+// deviceKeystore has accepted an introduction sent by one of its contacts
+func (m *MetadataStore) ContactIntroductionAccept(ctx context.Context, introduction *protocoltypes.ContactIntroduction) (operation.Operation, error) {
 	if !m.typeChecker(isAccountGroup) {
 		return nil, errcode.ErrCode_ErrGroupInvalidType
 	}
 
-	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateReceived) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if err := verifyContactIntroduction(introduction); err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	return m.contactAction(ctx, pk, &protocoltypes.AccountContactRequestIncomingAccepted{}, protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted)
-}
-
-// ContactBlock indicates the payload includes that the deviceKeystore has blocked a contact
-func (m *MetadataStore) ContactBlock(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
-	if !m.typeChecker(isAccountGroup) {
-		return nil, errcode.ErrCode_ErrGroupInvalidType
+	accountPK, err := m.memberDevice.Member().Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
 	}
 
-	accountPublicKey := m.memberDevice.Member()
-	if accountPublicKey.Equals(pk) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if !bytes.Equal(accountPK, introduction.RecipientPk) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("introduction sent to another account"))
 	}
 
-	if m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateBlocked) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if err := checkContactIntroductionExpiry(introduction, time.Now()); err != nil {
+		return nil, err
 	}
 
-	return m.contactAction(ctx, pk, &protocoltypes.AccountContactBlocked{}, protocoltypes.EventType_EventTypeAccountContactBlocked)
-}
+	introducerPK, err := crypto.UnmarshalEd25519PublicKey(introduction.IntroducerPk)
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
 
-// ContactUnblock indicates the payload includes that the deviceKeystore has unblocked a contact
-func (m *MetadataStore) ContactUnblock(ctx context.Context, pk crypto.PubKey) (operation.Operation, error) {
-	if !m.typeChecker(isAccountGroup) {
-		return nil, errcode.ErrCode_ErrGroupInvalidType
+	if !m.checkContactStatus(introducerPK, protocoltypes.ContactState_ContactStateAdded) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("introducer is not a contact"))
 	}
 
-	if !m.checkContactStatus(pk, protocoltypes.ContactState_ContactStateBlocked) {
-		return nil, errcode.ErrCode_ErrInvalidInput
+	if m.Index().(*metadataStoreIndex).isIntroductionAccepted(introduction.Introduced.Pk) {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("introduction already accepted"))
 	}
 
-	return m.contactAction(ctx, pk, &protocoltypes.AccountContactUnblocked{}, protocoltypes.EventType_EventTypeAccountContactUnblocked)
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.AccountContactIntroductionAccepted{
+		Introduction: introduction,
+	}, protocoltypes.EventType_EventTypeAccountContactIntroductionAccepted)
 }
 
 func (m *MetadataStore) ContactSendAliasKey(ctx context.Context) (operation.Operation, error) {
@@ -781,13 +2616,34 @@ func (m *MetadataStore) SendAccountVerifiedCredentialAdded(ctx context.Context,
 	return m.attributeSignAndAddEvent(ctx, token, protocoltypes.EventType_EventTypeAccountVerifiedCredentialRegistered)
 }
 
-func (m *MetadataStore) SendGroupReplicating(ctx context.Context, authenticationURL, replicationServer string) (operation.Operation, error) {
+// SendGroupReplicating announces that the group is replicated by the server
+// until expiresAt in unix nanoseconds, 0 if the registration doesn't expire
+func (m *MetadataStore) SendGroupReplicating(ctx context.Context, authenticationURL, replicationServer string, expiresAt int64) (operation.Operation, error) {
 	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupReplicating{
 		AuthenticationUrl: authenticationURL,
 		ReplicationServer: replicationServer,
+		ExpiresAt:         expiresAt,
+		UpdatedAt:         time.Now().UnixNano(),
+	}, protocoltypes.EventType_EventTypeGroupReplicating)
+}
+
+// SendGroupUnreplicating announces that the group isn't replicated by the
+// server anymore
+func (m *MetadataStore) SendGroupUnreplicating(ctx context.Context, replicationServer string) (operation.Operation, error) {
+	return m.attributeSignAndAddEvent(ctx, &protocoltypes.GroupReplicating{
+		ReplicationServer: replicationServer,
+		Unregistered:      true,
+		UpdatedAt:         time.Now().UnixNano(),
 	}, protocoltypes.EventType_EventTypeGroupReplicating)
 }
 
+// ListReplicationServers returns the registrations of the replication servers
+// the group is registered with at now, as announced by its members, a server
+// registered by several members is listed once
+func (m *MetadataStore) ListReplicationServers(now time.Time) []*protocoltypes.GroupReplicating {
+	return m.Index().(*metadataStoreIndex).listReplicationServers(now)
+}
+
 type accountSignableEvent interface {
 	proto.Message
 	SetDevicePK([]byte)
@@ -940,7 +2796,7 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 
 		if replication {
 			options.Index = basestore.NewNoopIndex
-			if err := store.InitBaseStore(ipfs, identity, addr, options); err != nil {
+			if err := store.InitBaseStore(s.logCompaction.wrapCoreAPI(ipfs, addr.String()), identity, addr, options); err != nil {
 				store.cancel()
 				return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
 			}
@@ -981,12 +2837,21 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 					entries = evt.Entries
 				}
 
+				if len(entries) > 0 {
+					atomic.StoreInt64(&store.lastActivity, time.Now().UnixMilli())
+					s.syncState.changed()
+				}
+
 				for _, entry := range entries {
 					ctx = tyber.ContextWithConstantTraceID(ctx, "msgrcvd-"+entry.GetHash().String())
 					tyber.LogTraceStart(ctx, store.logger, fmt.Sprintf("Received metadata from %s group %s", shortGroupType, b64GroupPK))
 
-					metaEvent, event, err := openMetadataEntry(store.OpLog(), entry, g)
-					if err != nil {
+					metaEvent, event, err := openMetadataEntry(ctx, store.OpLog(), entry, g, s.secretStore)
+					if errcode.Has(err, errcode.ErrCode_ErrMissingInput) {
+						tyber.LogStep(ctx, store.logger, "Metadata key unknown, queuing metadata event", tyber.ForceReopen, tyber.EndTrace)
+						store.queuePendingEntry(entry)
+						continue
+					} else if err != nil {
 						_ = tyber.LogFatalError(ctx, store.logger, "Unable to open metadata event", err, tyber.WithDetail("RawEvent", fmt.Sprint(e)), tyber.ForceReopen)
 						continue
 					}
@@ -999,32 +2864,154 @@ func constructorFactoryGroupMetadata(s *WeshOrbitDB, logger *zap.Logger) iface.S
 						tyber.UpdateTraceName(fmt.Sprintf("Received %s from %s group %s", strings.TrimPrefix(metaEvent.GetMetadata().GetEventType().String(), "EventType"), shortGroupType, b64GroupPK)),
 					)
 
-					recvEvent := EventMetadataReceived{
-						MetaEvent: metaEvent,
-						Event:     event,
-					}
-
-					if err := store.emitters.metadataReceived.Emit(recvEvent); err != nil {
-						store.logger.Warn("unable to emit recv event", zap.Error(err))
-					}
-
-					if err := store.emitters.groupMetadata.Emit(metaEvent); err != nil {
-						store.logger.Warn("unable to emit group metadata event", zap.Error(err))
-					}
+					store.emitMetadataEvent(metaEvent, event)
 				}
 			}
 		}(store.ctx)
 
 		options.Index = newMetadataIndex(store.ctx, g, store.memberDevice, s.secretStore)
-		if err := store.InitBaseStore(ipfs, identity, addr, options); err != nil {
+		if err := store.InitBaseStore(s.logCompaction.wrapCoreAPI(ipfs, addr.String()), identity, addr, options); err != nil {
+			store.cancel()
+			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
+		}
+
+		// the chain keys sent in the compacted entries aren't sent again
+		checkpoint, err := s.logCompaction.checkpoint(store.ctx, addr.String())
+		if err != nil {
 			store.cancel()
 			return nil, errcode.ErrCode_ErrOrbitDBInit.Wrap(err)
 		}
 
+		index := store.Index().(*metadataStoreIndex)
+		index.setCheckpointSentSecrets(checkpoint.SentSecrets)
+		index.setIndexCache(s.indexCache, addr.String())
+
 		return store, nil
 	}
 }
 
+func (m *MetadataStore) emitMetadataEvent(metaEvent *protocoltypes.GroupMetadataEvent, event proto.Message) {
+	if err := m.checkEventSender(metaEvent, event); err != nil {
+		m.logger.Warn("ignoring metadata event", zap.Error(err))
+		return
+	}
+
+	if evt, ok := event.(interface{ GetDevicePk() []byte }); ok {
+		m.recordDeviceSeen(evt.GetDevicePk(), metaEvent.GetMetadata().GetProtocolMetadata().GetSentAt())
+	}
+
+	recvEvent := EventMetadataReceived{
+		MetaEvent: metaEvent,
+		Event:     event,
+	}
+
+	if err := m.emitters.metadataReceived.Emit(recvEvent); err != nil {
+		m.logger.Warn("unable to emit recv event", zap.Error(err))
+	}
+
+	if err := m.emitters.groupMetadata.Emit(metaEvent); err != nil {
+		m.logger.Warn("unable to emit group metadata event", zap.Error(err))
+	}
+}
+
+// checkEventSender checks the events whose signature is only valid when sent
+// by a given member, a reintroduction must be sent by a device of the
+// previous account as the proof could be replayed in another contact group.
+// The events signed by a retired device key after the end of its grace
+// period are rejected, at the time set by their author as no other time is
+// recorded for the metadata entries.
+func (m *MetadataStore) checkEventSender(metaEvent *protocoltypes.GroupMetadataEvent, event proto.Message) error {
+	if signed, ok := event.(eventDeviceSigned); ok {
+		at := time.Now()
+		if sentAt := metaEvent.GetMetadata().GetProtocolMetadata().GetSentAt(); sentAt > 0 && sentAt < at.Unix() {
+			at = time.Unix(sentAt, 0)
+		}
+
+		if m.IsDeviceRetired(signed.GetDevicePk(), at) {
+			return errcode.ErrCode_ErrGroupPermissionDenied.Wrap(fmt.Errorf("event sent by a retired device key"))
+		}
+	}
+
+	evt, ok := event.(*protocoltypes.ContactAccountReintroduced)
+	if !ok {
+		return nil
+	}
+
+	devicePK, err := crypto.UnmarshalEd25519PublicKey(evt.DevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	member, err := m.GetMemberByDevice(devicePK)
+	if err != nil {
+		return errcode.ErrCode_ErrGroupMemberUnknownGroupID.Wrap(err)
+	}
+
+	memberPK, err := member.Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	if !bytes.Equal(memberPK, evt.Proof.GetOldAccountPk()) {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("reintroduction not sent by the previous account"))
+	}
+
+	return nil
+}
+
+func (m *MetadataStore) queuePendingEntry(e ipfslog.Entry) {
+	m.muPendingEntries.Lock()
+	defer m.muPendingEntries.Unlock()
+
+	if m.pendingEntries == nil {
+		m.pendingEntries = map[string]ipfslog.Entry{}
+	}
+
+	m.pendingEntries[e.GetHash().String()] = e
+}
+
+// processPendingEntries opens the queued entries after a chain key, and the
+// metadata keys sent with it, has been registered. The opened entries are
+// emitted and indexed.
+func (m *MetadataStore) processPendingEntries(ctx context.Context) {
+	type openedEntry struct {
+		metaEvent *protocoltypes.GroupMetadataEvent
+		event     proto.Message
+	}
+
+	opened := []openedEntry{}
+
+	m.muPendingEntries.Lock()
+	for hash, e := range m.pendingEntries {
+		metaEvent, event, err := openMetadataEntry(ctx, m.OpLog(), e, m.group, m.secretStore)
+		if errcode.Has(err, errcode.ErrCode_ErrMissingInput) {
+			continue
+		}
+
+		delete(m.pendingEntries, hash)
+		if err != nil {
+			m.logger.Error("unable to open metadata event", zap.Error(err))
+			continue
+		}
+
+		opened = append(opened, openedEntry{metaEvent: metaEvent, event: event})
+	}
+	m.muPendingEntries.Unlock()
+
+	if len(opened) == 0 {
+		return
+	}
+
+	// the index skipped these entries, it has to be updated again
+	if err := m.Index().UpdateIndex(m.OpLog(), nil); err != nil {
+		m.logger.Error("unable to update metadata index", zap.Error(err))
+	}
+
+	for _, o := range opened {
+		m.emitMetadataEvent(o.metaEvent, o.event)
+	}
+}
+
 func (m *MetadataStore) initEmitter() (err error) {
 	if m.emitters.metadataReceived, err = m.eventBus.Emitter(new(EventMetadataReceived)); err != nil {
 		return
@@ -1042,6 +3029,15 @@ func genNewSeed() (seed []byte, err error) {
 	return
 }
 
+// contactRequestLinkSeed derives the rendezvous seed of a contact request
+// link from the permanent seed of the account, the permanent seed can't be
+// found from the link
+func contactRequestLinkSeed(seed, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, seed)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
 func (m *MetadataStore) Close() error {
 	m.cancel()
 	return m.BaseStore.Close()
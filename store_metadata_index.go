@@ -1,10 +1,14 @@
 package weshnet
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
@@ -14,26 +18,91 @@ import (
 	"berty.tech/weshnet/v2/pkg/cryptoutil"
 	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/ratchettree"
 	"berty.tech/weshnet/v2/pkg/secretstore"
 )
 
+// groupSnapshotInterval is the number of metadata entries after which an admin
+// of a multi-member group appends a new snapshot
+const groupSnapshotInterval = 200
+
 // FIXME: replace members, devices, sentSecrets, contacts and groups by a circular buffer to avoid an attack by RAM saturation
 type metadataStoreIndex struct {
 	members                  map[string][]secretstore.MemberDevice
 	devices                  map[string]secretstore.MemberDevice
 	handledEvents            map[string]struct{}
-	sentSecrets              map[string]struct{}
+	sentSecrets              map[string]uint64
 	admins                   map[crypto.PubKey]struct{}
+	removedMembers           map[string]struct{}
+	pendingMembers           map[string][]byte
+	approvedMembers          map[string]struct{}
+	bannedMembers            map[string]struct{}
+	revokedDevices           map[string]struct{}
+	deviceCapabilities       map[string]*protocoltypes.GroupDeviceCapabilitiesSet
+	replicationServers       map[replicationServerKey]*protocoltypes.GroupReplicating
+	rotatedDevices           map[string]*protocoltypes.GroupDeviceKeyRotated
+	acknowledgedMessages     map[string]map[string]struct{}
+	readMessages             map[string]map[string]struct{}
+	roles                    map[string]protocoltypes.GroupMemberRole
+	chainKeyEpoch            uint64
+	owner                    []byte
+	primaryDevice            []byte
+	primaryTransfer          []byte
+	firstDevice              []byte
+	linkedDevices            map[string]struct{}
+	broadcastMode            bool
+	publicMode               *protocoltypes.MultiMemberGroupPublicModeSet
+	disappearingMessages     int64
+	disappearingEntry        cid.Cid
+	disappearingEntries      map[*protocoltypes.GroupDisappearingMessagesSet]cid.Cid
 	contacts                 map[string]*AccountContact
 	contactsFromGroupPK      map[string]*AccountContact
 	groups                   map[string]*accountGroup
 	contactRequestMetadata   map[string][]byte
+	contactRequestNonces     map[string]*contactRequestNonce
+	contactRequestPolicy     *protocoltypes.ContactRequestPolicy
+	presenceSettings         *protocoltypes.PresenceSettings
+	readReceiptsDisabled     bool
+	contactVerifications     map[string][]byte
+	contactMetadata          map[string][]byte
+	deviceNames              map[string]*protocoltypes.AccountDeviceNameSet
+	deviceFirstNames         map[string]deviceFirstName
+	deviceNameEvents         int
+	settings                 map[string]*protocoltypes.AccountSettingSet
+	groupDevices             map[string]map[string][]byte
+	acceptedIntroductions    map[string]struct{}
 	verifiedCredentials      []*protocoltypes.AccountVerifiedCredentialRegistered
 	contactRequestSeed       []byte
 	contactRequestEnabled    *bool
 	eventHandlers            map[protocoltypes.EventType][]func(event proto.Message) error
 	postIndexActions         []func() error
 	eventsContactAddAliasKey []*protocoltypes.ContactAliasKeyAdded
+	eventsModeration         []proto.Message
+	eventsMemberJoined       []memberJoin
+	eventsInvitationRevoked  []invitationRevocation
+	eventPosition            int
+	eventHash                cid.Cid
+	snapshot                 *protocoltypes.MultiMemberGroupSnapshotAdded
+	snapshotEntry            cid.Cid
+	snapshotCandidates       map[*protocoltypes.MultiMemberGroupSnapshotAdded]snapshotCandidate
+	verifiedSnapshots        map[string]struct{}
+	epochSnapshot            *protocoltypes.MultiMemberGroupSnapshotAdded
+	epochCommitCandidates    map[*protocoltypes.MultiMemberGroupEpochCommitted]cid.Cid
+	epochCommitsAuthorized   []*epochCommit
+	epochCommits             []*epochCommit
+	epochTip                 *epochCommit
+	epochRotation            int
+	epochRotationRequested   bool
+	epochChainKeys           map[string]map[string]*protocoltypes.GroupDeviceChainKeyAdded
+	truncated                bool
+	checkpointSentSecrets    map[string]uint64
+	indexCache               *metadataIndexCache
+	indexCacheAddress        string
+	indexCacheSealKey        *[cryptoutil.KeySize]byte
+	indexCachedMetadata      map[string]*protocoltypes.GroupMetadata
+	eventsSinceSnapshot      int
+	invitationRequired       bool
+	revokedInvitations       map[string]struct{}
 	ownAliasKeySent          bool
 	otherAliasKey            []byte
 	group                    *protocoltypes.Group
@@ -44,6 +113,61 @@ type metadataStoreIndex struct {
 	logger                   *zap.Logger
 }
 
+// memberJoin is a device added to the group and the position of the event in
+// the log, used to check the invitation it has been added with
+type memberJoin struct {
+	position   int
+	memberPK   []byte
+	invitation *protocoltypes.GroupInvitationToken
+	joinedAt   int64
+}
+
+// contactRequestNonce is the state of a contact request link shared with
+// an expiry or for a single use
+type contactRequestNonce struct {
+	registered bool
+	expiresAt  int64
+	singleUse  bool
+	consumed   bool
+}
+
+// check returns an error if the link can't be used anymore
+func (n *contactRequestNonce) check(now time.Time) error {
+	switch {
+	case !n.registered:
+		return errcode.ErrCode_ErrContactRequestNonceInvalid
+	case n.singleUse && n.consumed:
+		return errcode.ErrCode_ErrContactRequestNonceInvalid
+	case n.expiresAt != 0 && now.Unix() > n.expiresAt:
+		return errcode.ErrCode_ErrContactRequestExpired
+	}
+
+	return nil
+}
+
+// snapshotCandidate is a snapshot replayed from the log, it is only trusted
+// once its device is known as an admin at the position of the snapshot
+type snapshotCandidate struct {
+	hash        cid.Cid
+	newerEvents int
+}
+
+// epochCommit is a commit of the epoch tree of a multi-member group, the
+// commits are chained by their parent and each one starts a new epoch
+type epochCommit struct {
+	id     cid.Cid
+	epoch  uint64
+	order  int
+	event  *protocoltypes.MultiMemberGroupEpochCommitted
+	parent *ratchettree.Tree
+	tree   *ratchettree.Tree
+}
+
+type invitationRevocation struct {
+	position int
+	event    *protocoltypes.MultiMemberGroupInvitationRevoked
+}
+
 //nolint:revive
 func (m *metadataStoreIndex) Get(key string) interface{} {
 	return nil
@@ -68,10 +192,37 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 	m.contactsFromGroupPK = map[string]*AccountContact{}
 	m.groups = map[string]*accountGroup{}
 	m.contactRequestMetadata = map[string][]byte{}
+	m.contactRequestNonces = map[string]*contactRequestNonce{}
+	m.contactRequestPolicy = nil
+	m.presenceSettings = nil
+	m.readReceiptsDisabled = false
+	m.contactVerifications = map[string][]byte{}
+	m.contactMetadata = map[string][]byte{}
+	m.deviceNames = map[string]*protocoltypes.AccountDeviceNameSet{}
+	m.acknowledgedMessages = map[string]map[string]struct{}{}
+	m.readMessages = map[string]map[string]struct{}{}
+	m.deviceFirstNames = map[string]deviceFirstName{}
+	m.deviceNameEvents = 0
+	m.firstDevice = nil
+	m.settings = map[string]*protocoltypes.AccountSettingSet{}
+	m.acceptedIntroductions = map[string]struct{}{}
 	m.contactRequestEnabled = nil
 	m.contactRequestSeed = []byte(nil)
 	m.verifiedCredentials = nil
 	m.handledEvents = map[string]struct{}{}
+	m.snapshot = nil
+	m.snapshotEntry = cid.Undef
+	m.snapshotCandidates = map[*protocoltypes.MultiMemberGroupSnapshotAdded]snapshotCandidate{}
+	m.epochCommitCandidates = map[*protocoltypes.MultiMemberGroupEpochCommitted]cid.Cid{}
+	m.disappearingEntries = map[*protocoltypes.GroupDisappearingMessagesSet]cid.Cid{}
+	m.eventsSinceSnapshot = 0
+
+	// the parents of the oldest entry are missing once the log has been
+	// compacted
+	m.truncated = len(entries) > 0 && len(entries[0].GetNext()) > 0
+
+	cached := m.loadIndexCache()
+	opened := map[string]*protocoltypes.GroupMetadata{}
 
 	for i := len(entries) - 1; i >= 0; i-- {
 		e := entries[i]
@@ -83,21 +234,25 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 			continue
 		}
 
-		metaEvent, event, err := openMetadataEntry(log, e, m.group)
+		metadata, event, err := m.openIndexEntry(log, e, cached)
 		if err != nil {
 			m.logger.Error("unable to open metadata entry", zap.Error(err))
 			continue
 		}
 
-		handlers, ok := m.eventHandlers[metaEvent.Metadata.EventType]
+		opened[e.GetHash().KeyString()] = metadata
+
+		handlers, ok := m.eventHandlers[metadata.EventType]
 		if !ok {
 			m.handledEvents[e.GetHash().String()] = struct{}{}
-			m.logger.Error("handler for event type not found", zap.String("event-type", metaEvent.Metadata.EventType.String()))
+			m.logger.Error("handler for event type not found", zap.String("event-type", metadata.EventType.String()))
 			continue
 		}
 
 		var lastErr error
 
+		m.eventPosition = i
+		m.eventHash = e.GetHash()
 		for _, h := range handlers {
 			err = h(event)
 			if err != nil {
@@ -112,8 +267,25 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 		}
 
 		m.handledEvents[e.GetHash().String()] = struct{}{}
+
+		// older entries are summarized by the snapshot
+		if m.snapshot != nil {
+			break
+		}
+
+		// a snapshot doesn't count towards the next one, nor do the receipts
+		// it doesn't summarize
+		switch metadata.EventType {
+		case protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded,
+			protocoltypes.EventType_EventTypeGroupMessagesAcknowledged,
+			protocoltypes.EventType_EventTypeGroupMessagesRead:
+		default:
+			m.eventsSinceSnapshot++
+		}
 	}
 
+	m.storeIndexCache(opened)
+
 	for _, h := range m.postIndexActions {
 		if err := h(); err != nil {
 			return errcode.ErrCode_ErrInternal.Wrap(err)
@@ -123,6 +295,83 @@ func (m *metadataStoreIndex) UpdateIndex(log ipfslog.Log, _ []ipfslog.Entry) err
 	return nil
 }
 
+// setIndexCache sets the cache the metadata of the entries of the store is
+// persisted in, the entries are only opened once
+func (m *metadataStoreIndex) setIndexCache(cache *metadataIndexCache, address string) {
+	sealKey, err := indexCacheSealKey(m.group)
+	if err != nil {
+		m.logger.Warn("unable to derive index cache key", zap.Error(err))
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.indexCache = cache
+	m.indexCacheAddress = address
+	m.indexCacheSealKey = sealKey
+}
+
+// loadIndexCache returns the cached metadata of the entries, it is read from
+// the datastore on the first replay of the log and kept in memory then
+func (m *metadataStoreIndex) loadIndexCache() map[string]*protocoltypes.GroupMetadata {
+	if m.indexCache == nil || m.indexCachedMetadata != nil {
+		return m.indexCachedMetadata
+	}
+
+	cached, err := m.indexCache.load(m.ctx, m.indexCacheAddress, m.indexCacheSealKey)
+	if err != nil {
+		m.logger.Warn("unable to load cached index", zap.Error(err))
+
+		// the entries which can't be opened, such as the ones cached in
+		// clear by previous versions, are replaced
+		if err := m.indexCache.reset(m.ctx, m.indexCacheAddress); err != nil {
+			m.logger.Warn("unable to reset cached index", zap.Error(err))
+		}
+
+		cached = map[string]*protocoltypes.GroupMetadata{}
+	}
+
+	m.indexCachedMetadata = cached
+
+	return cached
+}
+
+// storeIndexCache persists the metadata of the entries opened while
+// replaying the log, the entries not replayed anymore are forgotten
+func (m *metadataStoreIndex) storeIndexCache(opened map[string]*protocoltypes.GroupMetadata) {
+	if m.indexCache == nil {
+		return
+	}
+
+	if err := m.indexCache.store(m.ctx, m.indexCacheAddress, m.indexCacheSealKey, opened, m.indexCachedMetadata); err != nil {
+		m.logger.Warn("unable to cache index", zap.Error(err))
+
+		// the cached entries are read again on the next replay
+		m.indexCachedMetadata = nil
+		return
+	}
+
+	m.indexCachedMetadata = opened
+}
+
+// openIndexEntry returns the metadata and the event of the entry, read from
+// cached when available instead of decrypting the entry
+func (m *metadataStoreIndex) openIndexEntry(log ipfslog.Log, e ipfslog.Entry, cached map[string]*protocoltypes.GroupMetadata) (*protocoltypes.GroupMetadata, proto.Message, error) {
+	if metadata, ok := cached[e.GetHash().KeyString()]; ok {
+		if event, err := openCachedMetadata(metadata); err == nil {
+			return metadata, event, nil
+		}
+	}
+
+	metaEvent, event, err := openMetadataEntry(m.ctx, log, e, m.group, m.secretStore)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return metaEvent.Metadata, event, nil
+}
+
 func (m *metadataStoreIndex) handleGroupMemberDeviceAdded(event proto.Message) error {
 	e, ok := event.(*protocoltypes.GroupMemberDeviceAdded)
 	if !ok {
@@ -139,6 +388,21 @@ func (m *metadataStoreIndex) handleGroupMemberDeviceAdded(event proto.Message) e
 		return errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
+	if m.group.GroupType == protocoltypes.GroupType_GroupTypeMultiMember {
+		m.eventsMemberJoined = append(m.eventsMemberJoined, memberJoin{
+			position:   m.eventPosition,
+			memberPK:   e.MemberPk,
+			invitation: e.Invitation,
+			joinedAt:   e.JoinedAt,
+		})
+	}
+
+	// entries are handled from the newest to the oldest, the last device
+	// added to the account group is the first device of the account
+	if m.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		m.firstDevice = e.DevicePk
+	}
+
 	if _, ok := m.devices[string(e.DevicePk)]; ok {
 		return nil
 	}
@@ -157,6 +421,22 @@ func (m *metadataStoreIndex) handleGroupDeviceChainKeyAdded(event proto.Message)
 		return errcode.ErrCode_ErrInvalidInput
 	}
 
+	// the chain keys sent to the devices of an epoch tree are listed by
+	// commit, see listEpochChainKeys
+	if len(e.EpochCommitId) > 0 {
+		commitKeys, ok := m.epochChainKeys[string(e.EpochCommitId)]
+		if !ok {
+			commitKeys = map[string]*protocoltypes.GroupDeviceChainKeyAdded{}
+			m.epochChainKeys[string(e.EpochCommitId)] = commitKeys
+		}
+
+		if _, ok := commitKeys[string(e.DevicePk)]; !ok {
+			commitKeys[string(e.DevicePk)] = e
+		}
+
+		return nil
+	}
+
 	_, err := crypto.UnmarshalEd25519PublicKey(e.DestMemberPk)
 	if err != nil {
 		return errcode.ErrCode_ErrDeserialization.Wrap(err)
@@ -167,599 +447,3170 @@ func (m *metadataStoreIndex) handleGroupDeviceChainKeyAdded(event proto.Message)
 		return errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	if m.ownMemberDevice.Device().Equals(senderPK) {
-		m.sentSecrets[string(e.DestMemberPk)] = struct{}{}
+	if !m.ownMemberDevice.Device().Equals(senderPK) {
+		return nil
+	}
+
+	dest := e.DestMemberPk
+	if len(e.DestDevicePk) > 0 {
+		dest = e.DestDevicePk
+	}
+
+	if epoch, ok := m.sentSecrets[string(dest)]; !ok || e.Epoch > epoch {
+		m.sentSecrets[string(dest)] = e.Epoch
 	}
 
 	return nil
 }
 
-func (m *metadataStoreIndex) getMemberByDevice(devicePublicKey crypto.PubKey) (crypto.PubKey, error) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+// handleGroupDeviceCapabilitiesSet keeps the most recent capabilities
+// announced by each device, they are not reset when the index is updated so
+// the events can be handled in any order
+func (m *metadataStoreIndex) handleGroupDeviceCapabilitiesSet(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupDeviceCapabilitiesSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
 
-	publicKeyBytes, err := devicePublicKey.Raw()
-	if err != nil {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	if previous, ok := m.deviceCapabilities[string(e.DevicePk)]; ok && previous.UpdatedAt >= e.UpdatedAt {
+		return nil
 	}
 
-	return m.unsafeGetMemberByDevice(publicKeyBytes)
+	m.deviceCapabilities[string(e.DevicePk)] = e
+
+	return nil
 }
 
-func (m *metadataStoreIndex) unsafeGetMemberByDevice(publicKeyBytes []byte) (crypto.PubKey, error) {
-	if l := len(publicKeyBytes); l != cryptoutil.KeySize {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid private key size, expected %d got %d", cryptoutil.KeySize, l))
-	}
+// replicationServerKey identifies the registrations of a replication server
+// by a device, or by a member once they are merged
+type replicationServerKey struct {
+	owner  string
+	server string
+}
 
-	device, ok := m.devices[string(publicKeyBytes)]
+// handleGroupReplicating keeps the most recent registration of each
+// replication server by each device, like the capabilities they are not reset
+// when the index is updated
+func (m *metadataStoreIndex) handleGroupReplicating(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupReplicating)
 	if !ok {
-		return nil, errcode.ErrCode_ErrMissingInput
+		return errcode.ErrCode_ErrInvalidInput
 	}
 
-	return device.Member(), nil
-}
-
-func (m *metadataStoreIndex) getDevicesForMember(pk crypto.PubKey) ([]crypto.PubKey, error) {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	if e.ReplicationServer == "" {
+		return nil
+	}
 
-	id, err := pk.Raw()
-	if err != nil {
-		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	key := replicationServerKey{owner: string(e.DevicePk), server: e.ReplicationServer}
+	if previous, ok := m.replicationServers[key]; ok && previous.UpdatedAt >= e.UpdatedAt {
+		return nil
 	}
 
-	mds, ok := m.members[string(id)]
+	m.replicationServers[key] = e
+
+	return nil
+}
+
+// handleGroupMessagesAcknowledged records the messages acknowledged by a
+// device, the acknowledgements are only added so the events can be handled in
+// any order. They are rebuilt on each update, the acknowledgements of the
+// messages pruned from the log are dropped when it is compacted.
+func (m *metadataStoreIndex) handleGroupMessagesAcknowledged(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupMessagesAcknowledged)
 	if !ok {
-		return nil, errcode.ErrCode_ErrInvalidInput
+		return errcode.ErrCode_ErrInvalidInput
 	}
 
-	ret := make([]crypto.PubKey, len(mds))
-	for i, md := range mds {
-		ret[i] = md.Device()
+	addMessageReceipts(m.acknowledgedMessages, e.DevicePk, e.Cids)
+
+	return nil
+}
+
+// handleGroupMessagesRead records the messages read on a device
+func (m *metadataStoreIndex) handleGroupMessagesRead(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupMessagesRead)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
 	}
 
-	return ret, nil
+	addMessageReceipts(m.readMessages, e.DevicePk, e.Cids)
+
+	return nil
 }
 
-func (m *metadataStoreIndex) MemberCount() int {
+func addMessageReceipts(receipts map[string]map[string]struct{}, devicePK []byte, ids [][]byte) {
+	for _, id := range ids {
+		devices, ok := receipts[string(id)]
+		if !ok {
+			devices = map[string]struct{}{}
+			receipts[string(id)] = devices
+		}
+
+		devices[string(devicePK)] = struct{}{}
+	}
+}
+
+// isMessageAcknowledged returns true if the device has acknowledged the
+// reception of the message
+func (m *metadataStoreIndex) isMessageAcknowledged(id []byte, devicePK []byte) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return len(m.members)
+	_, ok := m.acknowledgedMessages[string(id)][string(devicePK)]
+	return ok
 }
 
-func (m *metadataStoreIndex) DeviceCount() int {
+// isMessageRead returns true if the device has sent a read receipt for the
+// message
+func (m *metadataStoreIndex) isMessageRead(id []byte, devicePK []byte) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return len(m.devices)
+	_, ok := m.readMessages[string(id)][string(devicePK)]
+	return ok
 }
 
-func (m *metadataStoreIndex) listContacts() map[string]*AccountContact {
+// listMessageDeliveryStatus returns the active devices of the group other than
+// the sender of the message, with whether they have acknowledged and read it,
+// sorted by member and device. The revoked and retired devices and the
+// devices of the removed and banned members are left out.
+func (m *metadataStoreIndex) listMessageDeliveryStatus(id []byte, senderPK []byte) []*protocoltypes.MessageDeliveryStatus_Device {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	contacts := make(map[string]*AccountContact)
+	acknowledged, read := m.acknowledgedMessages[string(id)], m.readMessages[string(id)]
 
-	for k, contact := range m.contacts {
-		contacts[k] = &AccountContact{
-			state: contact.state,
-			contact: &protocoltypes.ShareableContact{
-				Pk:                   contact.contact.Pk,
-				PublicRendezvousSeed: contact.contact.PublicRendezvousSeed,
-				Metadata:             contact.contact.Metadata,
-			},
+	devices := make([]*protocoltypes.MessageDeliveryStatus_Device, 0, len(m.devices))
+	for pk, md := range m.devices {
+		if pk == string(senderPK) || !m.unsafeIsActiveDevice([]byte(pk)) {
+			continue
+		}
+
+		if _, retired := m.rotatedDevices[pk]; retired {
+			continue
+		}
+
+		memberPK, err := md.Member().Raw()
+		if err != nil {
+			continue
+		}
+
+		if _, removed := m.removedMembers[string(memberPK)]; removed {
+			continue
+		}
+
+		if _, banned := m.bannedMembers[string(memberPK)]; banned {
+			continue
 		}
+
+		_, isAcknowledged := acknowledged[pk]
+		_, isRead := read[pk]
+		devices = append(devices, &protocoltypes.MessageDeliveryStatus_Device{
+			MemberPk:     memberPK,
+			DevicePk:     []byte(pk),
+			Acknowledged: isAcknowledged || isRead,
+			Read:         isRead,
+		})
 	}
 
-	return contacts
+	sort.Slice(devices, func(i, j int) bool {
+		if c := bytes.Compare(devices[i].MemberPk, devices[j].MemberPk); c != 0 {
+			return c < 0
+		}
+
+		return bytes.Compare(devices[i].DevicePk, devices[j].DevicePk) < 0
+	})
+
+	return devices
 }
 
-func (m *metadataStoreIndex) listVerifiedCredentials() []*protocoltypes.AccountVerifiedCredentialRegistered {
+// getDeviceCapabilities returns the capabilities announced by a device, nil if
+// it hasn't announced any
+func (m *metadataStoreIndex) getDeviceCapabilities(devicePK []byte) *protocoltypes.DeviceCapabilities {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return m.verifiedCredentials
+	if e, ok := m.deviceCapabilities[string(devicePK)]; ok {
+		return e.Capabilities
+	}
+
+	return nil
 }
 
-func (m *metadataStoreIndex) listMembers() []crypto.PubKey {
+// getDeviceCapabilitiesUpdatedAt returns the time of the latest capabilities
+// announced by a device, 0 if it hasn't announced any
+func (m *metadataStoreIndex) getDeviceCapabilitiesUpdatedAt(devicePK []byte) int64 {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	members := make([]crypto.PubKey, len(m.members))
-	i := 0
-
-	for _, md := range m.members {
-		members[i] = md[0].Member()
-		i++
+	if e, ok := m.deviceCapabilities[string(devicePK)]; ok {
+		return e.UpdatedAt
 	}
 
-	return members
+	return 0
 }
 
-func (m *metadataStoreIndex) listDevices() []crypto.PubKey {
+// listReplicationServers returns the registrations of the replication
+// servers which haven't been unregistered nor expired at now, sorted by server.
+// The latest registration of each member is kept, a member unregistering a
+// server doesn't hide the registrations of the other members. A server
+// registered by several members is listed once, with the registration
+// expiring last. The events written before the expiry was recorded never
+// expire, as when they were written.
+func (m *metadataStoreIndex) listReplicationServers(now time.Time) []*protocoltypes.GroupReplicating {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	devices := make([]crypto.PubKey, len(m.devices))
-	i := 0
+	latest := map[replicationServerKey]*protocoltypes.GroupReplicating{}
+	for key, e := range m.replicationServers {
+		member := key.owner
+		if md, ok := m.devices[key.owner]; ok {
+			if memberPK, err := md.Member().Raw(); err == nil {
+				member = string(memberPK)
+			}
+		}
 
-	for _, md := range m.devices {
-		devices[i] = md.Device()
-		i++
+		key.owner = member
+		if previous, ok := latest[key]; ok && previous.UpdatedAt >= e.UpdatedAt {
+			continue
+		}
+
+		latest[key] = e
 	}
 
-	return devices
+	live := map[string]*protocoltypes.GroupReplicating{}
+	for _, e := range latest {
+		if e.Unregistered || (e.ExpiresAt != 0 && e.ExpiresAt <= now.UnixNano()) {
+			continue
+		}
+
+		if previous, ok := live[e.ReplicationServer]; ok && !replicationExpiresAfter(e, previous) {
+			continue
+		}
+
+		live[e.ReplicationServer] = e
+	}
+
+	servers := make([]*protocoltypes.GroupReplicating, 0, len(live))
+	for _, e := range live {
+		servers = append(servers, e)
+	}
+
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].ReplicationServer < servers[j].ReplicationServer
+	})
+
+	return servers
+}
+
+// replicationExpiresAfter returns true if the registration a expires after b,
+// the registrations without expiry never expire, the latest one is kept
+// between the registrations expiring at the same time
+func replicationExpiresAfter(a, b *protocoltypes.GroupReplicating) bool {
+	switch {
+	case a.ExpiresAt == b.ExpiresAt:
+		if a.UpdatedAt != b.UpdatedAt {
+			return a.UpdatedAt > b.UpdatedAt
+		}
+
+		return bytes.Compare(a.DevicePk, b.DevicePk) < 0
+	case a.ExpiresAt == 0:
+		return true
+	case b.ExpiresAt == 0:
+		return false
+	default:
+		return a.ExpiresAt > b.ExpiresAt
+	}
 }
 
-func (m *metadataStoreIndex) areSecretsAlreadySent(pk crypto.PubKey) (bool, error) {
+// listDeviceCapabilities returns the devices of the group with the
+// capabilities they have announced, sorted by member and device
+func (m *metadataStoreIndex) listDeviceCapabilities() []*protocoltypes.GroupDeviceCapabilities_Device {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	key, err := pk.Raw()
-	if err != nil {
-		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
-	}
+	devices := make([]*protocoltypes.GroupDeviceCapabilities_Device, 0, len(m.devices))
+	for pk, md := range m.devices {
+		memberPK, err := md.Member().Raw()
+		if err != nil {
+			continue
+		}
 
-	_, ok := m.sentSecrets[string(key)]
-	return ok, nil
-}
+		device := &protocoltypes.GroupDeviceCapabilities_Device{
+			MemberPk:     memberPK,
+			DevicePk:     []byte(pk),
+			Capabilities: &protocoltypes.DeviceCapabilities{},
+		}
 
-type accountGroupJoinedState uint32
+		if e, ok := m.deviceCapabilities[pk]; ok && e.Capabilities != nil {
+			device.Capabilities = e.Capabilities
+		}
 
-const (
-	accountGroupJoinedStateJoined accountGroupJoinedState = iota + 1
-	accountGroupJoinedStateLeft
-)
+		devices = append(devices, device)
+	}
 
-type accountGroup struct {
-	state accountGroupJoinedState
-	group *protocoltypes.Group
-}
+	sort.Slice(devices, func(i, j int) bool {
+		if c := bytes.Compare(devices[i].MemberPk, devices[j].MemberPk); c != 0 {
+			return c < 0
+		}
 
-type AccountContact struct {
-	state   protocoltypes.ContactState
-	contact *protocoltypes.ShareableContact
+		return bytes.Compare(devices[i].DevicePk, devices[j].DevicePk) < 0
+	})
+
+	return devices
 }
 
-func (m *metadataStoreIndex) handleGroupJoined(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountGroupJoined)
+// handleGroupDeviceKeyRotated records the retirement of the previous key of a
+// device, the new key joins the group as any other device. If a key has been
+// rotated several times the earliest retirement is kept.
+func (m *metadataStoreIndex) handleGroupDeviceKeyRotated(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupDeviceKeyRotated)
 	if !ok {
 		return errcode.ErrCode_ErrInvalidInput
 	}
 
-	_, ok = m.groups[string(evt.Group.PublicKey)]
-	if ok {
-		return nil
+	newDevicePK, err := crypto.UnmarshalEd25519PublicKey(e.NewDevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
 	}
 
-	m.groups[string(evt.Group.PublicKey)] = &accountGroup{
-		group: evt.Group,
-		state: accountGroupJoinedStateJoined,
+	// the new key must agree to replace the previous one
+	ok, err = newDevicePK.Verify(e.DevicePk, e.NewDeviceSig)
+	if err != nil {
+		return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(err)
 	}
 
-	return nil
-}
-
-func (m *metadataStoreIndex) handleGroupLeft(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountGroupLeft)
 	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+		return errcode.ErrCode_ErrCryptoSignatureVerification
 	}
 
-	_, ok = m.groups[string(evt.GroupPk)]
-	if ok {
-		return nil
+	// the primary role of the account follows the key of the device
+	if m.group.GroupType == protocoltypes.GroupType_GroupTypeAccount {
+		m.eventsModeration = append(m.eventsModeration, e)
 	}
 
-	m.groups[string(evt.GroupPk)] = &accountGroup{
-		state: accountGroupJoinedStateLeft,
+	if previous, ok := m.rotatedDevices[string(e.DevicePk)]; ok && previous.RetiredAt <= e.RetiredAt {
+		return nil
 	}
 
+	m.rotatedDevices[string(e.DevicePk)] = e
+
 	return nil
 }
 
-func (m *metadataStoreIndex) handleContactRequestDisabled(event proto.Message) error {
-	if m.contactRequestEnabled != nil {
-		return nil
-	}
+// isDeviceRetired returns true if the key of the device has been rotated and
+// its grace period is over
+func (m *metadataStoreIndex) isDeviceRetired(devicePK []byte, now time.Time) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	_, ok := event.(*protocoltypes.AccountContactRequestDisabled)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+	e, ok := m.rotatedDevices[string(devicePK)]
+	return ok && now.Unix() >= e.RetiredAt
+}
+
+// isSameDevice returns true if devicePK is previousPK or one of the keys
+// which replaced it through the key rotations of the device
+func (m *metadataStoreIndex) isSameDevice(previousPK, devicePK []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	// each rotation is followed once, a cycle can't loop forever
+	pk := previousPK
+	for i := 0; i <= len(m.rotatedDevices); i++ {
+		if bytes.Equal(pk, devicePK) {
+			return true
+		}
+
+		e, ok := m.rotatedDevices[string(pk)]
+		if !ok {
+			return false
+		}
+
+		pk = e.NewDevicePk
 	}
 
-	f := false
-	m.contactRequestEnabled = &f
+	return false
+}
 
-	return nil
+func (m *metadataStoreIndex) getMemberByDevice(devicePublicKey crypto.PubKey) (crypto.PubKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	publicKeyBytes, err := devicePublicKey.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	return m.unsafeGetMemberByDevice(publicKeyBytes)
 }
 
-func (m *metadataStoreIndex) handleContactRequestEnabled(event proto.Message) error {
-	if m.contactRequestEnabled != nil {
-		return nil
+func (m *metadataStoreIndex) unsafeGetMemberByDevice(publicKeyBytes []byte) (crypto.PubKey, error) {
+	if l := len(publicKeyBytes); l != cryptoutil.KeySize {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid private key size, expected %d got %d", cryptoutil.KeySize, l))
 	}
 
-	_, ok := event.(*protocoltypes.AccountContactRequestEnabled)
+	device, ok := m.devices[string(publicKeyBytes)]
 	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+		return nil, errcode.ErrCode_ErrMissingInput
 	}
 
-	t := true
-	m.contactRequestEnabled = &t
-
-	return nil
+	return device.Member(), nil
 }
 
-func (m *metadataStoreIndex) handleContactRequestReferenceReset(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestReferenceReset)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+func (m *metadataStoreIndex) getDevicesForMember(pk crypto.PubKey) ([]crypto.PubKey, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	id, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	if m.contactRequestSeed != nil {
-		return nil
+	mds, ok := m.members[string(id)]
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput
 	}
 
-	m.contactRequestSeed = evt.PublicRendezvousSeed
+	ret := make([]crypto.PubKey, len(mds))
+	for i, md := range mds {
+		ret[i] = md.Device()
+	}
 
-	return nil
+	return ret, nil
 }
 
-func (m *metadataStoreIndex) registerContactFromGroupPK(ac *AccountContact) error {
-	if m.group.GroupType != protocoltypes.GroupType_GroupTypeAccount {
-		return errcode.ErrCode_ErrGroupInvalidType
-	}
+// getActiveDevicesOfRevokedMember returns the devices of the member which
+// aren't revoked, false if none of its devices has been revoked
+func (m *metadataStoreIndex) getActiveDevicesOfRevokedMember(pk crypto.PubKey) ([]crypto.PubKey, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	contactPK, err := crypto.UnmarshalEd25519PublicKey(ac.contact.Pk)
+	id, err := pk.Raw()
 	if err != nil {
-		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		return nil, false
 	}
 
-	group, err := m.secretStore.GetGroupForContact(contactPK)
-	if err != nil {
-		return errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+	revoked := false
+	devices := []crypto.PubKey(nil)
+	for _, md := range m.members[string(id)] {
+		raw, err := md.Device().Raw()
+		if err != nil {
+			continue
+		}
+
+		if _, ok := m.revokedDevices[string(raw)]; ok {
+			revoked = true
+			continue
+		}
+
+		devices = append(devices, md.Device())
 	}
 
-	m.contactsFromGroupPK[string(group.PublicKey)] = ac
+	return devices, revoked
+}
 
-	return nil
+func (m *metadataStoreIndex) MemberCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	count := 0
+	for pk := range m.members {
+		if m.unsafeIsMemberActive(pk) {
+			count++
+		}
+	}
+
+	return count
 }
 
-func (m *metadataStoreIndex) handleContactRequestOutgoingEnqueued(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestOutgoingEnqueued)
-	if ko := !ok || evt.Contact == nil; ko {
-		return errcode.ErrCode_ErrInvalidInput
+func (m *metadataStoreIndex) DeviceCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	count := 0
+	for pk, mds := range m.members {
+		if m.unsafeIsMemberActive(pk) {
+			count += len(mds)
+		}
 	}
 
-	if _, ok := m.contacts[string(evt.Contact.Pk)]; ok {
-		if m.contacts[string(evt.Contact.Pk)].contact.Metadata == nil {
-			m.contacts[string(evt.Contact.Pk)].contact.Metadata = evt.Contact.Metadata
+	return count
+}
+
+func (m *metadataStoreIndex) listContacts() map[string]*AccountContact {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	contacts := make(map[string]*AccountContact)
+
+	for k, contact := range m.contacts {
+		contacts[k] = &AccountContact{
+			state: contact.state,
+			contact: &protocoltypes.ShareableContact{
+				Pk:                   contact.contact.Pk,
+				PublicRendezvousSeed: contact.contact.PublicRendezvousSeed,
+				Metadata:             contact.contact.Metadata,
+			},
 		}
+	}
 
-		if m.contacts[string(evt.Contact.Pk)].contact.PublicRendezvousSeed == nil {
-			m.contacts[string(evt.Contact.Pk)].contact.PublicRendezvousSeed = evt.Contact.PublicRendezvousSeed
+	return contacts
+}
+
+func (m *metadataStoreIndex) listVerifiedCredentials() []*protocoltypes.AccountVerifiedCredentialRegistered {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.verifiedCredentials
+}
+
+func (m *metadataStoreIndex) listMembers() []crypto.PubKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	members := make([]crypto.PubKey, 0, len(m.members))
+
+	for pk, md := range m.members {
+		if !m.unsafeIsMemberActive(pk) {
+			continue
 		}
 
-		return nil
+		members = append(members, md[0].Member())
 	}
 
-	if data, ok := m.contactRequestMetadata[string(evt.Contact.Pk)]; !ok || len(data) == 0 {
-		m.contactRequestMetadata[string(evt.Contact.Pk)] = evt.OwnMetadata
+	return members
+}
+
+func (m *metadataStoreIndex) listDevices() []crypto.PubKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	devices := make([]crypto.PubKey, 0, len(m.devices))
+
+	for pk, mds := range m.members {
+		if !m.unsafeIsMemberActive(pk) {
+			continue
+		}
+
+		for _, md := range mds {
+			devices = append(devices, md.Device())
+		}
 	}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateToRequest,
-		contact: &protocoltypes.ShareableContact{
-			Pk:                   evt.Contact.Pk,
-			Metadata:             evt.Contact.Metadata,
-			PublicRendezvousSeed: evt.Contact.PublicRendezvousSeed,
-		},
+	return devices
+}
+
+// areSecretsAlreadySent returns true if the current device chain key has
+// been sent to the given member for the given epoch
+func (m *metadataStoreIndex) areSecretsAlreadySent(pk crypto.PubKey, epoch uint64) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, err := pk.Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	m.contacts[string(evt.Contact.Pk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	if sentEpoch, ok := m.sentSecrets[string(key)]; ok && sentEpoch >= epoch {
+		return true, nil
+	}
 
-	return err
+	sentEpoch, ok := m.checkpointSentSecrets[string(key)]
+	return ok && sentEpoch >= epoch, nil
 }
 
-func (m *metadataStoreIndex) handleContactRequestOutgoingSent(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestOutgoingSent)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+// sentSecretEpochs returns the latest epoch of the chain key sent to each
+// member
+func (m *metadataStoreIndex) sentSecretEpochs() map[string]uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	epochs := make(map[string]uint64, len(m.sentSecrets)+len(m.checkpointSentSecrets))
+	for _, secrets := range []map[string]uint64{m.checkpointSentSecrets, m.sentSecrets} {
+		for memberPK, epoch := range secrets {
+			if sent, ok := epochs[memberPK]; !ok || epoch > sent {
+				epochs[memberPK] = epoch
+			}
+		}
 	}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		return nil
+	return epochs
+}
+
+// setCheckpointSentSecrets sets the chain keys sent in the entries removed
+// from the log by the compaction
+func (m *metadataStoreIndex) setCheckpointSentSecrets(sentSecrets []*protocoltypes.LogCheckpoint_SentSecret) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.checkpointSentSecrets = make(map[string]uint64, len(sentSecrets))
+	for _, sent := range sentSecrets {
+		m.checkpointSentSecrets[string(sent.MemberPk)] = sent.Epoch
 	}
+}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateAdded,
-		contact: &protocoltypes.ShareableContact{
-			Pk: evt.ContactPk,
-		},
+// snapshotCheckpoint returns the entry of the newest snapshot verified by the
+// replay of the log, the entries preceding it are summarized by the snapshot
+func (m *metadataStoreIndex) snapshotCheckpoint() cid.Cid {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.snapshotEntry
+}
+
+func (m *metadataStoreIndex) isMemberRemoved(pk crypto.PubKey) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, err := pk.Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	_, ok := m.removedMembers[string(key)]
+	return ok, nil
+}
 
-	return err
+func (m *metadataStoreIndex) isMemberPending(pk crypto.PubKey) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, err := pk.Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
+	}
+
+	_, ok := m.pendingMembers[string(key)]
+	return ok, nil
 }
 
-func (m *metadataStoreIndex) handleContactRequestIncomingReceived(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingReceived)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+func (m *metadataStoreIndex) isMemberBanned(pk crypto.PubKey) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	key, err := pk.Raw()
+	if err != nil {
+		return false, errcode.ErrCode_ErrInvalidInput.Wrap(err)
 	}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		if m.contacts[string(evt.ContactPk)].contact.Metadata == nil {
-			m.contacts[string(evt.ContactPk)].contact.Metadata = evt.ContactMetadata
+	_, ok := m.bannedMembers[string(key)]
+	return ok, nil
+}
+
+// getMembership returns the devices of the active members and the banned
+// members of the group
+func (m *metadataStoreIndex) getMembership() *groupMembership {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	membership := &groupMembership{
+		devices: make(map[string][]string, len(m.members)),
+		banned:  make(map[string]struct{}, len(m.bannedMembers)),
+	}
+
+	for pk, mds := range m.members {
+		if !m.unsafeIsMemberActive(pk) {
+			continue
 		}
 
-		if m.contacts[string(evt.ContactPk)].contact.PublicRendezvousSeed == nil {
-			m.contacts[string(evt.ContactPk)].contact.PublicRendezvousSeed = evt.ContactRendezvousSeed
+		for _, md := range mds {
+			if devicePK, err := md.Device().Raw(); err == nil {
+				membership.devices[pk] = append(membership.devices[pk], string(devicePK))
+			}
 		}
+	}
 
-		return nil
+	for pk := range m.bannedMembers {
+		membership.banned[pk] = struct{}{}
 	}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateReceived,
-		contact: &protocoltypes.ShareableContact{
-			Pk:                   evt.ContactPk,
-			Metadata:             evt.ContactMetadata,
-			PublicRendezvousSeed: evt.ContactRendezvousSeed,
-		},
+	return membership
+}
+
+func (m *metadataStoreIndex) listBannedMembers() [][]byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	banned := make([][]byte, 0, len(m.bannedMembers))
+	for pk := range m.bannedMembers {
+		banned = append(banned, []byte(pk))
+	}
+
+	return banned
+}
+
+// isDeviceRevoked returns true if the device has been revoked by its member
+func (m *metadataStoreIndex) isDeviceRevoked(devicePublicKeyBytes []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.revokedDevices[string(devicePublicKeyBytes)]
+	return ok
+}
+
+// unsafeRevokeDevice checks that a device revocation has been sent by a
+// device of the same member which isn't revoked itself, then revokes it
+func (m *metadataStoreIndex) unsafeRevokeDevice(senderPK []byte, revokedPK []byte) bool {
+	if _, ok := m.revokedDevices[string(senderPK)]; ok {
+		return false
+	}
+
+	sender, ok := m.devices[string(senderPK)]
+	if !ok {
+		return false
+	}
+
+	revoked, ok := m.devices[string(revokedPK)]
+	if !ok || !revoked.Member().Equals(sender.Member()) || revoked.Device().Equals(sender.Device()) {
+		return false
+	}
+
+	m.revokedDevices[string(revokedPK)] = struct{}{}
+
+	return true
+}
+
+// unsafeIsMemberActive returns false if the member has been removed, is
+// banned or is waiting for an admin approval
+func (m *metadataStoreIndex) unsafeIsMemberActive(memberPK string) bool {
+	if _, ok := m.removedMembers[memberPK]; ok {
+		return false
+	}
+
+	if _, ok := m.bannedMembers[memberPK]; ok {
+		return false
+	}
+
+	_, ok := m.pendingMembers[memberPK]
+	return !ok
+}
+
+// listJoinRequests returns the members waiting for an admin approval
+func (m *metadataStoreIndex) listJoinRequests() []*protocoltypes.GroupJoinRequestList_Reply {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	requests := make([]*protocoltypes.GroupJoinRequestList_Reply, 0, len(m.pendingMembers))
+	for pk, invitationID := range m.pendingMembers {
+		request := &protocoltypes.GroupJoinRequestList_Reply{
+			MemberPk:     []byte(pk),
+			InvitationId: invitationID,
+		}
+
+		for _, md := range m.members[pk] {
+			if devicePK, err := md.Device().Raw(); err == nil {
+				request.DevicePks = append(request.DevicePks, devicePK)
+			}
+		}
+
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+func (m *metadataStoreIndex) isAdminDevice(devicePublicKeyBytes []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.unsafeIsAdminDevice(devicePublicKeyBytes)
+}
+
+// canDevicePublish returns true if the device is allowed to send messages,
+// members waiting for an approval can't, and in broadcast mode only the
+// devices of moderators and admins can
+func (m *metadataStoreIndex) canDevicePublish(devicePublicKeyBytes []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	member, err := m.unsafeGetMemberByDevice(devicePublicKeyBytes)
+	if err != nil {
+		return !m.broadcastMode
+	}
+
+	memberRaw, err := member.Raw()
+	if err != nil {
+		return false
+	}
+
+	if _, ok := m.pendingMembers[string(memberRaw)]; ok {
+		return false
+	}
+
+	if !m.broadcastMode {
+		return true
+	}
+
+	return m.unsafeGetRole(memberRaw) >= protocoltypes.GroupMemberRole_GroupMemberRoleModerator
+}
+
+func (m *metadataStoreIndex) isBroadcastMode() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.broadcastMode
+}
+
+// getPublicMode returns the latest public descriptor set by an admin, nil if
+// the group isn't public or if the invitation of the descriptor has been
+// revoked
+func (m *metadataStoreIndex) getPublicMode() *protocoltypes.MultiMemberGroupPublicModeSet {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.publicMode == nil || !m.publicMode.Enabled || m.publicMode.Invitation == nil {
+		return nil
+	}
+
+	if _, ok := m.revokedInvitations[string(m.publicMode.Invitation.Id)]; ok {
+		return nil
+	}
+
+	return m.publicMode
+}
+
+func (m *metadataStoreIndex) isOwner(memberPublicKeyBytes []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.unsafeIsOwner(memberPublicKeyBytes)
+}
+
+// listRoles returns the role of each member of the group, indexed by the
+// member public key
+func (m *metadataStoreIndex) listRoles() map[string]protocoltypes.GroupMemberRole {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	roles := make(map[string]protocoltypes.GroupMemberRole, len(m.members))
+
+	for pk := range m.members {
+		if !m.unsafeIsMemberActive(pk) {
+			continue
+		}
+
+		roles[pk] = m.unsafeGetRole([]byte(pk))
+	}
+
+	return roles
+}
+
+// getChainKeyEpoch returns the epoch device chain keys must have reached.
+// Once a multi-member group has an epoch tree it is the epoch of the current
+// commit, advanced by every membership change. Before that, and for the
+// other groups, it is increased each time a member is removed or banned, a
+// device is revoked, and by each secret rotation or session reset.
+func (m *metadataStoreIndex) getChainKeyEpoch() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.chainKeyEpoch
+}
+
+type accountGroupJoinedState uint32
+
+const (
+	accountGroupJoinedStateJoined accountGroupJoinedState = iota + 1
+	accountGroupJoinedStateLeft
+)
+
+type accountGroup struct {
+	state accountGroupJoinedState
+	group *protocoltypes.Group
+}
+
+type AccountContact struct {
+	state   protocoltypes.ContactState
+	contact *protocoltypes.ShareableContact
+}
+
+func (m *metadataStoreIndex) handleGroupJoined(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountGroupJoined)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	_, ok = m.groups[string(evt.Group.PublicKey)]
+	if ok {
+		return nil
+	}
+
+	m.groups[string(evt.Group.PublicKey)] = &accountGroup{
+		group: evt.Group,
+		state: accountGroupJoinedStateJoined,
+	}
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupLeft(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountGroupLeft)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	_, ok = m.groups[string(evt.GroupPk)]
+	if ok {
+		return nil
+	}
+
+	m.groups[string(evt.GroupPk)] = &accountGroup{
+		state: accountGroupJoinedStateLeft,
+	}
+
+	return nil
+}
+
+// handleAccountPolicyChanged is handled once the primary device is known,
+// the policies of the account can only be changed by the primary device
+func (m *metadataStoreIndex) handleAccountPolicyChanged(event proto.Message) error {
+	switch event.(type) {
+	case *protocoltypes.AccountContactRequestDisabled,
+		*protocoltypes.AccountContactRequestEnabled,
+		*protocoltypes.AccountContactRequestReferenceReset,
+		*protocoltypes.AccountContactRequestPolicySet,
+		*protocoltypes.AccountPresenceSettingsSet,
+		*protocoltypes.AccountReadReceiptsSet:
+	default:
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, event)
+
+	return nil
+}
+
+// unsafeApplyAccountPolicy applies a policy change, the changes are applied
+// from the oldest to the newest
+func (m *metadataStoreIndex) unsafeApplyAccountPolicy(event proto.Message) {
+	switch evt := event.(type) {
+	case *protocoltypes.AccountContactRequestDisabled:
+		f := false
+		m.contactRequestEnabled = &f
+
+	case *protocoltypes.AccountContactRequestEnabled:
+		t := true
+		m.contactRequestEnabled = &t
+
+	case *protocoltypes.AccountContactRequestReferenceReset:
+		m.contactRequestSeed = evt.PublicRendezvousSeed
+
+	case *protocoltypes.AccountContactRequestPolicySet:
+		m.contactRequestPolicy = evt.Policy
+		if m.contactRequestPolicy == nil {
+			m.contactRequestPolicy = &protocoltypes.ContactRequestPolicy{}
+		}
+
+	case *protocoltypes.AccountPresenceSettingsSet:
+		m.presenceSettings = evt.Settings
+		if m.presenceSettings == nil {
+			m.presenceSettings = &protocoltypes.PresenceSettings{}
+		}
+
+	case *protocoltypes.AccountReadReceiptsSet:
+		m.readReceiptsDisabled = evt.Disabled
+	}
+}
+
+// handlePrimaryDevice is handled once all the devices are known, the primary
+// role belongs to the first device of the account, it is then transferred and
+// links the new devices
+func (m *metadataStoreIndex) handlePrimaryDevice(event proto.Message) error {
+	switch event.(type) {
+	case *protocoltypes.AccountDeviceLinked,
+		*protocoltypes.AccountPrimaryDeviceClaimed,
+		*protocoltypes.AccountPrimaryDeviceTransferProposed,
+		*protocoltypes.AccountPrimaryDeviceTransferAccepted:
+	default:
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, event)
+
+	return nil
+}
+
+// unsafeCanManageAccount returns true if the device can link and revoke
+// devices and change the policies of the account, any device can until a
+// primary device is designated
+func (m *metadataStoreIndex) unsafeCanManageAccount(devicePK []byte) bool {
+	return m.primaryDevice == nil || bytes.Equal(m.primaryDevice, devicePK)
+}
+
+// unsafeIsFirstDeviceKnown returns true if the device which created the
+// account is known, it isn't once the beginning of the log is missing
+func (m *metadataStoreIndex) unsafeIsFirstDeviceKnown() bool {
+	return m.group.GroupType == protocoltypes.GroupType_GroupTypeAccount && m.firstDevice != nil && !m.truncated
+}
+
+// unsafeIsLinkedDevice returns true if the device is the first device of the
+// account or has been linked by the primary device, every device is linked
+// when the first device of the account is unknown
+func (m *metadataStoreIndex) unsafeIsLinkedDevice(devicePK []byte) bool {
+	if !m.unsafeIsFirstDeviceKnown() {
+		return true
+	}
+
+	_, ok := m.linkedDevices[string(devicePK)]
+	return ok
+}
+
+// unsafeIsActiveDevice returns true if the device is known and not revoked
+func (m *metadataStoreIndex) unsafeIsActiveDevice(devicePK []byte) bool {
+	if _, ok := m.devices[string(devicePK)]; !ok {
+		return false
+	}
+
+	_, revoked := m.revokedDevices[string(devicePK)]
+	return !revoked
+}
+
+// isDeviceLinked returns true if the device is the first device of the
+// account or has been linked by the primary device
+func (m *metadataStoreIndex) isDeviceLinked(devicePK []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.unsafeIsLinkedDevice(devicePK)
+}
+
+// getPrimaryDevice returns the primary device of the account, nil if none
+// has been designated
+func (m *metadataStoreIndex) getPrimaryDevice() []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.primaryDevice
+}
+
+// getPrimaryTransfer returns the device the primary role has been proposed
+// to, nil if no transfer is pending
+func (m *metadataStoreIndex) getPrimaryTransfer() []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.primaryTransfer
+}
+
+func (m *metadataStoreIndex) registerContactFromGroupPK(ac *AccountContact) error {
+	if m.group.GroupType != protocoltypes.GroupType_GroupTypeAccount {
+		return errcode.ErrCode_ErrGroupInvalidType
+	}
+
+	contactPK, err := crypto.UnmarshalEd25519PublicKey(ac.contact.Pk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	group, err := m.secretStore.GetGroupForContact(contactPK)
+	if err != nil {
+		return errcode.ErrCode_ErrOrbitDBOpen.Wrap(err)
+	}
+
+	m.contactsFromGroupPK[string(group.PublicKey)] = ac
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleContactRequestOutgoingEnqueued(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestOutgoingEnqueued)
+	if ko := !ok || evt.Contact == nil; ko {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.Contact.Pk)]; ok {
+		if m.contacts[string(evt.Contact.Pk)].contact.Metadata == nil {
+			m.contacts[string(evt.Contact.Pk)].contact.Metadata = evt.Contact.Metadata
+		}
+
+		if m.contacts[string(evt.Contact.Pk)].contact.PublicRendezvousSeed == nil {
+			m.contacts[string(evt.Contact.Pk)].contact.PublicRendezvousSeed = evt.Contact.PublicRendezvousSeed
+		}
+
+		return nil
+	}
+
+	if data, ok := m.contactRequestMetadata[string(evt.Contact.Pk)]; !ok || len(data) == 0 {
+		m.contactRequestMetadata[string(evt.Contact.Pk)] = evt.OwnMetadata
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateToRequest,
+		contact: &protocoltypes.ShareableContact{
+			Pk:                    evt.Contact.Pk,
+			Metadata:              evt.Contact.Metadata,
+			PublicRendezvousSeed:  evt.Contact.PublicRendezvousSeed,
+			ExpiresAt:             evt.Contact.ExpiresAt,
+			Nonce:                 evt.Contact.Nonce,
+			Passphrase:            evt.Contact.Passphrase,
+			ProofOfWorkDifficulty: evt.Contact.ProofOfWorkDifficulty,
+		},
+	}
+
+	m.contacts[string(evt.Contact.Pk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactRequestOutgoingSent(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestOutgoingSent)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateAdded,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactRequestIncomingReceived(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingReceived)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if len(evt.Nonce) > 0 {
+		m.getContactRequestNonce(evt.Nonce).consumed = true
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		if m.contacts[string(evt.ContactPk)].contact.Metadata == nil {
+			m.contacts[string(evt.ContactPk)].contact.Metadata = evt.ContactMetadata
+		}
+
+		if m.contacts[string(evt.ContactPk)].contact.PublicRendezvousSeed == nil {
+			m.contacts[string(evt.ContactPk)].contact.PublicRendezvousSeed = evt.ContactRendezvousSeed
+		}
+
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateReceived,
+		contact: &protocoltypes.ShareableContact{
+			Pk:                   evt.ContactPk,
+			Metadata:             evt.ContactMetadata,
+			PublicRendezvousSeed: evt.ContactRendezvousSeed,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactRequestNonceRegistered(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestNonceRegistered)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	// events are handled from the newest to the oldest, the nonce may have
+	// already been marked as consumed
+	nonce := m.getContactRequestNonce(evt.Nonce)
+	nonce.registered = true
+	nonce.expiresAt = evt.ExpiresAt
+	nonce.singleUse = evt.SingleUse
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleContactVerified(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactVerified)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contactVerifications[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	m.contactVerifications[string(evt.ContactPk)] = evt.Fingerprint
+
+	return nil
+}
+
+// getContactVerification returns the verification payload of the contact at
+// the time of its last verification, nil if it isn't verified
+func (m *metadataStoreIndex) getContactVerification(contactPK []byte) []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.contactVerifications[string(contactPK)]
+}
+
+func (m *metadataStoreIndex) handleContactMetadataSet(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactMetadataSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contactMetadata[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	m.contactMetadata[string(evt.ContactPk)] = evt.Metadata
+
+	return nil
+}
+
+// getContactMetadata returns the private metadata attached to a contact
+func (m *metadataStoreIndex) getContactMetadata(contactPK []byte) []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.contactMetadata[string(contactPK)]
+}
+
+func (m *metadataStoreIndex) handleDeviceNameSet(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountDeviceNameSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	// the events are handled from the newest to the oldest, the first name
+	// set by the device is the last one handled
+	m.deviceNameEvents++
+	m.deviceFirstNames[string(evt.DevicePk)] = deviceFirstName{createdAt: evt.CreatedAt, seq: m.deviceNameEvents}
+
+	if _, ok := m.deviceNames[string(evt.DevicePk)]; ok {
+		return nil
+	}
+
+	m.deviceNames[string(evt.DevicePk)] = evt
+
+	return nil
+}
+
+// handleGroupDeviceRegistered records the device key used by a device of the
+// account on a multi-member group, the latest registration wins
+func (m *metadataStoreIndex) handleGroupDeviceRegistered(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountGroupDeviceRegistered)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.groupDevices[string(evt.GroupPk)][string(evt.DevicePk)]; ok {
+		return nil
+	}
+
+	groupDevicePK, err := crypto.UnmarshalEd25519PublicKey(evt.GroupDevicePk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	// the group device key must have been registered by its owner
+	if ok, err := groupDevicePK.Verify(evt.DevicePk, evt.GroupDeviceSig); err != nil || !ok {
+		m.logger.Warn("ignoring group device registration with an invalid signature")
+		return nil
+	}
+
+	if m.groupDevices[string(evt.GroupPk)] == nil {
+		m.groupDevices[string(evt.GroupPk)] = map[string][]byte{}
+	}
+
+	m.groupDevices[string(evt.GroupPk)][string(evt.DevicePk)] = evt.GroupDevicePk
+
+	return nil
+}
+
+// getGroupDevice returns the device key registered by a device of the account
+// on a multi-member group, nil if it hasn't registered any
+func (m *metadataStoreIndex) getGroupDevice(groupPK []byte, devicePK []byte) []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.groupDevices[string(groupPK)][string(devicePK)]
+}
+
+// getDeviceName returns the last name set by a device, nil if it hasn't set
+// any
+func (m *metadataStoreIndex) getDeviceName(devicePK []byte) *protocoltypes.AccountDeviceNameSet {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.deviceNames[string(devicePK)]
+}
+
+// listDeviceInfos returns the devices of the group with their names, sorted
+// by the order in which they have been named in the log
+func (m *metadataStoreIndex) listDeviceInfos() []*protocoltypes.DeviceInfo {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	createdAt := m.unsafeDeviceCreationTimes()
+
+	devices := make([]*protocoltypes.DeviceInfo, 0, len(m.devices))
+	for pk := range m.devices {
+		device := &protocoltypes.DeviceInfo{DevicePk: []byte(pk)}
+		if evt, ok := m.deviceNames[pk]; ok {
+			device.Name = evt.Name
+			device.Platform = evt.Platform
+			device.CreatedAt = createdAt[pk]
+		}
+
+		_, device.Revoked = m.revokedDevices[pk]
+		_, device.Retired = m.rotatedDevices[pk]
+		device.Primary = m.primaryDevice != nil && pk == string(m.primaryDevice)
+		device.PrimaryTransferPending = m.primaryTransfer != nil && pk == string(m.primaryTransfer)
+		device.Linked = m.unsafeIsLinkedDevice([]byte(pk))
+		devices = append(devices, device)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].CreatedAt != devices[j].CreatedAt {
+			return devices[i].CreatedAt < devices[j].CreatedAt
+		}
+
+		return bytes.Compare(devices[i].DevicePk, devices[j].DevicePk) < 0
+	})
+
+	return devices
+}
+
+// deviceFirstName is the first name set by a device, seq is higher for the
+// older events
+type deviceFirstName struct {
+	createdAt int64
+	seq       int
+}
+
+// unsafeDeviceCreationTimes returns the creation time reported by each device
+// in its first name, the time reported by a device is self-declared so it
+// can't precede the ones of the devices named before it in the log
+func (m *metadataStoreIndex) unsafeDeviceCreationTimes() map[string]int64 {
+	pks := make([]string, 0, len(m.deviceFirstNames))
+	for pk := range m.deviceFirstNames {
+		pks = append(pks, pk)
+	}
+
+	sort.Slice(pks, func(i, j int) bool {
+		return m.deviceFirstNames[pks[i]].seq > m.deviceFirstNames[pks[j]].seq
+	})
+
+	createdAt := make(map[string]int64, len(pks))
+	latest := int64(0)
+	for _, pk := range pks {
+		if t := m.deviceFirstNames[pk].createdAt; t > latest {
+			latest = t
+		}
+
+		createdAt[pk] = latest
+	}
+
+	return createdAt
+}
+
+// isMoreRecentSetting returns true if the setting has been set after the
+// other one, the settings set at the same time are ordered by device
+func isMoreRecentSetting(setting, other *protocoltypes.AccountSettingSet) bool {
+	if setting.UpdatedAt != other.UpdatedAt {
+		return setting.UpdatedAt > other.UpdatedAt
+	}
+
+	return bytes.Compare(setting.DevicePk, other.DevicePk) > 0
+}
+
+func (m *metadataStoreIndex) handleSettingSet(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountSettingSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if current, ok := m.settings[evt.Key]; ok && !isMoreRecentSetting(evt, current) {
+		return nil
+	}
+
+	m.settings[evt.Key] = evt
+
+	return nil
+}
+
+// getSetting returns the last event which has set or deleted the setting, nil
+// if it has never been set
+func (m *metadataStoreIndex) getSetting(key string) *protocoltypes.AccountSettingSet {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.settings[key]
+}
+
+// listSettings returns the given settings sorted by key, or all of them if
+// keys is empty. The deleted settings are only returned with withDeleted.
+func (m *metadataStoreIndex) listSettings(keys []string, withDeleted bool) []*protocoltypes.AccountSetting {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if len(keys) == 0 {
+		keys = make([]string, 0, len(m.settings))
+		for key := range m.settings {
+			keys = append(keys, key)
+		}
+	}
+
+	settings := []*protocoltypes.AccountSetting{}
+	for _, key := range keys {
+		evt, ok := m.settings[key]
+		if !ok || (evt.Deleted && !withDeleted) {
+			continue
+		}
+
+		setting := &protocoltypes.AccountSetting{
+			Key:       evt.Key,
+			UpdatedAt: evt.UpdatedAt,
+			DevicePk:  evt.DevicePk,
+			Deleted:   evt.Deleted,
+		}
+
+		if !evt.Deleted {
+			setting.Value = evt.Value
+		}
+
+		settings = append(settings, setting)
+	}
+
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Key < settings[j].Key
+	})
+
+	return settings
+}
+
+func (m *metadataStoreIndex) getPresenceSettings() *protocoltypes.PresenceSettings {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.presenceSettings == nil {
+		return &protocoltypes.PresenceSettings{}
+	}
+
+	return proto.Clone(m.presenceSettings).(*protocoltypes.PresenceSettings)
+}
+
+func (m *metadataStoreIndex) areReadReceiptsDisabled() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.readReceiptsDisabled
+}
+
+func (m *metadataStoreIndex) getContactRequestPolicy() *protocoltypes.ContactRequestPolicy {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.contactRequestPolicy == nil {
+		return &protocoltypes.ContactRequestPolicy{}
+	}
+
+	return proto.Clone(m.contactRequestPolicy).(*protocoltypes.ContactRequestPolicy)
+}
+
+func (m *metadataStoreIndex) getContactRequestNonce(nonce []byte) *contactRequestNonce {
+	if _, ok := m.contactRequestNonces[string(nonce)]; !ok {
+		m.contactRequestNonces[string(nonce)] = &contactRequestNonce{}
+	}
+
+	return m.contactRequestNonces[string(nonce)]
+}
+
+// checkContactRequestNonce returns an error if a contact request sent using
+// the link identified by the nonce must be rejected
+func (m *metadataStoreIndex) checkContactRequestNonce(nonce []byte, now time.Time) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	entry, ok := m.contactRequestNonces[string(nonce)]
+	if !ok {
+		return errcode.ErrCode_ErrContactRequestNonceInvalid
+	}
+
+	return entry.check(now)
+}
+
+// listContactRequestLinks returns the expiry of the valid contact request
+// links indexed by their nonce
+func (m *metadataStoreIndex) listContactRequestLinks(now time.Time) map[string]int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	links := map[string]int64{}
+	for nonce, entry := range m.contactRequestNonces {
+		if entry.check(now) == nil {
+			links[nonce] = entry.expiresAt
+		}
+	}
+
+	return links
+}
+
+func (m *metadataStoreIndex) handleContactRequestIncomingDiscarded(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingDiscarded)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateDiscarded,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactRequestIncomingAccepted(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingAccepted)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateAdded,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactBlocked(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactBlocked)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateBlocked,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactUnblocked(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactUnblocked)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateRemoved,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactDeleted(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactDeleted)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	// the verification and the metadata of a deleted contact are discarded,
+	// events are handled from the newest so the previous ones are ignored
+	if _, ok := m.contactVerifications[string(evt.ContactPk)]; !ok {
+		m.contactVerifications[string(evt.ContactPk)] = nil
+	}
+
+	if _, ok := m.contactMetadata[string(evt.ContactPk)]; !ok {
+		m.contactMetadata[string(evt.ContactPk)] = nil
+	}
+
+	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
+		return nil
+	}
+
+	ac := &AccountContact{
+		state: protocoltypes.ContactState_ContactStateRemoved,
+		contact: &protocoltypes.ShareableContact{
+			Pk: evt.ContactPk,
+		},
+	}
+
+	m.contacts[string(evt.ContactPk)] = ac
+	err := m.registerContactFromGroupPK(ac)
+
+	return err
+}
+
+func (m *metadataStoreIndex) handleContactAliasKeyAdded(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.ContactAliasKeyAdded)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsContactAddAliasKey = append(m.eventsContactAddAliasKey, evt)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberInitialMember(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupInitialMemberAnnounced)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	pk, err := crypto.UnmarshalEd25519PublicKey(e.MemberPk)
+	if err != nil {
+		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	if _, ok := m.admins[pk]; ok {
+		return errcode.ErrCode_ErrInternal
+	}
+
+	m.admins[pk] = struct{}{}
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupMemberRemoved(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupMemberRemoved)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if l := len(e.MemberPk); l != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member key size, expected %d, got %d", cryptoutil.KeySize, l))
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupMemberRoleSet(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupMemberRoleSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if l := len(e.MemberPk); l != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member key size, expected %d, got %d", cryptoutil.KeySize, l))
+	}
+
+	if _, ok := protocoltypes.GroupMemberRole_name[int32(e.Role)]; !ok || e.Role == protocoltypes.GroupMemberRole_GroupMemberRoleUndefined {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member role %d", e.Role))
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupMemberBanned(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupMemberBanned)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if l := len(e.MemberPk); l != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member key size, expected %d, got %d", cryptoutil.KeySize, l))
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupMemberApproved(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupMemberApproved)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if l := len(e.MemberPk); l != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member key size, expected %d, got %d", cryptoutil.KeySize, l))
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupBroadcastModeSet(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupBroadcastModeSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+// handleGroupDisappearingMessagesSet is handled once the roles are known, the
+// latest change made by a device allowed to send messages wins
+func (m *metadataStoreIndex) handleGroupDisappearingMessagesSet(event proto.Message) error {
+	e, ok := event.(*protocoltypes.GroupDisappearingMessagesSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.disappearingEntries[e] = m.eventHash
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+// unsafeCanSetDisappearingMessages returns true if the device is a known
+// device of the group allowed to send messages
+func (m *metadataStoreIndex) unsafeCanSetDisappearingMessages(devicePK []byte) bool {
+	md, ok := m.devices[string(devicePK)]
+	if !ok {
+		return false
+	}
+
+	memberRaw, err := md.Member().Raw()
+	if err != nil {
+		return false
+	}
+
+	if _, ok := m.pendingMembers[string(memberRaw)]; ok {
+		return false
+	}
+
+	if !m.broadcastMode || m.unsafeIsAdminDevice(devicePK) {
+		return true
+	}
+
+	return m.unsafeGetRole(memberRaw) >= protocoltypes.GroupMemberRole_GroupMemberRoleModerator
+}
+
+// getDisappearingMessages returns the delay after which the messages of the
+// group are deleted, 0 if disabled
+func (m *metadataStoreIndex) getDisappearingMessages() time.Duration {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return time.Duration(m.disappearingMessages) * time.Second
+}
+
+// getDisappearingMessagesEntry returns the entry which has set the current
+// delay of the disappearing messages, undefined if it has never been set
+func (m *metadataStoreIndex) getDisappearingMessagesEntry() cid.Cid {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.disappearingEntry
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupPublicModeSet(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupPublicModeSet)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleContactSessionReset(event proto.Message) error {
+	e, ok := event.(*protocoltypes.ContactSessionReset)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+// handleDeviceRevoked is handled once all the devices are known, a device
+// can only be revoked by another device of the same member
+func (m *metadataStoreIndex) handleDeviceRevoked(event proto.Message) error {
+	switch event.(type) {
+	case *protocoltypes.AccountDeviceRevoked, *protocoltypes.ContactDeviceRevoked, *protocoltypes.MultiMemberGroupDeviceRevoked:
+	default:
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, event)
+
+	return nil
+}
+
+// handleContactAccountReintroduced doesn't change the state of the group, the
+// proof has been verified when opening the entry and the clients are notified
+// by the metadata event
+func (m *metadataStoreIndex) handleContactAccountReintroduced(_ proto.Message) error {
+	return nil
+}
+
+// handleContactRemoved doesn't change the state of the group, the member
+// which sent it has deleted its local data of the group and the clients are
+// notified by the metadata event
+func (m *metadataStoreIndex) handleContactRemoved(_ proto.Message) error {
+	return nil
+}
+
+// handleContactIntroductionSent doesn't change the state of the group, the
+// introduction has been verified when opening the entry and the clients are
+// notified by the metadata event
+func (m *metadataStoreIndex) handleContactIntroductionSent(_ proto.Message) error {
+	return nil
+}
+
+func (m *metadataStoreIndex) handleContactIntroductionAccepted(event proto.Message) error {
+	evt, ok := event.(*protocoltypes.AccountContactIntroductionAccepted)
+	if !ok || evt.Introduction.GetIntroduced() == nil {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.acceptedIntroductions[string(evt.Introduction.Introduced.Pk)] = struct{}{}
+
+	return nil
+}
+
+// isIntroductionAccepted returns true if an introduction to the given account
+// has been accepted
+func (m *metadataStoreIndex) isIntroductionAccepted(introducedPK []byte) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	_, ok := m.acceptedIntroductions[string(introducedPK)]
+	return ok
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupSecretRotated(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupSecretRotated)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+// handleMultiMemberGroupEpochCommitted lists the commits of the epoch tree,
+// their committer is checked in the order of the events and the chain of
+// epochs is computed once all the events have been handled, see
+// postHandlerEpochs
+func (m *metadataStoreIndex) handleMultiMemberGroupEpochCommitted(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupEpochCommitted)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if m.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil
+	}
+
+	m.epochCommitCandidates[e] = m.eventHash
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+// handleMultiMemberGroupSnapshotAdded loads the newest trusted snapshot. A
+// snapshot is trusted once a replay of the log has shown that its device was
+// an admin when it was added, see unsafeVerifySnapshot, so the first replay
+// after the store is opened is always complete. The snapshot is only used by
+// devices which joined the group after it, other devices might have sent
+// secrets in the older entries and need to replay them, unless these entries
+// have been removed by the compaction of the log.
+func (m *metadataStoreIndex) handleMultiMemberGroupSnapshotAdded(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupSnapshotAdded)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if m.snapshot != nil || m.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil
+	}
+
+	m.snapshotCandidates[e] = snapshotCandidate{
+		hash:        m.eventHash,
+		newerEvents: m.eventsSinceSnapshot,
+	}
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	if _, ok := m.verifiedSnapshots[m.eventHash.KeyString()]; !ok {
+		return nil
+	}
+
+	ownDevice, err := m.ownMemberDevice.Device().Raw()
+	if err != nil {
+		return errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	for _, d := range e.Devices {
+		if bytes.Equal(d.DevicePk, ownDevice) && !m.truncated {
+			return nil
+		}
+	}
+
+	for _, d := range e.Devices {
+		if _, ok := m.devices[string(d.DevicePk)]; ok {
+			continue
+		}
+
+		member, err := crypto.UnmarshalEd25519PublicKey(d.MemberPk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		device, err := crypto.UnmarshalEd25519PublicKey(d.DevicePk)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		memberDevice := secretstore.NewMemberDevice(member, device)
+
+		m.devices[string(d.DevicePk)] = memberDevice
+		m.members[string(d.MemberPk)] = append(m.members[string(d.MemberPk)], memberDevice)
+	}
+
+	for _, ownerPK := range e.OwnerPks {
+		if m.unsafeIsAdminKey(ownerPK) {
+			continue
+		}
+
+		pk, err := crypto.UnmarshalEd25519PublicKey(ownerPK)
+		if err != nil {
+			return errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		m.admins[pk] = struct{}{}
+	}
+
+	m.snapshot = e
+
+	return nil
+}
+
+// unsafeVerifySnapshot is called in the chronological order of the events,
+// the snapshot is trusted if its device is an admin according to the history
+// replayed so far. The newest trusted snapshot is the checkpoint of the log,
+// the events are counted from it.
+func (m *metadataStoreIndex) unsafeVerifySnapshot(e *protocoltypes.MultiMemberGroupSnapshotAdded) {
+	candidate, ok := m.snapshotCandidates[e]
+	if !ok {
+		return
+	}
+
+	if _, ok := m.verifiedSnapshots[candidate.hash.KeyString()]; !ok {
+		if !m.unsafeIsAdminDevice(e.DevicePk) {
+			m.logger.Warn("ignoring snapshot sent by a non admin device")
+			return
+		}
+
+		m.verifiedSnapshots[candidate.hash.KeyString()] = struct{}{}
+	}
+
+	m.snapshotEntry = candidate.hash
+	m.epochSnapshot = e
+	m.eventsSinceSnapshot = candidate.newerEvents
+}
+
+func (m *metadataStoreIndex) unsafeIsAdminKey(publicKeyBytes []byte) bool {
+	pk, err := crypto.UnmarshalEd25519PublicKey(publicKeyBytes)
+	if err != nil {
+		return false
+	}
+
+	for admin := range m.admins {
+		if admin.Equals(pk) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newSnapshot summarizes the membership state of the group
+func (m *metadataStoreIndex) newSnapshot() *protocoltypes.MultiMemberGroupSnapshotAdded {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	snapshot := &protocoltypes.MultiMemberGroupSnapshotAdded{
+		ChainKeyEpoch:                m.chainKeyEpoch,
+		InvitationRequired:           m.invitationRequired,
+		BroadcastMode:                m.broadcastMode,
+		PublicMode:                   m.publicMode,
+		DisappearingMessagesDuration: m.disappearingMessages,
+		OwnerMemberPk:                m.owner,
+	}
+
+	if m.epochTip != nil {
+		snapshot.EpochCommitId = m.epochTip.id.Bytes()
+		snapshot.EpochTreeLeaves, snapshot.EpochTreeParents = secretstore.EpochTreeNodes(m.epochTip.tree)
+	}
+
+	for devicePK, md := range m.devices {
+		memberPK, err := md.Member().Raw()
+		if err != nil {
+			continue
+		}
+
+		snapshot.Devices = append(snapshot.Devices, &protocoltypes.MultiMemberGroupSnapshotAdded_Device{
+			MemberPk: memberPK,
+			DevicePk: []byte(devicePK),
+		})
+	}
+
+	for admin := range m.admins {
+		if ownerPK, err := admin.Raw(); err == nil {
+			snapshot.OwnerPks = append(snapshot.OwnerPks, ownerPK)
+		}
+	}
+
+	for memberPK, role := range m.roles {
+		snapshot.Roles = append(snapshot.Roles, &protocoltypes.MultiMemberGroupSnapshotAdded_MemberRole{
+			MemberPk: []byte(memberPK),
+			Role:     role,
+		})
+	}
+
+	for memberPK := range m.removedMembers {
+		snapshot.RemovedMemberPks = append(snapshot.RemovedMemberPks, []byte(memberPK))
+	}
+
+	for id := range m.revokedInvitations {
+		snapshot.RevokedInvitationIds = append(snapshot.RevokedInvitationIds, []byte(id))
+	}
+
+	for memberPK := range m.pendingMembers {
+		snapshot.PendingMemberPks = append(snapshot.PendingMemberPks, []byte(memberPK))
+	}
+
+	for memberPK := range m.bannedMembers {
+		snapshot.BannedMemberPks = append(snapshot.BannedMemberPks, []byte(memberPK))
+	}
+
+	return snapshot
+}
+
+// shouldAddSnapshot returns true if enough events have been appended since
+// the newest trusted snapshot
+func (m *metadataStoreIndex) shouldAddSnapshot() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.group.GroupType == protocoltypes.GroupType_GroupTypeMultiMember && m.eventsSinceSnapshot >= groupSnapshotInterval
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGroupInvitationRevoked(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupInvitationRevoked)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.eventsInvitationRevoked = append(m.eventsInvitationRevoked, invitationRevocation{
+		position: m.eventPosition,
+		event:    e,
+	})
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleMultiMemberGrantAdminRole(event proto.Message) error {
+	e, ok := event.(*protocoltypes.MultiMemberGroupAdminRoleGranted)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	if l := len(e.GranteeMemberPk); l != cryptoutil.KeySize {
+		return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid member key size, expected %d, got %d", cryptoutil.KeySize, l))
+	}
+
+	m.eventsModeration = append(m.eventsModeration, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) handleGroupMetadataPayloadSent(_ proto.Message) error {
+	return nil
+}
+
+func (m *metadataStoreIndex) handleAccountVerifiedCredentialRegistered(event proto.Message) error {
+	e, ok := event.(*protocoltypes.AccountVerifiedCredentialRegistered)
+	if !ok {
+		return errcode.ErrCode_ErrInvalidInput
+	}
+
+	m.verifiedCredentials = append(m.verifiedCredentials, e)
+
+	return nil
+}
+
+func (m *metadataStoreIndex) listAdmins() []crypto.PubKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	admins := make([]crypto.PubKey, len(m.admins))
+	i := 0
+
+	for admin := range m.admins {
+		admins[i] = admin
+		i++
+	}
+
+	return admins
+}
+
+func (m *metadataStoreIndex) listOtherMembersDevices() []crypto.PubKey {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if m.ownMemberDevice == nil || m.ownMemberDevice.Member() == nil {
+		return nil
+	}
+
+	ownMemberPK, err := m.ownMemberDevice.Member().Raw()
+	if err != nil {
+		m.logger.Warn("unable to serialize member pubkey", zap.Error(err))
+		return nil
+	}
+
+	devices := []crypto.PubKey(nil)
+	for pk, devicesForMember := range m.members {
+		if string(ownMemberPK) == pk {
+			continue
+		}
+
+		if !m.unsafeIsMemberActive(pk) {
+			continue
+		}
+
+		for _, md := range devicesForMember {
+			devices = append(devices, md.Device())
+		}
+	}
+
+	return devices
+}
+
+func (m *metadataStoreIndex) contactRequestsEnabled() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.contactRequestEnabled != nil && *m.contactRequestEnabled
+}
+
+func (m *metadataStoreIndex) contactRequestsSeed() []byte {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	return m.contactRequestSeed
+}
+
+func (m *metadataStoreIndex) getContact(pk crypto.PubKey) (*AccountContact, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	bytes, err := pk.Raw()
+	if err != nil {
+		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+	}
+
+	contact, ok := m.contacts[string(bytes)]
+	if !ok {
+		return nil, errcode.ErrCode_ErrMissingMapKey.Wrap(err)
+	}
+
+	return contact, nil
+}
+
+func (m *metadataStoreIndex) postHandlerSentAliases() error {
+	for _, evt := range m.eventsContactAddAliasKey {
+		memberPublicKey, err := m.unsafeGetMemberByDevice(evt.DevicePk)
+		if err != nil {
+			return fmt.Errorf("couldn't get member for device")
+		}
+
+		if memberPublicKey.Equals(m.ownMemberDevice.Member()) {
+			m.ownAliasKeySent = true
+			continue
+		}
+
+		if l := len(evt.AliasPk); l != cryptoutil.KeySize {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid alias key size, expected %d, got %d", cryptoutil.KeySize, l))
+		}
+
+		m.otherAliasKey = evt.AliasPk
+	}
+
+	m.eventsContactAddAliasKey = nil
+
+	return nil
+}
+
+// postHandlerModeration applies the role changes and the removals once all
+// the events have been handled, in the order they have been emitted, as the
+// permissions of the sender depend on the roles granted by older events.
+//
+// The admins are peers: when their decisions conflict, the latest event in
+// the order of the log wins. The owner is above them: it is always an admin,
+// the removals, bans and role changes targeting it are ignored whoever sends
+// them, while it can demote, remove or ban any admin. An admin demoted by the
+// owner loses its rights for the events following the demotion only.
+func (m *metadataStoreIndex) postHandlerModeration() error {
+	m.roles = map[string]protocoltypes.GroupMemberRole{}
+	m.removedMembers = map[string]struct{}{}
+	m.approvedMembers = map[string]struct{}{}
+	m.bannedMembers = map[string]struct{}{}
+	m.revokedDevices = map[string]struct{}{}
+	m.linkedDevices = map[string]struct{}{}
+	m.chainKeyEpoch = 0
+	m.owner = nil
+	m.primaryDevice = nil
+	m.primaryTransfer = nil
+	m.broadcastMode = false
+	m.publicMode = nil
+	m.disappearingMessages = 0
+	m.disappearingEntry = cid.Undef
+	m.epochSnapshot = nil
+	m.epochCommitsAuthorized = nil
+	m.epochRotation = -1
+
+	if m.snapshot != nil {
+		for _, r := range m.snapshot.Roles {
+			m.roles[string(r.MemberPk)] = r.Role
+		}
+
+		for _, pk := range m.snapshot.RemovedMemberPks {
+			m.removedMembers[string(pk)] = struct{}{}
+		}
+
+		for _, pk := range m.snapshot.BannedMemberPks {
+			m.bannedMembers[string(pk)] = struct{}{}
+		}
+
+		m.chainKeyEpoch = m.snapshot.ChainKeyEpoch
+		m.owner = m.snapshot.OwnerMemberPk
+		m.broadcastMode = m.snapshot.BroadcastMode
+		m.publicMode = m.snapshot.PublicMode
+		m.disappearingMessages = m.snapshot.DisappearingMessagesDuration
+		m.disappearingEntry = m.snapshotEntry
+	}
+
+	// the first device of the account is its primary device, it can only
+	// be claimed when the beginning of the account group is missing
+	if m.unsafeIsFirstDeviceKnown() {
+		m.primaryDevice = m.firstDevice
+		m.linkedDevices[string(m.firstDevice)] = struct{}{}
+	}
+
+	for i := len(m.eventsModeration) - 1; i >= 0; i-- {
+		order := len(m.eventsModeration) - 1 - i
+
+		switch evt := m.eventsModeration[i].(type) {
+		case *protocoltypes.MultiMemberGroupMemberRemoved:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) || m.unsafeIsOwner(evt.MemberPk) {
+				m.logger.Warn("ignoring unauthorized member removal")
+				continue
+			}
+
+			m.removedMembers[string(evt.MemberPk)] = struct{}{}
+			delete(m.roles, string(evt.MemberPk))
+			m.chainKeyEpoch++
+
+		case *protocoltypes.MultiMemberGroupSecretRotated:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring secret rotation requested by a non admin device")
+				continue
+			}
+
+			m.chainKeyEpoch++
+			m.epochRotation = order
+
+		case *protocoltypes.ContactSessionReset:
+			if _, ok := m.devices[string(evt.DevicePk)]; !ok || m.group.GroupType != protocoltypes.GroupType_GroupTypeContact {
+				m.logger.Warn("ignoring session reset requested by an unknown device")
+				continue
+			}
+
+			m.chainKeyEpoch++
+
+		case *protocoltypes.AccountDeviceRevoked:
+			if m.group.GroupType != protocoltypes.GroupType_GroupTypeAccount || !m.unsafeCanManageAccount(evt.DevicePk) || !m.unsafeRevokeDevice(evt.DevicePk, evt.RevokedDevicePk) {
+				m.logger.Warn("ignoring unauthorized device revocation")
+				continue
+			}
+
+			// the revoked device knows the account chain keys, they are
+			// renewed for the remaining devices
+			m.chainKeyEpoch++
+
+		case *protocoltypes.AccountContactRequestDisabled,
+			*protocoltypes.AccountContactRequestEnabled,
+			*protocoltypes.AccountContactRequestReferenceReset,
+			*protocoltypes.AccountContactRequestPolicySet,
+			*protocoltypes.AccountPresenceSettingsSet,
+			*protocoltypes.AccountReadReceiptsSet:
+			if !m.unsafeCanManageAccount(evt.(eventDeviceSigned).GetDevicePk()) {
+				m.logger.Warn("ignoring account policy change sent by a secondary device")
+				continue
+			}
+
+			m.unsafeApplyAccountPolicy(evt)
+
+		case *protocoltypes.AccountDeviceLinked:
+			if m.group.GroupType != protocoltypes.GroupType_GroupTypeAccount || !m.unsafeCanManageAccount(evt.DevicePk) {
+				m.logger.Warn("ignoring device linked by a secondary device")
+				continue
+			}
+
+			m.linkedDevices[string(evt.LinkedDevicePk)] = struct{}{}
+
+		case *protocoltypes.AccountPrimaryDeviceClaimed:
+			if m.primaryDevice != nil || !m.unsafeIsActiveDevice(evt.DevicePk) || !m.unsafeIsLinkedDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring primary device claim")
+				continue
+			}
+
+			m.primaryDevice = evt.DevicePk
+
+		case *protocoltypes.AccountPrimaryDeviceTransferProposed:
+			if m.primaryDevice == nil || !bytes.Equal(evt.DevicePk, m.primaryDevice) {
+				m.logger.Warn("ignoring primary device transfer proposed by a secondary device")
+				continue
+			}
+
+			if bytes.Equal(evt.NewPrimaryDevicePk, m.primaryDevice) {
+				m.primaryTransfer = nil
+				continue
+			}
+
+			if !m.unsafeIsActiveDevice(evt.NewPrimaryDevicePk) || !m.unsafeIsLinkedDevice(evt.NewPrimaryDevicePk) {
+				m.logger.Warn("ignoring primary device transfer to an unknown or unlinked device")
+				continue
+			}
+
+			m.primaryTransfer = evt.NewPrimaryDevicePk
+
+		case *protocoltypes.AccountPrimaryDeviceTransferAccepted:
+			if m.primaryTransfer == nil || !bytes.Equal(evt.DevicePk, m.primaryTransfer) || !bytes.Equal(evt.PreviousPrimaryDevicePk, m.primaryDevice) {
+				m.logger.Warn("ignoring primary device transfer not proposed")
+				continue
+			}
+
+			m.primaryDevice, m.primaryTransfer = m.primaryTransfer, nil
+
+		case *protocoltypes.GroupDeviceKeyRotated:
+			if m.primaryDevice != nil && bytes.Equal(evt.DevicePk, m.primaryDevice) {
+				m.primaryDevice = evt.NewDevicePk
+			}
+
+			if m.primaryTransfer != nil && bytes.Equal(evt.DevicePk, m.primaryTransfer) {
+				m.primaryTransfer = evt.NewDevicePk
+			}
+
+			if _, ok := m.linkedDevices[string(evt.DevicePk)]; ok {
+				m.linkedDevices[string(evt.NewDevicePk)] = struct{}{}
+			}
+
+		case *protocoltypes.ContactDeviceRevoked:
+			if m.group.GroupType != protocoltypes.GroupType_GroupTypeContact || !m.unsafeRevokeDevice(evt.DevicePk, evt.RevokedDevicePk) {
+				m.logger.Warn("ignoring unauthorized device revocation")
+				continue
+			}
+
+			// the chain keys are renewed without the revoked device
+			m.chainKeyEpoch++
+
+		case *protocoltypes.MultiMemberGroupDeviceRevoked:
+			if m.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember || !m.unsafeRevokeDevice(evt.DevicePk, evt.RevokedDevicePk) {
+				m.logger.Warn("ignoring unauthorized device revocation")
+				continue
+			}
+
+			m.chainKeyEpoch++
+
+		case *protocoltypes.MultiMemberGroupBroadcastModeSet:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring broadcast mode change requested by a non admin device")
+				continue
+			}
+
+			m.broadcastMode = evt.Enabled
+
+		case *protocoltypes.MultiMemberGroupPublicModeSet:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring public mode change requested by a non admin device")
+				continue
+			}
+
+			m.publicMode = evt
+
+		case *protocoltypes.GroupDisappearingMessagesSet:
+			if !m.unsafeCanSetDisappearingMessages(evt.DevicePk) {
+				m.logger.Warn("ignoring disappearing messages set by a device not allowed to send messages")
+				continue
+			}
+
+			m.disappearingMessages = evt.Duration
+			m.disappearingEntry = m.disappearingEntries[evt]
+
+		case *protocoltypes.MultiMemberGroupMemberBanned:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) || m.unsafeIsOwner(evt.MemberPk) {
+				m.logger.Warn("ignoring unauthorized member ban")
+				continue
+			}
+
+			m.unsafeSetBanned(evt.MemberPk, !evt.Unban)
+
+		case *protocoltypes.MultiMemberGroupMemberApproved:
+			if !m.unsafeIsAdminDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring join request approval sent by a non admin device")
+				continue
+			}
+
+			m.approvedMembers[string(evt.MemberPk)] = struct{}{}
+
+		case *protocoltypes.MultiMemberGroupMemberRoleSet:
+			m.unsafeSetRole(evt.DevicePk, evt.MemberPk, evt.Role)
+
+		case *protocoltypes.MultiMemberGroupAdminRoleGranted:
+			m.unsafeSetRole(evt.DevicePk, evt.GranteeMemberPk, protocoltypes.GroupMemberRole_GroupMemberRoleAdmin)
+
+		case *protocoltypes.MultiMemberGroupOwnershipTransferred:
+			m.unsafeTransferOwnership(evt.DevicePk, evt.MemberPk)
+
+		case *protocoltypes.MultiMemberGroupSnapshotAdded:
+			m.unsafeVerifySnapshot(evt)
+
+		case *protocoltypes.MultiMemberGroupEpochCommitted:
+			if !m.unsafeIsEpochDevice(evt.DevicePk) {
+				m.logger.Warn("ignoring epoch commit sent by an inactive device")
+				continue
+			}
+
+			m.epochCommitsAuthorized = append(m.epochCommitsAuthorized, &epochCommit{
+				id:    m.epochCommitCandidates[evt],
+				epoch: evt.Epoch,
+				order: order,
+				event: evt,
+			})
+		}
+	}
+
+	m.eventsModeration = nil
+
+	return nil
+}
+
+// postHandlerInvitations rejects the members who joined the group using an
+// invitation revoked before they used it, or expired when they joined. Once a
+// member has joined using an invitation token, the members joining afterwards
+// without one are rejected too, as the token could have been stripped from a
+// revoked invitation. Rejected members are handled as removed members, other
+// members may have sent them their keys before the rejection was known so a
+// new chain key epoch is started for each of them.
+//
+// The time a member joined is signed by its device, there is no trusted
+// clock in the group: a device lying about it can use an expired invitation
+// as long as it hasn't been revoked.
+func (m *metadataStoreIndex) postHandlerInvitations() error {
+	revokedAt := map[string]int{}
+	pending := map[string][]byte{}
+	tokenRequired := false
+
+	// revocations summarized by the snapshot happened before any other event
+	if m.snapshot != nil {
+		for _, id := range m.snapshot.RevokedInvitationIds {
+			revokedAt[string(id)] = -1
+		}
+
+		for _, pk := range m.snapshot.PendingMemberPks {
+			pending[string(pk)] = nil
+		}
+
+		tokenRequired = m.snapshot.InvitationRequired
+	}
+
+	for _, r := range m.eventsInvitationRevoked {
+		if !m.unsafeIsAdminDevice(r.event.DevicePk) {
+			m.logger.Warn("ignoring invitation revocation sent by a non admin device")
+			continue
+		}
+
+		if position, ok := revokedAt[string(r.event.InvitationId)]; !ok || r.position < position {
+			revokedAt[string(r.event.InvitationId)] = r.position
+		}
+	}
+
+	sort.SliceStable(m.eventsMemberJoined, func(i, j int) bool {
+		return m.eventsMemberJoined[i].position < m.eventsMemberJoined[j].position
+	})
+
+	accepted := map[string]struct{}{}
+	rejected := map[string]struct{}{}
+
+	for _, join := range m.eventsMemberJoined {
+		key := string(join.memberPK)
+		if _, ok := accepted[key]; ok {
+			continue
+		}
+
+		// banned members are excluded while the ban lasts, their join is
+		// checked again once unbanned
+		if _, ok := m.bannedMembers[key]; ok {
+			continue
+		}
+
+		switch {
+		case m.unsafeIsCreator(join.memberPK):
+		case join.invitation != nil:
+			if err := verifyGroupInvitationToken(m.group, join.invitation); err != nil || !m.unsafeIsAdminDevice(join.invitation.DevicePk) {
+				rejected[key] = struct{}{}
+				continue
+			}
+
+			if position, ok := revokedAt[string(join.invitation.Id)]; ok && position < join.position {
+				rejected[key] = struct{}{}
+				continue
+			}
+
+			if join.invitation.ExpiresAt != 0 && (join.joinedAt == 0 || isGroupInvitationExpired(join.invitation, time.Unix(join.joinedAt, 0))) {
+				rejected[key] = struct{}{}
+				continue
+			}
+
+			tokenRequired = true
+			if join.invitation.ApprovalRequired {
+				pending[key] = join.invitation.Id
+			}
+		case tokenRequired:
+			rejected[key] = struct{}{}
+			continue
+		}
+
+		accepted[key] = struct{}{}
+		delete(rejected, key)
+	}
+
+	for key := range rejected {
+		if _, ok := m.removedMembers[key]; ok {
+			continue
+		}
+
+		m.removedMembers[key] = struct{}{}
+		m.chainKeyEpoch++
+	}
+
+	for key := range pending {
+		_, approved := m.approvedMembers[key]
+		_, removed := m.removedMembers[key]
+		if approved || removed {
+			delete(pending, key)
+		}
+	}
+
+	m.pendingMembers = pending
+
+	m.invitationRequired = tokenRequired
+	m.revokedInvitations = make(map[string]struct{}, len(revokedAt))
+	for id := range revokedAt {
+		m.revokedInvitations[id] = struct{}{}
+	}
+
+	m.eventsMemberJoined = nil
+	m.eventsInvitationRevoked = nil
+
+	return nil
+}
+
+// postHandlerEpochs computes the epoch trees of a multi-member group. Each
+// commit applies membership changes to the tree of its parent commit and
+// starts the next epoch, the first commit adds the committer itself. A
+// commit is ignored if its parent is unknown, if it skips an epoch, if its
+// committer isn't part of the parent tree or if it adds unknown devices.
+//
+// Devices committing at the same time fork the chain, the current epoch is
+// the end of the chain starting from the oldest root and following the
+// oldest valid child of each commit, the ancestors of the commit summarized by
+// the newest trusted snapshot are preferred. Once the group has an epoch tree
+// the chain key epoch is the one of the current commit.
+func (m *metadataStoreIndex) postHandlerEpochs() error {
+	authorized := m.epochCommitsAuthorized
+	m.epochCommitsAuthorized = nil
+	m.epochCommits = nil
+	m.epochTip = nil
+	m.epochRotationRequested = false
+
+	if m.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return nil
+	}
+
+	inLog := make(map[string]*epochCommit, len(authorized))
+	for _, c := range authorized {
+		inLog[c.id.KeyString()] = c
+	}
+
+	trees := map[string]*ratchettree.Tree{}
+	epochs := map[string]uint64{}
+
+	// the commits older than a snapshot might have been skipped or removed
+	// from the log, the chain continues from the tree it summarizes
+	var seed *epochCommit
+	if s := m.epochSnapshot; s != nil && len(s.EpochCommitId) > 0 {
+		if _, ok := inLog[string(s.EpochCommitId)]; !ok {
+			id, err := cid.Cast(s.EpochCommitId)
+			if err != nil {
+				m.logger.Warn("ignoring invalid epoch commit id in snapshot", zap.Error(err))
+			} else if tree, err := secretstore.LoadEpochTree(s.EpochTreeLeaves, s.EpochTreeParents); err != nil {
+				m.logger.Warn("ignoring invalid epoch tree in snapshot", zap.Error(err))
+			} else {
+				seed = &epochCommit{id: id, epoch: s.ChainKeyEpoch, order: -1, tree: tree}
+				trees[id.KeyString()] = tree
+				epochs[id.KeyString()] = seed.epoch
+			}
+		}
+	}
+
+	children := map[string][]*epochCommit{}
+	for _, c := range authorized {
+		parentKey := string(c.event.ParentId)
+
+		var parent *ratchettree.Tree
+		if parentKey == "" {
+			if c.epoch == 0 {
+				m.logger.Warn("ignoring epoch commit starting the epoch 0")
+				continue
+			}
+
+			parent = &ratchettree.Tree{}
+		} else {
+			tree, ok := trees[parentKey]
+			if !ok || c.epoch != epochs[parentKey]+1 {
+				m.logger.Warn("ignoring epoch commit not following its parent")
+				continue
+			}
+
+			if tree.Find(c.event.DevicePk) < 0 {
+				m.logger.Warn("ignoring epoch commit sent by a device not part of the epoch")
+				continue
+			}
+
+			parent = tree
+		}
+
+		if !m.unsafeAreEpochDevicesKnown(c.event.AddedDevicePks) {
+			m.logger.Warn("ignoring epoch commit adding unknown devices")
+			continue
+		}
+
+		commit, err := secretstore.EpochCommitFromEvent(c.event)
+		if err != nil {
+			m.logger.Warn("ignoring invalid epoch commit", zap.Error(err))
+			continue
+		}
+
+		tree, err := parent.Apply(commit)
+		if err != nil {
+			m.logger.Warn("ignoring invalid epoch commit", zap.Error(err))
+			continue
+		}
+
+		c.parent, c.tree = parent, tree
+		trees[c.id.KeyString()] = tree
+		epochs[c.id.KeyString()] = c.epoch
+		children[parentKey] = append(children[parentKey], c)
+		m.epochCommits = append(m.epochCommits, c)
+	}
+
+	preferred := map[string]struct{}{}
+	if s := m.epochSnapshot; s != nil {
+		for id := string(s.EpochCommitId); id != ""; {
+			preferred[id] = struct{}{}
+
+			c, ok := inLog[id]
+			if !ok {
+				break
+			}
+
+			id = string(c.event.ParentId)
+		}
 	}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	next := func(parentKey string) *epochCommit {
+		for _, c := range children[parentKey] {
+			if _, ok := preferred[c.id.KeyString()]; ok {
+				return c
+			}
+		}
 
-	return err
-}
+		if len(children[parentKey]) > 0 {
+			return children[parentKey][0]
+		}
 
-func (m *metadataStoreIndex) handleContactRequestIncomingDiscarded(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingDiscarded)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+		return nil
 	}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		return nil
+	tip := seed
+	c := next("")
+	if seed != nil {
+		c = next(seed.id.KeyString())
 	}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateDiscarded,
-		contact: &protocoltypes.ShareableContact{
-			Pk: evt.ContactPk,
-		},
+	for ; c != nil; c = next(c.id.KeyString()) {
+		tip = c
 	}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	if tip == nil {
+		return nil
+	}
 
-	return err
-}
+	m.epochTip = tip
+	m.chainKeyEpoch = tip.epoch
+	m.epochRotationRequested = m.epochRotation > tip.order
 
-func (m *metadataStoreIndex) handleContactRequestIncomingAccepted(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactRequestIncomingAccepted)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
-	}
+	return nil
+}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		return nil
+// unsafeIsEpochDevice returns true if the device is active and its member
+// is neither removed nor banned, it is then allowed to commit an epoch
+func (m *metadataStoreIndex) unsafeIsEpochDevice(devicePK []byte) bool {
+	if !m.unsafeIsActiveDevice(devicePK) {
+		return false
 	}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateAdded,
-		contact: &protocoltypes.ShareableContact{
-			Pk: evt.ContactPk,
-		},
+	memberPK, err := m.devices[string(devicePK)].Member().Raw()
+	if err != nil {
+		return false
 	}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	_, removed := m.removedMembers[string(memberPK)]
+	_, banned := m.bannedMembers[string(memberPK)]
 
-	return err
+	return !removed && !banned
 }
 
-func (m *metadataStoreIndex) handleContactBlocked(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactBlocked)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+func (m *metadataStoreIndex) unsafeAreEpochDevicesKnown(devicePKs [][]byte) bool {
+	for _, devicePK := range devicePKs {
+		if _, ok := m.devices[string(devicePK)]; !ok {
+			return false
+		}
 	}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		return nil
-	}
+	return true
+}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateBlocked,
-		contact: &protocoltypes.ShareableContact{
-			Pk: evt.ContactPk,
-		},
-	}
+// unsafeListEpochDevices returns the devices which must be part of the
+// current epoch: the devices of the active members, except the revoked ones
+// and the ones whose key has been rotated
+func (m *metadataStoreIndex) unsafeListEpochDevices() map[string]struct{} {
+	devices := map[string]struct{}{}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+	for devicePK, md := range m.devices {
+		if _, ok := m.revokedDevices[devicePK]; ok {
+			continue
+		}
 
-	return err
-}
+		if _, ok := m.rotatedDevices[devicePK]; ok {
+			continue
+		}
 
-func (m *metadataStoreIndex) handleContactUnblocked(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.AccountContactUnblocked)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
-	}
+		memberPK, err := md.Member().Raw()
+		if err != nil || !m.unsafeIsMemberActive(string(memberPK)) {
+			continue
+		}
 
-	if _, ok := m.contacts[string(evt.ContactPk)]; ok {
-		return nil
+		devices[devicePK] = struct{}{}
 	}
 
-	ac := &AccountContact{
-		state: protocoltypes.ContactState_ContactStateRemoved,
-		contact: &protocoltypes.ShareableContact{
-			Pk: evt.ContactPk,
-		},
-	}
+	return devices
+}
 
-	m.contacts[string(evt.ContactPk)] = ac
-	err := m.registerContactFromGroupPK(ac)
+// epochChanges are the membership changes not committed yet
+type epochChanges struct {
+	tip     *epochCommit
+	removes [][]byte
+	adds    [][]byte
+	update  bool
 
-	return err
+	// committers are the devices allowed to commit the changes, in the
+	// order they commit them
+	committers [][]byte
 }
 
-func (m *metadataStoreIndex) handleContactAliasKeyAdded(event proto.Message) error {
-	evt, ok := event.(*protocoltypes.ContactAliasKeyAdded)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
-	}
-
-	m.eventsContactAddAliasKey = append(m.eventsContactAddAliasKey, evt)
+// pending returns true if a new epoch must be committed
+func (c *epochChanges) pending() bool {
+	return len(c.removes) > 0 || len(c.adds) > 0 || c.update
+}
 
-	return nil
+// revoking returns true if the changes remove devices from the epoch, or
+// if an admin requested a secret rotation
+func (c *epochChanges) revoking() bool {
+	return len(c.removes) > 0 || c.update
 }
 
-func (m *metadataStoreIndex) handleMultiMemberInitialMember(event proto.Message) error {
-	e, ok := event.(*protocoltypes.MultiMemberGroupInitialMemberAnnounced)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+// rank returns the position of the device in the committers, -1 if it
+// isn't allowed to commit
+func (c *epochChanges) rank(devicePK []byte) int {
+	for i, committer := range c.committers {
+		if bytes.Equal(committer, devicePK) {
+			return i
+		}
 	}
 
-	pk, err := crypto.UnmarshalEd25519PublicKey(e.MemberPk)
-	if err != nil {
-		return errcode.ErrCode_ErrDeserialization.Wrap(err)
+	return -1
+}
+
+// getEpochChanges compares the devices of the current epoch tree with the
+// devices which must be part of it. Every membership change starts a new
+// epoch: joins, approvals, removals, bans, device revocations and key
+// rotations, along with the secret rotations requested by the admins.
+func (m *metadataStoreIndex) getEpochChanges() *epochChanges {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	changes := &epochChanges{tip: m.epochTip, update: m.epochRotationRequested}
+	if m.group.GroupType != protocoltypes.GroupType_GroupTypeMultiMember {
+		return changes
 	}
 
-	if _, ok := m.admins[pk]; ok {
-		return errcode.ErrCode_ErrInternal
+	devices := m.unsafeListEpochDevices()
+
+	tree := &ratchettree.Tree{}
+	if m.epochTip != nil {
+		tree = m.epochTip.tree
 	}
 
-	m.admins[pk] = struct{}{}
+	for _, leaf := range tree.Leaves() {
+		if leaf == nil {
+			continue
+		}
 
-	return nil
-}
+		if _, ok := devices[string(leaf.ID)]; ok {
+			changes.committers = append(changes.committers, leaf.ID)
+			continue
+		}
 
-//nolint:revive
-func (m *metadataStoreIndex) handleMultiMemberGrantAdminRole(event proto.Message) error {
-	// TODO:
+		changes.removes = append(changes.removes, leaf.ID)
+	}
 
-	return nil
-}
+	for devicePK := range devices {
+		if tree.Find([]byte(devicePK)) < 0 {
+			changes.adds = append(changes.adds, []byte(devicePK))
+		}
+	}
 
-func (m *metadataStoreIndex) handleGroupMetadataPayloadSent(_ proto.Message) error {
-	return nil
-}
+	sort.Slice(changes.adds, func(i, j int) bool {
+		return bytes.Compare(changes.adds[i], changes.adds[j]) < 0
+	})
 
-func (m *metadataStoreIndex) handleAccountVerifiedCredentialRegistered(event proto.Message) error {
-	e, ok := event.(*protocoltypes.AccountVerifiedCredentialRegistered)
-	if !ok {
-		return errcode.ErrCode_ErrInvalidInput
+	// the first epoch is committed by one of the devices it adds
+	if m.epochTip == nil {
+		changes.committers = changes.adds
 	}
 
-	m.verifiedCredentials = append(m.verifiedCredentials, e)
+	sort.Slice(changes.committers, func(i, j int) bool {
+		return bytes.Compare(changes.committers[i], changes.committers[j]) < 0
+	})
 
-	return nil
+	return changes
 }
 
-func (m *metadataStoreIndex) listAdmins() []crypto.PubKey {
+// listEpochCommits returns the valid commits of the epoch trees in the order
+// they have been emitted, including the ones of the forks
+func (m *metadataStoreIndex) listEpochCommits() []*epochCommit {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	admins := make([]crypto.PubKey, len(m.admins))
-	i := 0
+	return append([]*epochCommit(nil), m.epochCommits...)
+}
 
-	for admin := range m.admins {
-		admins[i] = admin
-		i++
-	}
+// getEpochTip returns the commit which started the current epoch, nil if the
+// group has no epoch tree yet
+func (m *metadataStoreIndex) getEpochTip() *epochCommit {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
 
-	return admins
+	return m.epochTip
 }
 
-func (m *metadataStoreIndex) listOtherMembersDevices() []crypto.PubKey {
+// isMemberInEpoch returns true if the device and the current devices of the
+// member are part of the current epoch tree
+func (m *metadataStoreIndex) isMemberInEpoch(memberPK []byte, devicePK []byte) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	if m.ownMemberDevice == nil || m.ownMemberDevice.Member() == nil {
-		return nil
-	}
-
-	ownMemberPK, err := m.ownMemberDevice.Member().Raw()
-	if err != nil {
-		m.logger.Warn("unable to serialize member pubkey", zap.Error(err))
-		return nil
+	if m.epochTip == nil || m.epochTip.tree.Find(devicePK) < 0 {
+		return false
 	}
 
-	devices := []crypto.PubKey(nil)
-	for pk, devicesForMember := range m.members {
-		if string(ownMemberPK) == pk {
+	found := false
+	for memberDevicePK := range m.unsafeListEpochDevices() {
+		md := m.devices[memberDevicePK]
+		if raw, err := md.Member().Raw(); err != nil || !bytes.Equal(raw, memberPK) {
 			continue
 		}
 
-		for _, md := range devicesForMember {
-			devices = append(devices, md.Device())
+		if m.epochTip.tree.Find([]byte(memberDevicePK)) < 0 {
+			return false
 		}
+
+		found = true
 	}
 
-	return devices
+	return found
 }
 
-func (m *metadataStoreIndex) contactRequestsEnabled() bool {
+// epochChainKey is a chain key sent to the devices of an epoch tree
+type epochChainKey struct {
+	commitID []byte
+	event    *protocoltypes.GroupDeviceChainKeyAdded
+}
+
+// listEpochChainKeys returns the chain keys sent to the devices of the epoch
+// trees by devices which are part of them
+func (m *metadataStoreIndex) listEpochChainKeys() []*epochChainKey {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return m.contactRequestEnabled != nil && *m.contactRequestEnabled
+	keys := []*epochChainKey(nil)
+	for _, c := range m.epochCommits {
+		for devicePK, e := range m.epochChainKeys[c.id.KeyString()] {
+			if c.tree.Find([]byte(devicePK)) < 0 {
+				continue
+			}
+
+			keys = append(keys, &epochChainKey{commitID: c.id.Bytes(), event: e})
+		}
+	}
+
+	return keys
 }
 
-func (m *metadataStoreIndex) contactRequestsSeed() []byte {
+// isEpochChainKeySent returns true if the device has sent its chain key to
+// the devices of the epoch started by the commit
+func (m *metadataStoreIndex) isEpochChainKeySent(commitID cid.Cid, devicePK []byte) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	return m.contactRequestSeed
+	_, ok := m.epochChainKeys[commitID.KeyString()][string(devicePK)]
+	return ok
 }
 
-func (m *metadataStoreIndex) getContact(pk crypto.PubKey) (*AccountContact, error) {
+// isEpochChainKeySentToFork returns true if the device has sent its chain key
+// for the epoch of the commit to the devices of another commit, the chain
+// key has then to be renewed in a new epoch
+func (m *metadataStoreIndex) isEpochChainKeySentToFork(commit *epochCommit, devicePK []byte) bool {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	bytes, err := pk.Raw()
+	for _, c := range m.epochCommits {
+		if c.epoch != commit.epoch || c.id.Equals(commit.id) {
+			continue
+		}
+
+		if _, ok := m.epochChainKeys[c.id.KeyString()][string(devicePK)]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unsafeSetBanned updates the ban list, the latest event in the log wins.
+// Banning an active member starts a new chain key epoch, like a removal.
+func (m *metadataStoreIndex) unsafeSetBanned(memberPK []byte, banned bool) {
+	key := string(memberPK)
+
+	if !banned {
+		delete(m.bannedMembers, key)
+		return
+	}
+
+	if _, ok := m.bannedMembers[key]; ok {
+		return
+	}
+
+	_, known := m.members[key]
+	_, removed := m.removedMembers[key]
+	if known && !removed {
+		m.chainKeyEpoch++
+	}
+
+	m.bannedMembers[key] = struct{}{}
+	delete(m.roles, key)
+}
+
+func (m *metadataStoreIndex) unsafeSetRole(senderDevicePublicKeyBytes []byte, memberPublicKeyBytes []byte, role protocoltypes.GroupMemberRole) {
+	if !m.unsafeIsAdminDevice(senderDevicePublicKeyBytes) || m.unsafeIsOwner(memberPublicKeyBytes) {
+		m.logger.Warn("ignoring unauthorized member role change")
+		return
+	}
+
+	if _, ok := m.removedMembers[string(memberPublicKeyBytes)]; ok {
+		return
+	}
+
+	m.roles[string(memberPublicKeyBytes)] = role
+}
+
+// unsafeTransferOwnership makes the given member the owner of the group, the
+// sender must be a device of the current owner, which stays an admin. The
+// new owner must be an active member of the group.
+func (m *metadataStoreIndex) unsafeTransferOwnership(senderDevicePublicKeyBytes []byte, memberPublicKeyBytes []byte) {
+	sender, err := m.unsafeGetMemberByDevice(senderDevicePublicKeyBytes)
 	if err != nil {
-		return nil, errcode.ErrCode_ErrSerialization.Wrap(err)
+		m.logger.Warn("ignoring ownership transfer sent by an unknown device")
+		return
 	}
 
-	contact, ok := m.contacts[string(bytes)]
-	if !ok {
-		return nil, errcode.ErrCode_ErrMissingMapKey.Wrap(err)
+	senderRaw, err := sender.Raw()
+	if err != nil || !m.unsafeIsOwner(senderRaw) {
+		m.logger.Warn("ignoring ownership transfer sent by a device not owning the group")
+		return
 	}
 
-	return contact, nil
+	key := string(memberPublicKeyBytes)
+	_, known := m.members[key]
+	_, removed := m.removedMembers[key]
+	_, banned := m.bannedMembers[key]
+
+	if !known || removed || banned || bytes.Equal(senderRaw, memberPublicKeyBytes) {
+		m.logger.Warn("ignoring ownership transfer to an invalid member")
+		return
+	}
+
+	m.owner = memberPublicKeyBytes
+	m.roles[string(senderRaw)] = protocoltypes.GroupMemberRole_GroupMemberRoleAdmin
+	delete(m.roles, key)
 }
 
-func (m *metadataStoreIndex) postHandlerSentAliases() error {
-	for _, evt := range m.eventsContactAddAliasKey {
-		memberPublicKey, err := m.unsafeGetMemberByDevice(evt.DevicePk)
-		if err != nil {
-			return fmt.Errorf("couldn't get member for device")
+// unsafeIsOwner returns true if the given member owns the group, its admin
+// role can't be changed by the other admins, see postHandlerModeration. The
+// group creator owns the group until it transfers the ownership to another
+// member.
+func (m *metadataStoreIndex) unsafeIsOwner(memberPublicKeyBytes []byte) bool {
+	if m.owner != nil {
+		return bytes.Equal(m.owner, memberPublicKeyBytes)
+	}
+
+	return m.unsafeIsCreator(memberPublicKeyBytes)
+}
+
+// unsafeIsCreator returns true if the given member has announced itself as
+// the group creator
+func (m *metadataStoreIndex) unsafeIsCreator(memberPublicKeyBytes []byte) bool {
+	member, err := crypto.UnmarshalEd25519PublicKey(memberPublicKeyBytes)
+	if err != nil {
+		return false
+	}
+
+	for admin := range m.admins {
+		if admin.Equals(member) {
+			return true
 		}
 
-		if memberPublicKey.Equals(m.ownMemberDevice.Member()) {
-			m.ownAliasKeySent = true
+		adminRaw, err := admin.Raw()
+		if err != nil {
 			continue
 		}
 
-		if l := len(evt.AliasPk); l != cryptoutil.KeySize {
-			return errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("invalid alias key size, expected %d, got %d", cryptoutil.KeySize, l))
+		if adminMember, err := m.unsafeGetMemberByDevice(adminRaw); err == nil && adminMember.Equals(member) {
+			return true
 		}
+	}
 
-		m.otherAliasKey = evt.AliasPk
+	return false
+}
+
+// unsafeIsAdminDevice returns true if the given device belongs to the group
+// owner or to a member granted of the admin role
+func (m *metadataStoreIndex) unsafeIsAdminDevice(devicePublicKeyBytes []byte) bool {
+	device, err := crypto.UnmarshalEd25519PublicKey(devicePublicKeyBytes)
+	if err != nil {
+		return false
 	}
 
-	m.eventsContactAddAliasKey = nil
+	// the creator device is an admin before being added to the group, once
+	// the ownership is transferred its role is the one of its member
+	if m.owner == nil {
+		for admin := range m.admins {
+			if admin.Equals(device) {
+				return true
+			}
+		}
+	}
 
-	return nil
+	member, err := m.unsafeGetMemberByDevice(devicePublicKeyBytes)
+	if err != nil {
+		return false
+	}
+
+	memberRaw, err := member.Raw()
+	if err != nil {
+		return false
+	}
+
+	return m.unsafeGetRole(memberRaw) == protocoltypes.GroupMemberRole_GroupMemberRoleAdmin
+}
+
+func (m *metadataStoreIndex) unsafeGetRole(memberPublicKeyBytes []byte) protocoltypes.GroupMemberRole {
+	if _, ok := m.removedMembers[string(memberPublicKeyBytes)]; ok {
+		return protocoltypes.GroupMemberRole_GroupMemberRoleUndefined
+	}
+
+	if _, ok := m.bannedMembers[string(memberPublicKeyBytes)]; ok {
+		return protocoltypes.GroupMemberRole_GroupMemberRoleUndefined
+	}
+
+	if m.unsafeIsOwner(memberPublicKeyBytes) {
+		return protocoltypes.GroupMemberRole_GroupMemberRoleAdmin
+	}
+
+	if role, ok := m.roles[string(memberPublicKeyBytes)]; ok {
+		return role
+	}
+
+	return protocoltypes.GroupMemberRole_GroupMemberRoleMember
 }
 
 // nolint:staticcheck,revive
@@ -770,12 +3621,38 @@ func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstor
 			members:                map[string][]secretstore.MemberDevice{},
 			devices:                map[string]secretstore.MemberDevice{},
 			admins:                 map[crypto.PubKey]struct{}{},
-			sentSecrets:            map[string]struct{}{},
+			sentSecrets:            map[string]uint64{},
+			removedMembers:         map[string]struct{}{},
+			pendingMembers:         map[string][]byte{},
+			approvedMembers:        map[string]struct{}{},
+			bannedMembers:          map[string]struct{}{},
+			revokedDevices:         map[string]struct{}{},
+			linkedDevices:          map[string]struct{}{},
+			deviceCapabilities:     map[string]*protocoltypes.GroupDeviceCapabilitiesSet{},
+			replicationServers:     map[replicationServerKey]*protocoltypes.GroupReplicating{},
+			rotatedDevices:         map[string]*protocoltypes.GroupDeviceKeyRotated{},
+			acknowledgedMessages:   map[string]map[string]struct{}{},
+			readMessages:           map[string]map[string]struct{}{},
+			roles:                  map[string]protocoltypes.GroupMemberRole{},
 			handledEvents:          map[string]struct{}{},
 			contacts:               map[string]*AccountContact{},
 			contactsFromGroupPK:    map[string]*AccountContact{},
 			groups:                 map[string]*accountGroup{},
 			contactRequestMetadata: map[string][]byte{},
+			contactRequestNonces:   map[string]*contactRequestNonce{},
+			contactVerifications:   map[string][]byte{},
+			contactMetadata:        map[string][]byte{},
+			deviceNames:            map[string]*protocoltypes.AccountDeviceNameSet{},
+			deviceFirstNames:       map[string]deviceFirstName{},
+			settings:               map[string]*protocoltypes.AccountSettingSet{},
+			groupDevices:           map[string]map[string][]byte{},
+			acceptedIntroductions:  map[string]struct{}{},
+			snapshotCandidates:     map[*protocoltypes.MultiMemberGroupSnapshotAdded]snapshotCandidate{},
+			verifiedSnapshots:      map[string]struct{}{},
+			epochCommitCandidates:  map[*protocoltypes.MultiMemberGroupEpochCommitted]cid.Cid{},
+			disappearingEntries:    map[*protocoltypes.GroupDisappearingMessagesSet]cid.Cid{},
+			epochChainKeys:         map[string]map[string]*protocoltypes.GroupDeviceChainKeyAdded{},
+			epochRotation:          -1,
 			group:                  g,
 			ownMemberDevice:        md,
 			secretStore:            secretStore,
@@ -785,28 +3662,69 @@ func newMetadataIndex(ctx context.Context, g *protocoltypes.Group, md secretstor
 
 		m.eventHandlers = map[protocoltypes.EventType][]func(event proto.Message) error{
 			protocoltypes.EventType_EventTypeAccountContactBlocked:                  {m.handleContactBlocked},
-			protocoltypes.EventType_EventTypeAccountContactRequestDisabled:          {m.handleContactRequestDisabled},
-			protocoltypes.EventType_EventTypeAccountContactRequestEnabled:           {m.handleContactRequestEnabled},
+			protocoltypes.EventType_EventTypeAccountContactRequestDisabled:          {m.handleAccountPolicyChanged},
+			protocoltypes.EventType_EventTypeAccountContactRequestEnabled:           {m.handleAccountPolicyChanged},
 			protocoltypes.EventType_EventTypeAccountContactRequestIncomingAccepted:  {m.handleContactRequestIncomingAccepted},
 			protocoltypes.EventType_EventTypeAccountContactRequestIncomingDiscarded: {m.handleContactRequestIncomingDiscarded},
 			protocoltypes.EventType_EventTypeAccountContactRequestIncomingReceived:  {m.handleContactRequestIncomingReceived},
+			protocoltypes.EventType_EventTypeAccountContactRequestNonceRegistered:   {m.handleContactRequestNonceRegistered},
+			protocoltypes.EventType_EventTypeAccountContactRequestPolicySet:         {m.handleAccountPolicyChanged},
 			protocoltypes.EventType_EventTypeAccountContactRequestOutgoingEnqueued:  {m.handleContactRequestOutgoingEnqueued},
 			protocoltypes.EventType_EventTypeAccountContactRequestOutgoingSent:      {m.handleContactRequestOutgoingSent},
-			protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset:    {m.handleContactRequestReferenceReset},
+			protocoltypes.EventType_EventTypeAccountContactRequestReferenceReset:    {m.handleAccountPolicyChanged},
 			protocoltypes.EventType_EventTypeAccountContactUnblocked:                {m.handleContactUnblocked},
+			protocoltypes.EventType_EventTypeAccountContactVerified:                 {m.handleContactVerified},
+			protocoltypes.EventType_EventTypeAccountContactIntroductionAccepted:     {m.handleContactIntroductionAccepted},
+			protocoltypes.EventType_EventTypeAccountContactDeleted:                  {m.handleContactDeleted},
+			protocoltypes.EventType_EventTypeAccountContactMetadataSet:              {m.handleContactMetadataSet},
+			protocoltypes.EventType_EventTypeAccountPresenceSettingsSet:             {m.handleAccountPolicyChanged},
+			protocoltypes.EventType_EventTypeAccountReadReceiptsSet:                 {m.handleAccountPolicyChanged},
+			protocoltypes.EventType_EventTypeAccountDeviceRevoked:                   {m.handleDeviceRevoked},
+			protocoltypes.EventType_EventTypeAccountDeviceLinked:                    {m.handlePrimaryDevice},
+			protocoltypes.EventType_EventTypeAccountDeviceNameSet:                   {m.handleDeviceNameSet},
+			protocoltypes.EventType_EventTypeAccountSettingSet:                      {m.handleSettingSet},
+			protocoltypes.EventType_EventTypeAccountPrimaryDeviceClaimed:            {m.handlePrimaryDevice},
+			protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferProposed:   {m.handlePrimaryDevice},
+			protocoltypes.EventType_EventTypeAccountPrimaryDeviceTransferAccepted:   {m.handlePrimaryDevice},
+			protocoltypes.EventType_EventTypeAccountGroupDeviceRegistered:           {m.handleGroupDeviceRegistered},
 			protocoltypes.EventType_EventTypeAccountGroupJoined:                     {m.handleGroupJoined},
 			protocoltypes.EventType_EventTypeAccountGroupLeft:                       {m.handleGroupLeft},
 			protocoltypes.EventType_EventTypeContactAliasKeyAdded:                   {m.handleContactAliasKeyAdded},
+			protocoltypes.EventType_EventTypeContactSessionReset:                    {m.handleContactSessionReset},
+			protocoltypes.EventType_EventTypeContactAccountReintroduced:             {m.handleContactAccountReintroduced},
+			protocoltypes.EventType_EventTypeContactIntroductionSent:                {m.handleContactIntroductionSent},
+			protocoltypes.EventType_EventTypeContactDeviceRevoked:                   {m.handleDeviceRevoked},
+			protocoltypes.EventType_EventTypeContactRemoved:                         {m.handleContactRemoved},
+			protocoltypes.EventType_EventTypeMultiMemberGroupDeviceRevoked:          {m.handleDeviceRevoked},
 			protocoltypes.EventType_EventTypeGroupDeviceChainKeyAdded:               {m.handleGroupDeviceChainKeyAdded},
+			protocoltypes.EventType_EventTypeGroupDeviceCapabilitiesSet:             {m.handleGroupDeviceCapabilitiesSet},
+			protocoltypes.EventType_EventTypeGroupDeviceKeyRotated:                  {m.handleGroupDeviceKeyRotated},
+			protocoltypes.EventType_EventTypeGroupReplicating:                       {m.handleGroupReplicating},
+			protocoltypes.EventType_EventTypeGroupMessagesAcknowledged:              {m.handleGroupMessagesAcknowledged},
+			protocoltypes.EventType_EventTypeGroupMessagesRead:                      {m.handleGroupMessagesRead},
+			protocoltypes.EventType_EventTypeGroupDisappearingMessagesSet:           {m.handleGroupDisappearingMessagesSet},
 			protocoltypes.EventType_EventTypeGroupMemberDeviceAdded:                 {m.handleGroupMemberDeviceAdded},
 			protocoltypes.EventType_EventTypeMultiMemberGroupAdminRoleGranted:       {m.handleMultiMemberGrantAdminRole},
 			protocoltypes.EventType_EventTypeMultiMemberGroupInitialMemberAnnounced: {m.handleMultiMemberInitialMember},
+			protocoltypes.EventType_EventTypeMultiMemberGroupMemberRemoved:          {m.handleMultiMemberGroupMemberRemoved},
+			protocoltypes.EventType_EventTypeMultiMemberGroupMemberRoleSet:          {m.handleMultiMemberGroupMemberRoleSet},
+			protocoltypes.EventType_EventTypeMultiMemberGroupInvitationRevoked:      {m.handleMultiMemberGroupInvitationRevoked},
+			protocoltypes.EventType_EventTypeMultiMemberGroupSecretRotated:          {m.handleMultiMemberGroupSecretRotated},
+			protocoltypes.EventType_EventTypeMultiMemberGroupSnapshotAdded:          {m.handleMultiMemberGroupSnapshotAdded},
+			protocoltypes.EventType_EventTypeMultiMemberGroupEpochCommitted:         {m.handleMultiMemberGroupEpochCommitted},
+			protocoltypes.EventType_EventTypeMultiMemberGroupBroadcastModeSet:       {m.handleMultiMemberGroupBroadcastModeSet},
+			protocoltypes.EventType_EventTypeMultiMemberGroupMemberApproved:         {m.handleMultiMemberGroupMemberApproved},
+			protocoltypes.EventType_EventTypeMultiMemberGroupMemberBanned:           {m.handleMultiMemberGroupMemberBanned},
+			protocoltypes.EventType_EventTypeMultiMemberGroupPublicModeSet:          {m.handleMultiMemberGroupPublicModeSet},
 			protocoltypes.EventType_EventTypeGroupMetadataPayloadSent:               {m.handleGroupMetadataPayloadSent},
 			protocoltypes.EventType_EventTypeAccountVerifiedCredentialRegistered:    {m.handleAccountVerifiedCredentialRegistered},
 		}
 
 		m.postIndexActions = []func() error{
 			m.postHandlerSentAliases,
+			m.postHandlerModeration,
+			m.postHandlerInvitations,
+			m.postHandlerEpochs,
 		}
 
 		return m
@@ -0,0 +1,244 @@
+package weshnet
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/cryptoutil"
+	"berty.tech/weshnet/v2/pkg/errcode"
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+const (
+	// dsNamespaceIndexCacheEntries stores the opened metadata of the entries
+	// of each cached index
+	dsNamespaceIndexCacheEntries = "entries"
+
+	// namespaceIndexCacheKey is used to derive the key sealing the cached
+	// metadata of a group from its secret
+	namespaceIndexCacheKey = "weshnet/index-cache"
+)
+
+// metadataIndexCache persists the metadata of the entries replayed by the
+// indexes of the metadata stores. Opening an entry decrypts it and checks its
+// signature, which dominates the startup of large accounts, so the indexes
+// are rebuilt from the cached metadata and only the entries added since are
+// opened. The entries are content-addressed, so the metadata cached for a CID
+// is valid whatever the heads of the log. The handlers of the events are
+// still replayed, they only update the maps of the index in memory. The
+// metadata is sealed with a key derived from the secret of the group, so the
+// cache doesn't leak the events of the groups the datastore isn't encrypted.
+type metadataIndexCache struct {
+	datastore datastore.Datastore
+}
+
+func newMetadataIndexCache(ds datastore.Datastore) *metadataIndexCache {
+	return &metadataIndexCache{datastore: ds}
+}
+
+// indexCacheSealKey returns the key sealing the cached metadata of the group
+func indexCacheSealKey(g *protocoltypes.Group) (*[cryptoutil.KeySize]byte, error) {
+	if len(g.GetSecret()) == 0 {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("no group secret"))
+	}
+
+	key := make([]byte, cryptoutil.KeySize)
+	kdf := hkdf.New(sha3.New256, g.GetSecret(), nil, []byte(namespaceIndexCacheKey))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, errcode.ErrCode_ErrStreamRead.Wrap(err)
+	}
+
+	return cryptoutil.KeySliceToArray(key)
+}
+
+func sealIndexCacheEntry(sealKey *[cryptoutil.KeySize]byte, data []byte) ([]byte, error) {
+	nonce, err := cryptoutil.GenerateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], data, nonce, sealKey), nil
+}
+
+func openIndexCacheEntry(sealKey *[cryptoutil.KeySize]byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < cryptoutil.NonceSize {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("sealed value too short"))
+	}
+
+	nonce, err := cryptoutil.NonceSliceToArray(sealed[:cryptoutil.NonceSize])
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secretbox.Open(nil, sealed[cryptoutil.NonceSize:], nonce, sealKey)
+	if !ok {
+		return nil, errcode.ErrCode_ErrCryptoDecrypt.Wrap(fmt.Errorf("unable to open cached index entry"))
+	}
+
+	return data, nil
+}
+
+func dsKeyForIndexCache(namespace string, address string, parts ...string) datastore.Key {
+	return datastore.KeyWithNamespaces(append([]string{
+		namespace,
+		base64.RawURLEncoding.EncodeToString([]byte(address)),
+	}, parts...))
+}
+
+// load returns the cached metadata of the entries of the store indexed by
+// CID
+func (c *metadataIndexCache) load(ctx context.Context, address string, sealKey *[cryptoutil.KeySize]byte) (map[string]*protocoltypes.GroupMetadata, error) {
+	prefix := dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address)
+
+	results, err := c.datastore.Query(ctx, query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	entries := map[string]*protocoltypes.GroupMetadata{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		id, err := cid.Decode(datastore.RawKey(result.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		data, err := openIndexCacheEntry(sealKey, result.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		metadata := &protocoltypes.GroupMetadata{}
+		if err := proto.Unmarshal(data, metadata); err != nil {
+			return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+		}
+
+		entries[id.KeyString()] = metadata
+	}
+
+	return entries, nil
+}
+
+// cachedEntries returns the CIDs of the entries cached for the store
+func (c *metadataIndexCache) cachedEntries(ctx context.Context, address string) (map[string]struct{}, error) {
+	prefix := dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address)
+
+	results, err := c.datastore.Query(ctx, query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return nil, errcode.ErrCode_ErrDBRead.Wrap(err)
+	}
+	defer results.Close()
+
+	entries := map[string]struct{}{}
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, errcode.ErrCode_ErrDBRead.Wrap(result.Error)
+		}
+
+		id, err := cid.Decode(datastore.RawKey(result.Key).BaseNamespace())
+		if err != nil {
+			continue
+		}
+
+		entries[id.KeyString()] = struct{}{}
+	}
+
+	return entries, nil
+}
+
+// store replaces the cached index of the store, only the entries missing
+// from previous are written and the ones not replayed anymore are deleted
+func (c *metadataIndexCache) store(ctx context.Context, address string, sealKey *[cryptoutil.KeySize]byte, entries map[string]*protocoltypes.GroupMetadata, previous map[string]*protocoltypes.GroupMetadata) error {
+	for key, metadata := range entries {
+		if _, ok := previous[key]; ok {
+			continue
+		}
+
+		id, err := cid.Cast([]byte(key))
+		if err != nil {
+			return errcode.ErrCode_ErrInvalidInput.Wrap(err)
+		}
+
+		data, err := proto.Marshal(metadata)
+		if err != nil {
+			return errcode.ErrCode_ErrSerialization.Wrap(err)
+		}
+
+		if data, err = sealIndexCacheEntry(sealKey, data); err != nil {
+			return err
+		}
+
+		if err := c.datastore.Put(ctx, dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address, id.String()), data); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	for key := range previous {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+
+		id, err := cid.Cast([]byte(key))
+		if err != nil {
+			continue
+		}
+
+		if err := c.datastore.Delete(ctx, dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address, id.String())); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// reset deletes the cached index of the store, used once its entries have
+// been deleted or when the cached entries can't be opened
+func (c *metadataIndexCache) reset(ctx context.Context, address string) error {
+	entries, err := c.cachedEntries(ctx, address)
+	if err != nil {
+		return err
+	}
+
+	for key := range entries {
+		id, err := cid.Cast([]byte(key))
+		if err != nil {
+			continue
+		}
+
+		if err := c.datastore.Delete(ctx, dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address, id.String())); err != nil {
+			return errcode.ErrCode_ErrDBWrite.Wrap(err)
+		}
+	}
+
+	return nil
+}
+
+// openCachedMetadata returns the event of cached metadata, its signature
+// has been checked when the entry has been first opened
+func openCachedMetadata(metadata *protocoltypes.GroupMetadata) (proto.Message, error) {
+	et, ok := eventTypesMapper[metadata.EventType]
+	if !ok {
+		return nil, errcode.ErrCode_ErrInvalidInput.Wrap(fmt.Errorf("event type not found"))
+	}
+
+	payload := proto.Clone(et.Message)
+	if err := proto.Unmarshal(metadata.Payload, payload); err != nil {
+		return nil, errcode.ErrCode_ErrDeserialization.Wrap(err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,89 @@
+package weshnet
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dsync "github.com/ipfs/go-datastore/sync"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"berty.tech/weshnet/v2/pkg/protocoltypes"
+)
+
+func TestMetadataIndexCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	datastore := dsync.MutexWrap(ds.NewMapDatastore())
+	cache := newMetadataIndexCache(datastore)
+	ids := testLogCompactionCIDs(t)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+	sealKey, err := indexCacheSealKey(g)
+	require.NoError(t, err)
+	address := "/orbitdb/store"
+
+	event, err := proto.Marshal(&protocoltypes.GroupMessagesRead{DevicePk: []byte("device")})
+	require.NoError(t, err)
+
+	entries := map[string]*protocoltypes.GroupMetadata{
+		ids[0].KeyString(): {EventType: protocoltypes.EventType_EventTypeGroupMessagesRead, Payload: event},
+		ids[1].KeyString(): {EventType: protocoltypes.EventType_EventTypeGroupMetadataPayloadSent},
+	}
+
+	// nothing is cached yet
+	cached, err := cache.load(ctx, address, sealKey)
+	require.NoError(t, err)
+	require.Empty(t, cached)
+
+	require.NoError(t, cache.store(ctx, address, sealKey, entries, nil))
+
+	cached, err = cache.load(ctx, address, sealKey)
+	require.NoError(t, err)
+	require.Len(t, cached, 2)
+	require.True(t, proto.Equal(entries[ids[0].KeyString()], cached[ids[0].KeyString()]))
+
+	// the metadata isn't cached in clear
+	key := dsKeyForIndexCache(dsNamespaceIndexCacheEntries, address, ids[0].String())
+	data, err := datastore.Get(ctx, key)
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "device")
+
+	// the cache of another group can't be opened
+	other, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+	otherKey, err := indexCacheSealKey(other)
+	require.NoError(t, err)
+
+	_, err = cache.load(ctx, address, otherKey)
+	require.Error(t, err)
+
+	opened, err := openCachedMetadata(cached[ids[0].KeyString()])
+	require.NoError(t, err)
+	require.Equal(t, []byte("device"), opened.(*protocoltypes.GroupMessagesRead).DevicePk)
+
+	// the new entries are added and the ones not replayed anymore are
+	// deleted
+	delete(entries, ids[0].KeyString())
+	entries[ids[2].KeyString()] = &protocoltypes.GroupMetadata{EventType: protocoltypes.EventType_EventTypeGroupMetadataPayloadSent}
+	require.NoError(t, cache.store(ctx, address, sealKey, entries, cached))
+
+	cached, err = cache.load(ctx, address, sealKey)
+	require.NoError(t, err)
+	require.Len(t, cached, 2)
+	require.Contains(t, cached, ids[1].KeyString())
+	require.Contains(t, cached, ids[2].KeyString())
+
+	require.NoError(t, cache.reset(ctx, address))
+
+	cached, err = cache.load(ctx, address, sealKey)
+	require.NoError(t, err)
+	require.Empty(t, cached)
+
+	previous, err := cache.cachedEntries(ctx, address)
+	require.NoError(t, err)
+	require.Empty(t, previous)
+}
@@ -6,19 +6,26 @@ import (
 	crand "crypto/rand"
 	"fmt"
 	mrand "math/rand"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	datastore "github.com/ipfs/go-datastore"
 	ds_sync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	mh "github.com/multiformats/go-multihash"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
 
+	"berty.tech/weshnet/v2/pkg/errcode"
 	"berty.tech/weshnet/v2/pkg/ipfsutil"
 	"berty.tech/weshnet/v2/pkg/protocoltypes"
+	"berty.tech/weshnet/v2/pkg/ratchettree"
+	"berty.tech/weshnet/v2/pkg/secretstore"
 	"berty.tech/weshnet/v2/pkg/testutil"
 )
 
@@ -790,3 +797,1268 @@ func TestFlappyMultiDevices_Basic(t *testing.T) {
 	groups = meta[pi[1][2]].ListMultiMemberGroups()
 	require.Len(t, groups, 1)
 }
+
+func TestMetadataIndexModeration(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, ownerRaw, ownerDeviceRaw := newTestingMemberDevice(t, nil)
+	memberA, memberARaw, memberADeviceRaw := newTestingMemberDevice(t, nil)
+	memberB, memberBRaw, memberBDeviceRaw := newTestingMemberDevice(t, nil)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	for _, md := range []secretstore.MemberDevice{owner, memberA, memberB} {
+		memberRaw, err := md.Member().Raw()
+		require.NoError(t, err)
+
+		deviceRaw, err := md.Device().Raw()
+		require.NoError(t, err)
+
+		m.devices[string(deviceRaw)] = md
+		m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+	}
+	m.admins[owner.Device()] = struct{}{}
+
+	chronologicalEvents := []proto.Message{
+		// not an admin yet
+		&protocoltypes.MultiMemberGroupMemberRemoved{DevicePk: memberADeviceRaw, MemberPk: memberBRaw},
+		&protocoltypes.MultiMemberGroupSecretRotated{DevicePk: memberADeviceRaw},
+		&protocoltypes.MultiMemberGroupMemberRoleSet{DevicePk: ownerDeviceRaw, MemberPk: memberARaw, Role: protocoltypes.GroupMemberRole_GroupMemberRoleAdmin},
+		&protocoltypes.MultiMemberGroupMemberRemoved{DevicePk: memberADeviceRaw, MemberPk: memberBRaw},
+		// the group creator role can't be changed
+		&protocoltypes.MultiMemberGroupMemberRoleSet{DevicePk: memberADeviceRaw, MemberPk: ownerRaw, Role: protocoltypes.GroupMemberRole_GroupMemberRoleMember},
+		&protocoltypes.MultiMemberGroupSecretRotated{DevicePk: ownerDeviceRaw},
+		&protocoltypes.MultiMemberGroupBroadcastModeSet{DevicePk: memberBDeviceRaw, Enabled: false},
+		&protocoltypes.MultiMemberGroupBroadcastModeSet{DevicePk: ownerDeviceRaw, Enabled: true},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+
+	require.Equal(t, map[string]protocoltypes.GroupMemberRole{
+		string(ownerRaw):   protocoltypes.GroupMemberRole_GroupMemberRoleAdmin,
+		string(memberARaw): protocoltypes.GroupMemberRole_GroupMemberRoleAdmin,
+	}, m.listRoles())
+
+	removed, err := m.isMemberRemoved(memberB.Member())
+	require.NoError(t, err)
+	require.True(t, removed)
+
+	// one removal and one rotation
+	require.Equal(t, uint64(2), m.getChainKeyEpoch())
+	require.Len(t, m.listMembers(), 2)
+	require.Len(t, m.listDevices(), 2)
+
+	// only moderators and admins can publish in broadcast mode
+	require.True(t, m.isBroadcastMode())
+	require.True(t, m.canDevicePublish(memberADeviceRaw))
+	require.False(t, m.canDevicePublish(memberBDeviceRaw))
+}
+
+func TestMetadataIndexSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ownerStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	joinerStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, err := ownerStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	ownerRaw, err := owner.Member().Raw()
+	require.NoError(t, err)
+
+	ownerDeviceRaw, err := owner.Device().Raw()
+	require.NoError(t, err)
+
+	joiner, err := joinerStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	_, removedMember, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	_, removedDevice, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	removedMemberRaw, err := removedMember.Raw()
+	require.NoError(t, err)
+
+	removedDeviceRaw, err := removedDevice.Raw()
+	require.NoError(t, err)
+
+	// state of the group as seen by the owner
+	source := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	source.admins[owner.Device()] = struct{}{}
+	source.devices[string(ownerDeviceRaw)] = owner
+	source.members[string(ownerRaw)] = []secretstore.MemberDevice{owner}
+	source.devices[string(removedDeviceRaw)] = secretstore.NewMemberDevice(removedMember, removedDevice)
+	source.members[string(removedMemberRaw)] = []secretstore.MemberDevice{source.devices[string(removedDeviceRaw)]}
+	source.removedMembers[string(removedMemberRaw)] = struct{}{}
+	source.chainKeyEpoch = 3
+	source.invitationRequired = true
+
+	snapshot := source.newSnapshot()
+	snapshot.DevicePk = ownerDeviceRaw
+
+	snapshotHash, err := cid.Decode("QmdfTbBqBPQ7VNxZEYEj14VmRuZBkqFbiwReogJgS1zR1n")
+	require.NoError(t, err)
+
+	newJoinerIndex := func() *metadataStoreIndex {
+		m := newMetadataIndex(ctx, g, joiner, nil)(nil).(*metadataStoreIndex)
+		m.eventHash = snapshotHash
+		return m
+	}
+
+	// the snapshot isn't used until a replay of the log has shown that its
+	// device is an admin, the inviter of the device isn't trusted either
+	invitation, err := newGroupInvitationToken(g, owner, 0, false)
+	require.NoError(t, err)
+
+	m := newJoinerIndex()
+	m.group = proto.Clone(g).(*protocoltypes.Group)
+	m.group.Invitation = invitation
+	require.NoError(t, m.handleMultiMemberGroupSnapshotAdded(snapshot))
+	require.Nil(t, m.snapshot)
+	require.NoError(t, m.postHandlerModeration())
+	require.False(t, m.snapshotCheckpoint().Defined())
+
+	// the replay knows the owner as an admin, the snapshot is verified
+	m = newJoinerIndex()
+	m.admins[owner.Device()] = struct{}{}
+	m.eventsSinceSnapshot = 2
+	require.NoError(t, m.handleMultiMemberGroupSnapshotAdded(snapshot))
+	require.Nil(t, m.snapshot)
+	m.eventsSinceSnapshot = 5
+	require.NoError(t, m.postHandlerModeration())
+	require.Equal(t, snapshotHash, m.snapshotCheckpoint())
+
+	// only the events newer than the snapshot are counted
+	require.Equal(t, 2, m.eventsSinceSnapshot)
+
+	// the next replays are started from the verified snapshot
+	m.snapshotCandidates = map[*protocoltypes.MultiMemberGroupSnapshotAdded]snapshotCandidate{}
+	m.admins = map[crypto.PubKey]struct{}{}
+	require.NoError(t, m.handleMultiMemberGroupSnapshotAdded(snapshot))
+	require.NotNil(t, m.snapshot)
+	require.NoError(t, m.postHandlerModeration())
+	require.NoError(t, m.postHandlerInvitations())
+
+	require.Len(t, m.listMembers(), 1)
+	require.True(t, m.isOwner(ownerRaw))
+	require.True(t, m.isAdminDevice(ownerDeviceRaw))
+	require.True(t, m.invitationRequired)
+	require.Equal(t, uint64(3), m.getChainKeyEpoch())
+
+	removed, err := m.isMemberRemoved(removedMember)
+	require.NoError(t, err)
+	require.True(t, removed)
+
+	// devices listed in the snapshot replay the whole log
+	m = newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	m.eventHash = snapshotHash
+	m.verifiedSnapshots[snapshotHash.KeyString()] = struct{}{}
+	require.NoError(t, m.handleMultiMemberGroupSnapshotAdded(snapshot))
+	require.Nil(t, m.snapshot)
+}
+
+func TestMetadataIndexBanList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, ownerRaw, ownerDeviceRaw := newTestingMemberDevice(t, nil)
+	memberA, memberARaw, _ := newTestingMemberDevice(t, nil)
+	_, memberBRaw, _ := newTestingMemberDevice(t, nil)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	for _, md := range []secretstore.MemberDevice{owner, memberA} {
+		memberRaw, err := md.Member().Raw()
+		require.NoError(t, err)
+
+		deviceRaw, err := md.Device().Raw()
+		require.NoError(t, err)
+
+		m.devices[string(deviceRaw)] = md
+		m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+	}
+	m.admins[owner.Device()] = struct{}{}
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.MultiMemberGroupMemberBanned{DevicePk: ownerDeviceRaw, MemberPk: memberARaw},
+		&protocoltypes.MultiMemberGroupMemberBanned{DevicePk: ownerDeviceRaw, MemberPk: memberARaw, Unban: true},
+		&protocoltypes.MultiMemberGroupMemberBanned{DevicePk: ownerDeviceRaw, MemberPk: memberARaw},
+		// members can be banned before joining
+		&protocoltypes.MultiMemberGroupMemberBanned{DevicePk: ownerDeviceRaw, MemberPk: memberBRaw},
+		// the group creator can't be banned
+		&protocoltypes.MultiMemberGroupMemberBanned{DevicePk: ownerDeviceRaw, MemberPk: ownerRaw},
+	}
+
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+
+	require.ElementsMatch(t, [][]byte{memberARaw, memberBRaw}, m.listBannedMembers())
+	require.Len(t, m.listMembers(), 1)
+
+	// each ban of an active member starts a new epoch
+	require.Equal(t, uint64(2), m.getChainKeyEpoch())
+}
+
+func TestMetadataIndexJoinEpoch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ownerStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, err := ownerStore.GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	ownerRaw, err := owner.Member().Raw()
+	require.NoError(t, err)
+
+	ownerDeviceRaw, err := owner.Device().Raw()
+	require.NoError(t, err)
+
+	invitation, err := newGroupInvitationToken(g, owner, 0, false)
+	require.NoError(t, err)
+
+	approvalInvitation, err := newGroupInvitationToken(g, owner, 0, true)
+	require.NoError(t, err)
+
+	_, memberA, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberARaw, err := memberA.Raw()
+	require.NoError(t, err)
+
+	_, memberB, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberBRaw, err := memberB.Raw()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	m.admins[owner.Device()] = struct{}{}
+	m.devices[string(ownerDeviceRaw)] = owner
+	m.members[string(ownerRaw)] = []secretstore.MemberDevice{owner}
+
+	deviceRaw := map[string][]byte{}
+	for _, member := range []crypto.PubKey{memberA, memberB} {
+		md, memberRaw, raw := newTestingMemberDevice(t, member)
+		m.devices[string(raw)] = md
+		m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+		deviceRaw[string(memberRaw)] = raw
+	}
+
+	joins := []memberJoin{
+		{position: 3, memberPK: ownerRaw},
+		{position: 2, memberPK: memberARaw, invitation: invitation},
+		// a second device of the same member
+		{position: 1, memberPK: memberARaw, invitation: invitation},
+		{position: 0, memberPK: memberBRaw, invitation: approvalInvitation},
+	}
+
+	m.eventsMemberJoined = append([]memberJoin(nil), joins...)
+	require.NoError(t, m.postHandlerModeration())
+	require.NoError(t, m.postHandlerInvitations())
+	require.NoError(t, m.postHandlerEpochs())
+
+	// the joining members start the first epoch, a pending member isn't part
+	// of it
+	changes := m.getEpochChanges()
+	require.True(t, changes.pending())
+	require.False(t, changes.revoking())
+	require.ElementsMatch(t, [][]byte{ownerDeviceRaw, deviceRaw[string(memberARaw)]}, changes.adds)
+	require.ElementsMatch(t, changes.adds, changes.committers)
+
+	root, err := ownerStore.CreateGroupEpochCommit(ctx, g, nil, &ratchettree.Tree{}, m.getChainKeyEpoch()+1, nil, changes.adds)
+	require.NoError(t, err)
+
+	rootID := newEpochCommitCID(t, "root")
+	m.eventHash = rootID
+	require.NoError(t, m.handleMultiMemberGroupEpochCommitted(root))
+
+	m.eventsMemberJoined = append([]memberJoin(nil), joins...)
+	require.NoError(t, m.postHandlerModeration())
+	require.NoError(t, m.postHandlerInvitations())
+	require.NoError(t, m.postHandlerEpochs())
+
+	require.Equal(t, uint64(1), m.getChainKeyEpoch())
+	require.False(t, m.getEpochChanges().pending())
+
+	// the approval of the pending member starts the next one
+	approval := &protocoltypes.MultiMemberGroupMemberApproved{DevicePk: ownerDeviceRaw, MemberPk: memberBRaw}
+
+	m.eventsMemberJoined = append([]memberJoin(nil), joins...)
+	m.eventsModeration = []proto.Message{approval, root}
+	require.NoError(t, m.postHandlerModeration())
+	require.NoError(t, m.postHandlerInvitations())
+	require.NoError(t, m.postHandlerEpochs())
+
+	changes = m.getEpochChanges()
+	require.Equal(t, rootID, changes.tip.id)
+	require.Equal(t, [][]byte{deviceRaw[string(memberBRaw)]}, changes.adds)
+	require.Empty(t, changes.removes)
+}
+
+func TestMetadataIndexEpochCommits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	stores := make([]secretstore.SecretStore, 3)
+	devices := make([][]byte, 3)
+	for i := range stores {
+		stores[i], err = secretstore.NewInMemSecretStore(nil)
+		require.NoError(t, err)
+
+		md, err := stores[i].GetOwnMemberDeviceForGroup(g)
+		require.NoError(t, err)
+
+		devices[i], err = md.Device().Raw()
+		require.NoError(t, err)
+	}
+
+	owner, err := stores[0].GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	newIndex := func() *metadataStoreIndex {
+		m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+		for _, store := range stores {
+			md, err := store.GetOwnMemberDeviceForGroup(g)
+			require.NoError(t, err)
+
+			memberRaw, err := md.Member().Raw()
+			require.NoError(t, err)
+
+			deviceRaw, err := md.Device().Raw()
+			require.NoError(t, err)
+
+			m.devices[string(deviceRaw)] = md
+			m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+		}
+
+		return m
+	}
+
+	// replay handles the commits from the newest to the oldest
+	replay := func(m *metadataStoreIndex, ids []cid.Cid, commits []*protocoltypes.MultiMemberGroupEpochCommitted) {
+		for i := len(commits) - 1; i >= 0; i-- {
+			m.eventHash = ids[i]
+			require.NoError(t, m.handleMultiMemberGroupEpochCommitted(commits[i]))
+		}
+
+		require.NoError(t, m.postHandlerModeration())
+		require.NoError(t, m.postHandlerInvitations())
+		require.NoError(t, m.postHandlerEpochs())
+	}
+
+	root, err := stores[0].CreateGroupEpochCommit(ctx, g, nil, &ratchettree.Tree{}, 1, nil, devices[:2])
+	require.NoError(t, err)
+
+	rootID := newEpochCommitCID(t, "root")
+
+	m := newIndex()
+	replay(m, []cid.Cid{rootID}, []*protocoltypes.MultiMemberGroupEpochCommitted{root})
+
+	tip := m.getEpochTip()
+	require.NotNil(t, tip)
+	require.Equal(t, 2, tip.tree.Size())
+
+	for i, store := range stores {
+		known, err := store.ProcessGroupEpochCommit(ctx, g, rootID.Bytes(), tip.parent, root)
+		require.NoError(t, err)
+		require.Equal(t, i < 2, known)
+	}
+
+	// two devices of the epoch commit the join of the third one at the same
+	// time, the oldest commit is the current epoch
+	first, err := stores[1].CreateGroupEpochCommit(ctx, g, rootID.Bytes(), tip.tree, 2, nil, devices[2:])
+	require.NoError(t, err)
+
+	second, err := stores[0].CreateGroupEpochCommit(ctx, g, rootID.Bytes(), tip.tree, 2, nil, devices[2:])
+	require.NoError(t, err)
+
+	// a commit skipping an epoch is ignored
+	skipping, err := stores[0].CreateGroupEpochCommit(ctx, g, rootID.Bytes(), tip.tree, 3, nil, devices[2:])
+	require.NoError(t, err)
+
+	// so is a commit of a device not part of the parent epoch
+	external, err := stores[2].CreateGroupEpochCommit(ctx, g, rootID.Bytes(), tip.tree, 2, nil, devices[2:])
+	require.NoError(t, err)
+
+	firstID, secondID := newEpochCommitCID(t, "first"), newEpochCommitCID(t, "second")
+	skippingID, externalID := newEpochCommitCID(t, "skipping"), newEpochCommitCID(t, "external")
+
+	m = newIndex()
+	replay(m,
+		[]cid.Cid{rootID, externalID, firstID, secondID, skippingID},
+		[]*protocoltypes.MultiMemberGroupEpochCommitted{root, external, first, second, skipping},
+	)
+
+	require.Len(t, m.listEpochCommits(), 3)
+	require.Equal(t, firstID, m.getEpochTip().id)
+	require.Equal(t, uint64(2), m.getChainKeyEpoch())
+	require.False(t, m.getEpochChanges().pending())
+
+	// the devices of the epoch and the added device get the secrets of both
+	// forks
+	for _, c := range m.listEpochCommits()[1:] {
+		for _, store := range stores {
+			known, err := store.ProcessGroupEpochCommit(ctx, g, c.id.Bytes(), c.parent, c.event)
+			require.NoError(t, err)
+			require.True(t, known)
+		}
+	}
+
+	added, err := stores[2].GetOwnMemberDeviceForGroup(g)
+	require.NoError(t, err)
+
+	encrypted, err := stores[2].GetEpochShareableChainKey(ctx, g, firstID.Bytes())
+	require.NoError(t, err)
+
+	for _, store := range stores[:2] {
+		require.NoError(t, store.RegisterEpochChainKey(ctx, g, firstID.Bytes(), added.Device(), encrypted))
+	}
+
+	// the rotation of a device key is a revoking change, the next epoch is
+	// committed without the previous key
+	m.rotatedDevices[string(devices[1])] = &protocoltypes.GroupDeviceKeyRotated{DevicePk: devices[1]}
+
+	changes := m.getEpochChanges()
+	require.True(t, changes.revoking())
+	require.Equal(t, [][]byte{devices[1]}, changes.removes)
+	require.Equal(t, -1, changes.rank(devices[1]))
+
+	removal, err := stores[0].CreateGroupEpochCommit(ctx, g, firstID.Bytes(), m.getEpochTip().tree, 3, changes.removes, nil)
+	require.NoError(t, err)
+
+	removalID := newEpochCommitCID(t, "removal")
+	replay(m, []cid.Cid{rootID, firstID, secondID, removalID}, []*protocoltypes.MultiMemberGroupEpochCommitted{root, first, second, removal})
+	require.Equal(t, removalID, m.getEpochTip().id)
+
+	for i, store := range stores {
+		known, err := store.ProcessGroupEpochCommit(ctx, g, removalID.Bytes(), m.getEpochTip().parent, removal)
+		require.NoError(t, err)
+		require.Equal(t, i != 1, known)
+	}
+
+	// the snapshot summarizes the current epoch tree
+	snapshot := m.newSnapshot()
+	require.Equal(t, removalID.Bytes(), snapshot.EpochCommitId)
+
+	tree, err := secretstore.LoadEpochTree(snapshot.EpochTreeLeaves, snapshot.EpochTreeParents)
+	require.NoError(t, err)
+	require.Equal(t, 2, tree.Size())
+	require.Less(t, tree.Find(devices[1]), 0)
+}
+
+func newEpochCommitCID(t *testing.T, data string) cid.Cid {
+	t.Helper()
+
+	hash, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+	require.NoError(t, err)
+
+	return cid.NewCidV1(cid.DagCBOR, hash)
+}
+
+func TestMetadataIndexOwnershipTransfer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, ownerRaw, ownerDeviceRaw := newTestingMemberDevice(t, nil)
+	memberA, memberARaw, memberADeviceRaw := newTestingMemberDevice(t, nil)
+	memberB, memberBRaw, memberBDeviceRaw := newTestingMemberDevice(t, nil)
+	_, unknownRaw, _ := newTestingMemberDevice(t, nil)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	for _, md := range []secretstore.MemberDevice{owner, memberA, memberB} {
+		memberRaw, err := md.Member().Raw()
+		require.NoError(t, err)
+
+		deviceRaw, err := md.Device().Raw()
+		require.NoError(t, err)
+
+		m.devices[string(deviceRaw)] = md
+		m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+	}
+	m.admins[owner.Device()] = struct{}{}
+
+	chronologicalEvents := []proto.Message{
+		// only the owner can transfer the ownership
+		&protocoltypes.MultiMemberGroupOwnershipTransferred{DevicePk: memberBDeviceRaw, MemberPk: memberBRaw},
+		// the new owner must be a member of the group
+		&protocoltypes.MultiMemberGroupOwnershipTransferred{DevicePk: ownerDeviceRaw, MemberPk: unknownRaw},
+		&protocoltypes.MultiMemberGroupOwnershipTransferred{DevicePk: ownerDeviceRaw, MemberPk: memberARaw},
+		// the previous owner stays an admin but can't transfer the ownership anymore
+		&protocoltypes.MultiMemberGroupOwnershipTransferred{DevicePk: ownerDeviceRaw, MemberPk: memberBRaw},
+		&protocoltypes.MultiMemberGroupMemberRoleSet{DevicePk: ownerDeviceRaw, MemberPk: memberBRaw, Role: protocoltypes.GroupMemberRole_GroupMemberRoleModerator},
+		// the new owner can't be demoted
+		&protocoltypes.MultiMemberGroupMemberRoleSet{DevicePk: ownerDeviceRaw, MemberPk: memberARaw, Role: protocoltypes.GroupMemberRole_GroupMemberRoleMember},
+		&protocoltypes.MultiMemberGroupMemberRoleSet{DevicePk: memberADeviceRaw, MemberPk: ownerRaw, Role: protocoltypes.GroupMemberRole_GroupMemberRoleMember},
+	}
+
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+
+	require.True(t, m.isOwner(memberARaw))
+	require.False(t, m.isOwner(ownerRaw))
+	require.True(t, m.isAdminDevice(memberADeviceRaw))
+	require.False(t, m.isAdminDevice(ownerDeviceRaw))
+
+	require.Equal(t, map[string]protocoltypes.GroupMemberRole{
+		string(ownerRaw):   protocoltypes.GroupMemberRole_GroupMemberRoleMember,
+		string(memberARaw): protocoltypes.GroupMemberRole_GroupMemberRoleAdmin,
+		string(memberBRaw): protocoltypes.GroupMemberRole_GroupMemberRoleModerator,
+	}, m.listRoles())
+
+	// devices starting from a snapshot know the new owner
+	require.Equal(t, memberARaw, m.newSnapshot().OwnerMemberPk)
+}
+
+func TestMetadataIndexDisappearingMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	owner, _, ownerDeviceRaw := newTestingMemberDevice(t, nil)
+	member, _, memberDeviceRaw := newTestingMemberDevice(t, nil)
+	_, _, unknownDeviceRaw := newTestingMemberDevice(t, nil)
+
+	m := newMetadataIndex(ctx, g, owner, nil)(nil).(*metadataStoreIndex)
+	for _, md := range []secretstore.MemberDevice{owner, member} {
+		memberRaw, err := md.Member().Raw()
+		require.NoError(t, err)
+
+		deviceRaw, err := md.Device().Raw()
+		require.NoError(t, err)
+
+		m.devices[string(deviceRaw)] = md
+		m.members[string(memberRaw)] = []secretstore.MemberDevice{md}
+	}
+	m.admins[owner.Device()] = struct{}{}
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.GroupDisappearingMessagesSet{DevicePk: memberDeviceRaw, Duration: 60},
+		// only the devices of the group can change the delay
+		&protocoltypes.GroupDisappearingMessagesSet{DevicePk: unknownDeviceRaw, Duration: 1},
+		&protocoltypes.MultiMemberGroupBroadcastModeSet{DevicePk: ownerDeviceRaw, Enabled: true},
+		// in broadcast mode, only the devices allowed to send messages can
+		&protocoltypes.GroupDisappearingMessagesSet{DevicePk: memberDeviceRaw, Duration: 0},
+		&protocoltypes.GroupDisappearingMessagesSet{DevicePk: ownerDeviceRaw, Duration: 3600},
+	}
+
+	newEntryCID := func(data string) cid.Cid {
+		hash, err := mh.Sum([]byte(data), mh.SHA2_256, -1)
+		require.NoError(t, err)
+
+		return cid.NewCidV1(cid.DagCBOR, hash)
+	}
+
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		evt, ok := chronologicalEvents[i].(*protocoltypes.GroupDisappearingMessagesSet)
+		if !ok {
+			m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+			continue
+		}
+
+		m.eventHash = newEntryCID(fmt.Sprintf("entry %d", i))
+		require.NoError(t, m.handleGroupDisappearingMessagesSet(evt))
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+	require.Equal(t, time.Hour, m.getDisappearingMessages())
+
+	// the messages received before the entry setting the delay are kept
+	require.Equal(t, newEntryCID("entry 4"), m.getDisappearingMessagesEntry())
+
+	// devices starting from a snapshot know the delay
+	require.Equal(t, int64(3600), m.newSnapshot().DisappearingMessagesDuration)
+}
+
+func TestMetadataIndexContactRequestNonce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, g, nil, nil)(nil).(*metadataStoreIndex)
+	now := time.Now()
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.AccountContactRequestNonceRegistered{Nonce: []byte("single_use"), SingleUse: true},
+		&protocoltypes.AccountContactRequestNonceRegistered{Nonce: []byte("expired"), ExpiresAt: now.Add(-time.Minute).Unix()},
+		&protocoltypes.AccountContactRequestNonceRegistered{Nonce: []byte("expiring"), ExpiresAt: now.Add(time.Minute).Unix()},
+		&protocoltypes.AccountContactRequestNonceRegistered{Nonce: []byte("consumed"), SingleUse: true},
+		&protocoltypes.AccountContactRequestIncomingReceived{ContactPk: []byte("contact"), Nonce: []byte("consumed")},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		switch evt := chronologicalEvents[i].(type) {
+		case *protocoltypes.AccountContactRequestNonceRegistered:
+			require.NoError(t, m.handleContactRequestNonceRegistered(evt))
+		case *protocoltypes.AccountContactRequestIncomingReceived:
+			require.NoError(t, m.handleContactRequestIncomingReceived(evt))
+		}
+	}
+
+	require.NoError(t, m.checkContactRequestNonce([]byte("single_use"), now))
+	require.NoError(t, m.checkContactRequestNonce([]byte("expiring"), now))
+	require.Equal(t, errcode.ErrCode_ErrContactRequestExpired, m.checkContactRequestNonce([]byte("expiring"), now.Add(time.Hour)))
+	require.Equal(t, errcode.ErrCode_ErrContactRequestExpired, m.checkContactRequestNonce([]byte("expired"), now))
+	require.Equal(t, errcode.ErrCode_ErrContactRequestNonceInvalid, m.checkContactRequestNonce([]byte("consumed"), now))
+	require.Equal(t, errcode.ErrCode_ErrContactRequestNonceInvalid, m.checkContactRequestNonce([]byte("unknown"), now))
+
+	require.Equal(t, map[string]int64{
+		"single_use": 0,
+		"expiring":   now.Add(time.Minute).Unix(),
+	}, m.listContactRequestLinks(now))
+
+	// the seed of a link doesn't reveal the permanent one
+	seed := []byte("permanent seed")
+	require.NotEqual(t, seed, contactRequestLinkSeed(seed, []byte("single_use")))
+	require.NotEqual(t, contactRequestLinkSeed(seed, []byte("expiring")), contactRequestLinkSeed(seed, []byte("single_use")))
+	require.Equal(t, contactRequestLinkSeed(seed, []byte("expiring")), contactRequestLinkSeed(seed, []byte("expiring")))
+}
+
+func TestMetadataIndexContactSessionReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	md, _, deviceRaw := newTestingMemberDevice(t, nil)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeContact}, md, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(deviceRaw)] = md
+
+	require.NoError(t, m.handleContactSessionReset(&protocoltypes.ContactSessionReset{DevicePk: deviceRaw}))
+	require.NoError(t, m.handleContactSessionReset(&protocoltypes.ContactSessionReset{DevicePk: deviceRaw}))
+
+	// only the devices of the group can reset the session
+	require.NoError(t, m.handleContactSessionReset(&protocoltypes.ContactSessionReset{DevicePk: []byte("unknown")}))
+
+	require.NoError(t, m.postHandlerModeration())
+	require.Equal(t, uint64(2), m.getChainKeyEpoch())
+}
+
+func TestMetadataIndexDeviceRevoked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	_, contact, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	current, memberRaw, currentRaw := newTestingMemberDevice(t, member)
+	lost, _, lostRaw := newTestingMemberDevice(t, member)
+	contactDevice, _, contactDeviceRaw := newTestingMemberDevice(t, contact)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeContact}, current, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(currentRaw)] = current
+	m.devices[string(lostRaw)] = lost
+	m.devices[string(contactDeviceRaw)] = contactDevice
+
+	chronologicalEvents := []*protocoltypes.ContactDeviceRevoked{
+		// a contact can't revoke the devices of the account
+		{DevicePk: contactDeviceRaw, RevokedDevicePk: currentRaw},
+		{DevicePk: currentRaw, RevokedDevicePk: lostRaw},
+		// a revoked device can't revoke the other devices of its member
+		{DevicePk: lostRaw, RevokedDevicePk: currentRaw},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		require.NoError(t, m.handleDeviceRevoked(chronologicalEvents[i]))
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+	require.True(t, m.isDeviceRevoked(lostRaw))
+	require.False(t, m.isDeviceRevoked(currentRaw))
+	require.Equal(t, uint64(1), m.getChainKeyEpoch())
+
+	// the devices of a multi-member group are revoked the same way
+	m = newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeMultiMember}, current, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(currentRaw)] = current
+	m.devices[string(lostRaw)] = lost
+	m.devices[string(contactDeviceRaw)] = contactDevice
+
+	require.NoError(t, m.handleDeviceRevoked(&protocoltypes.MultiMemberGroupDeviceRevoked{DevicePk: currentRaw, RevokedDevicePk: lostRaw}))
+	require.NoError(t, m.handleDeviceRevoked(&protocoltypes.ContactDeviceRevoked{DevicePk: currentRaw, RevokedDevicePk: contactDeviceRaw}))
+	require.NoError(t, m.postHandlerModeration())
+	require.True(t, m.isDeviceRevoked(lostRaw))
+	require.False(t, m.isDeviceRevoked(contactDeviceRaw))
+	require.Equal(t, uint64(1), m.getChainKeyEpoch())
+
+	// the account chain keys are renewed for the remaining devices
+	m = newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, current, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(currentRaw)] = current
+	m.devices[string(lostRaw)] = lost
+	m.members[string(memberRaw)] = []secretstore.MemberDevice{current, lost}
+
+	devices, revoked := m.getActiveDevicesOfRevokedMember(member)
+	require.False(t, revoked)
+	require.Len(t, devices, 2)
+
+	require.NoError(t, m.handleDeviceRevoked(&protocoltypes.AccountDeviceRevoked{DevicePk: currentRaw, RevokedDevicePk: lostRaw}))
+	require.NoError(t, m.postHandlerModeration())
+	require.True(t, m.isDeviceRevoked(lostRaw))
+	require.Equal(t, uint64(1), m.getChainKeyEpoch())
+
+	devices, revoked = m.getActiveDevicesOfRevokedMember(member)
+	require.True(t, revoked)
+	require.Len(t, devices, 1)
+	require.True(t, devices[0].Equals(current.Device()))
+}
+
+func TestMetadataIndexGroupDeviceRegistered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, nil)(nil).(*metadataStoreIndex)
+
+	devicePK := newTestingAccountPK(t)
+	groupPK := newTestingAccountPK(t)
+
+	newRegistration := func() (*protocoltypes.AccountGroupDeviceRegistered, []byte) {
+		groupDevice, groupDevicePK := newTestingAccountKey(t)
+
+		sig, err := groupDevice.Sign(devicePK)
+		require.NoError(t, err)
+
+		return &protocoltypes.AccountGroupDeviceRegistered{
+			DevicePk:       devicePK,
+			GroupPk:        groupPK,
+			GroupDevicePk:  groupDevicePK,
+			GroupDeviceSig: sig,
+		}, groupDevicePK
+	}
+
+	previous, _ := newRegistration()
+	latest, latestPK := newRegistration()
+
+	// a group device key can't be registered by another device
+	forged, _ := newRegistration()
+	forged.DevicePk = newTestingAccountPK(t)
+	forged.GroupDevicePk = latestPK
+
+	// events are handled from the newest to the oldest
+	for _, evt := range []*protocoltypes.AccountGroupDeviceRegistered{forged, latest, previous} {
+		require.NoError(t, m.handleGroupDeviceRegistered(evt))
+	}
+
+	require.Equal(t, latestPK, m.getGroupDevice(groupPK, devicePK))
+	require.Nil(t, m.getGroupDevice(groupPK, forged.DevicePk))
+	require.Nil(t, m.getGroupDevice(devicePK, devicePK))
+}
+
+func TestMetadataIndexDeviceNames(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, nil)(nil).(*metadataStoreIndex)
+
+	devices := make([][]byte, 4)
+	for i := range devices {
+		md, _, deviceRaw := newTestingMemberDevice(t, member)
+		m.devices[string(deviceRaw)] = md
+		devices[i] = deviceRaw
+	}
+
+	chronologicalEvents := []*protocoltypes.AccountDeviceNameSet{
+		{DevicePk: devices[0], Name: "phone", Platform: "android", CreatedAt: 10},
+		{DevicePk: devices[1], Name: "laptop", Platform: "linux", CreatedAt: 20},
+		// the creation time is the one of the first name
+		{DevicePk: devices[1], Name: "work laptop", Platform: "linux", CreatedAt: 5},
+		// a device can't claim to have been created before the devices
+		// named before it
+		{DevicePk: devices[3], Name: "tablet", Platform: "ios", CreatedAt: 1},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		require.NoError(t, m.handleDeviceNameSet(chronologicalEvents[i]))
+	}
+
+	m.revokedDevices[string(devices[0])] = struct{}{}
+
+	laptop := &protocoltypes.DeviceInfo{DevicePk: devices[1], Name: "work laptop", Platform: "linux", CreatedAt: 20}
+	tablet := &protocoltypes.DeviceInfo{DevicePk: devices[3], Name: "tablet", Platform: "ios", CreatedAt: 20}
+	if bytes.Compare(devices[3], devices[1]) < 0 {
+		laptop, tablet = tablet, laptop
+	}
+
+	// devices without a name are listed first
+	require.Equal(t, []*protocoltypes.DeviceInfo{
+		{DevicePk: devices[2]},
+		{DevicePk: devices[0], Name: "phone", Platform: "android", CreatedAt: 10, Revoked: true},
+		laptop,
+		tablet,
+	}, m.listDeviceInfos())
+}
+
+func TestMetadataIndexSettings(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, nil)(nil).(*metadataStoreIndex)
+
+	deviceA, deviceB := []byte("device a"), []byte("device b")
+
+	events := []*protocoltypes.AccountSettingSet{
+		{DevicePk: deviceA, Key: "theme", Value: []byte("light"), UpdatedAt: 10},
+		{DevicePk: deviceB, Key: "theme", Value: []byte("dark"), UpdatedAt: 20},
+		{DevicePk: deviceA, Key: "notifications", Value: []byte("on"), UpdatedAt: 10},
+		{DevicePk: deviceA, Key: "language", Value: []byte("fr"), UpdatedAt: 10},
+		{DevicePk: deviceB, Key: "language", Value: []byte("en"), UpdatedAt: 10},
+		{DevicePk: deviceA, Key: "notifications", Deleted: true, UpdatedAt: 30},
+	}
+
+	// the last writer wins whatever the order of the events
+	for _, i := range []int{5, 0, 3, 1, 4, 2} {
+		require.NoError(t, m.handleSettingSet(events[i]))
+	}
+
+	require.Equal(t, []*protocoltypes.AccountSetting{
+		{Key: "language", Value: []byte("en"), UpdatedAt: 10, DevicePk: deviceB},
+		{Key: "theme", Value: []byte("dark"), UpdatedAt: 20, DevicePk: deviceB},
+	}, m.listSettings(nil, false))
+
+	require.Equal(t, []*protocoltypes.AccountSetting{
+		{Key: "notifications", UpdatedAt: 30, DevicePk: deviceA, Deleted: true},
+		{Key: "theme", Value: []byte("dark"), UpdatedAt: 20, DevicePk: deviceB},
+	}, m.listSettings([]string{"theme", "notifications", "unknown"}, true))
+}
+
+func TestMetadataIndexDeviceCapabilities(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberPK, err := member.Raw()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeMultiMember}, nil, nil)(nil).(*metadataStoreIndex)
+
+	devices := make([][]byte, 2)
+	for i := range devices {
+		md, _, deviceRaw := newTestingMemberDevice(t, member)
+		m.devices[string(deviceRaw)] = md
+		devices[i] = deviceRaw
+	}
+
+	if bytes.Compare(devices[0], devices[1]) > 0 {
+		devices[0], devices[1] = devices[1], devices[0]
+	}
+
+	pushOnly := &protocoltypes.DeviceCapabilities{Flags: uint64(protocoltypes.DeviceCapability_DeviceCapabilityPush)}
+	outOfStore := &protocoltypes.DeviceCapabilities{Flags: uint64(protocoltypes.DeviceCapability_DeviceCapabilityPush | protocoltypes.DeviceCapability_DeviceCapabilityOutOfStore), MaxPayloadSize: 1024}
+
+	// the most recent announce is kept whatever the order of the events
+	require.NoError(t, m.handleGroupDeviceCapabilitiesSet(&protocoltypes.GroupDeviceCapabilitiesSet{DevicePk: devices[0], Capabilities: outOfStore, UpdatedAt: 20}))
+	require.NoError(t, m.handleGroupDeviceCapabilitiesSet(&protocoltypes.GroupDeviceCapabilitiesSet{DevicePk: devices[0], Capabilities: pushOnly, UpdatedAt: 10}))
+	require.Equal(t, outOfStore, m.getDeviceCapabilities(devices[0]))
+	require.Nil(t, m.getDeviceCapabilities(devices[1]))
+
+	require.True(t, HasDeviceCapability(outOfStore, protocoltypes.DeviceCapability_DeviceCapabilityOutOfStore))
+	require.False(t, HasDeviceCapability(pushOnly, protocoltypes.DeviceCapability_DeviceCapabilityOutOfStore))
+	require.False(t, HasDeviceCapability(nil, protocoltypes.DeviceCapability_DeviceCapabilityPush))
+
+	require.Equal(t, []*protocoltypes.GroupDeviceCapabilities_Device{
+		{MemberPk: memberPK, DevicePk: devices[0], Capabilities: outOfStore},
+		{MemberPk: memberPK, DevicePk: devices[1], Capabilities: &protocoltypes.DeviceCapabilities{}},
+	}, m.listDeviceCapabilities())
+}
+
+func TestMetadataIndexMessagesAcknowledged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	memberPK, err := member.Raw()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeMultiMember}, nil, nil)(nil).(*metadataStoreIndex)
+
+	devices := make([][]byte, 3)
+	for i := range devices {
+		md, _, deviceRaw := newTestingMemberDevice(t, member)
+		m.devices[string(deviceRaw)] = md
+		devices[i] = deviceRaw
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return bytes.Compare(devices[i], devices[j]) < 0 })
+
+	require.NoError(t, m.handleGroupMessagesAcknowledged(&protocoltypes.GroupMessagesAcknowledged{DevicePk: devices[1], Cids: [][]byte{[]byte("message 1"), []byte("message 2")}}))
+	require.NoError(t, m.handleGroupMessagesAcknowledged(&protocoltypes.GroupMessagesAcknowledged{DevicePk: devices[2], Cids: [][]byte{[]byte("message 2")}}))
+	require.NoError(t, m.handleGroupMessagesRead(&protocoltypes.GroupMessagesRead{DevicePk: devices[1], Cids: [][]byte{[]byte("message 2")}}))
+	require.NoError(t, m.handleGroupMessagesRead(&protocoltypes.GroupMessagesRead{DevicePk: devices[2], Cids: [][]byte{[]byte("message 3")}}))
+
+	require.True(t, m.isMessageAcknowledged([]byte("message 1"), devices[1]))
+	require.False(t, m.isMessageAcknowledged([]byte("message 1"), devices[2]))
+
+	// the sender of the message is not listed
+	require.Equal(t, []*protocoltypes.MessageDeliveryStatus_Device{
+		{MemberPk: memberPK, DevicePk: devices[1], Acknowledged: true},
+		{MemberPk: memberPK, DevicePk: devices[2], Acknowledged: false},
+	}, m.listMessageDeliveryStatus([]byte("message 1"), devices[0]))
+
+	require.Equal(t, []*protocoltypes.MessageDeliveryStatus_Device{
+		{MemberPk: memberPK, DevicePk: devices[1], Acknowledged: true, Read: true},
+		{MemberPk: memberPK, DevicePk: devices[2], Acknowledged: true},
+	}, m.listMessageDeliveryStatus([]byte("message 2"), devices[0]))
+
+	// a read message is acknowledged
+	require.True(t, m.isMessageRead([]byte("message 3"), devices[2]))
+	require.Equal(t, []*protocoltypes.MessageDeliveryStatus_Device{
+		{MemberPk: memberPK, DevicePk: devices[1], Acknowledged: false},
+		{MemberPk: memberPK, DevicePk: devices[2], Acknowledged: true, Read: true},
+	}, m.listMessageDeliveryStatus([]byte("message 3"), devices[0]))
+
+	// the revoked devices and the devices of the removed members are left out
+	_, removedMember, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	removedMemberPK, err := removedMember.Raw()
+	require.NoError(t, err)
+
+	removedDevice, _, removedDeviceRaw := newTestingMemberDevice(t, removedMember)
+	m.devices[string(removedDeviceRaw)] = removedDevice
+	m.removedMembers[string(removedMemberPK)] = struct{}{}
+	m.revokedDevices[string(devices[2])] = struct{}{}
+
+	require.Equal(t, []*protocoltypes.MessageDeliveryStatus_Device{
+		{MemberPk: memberPK, DevicePk: devices[1], Acknowledged: false},
+	}, m.listMessageDeliveryStatus([]byte("message 3"), devices[0]))
+}
+
+func TestMetadataIndexDeviceKeyRotated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, nil)(nil).(*metadataStoreIndex)
+
+	previous, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	previousPK, err := previous.GetPublic().Raw()
+	require.NoError(t, err)
+
+	next, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	nextPK, err := next.GetPublic().Raw()
+	require.NoError(t, err)
+
+	sig, err := next.Sign(previousPK)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// the new key must sign the previous one
+	require.Error(t, m.handleGroupDeviceKeyRotated(&protocoltypes.GroupDeviceKeyRotated{DevicePk: previousPK, NewDevicePk: nextPK, NewDeviceSig: []byte("invalid"), RetiredAt: now.Unix()}))
+	require.False(t, m.isDeviceRetired(previousPK, now))
+
+	require.NoError(t, m.handleGroupDeviceKeyRotated(&protocoltypes.GroupDeviceKeyRotated{DevicePk: previousPK, NewDevicePk: nextPK, NewDeviceSig: sig, RetiredAt: now.Add(time.Hour).Unix()}))
+	require.False(t, m.isDeviceRetired(previousPK, now))
+	require.True(t, m.isDeviceRetired(previousPK, now.Add(time.Hour)))
+	require.False(t, m.isDeviceRetired(nextPK, now.Add(time.Hour)))
+
+	// the earliest retirement is kept
+	require.NoError(t, m.handleGroupDeviceKeyRotated(&protocoltypes.GroupDeviceKeyRotated{DevicePk: previousPK, NewDevicePk: nextPK, NewDeviceSig: sig, RetiredAt: now.Add(-time.Hour).Unix()}))
+	require.NoError(t, m.handleGroupDeviceKeyRotated(&protocoltypes.GroupDeviceKeyRotated{DevicePk: previousPK, NewDevicePk: nextPK, NewDeviceSig: sig, RetiredAt: now.Add(2 * time.Hour).Unix()}))
+	require.True(t, m.isDeviceRetired(previousPK, now))
+}
+
+func TestMetadataIndexPrimaryDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	first, _, firstRaw := newTestingMemberDevice(t, member)
+	second, _, secondRaw := newTestingMemberDevice(t, member)
+	third, _, thirdRaw := newTestingMemberDevice(t, member)
+	_, _, rotatedRaw := newTestingMemberDevice(t, member)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, first, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(firstRaw)] = first
+	m.devices[string(secondRaw)] = second
+	m.devices[string(thirdRaw)] = third
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.AccountPrimaryDeviceClaimed{DevicePk: firstRaw},
+		&protocoltypes.AccountReadReceiptsSet{DevicePk: firstRaw, Disabled: true},
+		// the role can only be claimed once
+		&protocoltypes.AccountPrimaryDeviceClaimed{DevicePk: secondRaw},
+		// secondary devices can't revoke devices nor change the policies
+		&protocoltypes.AccountDeviceRevoked{DevicePk: secondRaw, RevokedDevicePk: firstRaw},
+		&protocoltypes.AccountContactRequestDisabled{DevicePk: secondRaw},
+		&protocoltypes.AccountReadReceiptsSet{DevicePk: secondRaw, Disabled: false},
+		&protocoltypes.AccountPrimaryDeviceTransferProposed{DevicePk: secondRaw, NewPrimaryDevicePk: thirdRaw},
+		// the role must be proposed before being accepted
+		&protocoltypes.AccountPrimaryDeviceTransferAccepted{DevicePk: thirdRaw, PreviousPrimaryDevicePk: firstRaw},
+		&protocoltypes.AccountPrimaryDeviceTransferProposed{DevicePk: firstRaw, NewPrimaryDevicePk: secondRaw},
+		&protocoltypes.AccountPrimaryDeviceTransferAccepted{DevicePk: secondRaw, PreviousPrimaryDevicePk: firstRaw},
+		// the previous primary device is a secondary device
+		&protocoltypes.AccountDeviceRevoked{DevicePk: firstRaw, RevokedDevicePk: thirdRaw},
+		&protocoltypes.AccountDeviceRevoked{DevicePk: secondRaw, RevokedDevicePk: firstRaw},
+		// the role follows the key of the device
+		&protocoltypes.GroupDeviceKeyRotated{DevicePk: secondRaw, NewDevicePk: rotatedRaw},
+		&protocoltypes.AccountContactRequestEnabled{DevicePk: secondRaw},
+	}
+
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+
+	require.Equal(t, rotatedRaw, m.getPrimaryDevice())
+	require.Nil(t, m.getPrimaryTransfer())
+	require.True(t, m.isDeviceRevoked(firstRaw))
+	require.False(t, m.isDeviceRevoked(thirdRaw))
+	require.Nil(t, m.contactRequestEnabled)
+	require.True(t, m.areReadReceiptsDisabled())
+}
+
+func TestMetadataIndexPrimaryDeviceLinked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, member, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	first, _, firstRaw := newTestingMemberDevice(t, member)
+	second, _, secondRaw := newTestingMemberDevice(t, member)
+	stolen, _, stolenRaw := newTestingMemberDevice(t, member)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, first, nil)(nil).(*metadataStoreIndex)
+	m.devices[string(firstRaw)] = first
+	m.devices[string(secondRaw)] = second
+	m.devices[string(stolenRaw)] = stolen
+	m.firstDevice = firstRaw
+
+	chronologicalEvents := []proto.Message{
+		// the first device of the account is the primary device
+		&protocoltypes.AccountPrimaryDeviceClaimed{DevicePk: stolenRaw},
+		// only the primary device can link devices
+		&protocoltypes.AccountDeviceLinked{DevicePk: stolenRaw, LinkedDevicePk: stolenRaw},
+		&protocoltypes.AccountDeviceLinked{DevicePk: firstRaw, LinkedDevicePk: secondRaw},
+		// the role can't be transferred to a device which hasn't been linked
+		&protocoltypes.AccountPrimaryDeviceTransferProposed{DevicePk: firstRaw, NewPrimaryDevicePk: stolenRaw},
+		&protocoltypes.AccountPrimaryDeviceTransferAccepted{DevicePk: stolenRaw, PreviousPrimaryDevicePk: firstRaw},
+		&protocoltypes.AccountPrimaryDeviceTransferProposed{DevicePk: firstRaw, NewPrimaryDevicePk: secondRaw},
+		&protocoltypes.AccountPrimaryDeviceTransferAccepted{DevicePk: secondRaw, PreviousPrimaryDevicePk: firstRaw},
+	}
+
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+
+	require.Equal(t, secondRaw, m.getPrimaryDevice())
+	require.True(t, m.isDeviceLinked(firstRaw))
+	require.True(t, m.isDeviceLinked(secondRaw))
+	require.False(t, m.isDeviceLinked(stolenRaw))
+
+	// the first device is unknown once the beginning of the log is missing
+	m.truncated = true
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		m.eventsModeration = append(m.eventsModeration, chronologicalEvents[i])
+	}
+
+	require.NoError(t, m.postHandlerModeration())
+	require.Equal(t, stolenRaw, m.getPrimaryDevice())
+	require.True(t, m.isDeviceLinked(stolenRaw))
+}
+
+func TestMetadataIndexContactDeleted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	secretStore, err := secretstore.NewInMemSecretStore(nil)
+	require.NoError(t, err)
+
+	deleted, readded := newTestingAccountPK(t), newTestingAccountPK(t)
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, secretStore)(nil).(*metadataStoreIndex)
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.AccountContactVerified{ContactPk: deleted, Fingerprint: []byte("fingerprint")},
+		&protocoltypes.AccountContactVerified{ContactPk: readded, Fingerprint: []byte("previous")},
+		&protocoltypes.AccountContactDeleted{ContactPk: deleted},
+		&protocoltypes.AccountContactDeleted{ContactPk: readded},
+		&protocoltypes.AccountContactRequestIncomingAccepted{ContactPk: readded},
+		&protocoltypes.AccountContactVerified{ContactPk: readded, Fingerprint: []byte("current")},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		switch evt := chronologicalEvents[i].(type) {
+		case *protocoltypes.AccountContactVerified:
+			require.NoError(t, m.handleContactVerified(evt))
+		case *protocoltypes.AccountContactDeleted:
+			require.NoError(t, m.handleContactDeleted(evt))
+		case *protocoltypes.AccountContactRequestIncomingAccepted:
+			require.NoError(t, m.handleContactRequestIncomingAccepted(evt))
+		}
+	}
+
+	require.Equal(t, protocoltypes.ContactState_ContactStateRemoved, m.contacts[string(deleted)].state)
+	require.Nil(t, m.getContactVerification(deleted))
+
+	require.Equal(t, protocoltypes.ContactState_ContactStateAdded, m.contacts[string(readded)].state)
+	require.Equal(t, []byte("current"), m.getContactVerification(readded))
+}
+
+func TestMetadataIndexContactMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newMetadataIndex(ctx, &protocoltypes.Group{GroupType: protocoltypes.GroupType_GroupTypeAccount}, nil, nil)(nil).(*metadataStoreIndex)
+
+	// the contact is already known, its deletion only discards its metadata
+	m.contacts["deleted"] = &AccountContact{state: protocoltypes.ContactState_ContactStateRemoved}
+
+	chronologicalEvents := []proto.Message{
+		&protocoltypes.AccountContactMetadataSet{ContactPk: []byte("contact"), Metadata: []byte("previous")},
+		&protocoltypes.AccountContactMetadataSet{ContactPk: []byte("contact"), Metadata: []byte("current")},
+		&protocoltypes.AccountContactMetadataSet{ContactPk: []byte("deleted"), Metadata: []byte("petname")},
+		&protocoltypes.AccountContactDeleted{ContactPk: []byte("deleted")},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		switch evt := chronologicalEvents[i].(type) {
+		case *protocoltypes.AccountContactMetadataSet:
+			require.NoError(t, m.handleContactMetadataSet(evt))
+		case *protocoltypes.AccountContactDeleted:
+			require.NoError(t, m.handleContactDeleted(evt))
+		}
+	}
+
+	require.Equal(t, []byte("current"), m.getContactMetadata([]byte("contact")))
+	require.Nil(t, m.getContactMetadata([]byte("deleted")))
+	require.Nil(t, m.getContactMetadata([]byte("unknown")))
+}
+
+func TestMetadataIndexReplicationServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _, err := NewGroupMultiMember()
+	require.NoError(t, err)
+
+	m := newMetadataIndex(ctx, g, nil, nil)(nil).(*metadataStoreIndex)
+
+	_, memberA, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	_, memberB, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	newDevice := func(member crypto.PubKey) []byte {
+		md, _, deviceRaw := newTestingMemberDevice(t, member)
+		m.devices[string(deviceRaw)] = md
+
+		return deviceRaw
+	}
+
+	deviceA1, deviceA2, deviceB := newDevice(memberA), newDevice(memberA), newDevice(memberB)
+
+	now := time.Now()
+
+	chronologicalEvents := []*protocoltypes.GroupReplicating{
+		// a legacy event was written without expiry, it never expires
+		{DevicePk: deviceA1, ReplicationServer: "legacy.example"},
+		{DevicePk: deviceA1, ReplicationServer: "a.example", UpdatedAt: 1},
+		{DevicePk: deviceB, ReplicationServer: "a.example", UpdatedAt: 2},
+		{DevicePk: deviceA1, ReplicationServer: "b.example", UpdatedAt: 3},
+		{DevicePk: deviceA1, ReplicationServer: "c.example", UpdatedAt: 4, ExpiresAt: now.Add(-time.Second).UnixNano()},
+		{DevicePk: deviceB, ReplicationServer: "d.example", UpdatedAt: 5, ExpiresAt: now.Add(time.Hour).UnixNano()},
+		// a member unregistering a server doesn't hide the registrations of
+		// the other members
+		{DevicePk: deviceA2, ReplicationServer: "a.example", UpdatedAt: 6, Unregistered: true},
+		// a device unregisters the registration of another device of the
+		// same member
+		{DevicePk: deviceA2, ReplicationServer: "b.example", UpdatedAt: 7, Unregistered: true},
+	}
+
+	// events are handled from the newest to the oldest
+	for i := len(chronologicalEvents) - 1; i >= 0; i-- {
+		require.NoError(t, m.handleGroupReplicating(chronologicalEvents[i]))
+	}
+
+	listServers := func(at time.Time) []string {
+		servers := []string{}
+		for _, e := range m.listReplicationServers(at) {
+			servers = append(servers, e.ReplicationServer)
+		}
+
+		return servers
+	}
+
+	require.Equal(t, []string{"a.example", "d.example", "legacy.example"}, listServers(now))
+	require.Equal(t, []string{"a.example", "legacy.example"}, listServers(now.Add(2*time.Hour)))
+
+	// registering the group again lists the server back
+	require.NoError(t, m.handleGroupReplicating(&protocoltypes.GroupReplicating{DevicePk: deviceA1, ReplicationServer: "b.example", UpdatedAt: 8}))
+	require.Equal(t, []string{"a.example", "b.example", "d.example", "legacy.example"}, listServers(now))
+
+	// a server registered by several members is listed once, with the
+	// registration expiring last
+	require.NoError(t, m.handleGroupReplicating(&protocoltypes.GroupReplicating{DevicePk: deviceA1, ReplicationServer: "d.example", UpdatedAt: 9, ExpiresAt: now.Add(3 * time.Hour).UnixNano()}))
+	require.Equal(t, []string{"a.example", "b.example", "d.example", "legacy.example"}, listServers(now))
+
+	servers := m.listReplicationServers(now.Add(2 * time.Hour))
+	require.Len(t, servers, 4)
+	require.Equal(t, "d.example", servers[2].ReplicationServer)
+	require.Equal(t, deviceA1, servers[2].DevicePk)
+
+	// the members unregistering a legacy registration remove it
+	require.NoError(t, m.handleGroupReplicating(&protocoltypes.GroupReplicating{DevicePk: deviceA2, ReplicationServer: "legacy.example", UpdatedAt: 10, Unregistered: true}))
+	require.Equal(t, []string{"a.example", "b.example", "d.example"}, listServers(now))
+}
@@ -50,6 +50,20 @@ func getEntriesInRange(entries []ipliface.IPFSLogEntry, since, until []byte) ([]
 	return entries[startIndex : stopIndex+1], nil
 }
 
+// excludeRangeBounds removes the since and until entries from a range
+// returned by getEntriesInRange
+func excludeRangeBounds(entries []ipliface.IPFSLogEntry, since, until []byte) []ipliface.IPFSLogEntry {
+	if since != nil && len(entries) > 0 && bytes.Equal(entries[0].GetHash().Bytes(), since) {
+		entries = entries[1:]
+	}
+
+	if until != nil && len(entries) > 0 && bytes.Equal(entries[len(entries)-1].GetHash().Bytes(), until) {
+		entries = entries[:len(entries)-1]
+	}
+
+	return entries
+}
+
 func iterateOverEntries(entries []ipliface.IPFSLogEntry, reverse bool, f func(ipliface.IPFSLogEntry)) {
 	if reverse {
 		for i := len(entries) - 1; i > -1; i-- {
@@ -0,0 +1,53 @@
+package weshnet
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+
+	"berty.tech/weshnet/v2/pkg/errcode"
+)
+
+// TLSPins maps a server host name to the base64 encoded SHA-256 hashes of
+// the SubjectPublicKeyInfo it is allowed to present, connections to a pinned
+// host are refused if none of the certificates in its chain matches a pin.
+// Hosts without pins are verified using the system roots only.
+type TLSPins map[string][]string
+
+// SPKIHash returns the pin value to use for the given certificate
+func SPKIHash(rawSubjectPublicKeyInfo []byte) string {
+	sum := sha256.Sum256(rawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (p TLSPins) verifyConnection(cs tls.ConnectionState) error {
+	pins := p[cs.ServerName]
+	if len(pins) == 0 {
+		return nil
+	}
+
+	for _, cert := range cs.PeerCertificates {
+		hash := SPKIHash(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if pin == hash {
+				return nil
+			}
+		}
+	}
+
+	return errcode.ErrCode_ErrCryptoSignatureVerification.Wrap(fmt.Errorf("no certificate matching the pinned public keys for %s", cs.ServerName))
+}
+
+// tlsConfig returns a TLS client configuration enforcing the pins
+func (p TLSPins) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(p) > 0 {
+		config.VerifyConnection = p.verifyConnection
+	}
+
+	return config
+}
@@ -0,0 +1,39 @@
+package weshnet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSPinsVerifyConnection(t *testing.T) {
+	pinned := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("pinned key")}
+	other := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("other key")}
+
+	pins := TLSPins{
+		"replication.example.com": {SPKIHash(pinned.RawSubjectPublicKeyInfo)},
+	}
+
+	// leaf or intermediate matching the pin
+	require.NoError(t, pins.verifyConnection(tls.ConnectionState{
+		ServerName:       "replication.example.com",
+		PeerCertificates: []*x509.Certificate{other, pinned},
+	}))
+
+	// no matching certificate
+	require.Error(t, pins.verifyConnection(tls.ConnectionState{
+		ServerName:       "replication.example.com",
+		PeerCertificates: []*x509.Certificate{other},
+	}))
+
+	// host without pins
+	require.NoError(t, pins.verifyConnection(tls.ConnectionState{
+		ServerName:       "other.example.com",
+		PeerCertificates: []*x509.Certificate{other},
+	}))
+
+	require.Nil(t, TLSPins(nil).tlsConfig().VerifyConnection)
+	require.NotNil(t, pins.tlsConfig().VerifyConnection)
+}
@@ -0,0 +1,102 @@
+// datastore-migrate copies the datastore of a node to another storage driver.
+// The node must be stopped during the migration.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"berty.tech/weshnet/v2/pkg/storage"
+)
+
+func driverForName(name string) (storage.Driver, error) {
+	switch name {
+	case storage.DriverBadger:
+		return storage.Badger(nil), nil
+	case storage.DriverLevelDB:
+		return storage.LevelDB(nil), nil
+	case storage.DriverSQLite:
+		return storage.SQLite(""), nil
+	default:
+		return nil, fmt.Errorf("unknown driver %q, possible values: '%s', '%s' or '%s'", name, storage.DriverBadger, storage.DriverLevelDB, storage.DriverSQLite)
+	}
+}
+
+func run(ctx context.Context, dir, to string, compact bool) error {
+	from, err := storage.RecordedDriver(dir)
+	if err != nil {
+		return err
+	}
+
+	if from == "" {
+		return fmt.Errorf("no datastore found in %s", dir)
+	}
+
+	fromDriver, err := driverForName(from)
+	if err != nil {
+		return err
+	}
+
+	toDriver, err := driverForName(to)
+	if err != nil {
+		return err
+	}
+
+	count, err := storage.MigrateDirectory(ctx, dir, fromDriver, toDriver)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d entries copied from %s to %s\n", count, from, to)
+
+	if !compact {
+		return nil
+	}
+
+	datastore, err := storage.Open(dir, toDriver)
+	if err != nil {
+		return err
+	}
+	defer datastore.Close()
+
+	reclaimed, err := storage.Compact(ctx, datastore)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d bytes reclaimed\n", reclaimed)
+
+	return nil
+}
+
+func main() {
+	fs := flag.NewFlagSet("datastore-migrate", flag.ExitOnError)
+	dir := fs.String("dir", "", "datastore directory of the node")
+	to := fs.String("to", "", fmt.Sprintf("driver to migrate to, possible values: '%s', '%s' or '%s'", storage.DriverBadger, storage.DriverLevelDB, storage.DriverSQLite))
+	compact := fs.Bool("compact", false, "compact the datastore once migrated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: datastore-migrate -dir <dir> -to <driver> [flags]\n\n")
+		fmt.Fprintf(fs.Output(), "The files of the previous driver are deleted once the migration succeeded.\n\n")
+		fs.PrintDefaults()
+	}
+
+	_ = fs.Parse(os.Args[1:])
+
+	if *dir == "" || *to == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if err := run(ctx, *dir, *to, *compact); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}